@@ -0,0 +1,145 @@
+package icapclient
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AccessLogConfig represents the per-transaction access log settings
+type AccessLogConfig struct {
+	Path       string `yaml:"path" json:"path"`
+	MaxSizeMB  int    `yaml:"max_size_mb" json:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups" json:"max_backups"`
+	MaxAgeDays int    `yaml:"max_age_days" json:"max_age_days"`
+	Compress   bool   `yaml:"compress" json:"compress"`
+}
+
+// AccessLogEntry is one line of the access log, describing an ICAP transaction
+type AccessLogEntry struct {
+	Timestamp     time.Time `json:"timestamp"`
+	RequestID     string    `json:"request_id,omitempty"`
+	Method        string    `json:"method"`
+	Service       string    `json:"service"`
+	URI           string    `json:"uri,omitempty"`
+	Status        int       `json:"status"`
+	Verdict       string    `json:"verdict"`
+	RequestBytes  int       `json:"request_bytes"`
+	ResponseBytes int       `json:"response_bytes"`
+	DurationMs    float64   `json:"duration_ms"`
+	Retries       int       `json:"retries"`
+	Error         string    `json:"error,omitempty"`
+	// ContentHashes are the hashes of the body, when content_hash or
+	// scan_cache is enabled
+	ContentHashes ContentHashes `json:"content_hashes,omitempty"`
+	// Cached reports a verdict answered from the scan cache, and KnownClean
+	// one answered from the clean filter
+	Cached     bool `json:"cached,omitempty"`
+	KnownClean bool `json:"known_clean,omitempty"`
+	// Changes reports what the server changed in the message, when it
+	// changed anything
+	Changes *AdaptationReport `json:"changes,omitempty"`
+	// Policy is the decision of the client policy on a message it bypassed
+	// or blocked
+	Policy *PolicyDecision `json:"policy,omitempty"`
+}
+
+// accessLogger writes access log entries as JSON lines, one per transaction
+type accessLogger struct {
+	mu     sync.Mutex
+	writer io.WriteCloser
+}
+
+// newAccessLogger creates an access logger, or returns nil if no path is configured
+func newAccessLogger(config *AccessLogConfig) *accessLogger {
+	if config.Path == "" {
+		return nil
+	}
+
+	return &accessLogger{
+		writer: &lumberjack.Logger{
+			Filename:   config.Path,
+			MaxSize:    config.MaxSizeMB,
+			MaxBackups: config.MaxBackups,
+			MaxAge:     config.MaxAgeDays,
+			Compress:   config.Compress,
+		},
+	}
+}
+
+// Log writes an entry to the access log
+func (l *accessLogger) Log(entry *AccessLogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.writer.Write(line)
+	return err
+}
+
+// Close closes the underlying log file
+func (l *accessLogger) Close() error {
+	return l.writer.Close()
+}
+
+// accessLogVerdict summarizes the outcome of a transaction for the access log
+func accessLogVerdict(statusCode int, err error) string {
+	switch {
+	case err != nil || statusCode >= 400:
+		return "error"
+	case statusCode == int(NoContent):
+		return "allowed"
+	default:
+		return "modified"
+	}
+}
+
+// logAccess records a completed ICAP transaction in the access log
+func (c *IcapClient) logAccess(method IcapMethod, icapURL string, requestID string, httpData interface{}, hashes ContentHashes, response *IcapResponse, requestBytes int, responseBytes int, duration time.Duration, attempts int, err error) {
+	if c.accessLog == nil {
+		return
+	}
+
+	entry := &AccessLogEntry{
+		Timestamp:     time.Now().UTC(),
+		RequestID:     requestID,
+		Method:        string(method),
+		Service:       icapURL,
+		RequestBytes:  requestBytes,
+		ResponseBytes: responseBytes,
+		DurationMs:    float64(duration.Microseconds()) / 1000,
+		Retries:       max(attempts-1, 0),
+		ContentHashes: hashes,
+	}
+	if u, parseErr := url.Parse(icapURL); parseErr == nil {
+		entry.Service = u.Path
+	}
+	if request, ok := httpData.(*HttpRequest); ok {
+		entry.URI = request.URI
+	}
+	if response != nil {
+		entry.Status = response.StatusCode
+		entry.Cached = response.FromCache
+		entry.KnownClean = response.KnownClean
+		entry.Policy = response.Policy
+		if response.Changes.Changed() {
+			entry.Changes = response.Changes
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	entry.Verdict = accessLogVerdict(entry.Status, err)
+
+	if logErr := c.accessLog.Log(entry); logErr != nil {
+		c.logger.Warn("Failed to write access log", "error", logErr)
+	}
+}
@@ -0,0 +1,80 @@
+package icapclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestAccessLogVerdict tests verdict summaries
+func TestAccessLogVerdict(t *testing.T) {
+	tests := []struct {
+		status   int
+		err      error
+		expected string
+	}{
+		{204, nil, "allowed"},
+		{200, nil, "modified"},
+		{403, nil, "error"},
+		{0, errors.New("connection refused"), "error"},
+	}
+
+	for _, tt := range tests {
+		if verdict := accessLogVerdict(tt.status, tt.err); verdict != tt.expected {
+			t.Errorf("Expected verdict %s for %d/%v, got %s", tt.expected, tt.status, tt.err, verdict)
+		}
+	}
+}
+
+// TestIcapClient_AccessLog tests that each transaction writes one access log line
+func TestIcapClient_AccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	client := NewIcapClient(&IcapConfig{
+		Host:         "127.0.0.1",
+		Port:         1344,
+		Timeout:      time.Second,
+		Retries:      1,
+		LoggingLevel: "ERROR",
+		AccessLog:    AccessLogConfig{Path: path, MaxSizeMB: 1},
+	})
+
+	client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "http://example.com/", Version: "HTTP/1.1"})
+	client.Options(context.Background())
+	client.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open access log: %v", err)
+	}
+	defer file.Close()
+
+	var entries []AccessLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AccessLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Invalid access log line %s: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 access log entries, got %d", len(entries))
+	}
+
+	reqmod := entries[0]
+	if reqmod.Method != "REQMOD" || reqmod.Service != "/reqmod" || reqmod.URI != "http://example.com/" {
+		t.Errorf("Unexpected REQMOD entry: %+v", reqmod)
+	}
+	if reqmod.Retries != 1 || reqmod.Verdict != "error" || reqmod.Error == "" || reqmod.RequestBytes == 0 {
+		t.Errorf("Expected failed REQMOD with one retry, got %+v", reqmod)
+	}
+	if entries[1].Method != "OPTIONS" || entries[1].URI != "" {
+		t.Errorf("Unexpected OPTIONS entry: %+v", entries[1])
+	}
+}
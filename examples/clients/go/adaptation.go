@@ -0,0 +1,153 @@
+package icapclient
+
+import (
+	"io"
+	"net/http"
+	"sort"
+)
+
+// AdaptationReport describes what the ICAP server changed in the
+// encapsulated message, so audit logs can record modifications precisely
+type AdaptationReport struct {
+	// Replaced reports a REQMOD request answered with an HTTP response,
+	// typically a block page, rather than adapted. Headers are then not
+	// compared.
+	Replaced bool `yaml:"replaced,omitempty" json:"replaced,omitempty"`
+	// Method and URI are set when the server rewrote those of a request
+	Method *ValueChange `yaml:"method,omitempty" json:"method,omitempty"`
+	URI    *ValueChange `yaml:"uri,omitempty" json:"uri,omitempty"`
+	// Status is set when the status of a response changed, or from 0 when
+	// a request was replaced
+	Status *StatusChange `yaml:"status,omitempty" json:"status,omitempty"`
+
+	HeadersAdded    []HeaderChange `yaml:"headers_added,omitempty" json:"headers_added,omitempty"`
+	HeadersRemoved  []HeaderChange `yaml:"headers_removed,omitempty" json:"headers_removed,omitempty"`
+	HeadersModified []HeaderChange `yaml:"headers_modified,omitempty" json:"headers_modified,omitempty"`
+
+	// OriginalBodySize and BodySize are the lengths of the body sent and of
+	// the adapted body, BodySize being -1 when the adapted body is streamed
+	// from a reader of unknown length
+	OriginalBodySize int64 `yaml:"original_body_size" json:"original_body_size"`
+	BodySize         int64 `yaml:"body_size" json:"body_size"`
+	// BodyDelta is BodySize minus OriginalBodySize, or 0 when BodySize is
+	// unknown
+	BodyDelta int64 `yaml:"body_delta" json:"body_delta"`
+}
+
+// ValueChange is a value rewritten by the server
+type ValueChange struct {
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+}
+
+// StatusChange is an HTTP status rewritten by the server
+type StatusChange struct {
+	From int `yaml:"from" json:"from"`
+	To   int `yaml:"to" json:"to"`
+}
+
+// HeaderChange is a header added, removed or modified by the server, From
+// being empty when added and To when removed
+type HeaderChange struct {
+	Name string `yaml:"name" json:"name"`
+	From string `yaml:"from,omitempty" json:"from,omitempty"`
+	To   string `yaml:"to,omitempty" json:"to,omitempty"`
+}
+
+// Changed reports whether the server changed anything in the message
+func (r *AdaptationReport) Changed() bool {
+	return r != nil && (r.Replaced || r.Method != nil || r.URI != nil || r.Status != nil ||
+		len(r.HeadersAdded) > 0 || len(r.HeadersRemoved) > 0 || len(r.HeadersModified) > 0 ||
+		r.BodyDelta != 0)
+}
+
+// adaptationReport compares the adapted message of response with httpData,
+// whose body is originalSize bytes long, or returns nil if the server sent
+// no adapted message
+func adaptationReport(httpData interface{}, originalSize int64, response *IcapResponse) *AdaptationReport {
+	report := &AdaptationReport{OriginalBodySize: originalSize}
+	switch original := httpData.(type) {
+	case *HttpRequest:
+		switch {
+		case response.HttpResponse != nil:
+			report.Replaced = true
+			report.Status = &StatusChange{To: response.HttpResponse.StatusCode}
+			report.BodySize = bodyLength(response.HttpResponse.Body, response.HttpResponse.BodyReader)
+		case response.HttpRequest != nil:
+			adapted := response.HttpRequest
+			if adapted.Method != original.Method {
+				report.Method = &ValueChange{From: original.Method, To: adapted.Method}
+			}
+			if adapted.URI != original.URI {
+				report.URI = &ValueChange{From: original.URI, To: adapted.URI}
+			}
+			report.compareHeaders(original.Headers, adapted.Headers)
+			report.BodySize = bodyLength(adapted.Body, adapted.BodyReader)
+		default:
+			return nil
+		}
+	case *HttpResponse:
+		adapted := response.HttpResponse
+		if adapted == nil {
+			return nil
+		}
+		if adapted.StatusCode != original.StatusCode {
+			report.Status = &StatusChange{From: original.StatusCode, To: adapted.StatusCode}
+		}
+		report.compareHeaders(original.Headers, adapted.Headers)
+		report.BodySize = bodyLength(adapted.Body, adapted.BodyReader)
+	default:
+		return nil
+	}
+	if report.BodySize >= 0 {
+		report.BodyDelta = report.BodySize - report.OriginalBodySize
+	}
+	return report
+}
+
+// compareHeaders records the headers added, removed and modified from
+// original to adapted, by canonical name
+func (r *AdaptationReport) compareHeaders(original, adapted map[string]string) {
+	before := canonicalHeaders(original)
+	after := canonicalHeaders(adapted)
+	for name, to := range after {
+		from, ok := before[name]
+		switch {
+		case !ok:
+			r.HeadersAdded = append(r.HeadersAdded, HeaderChange{Name: name, To: to})
+		case from != to:
+			r.HeadersModified = append(r.HeadersModified, HeaderChange{Name: name, From: from, To: to})
+		}
+	}
+	for name, from := range before {
+		if _, ok := after[name]; !ok {
+			r.HeadersRemoved = append(r.HeadersRemoved, HeaderChange{Name: name, From: from})
+		}
+	}
+	for _, changes := range [][]HeaderChange{r.HeadersAdded, r.HeadersRemoved, r.HeadersModified} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+}
+
+// canonicalHeaders returns headers keyed by canonical name
+func canonicalHeaders(headers map[string]string) map[string]string {
+	canonical := make(map[string]string, len(headers))
+	for name, value := range headers {
+		canonical[http.CanonicalHeaderKey(name)] = value
+	}
+	return canonical
+}
+
+// bodyLength returns the length of a body held in memory or spooled to
+// disk, or -1 for other readers
+func bodyLength(body []byte, reader io.Reader) int64 {
+	if reader == nil {
+		return int64(len(body))
+	}
+	if spooled, ok := reader.(*spoolFile); ok {
+		if info, err := spooled.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return -1
+}
@@ -0,0 +1,91 @@
+package icapclient
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestAdaptationReport tests comparing adapted messages with the originals
+func TestAdaptationReport(t *testing.T) {
+	request := &HttpRequest{
+		Method: "POST", URI: "/upload", Version: "HTTP/1.1",
+		Headers: map[string]string{"host": "example.com", "Cookie": "a=1", "X-Trace": "1"},
+		Body:    []byte("secret data"),
+	}
+
+	report := adaptationReport(request, 11, &IcapResponse{StatusCode: 200, HttpRequest: &HttpRequest{
+		Method: "POST", URI: "/upload?redacted=1", Version: "HTTP/1.1",
+		Headers: map[string]string{"Host": "example.com", "X-Trace": "2", "X-Redacted": "true"},
+		Body:    []byte("[redacted]"),
+	}})
+	expected := &AdaptationReport{
+		URI:              &ValueChange{From: "/upload", To: "/upload?redacted=1"},
+		HeadersAdded:     []HeaderChange{{Name: "X-Redacted", To: "true"}},
+		HeadersRemoved:   []HeaderChange{{Name: "Cookie", From: "a=1"}},
+		HeadersModified:  []HeaderChange{{Name: "X-Trace", From: "1", To: "2"}},
+		OriginalBodySize: 11,
+		BodySize:         10,
+		BodyDelta:        -1,
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, report)
+	}
+	if !report.Changed() {
+		t.Errorf("Expected the report to show changes")
+	}
+
+	report = adaptationReport(request, 11, &IcapResponse{StatusCode: 200, HttpResponse: &HttpResponse{StatusCode: 403, Body: []byte("blocked")}})
+	if !report.Replaced || report.Status == nil || report.Status.To != 403 || report.BodyDelta != -4 || report.HeadersAdded != nil {
+		t.Errorf("Expected a replaced request with a 403 of 7 bytes, got %+v", report)
+	}
+
+	response := &HttpResponse{StatusCode: 200, Headers: map[string]string{"Content-Type": "text/html"}, Body: []byte("page")}
+	report = adaptationReport(response, 4, &IcapResponse{StatusCode: 200, HttpResponse: &HttpResponse{
+		StatusCode: 200, Headers: map[string]string{"content-type": "text/html"}, Body: []byte("page"),
+	}})
+	if report == nil || report.Changed() {
+		t.Errorf("Expected an unchanged response, got %+v", report)
+	}
+
+	if report := adaptationReport(response, 4, &IcapResponse{StatusCode: 204}); report != nil {
+		t.Errorf("Expected no report without an adapted message, got %+v", report)
+	}
+}
+
+// TestIcapClient_AdaptationReport tests attaching the report to responses
+func TestIcapClient_AdaptationReport(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		header := http.Header{"Content-Type": {"text/plain"}, "X-Scanned": {"yes"}}
+		w.WriteHeader(200, &http.Response{StatusCode: 451, Proto: "HTTP/1.1", Header: header}, true)
+		w.Write([]byte("removed"))
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	response, err := client.Respmod(context.Background(), &HttpResponse{
+		Version: "HTTP/1.1", StatusCode: 200, Reason: "OK",
+		Headers: map[string]string{"Content-Type": "text/plain"}, Body: []byte("malicious payload"),
+	})
+	if err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+	changes := response.Changes
+	if changes == nil {
+		t.Fatalf("Expected an adaptation report")
+	}
+	if changes.Status == nil || changes.Status.From != 200 || changes.Status.To != 451 {
+		t.Errorf("Expected a status change from 200 to 451, got %+v", changes.Status)
+	}
+	if len(changes.HeadersAdded) != 1 || changes.HeadersAdded[0].Name != "X-Scanned" {
+		t.Errorf("Expected X-Scanned to be added, got %+v", changes.HeadersAdded)
+	}
+	if changes.OriginalBodySize != 17 || changes.BodySize != 7 || changes.BodyDelta != -10 {
+		t.Errorf("Expected the body to shrink from 17 to 7 bytes, got %+v", changes)
+	}
+}
@@ -0,0 +1,61 @@
+package icapclient
+
+import (
+	"slices"
+	"strings"
+)
+
+// Capabilities advertised to the server in the Allow header
+const (
+	// AllowNoContent lets the server answer 204 No Content when the message
+	// is unmodified. Without it the server returns the whole message, which
+	// callers streaming a body they cannot read again rely on.
+	AllowNoContent = "204"
+	// AllowPartialContent lets the server answer 206 Partial Content,
+	// returning the start of the body and the offset of the original to
+	// continue from
+	AllowPartialContent = "206"
+	// AllowTrailers lets the server send trailers after the terminal chunk
+	// of encapsulated bodies
+	AllowTrailers = "trailers"
+	// AllowNone advertises nothing and omits the Allow header
+	AllowNone = "none"
+)
+
+// defaultAllow are the capabilities advertised when none are configured
+var defaultAllow = []string{AllowNoContent, AllowPartialContent}
+
+// allowHeader returns the Allow header advertising capabilities, the
+// defaults if nil, or "" to omit it. Unknown capabilities are ignored.
+func allowHeader(capabilities []string) string {
+	if capabilities == nil {
+		capabilities = defaultAllow
+	}
+	var allowed []string
+	for _, capability := range capabilities {
+		capability = strings.ToLower(strings.TrimSpace(capability))
+		if validCapability(capability) && capability != AllowNone && !slices.Contains(allowed, capability) {
+			allowed = append(allowed, capability)
+		}
+	}
+	return strings.Join(allowed, ", ")
+}
+
+// validCapability reports whether capability can be advertised in Allow
+func validCapability(capability string) bool {
+	switch strings.ToLower(strings.TrimSpace(capability)) {
+	case AllowNoContent, AllowPartialContent, AllowTrailers, AllowNone:
+		return true
+	}
+	return false
+}
+
+// setAllow sets the Allow header of headers for capabilities, removing it
+// when nothing is advertised
+func setAllow(headers map[string]string, capabilities []string) {
+	if allow := allowHeader(capabilities); allow != "" {
+		headers["Allow"] = allow
+	} else {
+		delete(headers, "Allow")
+	}
+}
@@ -0,0 +1,74 @@
+package icapclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestAllowHeader tests the Allow header advertised for capabilities
+func TestAllowHeader(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities []string
+		expected     string
+	}{
+		{"default", nil, "204, 206"},
+		{"empty", []string{}, ""},
+		{"none", []string{"none"}, ""},
+		{"no content only", []string{"204"}, "204"},
+		{"trailers", []string{"204", "206", "Trailers"}, "204, 206, trailers"},
+		{"duplicates", []string{"206", " 206", "204"}, "206, 204"},
+		{"unknown", []string{"preview", "204"}, "204"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allow := allowHeader(tt.capabilities); allow != tt.expected {
+				t.Errorf("Expected Allow %q, got %q", tt.expected, allow)
+			}
+		})
+	}
+}
+
+// TestIcapClient_Allow tests advertising the configured capabilities and
+// overriding them per request
+func TestIcapClient_Allow(t *testing.T) {
+	headers := make(chan icaptest.Header, 1)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		headers <- r.Header
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	for _, tt := range []struct {
+		name     string
+		allow    []string
+		override []string
+		expected string
+	}{
+		{"default", nil, nil, "204, 206"},
+		{"configured", []string{"204", "trailers"}, nil, "204, trailers"},
+		{"per request", []string{"204", "trailers"}, []string{"206"}, "206"},
+		{"omitted per request", nil, []string{AllowNone}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client.config.Load().Allow = tt.allow
+			ctx := WithRequestOptions(context.Background(), RequestOptions{Allow: tt.override})
+			_, err := client.Reqmod(ctx, &HttpRequest{
+				Method: "POST", URI: "/upload", Version: "HTTP/1.1", Headers: map[string]string{}, Body: []byte("body"),
+			})
+			if err != nil {
+				t.Fatalf("REQMOD failed: %v", err)
+			}
+			received, ok := (<-headers)["Allow"]
+			if received != tt.expected || ok != (tt.expected != "") {
+				t.Errorf("Expected Allow %q, got %q", tt.expected, received)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package icapclient
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backendDownJitter is the fraction by which the backend_down_ttl of each
+// failure is randomly shortened or lengthened, so that clients sharing a
+// server do not all probe it at once
+const backendDownJitter = 0.2
+
+// ErrBackendDown reports a request failed without dialing, the ICAP server
+// having refused or timed out a connect within backend_down_ttl
+var ErrBackendDown = errors.New("ICAP server down")
+
+// BackendDownError is the ErrBackendDown of a request, with the connect
+// failure that marked the server down and when it is next tried
+type BackendDownError struct {
+	Until time.Time
+	Err   error
+}
+
+func (e *BackendDownError) Error() string {
+	return fmt.Sprintf("%v until %s after connect failure: %v", ErrBackendDown, e.Until.Format(time.RFC3339Nano), e.Err)
+}
+
+func (e *BackendDownError) Is(target error) bool {
+	return target == ErrBackendDown
+}
+
+func (e *BackendDownError) Unwrap() error {
+	return e.Err
+}
+
+// backendState remembers connect failures for backend_down_ttl, during
+// which dials fail at once. Once it expires a single dial probes the
+// server while the others keep failing, until it connects or fails again.
+type backendState struct {
+	// ttl is the time.Duration of backend_down_ttl, changed by config
+	// reloads
+	ttl atomic.Int64
+	now func() time.Time
+
+	mu        sync.Mutex
+	downUntil time.Time
+	lastErr   error
+	probing   bool
+	rand      *rand.Rand
+}
+
+// newBackendState creates the state of a server known to be up
+func newBackendState() *backendState {
+	return &backendState{now: time.Now, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// allow returns a *BackendDownError while the server is marked down, and
+// nil when a dial may proceed
+func (s *backendState) allow() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.downUntil.IsZero() {
+		return nil
+	}
+	if s.now().Before(s.downUntil) || s.probing {
+		return &BackendDownError{Until: s.downUntil, Err: s.lastErr}
+	}
+	s.probing = true
+	return nil
+}
+
+// result records the outcome of a dial allowed by allow, marking the
+// server down for backend_down_ttl, jittered, if it failed
+func (s *backendState) result(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probing = false
+	ttl := time.Duration(s.ttl.Load())
+	if err == nil || ttl <= 0 {
+		s.downUntil, s.lastErr = time.Time{}, nil
+		return
+	}
+
+	jitter := 1 + backendDownJitter*(2*s.rand.Float64()-1)
+	s.downUntil = s.now().Add(time.Duration(float64(ttl) * jitter))
+	s.lastErr = err
+}
+
+// abort records a dial allowed by allow that was canceled by its caller,
+// telling nothing about the server
+func (s *backendState) abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probing = false
+}
+
+// setTTL sets backend_down_ttl, marking the server up when disabled
+func (s *backendState) setTTL(ttl time.Duration) {
+	s.ttl.Store(int64(ttl))
+	if ttl <= 0 {
+		s.mu.Lock()
+		s.downUntil, s.lastErr = time.Time{}, nil
+		s.mu.Unlock()
+	}
+}
+
+// down reports whether the server is marked down
+func (s *backendState) down() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.downUntil.IsZero()
+}
@@ -0,0 +1,90 @@
+package icapclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBackendState tests marking the server down, the jittered expiry and
+// the single probe after it
+func TestBackendState(t *testing.T) {
+	now := time.Unix(1000, 0)
+	state := newBackendState()
+	state.now = func() time.Time { return now }
+	state.setTTL(time.Second)
+
+	if err := state.allow(); err != nil {
+		t.Fatalf("Expected a dial to be allowed, got %v", err)
+	}
+	refused := errors.New("connection refused")
+	state.result(refused)
+
+	err := state.allow()
+	if !errors.Is(err, ErrBackendDown) || !errors.Is(err, refused) {
+		t.Fatalf("Expected ErrBackendDown wrapping the connect error, got %v", err)
+	}
+	var downErr *BackendDownError
+	if !errors.As(err, &downErr) {
+		t.Fatalf("Expected a *BackendDownError, got %T", err)
+	}
+	if ttl := downErr.Until.Sub(now); ttl < 800*time.Millisecond || ttl > 1200*time.Millisecond {
+		t.Errorf("Expected the TTL jittered within 20%%, got %s", ttl)
+	}
+
+	now = now.Add(2 * time.Second)
+	if err := state.allow(); err != nil {
+		t.Errorf("Expected a probe once expired, got %v", err)
+	}
+	if err := state.allow(); !errors.Is(err, ErrBackendDown) {
+		t.Errorf("Expected other dials to fail during the probe, got %v", err)
+	}
+	state.result(nil)
+	if state.down() {
+		t.Errorf("Expected a successful probe to mark the server up")
+	}
+	if err := state.allow(); err != nil {
+		t.Errorf("Expected dials to be allowed again, got %v", err)
+	}
+}
+
+// TestIcapClient_BackendDown tests failing requests without dialing while
+// the server is marked down
+func TestIcapClient_BackendDown(t *testing.T) {
+	var dials atomic.Int32
+	client := NewIcapClient(&IcapConfig{
+		Host: "127.0.0.1", Port: 1344, Timeout: 5 * time.Second, ConnectionPoolSize: 2, KeepAlive: true, LoggingLevel: "ERROR",
+		BackendDownTTL: time.Minute,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return nil, errors.New("connection refused")
+		},
+	})
+	defer client.Close()
+
+	request := &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}
+	_, err := client.Reqmod(context.Background(), request)
+	if err == nil || errors.Is(err, ErrBackendDown) {
+		t.Fatalf("Expected the connect error, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Reqmod(context.Background(), request); !errors.Is(err, ErrBackendDown) {
+			t.Errorf("Expected ErrBackendDown, got %v", err)
+		}
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("Expected 1 dial, got %d", n)
+	}
+
+	next := *client.config.Load()
+	next.BackendDownTTL = 0
+	client.Reload(&next)
+	client.Reqmod(context.Background(), request)
+	client.Reqmod(context.Background(), request)
+	if n := dials.Load(); n != 3 {
+		t.Errorf("Expected every request to dial when disabled, got %d dials", n)
+	}
+}
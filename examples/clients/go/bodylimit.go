@@ -0,0 +1,79 @@
+package icapclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrEntityTooLarge is wrapped by errors for bodies over max_body_size and
+// for 413 responses from the ICAP server
+var ErrEntityTooLarge = errors.New("entity too large")
+
+// Body limit actions for bodies exceeding max_body_size
+const (
+	// BodyLimitReject fails the request locally without contacting the server
+	BodyLimitReject = "reject"
+	// BodyLimitTruncate sends only the first max_body_size bytes of the body
+	BodyLimitTruncate = "truncate"
+)
+
+// applyBodyLimit enforces the max_body_size of config on an encapsulated HTTP message, or
+// on stream when the body is streamed. A truncated message is a copy whose
+// headers are left unchanged, so the Content-Length still tells the server
+// the original size.
+func (c *IcapClient) applyBodyLimit(config *IcapConfig, httpData interface{}, stream *bodyStream) (interface{}, error) {
+	limit := config.MaxBodySize
+	size := int64(len(httpBody(httpData)))
+	if stream != nil {
+		size = stream.size
+	}
+	if limit <= 0 || size <= limit {
+		return httpData, nil
+	}
+
+	if !strings.EqualFold(config.BodyLimitAction, BodyLimitTruncate) {
+		return nil, &IcapError{
+			Message: fmt.Sprintf("body of %d bytes exceeds max_body_size of %d bytes", size, limit),
+			Code:    int(RequestEntityTooLarge),
+			Err:     ErrEntityTooLarge,
+		}
+	}
+
+	c.logger.Warn("Truncating body over max_body_size", "size", size, "max_body_size", limit)
+	return truncateBody(httpData, stream, limit), nil
+}
+
+// truncateBody returns httpData with its body, or stream when the body is
+// streamed, cut to its first limit bytes, as a copy whose headers are left
+// unchanged
+func truncateBody(httpData interface{}, stream *bodyStream, limit int64) interface{} {
+	if stream != nil {
+		stream.size = min(stream.size, limit)
+		return httpData
+	}
+	switch data := httpData.(type) {
+	case *HttpRequest:
+		if int64(len(data.Body)) > limit {
+			truncated := *data
+			truncated.Body = data.Body[:limit:limit]
+			return &truncated
+		}
+	case *HttpResponse:
+		if int64(len(data.Body)) > limit {
+			truncated := *data
+			truncated.Body = data.Body[:limit:limit]
+			return &truncated
+		}
+	}
+	return httpData
+}
+
+// entityTooLargeError returns the error for a 413 response from the server
+func entityTooLargeError(response *IcapResponse) error {
+	return &IcapError{
+		Message: fmt.Sprintf("ICAP server rejected the body: %d %s", response.StatusCode, response.Reason),
+		Code:    response.StatusCode,
+		Err:     ErrEntityTooLarge,
+	}
+}
@@ -0,0 +1,137 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestIcapClient_applyBodyLimit tests the local max_body_size guard
+func TestIcapClient_applyBodyLimit(t *testing.T) {
+	body := []byte("0123456789")
+
+	tests := []struct {
+		name     string
+		limit    int64
+		action   string
+		wantBody string
+		wantErr  bool
+	}{
+		{"No limit", 0, "", "0123456789", false},
+		{"Within limit", 10, "", "0123456789", false},
+		{"Reject by default", 4, "", "", true},
+		{"Reject", 4, BodyLimitReject, "", true},
+		{"Truncate", 4, BodyLimitTruncate, "0123", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewIcapClient(&IcapConfig{LoggingLevel: "ERROR", MaxBodySize: tt.limit, BodyLimitAction: tt.action})
+			defer client.Close()
+
+			original := &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: body}
+			limited, err := client.applyBodyLimit(client.config.Load(), original, nil)
+			if tt.wantErr {
+				if !errors.Is(err, ErrEntityTooLarge) {
+					t.Errorf("Expected ErrEntityTooLarge, got %v", err)
+				}
+				var icapErr *IcapError
+				if errors.As(err, &icapErr) && icapErr.Code != 413 {
+					t.Errorf("Expected code 413, got %d", icapErr.Code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got := string(httpBody(limited)); got != tt.wantBody {
+				t.Errorf("Expected body %q, got %q", tt.wantBody, got)
+			}
+			if string(original.Body) != "0123456789" {
+				t.Errorf("Expected original body to be unchanged, got %q", original.Body)
+			}
+		})
+	}
+}
+
+// TestIcapClient_BodyLimitAgainstServer tests that rejected bodies are not
+// sent, truncated bodies are, and 413 responses are not retried
+func TestIcapClient_BodyLimitAgainstServer(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		mu.Lock()
+		bodies = append(bodies, r.Body)
+		mu.Unlock()
+		if len(r.Body) > 8 {
+			w.WriteHeader(413, nil, false)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	message := &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: bytes.Repeat([]byte("a"), 16)}
+	ctx := context.Background()
+
+	client := newTestServerClient(server, false)
+	client.config.Load().Retries = 2
+	defer client.Close()
+
+	if _, err := client.Respmod(ctx, message); !errors.Is(err, ErrEntityTooLarge) {
+		t.Errorf("Expected ErrEntityTooLarge from a 413, got %v", err)
+	}
+	if len(bodies) != 1 {
+		t.Errorf("Expected a 413 not to be retried, got %d requests", len(bodies))
+	}
+
+	client.config.Load().MaxBodySize = 8
+	if _, err := client.Respmod(ctx, message); !errors.Is(err, ErrEntityTooLarge) {
+		t.Errorf("Expected local ErrEntityTooLarge, got %v", err)
+	}
+	if len(bodies) != 1 {
+		t.Errorf("Expected a rejected body not to be sent, got %d requests", len(bodies))
+	}
+
+	client.config.Load().BodyLimitAction = BodyLimitTruncate
+	response, err := client.Respmod(ctx, message)
+	if err != nil || response.StatusCode != 204 {
+		t.Fatalf("Expected truncated body to be allowed, got %v %v", response, err)
+	}
+	if len(bodies) != 2 || len(bodies[1]) != 8 {
+		t.Errorf("Expected an 8 byte body to be sent, got %q", bodies[len(bodies)-1])
+	}
+}
+
+// TestIcapClient_EntityTooLargeSpool tests that the spooled body of a 413
+// response is removed
+func TestIcapClient_EntityTooLargeSpool(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(413, &http.Response{StatusCode: 413, Proto: "HTTP/1.1", Header: http.Header{}}, true)
+		w.Write(bytes.Repeat([]byte("too large "), 16))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, LoggingLevel: "ERROR",
+		Spool: SpoolConfig{Directory: dir, Threshold: 16},
+	})
+	defer client.Close()
+
+	message := &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte("body")}
+	if _, err := client.Respmod(context.Background(), message); !errors.Is(err, ErrEntityTooLarge) {
+		t.Fatalf("Expected ErrEntityTooLarge from a 413, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected the spool file of the 413 to be removed, found %d files", len(entries))
+	}
+}
@@ -0,0 +1,88 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxPooledBufferSize bounds the buffers kept for reuse, so a single large
+// object does not pin its memory in the pools for the life of the process
+const maxPooledBufferSize = 64 << 10
+
+var (
+	// bufferPool holds buffers for request serialization and chunk framing
+	bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	// bufioReaderPool holds the response read buffers of closed connections
+	bufioReaderPool sync.Pool
+	// bufioWriterPool holds the request write buffers of closed connections
+	bufioWriterPool sync.Pool
+	// parserPool holds response parsers with their line and header buffers
+	parserPool = sync.Pool{New: func() interface{} { return new(responseParser) }}
+)
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool unless it grew too large to keep
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// getBufioReader returns a pooled reader reading from r
+func getBufioReader(r io.Reader) *bufio.Reader {
+	if br, ok := bufioReaderPool.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// putBufioReader returns br to the pool
+func putBufioReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufioReaderPool.Put(br)
+}
+
+// getBufioWriter returns a pooled writer writing to w
+func getBufioWriter(w io.Writer) *bufio.Writer {
+	if bw, ok := bufioWriterPool.Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriter(w)
+}
+
+// putBufioWriter returns bw to the pool, discarding unflushed data
+func putBufioWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	bufioWriterPool.Put(bw)
+}
+
+// getResponseParser returns a pooled parser reading from br
+func getResponseParser(br *bufio.Reader, maxHeaderBytes, maxHeaderCount int) *responseParser {
+	p := parserPool.Get().(*responseParser)
+	p.reset(br, maxHeaderBytes, maxHeaderCount)
+	return p
+}
+
+// putResponseParser returns p to the pool, dropping buffers that grew too
+// large to keep
+func putResponseParser(p *responseParser) {
+	p.br = nil
+	if cap(p.block) > maxPooledBufferSize {
+		p.block = nil
+	}
+	if cap(p.line) > maxPooledBufferSize {
+		p.line = nil
+	}
+	parserPool.Put(p)
+}
@@ -0,0 +1,85 @@
+package icapclient
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestGetBuffer tests that pooled buffers come back empty
+func TestGetBuffer(t *testing.T) {
+	buf := getBuffer()
+	buf.WriteString("stale request")
+	putBuffer(buf)
+
+	for i := 0; i < 10; i++ {
+		buf := getBuffer()
+		if buf.Len() != 0 {
+			t.Errorf("Expected empty buffer, got %q", buf.String())
+		}
+		putBuffer(buf)
+	}
+}
+
+// TestPutBuffer_DropsLarge tests that oversized buffers are not pooled
+func TestPutBuffer_DropsLarge(t *testing.T) {
+	large := bytes.NewBuffer(make([]byte, 0, 2*maxPooledBufferSize))
+	putBuffer(large)
+
+	for i := 0; i < 10; i++ {
+		buf := getBuffer()
+		if buf == large {
+			t.Fatal("Expected oversized buffer to be dropped")
+		}
+		defer putBuffer(buf)
+	}
+}
+
+// TestResponseParser_Pooled tests that a pooled parser reads with its new
+// limits and keeps no state from its previous use
+func TestResponseParser_Pooled(t *testing.T) {
+	wire := "ICAP/1.0 200 OK\r\nX-First: one\r\nX-Second: two\r\nEncapsulated: null-body=0\r\n\r\n"
+
+	br := getBufioReader(strings.NewReader(wire))
+	parser := getResponseParser(br, 0, 0)
+	if _, err := parser.ReadResponse(); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	putResponseParser(parser)
+	putBufioReader(br)
+
+	br = getBufioReader(strings.NewReader(wire))
+	defer putBufioReader(br)
+	parser = getResponseParser(br, 0, 2)
+	defer putResponseParser(parser)
+	if _, err := parser.ReadResponse(); err == nil {
+		t.Error("Expected header count limit of a reused parser to apply")
+	}
+}
+
+// BenchmarkIcapClient_encodeRequest benchmarks request serialization into a
+// pooled buffer
+func BenchmarkIcapClient_encodeRequest(b *testing.B) {
+	client := NewIcapClient(&IcapConfig{LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	httpResponse := &HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       []byte("hello world"),
+	}
+	headers := map[string]string{
+		"Host":         "icap.example.com",
+		"Encapsulated": client.buildEncapsulatedHeader(httpResponse),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := getBuffer()
+		client.encodeRequest(buf, RESPMOD, "icap://icap.example.com:1344/respmod", headers, httpResponse)
+		putBuffer(buf)
+	}
+}
@@ -0,0 +1,207 @@
+package icapclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// ChainStage is an ICAP service of a Chain, scanned through Client with its
+// own server, services, policy and retries
+type ChainStage struct {
+	// Name identifies the stage in results, e.g. "dlp" or "av"
+	Name   string
+	Client *IcapClient
+}
+
+// Chain scans messages through ICAP services in order, e.g. DLP then
+// antivirus, the adapted message of each stage being the input of the next.
+// The chain stops at the first stage blocking the message or failing.
+type Chain struct {
+	stages []ChainStage
+}
+
+// NewChain creates a chain of stages, scanned in order
+func NewChain(stages ...ChainStage) *Chain {
+	return &Chain{stages: stages}
+}
+
+// StageResult is the outcome of a stage of a chain
+type StageResult struct {
+	Name    string
+	Verdict Verdict
+	// Response is nil when the stage failed without an answer from the
+	// server
+	Response *IcapResponse
+	Err      error
+}
+
+// ChainResult is the outcome of scanning a message through a chain
+type ChainResult struct {
+	// Verdict is VerdictBlocked or VerdictError when a stage blocked the
+	// message or failed, VerdictModified when a stage adapted it and
+	// VerdictAllowed otherwise
+	Verdict Verdict
+	// Stages are the results of the stages run, in order. Stages after one
+	// blocking the message or failing are not run.
+	Stages []StageResult
+	// Request is the request after the last stage of ScanRequest, and
+	// Response the response after the last stage of ScanResponse, or the
+	// block page of the stage that blocked a request
+	Request  *HttpRequest
+	Response *HttpResponse
+}
+
+// Close closes the responses of the stages, removing the spool files of
+// the adapted bodies, once the adapted message has been used
+func (r *ChainResult) Close() error {
+	return closeStages(r.Stages)
+}
+
+// closeStages closes the responses of stages, returning the first error
+func closeStages(stages []StageResult) error {
+	var firstErr error
+	for _, stage := range stages {
+		if stage.Response == nil {
+			continue
+		}
+		if err := stage.Response.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ScanRequest sends httpRequest through REQMOD at every stage. A body read
+// from a BodyReader that is not an io.Seeker is read into memory first, so
+// that it can be sent again after a stage allowing it.
+func (c *Chain) ScanRequest(ctx context.Context, httpRequest *HttpRequest) (*ChainResult, error) {
+	return c.scan(ctx, httpRequest, func(ctx context.Context, client *IcapClient, message interface{}) (Verdict, *IcapResponse, error) {
+		return client.ScanRequest(ctx, message.(*HttpRequest))
+	})
+}
+
+// ScanResponse sends httpResponse through RESPMOD at every stage, reading a
+// body that cannot be rewound into memory as ScanRequest does
+func (c *Chain) ScanResponse(ctx context.Context, httpResponse *HttpResponse) (*ChainResult, error) {
+	return c.scan(ctx, httpResponse, func(ctx context.Context, client *IcapClient, message interface{}) (Verdict, *IcapResponse, error) {
+		return client.ScanResponse(ctx, message.(*HttpResponse))
+	})
+}
+
+// scan runs the stages on message with scan, returning the error of a
+// failed stage along with the result
+func (c *Chain) scan(ctx context.Context, message interface{}, scan func(context.Context, *IcapClient, interface{}) (Verdict, *IcapResponse, error)) (*ChainResult, error) {
+	message, err := rewindableBody(message)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ChainResult{Verdict: VerdictAllowed}
+	for i, stage := range c.stages {
+		start, err := bodyPosition(message)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+		verdict, response, err := scan(ctx, stage.Client, message)
+		if verdict == VerdictError && err == nil {
+			err = &IcapError{Message: fmt.Sprintf("ICAP server answered %d %s", response.StatusCode, response.Reason), Code: response.StatusCode}
+		}
+		result.Stages = append(result.Stages, StageResult{Name: stage.Name, Verdict: verdict, Response: response, Err: err})
+		if err != nil {
+			result.Verdict = VerdictError
+			result.setMessage(message)
+			return result, fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+
+		switch verdict {
+		case VerdictBlocked:
+			result.Verdict = VerdictBlocked
+			result.setMessage(message)
+			if response.HttpResponse != nil {
+				result.Response = response.HttpResponse
+			}
+			return result, nil
+		case VerdictModified:
+			result.Verdict = VerdictModified
+			if adapted := adaptedMessage(message, response); adapted != nil {
+				// The next stage reads the adapted body, which may be
+				// streamed, e.g. while it is decoded
+				if i+1 < len(c.stages) {
+					if adapted, err = rewindableBody(adapted); err != nil {
+						return nil, fmt.Errorf("stage %s: %w", stage.Name, err)
+					}
+				}
+				message = adapted
+				continue
+			}
+		}
+		if err := seekBody(message, start); err != nil {
+			return nil, fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+	}
+	result.setMessage(message)
+	return result, nil
+}
+
+// setMessage records message as the request or response of the result
+func (r *ChainResult) setMessage(message interface{}) {
+	switch message := message.(type) {
+	case *HttpRequest:
+		r.Request = message
+	case *HttpResponse:
+		r.Response = message
+	}
+}
+
+// adaptedMessage returns the adapted message of response of the same kind
+// as message, or nil if there is none
+func adaptedMessage(message interface{}, response *IcapResponse) interface{} {
+	switch message.(type) {
+	case *HttpRequest:
+		if response.HttpRequest != nil {
+			return response.HttpRequest
+		}
+	case *HttpResponse:
+		if response.HttpResponse != nil {
+			return response.HttpResponse
+		}
+	}
+	return nil
+}
+
+// rewindableBody returns message with a BodyReader that is not an
+// io.Seeker read into Body
+func rewindableBody(message interface{}) (interface{}, error) {
+	if _, ok := httpBodyReader(message).(io.Seeker); ok {
+		return message, nil
+	}
+	return bufferedBody(message)
+}
+
+// bodyPosition returns the offset of the BodyReader of message, 0 when it
+// has none
+func bodyPosition(message interface{}) (int64, error) {
+	seeker, ok := httpBodyReader(message).(io.Seeker)
+	if !ok {
+		return 0, nil
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seek body: %w", err)
+	}
+	return offset, nil
+}
+
+// seekBody rewinds the BodyReader of message to offset, so that the next
+// stage reads it again
+func seekBody(message interface{}, offset int64) error {
+	seeker, ok := httpBodyReader(message).(io.Seeker)
+	if !ok {
+		return nil
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek body: %w", err)
+	}
+	return nil
+}
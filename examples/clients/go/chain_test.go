@@ -0,0 +1,153 @@
+package icapclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestChain tests passing adapted messages from stage to stage and
+// stopping at the first block
+func TestChain(t *testing.T) {
+	dlp := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if !bytes.Contains(r.Body, []byte("secret")) {
+			w.WriteHeader(204, nil, false)
+			return
+		}
+		r.Request.Header.Set("X-DLP", "redacted")
+		w.WriteHeader(200, r.Request, true)
+		w.Write(bytes.ReplaceAll(r.Body, []byte("secret"), []byte("[redacted]")))
+	}))
+	defer dlp.Close()
+	var scanned atomic.Value
+	av := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		scanned.Store(string(r.Body))
+		if !bytes.Contains(r.Body, []byte("virus")) {
+			w.WriteHeader(204, nil, false)
+			return
+		}
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/plain"}}}, true)
+		w.Write([]byte("blocked"))
+	}))
+	defer av.Close()
+
+	dlpClient := newTestServerClient(dlp, false)
+	defer dlpClient.Close()
+	avClient := newTestServerClient(av, false)
+	defer avClient.Close()
+	chain := NewChain(ChainStage{Name: "dlp", Client: dlpClient}, ChainStage{Name: "av", Client: avClient})
+
+	result, err := chain.ScanRequest(context.Background(), &HttpRequest{
+		Method: "POST", URI: "http://example.com/upload", Version: "HTTP/1.1",
+		Headers: map[string]string{"Host": "example.com"}, BodyReader: strings.NewReader("the secret plan"),
+	})
+	if err != nil {
+		t.Fatalf("Chain failed: %v", err)
+	}
+	defer result.Close()
+	if result.Verdict != VerdictModified || len(result.Stages) != 2 {
+		t.Fatalf("Expected a modified request after 2 stages, got %v after %d", result.Verdict, len(result.Stages))
+	}
+	if result.Stages[0].Verdict != VerdictModified || result.Stages[1].Verdict != VerdictAllowed {
+		t.Errorf("Expected dlp to modify and av to allow, got %v and %v", result.Stages[0].Verdict, result.Stages[1].Verdict)
+	}
+	if body, _ := scanned.Load().(string); body != "the [redacted] plan" {
+		t.Errorf("Expected av to scan the redacted body, got %q", body)
+	}
+	if result.Request == nil || string(result.Request.Body) != "the [redacted] plan" || headerValue(result.Request.Headers, "X-DLP") != "redacted" {
+		t.Errorf("Expected the redacted request, got %+v", result.Request)
+	}
+
+	result, err = chain.ScanResponse(context.Background(), &HttpResponse{
+		Version: "HTTP/1.1", StatusCode: 200, Reason: "OK",
+		Headers: map[string]string{"Content-Type": "text/plain"}, Body: []byte("a virus"),
+	})
+	if err != nil {
+		t.Fatalf("Chain failed: %v", err)
+	}
+	if result.Verdict != VerdictBlocked || result.Response == nil || result.Response.StatusCode != 403 {
+		t.Errorf("Expected the av block page, got %v %+v", result.Verdict, result.Response)
+	}
+
+	blocking := NewChain(ChainStage{Name: "av", Client: avClient}, ChainStage{Name: "dlp", Client: dlpClient})
+	result, err = blocking.ScanRequest(context.Background(), &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", Body: []byte("virus secret")})
+	if err != nil {
+		t.Fatalf("Chain failed: %v", err)
+	}
+	if result.Verdict != VerdictBlocked || len(result.Stages) != 1 {
+		t.Errorf("Expected the chain to stop at the av block, got %v after %d stages", result.Verdict, len(result.Stages))
+	}
+}
+
+// TestChain_StageError tests reporting the stage that failed
+func TestChain_StageError(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+	down := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	down.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	downClient := newTestServerClient(down, false)
+	defer downClient.Close()
+
+	result, err := NewChain(ChainStage{Name: "dlp", Client: client}, ChainStage{Name: "av", Client: downClient}).
+		ScanRequest(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+	if err == nil || !strings.HasPrefix(err.Error(), "stage av: ") {
+		t.Errorf("Expected the av stage to fail, got %v", err)
+	}
+	if result == nil || result.Verdict != VerdictError || len(result.Stages) != 2 || result.Stages[1].Err == nil {
+		t.Errorf("Expected an error result for the av stage, got %+v", result)
+	}
+}
+
+// TestChain_StreamedAdaptedBody tests that an adapted body streamed from a
+// spool file while it is decoded reaches the next stage and the result
+func TestChain_StreamedAdaptedBody(t *testing.T) {
+	plain := strings.Repeat("adapted content ", 64)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(plain))
+	zw.Close()
+
+	adapter := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(200, &http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{"Content-Encoding": {"gzip"}, "X-Adapted": {"yes"}}}, true)
+		w.Write(compressed.Bytes())
+	}))
+	defer adapter.Close()
+	var scanned atomic.Value
+	av := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		scanned.Store(string(r.Body))
+		w.WriteHeader(204, nil, false)
+	}))
+	defer av.Close()
+
+	host, port := adapter.HostPort()
+	adapterClient := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, LoggingLevel: "ERROR",
+		Spool: SpoolConfig{Threshold: 16}, DecodeContentEncoding: true,
+	})
+	defer adapterClient.Close()
+	avClient := newTestServerClient(av, false)
+	defer avClient.Close()
+
+	chain := NewChain(ChainStage{Name: "adapter", Client: adapterClient}, ChainStage{Name: "av", Client: avClient})
+	result, err := chain.ScanResponse(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte("original")})
+	if err != nil {
+		t.Fatalf("Chain failed: %v", err)
+	}
+	defer result.Close()
+	if body, _ := scanned.Load().(string); body != plain {
+		t.Errorf("Expected av to scan the decoded adapted body, got %d bytes", len(body))
+	}
+	if result.Response == nil || string(result.Response.Body) != plain {
+		t.Errorf("Expected the decoded adapted body in the result, got %+v", result.Response)
+	}
+}
@@ -0,0 +1,87 @@
+package icapclient
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Response profiles understanding the conventions of a backend
+const (
+	// ResponseProfileClamAV recognizes the threats reported by c-icap's
+	// virus_scan module and SquidClamav in front of ClamAV
+	ResponseProfileClamAV = "clamav"
+)
+
+var (
+	// clamavBlockPage matches the virus name in c-icap's VIRUS_FOUND
+	// template, "You try to upload/download a file that contain the virus
+	// <b>Eicar-Test-Signature</b>"
+	clamavBlockPage = regexp.MustCompile(`(?is)contains? the virus:?\s*(?:<br\s*/?>\s*)*<b>\s*([^<]+?)\s*</b>`)
+	// clamdResult matches a clamd scan result, "stream: Eicar-Test-Signature FOUND"
+	clamdResult = regexp.MustCompile(`^(?:[^:]*:\s+)?(\S.*?)\s+FOUND$`)
+)
+
+// ClamAVInfection returns the infection reported by a ClamAV-backed ICAP
+// service, or nil when the response reports none. It recognizes, in order:
+//   - an X-Infection-Found header, already parsed into response.Infection
+//   - the X-Virus-ID header set by c-icap and SquidClamav
+//   - a SquidClamav redirect to clwarn.cgi with the virus in its query
+//   - c-icap's VIRUS_FOUND block page
+func ClamAVInfection(response *IcapResponse) *Infection {
+	if response.Infection != nil {
+		return response.Infection
+	}
+
+	if threat := clamavThreat(headerValue(response.Headers, "X-Virus-ID")); threat != "" {
+		return &Infection{Type: ThreatVirus, Resolution: ResolutionBlocked, Threat: threat}
+	}
+
+	adapted := response.HttpResponse
+	if adapted == nil {
+		return nil
+	}
+	if adapted.StatusCode >= 300 && adapted.StatusCode < 400 {
+		if threat := squidClamavRedirect(headerValue(adapted.Headers, "Location")); threat != "" {
+			return &Infection{Type: ThreatVirus, Resolution: ResolutionBlocked, Threat: threat}
+		}
+	}
+	if match := clamavBlockPage.FindSubmatch(adapted.Body); match != nil {
+		if threat := clamavThreat(string(match[1])); threat != "" {
+			return &Infection{Type: ThreatVirus, Resolution: ResolutionBlocked, Threat: threat}
+		}
+	}
+	return nil
+}
+
+// applyResponseProfile fills the threat fields of response that the
+// response profile of config can infer from backend conventions
+func (c *IcapClient) applyResponseProfile(config *IcapConfig, response *IcapResponse) {
+	if strings.EqualFold(config.ResponseProfile, ResponseProfileClamAV) {
+		response.Infection = ClamAVInfection(response)
+	}
+}
+
+// squidClamavRedirect returns the virus named in a SquidClamav redirect,
+// e.g. "http://proxy/cgi-bin/clwarn.cgi?url=...&virus=stream:+Eicar-Test-Signature+FOUND"
+func squidClamavRedirect(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || !strings.Contains(u.Path, "clwarn") {
+		return ""
+	}
+	return clamavThreat(u.Query().Get("virus"))
+}
+
+// clamavThreat normalizes a ClamAV virus name, stripping the clamd
+// "stream: ... FOUND" decoration. Values meaning no virus yield "".
+func clamavThreat(value string) string {
+	value = strings.TrimSpace(value)
+	if match := clamdResult.FindStringSubmatch(value); match != nil {
+		value = match[1]
+	}
+	switch strings.ToLower(value) {
+	case "", "ok", "clean", "no threats", "none":
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,82 @@
+package icapclient
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestClamAVInfection tests recognizing c-icap and SquidClamav threats
+func TestClamAVInfection(t *testing.T) {
+	blockPage := []byte("<html><body><h1>VIRUS FOUND</h1>\nYou try to upload/download a file that contain the virus: <br>\n<b> Eicar-Test-Signature </b><br>\n</body></html>")
+
+	tests := []struct {
+		name     string
+		response *IcapResponse
+		expected string
+	}{
+		{"X-Infection-Found", &IcapResponse{Infection: &Infection{Threat: "Parsed"}, Headers: map[string]string{"X-Virus-ID": "Other"}}, "Parsed"},
+		{"X-Virus-ID", &IcapResponse{Headers: map[string]string{"X-Virus-ID": "Win.Test.EICAR_HDB-1"}}, "Win.Test.EICAR_HDB-1"},
+		{"X-Virus-ID clamd result", &IcapResponse{Headers: map[string]string{"x-virus-id": "stream: Eicar-Test-Signature FOUND"}}, "Eicar-Test-Signature"},
+		{"X-Virus-ID no threats", &IcapResponse{Headers: map[string]string{"X-Virus-ID": "no threats"}}, ""},
+		{"SquidClamav redirect", &IcapResponse{HttpResponse: &HttpResponse{StatusCode: 307, Headers: map[string]string{
+			"Location": "http://proxy/cgi-bin/clwarn.cgi?url=http://example.com/eicar.com&source=10.0.0.1&user=-&virus=stream:+Eicar-Test-Signature+FOUND",
+		}}}, "Eicar-Test-Signature"},
+		{"Other redirect", &IcapResponse{HttpResponse: &HttpResponse{StatusCode: 302, Headers: map[string]string{
+			"Location": "http://example.com/login?virus=nope",
+		}}}, ""},
+		{"c-icap block page", &IcapResponse{HttpResponse: &HttpResponse{StatusCode: 403, Body: blockPage}}, "Eicar-Test-Signature"},
+		{"Clean echo", &IcapResponse{HttpResponse: &HttpResponse{StatusCode: 200, Body: []byte("hello")}}, ""},
+		{"No content", &IcapResponse{StatusCode: 204}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			infection := ClamAVInfection(tt.response)
+			switch {
+			case tt.expected == "" && infection != nil:
+				t.Errorf("Expected no infection, got %+v", infection)
+			case tt.expected != "" && (infection == nil || infection.Threat != tt.expected):
+				t.Errorf("Expected threat %s, got %+v", tt.expected, infection)
+			}
+		})
+	}
+}
+
+// TestIcapClient_ClamAVProfile tests that the clamav response profile turns
+// an X-Virus-ID header into a blocked verdict
+func TestIcapClient_ClamAVProfile(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.Header().Set("X-Virus-ID", "Eicar-Test-Signature")
+		w.WriteHeader(200, &http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{}}, true)
+		w.Write([]byte("removed"))
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		profile  string
+		expected Verdict
+	}{
+		{"", VerdictModified},
+		{ResponseProfileClamAV, VerdictBlocked},
+	} {
+		client := newTestServerClient(server, false)
+		client.config.Load().ResponseProfile = tt.profile
+
+		verdict, response, err := client.ScanResponse(context.Background(), &HttpResponse{
+			Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Headers: map[string]string{"Content-Length": "5"}, Body: []byte("virus"),
+		})
+		client.Close()
+		if err != nil {
+			t.Fatalf("ScanResponse failed: %v", err)
+		}
+		if verdict != tt.expected {
+			t.Errorf("Profile %q: expected %s, got %s", tt.profile, tt.expected, verdict)
+		}
+		if tt.profile != "" && (response.Infection == nil || response.Infection.Threat != "Eicar-Test-Signature") {
+			t.Errorf("Expected Eicar-Test-Signature infection, got %+v", response.Infection)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package icapclient
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// defaultCleanFilterCapacity is the clean_filter.capacity used when unset
+	defaultCleanFilterCapacity = 1000000
+	// defaultCleanFilterFalsePositiveRate is the
+	// clean_filter.false_positive_rate used when unset
+	defaultCleanFilterFalsePositiveRate = 0.001
+)
+
+// cleanFilterMagic starts the files of persisted clean filters. Filters
+// saved before entries were keyed by service start with ICAPBLM1 and are
+// not loaded.
+const cleanFilterMagic = "ICAPBLM2"
+
+// CleanFilterConfig controls the Bloom filter of RESPMOD bodies found
+// clean, checked before a RESPMOD body is sent: bodies in the filter are
+// answered 204 without scanning. Entries are keyed by the service URL and
+// the SHA-256 of the body, so a body found clean by one service is still
+// scanned by the others. REQMOD verdicts often depend on the URL rather
+// than the body and are not recorded. A false positive skips the scan of a
+// body never seen, at FalsePositiveRate once Capacity hashes are added,
+// and more often beyond. Hashes stay in the filter across ISTag changes;
+// remove the file to forget them.
+type CleanFilterConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Path persists the filter between runs: it is loaded when the client
+	// is created and saved when it is closed
+	Path              string  `yaml:"path" json:"path"`
+	Capacity          int     `yaml:"capacity" json:"capacity"`
+	FalsePositiveRate float64 `yaml:"false_positive_rate" json:"false_positive_rate"`
+}
+
+// bloomFilter is a Bloom filter of SHA-256 digests, whose bits are indexed
+// by double hashing of the first 16 bytes of the digest
+type bloomFilter struct {
+	mu    sync.RWMutex
+	bits  []uint64
+	k     uint32
+	count uint64
+}
+
+// newBloomFilter creates an empty filter sized for capacity digests at the
+// false positive rate fpr
+func newBloomFilter(capacity int, fpr float64) *bloomFilter {
+	m := math.Ceil(-float64(capacity) * math.Log(fpr) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(capacity) * math.Ln2)
+	return &bloomFilter{
+		bits: make([]uint64, (uint64(m)+63)/64),
+		k:    uint32(max(k, 1)),
+	}
+}
+
+// sameShape reports whether f and other have as many bits and hashes
+func (f *bloomFilter) sameShape(other *bloomFilter) bool {
+	return len(f.bits) == len(other.bits) && f.k == other.k
+}
+
+// locate calls fn with the word and bit of each of the k locations of
+// digest
+func (f *bloomFilter) locate(digest []byte, fn func(word int, bit uint64) bool) {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.k); i++ {
+		location := (h1 + i*h2) % m
+		if !fn(int(location/64), 1<<(location%64)) {
+			return
+		}
+	}
+}
+
+// add adds digest, reporting whether it was not in the filter already
+func (f *bloomFilter) add(digest []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	added := false
+	f.locate(digest, func(word int, bit uint64) bool {
+		if f.bits[word]&bit == 0 {
+			f.bits[word] |= bit
+			added = true
+		}
+		return true
+	})
+	if added {
+		f.count++
+	}
+	return added
+}
+
+// contains reports whether digest may have been added
+func (f *bloomFilter) contains(digest []byte) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	found := true
+	f.locate(digest, func(word int, bit uint64) bool {
+		found = f.bits[word]&bit != 0
+		return found
+	})
+	return found
+}
+
+// entries returns the number of digests added
+func (f *bloomFilter) entries() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.count
+}
+
+// writeTo writes the filter to w: the magic, the number of words and of
+// hashes and the count, then the words, all big-endian
+func (f *bloomFilter) writeTo(w io.Writer) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	bw := bufio.NewWriter(w)
+	bw.WriteString(cleanFilterMagic)
+	binary.Write(bw, binary.BigEndian, uint64(len(f.bits)))
+	binary.Write(bw, binary.BigEndian, f.k)
+	binary.Write(bw, binary.BigEndian, f.count)
+	if err := binary.Write(bw, binary.BigEndian, f.bits); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readBloomFilter reads a filter written by writeTo
+func readBloomFilter(r io.Reader) (*bloomFilter, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(cleanFilterMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != cleanFilterMagic {
+		return nil, errors.New("not a clean filter file")
+	}
+	var words uint64
+	f := &bloomFilter{}
+	if err := binary.Read(br, binary.BigEndian, &words); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(br, binary.BigEndian, &f.k); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(br, binary.BigEndian, &f.count); err != nil {
+		return nil, err
+	}
+	if words == 0 || words > math.MaxInt32 || f.k == 0 {
+		return nil, errors.New("invalid clean filter header")
+	}
+	f.bits = make([]uint64, words)
+	if err := binary.Read(br, binary.BigEndian, f.bits); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// cleanFilter is the filter of known-clean bodies of a client
+type cleanFilter struct {
+	path    string
+	filter  *bloomFilter
+	metrics *ClientMetrics
+	// dirty reports hashes added since the filter was loaded or saved
+	dirty atomic.Bool
+}
+
+// openCleanFilter creates the filter of config, loading it from its path
+// if saved with the same capacity and false positive rate, or returns nil
+// if disabled
+func openCleanFilter(config CleanFilterConfig, logger Logger, metrics *ClientMetrics) *cleanFilter {
+	if !config.Enabled {
+		return nil
+	}
+	capacity, fpr := config.Capacity, config.FalsePositiveRate
+	if capacity <= 0 {
+		capacity = defaultCleanFilterCapacity
+	}
+	if fpr <= 0 || fpr >= 1 {
+		fpr = defaultCleanFilterFalsePositiveRate
+	}
+
+	f := &cleanFilter{path: config.Path, filter: newBloomFilter(capacity, fpr), metrics: metrics}
+	if f.path != "" {
+		loaded, err := loadBloomFilter(f.path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			logger.Warn("Failed to load clean filter, starting empty", "path", f.path, "error", err)
+		case !loaded.sameShape(f.filter):
+			logger.Warn("Clean filter saved with another capacity or false positive rate, starting empty", "path", f.path)
+		default:
+			f.filter = loaded
+			logger.Info("Clean filter loaded", "path", f.path, "entries", loaded.entries())
+		}
+	}
+	if metrics != nil {
+		metrics.CleanFilterEntries.Set(float64(f.filter.entries()))
+	}
+	return f
+}
+
+// loadBloomFilter reads the filter saved at path
+func loadBloomFilter(path string) (*bloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readBloomFilter(file)
+}
+
+// contains reports whether the body hashed as hashes is known clean to
+// the service at url
+func (f *cleanFilter) contains(method IcapMethod, url string, hashes ContentHashes) bool {
+	digest := f.digest(method, url, hashes)
+	return digest != nil && f.filter.contains(digest)
+}
+
+// add records the body hashed as hashes as clean to the service at url
+func (f *cleanFilter) add(method IcapMethod, url string, hashes ContentHashes) {
+	digest := f.digest(method, url, hashes)
+	if digest == nil || !f.filter.add(digest) {
+		return
+	}
+	f.dirty.Store(true)
+	if f.metrics != nil {
+		f.metrics.CleanFilterEntries.Set(float64(f.filter.entries()))
+	}
+}
+
+// digest returns the SHA-256 of the method, the service URL and the
+// SHA-256 of a RESPMOD body, or nil
+func (f *cleanFilter) digest(method IcapMethod, url string, hashes ContentHashes) []byte {
+	if f == nil || method != RESPMOD {
+		return nil
+	}
+	body, err := hex.DecodeString(hashes[HashSHA256])
+	if err != nil || len(body) != sha256.Size {
+		return nil
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", method, url)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// save writes the filter to its path, replacing the previous file at once,
+// if hashes were added
+func (f *cleanFilter) save() error {
+	if f == nil || f.path == "" || !f.dirty.Swap(false) {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		f.dirty.Store(true)
+		return fmt.Errorf("failed to save clean filter: %w", err)
+	}
+	err = f.filter.writeTo(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		f.dirty.Store(true)
+		return fmt.Errorf("failed to save clean filter: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestBloomFilter tests membership, the false positive rate and
+// persistence of the filter
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(1000, 0.01)
+	digest := func(i int) []byte {
+		sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+		return sum[:]
+	}
+
+	for i := 0; i < 1000; i++ {
+		filter.add(digest(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !filter.contains(digest(i)) {
+			t.Fatalf("Expected digest %d to be in the filter", i)
+		}
+	}
+	falsePositives := 0
+	for i := 1000; i < 11000; i++ {
+		if filter.contains(digest(i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.02 {
+		t.Errorf("Expected a false positive rate near 0.01, got %g", rate)
+	}
+
+	var buf bytes.Buffer
+	if err := filter.writeTo(&buf); err != nil {
+		t.Fatalf("Failed to write filter: %v", err)
+	}
+	loaded, err := readBloomFilter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read filter: %v", err)
+	}
+	if !loaded.sameShape(filter) || loaded.entries() != filter.entries() || !loaded.contains(digest(42)) {
+		t.Errorf("Expected the filter to round-trip")
+	}
+	if _, err := readBloomFilter(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Errorf("Expected an error reading garbage")
+	}
+}
+
+// TestIcapClient_CleanFilter tests answering known-clean bodies without
+// scanning, across runs
+func TestIcapClient_CleanFilter(t *testing.T) {
+	var requests atomic.Int32
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		requests.Add(1)
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "clean.bloom")
+	host, port := server.HostPort()
+	newClient := func(capacity int) *IcapClient {
+		return NewIcapClient(&IcapConfig{
+			Host: host, Port: port, Timeout: 5 * time.Second, ConnectionPoolSize: 2, KeepAlive: true, LoggingLevel: "ERROR",
+			CleanFilter: CleanFilterConfig{Enabled: true, Path: path, Capacity: capacity},
+		})
+	}
+	scan := func(client *IcapClient) *IcapResponse {
+		t.Helper()
+		response, err := client.Respmod(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte("test")})
+		if err != nil {
+			t.Fatalf("RESPMOD failed: %v", err)
+		}
+		return response
+	}
+
+	client := newClient(1000)
+	if response := scan(client); response.KnownClean {
+		t.Errorf("Expected the first scan to reach the server")
+	}
+	if response := scan(client); !response.KnownClean || response.StatusCode != 204 {
+		t.Errorf("Expected a known-clean 204, got %+v", response)
+	}
+	client.Close()
+
+	client = newClient(1000)
+	if response := scan(client); !response.KnownClean {
+		t.Errorf("Expected the filter to be loaded from %s", path)
+	}
+	client.Close()
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected 1 request to the server, got %d", n)
+	}
+
+	client = newClient(2000)
+	defer client.Close()
+	if response := scan(client); response.KnownClean {
+		t.Errorf("Expected a filter of another capacity to start empty")
+	}
+}
+
+// TestIcapClient_CleanFilterScope tests that REQMOD verdicts are not
+// recorded and that RESPMOD entries are kept per service
+func TestIcapClient_CleanFilterScope(t *testing.T) {
+	var requests atomic.Int32
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		requests.Add(1)
+		testServerHandler(w, r)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, KeepAlive: true, LoggingLevel: "ERROR",
+		CleanFilter: CleanFilterConfig{Enabled: true, Capacity: 1000},
+	})
+	defer client.Close()
+	ctx := context.Background()
+
+	body := []byte("virus")
+	for i := 0; i < 2; i++ {
+		response, err := client.Reqmod(ctx, &HttpRequest{Method: "POST", URI: "http://example.com/upload", Version: "HTTP/1.1", Headers: map[string]string{"Host": "example.com"}, Body: body})
+		if err != nil || response.KnownClean {
+			t.Fatalf("Expected REQMOD to reach the server, got %+v (%v)", response, err)
+		}
+	}
+	verdict, response, err := client.ScanResponse(ctx, &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: body})
+	if err != nil || verdict != VerdictBlocked || response.KnownClean {
+		t.Errorf("Expected a REQMOD 204 not to answer RESPMOD of the same body, got %s %+v (%v)", verdict, response, err)
+	}
+
+	clean := &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte("clean")}
+	if _, err := client.Respmod(ctx, clean); err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+	if response, err := client.Respmod(ctx, clean); err != nil || !response.KnownClean {
+		t.Errorf("Expected a known-clean 204, got %+v (%v)", response, err)
+	}
+	other := WithRequestOptions(ctx, RequestOptions{Service: "/av"})
+	if response, err := client.Respmod(other, clean); err != nil || response.KnownClean {
+		t.Errorf("Expected another service to scan the body, got %+v (%v)", response, err)
+	}
+	if n := requests.Load(); n != 5 {
+		t.Errorf("Expected 5 requests to the server, got %d", n)
+	}
+}
@@ -0,0 +1,51 @@
+package icapclient
+
+import (
+	"net/http"
+	"time"
+)
+
+// defaultClockSkewThreshold is the clock skew warned about when
+// clock_skew_threshold is zero
+const defaultClockSkewThreshold = 30 * time.Second
+
+// recordServerDate measures the clock skew from the Date header of a
+// response to a request sent at sentAt and answered at receivedAt. The
+// skew is the server time less the local time at the middle of the
+// exchange. A warning is logged when it exceeds clock_skew_threshold, and
+// again once it is back in range.
+func (c *IcapClient) recordServerDate(config *IcapConfig, response *IcapResponse, sentAt, receivedAt time.Time) {
+	date, err := http.ParseTime(headerValue(response.Headers, "Date"))
+	if err != nil {
+		return
+	}
+	skew := date.Sub(sentAt.Add(receivedAt.Sub(sentAt) / 2)).Truncate(time.Second)
+	c.clockSkew.Store(int64(skew))
+	if c.metrics != nil {
+		c.metrics.ClockSkew.Set(skew.Seconds())
+	}
+
+	threshold := config.ClockSkewThreshold
+	if threshold == 0 {
+		threshold = defaultClockSkewThreshold
+	}
+	skewed := threshold > 0 && (skew > threshold || skew < -threshold)
+	if c.clockSkewed.Swap(skewed) == skewed {
+		return
+	}
+	if skewed {
+		c.logger.Warn("Server clock skew exceeds threshold, timestamped credentials may be rejected",
+			"skew", skew, "threshold", threshold, "server_date", date)
+	} else {
+		c.logger.Info("Server clock skew back within threshold", "skew", skew, "threshold", threshold)
+	}
+}
+
+// ClockSkew returns how far the clock of the server is ahead of the local
+// clock, negative when it is behind, as measured from the Date header of
+// the last response carrying one. It is zero until then. Callers signing
+// requests with timestamps, e.g. HMAC signatures or JWT iat and exp
+// claims, can add it to time.Now() to match the server clock.
+func (c *IcapClient) ClockSkew() time.Duration {
+	return time.Duration(c.clockSkew.Load())
+}
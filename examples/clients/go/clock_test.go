@@ -0,0 +1,78 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestIcapClient_recordServerDate tests measuring the clock skew and
+// warning when it crosses the threshold
+func TestIcapClient_recordServerDate(t *testing.T) {
+	var buf bytes.Buffer
+	client := NewIcapClient(&IcapConfig{Logger: slog.New(slog.NewTextHandler(&buf, nil)), ClockSkewThreshold: time.Minute})
+	defer client.Close()
+
+	sentAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	receivedAt := sentAt.Add(2 * time.Second)
+	tests := []struct {
+		name     string
+		date     string
+		expected time.Duration
+		warning  string
+	}{
+		{"in sync", "Wed, 01 May 2024 12:00:01 GMT", 0, ""},
+		{"ahead", "Wed, 01 May 2024 12:05:01 GMT", 5 * time.Minute, "Server clock skew exceeds threshold"},
+		{"still ahead", "Wed, 01 May 2024 12:05:01 GMT", 5 * time.Minute, ""},
+		{"back in range", "Wed, 01 May 2024 12:00:31 GMT", 30 * time.Second, "Server clock skew back within threshold"},
+		{"behind", "Wed, 01 May 2024 11:58:01 GMT", -2 * time.Minute, "Server clock skew exceeds threshold"},
+		{"no date", "", -2 * time.Minute, ""},
+		{"invalid date", "yesterday", -2 * time.Minute, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			client.recordServerDate(client.config.Load(), &IcapResponse{Headers: map[string]string{"date": tt.date}}, sentAt, receivedAt)
+			if skew := client.ClockSkew(); skew != tt.expected {
+				t.Errorf("Expected skew %v, got %v", tt.expected, skew)
+			}
+			if logged := buf.String(); (tt.warning == "") != (logged == "") || !strings.Contains(logged, tt.warning) {
+				t.Errorf("Expected log %q, got %q", tt.warning, logged)
+			}
+		})
+	}
+}
+
+// TestIcapClient_DateHeader tests sending a Date header and measuring the
+// skew from the Date of the server
+func TestIcapClient_DateHeader(t *testing.T) {
+	received := make(chan string, 1)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		received <- r.Header.Get("Date")
+		w.Header().Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+		w.WriteHeader(200, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	before := time.Now().Truncate(time.Second)
+	if _, err := client.Options(context.Background()); err != nil {
+		t.Fatalf("Options failed: %v", err)
+	}
+	date, err := http.ParseTime(<-received)
+	if err != nil || date.Before(before) || date.After(time.Now()) {
+		t.Errorf("Expected a current HTTP date, got %v (%v)", date, err)
+	}
+	if skew := client.ClockSkew(); skew > -59*time.Minute || skew < -61*time.Minute {
+		t.Errorf("Expected a skew of about -1h, got %v", skew)
+	}
+}
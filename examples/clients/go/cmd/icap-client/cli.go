@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// cliOptions holds the persistent command-line flags shared by all modes
+type cliOptions struct {
+	configPath  string
+	host        string
+	port        int
+	method      string
+	verbose     bool
+	adminListen string
+	adminPprof  bool
+	readyTTL    time.Duration
+}
+
+// loadConfig loads the configuration file, or builds a default
+// configuration from the host and port flags
+func (o *cliOptions) loadConfig() (*icapclient.IcapConfig, error) {
+	var config *icapclient.IcapConfig
+
+	if o.configPath != "" {
+		var err error
+		config, err = icapclient.LoadConfig(o.configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+	} else {
+		config = &icapclient.IcapConfig{
+			Host:               o.host,
+			Port:               o.port,
+			Timeout:            30 * time.Second,
+			Retries:            3,
+			RetryDelay:         time.Second,
+			MaxRetryDelay:      60 * time.Second,
+			BackoffFactor:      2.0,
+			ConnectionPoolSize: 10,
+			KeepAlive:          true,
+			VerifySSL:          true,
+			LoggingLevel:       "INFO",
+			MetricsEnabled:     true,
+		}
+	}
+
+	if o.verbose {
+		config.LoggingLevel = "DEBUG"
+	}
+
+	return config, nil
+}
+
+// icapService is a parsed icap:// or icaps:// service URL
+type icapService struct {
+	url  *url.URL
+	host string
+	port int
+	tls  bool
+}
+
+// parseICAPService parses raw, an icap or icaps URL whose port defaults to
+// that of its scheme
+func parseICAPService(raw string) (*icapService, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ICAP URL %s: %w", raw, err)
+	}
+	service := &icapService{url: u, host: u.Hostname(), port: icapclient.DefaultPort}
+	switch u.Scheme {
+	case "icap":
+	case "icaps":
+		service.tls = true
+		service.port = icapclient.DefaultTLSPort
+	default:
+		return nil, fmt.Errorf("invalid ICAP URL %s: expected icap://host[:port]/service", raw)
+	}
+	if service.host == "" {
+		return nil, fmt.Errorf("invalid ICAP URL %s: expected icap://host[:port]/service", raw)
+	}
+	if u.Port() != "" {
+		if service.port, err = strconv.Atoi(u.Port()); err != nil {
+			return nil, fmt.Errorf("invalid ICAP URL %s: invalid port", raw)
+		}
+	}
+	return service, nil
+}
+
+// addr returns the host:port address of the service
+func (s *icapService) addr() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.port))
+}
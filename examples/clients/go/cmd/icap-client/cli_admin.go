@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// adminServer serves metrics, health and build info for long-running modes
+type adminServer struct {
+	client    *icapclient.IcapClient
+	registry  *prometheus.Registry
+	readiness *readinessProbe
+	server    *http.Server
+}
+
+// newAdminRegistry creates the registry exposed on the admin listener, with
+// Go runtime and process metrics alongside the client metrics
+func newAdminRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector())
+	registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return registry
+}
+
+// newAdminServer creates the admin HTTP server for client. Profiling
+// endpoints under /debug/pprof/ are only served when enablePprof is set.
+func newAdminServer(client *icapclient.IcapClient, registry *prometheus.Registry, readiness *readinessProbe, enablePprof bool) *adminServer {
+	admin := &adminServer{
+		client:    client,
+		registry:  registry,
+		readiness: readiness,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/health", admin.handleHealth)
+	mux.HandleFunc("/healthz", admin.handleLiveness)
+	mux.HandleFunc("/readyz", admin.handleReadiness)
+	mux.HandleFunc("/debug/buildinfo", admin.handleBuildInfo)
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	admin.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return admin
+}
+
+// Start listens on addr and serves admin requests in the background
+func (a *adminServer) Start(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := a.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.client.Logger().Error("Admin server failed", "error", err)
+		}
+	}()
+
+	a.client.Logger().Info("Admin server listening", "addr", listener.Addr().String())
+	return listener.Addr(), nil
+}
+
+// Shutdown gracefully stops the admin server
+func (a *adminServer) Shutdown(ctx context.Context) error {
+	return a.server.Shutdown(ctx)
+}
+
+// startDaemonClient creates the client for a long-running mode and starts
+// the admin listener when configured. The returned function releases both.
+func startDaemonClient(config *icapclient.IcapConfig, opts *cliOptions) (*icapclient.IcapClient, func(), error) {
+	registry := newAdminRegistry()
+	readiness := newReadinessProbe(opts.readyTTL)
+	if opts.adminListen != "" {
+		config.MetricsEnabled = true
+		config.MetricsRegisterer = registry
+		readiness.chainHooks(&config.Hooks)
+	}
+
+	client := icapclient.NewIcapClient(config)
+	stopWatch := watchDaemonConfig(client, opts)
+	if opts.adminListen == "" {
+		shutdown := func() {
+			stopWatch()
+			client.Close()
+		}
+		return client, shutdown, nil
+	}
+	readiness.client = client
+
+	admin := newAdminServer(client, registry, readiness, opts.adminPprof)
+	if _, err := admin.Start(opts.adminListen); err != nil {
+		stopWatch()
+		client.Close()
+		return nil, nil, fmt.Errorf("failed to start admin server: %w", err)
+	}
+
+	shutdown := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopWatch()
+		admin.Shutdown(ctx)
+		client.Close()
+	}
+	return client, shutdown, nil
+}
+
+// watchDaemonConfig hot-reloads the client when the configuration file
+// changes, applying the overrides of the command line and of
+// startDaemonClient. The returned function stops watching.
+func watchDaemonConfig(client *icapclient.IcapClient, opts *cliOptions) func() {
+	if opts.configPath == "" {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := client.WatchConfig(ctx, opts.configPath, func() (*icapclient.IcapConfig, error) {
+		config, err := opts.loadConfig()
+		if err == nil && opts.adminListen != "" {
+			config.MetricsEnabled = true
+		}
+		return config, err
+	})
+	if err != nil {
+		client.Logger().Warn("Config hot reload disabled", "error", err)
+	}
+	return cancel
+}
+
+// handleHealth reports the ICAP backend health as JSON
+func (a *adminServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health, _ := a.client.HealthCheck(r.Context())
+
+	status := http.StatusOK
+	if health["status"] != "healthy" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, health)
+}
+
+// handleLiveness reports that the process is alive
+func (a *adminServer) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadiness reports whether the ICAP backend answered OPTIONS within the TTL
+func (a *adminServer) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	ready, last := a.readiness.Ready(r.Context())
+
+	result := map[string]interface{}{"ready": ready}
+	if !last.IsZero() {
+		result["last_options_success"] = last.UTC().Format(time.RFC3339)
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, result)
+}
+
+// handleBuildInfo reports the client version and Go build information
+func (a *adminServer) handleBuildInfo(w http.ResponseWriter, r *http.Request) {
+	info := map[string]interface{}{
+		"version":    icapclient.Version,
+		"go_version": runtime.Version(),
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info["module"] = build.Main.Path
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				info[setting.Key] = setting.Value
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+// writeJSON writes value as an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
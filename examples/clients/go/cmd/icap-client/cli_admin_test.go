@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// TestAdminServer tests the admin endpoints
+func TestAdminServer(t *testing.T) {
+	registry := newAdminRegistry()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:              "127.0.0.1",
+		Port:              1,
+		Timeout:           time.Second,
+		LoggingLevel:      "ERROR",
+		MetricsEnabled:    true,
+		MetricsRegisterer: registry,
+	})
+	defer client.Close()
+
+	admin := newAdminServer(client, registry, newReadinessProbe(time.Minute), false)
+	addr, err := admin.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start admin server: %v", err)
+	}
+	defer admin.Shutdown(context.Background())
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + addr.String() + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("/metrics")
+	if status != http.StatusOK || !strings.Contains(body, "icap_client_connection_pool_size") {
+		t.Errorf("Expected client metrics, got %d: %s", status, body)
+	}
+	if !strings.Contains(body, "go_goroutines") {
+		t.Error("Expected Go runtime metrics")
+	}
+
+	status, body = get("/health")
+	if status != http.StatusServiceUnavailable || !strings.Contains(body, "unhealthy") {
+		t.Errorf("Expected unhealthy backend, got %d: %s", status, body)
+	}
+
+	status, body = get("/debug/buildinfo")
+	var info map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &info); err != nil || status != http.StatusOK {
+		t.Fatalf("Expected build info JSON, got %d: %s", status, body)
+	}
+	if info["version"] != icapclient.Version {
+		t.Errorf("Expected version %s, got %v", icapclient.Version, info["version"])
+	}
+
+	if status, body = get("/healthz"); status != http.StatusOK || body != "ok\n" {
+		t.Errorf("Expected liveness ok, got %d: %s", status, body)
+	}
+
+	if status, body = get("/readyz"); status != http.StatusServiceUnavailable || !strings.Contains(body, `"ready": false`) {
+		t.Errorf("Expected unreachable backend to be not ready, got %d: %s", status, body)
+	}
+
+	if status, _ = get("/debug/pprof/"); status != http.StatusNotFound {
+		t.Errorf("Expected pprof to be disabled by default, got %d", status)
+	}
+}
+
+// TestAdminServer_Pprof tests the opt-in profiling endpoints
+func TestAdminServer_Pprof(t *testing.T) {
+	registry := newAdminRegistry()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	admin := newAdminServer(client, registry, newReadinessProbe(time.Minute), true)
+	addr, err := admin.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start admin server: %v", err)
+	}
+	defer admin.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr.String() + "/debug/pprof/heap?debug=1")
+	if err != nil {
+		t.Fatalf("GET heap profile failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "heap profile") {
+		t.Errorf("Expected heap profile, got %d", resp.StatusCode)
+	}
+}
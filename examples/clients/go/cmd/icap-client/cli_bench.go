@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/spf13/cobra"
+)
+
+// newBenchCommand creates the bench command, which load-tests the ICAP server
+func newBenchCommand(opts *cliOptions) *cobra.Command {
+	var requests int
+	var concurrency int
+	var payloadSize int
+	var histogramFile string
+
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Benchmark the ICAP server with the selected method",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if requests < 1 || concurrency < 1 {
+				return fmt.Errorf("requests and concurrency must be at least 1")
+			}
+
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+
+			client, shutdown, err := startDaemonClient(config, opts)
+			if err != nil {
+				return err
+			}
+			defer shutdown()
+
+			send, err := benchRequestFunc(client, opts.method, payloadSize)
+			if err != nil {
+				return err
+			}
+
+			bodySize := payloadSize
+			if opts.method == "options" {
+				bodySize = 0
+			}
+
+			recorder := newLatencyRecorder()
+			engine := newScanEngine(cmd.Context(), concurrency, concurrency)
+			for i := 0; i < requests; i++ {
+				err := engine.Submit(cmd.Context(), func(ctx context.Context) {
+					start := time.Now()
+					response, err := send(ctx)
+					recorder.Record(time.Since(start), bodySize, response, err)
+				})
+				if err != nil {
+					break
+				}
+			}
+			engine.Close()
+
+			recorder.PrintSummary(cmd.OutOrStdout())
+			if histogramFile != "" {
+				if err := recorder.WriteHistogram(histogramFile); err != nil {
+					return fmt.Errorf("failed to write histogram: %w", err)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVarP(&requests, "requests", "n", 100, "Total number of requests")
+	cmd.Flags().IntVarP(&concurrency, "concurrency", "c", 10, "Number of concurrent requests")
+	cmd.Flags().IntVar(&payloadSize, "size", 1024, "Body size in bytes for REQMOD/RESPMOD")
+	cmd.Flags().StringVar(&histogramFile, "histogram-file", "", "Write the latency distribution in HdrHistogram format")
+	return cmd
+}
+
+// benchRequestFunc returns a function sending one benchmark request for method
+func benchRequestFunc(client *icapclient.IcapClient, method string, payloadSize int) (func(context.Context) (*icapclient.IcapResponse, error), error) {
+	payload := bytes.Repeat([]byte("a"), payloadSize)
+
+	switch method {
+	case "options":
+		return client.Options, nil
+	case "reqmod":
+		return func(ctx context.Context) (*icapclient.IcapResponse, error) {
+			return client.Reqmod(ctx, &icapclient.HttpRequest{
+				Method:  "POST",
+				URI:     "/bench",
+				Version: "HTTP/1.1",
+				Headers: map[string]string{
+					"Host":           "bench.example.com",
+					"Content-Length": strconv.Itoa(len(payload)),
+				},
+				Body: payload,
+			})
+		}, nil
+	case "respmod":
+		return func(ctx context.Context) (*icapclient.IcapResponse, error) {
+			return client.Respmod(ctx, &icapclient.HttpResponse{
+				Version:    "HTTP/1.1",
+				StatusCode: 200,
+				Reason:     "OK",
+				Headers: map[string]string{
+					"Content-Type":   "application/octet-stream",
+					"Content-Length": strconv.Itoa(len(payload)),
+				},
+				Body: payload,
+			})
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown method %q", method)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/spf13/cobra"
+)
+
+// compareIgnoredHeaders are the ICAP response headers left out of the
+// diff, as they differ between any two servers or any two responses
+var compareIgnoredHeaders = map[string]bool{
+	"Date": true, "Connection": true, "Keep-Alive": true, "Encapsulated": true,
+	"Istag": true, "Server": true,
+}
+
+// compareSide is the answer of one server to a payload
+type compareSide struct {
+	Verdict   string            `json:"verdict"`
+	Status    int               `json:"status,omitempty"`
+	Threat    string            `json:"threat,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	LatencyMs float64           `json:"latency_ms"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// headerDiff is an ICAP response header the servers answered differently,
+// empty on the side that did not send it
+type headerDiff struct {
+	Name string `json:"name"`
+	A    string `json:"a"`
+	B    string `json:"b"`
+}
+
+// compareResult is the comparison of the answers to a payload
+type compareResult struct {
+	Path         string       `json:"path"`
+	A            compareSide  `json:"a"`
+	B            compareSide  `json:"b"`
+	SameVerdict  bool         `json:"same_verdict"`
+	HeaderDiffs  []headerDiff `json:"header_diffs,omitempty"`
+	LatencyDelta float64      `json:"latency_delta_ms"`
+}
+
+// newCompareCommand creates the compare command, which sends the same
+// payloads to two servers and diffs their answers
+func newCompareCommand(opts *cliOptions) *cobra.Command {
+	var urlA, urlB, input, method string
+	var concurrency int
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "compare --a <url> --b <url> --input <path>",
+		Short: "Send identical payloads to two ICAP services and diff verdicts, headers and latency",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if urlA == "" || urlB == "" || input == "" {
+				return fmt.Errorf("--a, --b and --input are required")
+			}
+			if concurrency < 1 {
+				return fmt.Errorf("concurrency must be at least 1")
+			}
+			method = strings.ToLower(method)
+			if method != "respmod" && method != "reqmod" {
+				return fmt.Errorf("unknown method %q, expected respmod or reqmod", method)
+			}
+			files, err := collectScanFiles([]string{input}, true)
+			if err != nil {
+				return err
+			}
+
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+			clientA, err := newCompareClient(config, urlA)
+			if err != nil {
+				return err
+			}
+			defer clientA.Close()
+			clientB, err := newCompareClient(config, urlB)
+			if err != nil {
+				return err
+			}
+			defer clientB.Close()
+
+			recorderA, recorderB := newLatencyRecorder(), newLatencyRecorder()
+			results := make([]compareResult, len(files))
+			engine := newScanEngine(cmd.Context(), concurrency, concurrency)
+			for i, path := range files {
+				i, path := i, path
+				err := engine.Submit(cmd.Context(), func(ctx context.Context) {
+					results[i] = comparePayload(ctx, compareTarget{clientA, recorderA}, compareTarget{clientB, recorderB}, method, path)
+				})
+				if err != nil {
+					break
+				}
+			}
+			engine.Close()
+			if err := cmd.Context().Err(); err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			if jsonOutput {
+				encoder := json.NewEncoder(out)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(results); err != nil {
+					return err
+				}
+			} else {
+				printComparison(out, results, recorderA, recorderB)
+			}
+
+			different := 0
+			for _, result := range results {
+				if !result.SameVerdict {
+					different++
+				}
+			}
+			if different > 0 {
+				return fmt.Errorf("%d of %d payloads got different verdicts", different, len(results))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&urlA, "a", "", "URL of the first ICAP service, e.g. icap://old:1344/respmod")
+	cmd.Flags().StringVar(&urlB, "b", "", "URL of the second ICAP service")
+	cmd.Flags().StringVar(&input, "input", "", "File or directory of payloads, walked recursively")
+	cmd.Flags().StringVar(&method, "method", "respmod", "ICAP method to send payloads with: respmod or reqmod")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of payloads compared in parallel")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the comparison as JSON")
+	return cmd
+}
+
+// newCompareClient creates a client of the service at raw, with the other
+// settings of config. The scan cache is disabled so that the server answers
+// every payload.
+func newCompareClient(config *icapclient.IcapConfig, raw string) (*icapclient.IcapClient, error) {
+	service, err := parseICAPService(raw)
+	if err != nil {
+		return nil, err
+	}
+	copied := *config
+	copied.Host, copied.Port = service.host, service.port
+	copied.TLS.Enabled = service.tls
+	if path := service.url.Path; path != "" && path != "/" {
+		copied.Services.Reqmod, copied.Services.Respmod, copied.Services.Options = path, path, path
+	}
+	copied.ScanCache.Enabled = false
+	return icapclient.NewIcapClient(&copied), nil
+}
+
+// compareTarget is a compared server, recording its latencies
+type compareTarget struct {
+	client   *icapclient.IcapClient
+	recorder *latencyRecorder
+}
+
+// comparePayload sends the file at path to both servers in turn and diffs
+// their answers
+func comparePayload(ctx context.Context, a, b compareTarget, method, path string) compareResult {
+	result := compareResult{Path: path}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		result.A.Error, result.B.Error = err.Error(), err.Error()
+		result.A.Verdict, result.B.Verdict = icapclient.VerdictError.String(), icapclient.VerdictError.String()
+		result.SameVerdict = true
+		return result
+	}
+
+	result.A = sendPayload(ctx, a, method, path, body)
+	result.B = sendPayload(ctx, b, method, path, body)
+	result.SameVerdict = result.A.Verdict == result.B.Verdict
+	result.LatencyDelta = result.B.LatencyMs - result.A.LatencyMs
+	result.HeaderDiffs = diffHeaders(result.A.Headers, result.B.Headers)
+	return result
+}
+
+// sendPayload scans body, read from path, on target
+func sendPayload(ctx context.Context, target compareTarget, method, path string, body []byte) compareSide {
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	headers := map[string]string{
+		"Content-Type":   contentType,
+		"Content-Length": strconv.Itoa(len(body)),
+	}
+
+	var verdict icapclient.Verdict
+	var response *icapclient.IcapResponse
+	var err error
+	start := time.Now()
+	if method == "reqmod" {
+		headers["Host"] = "compare.invalid"
+		verdict, response, err = target.client.ScanRequest(ctx, &icapclient.HttpRequest{
+			Method:  "POST",
+			URI:     "http://compare.invalid/" + filepath.Base(path),
+			Version: "HTTP/1.1",
+			Headers: headers,
+			Body:    body,
+		})
+	} else {
+		verdict, response, err = target.client.ScanResponse(ctx, &icapclient.HttpResponse{
+			Version:    "HTTP/1.1",
+			StatusCode: 200,
+			Reason:     "OK",
+			Headers:    headers,
+			Body:       body,
+		})
+	}
+
+	latency := time.Since(start)
+	target.recorder.Record(latency, len(body), response, err)
+	side := compareSide{Verdict: verdict.String(), LatencyMs: float64(latency.Microseconds()) / 1000}
+	if err != nil {
+		side.Error = err.Error()
+		return side
+	}
+	defer response.Close()
+
+	side.Status = response.StatusCode
+	if report := response.ThreatReport(); report != nil {
+		side.Threat = report.ThreatName
+	}
+	side.Headers = make(map[string]string, len(response.Headers))
+	for name, value := range response.Headers {
+		if name = http.CanonicalHeaderKey(name); !compareIgnoredHeaders[name] {
+			side.Headers[name] = value
+		}
+	}
+	return side
+}
+
+// diffHeaders returns the headers of a and b with different values, by name
+func diffHeaders(a, b map[string]string) []headerDiff {
+	var diffs []headerDiff
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			diffs = append(diffs, headerDiff{Name: name, A: value, B: other})
+		}
+	}
+	for name, value := range b {
+		if _, ok := a[name]; !ok {
+			diffs = append(diffs, headerDiff{Name: name, B: value})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs
+}
+
+// printComparison prints results for humans, followed by a summary
+func printComparison(w io.Writer, results []compareResult, recorderA, recorderB *latencyRecorder) {
+	differentVerdicts, differentHeaders := 0, 0
+	for _, result := range results {
+		marker := "same"
+		if !result.SameVerdict {
+			marker = "DIFFERENT VERDICT"
+			differentVerdicts++
+		}
+		if len(result.HeaderDiffs) > 0 {
+			differentHeaders++
+		}
+		fmt.Fprintf(w, "%s: a=%s b=%s %s\n", result.Path, describeSide(result.A), describeSide(result.B), marker)
+		for _, diff := range result.HeaderDiffs {
+			fmt.Fprintf(w, "  %s: a=%q b=%q\n", diff.Name, diff.A, diff.B)
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Payloads:   %d\n", len(results))
+	fmt.Fprintf(w, "Verdicts:   %d same, %d different\n", len(results)-differentVerdicts, differentVerdicts)
+	fmt.Fprintf(w, "Headers:    %d payloads with different headers\n", differentHeaders)
+	if len(results) > 0 {
+		fmt.Fprintf(w, "Latency a:  p50=%s p90=%s p99=%s\n", recorderA.quantile(50), recorderA.quantile(90), recorderA.quantile(99))
+		fmt.Fprintf(w, "Latency b:  p50=%s p90=%s p99=%s\n", recorderB.quantile(50), recorderB.quantile(90), recorderB.quantile(99))
+	}
+}
+
+// describeSide returns the verdict of side with its status, latency and
+// threat or error
+func describeSide(side compareSide) string {
+	if side.Error != "" {
+		return fmt.Sprintf("%s (%s)", side.Verdict, side.Error)
+	}
+	description := fmt.Sprintf("%s (%d, %.1fms", side.Verdict, side.Status, side.LatencyMs)
+	if side.Threat != "" {
+		description += ", " + side.Threat
+	}
+	return description + ")"
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestCompareCommand tests the comparison of a server detecting a payload
+// with one allowing everything
+func TestCompareCommand(t *testing.T) {
+	old := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if bytes.Contains(r.Body, []byte("virus")) {
+			w.Header().Set("X-Infection-Found", "Type=0; Resolution=2; Threat=Test-Virus;")
+			w.WriteHeader(200, &http.Response{StatusCode: 403, Status: "403 Forbidden", ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}}, false)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer old.Close()
+	upgraded := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.Header().Set("X-Engine", "v2")
+		w.WriteHeader(204, nil, false)
+	}))
+	defer upgraded.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "clean.txt"), []byte("hello"), 0o644)
+	os.WriteFile(filepath.Join(dir, "virus.txt"), []byte("a virus"), 0o644)
+
+	var out bytes.Buffer
+	cmd := newCompareCommand(&cliOptions{})
+	cmd.SetOut(&out)
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	cmd.SetArgs([]string{"--a", old.URL + "/respmod", "--b", upgraded.URL + "/respmod", "--input", dir, "--json"})
+	err := cmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 payloads got different verdicts") {
+		t.Errorf("Expected 1 of 2 different verdicts, got %v", err)
+	}
+
+	var results []compareResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("Failed to decode results: %v\n%s", err, out.String())
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %+v", results)
+	}
+	clean, virus := results[0], results[1]
+	if !clean.SameVerdict || clean.A.Verdict != "allowed" {
+		t.Errorf("Expected the clean payload allowed by both, got %+v", clean)
+	}
+	if virus.SameVerdict || virus.A.Verdict != "blocked" || virus.B.Verdict != "allowed" || virus.A.Threat != "Test-Virus" {
+		t.Errorf("Expected the virus blocked by a only, got %+v", virus)
+	}
+	names := map[string]bool{}
+	for _, diff := range virus.HeaderDiffs {
+		names[diff.Name] = true
+	}
+	if !names["X-Infection-Found"] || !names["X-Engine"] || names["Istag"] {
+		t.Errorf("Expected X-Infection-Found and X-Engine to differ, got %+v", virus.HeaderDiffs)
+	}
+}
+
+// TestPrintComparison tests the human report
+func TestPrintComparison(t *testing.T) {
+	results := []compareResult{
+		{Path: "a.txt", A: compareSide{Verdict: "allowed", Status: 204}, B: compareSide{Verdict: "allowed", Status: 204}, SameVerdict: true},
+		{
+			Path: "b.txt", A: compareSide{Verdict: "blocked", Status: 200, Threat: "EICAR"}, B: compareSide{Verdict: "error", Error: "timeout"},
+			HeaderDiffs: []headerDiff{{Name: "X-Virus-ID", A: "EICAR"}},
+		},
+	}
+	recorder := newLatencyRecorder()
+	var out bytes.Buffer
+	printComparison(&out, results, recorder, recorder)
+	for _, expected := range []string{
+		"b.txt: a=blocked (200, 0.0ms, EICAR) b=error (timeout) DIFFERENT VERDICT",
+		`X-Virus-ID: a="EICAR" b=""`,
+		"Verdicts:   1 same, 1 different",
+		"Latency b:",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// errNoResponse is returned when the server closes the connection without
+// answering
+var errNoResponse = errors.New("connection closed without a response")
+
+// notApplicable is returned by a check the server does not support, giving
+// the reason
+type notApplicable string
+
+func (n notApplicable) Error() string { return string(n) }
+
+// conformanceCheck is one RFC 3507 behaviour verified against the server
+type conformanceCheck struct {
+	name string
+	run  func(c *conformanceChecker) error
+}
+
+// conformanceChecks are the checks of the report, in order
+var conformanceChecks = []conformanceCheck{
+	{"OPTIONS status", checkOptionsStatus},
+	{"OPTIONS Methods", checkOptionsMethods},
+	{"OPTIONS ISTag", checkOptionsISTag},
+	{"OPTIONS Encapsulated", checkOptionsEncapsulated},
+	{"Preview advertised", checkPreviewAdvertised},
+	{"Preview 100 Continue", checkPreviewContinue},
+	{"Preview ieof", checkPreviewIEOF},
+	{"204 with Allow: 204", check204Allowed},
+	{"No 204 without Allow: 204", checkNo204WithoutAllow},
+	{"Chunked framing", checkChunkedFraming},
+	{"Keep-alive", checkKeepAlive},
+	{"Malformed request line", checkMalformedRequestLine},
+	{"Unknown method", checkUnknownMethod},
+	{"Unsupported ICAP version", checkUnsupportedVersion},
+	{"Missing Encapsulated", checkMissingEncapsulated},
+	{"Invalid chunk size", checkInvalidChunkSize},
+	{"Unknown service", checkUnknownService},
+}
+
+// conformanceResult is the outcome of a check
+type conformanceResult struct {
+	Name string `json:"name"`
+	// Status is pass, fail or skip
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// conformanceReport is the compliance report of a server
+type conformanceReport struct {
+	URL     string              `json:"url"`
+	Passed  int                 `json:"passed"`
+	Failed  int                 `json:"failed"`
+	Skipped int                 `json:"skipped"`
+	Checks  []conformanceResult `json:"checks"`
+}
+
+// newConformanceCommand creates the conformance command, which runs
+// protocol tests against an ICAP server and reports its compliance
+func newConformanceCommand() *cobra.Command {
+	var jsonOutput, insecure bool
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "conformance <url>",
+		Short: "Check an ICAP service against RFC 3507",
+		Long: "Runs protocol tests against the ICAP service at url, e.g. icap://host:1344/respmod: " +
+			"OPTIONS headers, preview handling, 204 negotiation, chunked framing, keep-alive and " +
+			"the handling of malformed requests, and prints a pass/fail report.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			checker, err := newConformanceChecker(args[0], timeout, insecure)
+			if err != nil {
+				return err
+			}
+			report := checker.run()
+
+			out := cmd.OutOrStdout()
+			if jsonOutput {
+				encoder := json.NewEncoder(out)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(report); err != nil {
+					return err
+				}
+			} else {
+				printConformance(out, report)
+			}
+			if report.Failed > 0 {
+				return fmt.Errorf("%d of %d checks failed", report.Failed, len(report.Checks))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+	cmd.Flags().BoolVar(&insecure, "insecure", false, "Skip verification of the server certificate of icaps URLs")
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Second, "Timeout of each exchange with the server")
+	return cmd
+}
+
+// printConformance prints report for humans
+func printConformance(w io.Writer, report *conformanceReport) {
+	fmt.Fprintf(w, "RFC 3507 conformance of %s\n\n", report.URL)
+	for _, result := range report.Checks {
+		line := fmt.Sprintf("  %-4s  %-26s", strings.ToUpper(result.Status), result.Name)
+		if result.Detail != "" {
+			line += "  " + result.Detail
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+	fmt.Fprintf(w, "\n%d passed, %d failed, %d skipped\n", report.Passed, report.Failed, report.Skipped)
+}
+
+// conformanceChecker runs the checks against an ICAP service over raw
+// connections, so that it controls every byte sent
+type conformanceChecker struct {
+	service *url.URL
+	addr    string
+	tls     *tls.Config
+	timeout time.Duration
+
+	// options is the OPTIONS response of the service, fetched once
+	options    *wireResponse
+	optionsErr error
+}
+
+// newConformanceChecker creates a checker of the service at raw, an icap or
+// icaps URL
+func newConformanceChecker(raw string, timeout time.Duration, insecure bool) (*conformanceChecker, error) {
+	service, err := parseICAPService(raw)
+	if err != nil {
+		return nil, err
+	}
+	c := &conformanceChecker{service: service.url, addr: service.addr(), timeout: timeout}
+	if service.tls {
+		c.tls = &tls.Config{ServerName: service.host, InsecureSkipVerify: insecure}
+	}
+	return c, nil
+}
+
+// run runs every check, in order
+func (c *conformanceChecker) run() *conformanceReport {
+	report := &conformanceReport{URL: c.service.String()}
+	for _, check := range conformanceChecks {
+		result := conformanceResult{Name: check.name, Status: "pass"}
+		var skip notApplicable
+		switch err := check.run(c); {
+		case err == nil:
+			report.Passed++
+		case errors.As(err, &skip):
+			result.Status, result.Detail = "skip", err.Error()
+			report.Skipped++
+		default:
+			result.Status, result.Detail = "fail", err.Error()
+			report.Failed++
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+// wireConn is a connection to the server
+type wireConn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+}
+
+// dial connects to the server
+func (c *conformanceChecker) dial() (*wireConn, error) {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wireConn{Conn: conn, br: bufio.NewReader(conn), timeout: c.timeout}, nil
+}
+
+// exchange sends request and reads the response
+func (w *wireConn) exchange(request string) (*wireResponse, error) {
+	w.SetDeadline(time.Now().Add(w.timeout))
+	if _, err := io.WriteString(w, request); err != nil {
+		return nil, err
+	}
+	return readWireResponse(w.br)
+}
+
+// roundTrip sends request on a new connection and reads the response
+func (c *conformanceChecker) roundTrip(request string) (*wireResponse, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.exchange(request)
+}
+
+// wireResponse is an ICAP response as read off the wire
+type wireResponse struct {
+	Status int
+	Reason string
+	Header textproto.MIMEHeader
+	// HTTPHeader holds the encapsulated HTTP headers and Body the
+	// encapsulated body, if any
+	HTTPHeader []byte
+	Body       []byte
+	HasBody    bool
+}
+
+func (r *wireResponse) String() string {
+	return fmt.Sprintf("%d %s", r.Status, r.Reason)
+}
+
+// readWireResponse reads an ICAP response from br, strictly checking its
+// framing
+func readWireResponse(br *bufio.Reader) (*wireResponse, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+			return nil, errNoResponse
+		}
+		return nil, fmt.Errorf("no response: %w", err)
+	}
+	version, rest, _ := strings.Cut(line, " ")
+	codeText, reason, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeText)
+	if version != "ICAP/1.0" || len(codeText) != 3 || err != nil {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("malformed headers: %w", err)
+	}
+	response := &wireResponse{Status: code, Reason: reason, Header: header}
+	encapsulated := header.Get("Encapsulated")
+	if code == 100 || encapsulated == "" {
+		return response, nil
+	}
+
+	sections, err := parseWireEncapsulated(encapsulated)
+	if err != nil {
+		return nil, err
+	}
+	last := sections[len(sections)-1]
+	response.HTTPHeader = make([]byte, last.offset)
+	if _, err := io.ReadFull(br, response.HTTPHeader); err != nil {
+		return nil, fmt.Errorf("short encapsulated headers: %w", err)
+	}
+	if last.name == "null-body" {
+		return response, nil
+	}
+	response.HasBody = true
+	if response.Body, err = io.ReadAll(httputil.NewChunkedReader(br)); err != nil {
+		return nil, fmt.Errorf("malformed chunked body: %w", err)
+	}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, fmt.Errorf("malformed chunked body: %w", err)
+		}
+		if line == "" {
+			return response, nil
+		}
+	}
+}
+
+// wireSection is an entry of the Encapsulated header
+type wireSection struct {
+	name   string
+	offset int
+}
+
+// parseWireEncapsulated parses an Encapsulated header, requiring ascending
+// offsets and a last body or null-body entry
+func parseWireEncapsulated(value string) ([]wireSection, error) {
+	var sections []wireSection
+	for _, entry := range strings.Split(value, ",") {
+		name, offsetText, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		offset, err := strconv.Atoi(offsetText)
+		if !ok || err != nil || offset < 0 || (len(sections) > 0 && offset < sections[len(sections)-1].offset) {
+			return nil, fmt.Errorf("malformed Encapsulated header %q", value)
+		}
+		sections = append(sections, wireSection{name: strings.ToLower(name), offset: offset})
+	}
+	if !strings.HasSuffix(sections[len(sections)-1].name, "-body") {
+		return nil, fmt.Errorf("Encapsulated header %q does not end with a body", value)
+	}
+	return sections, nil
+}
+
+// head returns the request line and headers of an ICAP request to target
+func (c *conformanceChecker) head(method, target string, headers ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s ICAP/1.0\r\nHost: %s\r\n", method, target, c.service.Host)
+	for _, header := range headers {
+		b.WriteString(header + "\r\n")
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// optionsResponse returns the OPTIONS response of the service
+func (c *conformanceChecker) optionsResponse() (*wireResponse, error) {
+	if c.options == nil && c.optionsErr == nil {
+		c.options, c.optionsErr = c.roundTrip(c.head("OPTIONS", c.service.String(), "Encapsulated: null-body=0"))
+	}
+	return c.options, c.optionsErr
+}
+
+// scanMethod returns the method the service supports for body checks,
+// RESPMOD unless it only advertises REQMOD
+func (c *conformanceChecker) scanMethod() string {
+	if options, err := c.optionsResponse(); err == nil {
+		methods := strings.ToUpper(options.Header.Get("Methods"))
+		if !strings.Contains(methods, "RESPMOD") && strings.Contains(methods, "REQMOD") {
+			return "REQMOD"
+		}
+	}
+	return "RESPMOD"
+}
+
+// preview returns the preview size advertised by the service
+func (c *conformanceChecker) preview() (int, error) {
+	options, err := c.optionsResponse()
+	if err != nil {
+		return 0, err
+	}
+	value := options.Header.Get("Preview")
+	if value == "" {
+		return 0, notApplicable("no Preview advertised")
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid Preview header %q", value)
+	}
+	return n, nil
+}
+
+// scanHead returns the ICAP head and encapsulated HTTP headers of a scan of
+// a body of size bytes, with extra ICAP headers
+func (c *conformanceChecker) scanHead(size int, extra ...string) string {
+	var message, encapsulated string
+	method := c.scanMethod()
+	if method == "REQMOD" {
+		message = fmt.Sprintf("POST http://conformance.invalid/upload HTTP/1.1\r\nHost: conformance.invalid\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n", size)
+		encapsulated = fmt.Sprintf("req-hdr=0, req-body=%d", len(message))
+	} else {
+		request := "GET http://conformance.invalid/download HTTP/1.1\r\nHost: conformance.invalid\r\n\r\n"
+		message = request + fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n", size)
+		encapsulated = fmt.Sprintf("req-hdr=0, res-hdr=%d, res-body=%d", len(request), len(message))
+	}
+	headers := append([]string{"Encapsulated: " + encapsulated}, extra...)
+	return c.head(method, c.service.String(), headers...) + message
+}
+
+// conformanceBody returns a clean body of size bytes
+func conformanceBody(size int) []byte {
+	return bytes.Repeat([]byte("conformance "), size/12+1)[:size]
+}
+
+// chunks returns body as chunks of at most size bytes, without the last
+// chunk
+func chunks(body []byte, size int) string {
+	var b strings.Builder
+	for len(body) > 0 {
+		n := min(size, len(body))
+		fmt.Fprintf(&b, "%x\r\n%s\r\n", n, body[:n])
+		body = body[n:]
+	}
+	return b.String()
+}
+
+// expectClean requires response to allow body unmodified, with 204 when
+// allow204 is set or 200 echoing it
+func expectClean(response *wireResponse, body []byte, allow204 bool) error {
+	switch {
+	case response.Status == 204 && allow204:
+		return nil
+	case response.Status == 204:
+		return fmt.Errorf("204 although the request has no Allow: 204")
+	case response.Status != 200:
+		return fmt.Errorf("expected 200 or 204, got %s", response)
+	case !response.HasBody:
+		return fmt.Errorf("200 without the encapsulated body")
+	case !bytes.Equal(response.Body, body):
+		return fmt.Errorf("200 with a modified body of %d bytes, sent %d", len(response.Body), len(body))
+	}
+	return nil
+}
+
+// expectStatus requires response to have one of codes
+func expectStatus(response *wireResponse, err error, codes ...int) error {
+	if err != nil {
+		return err
+	}
+	texts := make([]string, len(codes))
+	for i, code := range codes {
+		if response.Status == code {
+			return nil
+		}
+		texts[i] = strconv.Itoa(code)
+	}
+	return fmt.Errorf("expected %s, got %s", strings.Join(texts, " or "), response)
+}
+
+// checkOptionsStatus requires OPTIONS to be answered 200
+func checkOptionsStatus(c *conformanceChecker) error {
+	options, err := c.optionsResponse()
+	return expectStatus(options, err, 200)
+}
+
+// checkOptionsMethods requires OPTIONS to advertise REQMOD or RESPMOD
+func checkOptionsMethods(c *conformanceChecker) error {
+	options, err := c.optionsResponse()
+	if err != nil {
+		return err
+	}
+	methods := options.Header.Get("Methods")
+	if methods == "" {
+		return fmt.Errorf("missing Methods header")
+	}
+	for _, method := range strings.Split(methods, ",") {
+		if method = strings.TrimSpace(method); method == "REQMOD" || method == "RESPMOD" {
+			return nil
+		}
+	}
+	return fmt.Errorf("Methods %q has neither REQMOD nor RESPMOD", methods)
+}
+
+// checkOptionsISTag requires OPTIONS to return a quoted ISTag of at most 32
+// bytes
+func checkOptionsISTag(c *conformanceChecker) error {
+	options, err := c.optionsResponse()
+	if err != nil {
+		return err
+	}
+	istag := options.Header.Get("ISTag")
+	switch {
+	case istag == "":
+		return fmt.Errorf("missing ISTag header")
+	case len(istag) < 2 || istag[0] != '"' || istag[len(istag)-1] != '"':
+		return fmt.Errorf("ISTag %s is not a quoted string", istag)
+	case len(istag)-2 > 32:
+		return fmt.Errorf("ISTag %s is longer than 32 bytes", istag)
+	}
+	return nil
+}
+
+// checkOptionsEncapsulated requires OPTIONS to return an Encapsulated
+// header with a null-body or opt-body
+func checkOptionsEncapsulated(c *conformanceChecker) error {
+	options, err := c.optionsResponse()
+	if err != nil {
+		return err
+	}
+	encapsulated := options.Header.Get("Encapsulated")
+	if encapsulated == "" {
+		return fmt.Errorf("missing Encapsulated header")
+	}
+	if !strings.HasPrefix(encapsulated, "null-body=") && !strings.HasPrefix(encapsulated, "opt-body=") {
+		return fmt.Errorf("expected null-body or opt-body, got Encapsulated %q", encapsulated)
+	}
+	return nil
+}
+
+// checkPreviewAdvertised requires a valid Preview header
+func checkPreviewAdvertised(c *conformanceChecker) error {
+	_, err := c.preview()
+	return err
+}
+
+// checkPreviewContinue sends a preview of a larger body, requiring 100
+// Continue followed by a clean answer, or a final answer right away
+func checkPreviewContinue(c *conformanceChecker) error {
+	preview, err := c.preview()
+	if err != nil {
+		return err
+	}
+	body := conformanceBody(2*preview + 16)
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request := c.scanHead(len(body), fmt.Sprintf("Preview: %d", preview), "Allow: 204")
+	response, err := conn.exchange(request + chunks(body[:preview], 4096) + "0\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	switch response.Status {
+	case 100:
+	case 200, 204:
+		return nil
+	default:
+		return fmt.Errorf("expected 100, 200 or 204 after the preview, got %s", response)
+	}
+	response, err = conn.exchange(chunks(body[preview:], 4096) + "0\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	return expectClean(response, body, true)
+}
+
+// checkPreviewIEOF sends a whole body as the preview, ended with ieof,
+// requiring a final answer without 100 Continue
+func checkPreviewIEOF(c *conformanceChecker) error {
+	preview, err := c.preview()
+	if err != nil {
+		return err
+	}
+	body := conformanceBody(min(preview, 32))
+	request := c.scanHead(len(body), fmt.Sprintf("Preview: %d", preview), "Allow: 204")
+	response, err := c.roundTrip(request + chunks(body, 4096) + "0; ieof\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	if response.Status == 100 {
+		return fmt.Errorf("100 Continue after ieof")
+	}
+	return expectClean(response, body, true)
+}
+
+// check204Allowed sends a clean body with Allow: 204, requiring 204 or 200
+// echoing it
+func check204Allowed(c *conformanceChecker) error {
+	body := conformanceBody(64)
+	response, err := c.roundTrip(c.scanHead(len(body), "Allow: 204") + chunks(body, 4096) + "0\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	return expectClean(response, body, true)
+}
+
+// checkNo204WithoutAllow sends a clean body without Allow: 204, requiring
+// 200 echoing it
+func checkNo204WithoutAllow(c *conformanceChecker) error {
+	body := conformanceBody(64)
+	response, err := c.roundTrip(c.scanHead(len(body)) + chunks(body, 4096) + "0\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	return expectClean(response, body, false)
+}
+
+// checkChunkedFraming sends a 256 KiB body in chunks of varied sizes, with
+// upper-case sizes and a chunk extension, requiring it echoed in a well
+// framed chunked body
+func checkChunkedFraming(c *conformanceChecker) error {
+	body := conformanceBody(256<<10 + 3)
+	var b strings.Builder
+	sizes := []int{1, 17, 4096, 65535, 3}
+	for rest, i := body, 0; len(rest) > 0; i++ {
+		n := min(sizes[i%len(sizes)], len(rest))
+		extension := ""
+		if i == 0 {
+			extension = `; conformance="chunk"`
+		}
+		fmt.Fprintf(&b, "%X%s\r\n%s\r\n", n, extension, rest[:n])
+		rest = rest[n:]
+	}
+	response, err := c.roundTrip(c.scanHead(len(body)) + b.String() + "0\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	return expectClean(response, body, false)
+}
+
+// checkKeepAlive requires two requests to be answered on one connection
+func checkKeepAlive(c *conformanceChecker) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request := c.head("OPTIONS", c.service.String(), "Encapsulated: null-body=0")
+	response, err := conn.exchange(request)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(response.Header.Get("Connection"), "close") {
+		return notApplicable("server closes connections")
+	}
+	if response, err = conn.exchange(request); err != nil {
+		return fmt.Errorf("second request: %w", err)
+	}
+	return expectStatus(response, nil, 200)
+}
+
+// checkMalformedRequestLine requires 400 to a request line that is not ICAP
+func checkMalformedRequestLine(c *conformanceChecker) error {
+	response, err := c.roundTrip("NOT AN ICAP REQUEST\r\n\r\n")
+	return expectStatus(response, err, 400)
+}
+
+// checkUnknownMethod requires 501 or 405 to an unknown method
+func checkUnknownMethod(c *conformanceChecker) error {
+	response, err := c.roundTrip(c.head("CONFORM", c.service.String(), "Encapsulated: null-body=0"))
+	return expectStatus(response, err, 501, 405)
+}
+
+// checkUnsupportedVersion requires 505 or 400 to an ICAP/2.0 request
+func checkUnsupportedVersion(c *conformanceChecker) error {
+	request := strings.Replace(c.head("OPTIONS", c.service.String(), "Encapsulated: null-body=0"), "ICAP/1.0", "ICAP/2.0", 1)
+	response, err := c.roundTrip(request)
+	return expectStatus(response, err, 505, 400)
+}
+
+// checkMissingEncapsulated requires 400 to a scan without Encapsulated
+func checkMissingEncapsulated(c *conformanceChecker) error {
+	response, err := c.roundTrip(c.head(c.scanMethod(), c.service.String()))
+	return expectStatus(response, err, 400)
+}
+
+// checkInvalidChunkSize requires 400, or the connection to be closed, on a
+// chunk size that is not hexadecimal
+func checkInvalidChunkSize(c *conformanceChecker) error {
+	response, err := c.roundTrip(c.scanHead(3) + "zz\r\nabc\r\n0\r\n\r\n")
+	if errors.Is(err, errNoResponse) {
+		return nil
+	}
+	return expectStatus(response, err, 400)
+}
+
+// checkUnknownService requires 404 to OPTIONS on a service that does not
+// exist
+func checkUnknownService(c *conformanceChecker) error {
+	missing := *c.service
+	missing.Path, missing.RawPath, missing.RawQuery = "/icap-conformance-missing", "", ""
+	response, err := c.roundTrip(c.head("OPTIONS", missing.String(), "Encapsulated: null-body=0"))
+	return expectStatus(response, err, 404)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// compliantHandler answers as RFC 3507 requires for the checks the icaptest
+// server leaves to its handler
+func compliantHandler(w icaptest.ResponseWriter, r *icaptest.Request) {
+	switch {
+	case r.URL.Path != "/respmod":
+		w.WriteHeader(404, nil, false)
+	case r.Method == "OPTIONS":
+		w.Header().Set("Methods", "RESPMOD")
+		w.Header().Set("ISTag", `"conformance-1"`)
+		w.Header().Set("Preview", "128")
+		w.WriteHeader(200, nil, false)
+	case r.Method != "RESPMOD":
+		w.WriteHeader(501, nil, false)
+	case r.Response == nil:
+		w.WriteHeader(400, nil, false)
+	case strings.Contains(r.Header.Get("Allow"), "204"):
+		w.WriteHeader(204, nil, false)
+	default:
+		w.WriteHeader(200, r.Response, true)
+		w.Write(r.Body)
+	}
+}
+
+// conformanceStatuses returns the status of each check of report by name
+func conformanceStatuses(report *conformanceReport) map[string]string {
+	statuses := make(map[string]string)
+	for _, result := range report.Checks {
+		statuses[result.Name] = result.Status
+	}
+	return statuses
+}
+
+// TestConformanceChecker tests the report on a compliant service
+func TestConformanceChecker(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(compliantHandler))
+	defer server.Close()
+
+	checker, err := newConformanceChecker(server.URL+"/respmod", 5*time.Second, false)
+	if err != nil {
+		t.Fatalf("Failed to create checker: %v", err)
+	}
+	report := checker.run()
+	statuses := conformanceStatuses(report)
+	for _, name := range []string{
+		"OPTIONS status", "OPTIONS ISTag", "Preview 100 Continue", "Preview ieof",
+		"204 with Allow: 204", "No 204 without Allow: 204", "Chunked framing",
+		"Keep-alive", "Unknown method", "Unknown service",
+	} {
+		if statuses[name] != "pass" {
+			t.Errorf("Expected %s to pass, got %+v", name, report.Checks)
+		}
+	}
+
+	var out bytes.Buffer
+	printConformance(&out, report)
+	if !strings.Contains(out.String(), "PASS  Chunked framing") || !strings.Contains(out.String(), " passed, ") {
+		t.Errorf("Unexpected report:\n%s", out.String())
+	}
+}
+
+// TestConformanceChecker_Failures tests the report on a service answering
+// 204 to everything
+func TestConformanceChecker_Failures(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	checker, _ := newConformanceChecker(server.URL+"/respmod", 5*time.Second, false)
+	report := checker.run()
+	statuses := conformanceStatuses(report)
+	for name, expected := range map[string]string{
+		"OPTIONS status":            "fail",
+		"Preview 100 Continue":      "skip",
+		"No 204 without Allow: 204": "fail",
+		"Unknown service":           "fail",
+	} {
+		if statuses[name] != expected {
+			t.Errorf("Expected %s to %s, got %q", name, expected, statuses[name])
+		}
+	}
+	if report.Failed == 0 || report.Passed+report.Failed+report.Skipped != len(conformanceChecks) {
+		t.Errorf("Unexpected counts %d passed, %d failed, %d skipped", report.Passed, report.Failed, report.Skipped)
+	}
+}
+
+// TestReadWireResponse tests the strict framing of responses
+func TestReadWireResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		body     string
+		valid    bool
+	}{
+		{"204", "ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n", "", true},
+		{"Chunked body", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\nHTTP/1.1 200 OK\r\n\r\n3\r\nabc\r\n2;x=y\r\nde\r\n0\r\n\r\n", "abcde", true},
+		{"Bad status line", "HTTP/1.1 200 OK\r\n\r\n", "", false},
+		{"Bad Encapsulated", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=19, res-body=0\r\n\r\n", "", false},
+		{"Bad chunk size", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\nHTTP/1.1 200 OK\r\n\r\nzz\r\nabc\r\n0\r\n\r\n", "", false},
+		{"Closed", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := readWireResponse(bufio.NewReader(strings.NewReader(tt.response)))
+			if (err == nil) != tt.valid {
+				t.Fatalf("Expected valid=%v, got %v", tt.valid, err)
+			}
+			if tt.valid && string(response.Body) != tt.body {
+				t.Errorf("Expected body %q, got %q", tt.body, response.Body)
+			}
+		})
+	}
+}
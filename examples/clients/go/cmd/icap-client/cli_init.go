@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/spf13/cobra"
+)
+
+// initOptions are the choices written into a starter configuration
+type initOptions struct {
+	Host          string
+	Port          int
+	Auth          string
+	TLS           bool
+	ServerName    string
+	Pins          []string
+	ReqmodPath    string
+	RespmodPath   string
+	OptionsPath   string
+	SecretsDir    string
+	PortFromFlags bool
+}
+
+// initConfigTemplate is the starter configuration written by init
+var initConfigTemplate = template.Must(template.New("config").Parse(`# G3ICAP Go client configuration, generated by icap-client init.
+# Durations are Go durations such as 500ms, 30s or 2m.
+
+# ICAP server
+host: {{printf "%q" .Host}}
+port: {{.Port}}
+
+# ICAP service path of each method, e.g. /avscan or /echo
+services:
+  reqmod: {{printf "%q" .ReqmodPath}}
+  respmod: {{printf "%q" .RespmodPath}}
+  options: {{printf "%q" .OptionsPath}}
+
+# Each request is bounded by timeout across its retries, and each attempt
+# by attempt_timeout; failed requests are retried with exponential backoff
+# from retry_delay up to max_retry_delay
+timeout: 30s
+attempt_timeout: 10s
+retries: 3
+retry_delay: 1s
+max_retry_delay: 60s
+backoff_factor: 2.0
+
+# Persistent connections kept for reuse
+connection_pool_size: 10
+keep_alive: true
+
+# DEBUG, INFO, WARN or ERROR
+logging_level: INFO
+metrics_enabled: true
+{{- if ne .Auth "none"}}
+
+# Credentials are read from files mounted from Kubernetes or Docker
+# secrets; replace a *_file key with the key itself to inline a value
+authentication:
+  method: {{.Auth}}
+{{- if eq .Auth "basic"}}
+  username: icap
+  password_file: {{.SecretsDir}}/icap_password
+{{- else if eq .Auth "bearer"}}
+  token_file: {{.SecretsDir}}/icap_token
+{{- else if eq .Auth "jwt"}}
+  jwt_token_file: {{.SecretsDir}}/icap_jwt
+{{- else if eq .Auth "api_key"}}
+  api_key_file: {{.SecretsDir}}/icap_api_key
+  header_name: X-API-Key
+{{- end}}
+{{- end}}
+
+# ICAPS: TLS to the ICAP server
+verify_ssl: true
+tls:
+  enabled: {{.TLS}}
+{{- if .TLS}}
+  # Name verified in the server certificate, when connecting by IP address
+  server_name: {{printf "%q" .ServerName}}
+  min_version: "1.2"
+{{- if .Pins}}
+  # SHA-256 of a server certificate or its public key
+  pinned_sha256:
+{{- range .Pins}}
+    - {{printf "%q" .}}
+{{- end}}
+{{- else}}
+  # Pin the SHA-256 of a server certificate or its public key:
+  # pinned_sha256:
+  #   - "sha256/..."
+{{- end}}
+{{- end}}
+`))
+
+// newInitCommand creates the init command, which writes a commented starter
+// configuration
+func newInitCommand(opts *cliOptions) *cobra.Command {
+	choices := &initOptions{}
+	var output string
+	var interactive bool
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Write a commented starter configuration",
+		Long: "Write a commented starter configuration for the chosen authentication method, " +
+			"TLS setup and service paths, from flags or, with --interactive, from prompts",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			choices.Host, choices.Port = opts.host, opts.port
+			choices.PortFromFlags = cmd.Flags().Changed("port")
+			if interactive {
+				if err := choices.prompt(cmd.InOrStdin(), cmd.OutOrStdout()); err != nil {
+					return err
+				}
+			}
+
+			config, err := choices.render()
+			if err != nil {
+				return err
+			}
+
+			if output == "-" {
+				_, err := cmd.OutOrStdout().Write(config)
+				return err
+			}
+			flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+			if force {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			}
+			file, err := os.OpenFile(output, flags, 0o600)
+			if errors.Is(err, os.ErrExist) {
+				return fmt.Errorf("%s already exists, use --force to overwrite it", output)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write config: %w", err)
+			}
+			if _, err := file.Write(config); err != nil {
+				file.Close()
+				return fmt.Errorf("failed to write config: %w", err)
+			}
+			if err := file.Close(); err != nil {
+				return fmt.Errorf("failed to write config: %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Wrote %s, use it with --config %s\n", output, output)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "icap-client.yaml", "Config file to write, or - for stdout")
+	cmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "Prompt for each setting")
+	cmd.Flags().BoolVar(&force, "force", false, "Overwrite an existing config file")
+	cmd.Flags().StringVar(&choices.Auth, "auth", "none", "Authentication method: none, basic, bearer, jwt or api_key")
+	cmd.Flags().BoolVar(&choices.TLS, "tls", false, "Connect with ICAPS (TLS), on port 11344 unless --port is set")
+	cmd.Flags().StringVar(&choices.ServerName, "tls-server-name", "", "Name verified in the server certificate")
+	cmd.Flags().StringSliceVar(&choices.Pins, "tls-pin", nil, "SHA-256 pin of the server certificate or public key (repeatable)")
+	cmd.Flags().StringVar(&choices.ReqmodPath, "reqmod-service", "/reqmod", "REQMOD service path")
+	cmd.Flags().StringVar(&choices.RespmodPath, "respmod-service", "/respmod", "RESPMOD service path")
+	cmd.Flags().StringVar(&choices.OptionsPath, "options-service", "/options", "OPTIONS service path")
+	cmd.Flags().StringVar(&choices.SecretsDir, "secrets-dir", "/run/secrets", "Directory of the credential files")
+	return cmd
+}
+
+// prompt asks for each setting on out, reading answers from in. An empty
+// answer keeps the current value.
+func (o *initOptions) prompt(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	ask := func(question, current string) string {
+		fmt.Fprintf(out, "%s [%s]: ", question, current)
+		if !scanner.Scan() {
+			return current
+		}
+		if answer := strings.TrimSpace(scanner.Text()); answer != "" {
+			return answer
+		}
+		return current
+	}
+
+	o.Host = ask("ICAP server host", o.Host)
+	o.TLS = strings.HasPrefix(strings.ToLower(ask("Use ICAPS (TLS)? y/n", yesNo(o.TLS))), "y")
+	if o.TLS && !o.PortFromFlags {
+		o.Port = 11344
+	}
+	port, err := strconv.Atoi(ask("ICAP server port", strconv.Itoa(o.Port)))
+	if err != nil {
+		return fmt.Errorf("invalid port: %w", err)
+	}
+	o.Port, o.PortFromFlags = port, true
+	if o.TLS {
+		o.ServerName = ask("TLS server name (empty to verify the host)", o.ServerName)
+	}
+	o.Auth = ask("Authentication method (none, basic, bearer, jwt, api_key)", o.Auth)
+	o.ReqmodPath = ask("REQMOD service path", o.ReqmodPath)
+	o.RespmodPath = ask("RESPMOD service path", o.RespmodPath)
+	o.OptionsPath = ask("OPTIONS service path", o.OptionsPath)
+	return scanner.Err()
+}
+
+// render returns the starter configuration
+func (o *initOptions) render() ([]byte, error) {
+	o.Auth = strings.ToLower(o.Auth)
+	switch icapclient.AuthenticationMethod(o.Auth) {
+	case icapclient.AuthNone, icapclient.AuthBasic, icapclient.AuthBearer, icapclient.AuthJWT, icapclient.AuthAPIKey:
+	default:
+		return nil, fmt.Errorf("unknown authentication method %q, expected none, basic, bearer, jwt or api_key", o.Auth)
+	}
+	if o.TLS && !o.PortFromFlags {
+		o.Port = 11344
+	}
+	o.SecretsDir = strings.TrimRight(o.SecretsDir, "/")
+
+	var buf bytes.Buffer
+	if err := initConfigTemplate.Execute(&buf, o); err != nil {
+		return nil, fmt.Errorf("failed to render config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// yesNo formats a boolean as a prompt default
+func yesNo(value bool) string {
+	if value {
+		return "y"
+	}
+	return "n"
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// TestInitOptions_Render tests that every starter configuration loads and
+// validates once its secrets exist
+func TestInitOptions_Render(t *testing.T) {
+	secrets := t.TempDir()
+	for _, name := range []string{"icap_password", "icap_token", "icap_jwt", "icap_api_key"} {
+		if err := os.WriteFile(filepath.Join(secrets, name), []byte("secret\n"), 0o600); err != nil {
+			t.Fatalf("Failed to write secret: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		options      initOptions
+		expectedPort int
+		expectedAuth map[string]string
+	}{
+		{"plain", initOptions{Auth: "none"}, 1344, nil},
+		{"basic", initOptions{Auth: "basic"}, 1344, map[string]string{"method": "basic", "username": "icap", "password": "secret"}},
+		{"bearer", initOptions{Auth: "bearer"}, 1344, map[string]string{"method": "bearer", "token": "secret"}},
+		{"jwt", initOptions{Auth: "JWT"}, 1344, map[string]string{"method": "jwt", "jwt_token": "secret"}},
+		{"api key", initOptions{Auth: "api_key"}, 1344, map[string]string{"method": "api_key", "api_key": "secret", "header_name": "X-API-Key"}},
+		{"tls", initOptions{Auth: "none", TLS: true, ServerName: "icap.internal", Pins: []string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}}, 11344, nil},
+		{"tls with port", initOptions{Auth: "none", TLS: true, PortFromFlags: true}, 1344, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			options.Host, options.Port, options.SecretsDir = "icap.example.com", 1344, secrets+"/"
+			options.ReqmodPath, options.RespmodPath, options.OptionsPath = "/reqmod", "/avscan", "/options"
+
+			data, err := options.render()
+			if err != nil {
+				t.Fatalf("render failed: %v", err)
+			}
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			config, err := icapclient.LoadConfig(path)
+			if err != nil {
+				t.Fatalf("Generated config does not load: %v\n%s", err, data)
+			}
+			if config.Host != "icap.example.com" || config.Port != tt.expectedPort || config.Services.Respmod != "/avscan" {
+				t.Errorf("Unexpected server %s:%d, services %+v", config.Host, config.Port, config.Services)
+			}
+			if config.TLS.Enabled != options.TLS || len(config.TLS.PinnedSHA256) != len(options.Pins) {
+				t.Errorf("Unexpected TLS settings %+v", config.TLS)
+			}
+			for key, value := range tt.expectedAuth {
+				if config.Authentication[key] != value {
+					t.Errorf("Expected authentication %s %q, got %q", key, value, config.Authentication[key])
+				}
+			}
+		})
+	}
+
+	if _, err := (&initOptions{Auth: "kerberos"}).render(); err == nil {
+		t.Error("Expected error for unknown authentication method")
+	}
+}
+
+// TestInitOptions_Prompt tests the interactive prompts
+func TestInitOptions_Prompt(t *testing.T) {
+	options := &initOptions{Host: "127.0.0.1", Port: 1344, Auth: "none", ReqmodPath: "/reqmod", RespmodPath: "/respmod", OptionsPath: "/options"}
+	input := strings.NewReader("icap.example.com\ny\n\nicap.internal\nbearer\n\n/avscan\n")
+	var output bytes.Buffer
+
+	if err := options.prompt(input, &output); err != nil {
+		t.Fatalf("prompt failed: %v", err)
+	}
+	if options.Host != "icap.example.com" || !options.TLS || options.Port != 11344 || options.ServerName != "icap.internal" {
+		t.Errorf("Unexpected server settings %+v", options)
+	}
+	if options.Auth != "bearer" || options.ReqmodPath != "/reqmod" || options.RespmodPath != "/avscan" || options.OptionsPath != "/options" {
+		t.Errorf("Unexpected auth and services %+v", options)
+	}
+	if !strings.Contains(output.String(), "ICAP server port [11344]: ") {
+		t.Errorf("Expected the TLS port as default, got prompts:\n%s", output.String())
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icapmilter"
+	"github.com/spf13/cobra"
+)
+
+// newMilterCommand creates the milter command, which scans mail handed over
+// by Postfix or Sendmail through the milter protocol
+func newMilterCommand(opts *cliOptions) *cobra.Command {
+	var listen string
+	var blocked string
+	var onError string
+	var maxMessageSize int64
+	var verdictHeader string
+
+	cmd := &cobra.Command{
+		Use:   "milter",
+		Short: "Scan mail from Postfix or Sendmail as a milter",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policy := icapmilter.Policy{MaxMessageSize: maxMessageSize, VerdictHeader: verdictHeader}
+			var err error
+			if policy.Blocked, err = icapmilter.ParseAction(blocked); err != nil {
+				return err
+			}
+			if policy.OnError, err = icapmilter.ParseAction(onError); err != nil {
+				return err
+			}
+			network, address, err := parseMilterAddress(listen)
+			if err != nil {
+				return err
+			}
+
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			client, shutdown, err := startDaemonClient(config, opts)
+			if err != nil {
+				return err
+			}
+			defer shutdown()
+
+			if network == "unix" {
+				os.Remove(address)
+			}
+			listener, err := net.Listen(network, address)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", listen, err)
+			}
+
+			server := icapmilter.NewServer(client, policy)
+			done := make(chan error, 1)
+			go func() { done <- server.Serve(listener) }()
+			client.Logger().Info("Milter listening", "address", listen)
+
+			select {
+			case <-ctx.Done():
+				server.Close()
+				return nil
+			case err := <-done:
+				server.Close()
+				if errors.Is(err, icapmilter.ErrServerClosed) {
+					return nil
+				}
+				return err
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&listen, "listen", "inet:127.0.0.1:8899", "Milter socket, as inet:host:port or unix:/path")
+	cmd.Flags().StringVar(&blocked, "blocked-action", string(icapmilter.ActionReject), "Action on blocked messages: reject, quarantine, discard, tempfail or accept")
+	cmd.Flags().StringVar(&onError, "error-action", string(icapmilter.ActionTempfail), "Action on messages that could not be scanned")
+	cmd.Flags().Int64Var(&maxMessageSize, "max-message-size", 50<<20, "Largest message buffered for scanning, in bytes (0 for no limit)")
+	cmd.Flags().StringVar(&verdictHeader, "verdict-header", "X-ICAP-Verdict", "Header added to delivered messages with the scan verdict (empty to disable)")
+	return cmd
+}
+
+// parseMilterAddress parses a milter socket in the Postfix notation,
+// inet:host:port or unix:/path. A bare host:port is a TCP address.
+func parseMilterAddress(address string) (string, string, error) {
+	scheme, rest, found := strings.Cut(address, ":")
+	switch {
+	case found && (scheme == "inet" || scheme == "inet6" || scheme == "tcp"):
+		return "tcp", rest, nil
+	case found && (scheme == "unix" || scheme == "local"):
+		if rest == "" {
+			return "", "", fmt.Errorf("invalid milter address %q: missing socket path", address)
+		}
+		return "unix", rest, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid milter address %q: expected inet:host:port or unix:/path", address)
+	}
+	return "tcp", address, nil
+}
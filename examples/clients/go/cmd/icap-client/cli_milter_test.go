@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+// TestParseMilterAddress tests the Postfix milter socket notation
+func TestParseMilterAddress(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedNetwork string
+		expectedAddress string
+		expectError     bool
+	}{
+		{"inet:127.0.0.1:8899", "tcp", "127.0.0.1:8899", false},
+		{"inet6:[::1]:8899", "tcp", "[::1]:8899", false},
+		{"unix:/var/run/icap-milter.sock", "unix", "/var/run/icap-milter.sock", false},
+		{"localhost:8899", "tcp", "localhost:8899", false},
+		{"unix:", "", "", true},
+		{"8899", "", "", true},
+	}
+
+	for _, tt := range tests {
+		network, address, err := parseMilterAddress(tt.input)
+		if (err != nil) != tt.expectError {
+			t.Errorf("parseMilterAddress(%q) error = %v, expectError %v", tt.input, err, tt.expectError)
+			continue
+		}
+		if network != tt.expectedNetwork || address != tt.expectedAddress {
+			t.Errorf("parseMilterAddress(%q) = %q, %q, expected %q, %q", tt.input, network, address, tt.expectedNetwork, tt.expectedAddress)
+		}
+	}
+}
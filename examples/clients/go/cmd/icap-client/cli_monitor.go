@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// newMonitorCommand creates the monitor command, which periodically checks
+// the ICAP server health until interrupted
+func newMonitorCommand(opts *cliOptions) *cobra.Command {
+	var interval time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "monitor",
+		Short: "Continuously monitor ICAP server health",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if interval <= 0 {
+				return fmt.Errorf("interval must be positive")
+			}
+
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			client, shutdown, err := startDaemonClient(config, opts)
+			if err != nil {
+				return err
+			}
+			defer shutdown()
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				health, _ := client.HealthCheck(ctx)
+				args := make([]any, 0, 2*len(health))
+				for key, value := range health {
+					args = append(args, key, value)
+				}
+				client.Logger().Info("Health check", args...)
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+				}
+			}
+		},
+	}
+
+	cmd.Flags().DurationVar(&interval, "interval", 30*time.Second, "Interval between health checks")
+	return cmd
+}
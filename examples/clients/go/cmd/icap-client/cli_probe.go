@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/spf13/cobra"
+)
+
+// probeHeaders are the OPTIONS headers reported in their own fields rather
+// than as extensions
+var probeHeaders = map[string]bool{
+	"Methods": true, "Service": true, "Istag": true, "Preview": true,
+	"Options-Ttl": true, "Max-Connections": true, "Allow": true,
+	"Transfer-Preview": true, "Transfer-Ignore": true, "Transfer-Complete": true,
+	"Service-Id": true, "Opt-Body-Type": true,
+	"Date": true, "Encapsulated": true, "Connection": true,
+}
+
+// serviceProbe is the capability report of an ICAP service
+type serviceProbe struct {
+	// Name lists the methods the service is configured for, e.g. "reqmod"
+	Name      string  `json:"name"`
+	URL       string  `json:"url"`
+	Status    int     `json:"status,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+
+	Methods   []string `json:"methods,omitempty"`
+	Service   string   `json:"service,omitempty"`
+	ServiceID string   `json:"service_id,omitempty"`
+	ISTag     string   `json:"istag,omitempty"`
+	// Preview, OptionsTTL (in seconds) and MaxConnections are nil when not
+	// advertised
+	Preview          *int     `json:"preview,omitempty"`
+	OptionsTTL       *int     `json:"options_ttl,omitempty"`
+	MaxConnections   *int     `json:"max_connections,omitempty"`
+	Allow            []string `json:"allow,omitempty"`
+	TransferPreview  []string `json:"transfer_preview,omitempty"`
+	TransferIgnore   []string `json:"transfer_ignore,omitempty"`
+	TransferComplete []string `json:"transfer_complete,omitempty"`
+	OptBodyType      string   `json:"opt_body_type,omitempty"`
+	// Extensions are the other headers of the response, e.g. X-Include
+	Extensions map[string]string `json:"extensions,omitempty"`
+}
+
+// probeTarget is a configured service path and the methods using it
+type probeTarget struct {
+	names []string
+	path  string
+}
+
+// newProbeCommand creates the probe command, which sends OPTIONS to every
+// configured service and reports their capabilities
+func newProbeCommand(opts *cliOptions) *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "probe",
+		Short: "Report the capabilities of every configured ICAP service",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+			client := icapclient.NewIcapClient(config)
+			defer client.Close()
+
+			probes := probeServices(cmd.Context(), client, config)
+			out := cmd.OutOrStdout()
+			if jsonOutput {
+				encoder := json.NewEncoder(out)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(probes); err != nil {
+					return err
+				}
+			} else {
+				printProbes(out, probes)
+			}
+
+			failed := 0
+			for _, probe := range probes {
+				if probe.Error != "" {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d services failed", failed, len(probes))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+	return cmd
+}
+
+// probeTargets returns the service paths of config, once each, in the
+// order REQMOD, RESPMOD, OPTIONS then custom methods by name
+func probeTargets(config *icapclient.IcapConfig) []probeTarget {
+	services := config.Services
+	paths := [][2]string{
+		{"reqmod", services.Reqmod}, {"respmod", services.Respmod}, {"options", services.Options},
+	}
+	custom := make([]string, 0, len(services.Custom))
+	for method := range services.Custom {
+		custom = append(custom, method)
+	}
+	sort.Strings(custom)
+	for _, method := range custom {
+		paths = append(paths, [2]string{strings.ToLower(method), services.Custom[method]})
+	}
+
+	var targets []probeTarget
+	for _, entry := range paths {
+		name, path := entry[0], entry[1]
+		if path == "" {
+			path = "/" + name
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		found := false
+		for i := range targets {
+			if targets[i].path == path {
+				targets[i].names = append(targets[i].names, name)
+				found = true
+			}
+		}
+		if !found {
+			targets = append(targets, probeTarget{names: []string{name}, path: path})
+		}
+	}
+	return targets
+}
+
+// probeServices sends OPTIONS to every service of config with client
+func probeServices(ctx context.Context, client *icapclient.IcapClient, config *icapclient.IcapConfig) []serviceProbe {
+	scheme := "icap"
+	if config.TLS.Enabled {
+		scheme = "icaps"
+	}
+	authority := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+
+	var probes []serviceProbe
+	for _, target := range probeTargets(config) {
+		probe := serviceProbe{Name: strings.Join(target.names, ","), URL: scheme + "://" + authority + target.path}
+		start := time.Now()
+		response, err := client.Options(icapclient.WithRequestOptions(ctx, icapclient.RequestOptions{Service: target.path}))
+		probe.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			probe.Error = err.Error()
+		} else {
+			probe.record(response)
+		}
+		probes = append(probes, probe)
+	}
+	return probes
+}
+
+// record fills the probe from the OPTIONS response of the service
+func (p *serviceProbe) record(response *icapclient.IcapResponse) {
+	p.Status, p.Reason = response.StatusCode, response.Reason
+	if response.StatusCode >= 400 {
+		p.Error = fmt.Sprintf("%d %s", response.StatusCode, response.Reason)
+	}
+
+	headers := make(map[string]string, len(response.Headers))
+	for name, value := range response.Headers {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	p.Methods = splitList(headers["Methods"])
+	p.Service = headers["Service"]
+	p.ServiceID = headers["Service-Id"]
+	p.ISTag = strings.Trim(headers["Istag"], `"`)
+	p.Preview = headerInt(headers, "Preview")
+	p.OptionsTTL = headerInt(headers, "Options-Ttl")
+	p.MaxConnections = headerInt(headers, "Max-Connections")
+	p.Allow = splitList(headers["Allow"])
+	p.TransferPreview = splitList(headers["Transfer-Preview"])
+	p.TransferIgnore = splitList(headers["Transfer-Ignore"])
+	p.TransferComplete = splitList(headers["Transfer-Complete"])
+	p.OptBodyType = headers["Opt-Body-Type"]
+	for name, value := range headers {
+		if !probeHeaders[name] {
+			if p.Extensions == nil {
+				p.Extensions = map[string]string{}
+			}
+			p.Extensions[name] = value
+		}
+	}
+}
+
+// splitList splits a comma-separated header value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// headerInt returns the integer value of the header name, or nil
+func headerInt(headers map[string]string, name string) *int {
+	value, err := strconv.Atoi(strings.TrimSpace(headers[name]))
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+// printProbes prints the probes for humans
+func printProbes(w io.Writer, probes []serviceProbe) {
+	for i, probe := range probes {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s (%s)\n", probe.URL, probe.Name)
+		if probe.Status == 0 {
+			fmt.Fprintf(w, "  Error:             %s\n", probe.Error)
+			continue
+		}
+		fmt.Fprintf(w, "  Status:            %d %s (%.1fms)\n", probe.Status, probe.Reason, probe.LatencyMs)
+		line := func(label string, value string) {
+			if value != "" {
+				fmt.Fprintf(w, "  %-18s %s\n", label+":", value)
+			}
+		}
+		number := func(label string, value *int, unit string) {
+			if value != nil {
+				line(label, strconv.Itoa(*value)+unit)
+			}
+		}
+		line("Methods", strings.Join(probe.Methods, ", "))
+		line("Service", probe.Service)
+		line("Service-ID", probe.ServiceID)
+		line("ISTag", probe.ISTag)
+		number("Preview", probe.Preview, " bytes")
+		number("Options-TTL", probe.OptionsTTL, "s")
+		number("Max-Connections", probe.MaxConnections, "")
+		line("Allow", strings.Join(probe.Allow, ", "))
+		line("Transfer-Preview", strings.Join(probe.TransferPreview, ", "))
+		line("Transfer-Ignore", strings.Join(probe.TransferIgnore, ", "))
+		line("Transfer-Complete", strings.Join(probe.TransferComplete, ", "))
+		line("Opt-body-type", probe.OptBodyType)
+
+		names := make([]string, 0, len(probe.Extensions))
+		for name := range probe.Extensions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			line(name, probe.Extensions[name])
+		}
+	}
+}
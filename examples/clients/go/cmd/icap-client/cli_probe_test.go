@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// optionsHandler answers OPTIONS with the capabilities of the service at
+// the request path
+func optionsHandler(w icaptest.ResponseWriter, r *icaptest.Request) {
+	h := w.Header()
+	if strings.HasSuffix(r.URL.Path, "/reqmod") {
+		h.Set("Methods", "REQMOD")
+	} else {
+		h.Set("Methods", "RESPMOD")
+	}
+	h.Set("Service", "Test scanner 1.0")
+	h.Set("ISTag", `"probe-1"`)
+	h.Set("Preview", "1024")
+	h.Set("Options-TTL", "3600")
+	h.Set("Max-Connections", "50")
+	h.Set("Allow", "204")
+	h.Set("Transfer-Preview", "*")
+	h.Set("Transfer-Ignore", "jpg, png")
+	h.Set("X-Include", "X-Client-IP")
+	w.WriteHeader(200, nil, false)
+}
+
+// TestProbeServices tests the capability report of the configured services
+func TestProbeServices(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(optionsHandler))
+	defer server.Close()
+	host, port := server.HostPort()
+	config := &icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		LoggingLevel: "ERROR",
+		Services:     icapclient.ServicesConfig{Reqmod: "/av/reqmod", Respmod: "/av/respmod", Options: "av/respmod"},
+	}
+	client := icapclient.NewIcapClient(config)
+	defer client.Close()
+
+	probes := probeServices(context.Background(), client, config)
+	if len(probes) != 2 {
+		t.Fatalf("Expected 2 services, got %+v", probes)
+	}
+	if probes[0].Name != "reqmod" || probes[1].Name != "respmod,options" {
+		t.Errorf("Expected reqmod and respmod,options, got %q and %q", probes[0].Name, probes[1].Name)
+	}
+	respmod := probes[1]
+	if respmod.Error != "" || respmod.Status != 200 {
+		t.Fatalf("Expected a 200 answer, got %+v", respmod)
+	}
+	if respmod.URL != server.URL+"/av/respmod" {
+		t.Errorf("Expected URL %s/av/respmod, got %s", server.URL, respmod.URL)
+	}
+	if strings.Join(respmod.Methods, ",") != "RESPMOD" || respmod.ISTag != "probe-1" {
+		t.Errorf("Expected RESPMOD and ISTag probe-1, got %v and %q", respmod.Methods, respmod.ISTag)
+	}
+	if respmod.Preview == nil || *respmod.Preview != 1024 || respmod.OptionsTTL == nil || *respmod.OptionsTTL != 3600 || respmod.MaxConnections == nil || *respmod.MaxConnections != 50 {
+		t.Errorf("Expected preview 1024, TTL 3600 and 50 connections, got %+v", respmod)
+	}
+	if strings.Join(respmod.TransferIgnore, ",") != "jpg,png" {
+		t.Errorf("Expected Transfer-Ignore jpg,png, got %v", respmod.TransferIgnore)
+	}
+	if respmod.Extensions["X-Include"] != "X-Client-IP" {
+		t.Errorf("Expected the X-Include extension, got %v", respmod.Extensions)
+	}
+
+	var human bytes.Buffer
+	printProbes(&human, probes)
+	for _, expected := range []string{"(respmod,options)", "Status:            200", "Preview:           1024 bytes", "Options-TTL:       3600s", "X-Include:         X-Client-IP"} {
+		if !strings.Contains(human.String(), expected) {
+			t.Errorf("Expected report to contain %q, got:\n%s", expected, human.String())
+		}
+	}
+
+	data, err := json.Marshal(probes)
+	if err != nil {
+		t.Fatalf("Failed to encode report: %v", err)
+	}
+	if !strings.Contains(string(data), `"max_connections":50`) || !strings.Contains(string(data), `"transfer_preview":["*"]`) {
+		t.Errorf("Unexpected JSON report %s", data)
+	}
+}
+
+// TestProbeServices_Down tests the report of an unreachable server
+func TestProbeServices_Down(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(optionsHandler))
+	host, port := server.HostPort()
+	server.Close()
+	config := &icapclient.IcapConfig{Host: host, Port: port, Timeout: time.Second, LoggingLevel: "ERROR"}
+	client := icapclient.NewIcapClient(config)
+	defer client.Close()
+
+	probes := probeServices(context.Background(), client, config)
+	if len(probes) != 3 {
+		t.Fatalf("Expected the 3 default services, got %+v", probes)
+	}
+	for _, probe := range probes {
+		if probe.Error == "" || probe.Status != 0 {
+			t.Errorf("Expected %s to fail, got %+v", probe.Name, probe)
+		}
+	}
+
+	var human bytes.Buffer
+	printProbes(&human, probes)
+	if !strings.Contains(human.String(), "Error:") {
+		t.Errorf("Expected errors in the report, got:\n%s", human.String())
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaphttp"
+	"github.com/spf13/cobra"
+)
+
+// newProxyCommand creates the proxy command, a forward HTTP proxy sending
+// requests through REQMOD and responses through RESPMOD
+func newProxyCommand(opts *cliOptions) *cobra.Command {
+	var listen string
+	var policy icaphttp.Policy
+
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Run a forward HTTP proxy adapting traffic through the ICAP server",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !policy.Reqmod && !policy.Respmod {
+				return fmt.Errorf("at least one of --reqmod and --respmod is required")
+			}
+
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			client, shutdown, err := startDaemonClient(config, opts)
+			if err != nil {
+				return err
+			}
+			defer shutdown()
+
+			proxy := newForwardProxy(client, policy)
+			if _, err := proxy.Start(listen); err != nil {
+				return fmt.Errorf("failed to start proxy: %w", err)
+			}
+
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			return proxy.Shutdown(shutdownCtx)
+		},
+	}
+
+	cmd.Flags().StringVar(&listen, "listen", ":3128", "Proxy HTTP listen address")
+	cmd.Flags().BoolVar(&policy.Reqmod, "reqmod", true, "Send requests through REQMOD before forwarding them")
+	cmd.Flags().BoolVar(&policy.Respmod, "respmod", true, "Send responses through RESPMOD before returning them")
+	cmd.Flags().BoolVar(&policy.FailOpen, "fail-open", false, "Pass traffic through unadapted when the ICAP server cannot be reached")
+	cmd.Flags().Int64Var(&policy.MaxBodySize, "max-body-size", 100<<20, "Largest body adapted, in bytes; larger bodies pass through (0 for no limit)")
+	cmd.Flags().Int64Var(&policy.Trickle, "trickle", 0, "Return responses over this size while RESPMOD completes (0 to wait for the verdict)")
+	return cmd
+}
+
+// forwardProxy is a forward HTTP proxy adapting traffic with icaphttp.
+// CONNECT tunnels are refused, since their traffic could not be scanned.
+type forwardProxy struct {
+	client *icapclient.IcapClient
+	server *http.Server
+}
+
+// newForwardProxy creates the proxy adapting traffic with client according
+// to policy
+func newForwardProxy(client *icapclient.IcapClient, policy icaphttp.Policy) *forwardProxy {
+	p := &forwardProxy{client: client}
+	reverse := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetXForwarded()
+		},
+		Transport:    icaphttp.NewTransport(nil, client, policy),
+		ErrorHandler: p.handleError,
+	}
+
+	p.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodConnect:
+				http.Error(w, "CONNECT tunnels are not supported, their traffic cannot be scanned", http.StatusMethodNotAllowed)
+			case !r.URL.IsAbs():
+				http.Error(w, "expected an absolute request URI", http.StatusBadRequest)
+			default:
+				reverse.ServeHTTP(w, r)
+			}
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return p
+}
+
+// Start listens on addr and serves proxy requests in the background
+func (p *forwardProxy) Start(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := p.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.client.Logger().Error("Proxy failed", "error", err)
+		}
+	}()
+
+	p.client.Logger().Info("Proxy listening", "addr", listener.Addr().String())
+	return listener.Addr(), nil
+}
+
+// Shutdown gracefully stops the proxy
+func (p *forwardProxy) Shutdown(ctx context.Context) error {
+	return p.server.Shutdown(ctx)
+}
+
+// handleError answers requests that could not be forwarded or adapted
+// with a 502
+func (p *forwardProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	p.client.Logger().Warn("Proxy request failed", "url", r.URL.String(), "error", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
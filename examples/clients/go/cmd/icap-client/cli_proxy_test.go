@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaphttp"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestForwardProxy tests forwarding clean traffic and answering blocked
+// requests and responses with the block page of the server
+func TestForwardProxy(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(blockingHandler))
+	defer server.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/virus" {
+			io.WriteString(w, "a virus inside")
+			return
+		}
+		io.WriteString(w, "hello world")
+	}))
+	defer origin.Close()
+
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		KeepAlive:    true,
+		LoggingLevel: "ERROR",
+	})
+	defer client.Close()
+
+	proxy := newForwardProxy(client, icaphttp.Policy{Reqmod: true, Respmod: true})
+	addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Shutdown(context.Background())
+	proxyURL := &url.URL{Scheme: "http", Host: addr.String()}
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	tests := []struct {
+		name         string
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{"Clean", "/", 200, "hello world"},
+		{"Blocked request", "/blocked", 403, "<h1>Blocked</h1>"},
+		{"Blocked response", "/virus", 403, "infected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := httpClient.Get(origin.URL + tt.path)
+			if err != nil {
+				t.Fatalf("GET through the proxy failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.expectedCode || string(body) != tt.expectedBody {
+				t.Errorf("Expected %d %q, got %d %q", tt.expectedCode, tt.expectedBody, resp.StatusCode, body)
+			}
+		})
+	}
+
+	req, _ := http.NewRequest(http.MethodConnect, proxyURL.String(), nil)
+	req.Host = "example.com:443"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected CONNECT to be refused with 405, got %d", resp.StatusCode)
+	}
+}
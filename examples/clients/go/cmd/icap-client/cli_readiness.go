@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// readinessProbe tracks whether the ICAP backend answered OPTIONS recently
+type readinessProbe struct {
+	client *icapclient.IcapClient
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	lastOK time.Time
+}
+
+// newReadinessProbe creates a probe that considers the backend ready for ttl
+// after a successful OPTIONS response
+func newReadinessProbe(ttl time.Duration) *readinessProbe {
+	return &readinessProbe{ttl: ttl}
+}
+
+// observe is an OnResponse hook recording successful OPTIONS responses
+func (p *readinessProbe) observe(event icapclient.ResponseEvent) {
+	if event.Method != icapclient.OPTIONS || event.Response == nil || event.Response.StatusCode >= 400 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastOK = time.Now()
+}
+
+// chainHooks registers the probe on hooks, keeping any existing OnResponse hook
+func (p *readinessProbe) chainHooks(hooks *icapclient.Hooks) {
+	next := hooks.OnResponse
+	hooks.OnResponse = func(event icapclient.ResponseEvent) {
+		p.observe(event)
+		if next != nil {
+			next(event)
+		}
+	}
+}
+
+// lastSuccess returns the time of the last successful OPTIONS response
+func (p *readinessProbe) lastSuccess() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastOK
+}
+
+// Ready reports whether OPTIONS succeeded within the TTL, probing the backend
+// with a fresh OPTIONS request when the last success is stale
+func (p *readinessProbe) Ready(ctx context.Context) (bool, time.Time) {
+	if last := p.lastSuccess(); !last.IsZero() && time.Since(last) <= p.ttl {
+		return true, last
+	}
+
+	if p.client != nil {
+		// A successful response is recorded through the OnResponse hook
+		p.client.Options(ctx)
+	}
+
+	last := p.lastSuccess()
+	return !last.IsZero() && time.Since(last) <= p.ttl, last
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// TestReadinessProbe tests readiness tracking from OPTIONS responses
+func TestReadinessProbe(t *testing.T) {
+	probe := newReadinessProbe(50 * time.Millisecond)
+	hooks := &icapclient.Hooks{}
+	var chained int
+	hooks.OnResponse = func(icapclient.ResponseEvent) { chained++ }
+	probe.chainHooks(hooks)
+
+	if ready, _ := probe.Ready(context.Background()); ready {
+		t.Error("Expected probe to be not ready before any OPTIONS response")
+	}
+
+	hooks.OnResponse(icapclient.ResponseEvent{Method: icapclient.REQMOD, Response: &icapclient.IcapResponse{StatusCode: 200}})
+	hooks.OnResponse(icapclient.ResponseEvent{Method: icapclient.OPTIONS, Response: &icapclient.IcapResponse{StatusCode: 503}})
+	if ready, _ := probe.Ready(context.Background()); ready {
+		t.Error("Expected only successful OPTIONS responses to mark readiness")
+	}
+
+	hooks.OnResponse(icapclient.ResponseEvent{Method: icapclient.OPTIONS, Response: &icapclient.IcapResponse{StatusCode: 200}})
+	if ready, last := probe.Ready(context.Background()); !ready || last.IsZero() {
+		t.Error("Expected probe to be ready after a successful OPTIONS response")
+	}
+	if chained != 3 {
+		t.Errorf("Expected the existing OnResponse hook to be called 3 times, got %d", chained)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ready, _ := probe.Ready(context.Background()); ready {
+		t.Error("Expected readiness to expire after the TTL")
+	}
+}
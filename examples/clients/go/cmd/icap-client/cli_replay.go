@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/spf13/cobra"
+)
+
+// Access log formats read by replay
+const (
+	// logFormatAuto detects the format of each line
+	logFormatAuto = "auto"
+	// logFormatSquid is Squid's native format, "time elapsed client
+	// action/code size method URL ident hierarchy/from type"
+	logFormatSquid = "squid"
+	// logFormatNginx is the combined format of nginx and Apache
+	logFormatNginx = "nginx"
+)
+
+// nginxLine matches a line in combined format, the referer and user agent
+// being optional as in the common format
+var nginxLine = regexp.MustCompile(`^(\S+) \S+ (\S+) \[([^\]]+)\] "([^"]*)" \d{3} \S+(?: "([^"]*)" "([^"]*)")?`)
+
+// accessEntry is a request reconstructed from an access log line
+type accessEntry struct {
+	time     time.Time
+	clientIP string
+	user     string
+	request  *icapclient.HttpRequest
+}
+
+// replayOptions are the settings of a replay
+type replayOptions struct {
+	format string
+	// origin is the scheme and host of the requests of nginx logs, which
+	// only hold their path
+	origin string
+	// speed divides the delays between requests, 0 sending them as fast as
+	// possible
+	speed       float64
+	concurrency int
+	// limit stops the replay after that many requests when positive
+	limit int
+}
+
+// replayStats are the outcome of a replay
+type replayStats struct {
+	mu       sync.Mutex
+	verdicts map[string]int
+	// policies counts the client policy decisions by action and rule
+	policies map[string]int
+	replayed int
+	skipped  int
+	// maxLag is how far the replay fell behind the pacing of the log
+	maxLag time.Duration
+}
+
+// newReplayCommand creates the replay command, which sends the requests of
+// access logs through REQMOD
+func newReplayCommand(opts *cliOptions) *cobra.Command {
+	options := replayOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "replay <access.log>...",
+		Short: "Replay the requests of Squid or nginx access logs through REQMOD",
+		Long: "Reads Squid native or nginx combined access logs, '-' being the standard input, " +
+			"reconstructs their requests and sends them through REQMOD at the pacing of the log " +
+			"divided by --speed. Requests that are not allowed are printed, followed by a summary " +
+			"of the verdicts and client policy decisions, to validate policy changes against real traffic.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch options.format {
+			case logFormatAuto, logFormatSquid, logFormatNginx:
+			default:
+				return fmt.Errorf("unknown format %q, expected auto, squid or nginx", options.format)
+			}
+			if options.speed < 0 {
+				return fmt.Errorf("speed must not be negative")
+			}
+			if options.concurrency < 1 {
+				return fmt.Errorf("concurrency must be at least 1")
+			}
+
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+			client, shutdown, err := startDaemonClient(config, opts)
+			if err != nil {
+				return err
+			}
+			defer shutdown()
+
+			readers := make([]io.Reader, 0, len(args))
+			for _, path := range args {
+				if path == "-" {
+					readers = append(readers, cmd.InOrStdin())
+					continue
+				}
+				file, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				readers = append(readers, file)
+			}
+
+			out := cmd.OutOrStdout()
+			recorder := newLatencyRecorder()
+			stats, err := runReplay(cmd.Context(), client, io.MultiReader(readers...), options, out, recorder)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(out)
+			stats.print(out)
+			recorder.PrintSummary(out)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&options.format, "format", logFormatAuto, "Access log format: auto, squid or nginx")
+	cmd.Flags().StringVar(&options.origin, "origin", "http://localhost", "Scheme and host of the requests of nginx logs")
+	cmd.Flags().Float64Var(&options.speed, "speed", 1, "Pacing of the log divided by this factor, e.g. 10 for 10x faster, 0 for no pacing")
+	cmd.Flags().IntVar(&options.concurrency, "concurrency", 16, "Maximum number of requests in flight")
+	cmd.Flags().IntVar(&options.limit, "limit", 0, "Stop after this many requests (0 for all)")
+	return cmd
+}
+
+// runReplay sends the requests logged in r through REQMOD, printing those
+// that are not allowed to out
+func runReplay(ctx context.Context, client *icapclient.IcapClient, r io.Reader, options replayOptions, out io.Writer, recorder *latencyRecorder) (*replayStats, error) {
+	stats := &replayStats{verdicts: map[string]int{}, policies: map[string]int{}}
+	var outMu sync.Mutex
+	var first time.Time
+	var start time.Time
+
+	engine := newScanEngine(ctx, options.concurrency, options.concurrency)
+	defer engine.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if options.limit > 0 && stats.replayed >= options.limit {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, err := parseAccessLine(options.format, line, options.origin)
+		if err != nil {
+			stats.skipped++
+			continue
+		}
+
+		if options.speed > 0 {
+			if first.IsZero() {
+				first, start = entry.time, time.Now()
+			}
+			due := start.Add(time.Duration(float64(entry.time.Sub(first)) / options.speed))
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return stats, ctx.Err()
+				case <-timer.C:
+				}
+			} else {
+				stats.maxLag = max(stats.maxLag, -wait)
+			}
+		}
+
+		stats.replayed++
+		err = engine.Submit(ctx, func(ctx context.Context) {
+			ctx = icapclient.WithRequestOptions(ctx, icapclient.RequestOptions{ClientIP: entry.clientIP, AuthenticatedUser: entry.user})
+			started := time.Now()
+			verdict, response, err := client.ScanRequest(ctx, entry.request)
+			recorder.Record(time.Since(started), 0, response, err)
+			var decision *icapclient.PolicyDecision
+			if response != nil {
+				decision = response.Policy
+				response.Close()
+			}
+			stats.record(verdict, decision)
+			if verdict == icapclient.VerdictAllowed {
+				return
+			}
+
+			outMu.Lock()
+			defer outMu.Unlock()
+			fmt.Fprintf(out, "%s %s %s", verdict, entry.request.Method, entry.request.URI)
+			if decision != nil {
+				fmt.Fprintf(out, " (policy %s %s)", decision.Action, decision.Rule)
+			}
+			if err != nil {
+				fmt.Fprintf(out, ": %v", err)
+			}
+			fmt.Fprintln(out)
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, fmt.Errorf("failed to read access log: %w", err)
+	}
+	engine.Close()
+	return stats, nil
+}
+
+// record counts the verdict of a request and the policy decision on it
+func (s *replayStats) record(verdict icapclient.Verdict, decision *icapclient.PolicyDecision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verdicts[verdict.String()]++
+	if decision != nil {
+		s.policies[strings.TrimSpace(decision.Action+" "+decision.Rule)]++
+	}
+}
+
+// print prints the counts of the replay
+func (s *replayStats) print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(w, "Replayed:   %d requests, %d lines skipped\n", s.replayed, s.skipped)
+	fmt.Fprintf(w, "Verdicts:  %s\n", formatCounts(s.verdicts))
+	if len(s.policies) > 0 {
+		fmt.Fprintf(w, "Policy:    %s\n", formatCounts(s.policies))
+	}
+	if s.maxLag > 0 {
+		fmt.Fprintf(w, "Max lag:    %s behind the log\n", s.maxLag.Round(time.Millisecond))
+	}
+}
+
+// formatCounts formats counts as " name=count" by name
+func formatCounts(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s=%d", name, counts[name])
+	}
+	return b.String()
+}
+
+// parseAccessLine parses a line of an access log in format, detecting Squid
+// lines by their Unix timestamp in auto format
+func parseAccessLine(format, line, origin string) (*accessEntry, error) {
+	if format == logFormatAuto {
+		format = logFormatNginx
+		if first, _, _ := strings.Cut(line, " "); strings.Contains(first, ".") {
+			if _, err := strconv.ParseFloat(first, 64); err == nil {
+				format = logFormatSquid
+			}
+		}
+	}
+	if format == logFormatSquid {
+		return parseSquidLine(line)
+	}
+	return parseNginxLine(line, origin)
+}
+
+// parseSquidLine parses a line of Squid's native access log
+func parseSquidLine(line string) (*accessEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("malformed Squid access log line %q", line)
+	}
+	timestamp, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed Squid access log timestamp %q", fields[0])
+	}
+	entry := &accessEntry{
+		time:     time.UnixMilli(int64(timestamp * 1000)),
+		clientIP: fields[2],
+	}
+	if len(fields) > 7 && fields[7] != "-" {
+		entry.user = fields[7]
+	}
+
+	method, target := fields[5], fields[6]
+	host := target
+	if method != "CONNECT" {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Squid access log URL %q is not absolute", target)
+		}
+		host = u.Host
+	}
+	entry.request = &icapclient.HttpRequest{
+		Method:  method,
+		URI:     target,
+		Version: "HTTP/1.1",
+		Headers: map[string]string{"Host": host},
+	}
+	return entry, nil
+}
+
+// parseNginxLine parses a line of an access log in combined format, the
+// requests of paths being sent to origin
+func parseNginxLine(line, origin string) (*accessEntry, error) {
+	match := nginxLine.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("malformed combined access log line %q", line)
+	}
+	logged, err := time.Parse("02/Jan/2006:15:04:05 -0700", match[3])
+	if err != nil {
+		return nil, fmt.Errorf("malformed combined access log time %q", match[3])
+	}
+	request := strings.Fields(match[4])
+	if len(request) != 3 {
+		return nil, fmt.Errorf("malformed combined access log request %q", match[4])
+	}
+
+	target := request[1]
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		target = strings.TrimSuffix(origin, "/") + target
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("combined access log request %q has no host", match[4])
+	}
+
+	entry := &accessEntry{time: logged, clientIP: match[1]}
+	if match[2] != "-" {
+		entry.user = match[2]
+	}
+	headers := map[string]string{"Host": u.Host}
+	if match[5] != "" && match[5] != "-" {
+		headers["Referer"] = match[5]
+	}
+	if match[6] != "" && match[6] != "-" {
+		headers["User-Agent"] = match[6]
+	}
+	entry.request = &icapclient.HttpRequest{
+		Method:  request[0],
+		URI:     target,
+		Version: request[2],
+		Headers: headers,
+	}
+	return entry, nil
+}
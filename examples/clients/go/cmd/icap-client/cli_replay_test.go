@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestParseAccessLine tests the reconstruction of requests from Squid and
+// nginx access logs
+func TestParseAccessLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		line     string
+		method   string
+		uri      string
+		host     string
+		clientIP string
+		valid    bool
+	}{
+		{"Squid", logFormatAuto, "1286536308.779    180 192.168.0.224 TCP_MISS/200 411 GET http://www.example.com/a?b=1 alice DIRECT/93.184.216.34 text/html", "GET", "http://www.example.com/a?b=1", "www.example.com", "192.168.0.224", true},
+		{"Squid CONNECT", logFormatSquid, "1286536309.001 20 10.0.0.1 TCP_TUNNEL/200 5000 CONNECT www.example.com:443 - HIER_DIRECT/93.184.216.34 -", "CONNECT", "www.example.com:443", "www.example.com:443", "10.0.0.1", true},
+		{"Squid relative URL", logFormatSquid, "1286536309.001 20 10.0.0.1 NONE/400 0 GET error:invalid-request - HIER_NONE/- -", "", "", "", "", false},
+		{"nginx", logFormatAuto, `203.0.113.7 - bob [10/Oct/2000:13:55:36 -0700] "POST /upload HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"`, "POST", "http://localhost/upload", "localhost", "203.0.113.7", true},
+		{"nginx absolute", logFormatNginx, `203.0.113.7 - - [10/Oct/2000:13:55:36 -0700] "GET http://proxied.example/x HTTP/1.1" 200 0`, "GET", "http://proxied.example/x", "proxied.example", "203.0.113.7", true},
+		{"nginx bad request", logFormatNginx, `203.0.113.7 - - [10/Oct/2000:13:55:36 -0700] "-" 400 0 "-" "-"`, "", "", "", "", false},
+		{"Garbage", logFormatAuto, "not an access log line", "", "", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := parseAccessLine(tt.format, tt.line, "http://localhost/")
+			if (err == nil) != tt.valid {
+				t.Fatalf("Expected valid=%v, got %v", tt.valid, err)
+			}
+			if !tt.valid {
+				return
+			}
+			request := entry.request
+			if request.Method != tt.method || request.URI != tt.uri || request.Headers["Host"] != tt.host || entry.clientIP != tt.clientIP {
+				t.Errorf("Expected %s %s on %s from %s, got %+v from %s", tt.method, tt.uri, tt.host, tt.clientIP, request, entry.clientIP)
+			}
+		})
+	}
+
+	entry, _ := parseAccessLine(logFormatAuto, `203.0.113.7 - bob [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 1 "-" "curl/8.0"`, "https://www.example.com")
+	if entry.user != "bob" || entry.request.Headers["User-Agent"] != "curl/8.0" || entry.request.Headers["Referer"] != "" {
+		t.Errorf("Unexpected nginx entry %+v, %+v", entry, entry.request)
+	}
+	if !entry.time.Equal(time.Date(2000, 10, 10, 20, 55, 36, 0, time.UTC)) {
+		t.Errorf("Expected the logged time, got %s", entry.time)
+	}
+}
+
+// TestRunReplay tests the replay of a Squid log through REQMOD, paced at
+// 10x the speed of the log
+func TestRunReplay(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.Request != nil && strings.Contains(r.Request.URL.Path, "/blocked") {
+			w.WriteHeader(200, &http.Response{StatusCode: 403, Status: "403 Forbidden", ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}}, false)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{Host: host, Port: port, Timeout: 5 * time.Second, LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	log := strings.Join([]string{
+		"1700000000.000 5 10.0.0.1 TCP_MISS/200 100 GET http://www.example.com/ - DIRECT/1.2.3.4 text/html",
+		"# comment",
+		"garbage",
+		"1700000001.000 5 10.0.0.2 TCP_MISS/200 100 GET http://www.example.com/blocked - DIRECT/1.2.3.4 text/html",
+		"1700000002.000 5 10.0.0.3 TCP_MISS/200 100 GET http://www.example.com/other - DIRECT/1.2.3.4 text/html",
+	}, "\n")
+
+	var out bytes.Buffer
+	recorder := newLatencyRecorder()
+	start := time.Now()
+	stats, err := runReplay(context.Background(), client, strings.NewReader(log), replayOptions{format: logFormatAuto, speed: 10, concurrency: 2}, &out, recorder)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected the 2s log to take 200ms at 10x, took %s", elapsed)
+	}
+	if stats.replayed != 3 || stats.skipped != 1 {
+		t.Errorf("Expected 3 requests and 1 skipped line, got %d and %d", stats.replayed, stats.skipped)
+	}
+	if stats.verdicts["allowed"] != 2 || stats.verdicts["blocked"] != 1 {
+		t.Errorf("Expected 2 allowed and 1 blocked, got %v", stats.verdicts)
+	}
+	if !strings.Contains(out.String(), "blocked GET http://www.example.com/blocked") {
+		t.Errorf("Expected the blocked request to be printed, got:\n%s", out.String())
+	}
+
+	var summary bytes.Buffer
+	stats.print(&summary)
+	if !strings.Contains(summary.String(), "Verdicts:   allowed=2 blocked=1") {
+		t.Errorf("Unexpected summary:\n%s", summary.String())
+	}
+
+	stats, err = runReplay(context.Background(), client, strings.NewReader(log), replayOptions{format: logFormatSquid, concurrency: 1, limit: 1}, &out, recorder)
+	if err != nil || stats.replayed != 1 {
+		t.Errorf("Expected a single request with limit 1, got %d, %v", stats.replayed, err)
+	}
+}
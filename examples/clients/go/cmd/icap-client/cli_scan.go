@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/spf13/cobra"
+)
+
+// newScanCommand creates the scan command, which sends files through RESPMOD
+func newScanCommand(opts *cliOptions) *cobra.Command {
+	var recursive bool
+	var concurrency int
+	var histogramFile string
+	var s3Endpoint string
+	var reportFile string
+	var cacheFile string
+	s3Options := s3ScanOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "scan <path>... | scan s3://bucket/prefix",
+		Short: "Scan files or S3 objects through RESPMOD",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if concurrency < 1 {
+				return fmt.Errorf("concurrency must be at least 1")
+			}
+
+			if isS3URL(args[0]) {
+				if len(args) != 1 {
+					return fmt.Errorf("an S3 scan takes a single s3://bucket/prefix argument")
+				}
+				s3Options.concurrency = concurrency
+				return runS3Scan(cmd, opts, args[0], s3Endpoint, reportFile, s3Options)
+			}
+
+			files, err := collectScanFiles(args, recursive)
+			if err != nil {
+				return err
+			}
+
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+			if cacheFile != "" {
+				config.ScanCache.Enabled = true
+				config.ScanCache.Path = cacheFile
+			}
+
+			client, shutdown, err := startDaemonClient(config, opts)
+			if err != nil {
+				return err
+			}
+			defer shutdown()
+
+			recorder := newLatencyRecorder()
+			out := cmd.OutOrStdout()
+			var outMu sync.Mutex
+
+			engine := newScanEngine(cmd.Context(), concurrency, concurrency)
+			for _, path := range files {
+				path := path
+				err := engine.Submit(cmd.Context(), func(ctx context.Context) {
+					verdict, response, size, latency, err := scanFile(ctx, client, path)
+					recorder.Record(latency, size, response, err)
+
+					outMu.Lock()
+					defer outMu.Unlock()
+					if err != nil {
+						fmt.Fprintf(out, "%s: error: %v\n", path, err)
+					} else {
+						fmt.Fprintf(out, "%s: %s (%d %s)", path, verdict, response.StatusCode, response.Reason)
+						if digest := response.ContentHashes[icapclient.HashSHA256]; digest != "" {
+							fmt.Fprintf(out, " sha256=%s", digest)
+						}
+						fmt.Fprintln(out)
+					}
+				})
+				if err != nil {
+					break
+				}
+			}
+			engine.Close()
+
+			fmt.Fprintln(out)
+			recorder.PrintSummary(out)
+			if histogramFile != "" {
+				if err := recorder.WriteHistogram(histogramFile); err != nil {
+					return fmt.Errorf("failed to write histogram: %w", err)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&recursive, "recursive", "r", false, "Scan directories recursively")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of files scanned in parallel")
+	cmd.Flags().StringVar(&histogramFile, "histogram-file", "", "Write the latency distribution in HdrHistogram format")
+	cmd.Flags().StringVar(&s3Endpoint, "s3-endpoint", "", "Endpoint of an S3-compatible service, addressed with path-style URLs")
+	cmd.Flags().StringVar(&s3Options.action, "infected-action", s3ActionNone, "Action on blocked S3 objects: none, tag or quarantine")
+	cmd.Flags().StringVar(&s3Options.quarantineBucket, "quarantine-bucket", "", "Bucket receiving quarantined S3 objects (default: the scanned bucket)")
+	cmd.Flags().StringVar(&s3Options.quarantinePrefix, "quarantine-prefix", "quarantine/", "Key prefix of quarantined S3 objects")
+	cmd.Flags().StringVar(&cacheFile, "cache-file", "", "Keep verdicts in a file, so files unchanged since a previous scan are not sent again")
+	cmd.Flags().StringVar(&reportFile, "report", "", "Write the JSON report of an S3 scan to a file instead of stdout")
+	return cmd
+}
+
+// runS3Scan scans the objects under an s3:// URL and writes the JSON report
+func runS3Scan(cmd *cobra.Command, opts *cliOptions, target, endpoint, reportFile string, options s3ScanOptions) error {
+	switch options.action {
+	case s3ActionNone, s3ActionTag, s3ActionQuarantine:
+	default:
+		return fmt.Errorf("unknown infected action %q", options.action)
+	}
+	bucket, prefix, err := parseS3URL(target)
+	if err != nil {
+		return err
+	}
+
+	config, err := opts.loadConfig()
+	if err != nil {
+		return err
+	}
+	applyS3SpoolConfig(config)
+	api, err := newS3Client(cmd.Context(), endpoint)
+	if err != nil {
+		return err
+	}
+	client, shutdown, err := startDaemonClient(config, opts)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	report, scanErr := scanS3(cmd.Context(), client, api, bucket, prefix, options)
+
+	out := cmd.OutOrStdout()
+	if reportFile != "" {
+		file, err := os.Create(reportFile)
+		if err != nil {
+			return fmt.Errorf("failed to create report: %w", err)
+		}
+		defer file.Close()
+		out = file
+	}
+	if err := writeS3Report(out, report); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return scanErr
+}
+
+// collectScanFiles expands the scan arguments into a list of regular files
+func collectScanFiles(paths []string, recursive bool) ([]string, error) {
+	var files []string
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		if !recursive {
+			return nil, fmt.Errorf("%s is a directory (use --recursive)", path)
+		}
+
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// scanFile sends a file through RESPMOD as the body of a 200 response,
+// streaming it from disk, and returns its verdict
+func scanFile(ctx context.Context, client *icapclient.IcapClient, path string) (icapclient.Verdict, *icapclient.IcapResponse, int, time.Duration, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return icapclient.VerdictError, nil, 0, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return icapclient.VerdictError, nil, 0, 0, err
+	}
+	size := int(info.Size())
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	httpResponse := &icapclient.HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers: map[string]string{
+			"Content-Type":   contentType,
+			"Content-Length": strconv.Itoa(size),
+		},
+		BodyReader: file,
+	}
+
+	start := time.Now()
+	verdict, response, err := client.ScanResponse(ctx, httpResponse)
+	if err == nil {
+		response.Close()
+	}
+	return verdict, response, size, time.Since(start), err
+}
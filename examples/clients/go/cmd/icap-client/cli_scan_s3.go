@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Actions taken on objects that are not allowed
+const (
+	s3ActionNone       = "none"
+	s3ActionTag        = "tag"
+	s3ActionQuarantine = "quarantine"
+)
+
+// s3VerdictTag is the object tag set to the verdict of tagged objects
+const s3VerdictTag = "icap-verdict"
+
+// s3SpoolThreshold is the spool threshold of S3 scans when none is
+// configured
+const s3SpoolThreshold = 8 << 20
+
+// s3API is the subset of the S3 client used to scan a bucket, implemented
+// by *s3.Client
+type s3API interface {
+	s3.ListObjectsV2APIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// s3ScanOptions controls what is done with the objects of an S3 scan
+type s3ScanOptions struct {
+	// action is taken on blocked objects: none, tag or quarantine
+	action string
+	// quarantineBucket receives quarantined objects, defaulting to the
+	// scanned bucket
+	quarantineBucket string
+	// quarantinePrefix is prepended to the key of quarantined objects.
+	// Objects under it are not scanned when quarantining to the scanned
+	// bucket.
+	quarantinePrefix string
+	concurrency      int
+}
+
+// s3ObjectResult is the report entry of one scanned object
+type s3ObjectResult struct {
+	Key        string                 `json:"key"`
+	Size       int64                  `json:"size"`
+	SHA256     string                 `json:"sha256,omitempty"`
+	Verdict    string                 `json:"verdict"`
+	IcapStatus int                    `json:"icap_status,omitempty"`
+	RequestID  string                 `json:"request_id,omitempty"`
+	Infection  *icapclient.Infection  `json:"infection,omitempty"`
+	Violations []icapclient.Violation `json:"violations,omitempty"`
+	Action     string                 `json:"action,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	LatencyMs  float64                `json:"latency_ms"`
+}
+
+// s3ScanSummary counts the verdicts of an S3 scan
+type s3ScanSummary struct {
+	Scanned  int `json:"scanned"`
+	Allowed  int `json:"allowed"`
+	Modified int `json:"modified"`
+	Blocked  int `json:"blocked"`
+	Errors   int `json:"errors"`
+}
+
+// s3ScanReport is the JSON report of an S3 scan
+type s3ScanReport struct {
+	Bucket    string           `json:"bucket"`
+	Prefix    string           `json:"prefix"`
+	StartedAt time.Time        `json:"started_at"`
+	Duration  float64          `json:"duration_seconds"`
+	Summary   s3ScanSummary    `json:"summary"`
+	Objects   []s3ObjectResult `json:"objects"`
+}
+
+// isS3URL reports whether a scan argument names an S3 location
+func isS3URL(arg string) bool {
+	return strings.HasPrefix(arg, "s3://")
+}
+
+// parseS3URL splits s3://bucket/prefix into its bucket and key prefix
+func parseS3URL(raw string) (string, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid S3 URL %s: %w", raw, err)
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %s: expected s3://bucket/prefix", raw)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// newS3Client creates an S3 client from the default AWS configuration. A
+// non-empty endpoint selects an S3-compatible service such as MinIO,
+// addressed with path-style URLs.
+func newS3Client(ctx context.Context, endpoint string) (*s3.Client, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	}), nil
+}
+
+// scanS3 scans the objects of bucket under prefix through RESPMOD, streaming
+// each object from S3 to the ICAP server, and acts on blocked objects
+func scanS3(ctx context.Context, client *icapclient.IcapClient, api s3API, bucket, prefix string, options s3ScanOptions) (*s3ScanReport, error) {
+	report := &s3ScanReport{Bucket: bucket, Prefix: prefix, StartedAt: time.Now().UTC(), Objects: []s3ObjectResult{}}
+	skipQuarantine := options.action == s3ActionQuarantine &&
+		(options.quarantineBucket == "" || options.quarantineBucket == bucket)
+
+	var mu sync.Mutex
+	engine := newScanEngine(ctx, options.concurrency, options.concurrency)
+	paginator := s3.NewListObjectsV2Paginator(api, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	var listErr error
+	for paginator.HasMorePages() && listErr == nil {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			listErr = fmt.Errorf("failed to list s3://%s/%s: %w", bucket, prefix, err)
+			break
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			if skipQuarantine && strings.HasPrefix(key, options.quarantinePrefix) {
+				continue
+			}
+
+			err := engine.Submit(ctx, func(ctx context.Context) {
+				result := scanS3Object(ctx, client, api, bucket, key, options)
+				mu.Lock()
+				report.Objects = append(report.Objects, result)
+				mu.Unlock()
+			})
+			if err != nil {
+				listErr = err
+				break
+			}
+		}
+	}
+	engine.Close()
+
+	sort.Slice(report.Objects, func(i, j int) bool {
+		return report.Objects[i].Key < report.Objects[j].Key
+	})
+	for _, result := range report.Objects {
+		report.Summary.Scanned++
+		switch result.Verdict {
+		case icapclient.VerdictAllowed.String():
+			report.Summary.Allowed++
+		case icapclient.VerdictModified.String():
+			report.Summary.Modified++
+		case icapclient.VerdictBlocked.String():
+			report.Summary.Blocked++
+		default:
+			report.Summary.Errors++
+		}
+	}
+	report.Duration = time.Since(report.StartedAt).Seconds()
+	return report, listErr
+}
+
+// applyS3SpoolConfig spools objects larger than s3SpoolThreshold to disk
+// unless a spool threshold is configured. Object bodies are not seekable,
+// so the client would otherwise read each one into memory before sending
+// it.
+func applyS3SpoolConfig(config *icapclient.IcapConfig) {
+	if config.Spool.Threshold <= 0 {
+		config.Spool.Threshold = s3SpoolThreshold
+	}
+}
+
+// scanS3Object streams one object through RESPMOD and acts on it when it
+// is blocked
+func scanS3Object(ctx context.Context, client *icapclient.IcapClient, api s3API, bucket, key string, options s3ScanOptions) s3ObjectResult {
+	result := s3ObjectResult{Key: key, Verdict: icapclient.VerdictError.String()}
+	start := time.Now()
+	defer func() { result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000 }()
+
+	object, err := api.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to get object: %v", err)
+		return result
+	}
+	defer object.Body.Close()
+	result.Size = aws.ToInt64(object.ContentLength)
+
+	contentType := aws.ToString(object.ContentType)
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	verdict, response, err := client.ScanResponse(ctx, &icapclient.HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers: map[string]string{
+			"Content-Type":   contentType,
+			"Content-Length": strconv.FormatInt(result.Size, 10),
+		},
+		BodyReader: io.LimitReader(object.Body, result.Size),
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	response.Close()
+
+	result.Verdict = verdict.String()
+	result.IcapStatus = response.StatusCode
+	result.RequestID = response.RequestID
+	result.SHA256 = response.ContentHashes[icapclient.HashSHA256]
+	result.Infection = response.Infection
+	result.Violations = response.Violations
+	if verdict != icapclient.VerdictBlocked || options.action == s3ActionNone {
+		return result
+	}
+
+	result.Action = options.action
+	switch options.action {
+	case s3ActionTag:
+		err = tagS3Object(ctx, api, bucket, key, verdict)
+	case s3ActionQuarantine:
+		err = quarantineS3Object(ctx, api, bucket, key, options)
+	}
+	if err != nil {
+		result.Action = ""
+		result.Error = fmt.Sprintf("failed to %s object: %v", options.action, err)
+	}
+	return result
+}
+
+// tagS3Object adds the verdict tag to the existing tags of an object
+func tagS3Object(ctx context.Context, api s3API, bucket, key string, verdict icapclient.Verdict) error {
+	existing, err := api.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+
+	tags := []types.Tag{{Key: aws.String(s3VerdictTag), Value: aws.String(verdict.String())}}
+	for _, tag := range existing.TagSet {
+		if aws.ToString(tag.Key) != s3VerdictTag {
+			tags = append(tags, tag)
+		}
+	}
+	_, err = api.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		Tagging: &types.Tagging{TagSet: tags},
+	})
+	return err
+}
+
+// quarantineS3Object moves an object under the quarantine prefix
+func quarantineS3Object(ctx context.Context, api s3API, bucket, key string, options s3ScanOptions) error {
+	destination := options.quarantineBucket
+	if destination == "" {
+		destination = bucket
+	}
+
+	_, err := api.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(destination),
+		Key:        aws.String(options.quarantinePrefix + key),
+		CopySource: aws.String(url.PathEscape(bucket) + "/" + (&url.URL{Path: key}).EscapedPath()),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = api.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	return err
+}
+
+// writeS3Report writes report as indented JSON
+func writeS3Report(w io.Writer, report *s3ScanReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
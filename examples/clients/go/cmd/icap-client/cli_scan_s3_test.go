@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3 is an in-memory s3API holding the objects of one bucket. Listings
+// return two keys per page to exercise pagination.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	tags    map[string][]types.Tag
+}
+
+func newFakeS3(objects map[string]string) *fakeS3 {
+	f := &fakeS3{objects: map[string][]byte{}, tags: map[string][]types.Tag{}}
+	for key, content := range objects {
+		f.objects[key] = []byte(content)
+	}
+	return f
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(aws.ToString(params.ContinuationToken))
+	end := start + 2
+	output := &s3.ListObjectsV2Output{}
+	if end < len(keys) {
+		output.IsTruncated = aws.Bool(true)
+		output.NextContinuationToken = aws.String(strconv.Itoa(end))
+	} else {
+		end = len(keys)
+	}
+	for _, key := range keys[start:end] {
+		output.Contents = append(output.Contents, types.Object{Key: aws.String(key), Size: aws.Int64(int64(len(f.objects[key])))})
+	}
+	return output, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(content)),
+		ContentLength: aws.Int64(int64(len(content))),
+	}, nil
+}
+
+func (f *fakeS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &s3.GetObjectTaggingOutput{TagSet: f.tags[aws.ToString(params.Key)]}, nil
+}
+
+func (f *fakeS3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tags[aws.ToString(params.Key)] = params.Tagging.TagSet
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	_, key, _ := strings.Cut(source, "/")
+	content, ok := f.objects[key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	f.objects[aws.ToString(params.Key)] = content
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// newS3TestClient returns a client of an icaptest server running
+// blockingHandler
+func newS3TestClient(t *testing.T) *icapclient.IcapClient {
+	t.Helper()
+
+	server := icaptest.NewServer(icaptest.HandlerFunc(blockingHandler))
+	t.Cleanup(server.Close)
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		KeepAlive:    true,
+		LoggingLevel: "ERROR",
+	})
+	t.Cleanup(client.Close)
+	return client
+}
+
+// TestParseS3URL tests splitting s3:// URLs into bucket and prefix
+func TestParseS3URL(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedBucket string
+		expectedPrefix string
+		expectError    bool
+	}{
+		{"s3://uploads", "uploads", "", false},
+		{"s3://uploads/2024/", "uploads", "2024/", false},
+		{"s3:///prefix", "", "", true},
+		{"https://uploads/prefix", "", "", true},
+	}
+
+	for _, tt := range tests {
+		bucket, prefix, err := parseS3URL(tt.input)
+		if (err != nil) != tt.expectError {
+			t.Errorf("parseS3URL(%q) error = %v, expectError %v", tt.input, err, tt.expectError)
+			continue
+		}
+		if bucket != tt.expectedBucket || prefix != tt.expectedPrefix {
+			t.Errorf("parseS3URL(%q) = %q, %q, expected %q, %q", tt.input, bucket, prefix, tt.expectedBucket, tt.expectedPrefix)
+		}
+	}
+}
+
+// TestScanS3 tests the report and the actions taken on blocked objects
+func TestScanS3(t *testing.T) {
+	client := newS3TestClient(t)
+	objects := map[string]string{
+		"docs/a.txt":            "clean",
+		"docs/b.txt":            "a virus",
+		"docs/sub/c.txt":        "also clean",
+		"docs/sub/d e.bin":      "virus again",
+		"other/e.txt":           "virus outside the prefix",
+		"quarantine/docs/x.txt": "virus already quarantined",
+	}
+
+	t.Run("none", func(t *testing.T) {
+		api := newFakeS3(objects)
+		report, err := scanS3(context.Background(), client, api, "bucket", "docs/", s3ScanOptions{action: s3ActionNone, concurrency: 2})
+		if err != nil {
+			t.Fatalf("scanS3 failed: %v", err)
+		}
+
+		expected := s3ScanSummary{Scanned: 4, Allowed: 2, Blocked: 2}
+		if report.Summary != expected {
+			t.Errorf("Expected summary %+v, got %+v", expected, report.Summary)
+		}
+		if report.Objects[1].Key != "docs/b.txt" || report.Objects[1].Verdict != "blocked" {
+			t.Fatalf("Expected docs/b.txt blocked, got %+v", report.Objects[1])
+		}
+		if report.Objects[1].Infection == nil || report.Objects[1].Infection.Threat != "Test-Virus" {
+			t.Errorf("Expected Test-Virus infection, got %+v", report.Objects[1].Infection)
+		}
+		if report.Objects[1].Action != "" || len(api.objects) != len(objects) {
+			t.Errorf("Expected no action, got %q", report.Objects[1].Action)
+		}
+
+		var buf bytes.Buffer
+		if err := writeS3Report(&buf, report); err != nil {
+			t.Fatalf("writeS3Report failed: %v", err)
+		}
+		var decoded s3ScanReport
+		if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded.Objects) != 4 {
+			t.Errorf("Expected a JSON report of 4 objects, got %s", buf.String())
+		}
+	})
+
+	t.Run("tag", func(t *testing.T) {
+		api := newFakeS3(objects)
+		api.tags["docs/b.txt"] = []types.Tag{{Key: aws.String("owner"), Value: aws.String("alice")}}
+		report, err := scanS3(context.Background(), client, api, "bucket", "docs/", s3ScanOptions{action: s3ActionTag, concurrency: 2})
+		if err != nil {
+			t.Fatalf("scanS3 failed: %v", err)
+		}
+
+		tags := map[string]string{}
+		for _, tag := range api.tags["docs/b.txt"] {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+		if tags[s3VerdictTag] != "blocked" || tags["owner"] != "alice" {
+			t.Errorf("Expected verdict tag added to existing tags, got %v", tags)
+		}
+		if _, ok := api.tags["docs/a.txt"]; ok {
+			t.Error("Expected allowed objects to be left untagged")
+		}
+		if report.Objects[1].Action != s3ActionTag {
+			t.Errorf("Expected tag action, got %q", report.Objects[1].Action)
+		}
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		api := newFakeS3(objects)
+		report, err := scanS3(context.Background(), client, api, "bucket", "", s3ScanOptions{action: s3ActionQuarantine, quarantinePrefix: "quarantine/", concurrency: 2})
+		if err != nil {
+			t.Fatalf("scanS3 failed: %v", err)
+		}
+
+		if report.Summary.Scanned != 5 {
+			t.Errorf("Expected quarantined objects to be skipped, scanned %d", report.Summary.Scanned)
+		}
+		for _, key := range []string{"docs/b.txt", "docs/sub/d e.bin", "other/e.txt"} {
+			if _, ok := api.objects[key]; ok {
+				t.Errorf("Expected %s to be removed", key)
+			}
+			if _, ok := api.objects["quarantine/"+key]; !ok {
+				t.Errorf("Expected %s to be quarantined", key)
+			}
+		}
+		if _, ok := api.objects["docs/a.txt"]; !ok {
+			t.Error("Expected allowed objects to stay in place")
+		}
+	})
+}
+
+// TestScanS3_ServerDown tests that scan failures are reported per object
+func TestScanS3_ServerDown(t *testing.T) {
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{Host: "127.0.0.1", Port: 1, Timeout: time.Second, LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	api := newFakeS3(map[string]string{"a.txt": "virus"})
+	report, err := scanS3(context.Background(), client, api, "bucket", "", s3ScanOptions{action: s3ActionQuarantine, quarantinePrefix: "quarantine/", concurrency: 1})
+	if err != nil {
+		t.Fatalf("scanS3 failed: %v", err)
+	}
+	if report.Summary.Errors != 1 || report.Objects[0].Error == "" {
+		t.Errorf("Expected one error, got %+v", report.Objects)
+	}
+	if _, ok := api.objects["a.txt"]; !ok {
+		t.Errorf("Expected the object to stay in place, got %v", api.objects)
+	}
+}
+
+// largeObjectS3 serves every object as size bytes generated on the fly
+type largeObjectS3 struct {
+	*fakeS3
+	size int64
+}
+
+func (f *largeObjectS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(io.LimitReader(rand.New(rand.NewSource(1)), f.size)),
+		ContentLength: aws.Int64(f.size),
+	}, nil
+}
+
+// TestScanS3Object_Spool tests that objects over the spool threshold are
+// spooled to disk rather than read into memory before they are sent
+func TestScanS3Object_Spool(t *testing.T) {
+	spoolDir := t.TempDir()
+	size := int64(s3SpoolThreshold + 1<<20)
+	var spooled atomic.Int64
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		files, _ := filepath.Glob(filepath.Join(spoolDir, "icap-spool-*"))
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				spooled.Store(info.Size())
+			}
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	config := &icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		LoggingLevel: "ERROR",
+		Spool:        icapclient.SpoolConfig{Directory: spoolDir},
+	}
+	applyS3SpoolConfig(config)
+	client := icapclient.NewIcapClient(config)
+	defer client.Close()
+
+	api := &largeObjectS3{fakeS3: newFakeS3(nil), size: size}
+	result := scanS3Object(context.Background(), client, api, "bucket", "large.bin", s3ScanOptions{action: s3ActionNone})
+	if result.Verdict != "allowed" || result.Size != size {
+		t.Fatalf("Expected the object allowed, got %+v", result)
+	}
+	if n := spooled.Load(); n != size {
+		t.Errorf("Expected a %d byte spool file while scanning, got %d", size, n)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/spf13/cobra"
+)
+
+// eicarTestString is the EICAR antivirus test file, detected as a virus by
+// every antivirus engine
+const eicarTestString = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// gtubeTestString is the GTUBE string, detected as spam by SpamAssassin and
+// most anti-spam engines
+const gtubeTestString = "XJS*C4JDBQADN1.NSBN3*2IDNEN*GTUBE-STANDARD-ANTI-UBE-TEST-EMAIL*C.34X"
+
+// selftestPayload is a test payload sent through RESPMOD
+type selftestPayload struct {
+	name        string
+	contentType string
+	filename    string
+	body        string
+	// detect is whether the server must block the payload
+	detect bool
+}
+
+// selftestPayloads are the payloads of the self-test. The clean payload
+// catches servers blocking everything.
+var selftestPayloads = []selftestPayload{
+	{name: "eicar", contentType: "application/octet-stream", filename: "eicar.com", body: eicarTestString, detect: true},
+	{
+		name: "gtube", contentType: "message/rfc822", filename: "gtube.eml", detect: true,
+		body: "From: selftest@example.com\r\nTo: postmaster@example.com\r\nSubject: GTUBE spam test\r\n\r\n" +
+			"This is the GTUBE, the Generic Test for Unsolicited Bulk Email.\r\n\r\n" + gtubeTestString + "\r\n",
+	},
+	{name: "clean", contentType: "text/plain", filename: "clean.txt", body: "icap-client selftest: this payload is clean\n"},
+}
+
+// selftestResult is the outcome of scanning a payload
+type selftestResult struct {
+	Payload string `json:"payload"`
+	// Expected is blocked or allowed
+	Expected  string  `json:"expected"`
+	Verdict   string  `json:"verdict"`
+	Status    int     `json:"status,omitempty"`
+	Threat    string  `json:"threat,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+	Passed    bool    `json:"passed"`
+}
+
+// newSelftestCommand creates the selftest command, which sends the EICAR
+// and GTUBE test payloads through RESPMOD and checks that they are detected
+func newSelftestCommand(opts *cliOptions) *cobra.Command {
+	var jsonOutput bool
+	var names []string
+
+	cmd := &cobra.Command{
+		Use:   "selftest",
+		Short: "Check that the ICAP server detects the EICAR and GTUBE test payloads",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payloads, err := selectPayloads(names)
+			if err != nil {
+				return err
+			}
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+			// A cached verdict would not test the server
+			config.ScanCache.Enabled = false
+			client := icapclient.NewIcapClient(config)
+			defer client.Close()
+
+			results := runSelftest(cmd.Context(), client, payloads)
+			out := cmd.OutOrStdout()
+			if jsonOutput {
+				encoder := json.NewEncoder(out)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(results); err != nil {
+					return err
+				}
+			} else {
+				printSelftest(out, results)
+			}
+
+			failed := 0
+			for _, result := range results {
+				if !result.Passed {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d payloads failed", failed, len(results))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the results as JSON")
+	cmd.Flags().StringSliceVar(&names, "payloads", []string{"eicar", "gtube", "clean"}, "Payloads to send: eicar, gtube and clean")
+	return cmd
+}
+
+// selectPayloads returns the payloads named in names
+func selectPayloads(names []string) ([]selftestPayload, error) {
+	var payloads []selftestPayload
+	for _, name := range names {
+		found := false
+		for _, payload := range selftestPayloads {
+			if strings.EqualFold(name, payload.name) {
+				payloads = append(payloads, payload)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown payload %q, expected eicar, gtube or clean", name)
+		}
+	}
+	return payloads, nil
+}
+
+// runSelftest scans payloads with client, in order
+func runSelftest(ctx context.Context, client *icapclient.IcapClient, payloads []selftestPayload) []selftestResult {
+	results := make([]selftestResult, 0, len(payloads))
+	for _, payload := range payloads {
+		results = append(results, scanPayload(ctx, client, payload))
+	}
+	return results
+}
+
+// scanPayload sends payload through RESPMOD as a download and checks the
+// verdict
+func scanPayload(ctx context.Context, client *icapclient.IcapClient, payload selftestPayload) selftestResult {
+	result := selftestResult{Payload: payload.name, Expected: icapclient.VerdictAllowed.String()}
+	if payload.detect {
+		result.Expected = icapclient.VerdictBlocked.String()
+	}
+
+	ctx = icapclient.WithRequestOptions(ctx, icapclient.RequestOptions{URL: "http://selftest.invalid/" + payload.filename})
+	start := time.Now()
+	verdict, response, err := client.ScanResponse(ctx, &icapclient.HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers: map[string]string{
+			"Content-Type":        payload.contentType,
+			"Content-Length":      strconv.Itoa(len(payload.body)),
+			"Content-Disposition": fmt.Sprintf("attachment; filename=%q", payload.filename),
+		},
+		Body: []byte(payload.body),
+	})
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	result.Verdict = verdict.String()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer response.Close()
+
+	result.Status = response.StatusCode
+	if report := response.ThreatReport(); report != nil {
+		result.Threat = report.ThreatName
+	}
+	detected := verdict == icapclient.VerdictBlocked || result.Threat != ""
+	switch {
+	case verdict == icapclient.VerdictError:
+		result.Error = fmt.Sprintf("ICAP server answered %d %s", response.StatusCode, response.Reason)
+	case response.Policy != nil && response.Policy.Action == icapclient.PolicyBypass:
+		result.Error = fmt.Sprintf("not scanned: client policy %s (rule %s)", response.Policy.Action, response.Policy.Rule)
+	case payload.detect && !detected:
+		result.Error = "not detected"
+	case !payload.detect && detected:
+		result.Error = "clean payload blocked"
+	default:
+		result.Passed = true
+	}
+	return result
+}
+
+// printSelftest prints results for humans
+func printSelftest(w io.Writer, results []selftestResult) {
+	passed := 0
+	for _, result := range results {
+		outcome := "FAIL"
+		if result.Passed {
+			outcome = "PASS"
+			passed++
+		}
+		line := fmt.Sprintf("  %s  %-6s expected %-8s got %s", outcome, result.Payload, result.Expected, result.Verdict)
+		if result.Status != 0 {
+			line += fmt.Sprintf(" (%d, %.1fms)", result.Status, result.LatencyMs)
+		}
+		if result.Threat != "" {
+			line += " threat=" + result.Threat
+		}
+		if result.Error != "" {
+			line += ": " + result.Error
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "\n%d of %d payloads passed\n", passed, len(results))
+}
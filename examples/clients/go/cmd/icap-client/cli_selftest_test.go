@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// newSelftestClient returns a client of an icaptest server running handler
+func newSelftestClient(t *testing.T, handler icaptest.HandlerFunc) *icapclient.IcapClient {
+	t.Helper()
+
+	server := icaptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{Host: host, Port: port, Timeout: 5 * time.Second, LoggingLevel: "ERROR"})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// detectingHandler blocks the EICAR and GTUBE payloads and allows the rest
+func detectingHandler(w icaptest.ResponseWriter, r *icaptest.Request) {
+	switch {
+	case bytes.Contains(r.Body, []byte("EICAR-STANDARD")):
+		w.Header().Set("X-Infection-Found", "Type=0; Resolution=2; Threat=EICAR-Test-File;")
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Status: "403 Forbidden", ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}}, false)
+	case bytes.Contains(r.Body, []byte("GTUBE")):
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Status: "403 Forbidden", ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}}, false)
+	default:
+		w.WriteHeader(204, nil, false)
+	}
+}
+
+// TestSelftest tests the verdicts on a server detecting both payloads
+func TestSelftest(t *testing.T) {
+	client := newSelftestClient(t, detectingHandler)
+
+	results := runSelftest(context.Background(), client, selftestPayloads)
+	for _, result := range results {
+		if !result.Passed {
+			t.Errorf("Expected %s to pass, got %+v", result.Payload, result)
+		}
+	}
+	if results[0].Threat != "EICAR-Test-File" {
+		t.Errorf("Expected threat EICAR-Test-File, got %q", results[0].Threat)
+	}
+
+	var out bytes.Buffer
+	printSelftest(&out, results)
+	if !strings.Contains(out.String(), "PASS  eicar") || !strings.Contains(out.String(), "3 of 3 payloads passed") {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
+
+// TestSelftest_NotDetected tests the verdicts on a server allowing
+// everything
+func TestSelftest_NotDetected(t *testing.T) {
+	client := newSelftestClient(t, func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(204, nil, false)
+	})
+
+	results := runSelftest(context.Background(), client, selftestPayloads)
+	for _, result := range results {
+		expected := result.Payload == "clean"
+		if result.Passed != expected {
+			t.Errorf("Expected %s passed=%v, got %+v", result.Payload, expected, result)
+		}
+		if !expected && result.Error != "not detected" {
+			t.Errorf("Expected %s not detected, got %q", result.Payload, result.Error)
+		}
+	}
+}
+
+// TestSelectPayloads tests the --payloads flag
+func TestSelectPayloads(t *testing.T) {
+	payloads, err := selectPayloads([]string{"GTUBE"})
+	if err != nil || len(payloads) != 1 || payloads[0].name != "gtube" {
+		t.Errorf("Expected the gtube payload, got %v, %v", payloads, err)
+	}
+	if _, err := selectPayloads([]string{"eicar", "virus"}); err == nil {
+		t.Error("Expected an error for an unknown payload")
+	}
+}
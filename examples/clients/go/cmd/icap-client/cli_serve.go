@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/spf13/cobra"
+)
+
+// newServeCommand creates the serve command, which exposes scanning as a
+// JSON HTTP API for applications that do not speak ICAP
+func newServeCommand(opts *cliOptions) *cobra.Command {
+	var listen string
+	var maxBodySize int64
+
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve /scan, /reqmod and /respmod over HTTP",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			client, shutdown, err := startDaemonClient(config, opts)
+			if err != nil {
+				return err
+			}
+			defer shutdown()
+
+			api := newAPIServer(client, maxBodySize)
+			if _, err := api.Start(listen); err != nil {
+				return fmt.Errorf("failed to start API server: %w", err)
+			}
+
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			return api.Shutdown(shutdownCtx)
+		},
+	}
+
+	cmd.Flags().StringVar(&listen, "listen", ":8088", "API HTTP listen address")
+	cmd.Flags().Int64Var(&maxBodySize, "max-body-size", 100<<20, "Largest request body accepted, in bytes (0 for no limit)")
+	return cmd
+}
+
+// apiServer translates JSON and multipart HTTP requests to ICAP calls
+type apiServer struct {
+	client      *icapclient.IcapClient
+	maxBodySize int64
+	server      *http.Server
+}
+
+// scanResult is the JSON answer of the API endpoints
+type scanResult struct {
+	Verdict      string                   `json:"verdict"`
+	IcapStatus   int                      `json:"icap_status,omitempty"`
+	IcapReason   string                   `json:"icap_reason,omitempty"`
+	RequestID    string                   `json:"request_id,omitempty"`
+	Infection    *icapclient.Infection    `json:"infection,omitempty"`
+	Violations   []icapclient.Violation   `json:"violations,omitempty"`
+	ThreatReport *icapclient.ThreatReport `json:"threat_report,omitempty"`
+	HttpRequest  *icapclient.HttpRequest  `json:"http_request,omitempty"`
+	HttpResponse *icapclient.HttpResponse `json:"http_response,omitempty"`
+	Error        string                   `json:"error,omitempty"`
+}
+
+// newAPIServer creates the API server for client. Request bodies larger
+// than maxBodySize are refused, unless it is zero.
+func newAPIServer(client *icapclient.IcapClient, maxBodySize int64) *apiServer {
+	api := &apiServer{client: client, maxBodySize: maxBodySize}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", api.handleScan)
+	mux.HandleFunc("/reqmod", api.handleReqmod)
+	mux.HandleFunc("/respmod", api.handleRespmod)
+
+	api.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return api
+}
+
+// Start listens on addr and serves API requests in the background
+func (a *apiServer) Start(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := a.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.client.Logger().Error("API server failed", "error", err)
+		}
+	}()
+
+	a.client.Logger().Info("API server listening", "addr", listener.Addr().String())
+	return listener.Addr(), nil
+}
+
+// Shutdown gracefully stops the API server
+func (a *apiServer) Shutdown(ctx context.Context) error {
+	return a.server.Shutdown(ctx)
+}
+
+// handleScan scans the "file" part of a multipart upload through RESPMOD,
+// streaming it to the ICAP server as it is received
+func (a *apiServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	if !a.accept(w, r) {
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, scanResult{Error: "expected a multipart/form-data upload"})
+		return
+	}
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			writeJSON(w, http.StatusBadRequest, scanResult{Error: `missing "file" part`})
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		if contentType == "" || contentType == "application/octet-stream" {
+			if byName := mime.TypeByExtension(filepath.Ext(part.FileName())); byName != "" {
+				contentType = byName
+			}
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		verdict, response, err := a.client.ScanResponse(a.requestContext(r), &icapclient.HttpResponse{
+			Version:    "HTTP/1.1",
+			StatusCode: 200,
+			Reason:     "OK",
+			Headers:    map[string]string{"Content-Type": contentType},
+			BodyReader: part,
+		})
+		a.writeResult(w, verdict, response, err)
+		return
+	}
+}
+
+// handleReqmod sends the JSON encoded HTTP request in the body through REQMOD
+func (a *apiServer) handleReqmod(w http.ResponseWriter, r *http.Request) {
+	var httpRequest icapclient.HttpRequest
+	if !a.decode(w, r, &httpRequest) {
+		return
+	}
+	if httpRequest.Version == "" {
+		httpRequest.Version = "HTTP/1.1"
+	}
+
+	verdict, response, err := a.client.ScanRequest(a.requestContext(r), &httpRequest)
+	a.writeResult(w, verdict, response, err)
+}
+
+// handleRespmod sends the JSON encoded HTTP response in the body through RESPMOD
+func (a *apiServer) handleRespmod(w http.ResponseWriter, r *http.Request) {
+	var httpResponse icapclient.HttpResponse
+	if !a.decode(w, r, &httpResponse) {
+		return
+	}
+	if httpResponse.Version == "" {
+		httpResponse.Version = "HTTP/1.1"
+	}
+
+	verdict, response, err := a.client.ScanResponse(a.requestContext(r), &httpResponse)
+	a.writeResult(w, verdict, response, err)
+}
+
+// accept checks the method of r and limits its body size
+func (a *apiServer) accept(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, scanResult{Error: "method not allowed"})
+		return false
+	}
+	if a.maxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, a.maxBodySize)
+	}
+	return true
+}
+
+// decode reads the JSON body of r into value
+func (a *apiServer) decode(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if !a.accept(w, r) {
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+		writeError(w, fmt.Errorf("invalid JSON body: %w", err))
+		return false
+	}
+	return true
+}
+
+// writeError answers an unreadable API request with 400 Bad Request, or 413
+// Request Entity Too Large when its body is over the size limit
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		status = http.StatusRequestEntityTooLarge
+	}
+	writeJSON(w, status, scanResult{Error: err.Error()})
+}
+
+// requestContext propagates the X-Request-ID of the API call and the
+// address of its caller to the ICAP request
+func (a *apiServer) requestContext(r *http.Request) context.Context {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	return icapclient.WithRequestOptions(r.Context(), icapclient.RequestOptions{
+		RequestID: r.Header.Get("X-Request-ID"),
+		ClientIP:  clientIP,
+	})
+}
+
+// writeResult answers with the verdict of a scan. Scans that failed to
+// reach a verdict are answered with 502 Bad Gateway.
+func (a *apiServer) writeResult(w http.ResponseWriter, verdict icapclient.Verdict, response *icapclient.IcapResponse, err error) {
+	result := scanResult{Verdict: verdict.String()}
+	if response != nil {
+		defer response.Close()
+		result.IcapStatus = response.StatusCode
+		result.IcapReason = response.Reason
+		result.RequestID = response.RequestID
+		result.Infection = response.Infection
+		result.Violations = response.Violations
+		result.ThreatReport = response.ThreatReport()
+		if result.HttpRequest, err = readRequest(response.HttpRequest); err == nil {
+			result.HttpResponse, err = readResponse(response.HttpResponse)
+		}
+	}
+
+	status := http.StatusOK
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		status = http.StatusRequestEntityTooLarge
+		result.Error = err.Error()
+	case err != nil:
+		status = http.StatusBadGateway
+		result.Error = err.Error()
+	case verdict == icapclient.VerdictError:
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, result)
+}
+
+// readRequest reads back an adapted request body spooled to disk, so that it
+// can be encoded as JSON
+func readRequest(r *icapclient.HttpRequest) (*icapclient.HttpRequest, error) {
+	if r == nil || r.BodyReader == nil {
+		return r, nil
+	}
+	body, err := io.ReadAll(r.BodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read adapted request body: %w", err)
+	}
+	adapted := *r
+	adapted.Body, adapted.BodyReader = body, nil
+	return &adapted, nil
+}
+
+// readResponse reads back an adapted response body spooled to disk, so that
+// it can be encoded as JSON
+func readResponse(r *icapclient.HttpResponse) (*icapclient.HttpResponse, error) {
+	if r == nil || r.BodyReader == nil {
+		return r, nil
+	}
+	body, err := io.ReadAll(r.BodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read adapted response body: %w", err)
+	}
+	adapted := *r
+	adapted.Body, adapted.BodyReader = body, nil
+	return &adapted, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// blockingHandler blocks requests to /blocked and responses containing
+// "virus", and echoes the request ID it received
+func blockingHandler(w icaptest.ResponseWriter, r *icaptest.Request) {
+	w.Header().Set("X-Echo-Request-ID", r.Header.Get("X-Request-ID"))
+	switch {
+	case r.Method == "REQMOD" && strings.HasPrefix(r.Request.URL.Path, "/blocked"):
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/html"}}}, true)
+		w.Write([]byte("<h1>Blocked</h1>"))
+	case r.Method == "RESPMOD" && strings.Contains(string(r.Body), "virus"):
+		w.Header().Set("X-Infection-Found", "Type=0; Resolution=2; Threat=Test-Virus;")
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/plain"}}}, true)
+		w.Write([]byte("infected"))
+	default:
+		w.WriteHeader(204, nil, false)
+	}
+}
+
+// startTestAPI starts an API server backed by an icaptest server and
+// returns its base URL
+func startTestAPI(t *testing.T, maxBodySize int64) string {
+	t.Helper()
+
+	server := icaptest.NewServer(icaptest.HandlerFunc(blockingHandler))
+	t.Cleanup(server.Close)
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		KeepAlive:    true,
+		LoggingLevel: "ERROR",
+	})
+	t.Cleanup(client.Close)
+
+	api := newAPIServer(client, maxBodySize)
+	addr, err := api.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start API server: %v", err)
+	}
+	t.Cleanup(func() { api.Shutdown(context.Background()) })
+	return "http://" + addr.String()
+}
+
+// postScan posts a request to the API and decodes its result
+func postScan(t *testing.T, url, contentType string, body []byte) (int, scanResult) {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Request-ID", "api-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	var result scanResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+	return resp.StatusCode, result
+}
+
+// uploadBody returns a multipart upload of content as the "file" part
+func uploadBody(t *testing.T, filename, content string) (string, []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writer.WriteField("comment", "ignored")
+	part, _ := writer.CreateFormFile("file", filename)
+	part.Write([]byte(content))
+	writer.Close()
+	return writer.FormDataContentType(), buf.Bytes()
+}
+
+// TestAPIServer_Scan tests multipart file scanning
+func TestAPIServer_Scan(t *testing.T) {
+	base := startTestAPI(t, 0)
+
+	tests := []struct {
+		name            string
+		content         string
+		expectedVerdict string
+		expectedThreat  string
+	}{
+		{"Clean", "hello world", "allowed", ""},
+		{"Infected", "a virus inside", "blocked", "Test-Virus"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, body := uploadBody(t, "file.txt", tt.content)
+			status, result := postScan(t, base+"/scan", contentType, body)
+
+			if status != http.StatusOK {
+				t.Errorf("Expected status 200, got %d (%s)", status, result.Error)
+			}
+			if result.Verdict != tt.expectedVerdict {
+				t.Errorf("Expected verdict %s, got %s", tt.expectedVerdict, result.Verdict)
+			}
+			if tt.expectedThreat != "" && (result.Infection == nil || result.Infection.Threat != tt.expectedThreat) {
+				t.Errorf("Expected threat %s, got %v", tt.expectedThreat, result.Infection)
+			}
+			if tt.expectedThreat != "" && (result.ThreatReport == nil || result.ThreatReport.ThreatName != tt.expectedThreat) {
+				t.Errorf("Expected threat report for %s, got %+v", tt.expectedThreat, result.ThreatReport)
+			}
+			if result.RequestID != "api-1" {
+				t.Errorf("Expected request ID api-1, got %q", result.RequestID)
+			}
+		})
+	}
+}
+
+// TestAPIServer_JSON tests the REQMOD and RESPMOD JSON endpoints
+func TestAPIServer_JSON(t *testing.T) {
+	base := startTestAPI(t, 0)
+
+	tests := []struct {
+		name            string
+		path            string
+		message         interface{}
+		expectedVerdict string
+		expectedBody    string
+	}{
+		{"Allowed request", "/reqmod", icapclient.HttpRequest{Method: "GET", URI: "/clean", Headers: map[string]string{"Host": "example.com"}}, "allowed", ""},
+		{"Blocked request", "/reqmod", icapclient.HttpRequest{Method: "GET", URI: "/blocked", Headers: map[string]string{"Host": "example.com"}}, "blocked", "<h1>Blocked</h1>"},
+		{"Allowed response", "/respmod", icapclient.HttpResponse{StatusCode: 200, Reason: "OK", Body: []byte("clean")}, "allowed", ""},
+		{"Blocked response", "/respmod", icapclient.HttpResponse{StatusCode: 200, Reason: "OK", Body: []byte("virus")}, "blocked", "infected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.message)
+			status, result := postScan(t, base+tt.path, "application/json", body)
+
+			if status != http.StatusOK {
+				t.Errorf("Expected status 200, got %d (%s)", status, result.Error)
+			}
+			if result.Verdict != tt.expectedVerdict {
+				t.Errorf("Expected verdict %s, got %s", tt.expectedVerdict, result.Verdict)
+			}
+			if tt.expectedBody != "" && (result.HttpResponse == nil || string(result.HttpResponse.Body) != tt.expectedBody) {
+				t.Errorf("Expected block page %q, got %+v", tt.expectedBody, result.HttpResponse)
+			}
+		})
+	}
+}
+
+// TestAPIServer_Errors tests the answers to invalid API requests
+func TestAPIServer_Errors(t *testing.T) {
+	base := startTestAPI(t, 512)
+
+	if status, _ := postScan(t, base+"/reqmod", "application/json", []byte("{")); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON, got %d", status)
+	}
+	if status, _ := postScan(t, base+"/scan", "text/plain", []byte("data")); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a non-multipart upload, got %d", status)
+	}
+
+	contentType, body := uploadBody(t, "big.bin", strings.Repeat("x", 1024))
+	if status, result := postScan(t, base+"/scan", contentType, body); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized upload, got %d (%s)", status, result.Error)
+	}
+
+	resp, err := http.Get(base + "/scan")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// maxRecordedLatency bounds the latency histogram; slower requests are clamped
+const maxRecordedLatency = 5 * time.Minute
+
+// latencyRecorder collects latency, throughput and status statistics for
+// batch and bench runs
+type latencyRecorder struct {
+	mu        sync.Mutex
+	histogram *hdrhistogram.Histogram
+	statuses  map[string]int
+	bytes     int64
+	started   time.Time
+	finished  time.Time
+}
+
+// newLatencyRecorder creates a recorder with microsecond resolution
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{
+		histogram: hdrhistogram.New(1, maxRecordedLatency.Microseconds(), 3),
+		statuses:  make(map[string]int),
+		started:   time.Now(),
+	}
+}
+
+// Record records one transaction; a nil response counts as an error
+func (r *latencyRecorder) Record(latency time.Duration, bytes int, response *icapclient.IcapResponse, err error) {
+	if latency > maxRecordedLatency {
+		latency = maxRecordedLatency
+	}
+
+	status := "error"
+	if err == nil && response != nil {
+		status = fmt.Sprintf("%d", response.StatusCode)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.histogram.RecordValue(latency.Microseconds())
+	r.statuses[status]++
+	r.bytes += int64(bytes)
+	r.finished = time.Now()
+}
+
+// quantile returns the latency at quantile q (0-100)
+func (r *latencyRecorder) quantile(q float64) time.Duration {
+	return time.Duration(r.histogram.ValueAtQuantile(q)) * time.Microsecond
+}
+
+// PrintSummary prints percentile latencies, throughput and per-status counts
+func (r *latencyRecorder) PrintSummary(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elapsed := r.finished.Sub(r.started)
+	total := r.histogram.TotalCount()
+
+	fmt.Fprintf(w, "Requests:   %d in %s\n", total, elapsed.Round(time.Millisecond))
+	if total == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "Latency:    p50=%s p90=%s p99=%s max=%s\n",
+		r.quantile(50), r.quantile(90), r.quantile(99),
+		time.Duration(r.histogram.Max())*time.Microsecond)
+
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		fmt.Fprintf(w, "Throughput: %.2f req/s, %.2f MB/s\n",
+			float64(total)/seconds, float64(r.bytes)/seconds/(1<<20))
+	}
+
+	statuses := make([]string, 0, len(r.statuses))
+	for status := range r.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	fmt.Fprint(w, "Statuses:  ")
+	for _, status := range statuses {
+		fmt.Fprintf(w, " %s=%d", status, r.statuses[status])
+	}
+	fmt.Fprintln(w)
+}
+
+// WriteHistogram writes the latency distribution in HdrHistogram percentile
+// format (milliseconds), which can be plotted or compared across runs
+func (r *latencyRecorder) WriteHistogram(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.histogram.PercentilesPrint(file, 5, 1000.0); err != nil {
+		return err
+	}
+	return file.Close()
+}
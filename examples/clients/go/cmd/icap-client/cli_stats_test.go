@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// TestLatencyRecorder tests the batch/bench summary
+func TestLatencyRecorder(t *testing.T) {
+	recorder := newLatencyRecorder()
+	for i := 1; i <= 100; i++ {
+		recorder.Record(time.Duration(i)*time.Millisecond, 1<<10, &icapclient.IcapResponse{StatusCode: 204}, nil)
+	}
+	recorder.Record(time.Second, 0, nil, errors.New("timeout"))
+
+	if p50 := recorder.quantile(50); p50 < 49*time.Millisecond || p50 > 52*time.Millisecond {
+		t.Errorf("Expected p50 around 50ms, got %s", p50)
+	}
+
+	var buf bytes.Buffer
+	recorder.PrintSummary(&buf)
+	summary := buf.String()
+
+	for _, expected := range []string{"Requests:   101", "p99=", "max=1.", "MB/s", "204=100", "error=1"} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("Expected summary to contain %q, got:\n%s", expected, summary)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "latency.hgrm")
+	if err := recorder.WriteHistogram(path); err != nil {
+		t.Fatalf("Failed to write histogram: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "Percentile") {
+		t.Errorf("Expected HdrHistogram percentile output, got %q", data)
+	}
+}
+
+// TestCollectScanFiles tests scan argument expansion
+func TestCollectScanFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0o755)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644)
+	os.WriteFile(filepath.Join(dir, "sub", "b.html"), []byte("b"), 0o644)
+
+	if _, err := collectScanFiles([]string{dir}, false); err == nil {
+		t.Error("Expected an error for a directory without --recursive")
+	}
+
+	files, err := collectScanFiles([]string{dir}, true)
+	if err != nil {
+		t.Fatalf("Failed to collect files: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected 2 files, got %v", files)
+	}
+
+	files, err = collectScanFiles([]string{filepath.Join(dir, "a.txt")}, false)
+	if err != nil || len(files) != 1 {
+		t.Errorf("Expected a single file, got %v, %v", files, err)
+	}
+}
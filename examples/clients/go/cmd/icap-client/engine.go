@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errEngineClosed is returned when submitting to a closed scanEngine
+var errEngineClosed = errors.New("scan engine closed")
+
+// scanJob is a unit of work run by a scanEngine worker. The context is
+// cancelled when the engine is shut down before the job completes.
+type scanJob func(ctx context.Context)
+
+// scanEngine runs scan jobs on a fixed pool of workers fed by a bounded
+// queue. Submit blocks while the queue is full, so producers are slowed to
+// the pace of the workers instead of spawning a goroutine per object.
+type scanEngine struct {
+	jobs   chan scanJob
+	quit   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+	workers   sync.WaitGroup
+}
+
+// newScanEngine starts workers goroutines consuming a queue of queueSize
+// jobs. Jobs run with a context derived from ctx.
+func newScanEngine(ctx context.Context, workers, queueSize int) *scanEngine {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	e := &scanEngine{
+		jobs:   make(chan scanJob, queueSize),
+		quit:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	e.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go e.work()
+	}
+	return e
+}
+
+// work runs queued jobs until the queue is closed and drained
+func (e *scanEngine) work() {
+	defer e.workers.Done()
+	for job := range e.jobs {
+		job(e.ctx)
+	}
+}
+
+// Submit queues job, blocking while the queue is full. It fails when ctx is
+// done or the engine is closed before the job could be queued.
+func (e *scanEngine) Submit(ctx context.Context, job scanJob) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return errEngineClosed
+	}
+
+	select {
+	case e.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.quit:
+		return errEngineClosed
+	}
+}
+
+// Close stops accepting jobs and waits for the queued and running jobs to
+// finish. Submit calls blocked on a full queue fail with errEngineClosed.
+func (e *scanEngine) Close() {
+	e.closeOnce.Do(func() {
+		close(e.quit)
+
+		e.mu.Lock()
+		e.closed = true
+		close(e.jobs)
+		e.mu.Unlock()
+	})
+	e.workers.Wait()
+	e.cancel()
+}
+
+// Shutdown drains the engine like Close, cancelling the context of the
+// remaining jobs if ctx is done first
+func (e *scanEngine) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		e.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		e.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestScanEngine_RunsAllJobs tests that every submitted job runs with at
+// most the configured number of workers active
+func TestScanEngine_RunsAllJobs(t *testing.T) {
+	const workers = 3
+	engine := newScanEngine(context.Background(), workers, 2)
+
+	var ran, active, maxActive int64
+	for i := 0; i < 50; i++ {
+		err := engine.Submit(context.Background(), func(ctx context.Context) {
+			n := atomic.AddInt64(&active, 1)
+			for {
+				max := atomic.LoadInt64(&maxActive)
+				if n <= max || atomic.CompareAndSwapInt64(&maxActive, max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&active, -1)
+			atomic.AddInt64(&ran, 1)
+		})
+		if err != nil {
+			t.Fatalf("Failed to submit job: %v", err)
+		}
+	}
+	engine.Close()
+
+	if ran != 50 {
+		t.Errorf("Expected 50 jobs to run, got %d", ran)
+	}
+	if maxActive > workers {
+		t.Errorf("Expected at most %d active jobs, got %d", workers, maxActive)
+	}
+}
+
+// TestScanEngine_Backpressure tests that Submit blocks while the workers are
+// busy and the queue is full
+func TestScanEngine_Backpressure(t *testing.T) {
+	release := make(chan struct{})
+	engine := newScanEngine(context.Background(), 1, 1)
+	defer engine.Close()
+	defer close(release)
+
+	block := func(ctx context.Context) { <-release }
+	// One job occupies the worker, one fills the queue
+	for i := 0; i < 2; i++ {
+		if err := engine.Submit(context.Background(), block); err != nil {
+			t.Fatalf("Failed to submit job: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := engine.Submit(ctx, block); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Submit to block until the deadline, got %v", err)
+	}
+}
+
+// TestScanEngine_CloseDrains tests that Close runs queued jobs and rejects
+// new and blocked submissions
+func TestScanEngine_CloseDrains(t *testing.T) {
+	release := make(chan struct{})
+	engine := newScanEngine(context.Background(), 1, 1)
+
+	var ran int64
+	job := func(ctx context.Context) {
+		<-release
+		atomic.AddInt64(&ran, 1)
+	}
+	for i := 0; i < 2; i++ {
+		if err := engine.Submit(context.Background(), job); err != nil {
+			t.Fatalf("Failed to submit job: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var blockedErr error
+	go func() {
+		defer wg.Done()
+		blockedErr = engine.Submit(context.Background(), job)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		engine.Close()
+		close(closed)
+	}()
+	wg.Wait()
+	if !errors.Is(blockedErr, errEngineClosed) {
+		t.Errorf("Expected blocked Submit to fail with errEngineClosed, got %v", blockedErr)
+	}
+
+	close(release)
+	<-closed
+	if ran != 2 {
+		t.Errorf("Expected the 2 queued jobs to run, got %d", ran)
+	}
+	if err := engine.Submit(context.Background(), job); !errors.Is(err, errEngineClosed) {
+		t.Errorf("Expected errEngineClosed after Close, got %v", err)
+	}
+}
+
+// TestScanEngine_ShutdownDeadline tests that Shutdown cancels running jobs
+// when its context expires
+func TestScanEngine_ShutdownDeadline(t *testing.T) {
+	engine := newScanEngine(context.Background(), 1, 0)
+
+	cancelled := make(chan struct{})
+	started := make(chan struct{})
+	if err := engine.Submit(context.Background(), func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+	}); err != nil {
+		t.Fatalf("Failed to submit job: %v", err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := engine.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	default:
+		t.Error("Expected the running job to be cancelled")
+	}
+}
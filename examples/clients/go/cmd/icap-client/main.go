@@ -0,0 +1,156 @@
+// Command icap-client is the command line interface of the G3ICAP Go client.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/spf13/cobra"
+)
+
+// main function and CLI
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line args and returns the exit status, 1 if
+// the command failed
+func run(args []string, stdout, stderr io.Writer) int {
+	rootCmd := newRootCommand()
+	rootCmd.SetArgs(args)
+	rootCmd.SetOut(stdout)
+	rootCmd.SetErr(stderr)
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// newRootCommand returns the icap-client command with its subcommands.
+// Errors are printed by run, and usage only when asked for, so that a
+// failed scan or check does not end with the help text.
+func newRootCommand() *cobra.Command {
+	var rootCmd = &cobra.Command{
+		Use:           "icap-client",
+		Short:         "G3ICAP Go Client",
+		Long:          "A comprehensive Go client for interacting with G3ICAP servers",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	opts := &cliOptions{}
+
+	rootCmd.PersistentFlags().StringVar(&opts.configPath, "config", "", "Configuration file path")
+	rootCmd.PersistentFlags().StringVar(&opts.host, "host", "127.0.0.1", "ICAP server host")
+	rootCmd.PersistentFlags().IntVar(&opts.port, "port", 1344, "ICAP server port")
+	rootCmd.PersistentFlags().StringVar(&opts.method, "method", "options", "ICAP method (reqmod, respmod, options, or a vendor method such as log)")
+	rootCmd.PersistentFlags().BoolVar(&opts.verbose, "verbose", false, "Verbose logging")
+	rootCmd.PersistentFlags().StringVar(&opts.adminListen, "admin-listen", "", "Admin HTTP listen address for long-running modes (e.g. :9090)")
+	rootCmd.PersistentFlags().BoolVar(&opts.adminPprof, "admin-pprof", false, "Expose pprof profiling endpoints on the admin listener")
+	rootCmd.PersistentFlags().DurationVar(&opts.readyTTL, "ready-ttl", time.Minute, "How long a successful OPTIONS keeps /readyz ready")
+
+	rootCmd.AddCommand(newMonitorCommand(opts))
+	rootCmd.AddCommand(newScanCommand(opts))
+	rootCmd.AddCommand(newBenchCommand(opts))
+	rootCmd.AddCommand(newServeCommand(opts))
+	rootCmd.AddCommand(newProxyCommand(opts))
+	rootCmd.AddCommand(newMilterCommand(opts))
+	rootCmd.AddCommand(newInitCommand(opts))
+	rootCmd.AddCommand(newProbeCommand(opts))
+	rootCmd.AddCommand(newConformanceCommand())
+	rootCmd.AddCommand(newSelftestCommand(opts))
+	rootCmd.AddCommand(newCompareCommand(opts))
+	rootCmd.AddCommand(newReplayCommand(opts))
+
+	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		// Load configuration
+		config, err := opts.loadConfig()
+		if err != nil {
+			return err
+		}
+
+		// Create client
+		client := icapclient.NewIcapClient(config)
+		defer client.Close()
+
+		ctx := context.Background()
+
+		// Execute method
+		switch opts.method {
+		case "options":
+			response, err := client.Options(ctx)
+			if err != nil {
+				return fmt.Errorf("OPTIONS request failed: %w", err)
+			}
+			fmt.Printf("OPTIONS Response: %d %s\n", response.StatusCode, response.Reason)
+			fmt.Printf("Headers: %+v\n", response.Headers)
+			if optBody := response.OptBody; optBody != nil {
+				if optBody.Fields != nil {
+					fmt.Printf("Opt-body (%s): %+v\n", optBody.Type, optBody.Fields)
+				} else {
+					fmt.Printf("Opt-body (%s): %d bytes\n", optBody.Type, len(optBody.Bytes()))
+				}
+			}
+
+		case "reqmod":
+			httpRequest := &icapclient.HttpRequest{
+				Method:  "GET",
+				URI:     "/",
+				Version: "HTTP/1.1",
+				Headers: map[string]string{
+					"Host":       "example.com",
+					"User-Agent": "Go-Client",
+				},
+			}
+
+			response, err := client.Reqmod(ctx, httpRequest)
+			if err != nil {
+				return fmt.Errorf("REQMOD request failed: %w", err)
+			}
+			fmt.Printf("REQMOD Response: %d %s\n", response.StatusCode, response.Reason)
+
+		case "respmod":
+			httpResponse := &icapclient.HttpResponse{
+				Version:    "HTTP/1.1",
+				StatusCode: 200,
+				Reason:     "OK",
+				Headers: map[string]string{
+					"Content-Type": "text/html",
+				},
+				Body: []byte("<html><body>Hello World</body></html>"),
+			}
+
+			response, err := client.Respmod(ctx, httpResponse)
+			if err != nil {
+				return fmt.Errorf("RESPMOD request failed: %w", err)
+			}
+			fmt.Printf("RESPMOD Response: %d %s\n", response.StatusCode, response.Reason)
+
+		default:
+			method := icapclient.IcapMethod(strings.ToUpper(opts.method))
+			response, err := client.Do(ctx, method, nil)
+			if err != nil {
+				return fmt.Errorf("%s request failed: %w", method, err)
+			}
+			fmt.Printf("%s Response: %d %s\n", method, response.StatusCode, response.Reason)
+			fmt.Printf("Headers: %+v\n", response.Headers)
+		}
+
+		// Health check
+		health, err := client.HealthCheck(ctx)
+		if err != nil {
+			return fmt.Errorf("health check failed: %w", err)
+		}
+		fmt.Printf("Health Check: %+v\n", health)
+
+		return nil
+	}
+
+	return rootCmd
+}
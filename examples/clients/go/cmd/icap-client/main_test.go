@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestRun_ExitStatus tests that failed checks exit non-zero without
+// printing the usage
+func TestRun_ExitStatus(t *testing.T) {
+	detecting := icaptest.NewServer(icaptest.HandlerFunc(detectingHandler))
+	defer detecting.Close()
+	always204 := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(204, nil, false)
+	}))
+	defer always204.Close()
+	notFound := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(404, nil, false)
+	}))
+	defer notFound.Close()
+	serverFlags := func(server *icaptest.Server) []string {
+		host, port := server.HostPort()
+		return []string{"--host", host, "--port", strconv.Itoa(port)}
+	}
+
+	samples := t.TempDir()
+	os.WriteFile(filepath.Join(samples, "eicar.txt"), []byte(eicarTestString), 0o644)
+	compare := func(a, b *icaptest.Server) []string {
+		return []string{"compare", "--a", a.URL + "/respmod", "--b", b.URL + "/respmod", "--input", samples}
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+	}{
+		{"Selftest pass", append([]string{"selftest"}, serverFlags(detecting)...), 0},
+		{"Selftest failure", append([]string{"selftest"}, serverFlags(always204)...), 1},
+		{"Conformance failure", []string{"conformance", always204.URL + "/respmod"}, 1},
+		{"Probe pass", append([]string{"probe"}, serverFlags(always204)...), 0},
+		{"Probe failure", append([]string{"probe"}, serverFlags(notFound)...), 1},
+		{"Compare same verdicts", compare(detecting, detecting), 0},
+		{"Compare different verdicts", compare(detecting, always204), 1},
+		{"Unknown flag", []string{"--no-such-flag"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if status := run(tt.args, &stdout, &stderr); status != tt.status {
+				t.Errorf("Expected exit status %d, got %d\n%s%s", tt.status, status, stdout.String(), stderr.String())
+			}
+			if tt.status != 0 && !strings.HasPrefix(stderr.String(), "Error: ") {
+				t.Errorf("Expected the error on stderr, got %q", stderr.String())
+			}
+			if strings.Contains(stderr.String(), "Usage:") || strings.Contains(stdout.String(), "Usage:") {
+				t.Errorf("Expected no usage on failure, got\n%s%s", stdout.String(), stderr.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Command icap-gateway serves the G3ICAP Go client over gRPC, so that
+// services in any language can scan HTTP messages and files through the
+// client's connection pool without speaking ICAP themselves.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/gatewaypb"
+)
+
+// gatewayOptions holds the command line options of the gateway
+type gatewayOptions struct {
+	configPath string
+	host       string
+	port       int
+	listen     string
+}
+
+// loadConfig loads the client configuration from a file or the flags
+func (o *gatewayOptions) loadConfig() (*icapclient.IcapConfig, error) {
+	if o.configPath != "" {
+		config, err := icapclient.LoadConfig(o.configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+		return config, nil
+	}
+	return &icapclient.IcapConfig{
+		Host:               o.host,
+		Port:               o.port,
+		Timeout:            30 * time.Second,
+		Retries:            3,
+		RetryDelay:         time.Second,
+		MaxRetryDelay:      60 * time.Second,
+		BackoffFactor:      2.0,
+		ConnectionPoolSize: 10,
+		KeepAlive:          true,
+		VerifySSL:          true,
+		LoggingLevel:       "INFO",
+		MetricsEnabled:     true,
+	}, nil
+}
+
+func main() {
+	opts := &gatewayOptions{}
+	rootCmd := &cobra.Command{
+		Use:   "icap-gateway",
+		Short: "gRPC scanning gateway for G3ICAP",
+		Long:  "Serve ScanRequest, ScanResponse and ScanFile over gRPC, backed by a pooled ICAP client",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := opts.loadConfig()
+			if err != nil {
+				return err
+			}
+
+			client := icapclient.NewIcapClient(config)
+			defer client.Close()
+
+			listener, err := net.Listen("tcp", opts.listen)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", opts.listen, err)
+			}
+
+			server := grpc.NewServer()
+			gatewaypb.RegisterScanServiceServer(server, newScanServer(client))
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if opts.configPath != "" {
+				if err := client.WatchConfig(ctx, opts.configPath, opts.loadConfig); err != nil {
+					client.Logger().Warn("Config hot reload disabled", "error", err)
+				}
+			}
+			go func() {
+				<-ctx.Done()
+				server.GracefulStop()
+			}()
+
+			client.Logger().Info("gRPC gateway listening", "addr", listener.Addr().String())
+			return server.Serve(listener)
+		},
+	}
+
+	rootCmd.Flags().StringVar(&opts.configPath, "config", "", "Configuration file path")
+	rootCmd.Flags().StringVar(&opts.host, "host", "127.0.0.1", "ICAP server host")
+	rootCmd.Flags().IntVar(&opts.port, "port", 1344, "ICAP server port")
+	rootCmd.Flags().StringVar(&opts.listen, "listen", ":9000", "gRPC listen address")
+
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintf(rootCmd.OutOrStderr(), "Error: %v\n", err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"path/filepath"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/gatewaypb"
+)
+
+// scanServer implements the gRPC ScanService with an ICAP client
+type scanServer struct {
+	gatewaypb.UnimplementedScanServiceServer
+	client *icapclient.IcapClient
+}
+
+// newScanServer creates a ScanService backed by client
+func newScanServer(client *icapclient.IcapClient) *scanServer {
+	return &scanServer{client: client}
+}
+
+// ScanRequest sends an HTTP request through REQMOD
+func (s *scanServer) ScanRequest(ctx context.Context, in *gatewaypb.ScanRequestRequest) (*gatewaypb.ScanResult, error) {
+	if in.GetRequest() == nil {
+		return nil, status.Error(codes.InvalidArgument, "request is required")
+	}
+	ctx = withMetadata(ctx, in.GetMetadata())
+	verdict, response, err := s.client.ScanRequest(ctx, fromRequest(in.GetRequest()))
+	return scanResult(verdict, response, err)
+}
+
+// ScanResponse sends an HTTP response through RESPMOD
+func (s *scanServer) ScanResponse(ctx context.Context, in *gatewaypb.ScanResponseRequest) (*gatewaypb.ScanResult, error) {
+	if in.GetResponse() == nil {
+		return nil, status.Error(codes.InvalidArgument, "response is required")
+	}
+	ctx = withMetadata(ctx, in.GetMetadata())
+	verdict, response, err := s.client.ScanResponse(ctx, fromResponse(in.GetResponse()))
+	return scanResult(verdict, response, err)
+}
+
+// ScanFile streams a file through RESPMOD as the body of a 200 response
+func (s *scanServer) ScanFile(stream gatewaypb.ScanService_ScanFileServer) error {
+	first, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return status.Error(codes.InvalidArgument, "no file chunks received")
+	}
+	if err != nil {
+		return err
+	}
+
+	contentType := first.GetContentType()
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(first.GetFilename()))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	body := &chunkReader{stream: stream, data: first.GetData()}
+	ctx := withMetadata(stream.Context(), first.GetMetadata())
+	verdict, response, err := s.client.ScanResponse(ctx, &icapclient.HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers:    map[string]string{"Content-Type": contentType},
+		BodyReader: body,
+	})
+	if body.err != nil {
+		return body.err
+	}
+
+	result, err := scanResult(verdict, response, err)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(result)
+}
+
+// chunkReader reads the data of a ScanFile stream
+type chunkReader struct {
+	stream gatewaypb.ScanService_ScanFileServer
+	data   []byte
+	err    error
+}
+
+// Read implements io.Reader
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		chunk, err := r.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.data = chunk.GetData()
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// withMetadata attaches the request metadata to ctx
+func withMetadata(ctx context.Context, metadata *gatewaypb.RequestMetadata) context.Context {
+	if metadata == nil {
+		return ctx
+	}
+	return icapclient.WithRequestOptions(ctx, icapclient.RequestOptions{
+		RequestID:           metadata.GetRequestId(),
+		ClientIP:            metadata.GetClientIp(),
+		ServerIP:            metadata.GetServerIp(),
+		AuthenticatedUser:   metadata.GetAuthenticatedUser(),
+		AuthenticatedGroups: metadata.GetAuthenticatedGroups(),
+		SubscriberID:        metadata.GetSubscriberId(),
+	})
+}
+
+// scanResult converts the outcome of a scan to its gRPC result. Scans that
+// produced no ICAP response fail with Unavailable.
+func scanResult(verdict icapclient.Verdict, response *icapclient.IcapResponse, err error) (*gatewaypb.ScanResult, error) {
+	if response == nil {
+		if err == nil {
+			err = errors.New("no response")
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer response.Close()
+
+	result := &gatewaypb.ScanResult{
+		Verdict:     toVerdict(verdict),
+		IcapStatus:  int32(response.StatusCode),
+		IcapReason:  response.Reason,
+		IcapHeaders: response.Headers,
+		RequestId:   response.RequestID,
+	}
+	if r := response.HttpRequest; r != nil {
+		adapted, err := toRequest(r)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		result.AdaptedRequest = adapted
+	}
+	if r := response.HttpResponse; r != nil {
+		adapted, err := toResponse(r)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		result.AdaptedResponse = adapted
+	}
+	if i := response.Infection; i != nil {
+		result.Infection = &gatewaypb.Infection{Type: int32(i.Type), Resolution: int32(i.Resolution), Threat: i.Threat}
+	}
+	for _, v := range response.Violations {
+		result.Violations = append(result.Violations, &gatewaypb.Violation{
+			Filename:   v.Filename,
+			Threat:     v.Threat,
+			ProblemId:  int32(v.ProblemID),
+			Resolution: int32(v.Resolution),
+		})
+	}
+	return result, nil
+}
+
+// toVerdict converts a client verdict to its gRPC enum
+func toVerdict(verdict icapclient.Verdict) gatewaypb.Verdict {
+	switch verdict {
+	case icapclient.VerdictAllowed:
+		return gatewaypb.Verdict_VERDICT_ALLOWED
+	case icapclient.VerdictModified:
+		return gatewaypb.Verdict_VERDICT_MODIFIED
+	case icapclient.VerdictBlocked:
+		return gatewaypb.Verdict_VERDICT_BLOCKED
+	case icapclient.VerdictError:
+		return gatewaypb.Verdict_VERDICT_ERROR
+	default:
+		return gatewaypb.Verdict_VERDICT_UNSPECIFIED
+	}
+}
+
+// fromRequest converts a gRPC HTTP request to the client form
+func fromRequest(r *gatewaypb.HttpRequest) *icapclient.HttpRequest {
+	version := r.GetVersion()
+	if version == "" {
+		version = "HTTP/1.1"
+	}
+	return &icapclient.HttpRequest{
+		Method:  r.GetMethod(),
+		URI:     r.GetUri(),
+		Version: version,
+		Headers: r.GetHeaders(),
+		Body:    r.GetBody(),
+	}
+}
+
+// fromResponse converts a gRPC HTTP response to the client form
+func fromResponse(r *gatewaypb.HttpResponse) *icapclient.HttpResponse {
+	version := r.GetVersion()
+	if version == "" {
+		version = "HTTP/1.1"
+	}
+	headers := r.GetHeaders()
+	if len(r.GetBody()) > 0 && headers["Content-Length"] == "" {
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers["Content-Length"] = strconv.Itoa(len(r.GetBody()))
+	}
+	return &icapclient.HttpResponse{
+		Version:    version,
+		StatusCode: int(r.GetStatusCode()),
+		Reason:     r.GetReason(),
+		Headers:    headers,
+		Body:       r.GetBody(),
+	}
+}
+
+// toRequest converts an adapted request to its gRPC form, reading back a
+// body spooled to disk
+func toRequest(r *icapclient.HttpRequest) (*gatewaypb.HttpRequest, error) {
+	body, err := readBody(r.Body, r.BodyReader)
+	if err != nil {
+		return nil, err
+	}
+	return &gatewaypb.HttpRequest{Method: r.Method, Uri: r.URI, Version: r.Version, Headers: r.Headers, Body: body}, nil
+}
+
+// toResponse converts an adapted response to its gRPC form, reading back a
+// body spooled to disk
+func toResponse(r *icapclient.HttpResponse) (*gatewaypb.HttpResponse, error) {
+	body, err := readBody(r.Body, r.BodyReader)
+	if err != nil {
+		return nil, err
+	}
+	return &gatewaypb.HttpResponse{
+		Version:    r.Version,
+		StatusCode: int32(r.StatusCode),
+		Reason:     r.Reason,
+		Headers:    r.Headers,
+		Body:       body,
+	}, nil
+}
+
+// readBody returns a body held in memory or read from reader
+func readBody(body []byte, reader io.Reader) ([]byte, error) {
+	if reader == nil {
+		return body, nil
+	}
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/gatewaypb"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// scanHandler blocks requests to /blocked and responses containing "virus",
+// reporting the infection, and echoes the request ID it received
+func scanHandler(w icaptest.ResponseWriter, r *icaptest.Request) {
+	w.Header().Set("X-Echo-Request-ID", r.Header.Get("X-Request-ID"))
+	switch {
+	case r.Method == "REQMOD" && strings.HasPrefix(r.Request.URL.Path, "/blocked"):
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/html"}}}, true)
+		w.Write([]byte("<h1>Blocked</h1>"))
+	case r.Method == "RESPMOD" && strings.Contains(string(r.Body), "virus"):
+		w.Header().Set("X-Infection-Found", "Type=0; Resolution=2; Threat=Test-Virus;")
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/plain"}}}, true)
+		w.Write([]byte("infected"))
+	default:
+		w.WriteHeader(204, nil, false)
+	}
+}
+
+// newTestGateway returns a gRPC client of a gateway backed by an icaptest
+// server running handler
+func newTestGateway(t *testing.T, handler icaptest.HandlerFunc) gatewaypb.ScanServiceClient {
+	t.Helper()
+
+	server := icaptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		KeepAlive:    true,
+		LoggingLevel: "ERROR",
+	})
+	t.Cleanup(client.Close)
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	gatewaypb.RegisterScanServiceServer(grpcServer, newScanServer(client))
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial gateway: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return gatewaypb.NewScanServiceClient(conn)
+}
+
+// TestScanServer_ScanRequest tests REQMOD verdicts over gRPC
+func TestScanServer_ScanRequest(t *testing.T) {
+	gateway := newTestGateway(t, scanHandler)
+
+	tests := []struct {
+		name            string
+		uri             string
+		expectedVerdict gatewaypb.Verdict
+		expectedBody    string
+	}{
+		{"Allowed", "/clean", gatewaypb.Verdict_VERDICT_ALLOWED, ""},
+		{"Blocked", "/blocked", gatewaypb.Verdict_VERDICT_BLOCKED, "<h1>Blocked</h1>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := gateway.ScanRequest(context.Background(), &gatewaypb.ScanRequestRequest{
+				Request: &gatewaypb.HttpRequest{
+					Method:  "GET",
+					Uri:     tt.uri,
+					Headers: map[string]string{"Host": "example.com"},
+				},
+				Metadata: &gatewaypb.RequestMetadata{RequestId: "req-1"},
+			})
+			if err != nil {
+				t.Fatalf("ScanRequest failed: %v", err)
+			}
+			if result.Verdict != tt.expectedVerdict {
+				t.Errorf("Expected verdict %v, got %v", tt.expectedVerdict, result.Verdict)
+			}
+			if result.RequestId != "req-1" || result.IcapHeaders["X-Echo-Request-ID"] != "req-1" {
+				t.Errorf("Expected request ID req-1, got %q (server saw %q)", result.RequestId, result.IcapHeaders["X-Echo-Request-ID"])
+			}
+			if body := string(result.GetAdaptedResponse().GetBody()); body != tt.expectedBody {
+				t.Errorf("Expected block page %q, got %q", tt.expectedBody, body)
+			}
+		})
+	}
+}
+
+// TestScanServer_ScanResponse tests RESPMOD verdicts and threat reporting
+func TestScanServer_ScanResponse(t *testing.T) {
+	gateway := newTestGateway(t, scanHandler)
+
+	result, err := gateway.ScanResponse(context.Background(), &gatewaypb.ScanResponseRequest{
+		Response: &gatewaypb.HttpResponse{StatusCode: 200, Reason: "OK", Body: []byte("a virus")},
+	})
+	if err != nil {
+		t.Fatalf("ScanResponse failed: %v", err)
+	}
+	if result.Verdict != gatewaypb.Verdict_VERDICT_BLOCKED {
+		t.Errorf("Expected verdict blocked, got %v", result.Verdict)
+	}
+	if result.Infection == nil || result.Infection.Threat != "Test-Virus" {
+		t.Errorf("Expected infection Test-Virus, got %v", result.Infection)
+	}
+}
+
+// TestScanServer_ScanFile tests scanning a file streamed in chunks
+func TestScanServer_ScanFile(t *testing.T) {
+	gateway := newTestGateway(t, scanHandler)
+
+	tests := []struct {
+		name            string
+		chunks          []string
+		expectedVerdict gatewaypb.Verdict
+	}{
+		{"Clean", []string{"hello ", "world"}, gatewaypb.Verdict_VERDICT_ALLOWED},
+		{"Infected", []string{"a vi", "rus", " inside"}, gatewaypb.Verdict_VERDICT_BLOCKED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := gateway.ScanFile(context.Background())
+			if err != nil {
+				t.Fatalf("ScanFile failed: %v", err)
+			}
+			for i, chunk := range tt.chunks {
+				message := &gatewaypb.ScanFileChunk{Data: []byte(chunk)}
+				if i == 0 {
+					message.Filename = "file.txt"
+				}
+				if err := stream.Send(message); err != nil {
+					t.Fatalf("Send failed: %v", err)
+				}
+			}
+			result, err := stream.CloseAndRecv()
+			if err != nil {
+				t.Fatalf("CloseAndRecv failed: %v", err)
+			}
+			if result.Verdict != tt.expectedVerdict {
+				t.Errorf("Expected verdict %v, got %v", tt.expectedVerdict, result.Verdict)
+			}
+		})
+	}
+}
+
+// TestScanServer_Errors tests the status codes of failed scans
+func TestScanServer_Errors(t *testing.T) {
+	gateway := newTestGateway(t, scanHandler)
+
+	_, err := gateway.ScanRequest(context.Background(), &gatewaypb.ScanRequestRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a missing request, got %v", err)
+	}
+
+	stream, err := gateway.ScanFile(context.Background())
+	if err != nil {
+		t.Fatalf("ScanFile failed: %v", err)
+	}
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an empty stream, got %v", err)
+	}
+
+	down := newScanServer(icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         "127.0.0.1",
+		Port:         1,
+		Timeout:      time.Second,
+		LoggingLevel: "ERROR",
+	}))
+	defer down.client.Close()
+	_, err = down.ScanRequest(context.Background(), &gatewaypb.ScanRequestRequest{
+		Request: &gatewaypb.HttpRequest{Method: "GET", Uri: "/"},
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable when the ICAP server is down, got %v", err)
+	}
+}
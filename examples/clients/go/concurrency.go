@@ -0,0 +1,65 @@
+package icapclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// acquireRequest takes one of the max_concurrent_requests slots of the
+// client and returns the function releasing it
+func (c *IcapClient) acquireRequest(ctx context.Context) (func(), error) {
+	if !c.requests.tryAcquire() {
+		if err := c.waitRequest(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if c.metrics != nil {
+		c.metrics.RequestsInFlight.Inc()
+	}
+	return func() {
+		c.requests.release()
+		if c.metrics != nil {
+			c.metrics.RequestsInFlight.Dec()
+		}
+	}, nil
+}
+
+// waitRequest waits for a request slot as requests wait for a connection:
+// up to pool_wait_timeout before failing with a PoolExhaustedError, or
+// until ctx is done
+func (c *IcapClient) waitRequest(ctx context.Context) error {
+	wait := c.transport.poolWait()
+	limit := c.requests.getLimit()
+	if wait < 0 {
+		return &PoolExhaustedError{Limit: limit, Resource: "requests"}
+	}
+	var exhausted <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		exhausted = timer.C
+	}
+
+	waitStart := time.Now()
+	if c.metrics != nil {
+		c.metrics.PoolQueueDepth.Inc()
+		defer func() {
+			c.metrics.PoolQueueDepth.Dec()
+			c.metrics.PoolWaitDuration.Observe(time.Since(waitStart).Seconds())
+		}()
+	}
+	for {
+		released := c.requests.wait()
+		if c.requests.tryAcquire() {
+			return nil
+		}
+		select {
+		case <-released:
+		case <-exhausted:
+			return &PoolExhaustedError{Limit: limit, Resource: "requests", Wait: time.Since(waitStart)}
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for one of %d request slots: %w", limit, ctx.Err())
+		}
+	}
+}
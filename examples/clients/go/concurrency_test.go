@@ -0,0 +1,100 @@
+package icapclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestIcapClient_MaxConcurrentRequests tests capping the requests in flight
+// below the pool size
+func TestIcapClient_MaxConcurrentRequests(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		n := inFlight.Add(1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		inFlight.Add(-1)
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, ConnectionPoolSize: 10, KeepAlive: true, LoggingLevel: "ERROR",
+		MaxConcurrentRequests: 2,
+	})
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}); err != nil {
+				t.Errorf("REQMOD failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p != 2 {
+		t.Errorf("Expected 2 concurrent requests at most, got %d", p)
+	}
+}
+
+// TestIcapClient_MaxConcurrentRequestsExhausted tests failing with
+// ErrPoolExhausted when no request slot frees up, and lifting the cap on
+// reload
+func TestIcapClient_MaxConcurrentRequestsExhausted(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.URL.Path == "/slow" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	config := &IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, ConnectionPoolSize: 10, KeepAlive: true, LoggingLevel: "ERROR",
+		MaxConcurrentRequests: 1, PoolWaitTimeout: 20 * time.Millisecond, Services: ServicesConfig{Reqmod: "/slow"},
+	}
+	client := NewIcapClient(config)
+	defer client.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+		done <- err
+	}()
+	<-arrived
+
+	_, err := client.Respmod(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK"})
+	var poolErr *PoolExhaustedError
+	if !errors.Is(err, ErrPoolExhausted) || !errors.As(err, &poolErr) {
+		t.Fatalf("Expected ErrPoolExhausted, got %v", err)
+	}
+	if poolErr.Resource != "requests" || poolErr.Limit != 1 || poolErr.Wait < 20*time.Millisecond {
+		t.Errorf("Expected 1 request slot waited on for 20ms, got %+v", poolErr)
+	}
+
+	changed := *config
+	changed.MaxConcurrentRequests = 0
+	client.Reload(&changed)
+	if _, err := client.Respmod(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK"}); err != nil {
+		t.Errorf("Expected the cap lifted, got %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Expected the slow request to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+//go:build conformance
+
+// The conformance suite runs the client against real ICAP servers and prints
+// a compatibility matrix. By default it starts c-icap and G3ICAP with docker
+// compose from testdata/conformance:
+//
+//	go test -tags conformance -run TestConformance -v
+//
+// Set ICAP_CONFORMANCE_TARGETS to test already running servers instead, as
+// a comma-separated list of name=host:port/service entries, and
+// ICAP_CONFORMANCE_REPORT to write the matrix as Markdown to a file.
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// conformanceCompose is the compose file of the default servers
+const conformanceCompose = "testdata/conformance/compose.yaml"
+
+// conformanceTarget is an ICAP server under test
+type conformanceTarget struct {
+	name    string
+	host    string
+	port    int
+	service string // empty uses the default per-method services
+}
+
+// defaultConformanceTargets are the servers started from conformanceCompose
+var defaultConformanceTargets = []conformanceTarget{
+	{name: "c-icap", host: "127.0.0.1", port: 13440, service: "/echo"},
+	{name: "g3icap", host: "127.0.0.1", port: 13441},
+}
+
+// conformanceCheck is one behaviour verified against every target
+type conformanceCheck struct {
+	name string
+	run  func(ctx context.Context, client *IcapClient, connects *int) error
+}
+
+// conformanceChecks are the behaviours in the compatibility matrix
+var conformanceChecks = []conformanceCheck{
+	{"OPTIONS", checkOptions},
+	{"Preview advertised", checkPreviewAdvertised},
+	{"REQMOD 204", checkReqmod204},
+	{"RESPMOD small body", checkRespmodBody(64)},
+	{"RESPMOD chunked 256 KiB", checkRespmodBody(256 << 10)},
+	{"Keep-alive reuse", checkKeepAlive},
+}
+
+// errNotApplicable marks a check the server does not support
+var errNotApplicable = fmt.Errorf("not applicable")
+
+// TestConformance runs every check against every target
+func TestConformance(t *testing.T) {
+	targets := conformanceTargets(t)
+
+	results := make(map[string]map[string]string)
+	for _, target := range targets {
+		results[target.name] = make(map[string]string)
+		for _, check := range conformanceChecks {
+			target, check := target, check
+			t.Run(target.name+"/"+check.name, func(t *testing.T) {
+				connects := 0
+				client := newConformanceClient(target, &connects)
+				defer client.Close()
+
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+
+				switch err := check.run(ctx, client, &connects); {
+				case err == nil:
+					results[target.name][check.name] = "pass"
+				case err == errNotApplicable:
+					results[target.name][check.name] = "n/a"
+					t.Skip("not supported by server")
+				default:
+					results[target.name][check.name] = "FAIL"
+					t.Error(err)
+				}
+			})
+		}
+	}
+
+	report := conformanceMatrix(targets, results)
+	t.Log("\n" + report)
+	if path := os.Getenv("ICAP_CONFORMANCE_REPORT"); path != "" {
+		if err := os.WriteFile(path, []byte(report), 0o644); err != nil {
+			t.Errorf("Failed to write report: %v", err)
+		}
+	}
+}
+
+// conformanceTargets returns the configured targets, starting the default
+// servers when none are configured
+func conformanceTargets(t *testing.T) []conformanceTarget {
+	t.Helper()
+
+	if spec := os.Getenv("ICAP_CONFORMANCE_TARGETS"); spec != "" {
+		targets, err := parseConformanceTargets(spec)
+		if err != nil {
+			t.Fatalf("Invalid ICAP_CONFORMANCE_TARGETS: %v", err)
+		}
+		return targets
+	}
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not available and ICAP_CONFORMANCE_TARGETS not set")
+	}
+
+	up := exec.Command("docker", "compose", "-f", conformanceCompose, "up", "-d", "--build", "--wait")
+	if output, err := up.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start conformance servers: %v\n%s", err, output)
+	}
+	t.Cleanup(func() {
+		exec.Command("docker", "compose", "-f", conformanceCompose, "down").Run()
+	})
+
+	return defaultConformanceTargets
+}
+
+// parseConformanceTargets parses name=host:port/service entries
+func parseConformanceTargets(spec string) ([]conformanceTarget, error) {
+	var targets []conformanceTarget
+	for _, entry := range strings.Split(spec, ",") {
+		name, addr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q is not name=host:port", entry)
+		}
+
+		service := ""
+		if i := strings.Index(addr, "/"); i >= 0 {
+			addr, service = addr[:i], addr[i:]
+		}
+		host, portText, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", entry, err)
+		}
+		port, err := strconv.Atoi(portText)
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: invalid port", entry)
+		}
+
+		targets = append(targets, conformanceTarget{name: name, host: host, port: port, service: service})
+	}
+	return targets, nil
+}
+
+// newConformanceClient creates a client for target counting new connections
+func newConformanceClient(target conformanceTarget, connects *int) *IcapClient {
+	return NewIcapClient(&IcapConfig{
+		Host:               target.host,
+		Port:               target.port,
+		Timeout:            10 * time.Second,
+		ConnectionPoolSize: 1,
+		KeepAlive:          true,
+		LoggingLevel:       "ERROR",
+		Services: ServicesConfig{
+			Reqmod:  target.service,
+			Respmod: target.service,
+			Options: target.service,
+		},
+		Hooks: Hooks{OnConnect: func(ConnectEvent) { *connects++ }},
+	})
+}
+
+// checkOptions requires a 200 OPTIONS response with Methods and ISTag
+func checkOptions(ctx context.Context, client *IcapClient, _ *int) error {
+	response, err := client.Options(ctx)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != 200 {
+		return fmt.Errorf("expected 200, got %d %s", response.StatusCode, response.Reason)
+	}
+	if headerValue(response.Headers, "Methods") == "" {
+		return fmt.Errorf("missing Methods header")
+	}
+	if headerValue(response.Headers, "ISTag") == "" {
+		return fmt.Errorf("missing ISTag header")
+	}
+	return nil
+}
+
+// checkPreviewAdvertised requires a numeric Preview header when present
+func checkPreviewAdvertised(ctx context.Context, client *IcapClient, _ *int) error {
+	response, err := client.Options(ctx)
+	if err != nil {
+		return err
+	}
+	preview := headerValue(response.Headers, "Preview")
+	if preview == "" {
+		return errNotApplicable
+	}
+	if n, err := strconv.Atoi(preview); err != nil || n < 0 {
+		return fmt.Errorf("invalid Preview header %q", preview)
+	}
+	return nil
+}
+
+// checkReqmod204 requires a clean request to be allowed, with 204 or an
+// unmodified encapsulated request
+func checkReqmod204(ctx context.Context, client *IcapClient, _ *int) error {
+	response, err := client.Reqmod(ctx, &HttpRequest{
+		Method:  "GET",
+		URI:     "http://example.com/",
+		Version: "HTTP/1.1",
+		Headers: map[string]string{"Host": "example.com"},
+	})
+	if err != nil {
+		return err
+	}
+	switch response.StatusCode {
+	case 204:
+		return nil
+	case 200:
+		if response.HttpRequest == nil || response.HttpRequest.Method != "GET" {
+			return fmt.Errorf("200 without the encapsulated request")
+		}
+		return nil
+	default:
+		return fmt.Errorf("expected 204 or 200, got %d %s", response.StatusCode, response.Reason)
+	}
+}
+
+// checkRespmodBody requires a clean body of size bytes to come back intact
+func checkRespmodBody(size int) func(context.Context, *IcapClient, *int) error {
+	return func(ctx context.Context, client *IcapClient, _ *int) error {
+		body := bytes.Repeat([]byte("conformance "), size/12+1)[:size]
+		response, err := client.Respmod(ctx, &HttpResponse{
+			Version:    "HTTP/1.1",
+			StatusCode: 200,
+			Reason:     "OK",
+			Headers: map[string]string{
+				"Content-Type":   "text/plain",
+				"Content-Length": strconv.Itoa(size),
+			},
+			Body: body,
+		})
+		if err != nil {
+			return err
+		}
+		switch response.StatusCode {
+		case 204:
+			return nil
+		case 200:
+			if response.HttpResponse == nil || !bytes.Equal(response.HttpResponse.Body, body) {
+				return fmt.Errorf("200 with a modified or missing body")
+			}
+			return nil
+		default:
+			return fmt.Errorf("expected 204 or 200, got %d %s", response.StatusCode, response.Reason)
+		}
+	}
+}
+
+// checkKeepAlive requires consecutive requests to share a connection
+func checkKeepAlive(ctx context.Context, client *IcapClient, connects *int) error {
+	for i := 0; i < 3; i++ {
+		if _, err := client.Options(ctx); err != nil {
+			return err
+		}
+	}
+	if *connects != 1 {
+		return fmt.Errorf("expected 1 connection for 3 requests, got %d", *connects)
+	}
+	return nil
+}
+
+// conformanceMatrix renders the results as a Markdown table
+func conformanceMatrix(targets []conformanceTarget, results map[string]map[string]string) string {
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		names = append(names, target.name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "| Check | %s |\n", strings.Join(names, " | "))
+	fmt.Fprintf(&b, "|---|%s\n", strings.Repeat("---|", len(names)))
+	for _, check := range conformanceChecks {
+		row := make([]string, 0, len(names))
+		for _, name := range names {
+			result := results[name][check.name]
+			if result == "" {
+				result = "-"
+			}
+			row = append(row, result)
+		}
+		fmt.Fprintf(&b, "| %s | %s |\n", check.name, strings.Join(row, " | "))
+	}
+	return b.String()
+}
@@ -0,0 +1,210 @@
+package icapclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPoolExhausted reports a request that found every connection busy and
+// gave up waiting for one
+var ErrPoolExhausted = errors.New("connection pool exhausted")
+
+// PoolExhaustedError is the ErrPoolExhausted of a request, with the limit
+// it waited on and for how long
+type PoolExhaustedError struct {
+	Limit int
+	// Resource is what was busy: "connections", or "requests" at the
+	// max_concurrent_requests of the client
+	Resource string
+	Wait     time.Duration
+}
+
+func (e *PoolExhaustedError) Error() string {
+	return fmt.Sprintf("%v: all %d %s busy after waiting %s", ErrPoolExhausted, e.Limit, e.Resource, e.Wait)
+}
+
+func (e *PoolExhaustedError) Unwrap() error {
+	return ErrPoolExhausted
+}
+
+// connLimiter counts the connections open to the server, idle or in use,
+// and bounds them once the server advertises Max-Connections
+type connLimiter struct {
+	mu    sync.Mutex
+	limit int
+	open  int
+	// released is closed, and replaced, whenever a connection is closed or
+	// returned to the idle pool
+	released chan struct{}
+}
+
+// newConnLimiter returns a limiter without a limit
+func newConnLimiter() *connLimiter {
+	return &connLimiter{released: make(chan struct{})}
+}
+
+// tryAcquire counts a new connection, reporting false if the limit is
+// reached
+func (l *connLimiter) tryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit > 0 && l.open >= l.limit {
+		return false
+	}
+	l.open++
+	return true
+}
+
+// release uncounts a closed connection
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+	l.notifyLocked()
+}
+
+// notify wakes the requests waiting for a connection
+func (l *connLimiter) notify() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notifyLocked()
+}
+
+func (l *connLimiter) notifyLocked() {
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// wait returns a channel closed the next time a connection is released,
+// taken before checking for one so that no release is missed
+func (l *connLimiter) wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.released
+}
+
+// setLimit sets the connection limit, zero for none
+func (l *connLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.notifyLocked()
+}
+
+// getLimit returns the connection limit, zero for none
+func (l *connLimiter) getLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// maxConnectionsLimit returns the connections the client keeps open for a
+// server advertising Max-Connections of maxConns: a tenth fewer and at least
+// one fewer, but never none, leaving room for the connections the server
+// has not yet seen closed
+func maxConnectionsLimit(maxConns int) int {
+	margin := max(maxConns/10, 1)
+	return max(maxConns-margin, 1)
+}
+
+// recordMaxConnections clamps the connection limit and the idle pool below
+// the Max-Connections header of an OPTIONS response, or lifts the clamp
+// when the header is absent
+func (t *icapTransport) recordMaxConnections(headers map[string]string) {
+	limit := 0
+	if maxConns, err := strconv.Atoi(strings.TrimSpace(headerValue(headers, "Max-Connections"))); err == nil && maxConns > 0 {
+		limit = maxConnectionsLimit(maxConns)
+	}
+	if limit == t.conns.getLimit() {
+		return
+	}
+
+	t.mu.Lock()
+	t.maxIdle = t.poolSize
+	if limit > 0 {
+		t.maxIdle = min(t.poolSize, limit)
+	}
+	var excess []*persistConn
+	if len(t.idle) > t.maxIdle {
+		excess = append(excess, t.idle[:len(t.idle)-t.maxIdle]...)
+		t.idle = append(t.idle[:0], t.idle[len(t.idle)-t.maxIdle:]...)
+	}
+	t.mu.Unlock()
+
+	t.conns.setLimit(limit)
+	for _, pc := range excess {
+		pc.close(closeReasonPoolFull)
+	}
+}
+
+// idleLimit returns the size of the idle pool
+func (t *icapTransport) idleLimit() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.maxIdle
+}
+
+// poolWait returns how long to wait for a busy connection or request slot:
+// pool_wait_timeout, the attempt timeout if zero, negative for not at all
+// and zero for as long as the context allows
+func (t *icapTransport) poolWait() time.Duration {
+	if wait := t.getPoolWaitTimeout(); wait != 0 {
+		return wait
+	}
+	return t.getAttemptTimeout()
+}
+
+// acquireConn counts a new connection, waiting while the limit is reached
+// until a connection is released. With reuseIdle it returns an idle
+// connection instead when there is one. A request that waited for
+// pool_wait_timeout, or the attempt timeout if unset, fails with a
+// PoolExhaustedError; one whose ctx is done fails with its error.
+func (t *icapTransport) acquireConn(ctx context.Context, reuseIdle bool) (*persistConn, error) {
+	var waitStart time.Time
+	var exhausted <-chan time.Time
+	defer func() {
+		if !waitStart.IsZero() && t.metrics != nil {
+			t.metrics.PoolQueueDepth.Dec()
+			t.metrics.PoolWaitDuration.Observe(time.Since(waitStart).Seconds())
+		}
+	}()
+	for {
+		released := t.conns.wait()
+		if reuseIdle {
+			if pc := t.popIdle(); pc != nil {
+				return pc, nil
+			}
+		}
+		if t.conns.tryAcquire() {
+			return nil, nil
+		}
+
+		if waitStart.IsZero() {
+			wait := t.poolWait()
+			if wait < 0 {
+				return nil, &PoolExhaustedError{Limit: t.conns.getLimit(), Resource: "connections"}
+			}
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				defer timer.Stop()
+				exhausted = timer.C
+			}
+			waitStart = time.Now()
+			if t.metrics != nil {
+				t.metrics.PoolQueueDepth.Inc()
+			}
+		}
+		select {
+		case <-released:
+		case <-exhausted:
+			return nil, &PoolExhaustedError{Limit: t.conns.getLimit(), Resource: "connections", Wait: time.Since(waitStart)}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for one of %d connections: %w", t.conns.getLimit(), ctx.Err())
+		}
+	}
+}
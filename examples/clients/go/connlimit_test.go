@@ -0,0 +1,182 @@
+package icapclient
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestMaxConnectionsLimit tests the safety margin below Max-Connections
+func TestMaxConnectionsLimit(t *testing.T) {
+	for _, tt := range []struct {
+		maxConns int
+		expected int
+	}{
+		{1, 1},
+		{2, 1},
+		{10, 9},
+		{25, 23},
+		{100, 90},
+	} {
+		if limit := maxConnectionsLimit(tt.maxConns); limit != tt.expected {
+			t.Errorf("Max-Connections %d: expected limit %d, got %d", tt.maxConns, tt.expected, limit)
+		}
+	}
+}
+
+// TestIcapClient_MaxConnections tests bounding concurrent connections below
+// the Max-Connections of the OPTIONS response, and lifting the bound when
+// the server stops advertising it
+func TestIcapClient_MaxConnections(t *testing.T) {
+	var maxConns atomic.Int32
+	maxConns.Store(3)
+	var inFlight, peak atomic.Int32
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Methods", "REQMOD")
+			if n := maxConns.Load(); n > 0 {
+				w.Header().Set("Max-Connections", strconv.Itoa(int(n)))
+			}
+			w.WriteHeader(200, nil, false)
+			return
+		}
+		n := inFlight.Add(1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		inFlight.Add(-1)
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, ConnectionPoolSize: 10, KeepAlive: true, LoggingLevel: "ERROR",
+	})
+	defer client.Close()
+
+	if _, err := client.Options(context.Background()); err != nil {
+		t.Fatalf("Options failed: %v", err)
+	}
+	if limit, idle := client.transport.conns.getLimit(), client.transport.idleLimit(); limit != 2 || idle != 2 {
+		t.Fatalf("Expected a limit and idle pool of 2, got %d and %d", limit, idle)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Reqmod(context.Background(), &HttpRequest{
+				Method: "POST", URI: "/upload", Version: "HTTP/1.1", Headers: map[string]string{}, Body: []byte("body"),
+			})
+			if err != nil {
+				t.Errorf("REQMOD failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p > 2 {
+		t.Errorf("Expected at most 2 concurrent requests, got %d", p)
+	}
+	if conns, _ := server.Stats(); conns > 2 {
+		t.Errorf("Expected at most 2 connections, got %d", conns)
+	}
+
+	maxConns.Store(0)
+	if _, err := client.Options(context.Background()); err != nil {
+		t.Fatalf("Options failed: %v", err)
+	}
+	if limit, idle := client.transport.conns.getLimit(), client.transport.idleLimit(); limit != 0 || idle != 10 {
+		t.Errorf("Expected no limit and an idle pool of 10, got %d and %d", limit, idle)
+	}
+}
+
+// TestIcapClient_PoolExhausted tests failing with ErrPoolExhausted once a
+// request waited pool_wait_timeout for a busy connection, or at once when
+// it is negative
+func TestIcapClient_PoolExhausted(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Max-Connections", "2")
+			w.WriteHeader(200, nil, false)
+			return
+		}
+		arrived <- struct{}{}
+		<-release
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	var events []PoolExhaustedEvent
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host:               host,
+		Port:               port,
+		Timeout:            5 * time.Second,
+		PoolWaitTimeout:    50 * time.Millisecond,
+		ConnectionPoolSize: 2,
+		KeepAlive:          true,
+		LoggingLevel:       "ERROR",
+		MetricsEnabled:     true,
+		MetricsRegisterer:  prometheus.NewRegistry(),
+		Hooks:              Hooks{OnPoolExhausted: func(event PoolExhaustedEvent) { events = append(events, event) }},
+	})
+	defer client.Close()
+
+	if _, err := client.Options(context.Background()); err != nil {
+		t.Fatalf("Options failed: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+		done <- err
+	}()
+	<-arrived
+
+	_, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+	var poolErr *PoolExhaustedError
+	if !errors.Is(err, ErrPoolExhausted) || !errors.As(err, &poolErr) {
+		t.Fatalf("Expected ErrPoolExhausted, got %v", err)
+	}
+	if poolErr.Limit != 1 || poolErr.Wait < 50*time.Millisecond {
+		t.Errorf("Expected a limit of 1 and a wait of 50ms, got %d and %v", poolErr.Limit, poolErr.Wait)
+	}
+	if len(events) != 1 || events[0].Method != REQMOD || events[0].Wait != poolErr.Wait {
+		t.Errorf("Expected one REQMOD pool exhausted event, got %+v", events)
+	}
+
+	client.transport.setTimeouts(&IcapConfig{Timeout: 5 * time.Second, PoolWaitTimeout: -1})
+	start := time.Now()
+	if _, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Expected ErrPoolExhausted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("Expected to fail without waiting, took %v", elapsed)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Expected the busy request to succeed, got %v", err)
+	}
+	if v := testutil.ToFloat64(client.metrics.PoolQueueDepth); v != 0 {
+		t.Errorf("Expected an empty queue, got %v", v)
+	}
+	var metric dto.Metric
+	if err := client.metrics.PoolWaitDuration.Write(&metric); err != nil {
+		t.Fatalf("Failed to collect histogram: %v", err)
+	}
+	if observed := metric.GetHistogram().GetSampleCount(); observed != 1 {
+		t.Errorf("Expected 1 pool wait, got %d", observed)
+	}
+}
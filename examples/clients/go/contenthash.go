@@ -0,0 +1,136 @@
+package icapclient
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Content hash algorithms, the keys of ContentHashes
+const (
+	HashSHA256 = "sha256"
+	HashSHA1   = "sha1"
+	HashMD5    = "md5"
+)
+
+// hashAlgorithms are the supported content hash algorithms, in the order
+// they are reported
+var hashAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{HashSHA256, sha256.New},
+	{HashSHA1, sha1.New},
+	{HashMD5, md5.New},
+}
+
+// ContentHashConfig controls hashing of the bodies sent for scanning, so
+// that results can be deduplicated and looked up in threat intelligence
+// feeds. Bodies are hashed as given, before compression or truncation.
+type ContentHashConfig struct {
+	// Enabled computes the SHA-256 of each body
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Algorithms adds "sha1" or "md5" hashes
+	Algorithms []string `yaml:"algorithms" json:"algorithms"`
+	// Header sends the hashes to the server in an X-Content-Hash header
+	Header bool `yaml:"header" json:"header"`
+}
+
+// ContentHashes maps hash algorithms to the hex digests of a body
+type ContentHashes map[string]string
+
+// String formats the hashes as in the X-Content-Hash header, e.g.
+// "sha256=9f86d0..., md5=098f6b..."
+func (h ContentHashes) String() string {
+	var parts []string
+	for _, algorithm := range hashAlgorithms {
+		if digest, ok := h[algorithm.name]; ok {
+			parts = append(parts, algorithm.name+"="+digest)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// validHashAlgorithm reports whether name is a supported hash algorithm
+func validHashAlgorithm(name string) bool {
+	for _, algorithm := range hashAlgorithms {
+		if strings.EqualFold(name, algorithm.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentHasher hashes a body with the configured algorithms at once
+type contentHasher struct {
+	hashers map[string]hash.Hash
+	w       io.Writer
+}
+
+// newContentHasher returns a hasher of SHA-256 and the configured
+// algorithms
+func newContentHasher(config ContentHashConfig) *contentHasher {
+	h := &contentHasher{hashers: make(map[string]hash.Hash)}
+	writers := []io.Writer{}
+	for _, algorithm := range hashAlgorithms {
+		wanted := algorithm.name == HashSHA256
+		for _, name := range config.Algorithms {
+			wanted = wanted || strings.EqualFold(name, algorithm.name)
+		}
+		if wanted {
+			h.hashers[algorithm.name] = algorithm.new()
+			writers = append(writers, h.hashers[algorithm.name])
+		}
+	}
+	h.w = io.MultiWriter(writers...)
+	return h
+}
+
+// sum returns the hashes of the bytes written
+func (h *contentHasher) sum() ContentHashes {
+	hashes := make(ContentHashes, len(h.hashers))
+	for name, hasher := range h.hashers {
+		hashes[name] = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return hashes
+}
+
+// hashContent returns the hashes of the body of httpData, or nil if none of
+// content_hash, scan_cache and clean_filter is enabled or there is no body.
+//
+// The scan cache, the clean filter and the X-Content-Hash header need the
+// hashes before the body is sent, so a streamed body is then read in a
+// separate pass first. Otherwise stream hashes it as it is sent, hashContent
+// returns nil and the hashes are taken from stream.contentHashes once the
+// request completed, so the body is only read once.
+func (c *IcapClient) hashContent(config ContentHashConfig, httpData interface{}, stream *bodyStream) (ContentHashes, error) {
+	if !config.Enabled && c.scanCache == nil && c.cleanFilter == nil {
+		return nil, nil
+	}
+	hasher := newContentHasher(config)
+
+	switch {
+	case stream != nil && c.scanCache == nil && c.cleanFilter == nil && !config.Header:
+		stream.hasher, stream.hashSize = hasher, stream.size
+		return nil, nil
+	case stream != nil:
+		if _, err := stream.source.Seek(stream.start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind body: %w", err)
+		}
+		if _, err := io.CopyN(hasher.w, stream.source, stream.size); err != nil {
+			return nil, fmt.Errorf("failed to read body: %w", err)
+		}
+	default:
+		body := httpBody(httpData)
+		if len(body) == 0 {
+			return nil, nil
+		}
+		hasher.w.Write(body)
+	}
+	return hasher.sum(), nil
+}
@@ -0,0 +1,142 @@
+package icapclient
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// Digests of "test"
+const (
+	testSHA256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	testMD5    = "098f6bcd4621d373cade4e832627b4f6"
+)
+
+// TestContentHashes_String tests formatting hashes in algorithm order
+func TestContentHashes_String(t *testing.T) {
+	hashes := ContentHashes{HashMD5: "m", HashSHA256: "s", HashSHA1: "h"}
+	if got, want := hashes.String(), "sha256=s, sha1=h, md5=m"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+// TestIcapClient_ContentHash tests hashing bodies held in memory, seekable
+// and streamed, and sending the X-Content-Hash header
+func TestIcapClient_ContentHash(t *testing.T) {
+	headers := make(chan string, 1)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		headers <- r.Header.Get("X-Content-Hash")
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	tests := []struct {
+		name string
+		body func() *HttpRequest
+	}{
+		{"in memory", func() *HttpRequest {
+			return &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", Body: []byte("test")}
+		}},
+		{"seekable", func() *HttpRequest {
+			return &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", BodyReader: strings.NewReader("test")}
+		}},
+		{"streamed", func() *HttpRequest {
+			return &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", BodyReader: io.MultiReader(strings.NewReader("te"), strings.NewReader("st"))}
+		}},
+	}
+
+	for _, header := range []bool{false, true} {
+		client.config.Load().ContentHash = ContentHashConfig{Enabled: true, Algorithms: []string{"MD5"}, Header: header}
+		for _, tt := range tests {
+			response, err := client.Reqmod(context.Background(), tt.body())
+			if err != nil {
+				t.Fatalf("%s: REQMOD failed: %v", tt.name, err)
+			}
+			if got := response.ContentHashes[HashSHA256]; got != testSHA256 {
+				t.Errorf("%s: Expected SHA-256 %s, got %s", tt.name, testSHA256, got)
+			}
+			if got := response.ContentHashes[HashMD5]; got != testMD5 {
+				t.Errorf("%s: Expected MD5 %s, got %s", tt.name, testMD5, got)
+			}
+			if _, ok := response.ContentHashes[HashSHA1]; ok {
+				t.Errorf("%s: Expected no SHA-1", tt.name)
+			}
+
+			want := ""
+			if header {
+				want = "sha256=" + testSHA256 + ", md5=" + testMD5
+			}
+			if got := <-headers; got != want {
+				t.Errorf("%s: Expected X-Content-Hash %q, got %q", tt.name, want, got)
+			}
+		}
+	}
+
+	client.config.Load().ContentHash = ContentHashConfig{}
+	response, err := client.Reqmod(context.Background(), &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", Body: []byte("test")})
+	if err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+	<-headers
+	if response.ContentHashes != nil {
+		t.Errorf("Expected no hashes when disabled, got %v", response.ContentHashes)
+	}
+}
+
+// countingReadSeeker counts the bytes read from a body
+type countingReadSeeker struct {
+	io.ReadSeeker
+	read int
+}
+
+func (r *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.read += n
+	return n, err
+}
+
+// TestIcapClient_ContentHashWhileSending tests that a seekable body is
+// hashed as it is sent, reading it once, and that the part left unsent by a
+// truncation is still hashed
+func TestIcapClient_ContentHashWhileSending(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	client.config.Load().ContentHash = ContentHashConfig{Enabled: true}
+
+	body := &countingReadSeeker{ReadSeeker: strings.NewReader("test")}
+	response, err := client.Reqmod(context.Background(), &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", BodyReader: body})
+	if err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+	if got := response.ContentHashes[HashSHA256]; got != testSHA256 {
+		t.Errorf("Expected SHA-256 %s, got %s", testSHA256, got)
+	}
+	if body.read != 4 {
+		t.Errorf("Expected the body to be read once, read %d bytes", body.read)
+	}
+
+	client.config.Load().MaxBodySize = 2
+	client.config.Load().BodyLimitAction = BodyLimitTruncate
+	body = &countingReadSeeker{ReadSeeker: strings.NewReader("test")}
+	response, err = client.Reqmod(context.Background(), &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", BodyReader: body})
+	if err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+	if got := response.ContentHashes[HashSHA256]; got != testSHA256 {
+		t.Errorf("Expected the SHA-256 of the whole truncated body %s, got %s", testSHA256, got)
+	}
+	if body.read != 4 {
+		t.Errorf("Expected the body to be read once, read %d bytes", body.read)
+	}
+}
@@ -0,0 +1,208 @@
+package icapclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptrace"
+)
+
+const (
+	// defaultDNSMinTTL is the dns.min_ttl used when unset
+	defaultDNSMinTTL = time.Second
+	// defaultDNSMaxTTL is the dns.max_ttl used when unset
+	defaultDNSMaxTTL = 30 * time.Second
+)
+
+// DNSCacheConfig controls caching of the ICAP server (or proxy) addresses.
+// The system resolver does not expose record TTLs, so resolutions are
+// refreshed in the background once they are MaxTTL old, and DNS is never
+// queried for a host more often than every MinTTL, even after connect
+// failures have evicted its addresses.
+type DNSCacheConfig struct {
+	Enabled bool          `yaml:"enabled" json:"enabled"`
+	MinTTL  time.Duration `yaml:"min_ttl" json:"min_ttl"`
+	MaxTTL  time.Duration `yaml:"max_ttl" json:"max_ttl"`
+}
+
+// dnsCache caches host name resolutions, evicting addresses that fail to
+// connect
+type dnsCache struct {
+	lookup func(ctx context.Context, host string) ([]string, error)
+	minTTL time.Duration
+	maxTTL time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+// dnsEntry is the cached resolution of a host
+type dnsEntry struct {
+	// resolved holds every address of the last resolution and healthy
+	// those not evicted since
+	resolved []string
+	healthy  []string
+
+	resolvedAt time.Time
+	// checkedAt is the time of the last lookup attempt, successful or not
+	checkedAt  time.Time
+	refreshing bool
+}
+
+// newDNSCache creates a cache for config resolving with the system resolver
+func newDNSCache(config DNSCacheConfig) *dnsCache {
+	minTTL, maxTTL := config.MinTTL, config.MaxTTL
+	if minTTL <= 0 {
+		minTTL = defaultDNSMinTTL
+	}
+	if maxTTL <= 0 {
+		maxTTL = defaultDNSMaxTTL
+	}
+	if maxTTL < minTTL {
+		maxTTL = minTTL
+	}
+
+	return &dnsCache{
+		lookup:  net.DefaultResolver.LookupHost,
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+		now:     time.Now,
+		entries: make(map[string]*dnsEntry),
+	}
+}
+
+// resolve returns the addresses to try for host
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	now := c.now()
+	entry := c.entries[host]
+
+	if entry != nil {
+		age := now.Sub(entry.resolvedAt)
+		if len(entry.healthy) > 0 {
+			if age >= c.maxTTL && now.Sub(entry.checkedAt) >= c.minTTL && !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(host)
+			}
+			addrs := append([]string(nil), entry.healthy...)
+			c.mu.Unlock()
+			return addrs, nil
+		}
+		if now.Sub(entry.checkedAt) < c.minTTL {
+			// Every address failed but re-resolving now would query
+			// DNS too often; try the last resolution again
+			addrs := append([]string(nil), entry.resolved...)
+			c.mu.Unlock()
+			return addrs, nil
+		}
+	}
+	c.mu.Unlock()
+
+	return c.lookupAndStore(ctx, host)
+}
+
+// refresh re-resolves host in the background, keeping the cached addresses
+// if the lookup fails
+func (c *dnsCache) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.maxTTL)
+	defer cancel()
+	c.lookupAndStore(ctx, host)
+
+	c.mu.Lock()
+	if entry := c.entries[host]; entry != nil {
+		entry.refreshing = false
+	}
+	c.mu.Unlock()
+}
+
+// lookupAndStore resolves host and caches the result
+func (c *dnsCache) lookupAndStore(ctx context.Context, host string) ([]string, error) {
+	addrs, err := c.lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	entry := c.entries[host]
+	if err != nil {
+		if entry != nil {
+			entry.checkedAt = now
+		}
+		return nil, err
+	}
+
+	if entry == nil {
+		entry = &dnsEntry{}
+		c.entries[host] = entry
+	}
+	entry.resolved = addrs
+	entry.healthy = append([]string(nil), addrs...)
+	entry.resolvedAt = now
+	entry.checkedAt = now
+	return append([]string(nil), addrs...), nil
+}
+
+// evict removes addr from the healthy addresses of host after a connect
+// failure
+func (c *dnsCache) evict(host, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[host]
+	if entry == nil {
+		return
+	}
+	for i, healthy := range entry.healthy {
+		if healthy == addr {
+			entry.healthy = append(entry.healthy[:i:i], entry.healthy[i+1:]...)
+			return
+		}
+	}
+}
+
+// wrapDial returns dial connecting to the cached addresses of host names,
+// trying each in turn and evicting those that fail. IP addresses are dialed
+// directly.
+func (c *dnsCache) wrapDial(dial dialFunc) dialFunc {
+	if c == nil {
+		return dial
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		trace := icaptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.DNSStart != nil {
+			trace.DNSStart(icaptrace.DNSStartInfo{Host: host})
+		}
+		ips, err := c.resolve(ctx, host)
+		if trace != nil && trace.DNSDone != nil {
+			trace.DNSDone(icaptrace.DNSDoneInfo{Addrs: ips, Err: err})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			c.evict(host, ip)
+		}
+		return nil, lastErr
+	}
+}
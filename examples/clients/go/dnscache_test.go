@@ -0,0 +1,172 @@
+package icapclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers lookups from a mutable table and counts them
+type fakeResolver struct {
+	mu      sync.Mutex
+	addrs   map[string][]string
+	lookups int
+	err     error
+}
+
+func (r *fakeResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return append([]string(nil), r.addrs[host]...), nil
+}
+
+func (r *fakeResolver) set(host string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs[host] = addrs
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// newTestDNSCache creates a cache over resolver with a controllable clock
+func newTestDNSCache(resolver *fakeResolver) (*dnsCache, *time.Time) {
+	now := time.Unix(1000, 0)
+	cache := newDNSCache(DNSCacheConfig{Enabled: true, MinTTL: time.Second, MaxTTL: 10 * time.Second})
+	cache.lookup = resolver.lookup
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+// waitForLookups waits for background refreshes to reach n lookups
+func waitForLookups(t *testing.T, resolver *fakeResolver, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for resolver.count() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d lookups, got %d", n, resolver.count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestDNSCache_Resolve tests caching and background re-resolution
+func TestDNSCache_Resolve(t *testing.T) {
+	resolver := &fakeResolver{addrs: map[string][]string{"icap.example.com": {"10.0.0.1"}}}
+	cache, now := newTestDNSCache(resolver)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		addrs, err := cache.resolve(ctx, "icap.example.com")
+		if err != nil || !reflect.DeepEqual(addrs, []string{"10.0.0.1"}) {
+			t.Fatalf("Expected [10.0.0.1], got %v %v", addrs, err)
+		}
+	}
+	if resolver.count() != 1 {
+		t.Errorf("Expected 1 lookup for cached resolutions, got %d", resolver.count())
+	}
+
+	// The backend moves; the expired entry is served while it is refreshed
+	resolver.set("icap.example.com", "10.0.0.2")
+	*now = now.Add(11 * time.Second)
+	if addrs, _ := cache.resolve(ctx, "icap.example.com"); !reflect.DeepEqual(addrs, []string{"10.0.0.1"}) {
+		t.Errorf("Expected stale address while refreshing, got %v", addrs)
+	}
+	waitForLookups(t, resolver, 2)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		addrs, _ := cache.resolve(ctx, "icap.example.com")
+		if reflect.DeepEqual(addrs, []string{"10.0.0.2"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected refreshed address 10.0.0.2, got %v", addrs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestDNSCache_Evict tests eviction after connect failures and the min_ttl
+// floor on re-resolution
+func TestDNSCache_Evict(t *testing.T) {
+	resolver := &fakeResolver{addrs: map[string][]string{"icap.example.com": {"10.0.0.1", "10.0.0.2"}}}
+	cache, now := newTestDNSCache(resolver)
+	ctx := context.Background()
+
+	cache.resolve(ctx, "icap.example.com")
+	cache.evict("icap.example.com", "10.0.0.1")
+	if addrs, _ := cache.resolve(ctx, "icap.example.com"); !reflect.DeepEqual(addrs, []string{"10.0.0.2"}) {
+		t.Errorf("Expected evicted address to be skipped, got %v", addrs)
+	}
+
+	// Every address failed within min_ttl: retry them without a lookup
+	cache.evict("icap.example.com", "10.0.0.2")
+	if addrs, _ := cache.resolve(ctx, "icap.example.com"); len(addrs) != 2 || resolver.count() != 1 {
+		t.Errorf("Expected the last resolution without a lookup, got %v after %d lookups", addrs, resolver.count())
+	}
+
+	// After min_ttl the host is re-resolved
+	resolver.set("icap.example.com", "10.0.0.3")
+	*now = now.Add(2 * time.Second)
+	if addrs, _ := cache.resolve(ctx, "icap.example.com"); !reflect.DeepEqual(addrs, []string{"10.0.0.3"}) {
+		t.Errorf("Expected re-resolved address, got %v", addrs)
+	}
+
+	// A failing lookup is reported and not cached
+	resolver.err = errors.New("no such host")
+	if _, err := cache.resolve(ctx, "other.example.com"); err == nil {
+		t.Error("Expected lookup failure")
+	}
+}
+
+// TestDNSCache_wrapDial tests dialing cached addresses in turn
+func TestDNSCache_wrapDial(t *testing.T) {
+	resolver := &fakeResolver{addrs: map[string][]string{"icap.example.com": {"10.0.0.1", "10.0.0.2"}}}
+	cache, _ := newTestDNSCache(resolver)
+
+	var dialed []string
+	dial := cache.wrapDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "10.0.0.1:1344" {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+
+	conn, err := dial(context.Background(), "tcp", "icap.example.com:1344")
+	if err != nil {
+		t.Fatalf("Expected dial to fall back to the second address, got %v", err)
+	}
+	conn.Close()
+	if !reflect.DeepEqual(dialed, []string{"10.0.0.1:1344", "10.0.0.2:1344"}) {
+		t.Errorf("Expected both addresses dialed in order, got %v", dialed)
+	}
+
+	dialed = nil
+	conn, _ = dial(context.Background(), "tcp", "icap.example.com:1344")
+	conn.Close()
+	if !reflect.DeepEqual(dialed, []string{"10.0.0.2:1344"}) {
+		t.Errorf("Expected the failed address to be evicted, got %v", dialed)
+	}
+
+	dialed = nil
+	conn, _ = dial(context.Background(), "tcp", "192.0.2.1:1344")
+	conn.Close()
+	if !reflect.DeepEqual(dialed, []string{"192.0.2.1:1344"}) || resolver.count() != 1 {
+		t.Errorf("Expected IP addresses to bypass the cache, got %v", dialed)
+	}
+}
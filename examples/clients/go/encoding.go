@@ -0,0 +1,386 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Bounds of decoded bodies, which stop compression bombs in adapted
+// responses from exhausting memory
+const (
+	// defaultMaxDecodedSize bounds bodies decoded into memory when
+	// max_body_size is unset
+	defaultMaxDecodedSize = 64 << 20
+	// maxDecodingRatio bounds the decoded size of a body to that many
+	// times the encoded bytes read, beyond the first decodingRatioSlack
+	// decoded bytes
+	maxDecodingRatio   = 200
+	decodingRatioSlack = 1 << 20
+)
+
+// errDecodingRatio is returned by decoded bodies expanding beyond
+// maxDecodingRatio
+var errDecodingRatio = fmt.Errorf("decoded body expands more than %d times", maxDecodingRatio)
+
+// decodeResponseBody replaces the body of the adapted HTTP response, when
+// decode_content_encoding is set and it is encoded with gzip, deflate or br,
+// with the decoded body. Content-Encoding is removed and Content-Length set
+// to the decoded size, or removed for a spooled body, which is decoded as
+// it is read. Bodies with other encodings, that fail to decode or that
+// decode to more than max_body_size, 64 MiB if unset, are left as they are.
+// Reads of a spooled body fail once it exceeds max_body_size, if set, or
+// expands more than maxDecodingRatio times.
+func (c *IcapClient) decodeResponseBody(config *IcapConfig, response *IcapResponse) {
+	adapted := response.HttpResponse
+	if !config.DecodeContentEncoding || adapted == nil {
+		return
+	}
+	encodings, ok := contentEncodings(headerValue(adapted.Headers, "Content-Encoding"))
+	if !ok || len(encodings) == 0 {
+		return
+	}
+
+	if adapted.BodyReader != nil {
+		reader, err := decodingReader(adapted.BodyReader, encodings, config.MaxBodySize)
+		if err != nil {
+			c.logger.Warn("Failed to decode response body", "request_id", response.RequestID, "error", err)
+			if seeker, ok := adapted.BodyReader.(io.Seeker); ok {
+				seeker.Seek(0, io.SeekStart)
+			}
+			return
+		}
+		adapted.BodyReader = reader
+		deleteHeader(adapted.Headers, "Content-Length")
+	} else {
+		limit := config.MaxBodySize
+		if limit <= 0 {
+			limit = defaultMaxDecodedSize
+		}
+		body, err := decodeBody(adapted.Body, encodings, limit)
+		if err != nil {
+			c.logger.Warn("Failed to decode response body", "request_id", response.RequestID, "error", err)
+			return
+		}
+		adapted.Body = body
+		setHeader(adapted.Headers, "Content-Length", strconv.Itoa(len(body)))
+	}
+	deleteHeader(adapted.Headers, "Content-Encoding")
+}
+
+// contentEncodings parses a Content-Encoding header into the codings to
+// undo, last applied first. It reports false if any coding is unsupported.
+func contentEncodings(header string) ([]string, bool) {
+	var encodings []string
+	for _, coding := range strings.Split(header, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "", "identity":
+		case "gzip", "x-gzip", "deflate", "br":
+			encodings = append([]string{coding}, encodings...)
+		default:
+			return nil, false
+		}
+	}
+	return encodings, true
+}
+
+// decodeBody decodes body, failing if the result exceeds limit when it is
+// positive
+func decodeBody(body []byte, encodings []string, limit int64) ([]byte, error) {
+	reader, err := decodingReader(bytes.NewReader(body), encodings, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// decodingReader returns a reader decoding src with encodings in order,
+// failing once the decoded body exceeds limit, when positive, or expands
+// more than maxDecodingRatio times. Closing it closes the decoders and src,
+// if it is an io.Closer; src is left open on error.
+func decodingReader(src io.Reader, encodings []string, limit int64) (io.ReadCloser, error) {
+	encoded := &countingReader{Reader: src}
+	decoder := &decodedBody{Reader: encoded, encoded: encoded, limit: limit}
+	for _, coding := range encodings {
+		switch coding {
+		case "gzip", "x-gzip":
+			reader, err := gzip.NewReader(decoder.Reader)
+			if err != nil {
+				decoder.Close()
+				return nil, fmt.Errorf("invalid gzip body: %w", err)
+			}
+			decoder.Reader = reader
+			decoder.closers = append(decoder.closers, reader)
+		case "deflate":
+			reader, err := deflateReader(decoder.Reader)
+			if err != nil {
+				decoder.Close()
+				return nil, fmt.Errorf("invalid deflate body: %w", err)
+			}
+			decoder.Reader = reader
+			decoder.closers = append(decoder.closers, reader)
+		case "br":
+			decoder.Reader = brotli.NewReader(decoder.Reader)
+		}
+	}
+	if closer, ok := src.(io.Closer); ok {
+		decoder.closers = append([]io.Closer{closer}, decoder.closers...)
+	}
+	return decoder, nil
+}
+
+// countingReader counts the bytes read from Reader
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// deflateReader decodes an HTTP deflate body, which should be zlib wrapped
+// but is raw deflate from some servers
+func deflateReader(src io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(src)
+	header, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// decodedBody is a decoded body, closing its decoders and source
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+	// encoded counts the encoded bytes read, and decoded the bytes
+	// returned, bounded by limit when positive and by maxDecodingRatio
+	encoded *countingReader
+	decoded int64
+	limit   int64
+}
+
+// Read reads decoded bytes, failing once the body exceeds its bounds
+func (d *decodedBody) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	d.decoded += int64(n)
+	switch {
+	case d.limit > 0 && d.decoded > d.limit:
+		return 0, fmt.Errorf("decoded body exceeds max_body_size of %d bytes", d.limit)
+	case d.decoded > decodingRatioSlack && d.decoded > d.encoded.n*maxDecodingRatio:
+		return 0, errDecodingRatio
+	}
+	return n, err
+}
+
+// Close closes the decoders and the source, innermost last
+func (d *decodedBody) Close() error {
+	var err error
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if closeErr := d.closers[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	d.closers = nil
+	return err
+}
+
+// setHeader sets a header, replacing any existing one regardless of case
+func setHeader(headers map[string]string, name, value string) {
+	deleteHeader(headers, name)
+	headers[name] = value
+}
+
+// deleteHeader removes a header regardless of case
+func deleteHeader(headers map[string]string, name string) {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			delete(headers, key)
+		}
+	}
+}
+
+// Compression modes of outgoing encapsulated bodies
+const (
+	// CompressionOff sends bodies as they are
+	CompressionOff = "off"
+	// CompressionAuto compresses bodies when the OPTIONS response of the
+	// server advertises gzip in an Accept-Encoding header
+	CompressionAuto = "auto"
+	// CompressionAlways compresses bodies without asking the server
+	CompressionAlways = "always"
+)
+
+// defaultCompressionMinSize is the smallest body worth compressing when
+// compression.min_size is zero
+const defaultCompressionMinSize = 1024
+
+// defaultCompressibleTypes are the media types compressed when
+// compression.content_types is empty
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/xml",
+	"application/javascript",
+	"application/x-www-form-urlencoded",
+	"image/svg+xml",
+}
+
+// Server support for gzip encoded bodies, learned from OPTIONS responses
+const (
+	gzipSupportUnknown int32 = iota
+	gzipSupported
+	gzipUnsupported
+)
+
+// CompressionConfig controls gzip compression of the encapsulated HTTP
+// bodies sent to the server. Only bodies held in memory, without a
+// Content-Encoding, of at least MinSize bytes and of a compressible
+// Content-Type are compressed, and only when that makes them smaller.
+type CompressionConfig struct {
+	// Mode is "off" (the default), "auto" or "always"
+	Mode string `yaml:"mode" json:"mode"`
+	// MinSize is the smallest body compressed, 1024 bytes if zero
+	MinSize int64 `yaml:"min_size" json:"min_size"`
+	// ContentTypes are the media types compressed, e.g. "application/json",
+	// or "text/*" for all subtypes. Text, JSON, XML, JavaScript, form and
+	// SVG bodies are compressed if empty.
+	ContentTypes []string `yaml:"content_types" json:"content_types"`
+}
+
+// parseCompressionMode parses a compression mode, "off" if empty
+func parseCompressionMode(mode string) (string, error) {
+	switch mode = strings.ToLower(mode); mode {
+	case "":
+		return CompressionOff, nil
+	case CompressionOff, CompressionAuto, CompressionAlways:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown compression mode %q", mode)
+}
+
+// compressBody returns a copy of httpData with its body gzip compressed and
+// Content-Encoding and Content-Length set, or httpData itself when the
+// compression settings or the server rule it out
+func (c *IcapClient) compressBody(ctx context.Context, settings *CompressionConfig, httpData interface{}) interface{} {
+	mode, _ := parseCompressionMode(settings.Mode)
+	if mode == CompressionOff || httpBodyReader(httpData) != nil {
+		return httpData
+	}
+
+	body := httpBody(httpData)
+	headers := httpHeaders(httpData)
+	minSize := settings.MinSize
+	if minSize <= 0 {
+		minSize = defaultCompressionMinSize
+	}
+	if int64(len(body)) < minSize || !compressibleType(headerValue(headers, "Content-Type"), settings.ContentTypes) {
+		return httpData
+	}
+	if encoding := headerValue(headers, "Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return httpData
+	}
+	if mode == CompressionAuto && !c.serverAcceptsGzip(ctx) {
+		return httpData
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	zw := gzip.NewWriter(buf)
+	zw.Write(body)
+	zw.Close()
+	if buf.Len() >= len(body) {
+		return httpData
+	}
+	compressed := append([]byte(nil), buf.Bytes()...)
+
+	encoded := make(map[string]string, len(headers)+1)
+	for name, value := range headers {
+		encoded[name] = value
+	}
+	setHeader(encoded, "Content-Encoding", "gzip")
+	setHeader(encoded, "Content-Length", strconv.Itoa(len(compressed)))
+	c.logger.Debug("Compressed encapsulated body", "size", len(body), "compressed_size", len(compressed))
+
+	switch data := httpData.(type) {
+	case *HttpRequest:
+		request := *data
+		request.Headers, request.Body = encoded, compressed
+		return &request
+	case *HttpResponse:
+		response := *data
+		response.Headers, response.Body = encoded, compressed
+		return &response
+	}
+	return httpData
+}
+
+// serverAcceptsGzip reports whether the server advertised gzip support,
+// sending an OPTIONS request the first time it is asked
+func (c *IcapClient) serverAcceptsGzip(ctx context.Context) bool {
+	if support := c.gzipSupport.Load(); support != gzipSupportUnknown {
+		return support == gzipSupported
+	}
+	if _, err := c.Options(ctx); err != nil {
+		c.logger.Warn("Failed to learn server gzip support, sending body uncompressed", "error", err)
+		return false
+	}
+	return c.gzipSupport.Load() == gzipSupported
+}
+
+// recordAcceptEncoding remembers whether an OPTIONS response advertises
+// gzip in its Accept-Encoding header
+func (c *IcapClient) recordAcceptEncoding(response *IcapResponse) {
+	if response.StatusCode != int(OK) {
+		return
+	}
+	support := gzipUnsupported
+	for _, coding := range strings.Split(headerValue(response.Headers, "Accept-Encoding"), ",") {
+		coding, _, _ = strings.Cut(coding, ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			support = gzipSupported
+		}
+	}
+	c.gzipSupport.Store(support)
+}
+
+// compressibleType reports whether contentType matches one of types, or
+// of the default compressible types if types is empty
+func compressibleType(contentType string, types []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+	for _, pattern := range types {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,296 @@
+package icapclient
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// encodeTestBody encodes data with a content coding
+func encodeTestBody(t *testing.T, coding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("Unknown coding %s", coding)
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// TestIcapClient_decodeResponseBody tests decoding adapted response bodies
+// and fixing their headers
+func TestIcapClient_decodeResponseBody(t *testing.T) {
+	plain := []byte(strings.Repeat("plaintext ", 100))
+	gzipped := encodeTestBody(t, "gzip", plain)
+
+	tests := []struct {
+		name             string
+		disabled         bool
+		contentEncoding  string
+		body             []byte
+		maxBodySize      int64
+		expectedBody     []byte
+		expectedEncoding string
+	}{
+		{"gzip", false, "gzip", gzipped, 0, plain, ""},
+		{"x-gzip", false, "x-gzip", gzipped, 0, plain, ""},
+		{"deflate", false, "deflate", encodeTestBody(t, "deflate", plain), 0, plain, ""},
+		{"raw deflate", false, "Deflate", encodeTestBody(t, "raw deflate", plain), 0, plain, ""},
+		{"br", false, "br", encodeTestBody(t, "br", plain), 0, plain, ""},
+		{"stacked", false, "gzip, br", encodeTestBody(t, "br", gzipped), 0, plain, ""},
+		{"identity", false, "identity", plain, 0, plain, "identity"},
+		{"disabled", true, "gzip", gzipped, 0, gzipped, "gzip"},
+		{"unsupported", false, "gzip, zstd", gzipped, 0, gzipped, "gzip, zstd"},
+		{"corrupt", false, "gzip", []byte("not gzip"), 0, []byte("not gzip"), "gzip"},
+		{"over max_body_size", false, "gzip", gzipped, 100, gzipped, "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewIcapClient(&IcapConfig{LoggingLevel: "ERROR", DecodeContentEncoding: !tt.disabled, MaxBodySize: tt.maxBodySize})
+			defer client.Close()
+
+			response := &IcapResponse{HttpResponse: &HttpResponse{
+				StatusCode: 200,
+				Headers:    map[string]string{"content-encoding": tt.contentEncoding, "Content-Length": "1"},
+				Body:       tt.body,
+			}}
+			client.decodeResponseBody(client.config.Load(), response)
+
+			adapted := response.HttpResponse
+			if !bytes.Equal(adapted.Body, tt.expectedBody) {
+				t.Errorf("Expected %d byte body, got %d bytes", len(tt.expectedBody), len(adapted.Body))
+			}
+			if encoding := headerValue(adapted.Headers, "Content-Encoding"); encoding != tt.expectedEncoding {
+				t.Errorf("Expected Content-Encoding %q, got %q", tt.expectedEncoding, encoding)
+			}
+			expectedLength := "1"
+			if tt.expectedEncoding == "" {
+				expectedLength = "1000"
+			}
+			if length := headerValue(adapted.Headers, "Content-Length"); length != expectedLength {
+				t.Errorf("Expected Content-Length %s, got %s", expectedLength, length)
+			}
+		})
+	}
+}
+
+// TestIcapClient_DecodeSpooledResponse tests decoding a response body
+// spooled to disk as it is read
+func TestIcapClient_DecodeSpooledResponse(t *testing.T) {
+	plain := strings.Repeat("spooled plaintext ", 1000)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		resp := &http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{"Content-Encoding": {"gzip"}}}
+		w.WriteHeader(200, resp, true)
+		w.Write(encodeTestBody(t, "gzip", []byte(plain)))
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	client.config.Load().DecodeContentEncoding = true
+	client.config.Load().Spool = SpoolConfig{Directory: t.TempDir(), Threshold: 16}
+	client.transport.spool = client.config.Load().Spool
+	defer client.Close()
+
+	response, err := client.Respmod(context.Background(), &HttpResponse{
+		Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Headers: map[string]string{}, Body: []byte("hello"),
+	})
+	if err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+	defer response.Close()
+
+	adapted := response.HttpResponse
+	if adapted == nil || adapted.BodyReader == nil {
+		t.Fatalf("Expected a spooled body, got %+v", adapted)
+	}
+	if headerValue(adapted.Headers, "Content-Encoding") != "" || headerValue(adapted.Headers, "Content-Length") != "" {
+		t.Errorf("Expected Content-Encoding and Content-Length removed, got %v", adapted.Headers)
+	}
+	data, err := io.ReadAll(adapted.BodyReader)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if string(data) != plain {
+		t.Errorf("Expected %d byte decoded body, got %d bytes", len(plain), len(data))
+	}
+}
+
+// TestIcapClient_DecodeBomb tests that bodies expanding past the bounds of
+// decoding are left encoded in memory and fail to read when spooled
+func TestIcapClient_DecodeBomb(t *testing.T) {
+	bomb := encodeTestBody(t, "gzip", make([]byte, 100<<20))
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		resp := &http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{"Content-Encoding": {"gzip"}}}
+		w.WriteHeader(200, resp, true)
+		w.Write(bomb)
+	}))
+	defer server.Close()
+
+	for _, spooled := range []bool{false, true} {
+		client := newTestServerClient(server, false)
+		client.config.Load().DecodeContentEncoding = true
+		if spooled {
+			client.config.Load().Spool = SpoolConfig{Directory: t.TempDir(), Threshold: 16}
+			client.transport.spool = client.config.Load().Spool
+		}
+
+		response, err := client.Respmod(context.Background(), &HttpResponse{
+			Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Headers: map[string]string{}, Body: []byte("hello"),
+		})
+		if err != nil {
+			t.Fatalf("RESPMOD failed: %v", err)
+		}
+		adapted := response.HttpResponse
+		if spooled {
+			if _, err := io.Copy(io.Discard, adapted.BodyReader); err == nil {
+				t.Errorf("Expected reading the spooled bomb to fail")
+			}
+		} else if headerValue(adapted.Headers, "Content-Encoding") != "gzip" || !bytes.Equal(adapted.Body, bomb) {
+			t.Errorf("Expected the bomb left encoded, got %d bytes with headers %v", len(adapted.Body), adapted.Headers)
+		}
+		response.Close()
+		client.Close()
+	}
+}
+
+// TestIcapClient_compressBody tests which outgoing bodies are compressed
+func TestIcapClient_compressBody(t *testing.T) {
+	text := []byte(strings.Repeat("compress me ", 200))
+	random := make([]byte, 4096)
+	for i := range random {
+		random[i] = byte(i * 7919 >> 3)
+	}
+	incompressible := encodeTestBody(t, "gzip", encodeTestBody(t, "br", random))
+
+	tests := []struct {
+		name       string
+		settings   CompressionConfig
+		headers    map[string]string
+		body       []byte
+		reader     io.Reader
+		compressed bool
+	}{
+		{"off", CompressionConfig{}, map[string]string{"Content-Type": "text/plain"}, text, nil, false},
+		{"always", CompressionConfig{Mode: "always"}, map[string]string{"Content-Type": "text/plain; charset=utf-8"}, text, nil, true},
+		{"json", CompressionConfig{Mode: "Always"}, map[string]string{"content-type": "application/json"}, text, nil, true},
+		{"under min size", CompressionConfig{Mode: "always", MinSize: 4096}, map[string]string{"Content-Type": "text/plain"}, text, nil, false},
+		{"binary type", CompressionConfig{Mode: "always"}, map[string]string{"Content-Type": "image/png"}, text, nil, false},
+		{"no type", CompressionConfig{Mode: "always"}, map[string]string{}, text, nil, false},
+		{"configured type", CompressionConfig{Mode: "always", ContentTypes: []string{"application/*"}}, map[string]string{"Content-Type": "application/octet-stream"}, text, nil, true},
+		{"already encoded", CompressionConfig{Mode: "always"}, map[string]string{"Content-Type": "text/plain", "Content-Encoding": "br"}, text, nil, false},
+		{"identity", CompressionConfig{Mode: "always"}, map[string]string{"Content-Type": "text/plain", "Content-Encoding": "identity"}, text, nil, true},
+		{"incompressible", CompressionConfig{Mode: "always"}, map[string]string{"Content-Type": "text/plain"}, incompressible, nil, false},
+		{"streamed", CompressionConfig{Mode: "always"}, map[string]string{"Content-Type": "text/plain"}, nil, bytes.NewReader(text), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewIcapClient(&IcapConfig{LoggingLevel: "ERROR", Compression: tt.settings})
+			defer client.Close()
+
+			original := &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", Headers: tt.headers, Body: tt.body, BodyReader: tt.reader}
+			result := client.compressBody(context.Background(), &client.config.Load().Compression, original).(*HttpRequest)
+			if !tt.compressed {
+				if result != original {
+					t.Errorf("Expected the body sent as is, got headers %v", result.Headers)
+				}
+				return
+			}
+
+			if result == original || headerValue(original.Headers, "Content-Length") != "" {
+				t.Fatal("Expected a compressed copy leaving the original unchanged")
+			}
+			if encoding := headerValue(result.Headers, "Content-Encoding"); encoding != "gzip" {
+				t.Errorf("Expected Content-Encoding gzip, got %q", encoding)
+			}
+			if length := headerValue(result.Headers, "Content-Length"); length != strconv.Itoa(len(result.Body)) {
+				t.Errorf("Expected Content-Length %d, got %s", len(result.Body), length)
+			}
+			decoded, err := decodeBody(result.Body, []string{"gzip"}, 0)
+			if err != nil || !bytes.Equal(decoded, tt.body) {
+				t.Errorf("Expected the body to decode to the original, got error %v", err)
+			}
+		})
+	}
+}
+
+// TestIcapClient_CompressionAuto tests compressing only when the OPTIONS
+// response of the server advertises gzip
+func TestIcapClient_CompressionAuto(t *testing.T) {
+	for _, tt := range []struct {
+		acceptEncoding string
+		compressed     bool
+	}{
+		{"", false},
+		{"deflate", false},
+		{"br, gzip;q=0.5", true},
+	} {
+		var optionsRequests atomic.Int32
+		received := make(chan *icaptest.Request, 1)
+		server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+			if r.Method == "OPTIONS" {
+				optionsRequests.Add(1)
+				w.Header().Set("Methods", "REQMOD")
+				if tt.acceptEncoding != "" {
+					w.Header().Set("Accept-Encoding", tt.acceptEncoding)
+				}
+				w.WriteHeader(200, nil, false)
+				return
+			}
+			received <- r
+			w.WriteHeader(204, nil, false)
+		}))
+
+		client := newTestServerClient(server, false)
+		client.config.Load().Compression = CompressionConfig{Mode: CompressionAuto}
+		body := strings.Repeat("compress me ", 200)
+		for i := 0; i < 2; i++ {
+			_, err := client.Reqmod(context.Background(), &HttpRequest{
+				Method: "POST", URI: "/upload", Version: "HTTP/1.1",
+				Headers: map[string]string{"Content-Type": "text/plain"}, Body: []byte(body),
+			})
+			if err != nil {
+				t.Fatalf("REQMOD failed: %v", err)
+			}
+			r := <-received
+			encoding := r.Request.Header.Get("Content-Encoding")
+			if compressed := encoding == "gzip"; compressed != tt.compressed {
+				t.Errorf("Accept-Encoding %q: expected compressed %v, got Content-Encoding %q", tt.acceptEncoding, tt.compressed, encoding)
+			}
+			if tt.compressed {
+				decoded, err := decodeBody(r.Body, []string{"gzip"}, 0)
+				if err != nil || string(decoded) != body {
+					t.Errorf("Expected the received body to decode to the original, got error %v", err)
+				}
+			}
+		}
+		if n := optionsRequests.Load(); n != 1 {
+			t.Errorf("Expected a single OPTIONS request, got %d", n)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,172 @@
+package icapclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Aggregations of the verdicts of a FanOut
+const (
+	// AggregateAnyBlock blocks the message when any service blocks it.
+	// Services that fail are ignored as long as one answered.
+	AggregateAnyBlock = "any-block"
+	// AggregateAllClean allows the message only when every service
+	// answered and none blocked it, failing closed
+	AggregateAllClean = "all-clean"
+	// AggregateMajority blocks the message when more than half of the
+	// services that answered block it
+	AggregateMajority = "majority"
+)
+
+// FanOut scans the same message through several ICAP services at once,
+// e.g. antivirus, sandbox and DLP, and combines their verdicts. Adapted
+// messages are not merged; a Chain applies adaptations in turn.
+type FanOut struct {
+	aggregation string
+	stages      []ChainStage
+}
+
+// NewFanOut creates a fan-out to stages combining their verdicts with
+// aggregation, AggregateAnyBlock if empty
+func NewFanOut(aggregation string, stages ...ChainStage) (*FanOut, error) {
+	aggregation = strings.ToLower(aggregation)
+	switch aggregation {
+	case "":
+		aggregation = AggregateAnyBlock
+	case AggregateAnyBlock, AggregateAllClean, AggregateMajority:
+	default:
+		return nil, fmt.Errorf("unknown aggregation %q, expected any-block, all-clean or majority", aggregation)
+	}
+	return &FanOut{aggregation: aggregation, stages: stages}, nil
+}
+
+// FanOutResult is the outcome of scanning a message through a fan-out
+type FanOutResult struct {
+	// Verdict is VerdictBlocked or VerdictAllowed as combined by the
+	// aggregation, or VerdictError when no service answered
+	Verdict Verdict
+	// Services are the results of the services, in the order of the stages
+	Services []StageResult
+	// Response is the response of the first service blocking the message,
+	// holding its block page, nil unless the message is blocked
+	Response *IcapResponse
+}
+
+// Close closes the responses of the services
+func (r *FanOutResult) Close() error {
+	return closeStages(r.Services)
+}
+
+// ScanRequest sends httpRequest through REQMOD to every service
+// concurrently. A body read from a BodyReader is read into memory first, so
+// that every service gets it.
+func (f *FanOut) ScanRequest(ctx context.Context, httpRequest *HttpRequest) (*FanOutResult, error) {
+	return f.scan(ctx, httpRequest, func(ctx context.Context, client *IcapClient, message interface{}) (Verdict, *IcapResponse, error) {
+		return client.ScanRequest(ctx, message.(*HttpRequest))
+	})
+}
+
+// ScanResponse sends httpResponse through RESPMOD to every service
+// concurrently, reading a streamed body into memory as ScanRequest does
+func (f *FanOut) ScanResponse(ctx context.Context, httpResponse *HttpResponse) (*FanOutResult, error) {
+	return f.scan(ctx, httpResponse, func(ctx context.Context, client *IcapClient, message interface{}) (Verdict, *IcapResponse, error) {
+		return client.ScanResponse(ctx, message.(*HttpResponse))
+	})
+}
+
+// scan sends message to every service with scan and aggregates the
+// verdicts, returning an error when no service answered
+func (f *FanOut) scan(ctx context.Context, message interface{}, scan func(context.Context, *IcapClient, interface{}) (Verdict, *IcapResponse, error)) (*FanOutResult, error) {
+	message, err := bufferedBody(message)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &FanOutResult{Services: make([]StageResult, len(f.stages))}
+	var wg sync.WaitGroup
+	for i, stage := range f.stages {
+		wg.Add(1)
+		go func(i int, stage ChainStage) {
+			defer wg.Done()
+			verdict, response, err := scan(ctx, stage.Client, message)
+			if verdict == VerdictError && err == nil {
+				err = &IcapError{Message: fmt.Sprintf("ICAP server answered %d %s", response.StatusCode, response.Reason), Code: response.StatusCode}
+			}
+			result.Services[i] = StageResult{Name: stage.Name, Verdict: verdict, Response: response, Err: err}
+		}(i, stage)
+	}
+	wg.Wait()
+
+	var answered, blocked int
+	var firstErr error
+	for _, service := range result.Services {
+		switch {
+		case service.Err != nil:
+			if firstErr == nil {
+				firstErr = fmt.Errorf("service %s: %w", service.Name, service.Err)
+			}
+		case service.Verdict == VerdictBlocked:
+			answered++
+			blocked++
+			if result.Response == nil {
+				result.Response = service.Response
+			}
+		default:
+			answered++
+		}
+	}
+	if answered == 0 {
+		result.Verdict = VerdictError
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no service to scan with")
+		}
+		return result, firstErr
+	}
+
+	result.Verdict = VerdictAllowed
+	switch f.aggregation {
+	case AggregateAnyBlock:
+		if blocked > 0 {
+			result.Verdict = VerdictBlocked
+		}
+	case AggregateAllClean:
+		if blocked > 0 || answered < len(result.Services) {
+			result.Verdict = VerdictBlocked
+		}
+	case AggregateMajority:
+		if blocked*2 > answered {
+			result.Verdict = VerdictBlocked
+		}
+	}
+	if result.Verdict != VerdictBlocked {
+		result.Response = nil
+	}
+	return result, nil
+}
+
+// bufferedBody returns message with its BodyReader read into Body
+func bufferedBody(message interface{}) (interface{}, error) {
+	reader := httpBodyReader(message)
+	if reader == nil {
+		return message, nil
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	switch message := message.(type) {
+	case *HttpRequest:
+		copied := *message
+		copied.Body, copied.BodyReader = body, nil
+		return &copied, nil
+	case *HttpResponse:
+		copied := *message
+		copied.Body, copied.BodyReader = body, nil
+		return &copied, nil
+	}
+	return message, nil
+}
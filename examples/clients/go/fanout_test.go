@@ -0,0 +1,98 @@
+package icapclient
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestFanOut tests combining the verdicts of services scanning the same
+// message
+func TestFanOut(t *testing.T) {
+	clean := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(204, nil, false)
+	}))
+	defer clean.Close()
+	blocking := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if string(r.Body) != "payload" {
+			w.WriteHeader(204, nil, false)
+			return
+		}
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/plain"}}}, true)
+		w.Write([]byte("blocked"))
+	}))
+	defer blocking.Close()
+	down := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	down.Close()
+
+	stages := map[string]ChainStage{}
+	for name, server := range map[string]*icaptest.Server{"av": clean, "sandbox": blocking, "dlp": clean, "down": down} {
+		client := newTestServerClient(server, false)
+		defer client.Close()
+		stages[name] = ChainStage{Name: name, Client: client}
+	}
+
+	for _, tt := range []struct {
+		name        string
+		aggregation string
+		stages      []string
+		expected    Verdict
+	}{
+		{"any block", "", []string{"av", "sandbox", "dlp"}, VerdictBlocked},
+		{"any block ignores failures", AggregateAnyBlock, []string{"av", "down"}, VerdictAllowed},
+		{"all clean", AggregateAllClean, []string{"av", "dlp"}, VerdictAllowed},
+		{"all clean fails closed", AggregateAllClean, []string{"av", "down"}, VerdictBlocked},
+		{"majority clean", AggregateMajority, []string{"av", "sandbox", "dlp"}, VerdictAllowed},
+		{"majority tie", AggregateMajority, []string{"av", "sandbox"}, VerdictAllowed},
+		{"majority of answers", AggregateMajority, []string{"sandbox", "down"}, VerdictBlocked},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var fanOutStages []ChainStage
+			for _, name := range tt.stages {
+				fanOutStages = append(fanOutStages, stages[name])
+			}
+			fanOut, err := NewFanOut(tt.aggregation, fanOutStages...)
+			if err != nil {
+				t.Fatalf("NewFanOut failed: %v", err)
+			}
+			result, err := fanOut.ScanResponse(context.Background(), &HttpResponse{
+				Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", BodyReader: strings.NewReader("payload"),
+			})
+			if err != nil {
+				t.Fatalf("Fan-out failed: %v", err)
+			}
+			defer result.Close()
+			if result.Verdict != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, result.Verdict)
+			}
+			if len(result.Services) != len(tt.stages) {
+				t.Fatalf("Expected %d service results, got %d", len(tt.stages), len(result.Services))
+			}
+			for i, service := range result.Services {
+				if service.Name != tt.stages[i] || (service.Err != nil) != (service.Name == "down") {
+					t.Errorf("Expected the result of %s, got %+v", tt.stages[i], service)
+				}
+			}
+			if result.Verdict != VerdictBlocked && result.Response != nil {
+				t.Errorf("Expected no block page when allowed, got %+v", result.Response)
+			}
+		})
+	}
+
+	fanOut, _ := NewFanOut(AggregateAnyBlock, stages["av"], stages["sandbox"])
+	result, err := fanOut.ScanRequest(context.Background(), &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", Body: []byte("payload")})
+	if err != nil || result.Response == nil || result.Response.HttpResponse == nil || result.Response.HttpResponse.StatusCode != 403 {
+		t.Errorf("Expected the sandbox block page, got %+v %v", result, err)
+	}
+
+	fanOut, _ = NewFanOut(AggregateAnyBlock, stages["down"])
+	if result, err := fanOut.ScanRequest(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}); err == nil || result.Verdict != VerdictError {
+		t.Errorf("Expected an error when no service answered, got %v", err)
+	}
+	if _, err := NewFanOut("unanimous"); err == nil {
+		t.Errorf("Expected an unknown aggregation to fail")
+	}
+}
@@ -0,0 +1,186 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FaultInjectionConfig injects failures into the ICAP transport so retry and
+// failover settings can be exercised against a healthy server. Rates are
+// probabilities between 0 and 1, evaluated per request.
+type FaultInjectionConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// ResetRate is the probability the connection is reset before the response
+	ResetRate float64 `yaml:"reset_rate" json:"reset_rate"`
+	// SlowReadRate is the probability reads of a response are slowed down by
+	// SlowReadDelay each
+	SlowReadRate  float64       `yaml:"slow_read_rate" json:"slow_read_rate"`
+	SlowReadDelay time.Duration `yaml:"slow_read_delay" json:"slow_read_delay"`
+	// TruncateRate is the probability the response is cut off after
+	// TruncateAfter bytes
+	TruncateRate  float64 `yaml:"truncate_rate" json:"truncate_rate"`
+	TruncateAfter int     `yaml:"truncate_after" json:"truncate_after"`
+	// ContinueDelay delays delivery of every 100 Continue response
+	ContinueDelay time.Duration `yaml:"continue_delay" json:"continue_delay"`
+	// ErrorRate is the probability a request is answered with ErrorStatus
+	// (default 503) without reaching the server
+	ErrorRate   float64 `yaml:"error_rate" json:"error_rate"`
+	ErrorStatus int     `yaml:"error_status" json:"error_status"`
+	// Seed makes the injected faults reproducible; zero seeds from the clock
+	Seed int64 `yaml:"seed" json:"seed"`
+}
+
+// faultInjector decides which faults to inject
+type faultInjector struct {
+	config *FaultInjectionConfig
+	logger Logger
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// newFaultInjector creates a fault injector, or returns nil if fault
+// injection is disabled
+func newFaultInjector(config *FaultInjectionConfig, logger Logger) *faultInjector {
+	if !config.Enabled {
+		return nil
+	}
+
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	logger.Warn("Fault injection enabled, ICAP requests will fail on purpose",
+		"reset_rate", config.ResetRate,
+		"slow_read_rate", config.SlowReadRate,
+		"truncate_rate", config.TruncateRate,
+		"error_rate", config.ErrorRate,
+		"seed", seed,
+	)
+
+	return &faultInjector{
+		config: config,
+		logger: logger,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// roll reports whether a fault with the given probability should be injected
+func (f *faultInjector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64() < rate
+}
+
+// errorResponse returns a synthesized error response, or nil if none is injected
+func (f *faultInjector) errorResponse() *IcapResponse {
+	if f == nil || !f.roll(f.config.ErrorRate) {
+		return nil
+	}
+
+	status := f.config.ErrorStatus
+	if status == 0 {
+		status = int(ServiceUnavailable)
+	}
+	f.logger.Debug("Injected fault", "fault", "error_status", "status_code", status)
+
+	return &IcapResponse{
+		Version:    "ICAP/1.0",
+		StatusCode: status,
+		Reason:     "Injected Fault",
+		Headers:    map[string]string{"Connection": "close"},
+	}
+}
+
+// wrapDial wraps the connections made by dial with fault injection
+func (f *faultInjector) wrapDial(dial dialFunc) dialFunc {
+	if f == nil {
+		return dial
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &faultConn{Conn: conn, injector: f, remaining: -1}, nil
+	}
+}
+
+// faultConn injects faults into the responses read from a connection. Each
+// write starts a new exchange, for which faults are decided on the first read.
+type faultConn struct {
+	net.Conn
+	injector *faultInjector
+
+	newExchange bool
+	slow        bool
+	remaining   int // bytes left before truncation, or -1
+	readAny     bool
+}
+
+// Write writes to the connection and marks the start of an exchange
+func (c *faultConn) Write(p []byte) (int, error) {
+	c.newExchange = true
+	return c.Conn.Write(p)
+}
+
+// Read reads from the connection, injecting the faults planned for the exchange
+func (c *faultConn) Read(p []byte) (int, error) {
+	config := c.injector.config
+
+	if c.newExchange {
+		c.newExchange = false
+		c.readAny = false
+		c.remaining = -1
+
+		if c.injector.roll(config.ResetRate) {
+			c.injector.logger.Debug("Injected fault", "fault", "reset")
+			c.Conn.Close()
+			return 0, &net.OpError{Op: "read", Net: "tcp", Addr: c.RemoteAddr(), Err: syscall.ECONNRESET}
+		}
+		c.slow = c.injector.roll(config.SlowReadRate)
+		if c.injector.roll(config.TruncateRate) {
+			c.injector.logger.Debug("Injected fault", "fault", "truncate", "after", config.TruncateAfter)
+			c.remaining = config.TruncateAfter
+		}
+	}
+
+	if c.slow && config.SlowReadDelay > 0 {
+		time.Sleep(config.SlowReadDelay)
+	}
+
+	if c.remaining == 0 {
+		c.Conn.Close()
+		return 0, io.ErrUnexpectedEOF
+	}
+	if c.remaining > 0 && len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.Conn.Read(p)
+	if c.remaining > 0 {
+		c.remaining -= n
+	}
+
+	if !c.readAny && n > 0 {
+		c.readAny = true
+		if config.ContinueDelay > 0 && bytes.HasPrefix(p[:n], []byte("ICAP/1.0 100")) {
+			c.injector.logger.Debug("Injected fault", "fault", "continue_delay", "delay", config.ContinueDelay)
+			time.Sleep(config.ContinueDelay)
+		}
+	}
+
+	return n, err
+}
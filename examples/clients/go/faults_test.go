@@ -0,0 +1,118 @@
+package icapclient
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// newFaultTestClient creates a client for server with fault injection
+func newFaultTestClient(server *icaptest.Server, faults FaultInjectionConfig) *IcapClient {
+	host, port := server.HostPort()
+	faults.Enabled = true
+	faults.Seed = 1
+	return NewIcapClient(&IcapConfig{
+		Host:           host,
+		Port:           port,
+		Timeout:        5 * time.Second,
+		KeepAlive:      true,
+		LoggingLevel:   "ERROR",
+		FaultInjection: faults,
+	})
+}
+
+// TestFaultInjection tests each injected fault against a healthy server
+func TestFaultInjection(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		faults     FaultInjectionConfig
+		wantErr    bool
+		wantStatus int
+	}{
+		{"No faults", FaultInjectionConfig{}, false, 200},
+		{"Random 5xx", FaultInjectionConfig{ErrorRate: 1}, false, 503},
+		{"Custom status", FaultInjectionConfig{ErrorRate: 1, ErrorStatus: 500}, false, 500},
+		{"Connection reset", FaultInjectionConfig{ResetRate: 1}, true, 0},
+		{"Truncated response", FaultInjectionConfig{TruncateRate: 1, TruncateAfter: 10}, true, 0},
+		{"Slow reads", FaultInjectionConfig{SlowReadRate: 1, SlowReadDelay: time.Millisecond}, false, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFaultTestClient(server, tt.faults)
+			defer client.Close()
+
+			response, err := client.Options(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if response != nil && response.StatusCode != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, response.StatusCode)
+			}
+		})
+	}
+}
+
+// TestFaultInjection_Retries tests that retries recover from intermittent faults
+func TestFaultInjection_Retries(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	client := newFaultTestClient(server, FaultInjectionConfig{ResetRate: 0.5})
+	client.config.Load().Retries = 10
+	client.config.Load().RetryBudget = -1
+	defer client.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, err := client.Options(context.Background()); err != nil {
+			t.Fatalf("Expected retries to recover from resets, got %v", err)
+		}
+	}
+}
+
+// TestFaultInjection_Disabled tests that no injector is created when disabled
+func TestFaultInjection_Disabled(t *testing.T) {
+	if f := newFaultInjector(&FaultInjectionConfig{ErrorRate: 1}, NewDefaultLogger("ERROR")); f != nil {
+		t.Error("Expected nil injector when fault injection is disabled")
+	}
+
+	var f *faultInjector
+	if f.errorResponse() != nil {
+		t.Error("Expected no error response from nil injector")
+	}
+}
+
+// TestFaultConn_ContinueDelay tests delaying 100 Continue responses
+func TestFaultConn_ContinueDelay(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	injector := newFaultInjector(&FaultInjectionConfig{
+		Enabled:       true,
+		ContinueDelay: 50 * time.Millisecond,
+	}, NewDefaultLogger("ERROR"))
+	conn := &faultConn{Conn: client, injector: injector, remaining: -1}
+
+	go func() {
+		io.ReadAll(server)
+	}()
+	conn.Write([]byte("RESPMOD"))
+	go server.Write([]byte("ICAP/1.0 100 Continue\r\n\r\n"))
+
+	start := time.Now()
+	buf := make([]byte, 64)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected 100 Continue to be delayed, got %v", elapsed)
+	}
+}
@@ -0,0 +1,5 @@
+// Package gatewaypb holds the gRPC API of cmd/icap-gateway generated from
+// gateway.proto.
+package gatewaypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative gateway.proto
@@ -0,0 +1,233 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// updateGolden rewrites the expected sections of the golden files
+var updateGolden = flag.Bool("update", false, "update expected results in testdata/golden")
+
+// goldenCase is a recorded ICAP exchange. Files in testdata/golden hold the
+// raw bytes, CRLFs included, in sections introduced by "-- name --" lines:
+//
+//	-- request --   bytes the client sends, checked by the replaying server
+//	-- response --  bytes the server answers with
+//	-- expected --  the parsed response as written by describeResponse, or
+//	                "error: <substring>" for exchanges that must fail
+type goldenCase struct {
+	path     string
+	comment  string
+	request  []byte
+	response []byte
+	expected string
+}
+
+// loadGoldenCase reads a golden file
+func loadGoldenCase(path string) (*goldenCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := make(map[string][]byte)
+	var current string
+	var comment []byte
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+
+		marker := strings.TrimSpace(string(line))
+		if strings.HasPrefix(marker, "-- ") && strings.HasSuffix(marker, " --") {
+			current = strings.TrimSpace(marker[3 : len(marker)-3])
+			if _, ok := sections[current]; ok {
+				return nil, fmt.Errorf("%s: duplicate section %q", path, current)
+			}
+			sections[current] = []byte{}
+			continue
+		}
+		if current == "" {
+			comment = append(comment, line...)
+			continue
+		}
+		sections[current] = append(sections[current], line...)
+	}
+
+	for _, name := range []string{"request", "response"} {
+		if _, ok := sections[name]; !ok {
+			return nil, fmt.Errorf("%s: missing section %q", path, name)
+		}
+	}
+
+	return &goldenCase{
+		path:     path,
+		comment:  string(comment),
+		request:  sections["request"],
+		response: sections["response"],
+		expected: string(sections["expected"]),
+	}, nil
+}
+
+// write rewrites the golden file with expected
+func (c *goldenCase) write(expected string) error {
+	var buf bytes.Buffer
+	buf.WriteString(c.comment)
+	buf.WriteString("-- request --\n")
+	buf.Write(c.request)
+	buf.WriteString("-- response --\n")
+	buf.Write(c.response)
+	buf.WriteString("-- expected --\n")
+	buf.WriteString(expected)
+	return os.WriteFile(c.path, buf.Bytes(), 0o644)
+}
+
+// replayGolden serves the recorded response to a client transport and
+// returns what the client made of it
+func replayGolden(t *testing.T, c *goldenCase) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		request := make([]byte, len(c.request))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			serverErr <- fmt.Errorf("failed to read request: %w", err)
+			return
+		}
+		if !bytes.Equal(request, c.request) {
+			serverErr <- fmt.Errorf("request mismatch:\nexpected %q\ngot      %q", c.request, request)
+			return
+		}
+		_, err = conn.Write(c.response)
+		serverErr <- err
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	client := NewIcapClient(&IcapConfig{
+		Host:         addr.IP.String(),
+		Port:         addr.Port,
+		Timeout:      5 * time.Second,
+		LoggingLevel: "ERROR",
+	})
+	defer client.Close()
+
+	response, err := client.transport.roundTrip(context.Background(), c.request, nil)
+	if err := <-serverErr; err != nil {
+		t.Fatalf("Replay server: %v", err)
+	}
+	if err != nil {
+		return "error: " + err.Error() + "\n"
+	}
+	return describeResponse(response)
+}
+
+// describeResponse renders a response in the stable text form of the
+// expected sections
+func describeResponse(response *IcapResponse) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "status: %s %d %s\n", response.Version, response.StatusCode, response.Reason)
+	writeSortedHeaders(&b, "header", response.Headers)
+
+	if r := response.HttpRequest; r != nil {
+		fmt.Fprintf(&b, "http-request: %s %s %s\n", r.Method, r.URI, r.Version)
+		writeSortedHeaders(&b, "http-header", r.Headers)
+		if r.Body != nil {
+			fmt.Fprintf(&b, "http-body: %s\n", strconv.Quote(string(r.Body)))
+		}
+	}
+	if r := response.HttpResponse; r != nil {
+		fmt.Fprintf(&b, "http-response: %s %d %s\n", r.Version, r.StatusCode, r.Reason)
+		writeSortedHeaders(&b, "http-header", r.Headers)
+		if r.Body != nil {
+			fmt.Fprintf(&b, "http-body: %s\n", strconv.Quote(string(r.Body)))
+		}
+	}
+	if i := response.Infection; i != nil {
+		fmt.Fprintf(&b, "infection: %s %s %q\n", i.Type, i.Resolution, i.Threat)
+	}
+	for _, v := range response.Violations {
+		fmt.Fprintf(&b, "violation: %q %q %d %s\n", v.Filename, v.Threat, v.ProblemID, v.Resolution)
+	}
+	if response.HttpRequest == nil && response.HttpResponse == nil && response.Body != nil {
+		fmt.Fprintf(&b, "body: %s\n", strconv.Quote(string(response.Body)))
+	}
+	return b.String()
+}
+
+// writeSortedHeaders writes one line per header in name order
+func writeSortedHeaders(b *strings.Builder, prefix string, headers map[string]string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(b, "%s %s: %s\n", prefix, name, headers[name])
+	}
+}
+
+// TestGolden replays the recorded exchanges in testdata/golden
+func TestGolden(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "golden", "*.icap"))
+	if err != nil {
+		t.Fatalf("Failed to list golden files: %v", err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("No golden files found")
+	}
+
+	for _, path := range paths {
+		path := path
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".icap"), func(t *testing.T) {
+			c, err := loadGoldenCase(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := replayGolden(t, c)
+			if *updateGolden {
+				if err := c.write(actual); err != nil {
+					t.Fatalf("Failed to update %s: %v", path, err)
+				}
+				return
+			}
+
+			if expectedErr, ok := strings.CutPrefix(strings.TrimSpace(c.expected), "error: "); ok {
+				if !strings.Contains(actual, expectedErr) {
+					t.Errorf("Expected error containing %q, got:\n%s", expectedErr, actual)
+				}
+				return
+			}
+			if actual != c.expected {
+				t.Errorf("Response mismatch for %s\nexpected:\n%s\ngot:\n%s", path, c.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package icapclient
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Hooks are optional callbacks invoked during the request lifecycle so
+// applications can attach their own counters, alerts or audit code. Hooks are
+// called synchronously and must be safe for concurrent use.
+type Hooks struct {
+	// OnConnect is called after each connection attempt to the ICAP server
+	OnConnect func(ConnectEvent)
+	// OnRetry is called before an attempt that follows a failed one
+	OnRetry func(RetryEvent)
+	// OnResponse is called for every ICAP response received
+	OnResponse func(ResponseEvent)
+	// OnVerdict is called once per transaction with its final outcome
+	OnVerdict func(VerdictEvent)
+	// OnPoolExhausted is called when a request cannot get a connection
+	// because the connection pool is at capacity
+	OnPoolExhausted func(PoolExhaustedEvent)
+}
+
+// ConnectEvent describes a connection attempt
+type ConnectEvent struct {
+	Addr     string
+	TLS      bool
+	Duration time.Duration
+	Err      error
+}
+
+// RetryEvent describes a retry of a failed attempt
+type RetryEvent struct {
+	Method  IcapMethod
+	URL     string
+	Attempt int
+	Err     error
+}
+
+// ResponseEvent describes a received ICAP response
+type ResponseEvent struct {
+	Method   IcapMethod
+	URL      string
+	Response *IcapResponse
+	Attempt  int
+	Duration time.Duration
+}
+
+// VerdictEvent describes the final outcome of a transaction. Verdict tells
+// a block apart from an adaptation, as returned by ScanRequest and
+// ScanResponse.
+type VerdictEvent struct {
+	Method   IcapMethod
+	URL      string
+	Verdict  Verdict
+	Response *IcapResponse
+	Err      error
+}
+
+// PoolExhaustedEvent describes a request that found the pool at capacity
+type PoolExhaustedEvent struct {
+	Method IcapMethod
+	URL    string
+	Wait   time.Duration
+}
+
+// dialFunc is the signature of net.Dialer.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// wrapDial reports connection attempts made through dial to OnConnect
+func (h *Hooks) wrapDial(dial dialFunc, isTLS bool) dialFunc {
+	if h.OnConnect == nil {
+		return dial
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		h.OnConnect(ConnectEvent{
+			Addr:     addr,
+			TLS:      isTLS,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+		return conn, err
+	}
+}
+
+// retry calls OnRetry if set
+func (h *Hooks) retry(event RetryEvent) {
+	if h.OnRetry != nil {
+		h.OnRetry(event)
+	}
+}
+
+// response calls OnResponse if set
+func (h *Hooks) response(event ResponseEvent) {
+	if h.OnResponse != nil {
+		h.OnResponse(event)
+	}
+}
+
+// verdict calls OnVerdict if set
+func (h *Hooks) verdict(event VerdictEvent) {
+	if h.OnVerdict != nil {
+		h.OnVerdict(event)
+	}
+}
+
+// poolExhausted calls OnPoolExhausted if set
+func (h *Hooks) poolExhausted(event PoolExhaustedEvent) {
+	if h.OnPoolExhausted != nil {
+		h.OnPoolExhausted(event)
+	}
+}
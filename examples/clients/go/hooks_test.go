@@ -0,0 +1,187 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestHooks_wrapDial tests OnConnect reporting
+func TestHooks_wrapDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	var events []ConnectEvent
+	hooks := &Hooks{OnConnect: func(e ConnectEvent) { events = append(events, e) }}
+	dial := hooks.wrapDial((&net.Dialer{}).DialContext, false)
+
+	conn, err := dial(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Close()
+
+	listener.Close()
+	dial(context.Background(), "tcp", listener.Addr().String())
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 connect events, got %d", len(events))
+	}
+	if events[0].Err != nil || events[0].Addr != listener.Addr().String() {
+		t.Errorf("Unexpected successful connect event: %+v", events[0])
+	}
+	if events[1].Err == nil {
+		t.Error("Expected the second connect event to report an error")
+	}
+
+	// Without OnConnect the dial function is used as is
+	if (&Hooks{}).wrapDial(nil, false) != nil {
+		t.Error("Expected dial to be returned unchanged without OnConnect")
+	}
+}
+
+// TestIcapClient_Hooks tests retry and verdict hooks on a failing backend
+func TestIcapClient_Hooks(t *testing.T) {
+	var mu sync.Mutex
+	var retries []RetryEvent
+	var verdicts []VerdictEvent
+
+	client := NewIcapClient(&IcapConfig{
+		Host:         "127.0.0.1",
+		Port:         1344,
+		Timeout:      time.Second,
+		Retries:      2,
+		LoggingLevel: "ERROR",
+		Hooks: Hooks{
+			OnRetry: func(e RetryEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+				retries = append(retries, e)
+			},
+			OnVerdict: func(e VerdictEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+				verdicts = append(verdicts, e)
+			},
+		},
+	})
+	defer client.Close()
+
+	if _, err := client.Options(context.Background()); err == nil {
+		t.Skip("OPTIONS request succeeded, no retries to check")
+	}
+
+	if len(retries) != 2 || retries[0].Attempt != 2 || retries[1].Attempt != 3 || retries[0].Err == nil {
+		t.Errorf("Expected retry events for attempts 2 and 3, got %+v", retries)
+	}
+	if len(verdicts) != 1 || verdicts[0].Verdict != VerdictError || verdicts[0].Method != OPTIONS {
+		t.Errorf("Expected one error verdict, got %+v", verdicts)
+	}
+}
+
+// TestIcapClient_VerdictHookBlocked tests that OnVerdict tells a block apart
+// from an adaptation
+func TestIcapClient_VerdictHookBlocked(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	var verdicts []Verdict
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	client.config.Load().Hooks.OnVerdict = func(e VerdictEvent) { verdicts = append(verdicts, e.Verdict) }
+
+	ctx := context.Background()
+	for _, body := range []string{"clean", "virus"} {
+		if _, err := client.Respmod(ctx, &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte(body)}); err != nil {
+			t.Fatalf("RESPMOD failed: %v", err)
+		}
+	}
+
+	if len(verdicts) != 2 || verdicts[0] != VerdictAllowed || verdicts[1] != VerdictBlocked {
+		t.Errorf("Expected allowed and blocked verdicts, got %v", verdicts)
+	}
+}
+
+// TestIcapClient_LocalVerdicts tests that requests answered or refused
+// without contacting the server are logged and reported to OnVerdict
+func TestIcapClient_LocalVerdicts(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.Method == "REQMOD" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var verdicts []Verdict
+	path := filepath.Join(t.TempDir(), "access.log")
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, KeepAlive: true, LoggingLevel: "ERROR",
+		MaxConcurrentRequests: 1, PoolWaitTimeout: -1,
+		TransferTypes: TransferTypesConfig{Ignore: []string{"image/*"}},
+		AccessLog:     AccessLogConfig{Path: path, MaxSizeMB: 1},
+		Hooks: Hooks{OnVerdict: func(e VerdictEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			verdicts = append(verdicts, e.Verdict)
+		}},
+	})
+
+	image := &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Headers: map[string]string{"Content-Type": "image/png"}, Body: []byte("png")}
+	if response, err := client.Respmod(context.Background(), image); err != nil || response.StatusCode != 204 {
+		t.Fatalf("Expected a local 204 for an ignored body, got %+v (%v)", response, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+		done <- err
+	}()
+	<-arrived
+	if _, err := client.Respmod(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK"}); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Expected ErrPoolExhausted, got %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+	client.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []Verdict{VerdictAllowed, VerdictError, VerdictAllowed}; !slices.Equal(verdicts, want) {
+		t.Errorf("Expected verdicts %v, got %v", want, verdicts)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read access log: %v", err)
+	}
+	var entries []AccessLogEntry
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var entry AccessLogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("Invalid access log line %s: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 || entries[0].Status != 204 || entries[1].Error == "" || entries[2].Method != "REQMOD" {
+		t.Errorf("Expected the ignored and refused requests in the access log, got %+v", entries)
+	}
+}
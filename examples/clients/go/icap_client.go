@@ -1,7 +1,5 @@
-package main
-
 /*
-G3ICAP Go Client
+Package icapclient is the G3ICAP Go Client.
 
 A comprehensive Go client for interacting with G3ICAP servers,
 supporting REQMOD, RESPMOD, and OPTIONS methods with full authentication
@@ -11,27 +9,33 @@ Author: G3ICAP Team
 License: Apache 2.0
 Version: 1.0.0
 */
+package icapclient
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptrace"
+	"github.com/mitchellh/mapstructure"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/sirupsen/logrus"
-	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Version is the client version reported in User-Agent and build info,
+// and available to identity header templates
+var Version = "1.0.0"
+
 // IcapMethod represents ICAP methods
 type IcapMethod string
 
@@ -48,6 +52,7 @@ const (
 	Continue                    IcapResponseCode = 100
 	OK                         IcapResponseCode = 200
 	NoContent                  IcapResponseCode = 204
+	PartialContent             IcapResponseCode = 206
 	BadRequest                 IcapResponseCode = 400
 	NotFound                   IcapResponseCode = 404
 	MethodNotAllowed           IcapResponseCode = 405
@@ -73,19 +78,106 @@ const (
 
 // IcapConfig represents ICAP client configuration
 type IcapConfig struct {
-	Host               string            `yaml:"host" json:"host"`
-	Port               int               `yaml:"port" json:"port"`
-	Timeout            time.Duration     `yaml:"timeout" json:"timeout"`
-	Retries            int               `yaml:"retries" json:"retries"`
-	RetryDelay         time.Duration     `yaml:"retry_delay" json:"retry_delay"`
-	MaxRetryDelay      time.Duration     `yaml:"max_retry_delay" json:"max_retry_delay"`
-	BackoffFactor      float64           `yaml:"backoff_factor" json:"backoff_factor"`
-	ConnectionPoolSize int               `yaml:"connection_pool_size" json:"connection_pool_size"`
-	KeepAlive          bool              `yaml:"keep_alive" json:"keep_alive"`
-	VerifySSL          bool              `yaml:"verify_ssl" json:"verify_ssl"`
-	Authentication     map[string]string `yaml:"authentication" json:"authentication"`
-	LoggingLevel       string            `yaml:"logging_level" json:"logging_level"`
-	MetricsEnabled     bool              `yaml:"metrics_enabled" json:"metrics_enabled"`
+	Host string `yaml:"host" json:"host"`
+	Port int    `yaml:"port" json:"port"`
+	// Timeout bounds a request across its attempts and retry delays, and
+	// AttemptTimeout each attempt, Timeout if zero
+	Timeout        time.Duration `yaml:"timeout" json:"timeout"`
+	AttemptTimeout time.Duration `yaml:"attempt_timeout" json:"attempt_timeout"`
+	// PoolWaitTimeout is how long a request waits for a connection when
+	// every connection allowed by the server is busy, before failing with
+	// ErrPoolExhausted: AttemptTimeout if zero, not at all if negative
+	PoolWaitTimeout time.Duration `yaml:"pool_wait_timeout" json:"pool_wait_timeout"`
+	// BackendDownTTL is how long a failed connect marks the server down,
+	// failing further connects at once instead of each waiting for the
+	// connect timeout; disabled if zero
+	BackendDownTTL time.Duration `yaml:"backend_down_ttl" json:"backend_down_ttl"`
+	// MaxConcurrentRequests caps the requests of the client in flight at
+	// once, retries included, whatever the pool size; unlimited if zero
+	MaxConcurrentRequests int                  `yaml:"max_concurrent_requests" json:"max_concurrent_requests"`
+	Retries               int                  `yaml:"retries" json:"retries"`
+	RetryDelay            time.Duration        `yaml:"retry_delay" json:"retry_delay"`
+	MaxRetryDelay         time.Duration        `yaml:"max_retry_delay" json:"max_retry_delay"`
+	BackoffFactor         float64              `yaml:"backoff_factor" json:"backoff_factor"`
+	ConnectionPoolSize    int                  `yaml:"connection_pool_size" json:"connection_pool_size"`
+	KeepAlive             bool                 `yaml:"keep_alive" json:"keep_alive"`
+	KeepAlivePing         time.Duration        `yaml:"keep_alive_ping" json:"keep_alive_ping"`
+	WarmupConnections     int                  `yaml:"warmup_connections" json:"warmup_connections"`
+	MaxRequestsPerConn    int                  `yaml:"max_requests_per_conn" json:"max_requests_per_conn"`
+	VerifySSL             bool                 `yaml:"verify_ssl" json:"verify_ssl"`
+	Authentication        map[string]string    `yaml:"authentication" json:"authentication"`
+	LoggingLevel          string               `yaml:"logging_level" json:"logging_level"`
+	MetricsEnabled        bool                 `yaml:"metrics_enabled" json:"metrics_enabled"`
+	TLS                   TLSConfig            `yaml:"tls" json:"tls"`
+	AccessLog             AccessLogConfig      `yaml:"access_log" json:"access_log"`
+	FaultInjection        FaultInjectionConfig `yaml:"fault_injection" json:"fault_injection"`
+	MaxHeaderBytes        int                  `yaml:"max_header_bytes" json:"max_header_bytes"`
+	MaxHeaderCount        int                  `yaml:"max_header_count" json:"max_header_count"`
+	Services              ServicesConfig       `yaml:"services" json:"services"`
+	MaxBodySize           int64                `yaml:"max_body_size" json:"max_body_size"`
+	BodyLimitAction       string               `yaml:"body_limit_action" json:"body_limit_action"`
+	ResponseProfile       string               `yaml:"response_profile" json:"response_profile"`
+	// DecodeContentEncoding decodes gzip, deflate and br encoded bodies of
+	// adapted HTTP responses, fixing their Content-Encoding and
+	// Content-Length headers
+	DecodeContentEncoding bool              `yaml:"decode_content_encoding" json:"decode_content_encoding"`
+	Compression           CompressionConfig `yaml:"compression" json:"compression"`
+	Spool                 SpoolConfig       `yaml:"spool" json:"spool"`
+	Proxy                 ProxyConfig       `yaml:"proxy" json:"proxy"`
+	DNS                   DNSCacheConfig    `yaml:"dns" json:"dns"`
+	Throttle              ThrottleConfig    `yaml:"throttle" json:"throttle"`
+	ContentHash           ContentHashConfig `yaml:"content_hash" json:"content_hash"`
+	ScanCache             ScanCacheConfig   `yaml:"scan_cache" json:"scan_cache"`
+	CleanFilter           CleanFilterConfig `yaml:"clean_filter" json:"clean_filter"`
+	Policy                PolicyConfig      `yaml:"policy" json:"policy"`
+	// HostHeader overrides the Host header, e.g. for virtual-hosted ICAP
+	// services behind a shared address
+	HostHeader string         `yaml:"host_header" json:"host_header"`
+	Identity   IdentityConfig `yaml:"identity" json:"identity"`
+	// Allow lists the capabilities advertised in the Allow header: "204",
+	// "206" and "trailers", or "none" to omit it. "204, 206" if empty.
+	Allow []string `yaml:"allow" json:"allow"`
+	// TransferRules applies the Preview, Transfer-Preview, Transfer-Ignore
+	// and Transfer-Complete headers of the OPTIONS response of the server
+	// to REQMOD and RESPMOD bodies, by file extension
+	TransferRules bool                `yaml:"transfer_rules" json:"transfer_rules"`
+	TransferTypes TransferTypesConfig `yaml:"transfer_types" json:"transfer_types"`
+	// ClockSkewThreshold is the difference between the server Date and the
+	// local clock logged as a warning, 30s if zero and never if negative
+	ClockSkewThreshold time.Duration `yaml:"clock_skew_threshold" json:"clock_skew_threshold"`
+	// ServiceID is sent as Service-ID, and TenantID in TenantHeader
+	// (X-Tenant-ID if empty), to multi-tenant ICAP platforms
+	ServiceID    string `yaml:"service_id" json:"service_id"`
+	TenantID     string `yaml:"tenant_id" json:"tenant_id"`
+	TenantHeader string `yaml:"tenant_header" json:"tenant_header"`
+	// RetryOn lists, by method, the error classes retried: "connect",
+	// "send", "response" and "unavailable". Methods that are not listed
+	// retry every class, e.g. RESPMOD: [connect] never resends a body the
+	// server may already have scanned.
+	RetryOn map[string][]string `yaml:"retry_on" json:"retry_on"`
+	// RetryBudget is the ratio of retries to requests allowed across the
+	// client, beyond a reserve of 10, 0.2 if zero and unbounded if negative
+	RetryBudget       float64               `yaml:"retry_budget" json:"retry_budget"`
+	MetricsNamespace  string                `yaml:"metrics_namespace" json:"metrics_namespace"`
+	MetricsRegisterer prometheus.Registerer `yaml:"-" json:"-"`
+	TracerProvider    trace.TracerProvider  `yaml:"-" json:"-"`
+	Logger            Logger                `yaml:"-" json:"-"`
+	// DialContext, when set, opens the TCP connections, to the ICAP server
+	// or the configured proxy, in place of net.Dialer. TLS, proxies and
+	// the ICAP protocol are layered on top as usual.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error) `yaml:"-" json:"-"`
+	Hooks       Hooks                                                             `yaml:"-" json:"-"`
+}
+
+// ServicesConfig overrides the ICAP service path used for each method, e.g.
+// "/echo" for the c-icap echo service
+type ServicesConfig struct {
+	Reqmod  string `yaml:"reqmod" json:"reqmod"`
+	Respmod string `yaml:"respmod" json:"respmod"`
+	Options string `yaml:"options" json:"options"`
+	// Custom maps vendor-specific methods sent with Do, e.g. "LOG", to
+	// their service path. Methods are matched ignoring case.
+	Custom map[string]string `yaml:"custom" json:"custom"`
 }
 
 // HttpRequest represents an HTTP request
@@ -95,6 +187,11 @@ type HttpRequest struct {
 	Version string            `yaml:"version" json:"version"`
 	Headers map[string]string `yaml:"headers" json:"headers"`
 	Body    []byte            `yaml:"body" json:"body"`
+	// BodyReader, when set, is sent instead of Body
+	BodyReader io.Reader `yaml:"-" json:"-"`
+	// Trailer holds the trailer fields sent after the terminal chunk of a
+	// non-empty body, e.g. a checksum of the body
+	Trailer map[string]string `yaml:"trailer,omitempty" json:"trailer,omitempty"`
 }
 
 // HttpResponse represents an HTTP response
@@ -104,24 +201,77 @@ type HttpResponse struct {
 	Reason     string            `yaml:"reason" json:"reason"`
 	Headers    map[string]string `yaml:"headers" json:"headers"`
 	Body       []byte            `yaml:"body" json:"body"`
+	// BodyReader, when set, is sent instead of Body. In responses it holds
+	// a body spooled to disk, released by IcapResponse.Close.
+	BodyReader io.Reader `yaml:"-" json:"-"`
+	// Trailer holds the trailer fields sent after the terminal chunk of a
+	// non-empty body, e.g. a checksum of the body
+	Trailer map[string]string `yaml:"trailer,omitempty" json:"trailer,omitempty"`
 }
 
 // IcapResponse represents an ICAP response
 type IcapResponse struct {
-	Version    string            `yaml:"version" json:"version"`
-	StatusCode int               `yaml:"status_code" json:"status_code"`
-	Reason     string            `yaml:"reason" json:"reason"`
-	Headers    map[string]string `yaml:"headers" json:"headers"`
-	Body       []byte            `yaml:"body" json:"body"`
-	HttpRequest  *HttpRequest  `yaml:"http_request,omitempty" json:"http_request,omitempty"`
-	HttpResponse *HttpResponse `yaml:"http_response,omitempty" json:"http_response,omitempty"`
+	Version      string            `yaml:"version" json:"version"`
+	StatusCode   int               `yaml:"status_code" json:"status_code"`
+	Reason       string            `yaml:"reason" json:"reason"`
+	Headers      map[string]string `yaml:"headers" json:"headers"`
+	Body         []byte            `yaml:"body" json:"body"`
+	HttpRequest  *HttpRequest      `yaml:"http_request,omitempty" json:"http_request,omitempty"`
+	HttpResponse *HttpResponse     `yaml:"http_response,omitempty" json:"http_response,omitempty"`
+	RequestID    string            `yaml:"request_id" json:"request_id"`
+	Infection    *Infection        `yaml:"infection,omitempty" json:"infection,omitempty"`
+	Violations   []Violation       `yaml:"violations,omitempty" json:"violations,omitempty"`
+	// ChunkExtensions are the extensions of the chunks of the encapsulated
+	// body, e.g. use-original-body in 206 responses
+	ChunkExtensions []ChunkExtension `yaml:"chunk_extensions,omitempty" json:"chunk_extensions,omitempty"`
+	// OptBody is the decoded opt-body of an OPTIONS response, whose raw
+	// bytes are also in Body
+	OptBody *OptBody `yaml:"opt_body,omitempty" json:"opt_body,omitempty"`
+	// Timings breaks down the time spent on the request
+	Timings *Timings `yaml:"timings,omitempty" json:"timings,omitempty"`
+	// ContentHashes are the hashes of the body sent, when content_hash or
+	// scan_cache is enabled
+	ContentHashes ContentHashes `yaml:"content_hashes,omitempty" json:"content_hashes,omitempty"`
+	// Changes reports what the server changed in the encapsulated message,
+	// when it sent an adapted message
+	Changes *AdaptationReport `yaml:"changes,omitempty" json:"changes,omitempty"`
+	// Policy is the decision of the client policy on a message bypassed or
+	// blocked without contacting the server, allowed or blocked after the
+	// server failed, or scanned in part
+	Policy *PolicyDecision `yaml:"policy,omitempty" json:"policy,omitempty"`
+	// FromCache reports a response answered from the scan cache, without
+	// contacting the server
+	FromCache bool `yaml:"from_cache,omitempty" json:"from_cache,omitempty"`
+	// KnownClean reports a 204 answered because the hash of the body is in
+	// the clean filter, without contacting the server
+	KnownClean bool `yaml:"known_clean,omitempty" json:"known_clean,omitempty"`
+}
+
+// Close removes the spool file of an encapsulated body spooled to disk. It
+// is a no-op for bodies held in memory.
+func (r *IcapResponse) Close() error {
+	var reader io.Reader
+	switch {
+	case r.HttpResponse != nil:
+		reader = r.HttpResponse.BodyReader
+	case r.HttpRequest != nil:
+		reader = r.HttpRequest.BodyReader
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
 
 // IcapError represents ICAP client errors
 type IcapError struct {
-	Message string
-	Code    int
-	Err     error
+	Message   string
+	Code      int
+	RequestID string
+	Err       error
+	// RetryAfter is the delay asked for by the Retry-After header of a 503
+	// response, zero if none
+	RetryAfter time.Duration
 }
 
 func (e *IcapError) Error() string {
@@ -131,6 +281,19 @@ func (e *IcapError) Error() string {
 	return e.Message
 }
 
+func (e *IcapError) Unwrap() error {
+	return e.Err
+}
+
+// withRequestID records the request ID of the failed transaction on err
+func withRequestID(err error, requestID string) error {
+	var icapErr *IcapError
+	if errors.As(err, &icapErr) && icapErr.RequestID == "" {
+		icapErr.RequestID = requestID
+	}
+	return err
+}
+
 // AuthenticationHandler handles different authentication methods
 type AuthenticationHandler struct {
 	method AuthenticationMethod
@@ -177,53 +340,38 @@ func (h *AuthenticationHandler) GetHeaders() map[string]string {
 
 // IcapClient represents the ICAP client
 type IcapClient struct {
-	config        *IcapConfig
-	logger        *logrus.Logger
-	httpClient    *http.Client
+	config        atomic.Pointer[IcapConfig]
+	logger        Logger
+	logLevel      *slog.LevelVar
+	transport     *icapTransport
 	authHandler   *AuthenticationHandler
 	metrics       *ClientMetrics
-}
-
-// ClientMetrics represents client metrics
-type ClientMetrics struct {
-	RequestsTotal     prometheus.Counter
-	RequestsSuccess   prometheus.Counter
-	RequestsFailed    prometheus.Counter
-	ResponseTime      prometheus.Histogram
-	ConnectionPool    prometheus.Gauge
-}
-
-// NewClientMetrics creates new client metrics
-func NewClientMetrics() *ClientMetrics {
-	return &ClientMetrics{
-		RequestsTotal: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "icap_client_requests_total",
-			Help: "Total number of ICAP requests",
-		}),
-		RequestsSuccess: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "icap_client_requests_success_total",
-			Help: "Total number of successful ICAP requests",
-		}),
-		RequestsFailed: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "icap_client_requests_failed_total",
-			Help: "Total number of failed ICAP requests",
-		}),
-		ResponseTime: promauto.NewHistogram(prometheus.HistogramOpts{
-			Name:    "icap_client_response_time_seconds",
-			Help:    "ICAP client response time in seconds",
-			Buckets: prometheus.DefBuckets,
-		}),
-		ConnectionPool: promauto.NewGauge(prometheus.GaugeOpts{
-			Name: "icap_client_connection_pool_size",
-			Help: "ICAP client connection pool size",
-		}),
-	}
+	keyLog        io.Closer
+	tracer        trace.Tracer
+	accessLog     *accessLogger
+	gzipSupport   atomic.Int32
+	identity      atomic.Pointer[map[string]string]
+	transferRules atomic.Pointer[transferRules]
+	clockSkew     atomic.Int64
+	clockSkewed   atomic.Bool
+	retryBudget   retryBudget
+	// requests counts the requests in flight against max_concurrent_requests
+	requests      *connLimiter
+	scanCache     *scanCache
+	cleanFilter   *cleanFilter
+	policy        atomic.Pointer[policy]
+	policyWatcher policyWatcher
 }
 
 // NewIcapClient creates a new ICAP client
 func NewIcapClient(config *IcapConfig) *IcapClient {
-	logger := logrus.New()
-	logger.SetLevel(getLogLevel(config.LoggingLevel))
+	logger := config.Logger
+	var logLevel *slog.LevelVar
+	if logger == nil {
+		logLevel = &slog.LevelVar{}
+		logLevel.Set(getLogLevel(config.LoggingLevel))
+		logger = newLevelLogger(logLevel)
+	}
 
 	// Setup authentication
 	var authHandler *AuthenticationHandler
@@ -232,261 +380,514 @@ func NewIcapClient(config *IcapConfig) *IcapClient {
 		authHandler = NewAuthenticationHandler(method, config.Authentication)
 	}
 
-	// Setup HTTP client
-	transport := &http.Transport{
-		MaxIdleConns:        config.ConnectionPoolSize,
-		MaxIdleConnsPerHost: config.ConnectionPoolSize,
-		IdleConnTimeout:     config.Timeout,
-		DisableKeepAlives:   !config.KeepAlive,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: !config.VerifySSL,
-		},
-		DialContext: (&net.Dialer{
-			Timeout:   config.Timeout,
-			KeepAlive: config.Timeout,
-		}).DialContext,
-	}
-
-	httpClient := &http.Client{
-		Transport: transport,
-		Timeout:   config.Timeout,
-	}
-
 	// Setup metrics
 	var metrics *ClientMetrics
 	if config.MetricsEnabled {
-		metrics = NewClientMetrics()
+		metrics = NewClientMetrics(config.MetricsRegisterer, config.MetricsNamespace)
 		metrics.ConnectionPool.Set(float64(config.ConnectionPoolSize))
 	}
 
-	return &IcapClient{
-		config:      config,
+	// Setup ICAP transport
+	tlsConfig := buildTLSConfig(config)
+	keyLog, err := openKeyLogFile(&config.TLS)
+	if err != nil {
+		logger.Warn("Failed to open TLS key log file", "error", err)
+	} else if keyLog != nil {
+		tlsConfig.KeyLogWriter = keyLog
+		logger.Warn("TLS key logging enabled, ICAPS traffic can be decrypted", "path", keyLog.Name())
+	}
+
+	client := &IcapClient{
 		logger:      logger,
-		httpClient:  httpClient,
+		logLevel:    logLevel,
+		transport:   newIcapTransport(config, tlsConfig, metrics, newFaultInjector(&config.FaultInjection, logger)),
 		authHandler: authHandler,
 		metrics:     metrics,
+		keyLog:      keyLog,
+		tracer:      newTracer(config.TracerProvider),
+		accessLog:   newAccessLogger(&config.AccessLog),
+		scanCache:   newScanCache(config.ScanCache),
+		cleanFilter: openCleanFilter(config.CleanFilter, logger, metrics),
+	}
+	client.requests = newConnLimiter()
+	client.requests.setLimit(max(config.MaxConcurrentRequests, 0))
+	client.config.Store(config)
+	client.loadPolicy(config.Policy)
+	client.restoreScanCache()
+	client.startScanCacheSaver(config.ScanCache.SaveInterval)
+	identity := client.identityHeaders(config)
+	client.identity.Store(&identity)
+
+	// Keep idle pooled connections alive with OPTIONS pings
+	if config.KeepAlive {
+		client.transport.startPinger(config.KeepAlivePing, client.encodeOptionsRequest)
 	}
-}
 
-// getLogLevel converts string to logrus level
-func getLogLevel(level string) logrus.Level {
-	switch strings.ToUpper(level) {
-	case "DEBUG":
-		return logrus.DebugLevel
-	case "INFO":
-		return logrus.InfoLevel
-	case "WARN", "WARNING":
-		return logrus.WarnLevel
-	case "ERROR":
-		return logrus.ErrorLevel
-	case "FATAL":
-		return logrus.FatalLevel
-	default:
-		return logrus.InfoLevel
+	// Warm-up is best effort, connections that fail are dialed on demand
+	if config.WarmupConnections > 0 {
+		if err := client.Warmup(context.Background(), config.WarmupConnections); err != nil {
+			logger.Warn("Connection warm-up incomplete", "error", err)
+		}
 	}
+
+	return client
+}
+
+// Logger returns the logger of the client
+func (c *IcapClient) Logger() Logger {
+	return c.logger
 }
 
-// buildICAPURL builds ICAP URL for method
-func (c *IcapClient) buildICAPURL(method IcapMethod) string {
+// buildICAPURL builds ICAP URL for method under config
+func (c *IcapClient) buildICAPURL(config *IcapConfig, method IcapMethod) string {
 	var path string
 	switch method {
 	case REQMOD:
-		path = "/reqmod"
+		path = servicePath(config.Services.Reqmod, "/reqmod")
 	case RESPMOD:
-		path = "/respmod"
+		path = servicePath(config.Services.Respmod, "/respmod")
 	case OPTIONS:
-		path = "/options"
+		path = servicePath(config.Services.Options, "/options")
+	default:
+		path = servicePath(headerValue(config.Services.Custom, string(method)), "/"+strings.ToLower(string(method)))
 	}
-	return fmt.Sprintf("icap://%s:%d%s", c.config.Host, c.config.Port, path)
+	return c.serviceURL(config, path)
+}
+
+// serviceURL builds the ICAP URL of the service at path under config
+func (c *IcapClient) serviceURL(config *IcapConfig, path string) string {
+	scheme := "icap"
+	if config.TLS.Enabled {
+		scheme = "icaps"
+	}
+	return scheme + "://" + net.JoinHostPort(config.Host, strconv.Itoa(config.Port)) + path
+}
+
+// Default ports of the icap and icaps schemes
+const (
+	DefaultPort    = 1344
+	DefaultTLSPort = 11344
+)
+
+// hostHeader returns the Host header: host_header when set, otherwise the
+// ICAP authority with the port omitted when it is the default of the scheme
+func (c *IcapClient) hostHeader(config *IcapConfig) string {
+	if config.HostHeader != "" {
+		return config.HostHeader
+	}
+	defaultPort := DefaultPort
+	if config.TLS.Enabled {
+		defaultPort = DefaultTLSPort
+	}
+	if config.Port == defaultPort {
+		if strings.Contains(config.Host, ":") {
+			return "[" + config.Host + "]"
+		}
+		return config.Host
+	}
+	return net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+}
+
+// servicePath returns the configured service path, or the default if unset
+func servicePath(configured, fallback string) string {
+	if configured == "" {
+		return fallback
+	}
+	if !strings.HasPrefix(configured, "/") {
+		return "/" + configured
+	}
+	return configured
 }
 
 // buildEncapsulatedHeader builds Encapsulated header for ICAP request
 func (c *IcapClient) buildEncapsulatedHeader(httpData interface{}) string {
+	var section string
 	switch httpData.(type) {
 	case *HttpRequest:
-		return "req-hdr=0, null-body=75"
+		section = "req"
 	case *HttpResponse:
-		return "res-hdr=0, null-body=120"
+		section = "res"
 	default:
 		return "null-body=0"
 	}
+
+	headerLength := httpHeaderLength(httpData)
+	if len(httpBody(httpData)) > 0 || httpBodyReader(httpData) != nil {
+		return fmt.Sprintf("%s-hdr=0, %s-body=%d", section, section, headerLength)
+	}
+	return fmt.Sprintf("%s-hdr=0, null-body=%d", section, headerLength)
 }
 
 // serializeHTTPData serializes HTTP data for ICAP body
 func (c *IcapClient) serializeHTTPData(httpData interface{}) []byte {
-	var lines []string
+	return append(serializeHTTPHeader(httpData), httpBody(httpData)...)
+}
 
-	switch data := httpData.(type) {
-	case *HttpRequest:
-		lines = append(lines, fmt.Sprintf("%s %s %s", data.Method, data.URI, data.Version))
-		for name, value := range data.Headers {
-			lines = append(lines, fmt.Sprintf("%s: %s", name, value))
-		}
-		lines = append(lines, "") // Empty line
-		if len(data.Body) > 0 {
-			lines = append(lines, string(data.Body))
-		}
-	case *HttpResponse:
-		lines = append(lines, fmt.Sprintf("%s %d %s", data.Version, data.StatusCode, data.Reason))
-		for name, value := range data.Headers {
-			lines = append(lines, fmt.Sprintf("%s: %s", name, value))
-		}
-		lines = append(lines, "") // Empty line
-		if len(data.Body) > 0 {
-			lines = append(lines, string(data.Body))
+// parseICAPResponse parses ICAP response
+func (c *IcapClient) parseICAPResponse(responseText string) (*IcapResponse, error) {
+	br := getBufioReader(strings.NewReader(responseText))
+	defer putBufioReader(br)
+	parser := getResponseParser(br, c.config.Load().MaxHeaderBytes, c.config.Load().MaxHeaderCount)
+	defer putResponseParser(parser)
+	return parser.ReadResponse()
+}
+
+// requestHeaders returns the ICAP headers common to every request for
+// httpData under config
+func (c *IcapClient) requestHeaders(config *IcapConfig, httpData interface{}) map[string]string {
+	headers := make(map[string]string)
+	headers["Host"] = c.hostHeader(config)
+	headers["Date"] = time.Now().UTC().Format(http.TimeFormat)
+	if config.ServiceID != "" {
+		headers["Service-ID"] = config.ServiceID
+	}
+	if config.TenantID != "" {
+		headers[tenantHeader(config.TenantHeader)] = config.TenantID
+	}
+	for name, value := range *c.identity.Load() {
+		headers[name] = value
+	}
+	setAllow(headers, config.Allow)
+
+	if httpData != nil {
+		headers["Encapsulated"] = c.buildEncapsulatedHeader(httpData)
+	}
+
+	// Add authentication headers
+	if c.authHandler != nil {
+		authHeaders := c.authHandler.GetHeaders()
+		for name, value := range authHeaders {
+			headers[name] = value
 		}
 	}
 
-	return []byte(strings.Join(lines, "\r\n"))
+	return headers
 }
 
-// parseICAPResponse parses ICAP response
-func (c *IcapClient) parseICAPResponse(responseText string) *IcapResponse {
-	lines := strings.Split(responseText, "\r\n")
-
-	// Parse status line
-	statusLine := lines[0]
-	parts := strings.SplitN(statusLine, " ", 3)
-	version := parts[0]
-	statusCode, _ := strconv.Atoi(parts[1])
-	reason := parts[2]
+// makeRequest makes ICAP request with retry logic. The configuration is
+// loaded once, so a request keeps the settings it started with across
+// retries when the client is reloaded.
+func (c *IcapClient) makeRequest(ctx context.Context, method IcapMethod, httpData interface{}) (*IcapResponse, error) {
+	config := c.config.Load()
+	url := c.buildICAPURL(config, method)
 
-	// Parse headers
-	headers := make(map[string]string)
-	bodyStart := 0
+	opts := requestOptionsFrom(ctx)
+	if opts.Service != "" {
+		url = c.serviceURL(config, servicePath(opts.Service, ""))
+	}
+	if opts.RequestID == "" {
+		opts.RequestID = newRequestID()
+	}
+	requestID := opts.RequestID
 
-	for i, line := range lines[1:] {
-		if line == "" {
-			bodyStart = i + 2
-			break
+	stream, err := openBodyStream(httpData, config.Spool.withThreshold(opts.SpoolThreshold))
+	if err != nil {
+		return nil, &IcapError{Message: "Failed to prepare body", RequestID: requestID, Err: err}
+	}
+	defer stream.Close()
+	if stream != nil {
+		stream.trailer = httpTrailer(httpData)
+	}
+	original, originalSize := httpData, int64(len(httpBody(httpData)))
+	if stream != nil {
+		originalSize = stream.size
+	}
+	var preview *PolicyDecision
+	var previewSize int64
+	var onFailure string
+	if p := c.policy.Load(); p != nil && (method == REQMOD || method == RESPMOD) {
+		var decision PolicyDecision
+		decision, onFailure = p.evaluate(newPolicyMessage(method, httpData, originalSize, opts.URL))
+		if c.metrics != nil {
+			c.metrics.PolicyDecisions.WithLabelValues(decision.Action).Inc()
 		}
-		if strings.Contains(line, ":") {
-			parts := strings.SplitN(line, ":", 2)
-			name := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-			headers[name] = value
+		switch decision.Action {
+		case PolicyBypass, PolicyBlock:
+			if decision.Action == PolicyBypass && c.metrics != nil {
+				c.metrics.PolicyBypassedBytes.WithLabelValues(PolicyBypass).Add(float64(originalSize))
+			}
+			return c.localResponse(config, method, url, requestID, httpData, nil, policyResponse(decision), "client policy"), nil
+		case PolicyPreview:
+			preview, previewSize = &decision, p.previewSize
 		}
 	}
-
-	// Parse body
-	var body []byte
-	if bodyStart < len(lines) {
-		bodyText := strings.Join(lines[bodyStart:], "\r\n")
-		if strings.TrimSpace(bodyText) != "" {
-			body = []byte(bodyText)
+	hashes, err := c.hashContent(config.ContentHash, httpData, stream)
+	if err != nil {
+		return nil, &IcapError{Message: "Failed to hash body", RequestID: requestID, Err: err}
+	}
+	if c.cleanFilter.contains(method, url, hashes) {
+		if c.metrics != nil {
+			c.metrics.CleanFilterHits.Inc()
 		}
+		response := &IcapResponse{
+			Version:    "ICAP/1.0",
+			StatusCode: int(NoContent),
+			Reason:     "No Content",
+			Headers:    map[string]string{},
+			KnownClean: true,
+		}
+		return c.localResponse(config, method, url, requestID, httpData, hashes, response, "clean filter"), nil
+	}
+	cacheKey := c.scanCache.messageKey(method, httpData, hashes)
+	if cached, ok := c.scanCache.lookup(method, url, cacheKey); ok {
+		if c.metrics != nil {
+			c.metrics.ScanCacheLookups.WithLabelValues("hit").Inc()
+		}
+		cached.FromCache = true
+		cached.Changes = adaptationReport(httpData, originalSize, cached)
+		return c.localResponse(config, method, url, requestID, httpData, hashes, cached, "scan cache"), nil
+	}
+	if cacheKey != "" && c.metrics != nil {
+		c.metrics.ScanCacheLookups.WithLabelValues("miss").Inc()
 	}
 
-	return &IcapResponse{
-		Version:    version,
-		StatusCode: statusCode,
-		Reason:     reason,
-		Headers:    headers,
-		Body:       body,
+	// A preview verdict covers part of the body, so it is not remembered
+	// under the hashes of the whole body
+	if preview != nil {
+		cacheKey = ""
+		if originalSize > previewSize {
+			c.logger.Debug("Scanning the start of the body only", "request_id", requestID, "size", originalSize, "preview_size", previewSize)
+			httpData = truncateBody(httpData, stream, previewSize)
+			if c.metrics != nil {
+				c.metrics.PolicyBypassedBytes.WithLabelValues(PolicyPreview).Add(float64(originalSize - previewSize))
+			}
+		}
 	}
-}
 
-// makeRequest makes ICAP request with retry logic
-func (c *IcapClient) makeRequest(ctx context.Context, method IcapMethod, httpData interface{}) (*IcapResponse, error) {
-	url := c.buildICAPURL(method)
+	httpData, err = c.applyBodyLimit(config, httpData, stream)
+	if err != nil {
+		c.logger.Warn("Request refused", "method", method, "request_id", requestID, "error", err)
+		return nil, c.localError(config, method, url, requestID, httpData, hashes, err)
+	}
+	httpData = c.compressBody(ctx, &config.Compression, httpData)
+
+	action, previewSize := c.transferAction(ctx, config, method, httpData)
+	switch action {
+	case transferIgnore:
+		c.logger.Debug("Request skipped, the body is in Transfer-Ignore or transfer_types.ignore", "method", method, "request_id", requestID)
+		if hashes == nil {
+			hashes = stream.contentHashes()
+		}
+		response := &IcapResponse{
+			Version:    "ICAP/1.0",
+			StatusCode: int(NoContent),
+			Reason:     "No Content",
+			Headers:    map[string]string{},
+		}
+		return c.localResponse(config, method, url, requestID, httpData, hashes, response, "transfer rules"), nil
+	case transferPreview:
+		httpData, stream = previewStream(httpData, stream, previewSize)
+	}
 
 	// Build headers
-	headers := make(map[string]string)
-	headers["Host"] = fmt.Sprintf("%s:%d", c.config.Host, c.config.Port)
-	headers["User-Agent"] = "G3ICAP-Go-Client/1.0.0"
-	headers["Allow"] = "204"
+	headers := c.requestHeaders(config, httpData)
 
-	if httpData != nil {
-		headers["Encapsulated"] = c.buildEncapsulatedHeader(httpData)
+	if stream != nil && stream.preview {
+		headers["Preview"] = strconv.FormatInt(stream.previewSize, 10)
 	}
 
-	// Add authentication headers
-	if c.authHandler != nil {
-		authHeaders := c.authHandler.GetHeaders()
-		for name, value := range authHeaders {
-			headers[name] = value
-		}
+	// Add per-request metadata headers
+	opts.applyHeaders(headers, tenantHeader(config.TenantHeader))
+	if hashes != nil && config.ContentHash.Header {
+		headers["X-Content-Hash"] = hashes.String()
 	}
 
-	// Build body
-	var body []byte
-	if httpData != nil {
-		body = c.serializeHTTPData(httpData)
+	// The span sets X-Trace-Id, so it starts before the headers are encoded
+	ctx, span := c.startRequestSpan(ctx, config, method, url, headers)
+
+	// Build request
+	request := getBuffer()
+	defer putBuffer(request)
+	bodySize := c.encodeRequest(request, method, url, headers, httpData)
+	if stream != nil {
+		bodySize += int(stream.size)
 	}
 
-	// Retry logic
-	var lastErr error
-	for attempt := 0; attempt <= c.config.Retries; attempt++ {
-		startTime := time.Now()
+	// The timeout bounds every attempt and retry delay together
+	if timeout := config.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-		// Create request
-		req, err := http.NewRequestWithContext(ctx, string(method), url, bytes.NewReader(body))
-		if err != nil {
-			lastErr = &IcapError{Message: "Failed to create request", Err: err}
-			continue
+	releaseRequest, err := c.acquireRequest(ctx)
+	if err != nil {
+		var poolErr *PoolExhaustedError
+		if errors.As(err, &poolErr) {
+			config.Hooks.poolExhausted(PoolExhaustedEvent{Method: method, URL: url, Wait: poolErr.Wait})
 		}
+		c.logger.Warn("Request refused", "method", method, "request_id", requestID, "error", err)
+		endRequestSpan(span, nil, 0, bodySize, 0, err)
+		return nil, c.localError(config, method, url, requestID, httpData, hashes, &IcapError{Message: "Request refused", Err: err})
+	}
+	defer releaseRequest()
 
-		// Set headers
-		for name, value := range headers {
-			req.Header.Set(name, value)
+	// Retry logic
+	var lastErr error
+	var delay, lastAttempt time.Duration
+	attempts := 0
+	requestStart := time.Now()
+	c.retryBudget.request(retryBudgetRatio(config))
+	for attempt := 0; attempt <= config.Retries; attempt++ {
+		if attempt > 0 {
+			if reason := c.skipRetry(ctx, config, delay, lastAttempt); reason != "" {
+				if c.metrics != nil {
+					c.metrics.RetriesSkipped.WithLabelValues(reason).Inc()
+				}
+				c.logger.Warn("Retry skipped", "request_id", requestID, "reason", reason, "attempt", attempt+1)
+				break
+			}
+			if err := sleepContext(ctx, delay); err != nil {
+				lastErr = &IcapError{Message: "Request canceled before retrying", Err: err}
+				break
+			}
+			config.Hooks.retry(RetryEvent{Method: method, URL: url, Attempt: attempt + 1, Err: lastErr})
 		}
+		attempts = attempt + 1
+		startTime := time.Now()
 
 		// Make request
-		resp, err := c.httpClient.Do(req)
+		timings := &Timings{}
+		icapResponse, err := c.transport.roundTrip(icaptrace.WithClientTrace(ctx, timings.clientTrace()), request.Bytes(), stream)
+		lastAttempt = time.Since(startTime)
 		if err != nil {
 			lastErr = &IcapError{Message: "Request failed", Err: err}
-			c.logger.WithError(err).WithField("attempt", attempt+1).Warn("Request failed")
-			continue
-		}
-
-		// Read response
-		responseBody, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			lastErr = &IcapError{Message: "Failed to read response", Err: err}
+			var poolErr *PoolExhaustedError
+			if errors.As(err, &poolErr) {
+				config.Hooks.poolExhausted(PoolExhaustedEvent{Method: method, URL: url, Wait: poolErr.Wait})
+			}
+			delay = backoffDelay(config, attempt+1)
+			c.logger.Warn("Request failed", "request_id", requestID, "error", err, "attempt", attempt+1)
+			if class := errorClass(err); !retryEligible(config, method, class) {
+				c.logger.Debug("Retry not eligible", "request_id", requestID, "method", method, "error_class", class)
+				break
+			}
 			continue
 		}
 
 		responseTime := time.Since(startTime)
+		c.recordServerDate(config, icapResponse, startTime, startTime.Add(responseTime))
 
 		// Update metrics
 		if c.metrics != nil {
-			c.metrics.RequestsTotal.Inc()
-			c.metrics.ResponseTime.Observe(responseTime.Seconds())
-			if resp.StatusCode < 400 {
-				c.metrics.RequestsSuccess.Inc()
-			} else {
-				c.metrics.RequestsFailed.Inc()
-			}
+			c.metrics.observeResponse(method, url, icapResponse.StatusCode, responseTime, requestID)
 		}
 
-		// Parse response
-		icapResponse := c.parseICAPResponse(string(responseBody))
+		config.Hooks.response(ResponseEvent{
+			Method:   method,
+			URL:      url,
+			Response: icapResponse,
+			Attempt:  attempts,
+			Duration: responseTime,
+		})
+
+		icapResponse.RequestID = requestID
+		timings.Attempts = attempts
+		icapResponse.Timings = timings
+		if hashes == nil {
+			hashes = stream.contentHashes()
+		}
+		icapResponse.ContentHashes = hashes
+		if err := c.reassemblePartial(config.Spool, icapResponse, httpData, stream); err != nil {
+			icapResponse.Close()
+			lastErr = &IcapError{Message: "Failed to reassemble partial content", Err: err}
+			c.logger.Warn("Partial content failed", "request_id", requestID, "error", err)
+			break
+		}
+		c.decodeResponseBody(config, icapResponse)
+		c.applyResponseProfile(config, icapResponse)
+		icapResponse.Changes = adaptationReport(original, originalSize, icapResponse)
+		icapResponse.Policy = preview
+		if method == OPTIONS {
+			c.recordCapabilities(icapResponse)
+		}
 
-		c.logger.WithFields(logrus.Fields{
-			"method":       method,
-			"status_code":  icapResponse.StatusCode,
-			"response_time": responseTime,
-			"attempt":      attempt + 1,
-		}).Info("ICAP request completed")
+		c.logger.Info("ICAP request completed",
+			"method", method,
+			"request_id", requestID,
+			"status_code", icapResponse.StatusCode,
+			"response_time", responseTime,
+			"attempt", attempt+1,
+		)
+
+		// A 503 with Retry-After is retried once the server asked for
+		if wait, ok := retryAfter(icapResponse, time.Now()); ok {
+			icapResponse.Close()
+			lastErr = &IcapError{
+				Message:    fmt.Sprintf("ICAP server unavailable: %d %s", icapResponse.StatusCode, icapResponse.Reason),
+				Code:       icapResponse.StatusCode,
+				RetryAfter: wait,
+			}
+			delay = capRetryDelay(config, wait)
+			c.logger.Warn("Server unavailable", "request_id", requestID, "retry_after", wait, "attempt", attempt+1)
+			if !retryEligible(config, method, ErrorClassUnavailable) {
+				c.logger.Debug("Retry not eligible", "request_id", requestID, "method", method, "error_class", ErrorClassUnavailable)
+				break
+			}
+			continue
+		}
+
+		// A 413 is final, the same body would be rejected again
+		if icapResponse.StatusCode == int(RequestEntityTooLarge) {
+			icapResponse.Close()
+			lastErr = entityTooLargeError(icapResponse)
+			break
+		}
 
+		timings.Total = time.Since(requestStart)
+		if flushed := c.scanCache.record(method, url, cacheKey, icapResponse); flushed > 0 {
+			c.logger.Info("Scan cache flushed, the server ISTag changed", "url", url, "istag", headerValue(icapResponse.Headers, "ISTag"), "entries", flushed)
+		}
+		if icapResponse.StatusCode == int(NoContent) && preview == nil {
+			c.cleanFilter.add(method, url, hashes)
+		}
+		endRequestSpan(span, icapResponse, attempts, bodySize, len(icapResponse.Body), nil)
+		c.logAccess(method, url, requestID, httpData, hashes, icapResponse, bodySize, len(icapResponse.Body), time.Since(requestStart), attempts, nil)
+		config.Hooks.verdict(VerdictEvent{
+			Method:   method,
+			URL:      url,
+			Verdict:  verdictOf(original, icapResponse),
+			Response: icapResponse,
+		})
 		return icapResponse, nil
 	}
 
-	// All retries failed
+	// All retries failed or the server rejected the body
+	if hashes == nil {
+		hashes = stream.contentHashes()
+	}
 	if c.metrics != nil {
-		c.metrics.RequestsFailed.Inc()
+		c.metrics.observeFailure(method, url)
 	}
-	return nil, lastErr
+	endRequestSpan(span, nil, attempts, bodySize, 0, lastErr)
+	if decision, ok := failureDecision(ctx, onFailure, lastErr); ok {
+		c.logger.Warn("ICAP server failed, answering under the client policy", "method", method, "request_id", requestID, "on_failure", onFailure, "error", lastErr)
+		if c.metrics != nil {
+			if onFailure == FailOpen {
+				c.metrics.FailOpen.WithLabelValues(string(method)).Inc()
+			} else {
+				c.metrics.FailClosed.WithLabelValues(string(method)).Inc()
+			}
+		}
+		return c.localResponse(config, method, url, requestID, original, hashes, policyResponse(decision), "client policy"), nil
+	}
+	c.logAccess(method, url, requestID, httpData, hashes, nil, bodySize, 0, time.Since(requestStart), attempts, lastErr)
+	config.Hooks.verdict(VerdictEvent{
+		Method:  method,
+		URL:     url,
+		Verdict: VerdictError,
+		Err:     lastErr,
+	})
+	return nil, withRequestID(lastErr, requestID)
 }
 
 // Reqmod sends REQMOD request
 func (c *IcapClient) Reqmod(ctx context.Context, httpRequest *HttpRequest) (*IcapResponse, error) {
-	c.logger.WithField("uri", httpRequest.URI).Info("Sending REQMOD request")
+	c.logger.Info("Sending REQMOD request", "uri", httpRequest.URI)
 
 	response, err := c.makeRequest(ctx, REQMOD, httpRequest)
 	if err != nil {
-		c.logger.WithError(err).Error("REQMOD request failed")
+		c.logger.Error("REQMOD request failed", "error", err)
 		return nil, err
 	}
 
@@ -495,11 +896,11 @@ func (c *IcapClient) Reqmod(ctx context.Context, httpRequest *HttpRequest) (*Ica
 
 // Respmod sends RESPMOD request
 func (c *IcapClient) Respmod(ctx context.Context, httpResponse *HttpResponse) (*IcapResponse, error) {
-	c.logger.WithField("status_code", httpResponse.StatusCode).Info("Sending RESPMOD request")
+	c.logger.Info("Sending RESPMOD request", "status_code", httpResponse.StatusCode)
 
 	response, err := c.makeRequest(ctx, RESPMOD, httpResponse)
 	if err != nil {
-		c.logger.WithError(err).Error("RESPMOD request failed")
+		c.logger.Error("RESPMOD request failed", "error", err)
 		return nil, err
 	}
 
@@ -512,7 +913,40 @@ func (c *IcapClient) Options(ctx context.Context) (*IcapResponse, error) {
 
 	response, err := c.makeRequest(ctx, OPTIONS, nil)
 	if err != nil {
-		c.logger.WithError(err).Error("OPTIONS request failed")
+		c.logger.Error("OPTIONS request failed", "error", err)
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// Do sends a request with any method, including vendor-specific methods
+// such as LOG, encapsulating httpData: an *HttpRequest, an *HttpResponse or
+// nil for none. Custom methods are sent to their path in services.custom,
+// "/" and the lower-cased method by default. Retries, authentication and
+// per-request options apply as for the standard methods.
+func (c *IcapClient) Do(ctx context.Context, method IcapMethod, httpData interface{}) (*IcapResponse, error) {
+	if !validHeaderName(string(method)) {
+		return nil, &IcapError{Message: fmt.Sprintf("invalid ICAP method %q", method)}
+	}
+	switch data := httpData.(type) {
+	case nil:
+	case *HttpRequest:
+		if data == nil {
+			httpData = nil
+		}
+	case *HttpResponse:
+		if data == nil {
+			httpData = nil
+		}
+	default:
+		return nil, &IcapError{Message: fmt.Sprintf("cannot encapsulate %T, expected *HttpRequest or *HttpResponse", httpData)}
+	}
+
+	c.logger.Info("Sending request", "method", method)
+	response, err := c.makeRequest(ctx, method, httpData)
+	if err != nil {
+		c.logger.Error("Request failed", "method", method, "error", err)
 		return nil, err
 	}
 
@@ -551,10 +985,36 @@ func (c *IcapClient) HealthCheck(ctx context.Context) (map[string]interface{}, e
 	}, nil
 }
 
+// recordCapabilities remembers the capabilities advertised by an OPTIONS
+// response
+func (c *IcapClient) recordCapabilities(response *IcapResponse) {
+	c.recordAcceptEncoding(response)
+	c.recordTransferRules(response)
+	c.transport.recordMaxConnections(response.Headers)
+	if response.StatusCode == int(OK) {
+		c.scanCache.recordOptions(response.Headers)
+	}
+}
+
 // Close closes the client
 func (c *IcapClient) Close() {
-	if c.httpClient != nil {
-		c.httpClient.CloseIdleConnections()
+	if c.transport != nil {
+		c.transport.stopPinger()
+		c.transport.closeIdleConnections()
+	}
+	if c.keyLog != nil {
+		c.keyLog.Close()
+	}
+	if c.accessLog != nil {
+		c.accessLog.Close()
+	}
+	if err := c.cleanFilter.save(); err != nil {
+		c.logger.Error("Clean filter not saved", "path", c.cleanFilter.path, "error", err)
+	}
+	c.policyWatcher.close()
+	c.scanCache.stopSaver()
+	if err := c.scanCache.save(); err != nil {
+		c.logger.Error("Scan cache not saved", "path", c.scanCache.path, "error", err)
 	}
 	c.logger.Info("ICAP client closed")
 }
@@ -566,7 +1026,7 @@ func LoadConfig(configPath string) (*IcapConfig, error) {
 
 	// Set defaults
 	viper.SetDefault("host", "127.0.0.1")
-	viper.SetDefault("port", 1344)
+	viper.SetDefault("port", DefaultPort)
 	viper.SetDefault("timeout", "30s")
 	viper.SetDefault("retries", 3)
 	viper.SetDefault("retry_delay", "1s")
@@ -583,126 +1043,17 @@ func LoadConfig(configPath string) (*IcapConfig, error) {
 	}
 
 	var config IcapConfig
-	if err := viper.Unmarshal(&config); err != nil {
+	if err := viper.Unmarshal(&config, func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = "yaml"
+	}); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
-
-	return &config, nil
-}
-
-// main function and CLI
-func main() {
-	var rootCmd = &cobra.Command{
-		Use:   "icap-client",
-		Short: "G3ICAP Go Client",
-		Long:  "A comprehensive Go client for interacting with G3ICAP servers",
+	if err := config.ResolveSecretFiles(); err != nil {
+		return nil, err
 	}
-
-	var configPath string
-	var host string
-	var port int
-	var method string
-	var verbose bool
-
-	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "Configuration file path")
-	rootCmd.PersistentFlags().StringVar(&host, "host", "127.0.0.1", "ICAP server host")
-	rootCmd.PersistentFlags().IntVar(&port, "port", 1344, "ICAP server port")
-	rootCmd.PersistentFlags().StringVar(&method, "method", "options", "ICAP method (reqmod, respmod, options)")
-	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "Verbose logging")
-
-	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
-		// Load configuration
-		var config *IcapConfig
-		var err error
-
-		if configPath != "" {
-			config, err = LoadConfig(configPath)
-			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
-			}
-		} else {
-			config = &IcapConfig{
-				Host:           host,
-				Port:           port,
-				Timeout:        30 * time.Second,
-				Retries:        3,
-				RetryDelay:     time.Second,
-				MaxRetryDelay:  60 * time.Second,
-				BackoffFactor:  2.0,
-				ConnectionPoolSize: 10,
-				KeepAlive:      true,
-				VerifySSL:      true,
-				LoggingLevel:   "INFO",
-				MetricsEnabled: true,
-			}
-		}
-
-		if verbose {
-			config.LoggingLevel = "DEBUG"
-		}
-
-		// Create client
-		client := NewIcapClient(config)
-		defer client.Close()
-
-		ctx := context.Background()
-
-		// Execute method
-		switch method {
-		case "options":
-			response, err := client.Options(ctx)
-			if err != nil {
-				return fmt.Errorf("OPTIONS request failed: %w", err)
-			}
-			fmt.Printf("OPTIONS Response: %d %s\n", response.StatusCode, response.Reason)
-			fmt.Printf("Headers: %+v\n", response.Headers)
-
-		case "reqmod":
-			httpRequest := &HttpRequest{
-				Method:  "GET",
-				URI:     "/",
-				Version: "HTTP/1.1",
-				Headers: map[string]string{
-					"Host":       "example.com",
-					"User-Agent": "Go-Client",
-				},
-			}
-
-			response, err := client.Reqmod(ctx, httpRequest)
-			if err != nil {
-				return fmt.Errorf("REQMOD request failed: %w", err)
-			}
-			fmt.Printf("REQMOD Response: %d %s\n", response.StatusCode, response.Reason)
-
-		case "respmod":
-			httpResponse := &HttpResponse{
-				Version:    "HTTP/1.1",
-				StatusCode: 200,
-				Reason:     "OK",
-				Headers: map[string]string{
-					"Content-Type": "text/html",
-				},
-				Body: []byte("<html><body>Hello World</body></html>"),
-			}
-
-			response, err := client.Respmod(ctx, httpResponse)
-			if err != nil {
-				return fmt.Errorf("RESPMOD request failed: %w", err)
-			}
-			fmt.Printf("RESPMOD Response: %d %s\n", response.StatusCode, response.Reason)
-		}
-
-		// Health check
-		health, err := client.HealthCheck(ctx)
-		if err != nil {
-			return fmt.Errorf("health check failed: %w", err)
-		}
-		fmt.Printf("Health Check: %+v\n", health)
-
-		return nil
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(rootCmd.OutOrStderr(), "Error: %v\n", err)
-	}
+	return &config, nil
 }
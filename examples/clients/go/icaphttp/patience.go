@@ -0,0 +1,222 @@
+package icaphttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// patienceParam is the query parameter identifying the pending scan of a
+// patience page reload
+const patienceParam = "icap-patience"
+
+// defaultPatienceRefresh is the PatienceRefresh used when unset
+const defaultPatienceRefresh = 2 * time.Second
+
+// patienceTTL is how long a scanned response waits for the reload that
+// collects it before it is dropped
+const patienceTTL = 10 * time.Minute
+
+// defaultPatiencePage is the patience page used when PatiencePage is empty
+const defaultPatiencePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}};url={{.URL}}">
+<title>Scanning in progress</title>
+</head>
+<body>
+<h1>Scanning in progress</h1>
+<p>{{.Target}} is being scanned for threats ({{.Elapsed}} so far). The download starts once the scan completes.</p>
+<p><a href="{{.URL}}">Check again</a></p>
+</body>
+</html>
+`
+
+// PatienceData is the data of the patience page template
+type PatienceData struct {
+	// URL reloads the page, delivering the response once scanned
+	URL string
+	// Target is the URL being downloaded
+	Target string
+	// Refresh is the number of seconds between reloads
+	Refresh int
+	// Elapsed is the time spent scanning, rounded to the second
+	Elapsed time.Duration
+}
+
+// patienceScan is a RESPMOD scan outlasting PatienceAfter
+type patienceScan struct {
+	started time.Time
+	done    chan struct{}
+	// resp and err are the outcome of the scan, set when done is closed
+	resp *http.Response
+	err  error
+}
+
+// patienceScans holds the pending scans by token
+type patienceScans struct {
+	mu    sync.Mutex
+	scans map[string]*patienceScan
+}
+
+// add stores scan under a new token until patienceTTL elapses
+func (s *patienceScans) add(scan *patienceScan) string {
+	var b [16]byte
+	rand.Read(b[:])
+	token := hex.EncodeToString(b[:])
+
+	s.mu.Lock()
+	if s.scans == nil {
+		s.scans = map[string]*patienceScan{}
+	}
+	s.scans[token] = scan
+	s.mu.Unlock()
+
+	time.AfterFunc(patienceTTL, func() {
+		if s.remove(token) != nil {
+			<-scan.done
+			if scan.resp != nil {
+				scan.resp.Body.Close()
+			}
+		}
+	})
+	return token
+}
+
+// get returns the scan of token, or nil
+func (s *patienceScans) get(token string) *patienceScan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scans[token]
+}
+
+// remove removes and returns the scan of token, or nil
+func (s *patienceScans) remove(token string) *patienceScan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scan := s.scans[token]
+	delete(s.scans, token)
+	return scan
+}
+
+// parsePatiencePage parses page, or the default page when it is empty
+func parsePatiencePage(page string) (*template.Template, error) {
+	if page == "" {
+		page = defaultPatiencePage
+	}
+	return template.New("patience").Parse(page)
+}
+
+// scanWithPatience scans resp, the response to req holding data, answering
+// with a patience page when the scan outlasts PatienceAfter. The scan then
+// goes on and its outcome is delivered on a reload of the page.
+func (t *Transport) scanWithPatience(req *http.Request, resp *http.Response, data []byte) (*http.Response, error) {
+	scan := &patienceScan{started: time.Now(), done: make(chan struct{})}
+	go func() {
+		scan.resp, scan.err = t.scanResponse(context.WithoutCancel(req.Context()), req, resp, data)
+		close(scan.done)
+	}()
+
+	timer := time.NewTimer(t.policy.PatienceAfter)
+	defer timer.Stop()
+	select {
+	case <-scan.done:
+		return scan.resp, scan.err
+	case <-timer.C:
+	}
+
+	token := t.patience.add(scan)
+	t.client.Logger().Info("Scan in progress, answering with a patience page", "url", req.URL.String())
+	return t.patienceResponse(req, scan, token)
+}
+
+// resumePatience answers the reload of a patience page, with the scanned
+// response once the scan finished or the page again, and reports whether
+// req was such a reload
+func (t *Transport) resumePatience(req *http.Request) (*http.Response, bool, error) {
+	token := req.URL.Query().Get(patienceParam)
+	if token == "" {
+		return nil, false, nil
+	}
+	scan := t.patience.get(token)
+	if scan == nil {
+		return nil, false, nil
+	}
+
+	select {
+	case <-scan.done:
+	default:
+		resp, err := t.patienceResponse(req, scan, token)
+		return resp, true, err
+	}
+	if t.patience.remove(token) == nil {
+		// Another reload collected the response
+		return nil, false, nil
+	}
+	if scan.err != nil {
+		return nil, true, scan.err
+	}
+	scan.resp.Request = req
+	return scan.resp, true, nil
+}
+
+// withoutPatienceParam returns req without the patience query parameter,
+// so that an expired reload fetches the URL again
+func withoutPatienceParam(req *http.Request) *http.Request {
+	query := req.URL.Query()
+	if !query.Has(patienceParam) {
+		return req
+	}
+	query.Del(patienceParam)
+	req = req.Clone(req.Context())
+	req.URL.RawQuery = query.Encode()
+	return req
+}
+
+// patienceResponse returns the patience page of scan, reloading req with
+// token
+func (t *Transport) patienceResponse(req *http.Request, scan *patienceScan, token string) (*http.Response, error) {
+	refresh := t.policy.PatienceRefresh
+	if refresh <= 0 {
+		refresh = defaultPatienceRefresh
+	}
+	target := withoutPatienceParam(req).URL
+	reload := *target
+	query := reload.Query()
+	query.Set(patienceParam, token)
+	reload.RawQuery = query.Encode()
+
+	var page bytes.Buffer
+	err := t.patiencePage.Execute(&page, PatienceData{
+		URL:     reload.String(),
+		Target:  target.String(),
+		Refresh: int(max(refresh.Round(time.Second), time.Second) / time.Second),
+		Elapsed: time.Since(scan.started).Round(time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   {"text/html; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(page.Len())},
+			"Cache-Control":  {"no-store"},
+		},
+		Body:          io.NopCloser(&page),
+		ContentLength: int64(page.Len()),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,109 @@
+package icaphttp
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestTransport_Patience tests answering slow scans with a patience page and
+// delivering the response on a reload
+func TestTransport_Patience(t *testing.T) {
+	release := make(chan struct{})
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if strings.Contains(string(r.Body), "slow") {
+			<-release
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+	var once sync.Once
+	releaseScan := func() { once.Do(func() { close(release) }) }
+	defer releaseScan()
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{Host: host, Port: port, Timeout: 5 * time.Second, LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "file "+r.URL.Path)
+	}))
+	defer origin.Close()
+	httpClient := &http.Client{Transport: NewTransport(nil, client, Policy{
+		Respmod:       true,
+		PatienceAfter: 50 * time.Millisecond,
+		PatiencePage:  `{{.Refresh}} {{.URL}}`,
+	})}
+
+	resp, err := httpClient.Get(origin.URL + "/fast")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "file /fast" {
+		t.Errorf("Expected the file of a fast scan, got %q", body)
+	}
+
+	resp, err = httpClient.Get(origin.URL + "/slow?v=1")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	refresh, reload, _ := strings.Cut(html.UnescapeString(string(body)), " ")
+	if refresh != "2" || !strings.Contains(reload, "icap-patience=") || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("Expected a patience page reloading every 2s, got %q", body)
+	}
+	reloadURL, err := url.Parse(reload)
+	if err != nil || reloadURL.Query().Get("v") != "1" {
+		t.Fatalf("Expected the reload to keep the query, got %q", reload)
+	}
+
+	resp, err = httpClient.Get(reload)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(string(body), "2 ") {
+		t.Errorf("Expected the patience page while scanning, got %q", body)
+	}
+
+	releaseScan()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err = httpClient.Get(reload)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) == "file /slow" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if string(body) != "file /slow" {
+		t.Fatalf("Expected the file once scanned, got %q", body)
+	}
+
+	// Once collected, the token is unknown and the URL is fetched again
+	resp, err = httpClient.Get(reload)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "file /slow" {
+		t.Errorf("Expected the file to be fetched again, got %q", body)
+	}
+}
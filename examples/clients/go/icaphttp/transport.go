@@ -0,0 +1,298 @@
+// Package icaphttp adapts net/http traffic through an ICAP server. NewTransport
+// wraps an http.RoundTripper so that requests go through REQMOD before they
+// are forwarded and responses go through RESPMOD before they are returned.
+package icaphttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// Policy selects which messages are adapted and how ICAP failures are handled
+type Policy struct {
+	// Reqmod sends requests through REQMOD before they are forwarded
+	Reqmod bool
+	// Respmod sends responses through RESPMOD before they are returned
+	Respmod bool
+	// FailOpen passes messages through unadapted when the ICAP server
+	// cannot be reached, instead of failing the round trip
+	FailOpen bool
+	// MaxBodySize is the largest body read into memory for adaptation.
+	// Messages with larger bodies are passed through unadapted. Zero
+	// adapts every body.
+	MaxBodySize int64
+	// Trickle, when positive, returns responses whose body is larger than
+	// it, or of unknown length, before RESPMOD completes, so that clients
+	// downloading large files do not time out. The body is forwarded as
+	// it arrives but for its last TrickleHoldBack bytes, 64 KiB if zero,
+	// released once the server allowed the response. Reads fail with
+	// ErrTrickleBlocked when the server blocks or adapts it instead.
+	// Trickled bodies are scanned whatever their size, spooled to disk
+	// beyond Trickle bytes in the spool directory of the client. The
+	// origin is read at the pace of the client, a bounded window ahead of
+	// it.
+	Trickle         int64
+	TrickleHoldBack int64
+	// PatienceAfter, when positive, answers GET requests whose response
+	// is still being scanned after it with a patience page, as secure web
+	// gateways do. The scan goes on and the page reloads itself every
+	// PatienceRefresh, 2s if zero, until the response is delivered.
+	// PatiencePage is the html/template of the page, executed with
+	// PatienceData, a built-in page if empty.
+	PatienceAfter   time.Duration
+	PatienceRefresh time.Duration
+	PatiencePage    string
+}
+
+// Transport is an http.RoundTripper adapting traffic through an ICAP server
+type Transport struct {
+	base   http.RoundTripper
+	client *icapclient.IcapClient
+	policy Policy
+
+	patiencePage *template.Template
+	patience     patienceScans
+}
+
+// NewTransport returns a transport forwarding requests with base, or
+// http.DefaultTransport when base is nil, after adapting them with client
+// according to policy. Blocked requests and responses are answered with the
+// block page returned by the ICAP server. An invalid PatiencePage is
+// logged and replaced by the built-in page.
+func NewTransport(base http.RoundTripper, client *icapclient.IcapClient, policy Policy) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &Transport{base: base, client: client, policy: policy}
+	if policy.PatienceAfter > 0 {
+		page, err := parsePatiencePage(policy.PatiencePage)
+		if err != nil {
+			client.Logger().Warn("Invalid patience page, using the built-in page", "error", err)
+			page, _ = parsePatiencePage("")
+		}
+		t.patiencePage = page
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.policy.PatienceAfter > 0 {
+		if resp, ok, err := t.resumePatience(req); ok {
+			return resp, err
+		}
+		req = withoutPatienceParam(req)
+	}
+	if t.policy.Reqmod {
+		adapted, blocked, err := t.adaptRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		if blocked != nil {
+			return blocked, nil
+		}
+		req = adapted
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !t.policy.Respmod {
+		return resp, err
+	}
+	return t.adaptResponse(req, resp)
+}
+
+// adaptRequest sends req through REQMOD. It returns the request to forward,
+// or the response to answer with when the server blocked the request.
+func (t *Transport) adaptRequest(req *http.Request) (*http.Request, *http.Response, error) {
+	data, passthrough, err := t.readBody(req.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	req = req.Clone(req.Context())
+	if passthrough != nil {
+		req.Body = passthrough
+		return req, nil, nil
+	}
+	req.Body = newBody(data)
+
+	verdict, response, err := t.client.ScanRequest(req.Context(), &icapclient.HttpRequest{
+		Method:  req.Method,
+		URI:     req.URL.String(),
+		Version: req.Proto,
+		Headers: flattenHeader(req.Header, req.Host),
+		Body:    data,
+	})
+	switch verdict {
+	case icapclient.VerdictError:
+		return t.failRequest(req, scanError(response, err))
+	case icapclient.VerdictAllowed:
+		response.Close()
+		return req, nil, nil
+	}
+
+	if response.HttpResponse != nil {
+		return nil, newResponse(req, response), nil
+	}
+	if verdict == icapclient.VerdictBlocked || response.HttpRequest == nil {
+		response.Close()
+		return nil, forbidden(req), nil
+	}
+	err = response.ApplyToRequest(req)
+	response.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("icaphttp: %w", err)
+	}
+	return req, nil, nil
+}
+
+// failRequest forwards req unadapted when the policy fails open
+func (t *Transport) failRequest(req *http.Request, err error) (*http.Request, *http.Response, error) {
+	if t.policy.FailOpen {
+		t.client.Logger().Warn("REQMOD failed, forwarding unadapted", "url", req.URL.String(), "error", err)
+		return req, nil, nil
+	}
+	return nil, nil, fmt.Errorf("icaphttp: REQMOD failed: %w", err)
+}
+
+// adaptResponse sends resp, the response to req, through RESPMOD and
+// returns the response to hand to the caller
+func (t *Transport) adaptResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if t.trickles(resp) {
+		return t.trickleResponse(req, resp), nil
+	}
+	data, passthrough, err := t.readBody(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if passthrough != nil {
+		resp.Body = passthrough
+		return resp, nil
+	}
+	resp.Body = newBody(data)
+	if t.policy.PatienceAfter > 0 && req.Method == http.MethodGet {
+		return t.scanWithPatience(req, resp, data)
+	}
+	return t.scanResponse(req.Context(), req, resp, data)
+}
+
+// scanResponse sends resp, the response to req holding data, through
+// RESPMOD with ctx and returns the response to hand to the caller
+func (t *Transport) scanResponse(ctx context.Context, req *http.Request, resp *http.Response, data []byte) (*http.Response, error) {
+	verdict, response, err := t.client.ScanResponse(ctx, &icapclient.HttpResponse{
+		Version:    resp.Proto,
+		StatusCode: resp.StatusCode,
+		Reason:     strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		Headers:    flattenHeader(resp.Header, ""),
+		Body:       data,
+	})
+	switch verdict {
+	case icapclient.VerdictError:
+		err = scanError(response, err)
+		if t.policy.FailOpen {
+			t.client.Logger().Warn("RESPMOD failed, returning unadapted", "url", req.URL.String(), "error", err)
+			return resp, nil
+		}
+		return nil, fmt.Errorf("icaphttp: RESPMOD failed: %w", err)
+	case icapclient.VerdictAllowed:
+		response.Close()
+		return resp, nil
+	}
+
+	if response.HttpResponse == nil {
+		response.Close()
+		return forbidden(req), nil
+	}
+	response.ApplyToResponse(resp)
+	return resp, nil
+}
+
+// scanError returns the error of a failed scan, describing ICAP error
+// responses that the client returned without an error
+func scanError(response *icapclient.IcapResponse, err error) error {
+	if err == nil && response != nil {
+		err = fmt.Errorf("ICAP server answered %d %s", response.StatusCode, response.Reason)
+	}
+	return err
+}
+
+// newBody returns a body reading data
+func newBody(data []byte) io.ReadCloser {
+	if len(data) == 0 {
+		return http.NoBody
+	}
+	return io.NopCloser(bytes.NewReader(data))
+}
+
+// readBody reads body into memory and closes it. A body over MaxBodySize is
+// not adapted, and is returned as passthrough, yielding the same bytes,
+// instead.
+func (t *Transport) readBody(body io.ReadCloser) (data []byte, passthrough io.ReadCloser, err error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil, nil
+	}
+
+	reader := io.Reader(body)
+	if t.policy.MaxBodySize > 0 {
+		reader = io.LimitReader(body, t.policy.MaxBodySize+1)
+	}
+	data, err = io.ReadAll(reader)
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	if t.policy.MaxBodySize > 0 && int64(len(data)) > t.policy.MaxBodySize {
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}, nil
+	}
+	body.Close()
+	return data, nil, nil
+}
+
+// flattenHeader converts header to the one-value-per-name form of the
+// client, joining repeated values with commas
+func flattenHeader(header http.Header, host string) map[string]string {
+	headers := make(map[string]string, len(header)+1)
+	for name, values := range header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	if host != "" {
+		headers["Host"] = host
+	}
+	return headers
+}
+
+// newResponse converts the block page answering req to an http.Response.
+// Its body releases the ICAP response when closed.
+func newResponse(req *http.Request, response *icapclient.IcapResponse) *http.Response {
+	resp := &http.Response{Request: req}
+	response.ApplyToResponse(resp)
+	return resp
+}
+
+// forbidden answers req with a plain 403 when the server blocked a message
+// without sending a block page
+func forbidden(req *http.Request) *http.Response {
+	const body = "Blocked by ICAP policy\n"
+	return &http.Response{
+		Status:        "403 Forbidden",
+		StatusCode:    http.StatusForbidden,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "Content-Length": {strconv.Itoa(len(body))}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
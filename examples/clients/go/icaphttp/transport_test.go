@@ -0,0 +1,141 @@
+package icaphttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// adaptingHandler blocks requests to /blocked, rewrites requests to /rewrite
+// and blocks responses containing "virus"
+func adaptingHandler(w icaptest.ResponseWriter, r *icaptest.Request) {
+	switch {
+	case r.Method == "REQMOD" && strings.HasPrefix(r.Request.URL.Path, "/blocked"):
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/html"}}}, true)
+		w.Write([]byte("<h1>Blocked</h1>"))
+	case r.Method == "REQMOD" && strings.HasPrefix(r.Request.URL.Path, "/rewrite"):
+		rewritten := r.Request.Clone(r.Request.Context())
+		rewritten.URL = &url.URL{Path: "/rewritten"}
+		rewritten.RequestURI = "/rewritten"
+		rewritten.Header.Set("X-Adapted", "true")
+		w.WriteHeader(200, rewritten, false)
+	case r.Method == "RESPMOD" && strings.Contains(string(r.Body), "virus"):
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/plain"}}}, true)
+		w.Write([]byte("infected"))
+	default:
+		w.WriteHeader(204, nil, false)
+	}
+}
+
+// newTestTransport returns an HTTP client adapting traffic through an
+// icaptest server, and an origin echoing the request path and an X-Adapted
+// header
+func newTestTransport(t *testing.T, policy Policy) (*http.Client, *httptest.Server) {
+	t.Helper()
+
+	server := icaptest.NewServer(icaptest.HandlerFunc(adaptingHandler))
+	t.Cleanup(server.Close)
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		KeepAlive:    true,
+		LoggingLevel: "ERROR",
+	})
+	t.Cleanup(client.Close)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path+" "+r.Header.Get("X-Adapted")+" "+r.URL.Query().Get("body"))
+	}))
+	t.Cleanup(origin.Close)
+
+	return &http.Client{Transport: NewTransport(nil, client, policy)}, origin
+}
+
+// TestTransport tests REQMOD and RESPMOD adaptation of HTTP round trips
+func TestTransport(t *testing.T) {
+	httpClient, origin := newTestTransport(t, Policy{Reqmod: true, Respmod: true})
+
+	tests := []struct {
+		name         string
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{"Allowed", "/clean", 200, "/clean  "},
+		{"Blocked request", "/blocked", 403, "<h1>Blocked</h1>"},
+		{"Rewritten request", "/rewrite", 200, "/rewritten true "},
+		{"Blocked response", "/clean?body=virus", 403, "infected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := httpClient.Get(origin.URL + tt.path)
+			if err != nil {
+				t.Fatalf("GET failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Errorf("Expected status %d, got %d", tt.expectedCode, resp.StatusCode)
+			}
+			if string(body) != tt.expectedBody {
+				t.Errorf("Expected body %q, got %q", tt.expectedBody, body)
+			}
+		})
+	}
+}
+
+// TestTransport_MaxBodySize tests that large bodies bypass adaptation
+func TestTransport_MaxBodySize(t *testing.T) {
+	httpClient, origin := newTestTransport(t, Policy{Respmod: true, MaxBodySize: 4})
+
+	resp, err := httpClient.Get(origin.URL + "/clean?body=virus")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 200 || string(body) != "/clean  virus" {
+		t.Errorf("Expected the unadapted response, got %d %q", resp.StatusCode, body)
+	}
+}
+
+// TestTransport_FailOpen tests the behaviour when the ICAP server is down
+func TestTransport_FailOpen(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "origin")
+	}))
+	defer origin.Close()
+
+	server := icaptest.NewServer(icaptest.HandlerFunc(adaptingHandler))
+	host, port := server.HostPort()
+	server.Close()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{Host: host, Port: port, Timeout: time.Second, LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	closed := &http.Client{Transport: NewTransport(nil, client, Policy{Reqmod: true})}
+	if _, err := closed.Get(origin.URL); err == nil || !strings.Contains(err.Error(), "REQMOD failed") {
+		t.Errorf("Expected REQMOD failure, got %v", err)
+	}
+
+	open := &http.Client{Transport: NewTransport(nil, client, Policy{Reqmod: true, FailOpen: true})}
+	resp, err := open.Get(origin.URL)
+	if err != nil {
+		t.Fatalf("Expected fail-open GET to succeed, got %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "origin" {
+		t.Errorf("Expected origin body, got %q", body)
+	}
+}
@@ -0,0 +1,180 @@
+package icaphttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// defaultTrickleHoldBack is the TrickleHoldBack used when unset
+const defaultTrickleHoldBack = 64 << 10
+
+// trickleWindow is how far the origin body is read ahead of the client
+// beyond the held back bytes
+const trickleWindow = 64 << 10
+
+// ErrTrickleBlocked is returned by the body of a trickled response that the
+// ICAP server blocked or adapted once its beginning had been forwarded
+var ErrTrickleBlocked = errors.New("icaphttp: response blocked after trickling")
+
+// errBodyClosed is returned by reads from a closed trickled body
+var errBodyClosed = errors.New("icaphttp: read on closed body")
+
+// trickles reports whether resp is trickled: its body is over the Trickle
+// threshold or of unknown length
+func (t *Transport) trickles(resp *http.Response) bool {
+	if t.policy.Trickle <= 0 || resp.Body == nil || resp.Body == http.NoBody {
+		return false
+	}
+	return resp.ContentLength < 0 || resp.ContentLength > t.policy.Trickle
+}
+
+// trickleResponse returns resp with a body forwarding the origin body while
+// it is sent through RESPMOD, holding back its tail until the verdict
+func (t *Transport) trickleResponse(req *http.Request, resp *http.Response) *http.Response {
+	holdBack := t.policy.TrickleHoldBack
+	if holdBack <= 0 {
+		holdBack = defaultTrickleHoldBack
+	}
+	origin := resp.Body
+	body := newTrickleBody(origin, holdBack)
+	resp.Body = body
+
+	message := &icapclient.HttpResponse{
+		Version:    resp.Proto,
+		StatusCode: resp.StatusCode,
+		Reason:     strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		Headers:    flattenHeader(resp.Header, ""),
+		BodyReader: io.TeeReader(origin, body),
+	}
+	// The origin body is not seekable, so beyond Trickle bytes it is
+	// spooled to disk rather than read into memory before it is sent
+	opts := icapclient.ContextRequestOptions(req.Context())
+	opts.SpoolThreshold = t.policy.Trickle
+	ctx := icapclient.WithRequestOptions(req.Context(), opts)
+	go func() {
+		defer origin.Close()
+		verdict, response, err := t.client.ScanResponse(ctx, message)
+		if response != nil {
+			response.Close()
+		}
+		switch verdict {
+		case icapclient.VerdictError:
+			err = scanError(response, err)
+			if !t.policy.FailOpen {
+				body.finish(fmt.Errorf("icaphttp: RESPMOD failed: %w", err))
+				return
+			}
+			t.client.Logger().Warn("RESPMOD failed, releasing the trickled response", "url", req.URL.String(), "error", err)
+		case icapclient.VerdictAllowed:
+		default:
+			t.client.Logger().Warn("Trickled response cut short", "url", req.URL.String(), "verdict", verdict)
+			body.finish(ErrTrickleBlocked)
+			return
+		}
+		// The client may not have read the whole body, e.g. when its
+		// policy bypassed it
+		if _, err := io.Copy(body, origin); err != nil {
+			body.finish(err)
+			return
+		}
+		body.finish(nil)
+	}()
+	return resp
+}
+
+// trickleBody is the body of a trickled response. Bytes written to it are
+// readable once more than holdBack bytes follow them, and the tail once
+// the scan finished. Writes block while holdBack plus trickleWindow bytes
+// are pending, so the origin is read at the pace of the client.
+type trickleBody struct {
+	origin   io.Closer
+	holdBack int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	// released is set once the whole body may be read, err once reads
+	// fail
+	released bool
+	err      error
+	closed   bool
+}
+
+// newTrickleBody creates a body holding back holdBack bytes of origin
+func newTrickleBody(origin io.Closer, holdBack int64) *trickleBody {
+	b := &trickleBody{origin: origin, holdBack: int(holdBack)}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Write appends p to the body once the client read enough of it, dropping
+// p once the body is closed or failed
+func (b *trickleBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.closed && b.err == nil && len(b.pending) >= b.holdBack+trickleWindow {
+		b.cond.Wait()
+	}
+	if !b.closed && b.err == nil {
+		b.pending = append(b.pending, p...)
+		b.cond.Broadcast()
+	}
+	return len(p), nil
+}
+
+// Read reads the bytes that are not held back, waiting for more
+func (b *trickleBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		switch {
+		case b.closed:
+			return 0, errBodyClosed
+		case b.err != nil:
+			return 0, b.err
+		}
+		available := len(b.pending)
+		if !b.released {
+			available -= b.holdBack
+		}
+		if available > 0 {
+			n := copy(p, b.pending[:available])
+			b.pending = b.pending[n:]
+			b.cond.Broadcast()
+			return n, nil
+		}
+		if b.released {
+			return 0, io.EOF
+		}
+		b.cond.Wait()
+	}
+}
+
+// finish releases the tail of the body, or fails its reads with err
+func (b *trickleBody) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.err = err
+	} else {
+		b.released = true
+	}
+	b.cond.Broadcast()
+}
+
+// Close closes the body and the origin body, stopping the scan
+func (b *trickleBody) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.pending = nil
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	return b.origin.Close()
+}
@@ -0,0 +1,151 @@
+package icaphttp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestTrickleBody tests holding back the tail of a body until the verdict
+func TestTrickleBody(t *testing.T) {
+	body := newTrickleBody(io.NopCloser(nil), 4)
+	body.Write([]byte("0123456789"))
+	buf := make([]byte, 32)
+	if n, err := body.Read(buf); err != nil || string(buf[:n]) != "012345" {
+		t.Errorf("Expected the bytes before the held back tail, got %q %v", buf[:n], err)
+	}
+	body.finish(nil)
+	if data, err := io.ReadAll(body); err != nil || string(data) != "6789" {
+		t.Errorf("Expected the released tail, got %q %v", data, err)
+	}
+
+	body = newTrickleBody(io.NopCloser(nil), 4)
+	body.Write([]byte("0123456789"))
+	body.finish(ErrTrickleBlocked)
+	if data, err := io.ReadAll(body); !errors.Is(err, ErrTrickleBlocked) || len(data) != 0 {
+		t.Errorf("Expected ErrTrickleBlocked without the pending bytes, got %q %v", data, err)
+	}
+}
+
+// TestTrickleBody_Backpressure tests that writes wait for the client once
+// the held back bytes and the window are pending
+func TestTrickleBody_Backpressure(t *testing.T) {
+	body := newTrickleBody(io.NopCloser(nil), 4)
+	body.Write(make([]byte, 4+trickleWindow))
+	written := make(chan struct{})
+	go func() {
+		body.Write([]byte("x"))
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("Expected the write to wait for the client")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n, err := body.Read(make([]byte, 1024)); err != nil || n != 1024 {
+		t.Fatalf("Expected 1024 bytes, got %d %v", n, err)
+	}
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the write to resume once the client read")
+	}
+
+	body.Close()
+	body.Write(make([]byte, 4+trickleWindow))
+	body.Write([]byte("x"))
+}
+
+// TestTransport_Trickle tests forwarding the beginning of large responses
+// while they are scanned
+func TestTransport_Trickle(t *testing.T) {
+	httpClient, _ := newTestTransport(t, Policy{Respmod: true, Trickle: 8, TrickleHoldBack: 4})
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "0123456789")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, r.URL.Query().Get("tail"))
+	}))
+	defer origin.Close()
+
+	resp, err := httpClient.Get(origin.URL + "/download?tail=clean")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "012345" {
+		t.Fatalf("Expected the beginning before the origin finished, got %q %v", buf, err)
+	}
+	close(release)
+	if rest, err := io.ReadAll(resp.Body); err != nil || string(rest) != "6789clean" {
+		t.Errorf("Expected the rest once allowed, got %q %v", rest, err)
+	}
+
+	resp, err = httpClient.Get(origin.URL + "/download?tail=virus")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if data, err := io.ReadAll(resp.Body); !errors.Is(err, ErrTrickleBlocked) || len(data) > 11 {
+		t.Errorf("Expected the download to be cut short with the tail held back, got %q %v", data, err)
+	}
+}
+
+// TestTransport_TrickleSpool tests that trickled bodies are spooled to disk
+// rather than read into memory before they are sent, without a spool
+// configured on the client
+func TestTransport_TrickleSpool(t *testing.T) {
+	spoolDir := t.TempDir()
+	var spooled atomic.Int64
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		files, _ := filepath.Glob(filepath.Join(spoolDir, "icap-spool-*"))
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				spooled.Store(info.Size())
+			}
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		LoggingLevel: "ERROR",
+		Spool:        icapclient.SpoolConfig{Directory: spoolDir},
+	})
+	defer client.Close()
+
+	body := strings.Repeat("x", 1<<20)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer origin.Close()
+
+	httpClient := &http.Client{Transport: NewTransport(nil, client, Policy{Respmod: true, Trickle: 64 << 10})}
+	resp, err := httpClient.Get(origin.URL + "/download")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if data, err := io.ReadAll(resp.Body); err != nil || len(data) != len(body) {
+		t.Fatalf("Expected the whole body, got %d bytes %v", len(data), err)
+	}
+	if n := spooled.Load(); n != int64(len(body)) {
+		t.Errorf("Expected a %d byte spool file while scanning, got %d", len(body), n)
+	}
+}
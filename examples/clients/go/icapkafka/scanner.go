@@ -0,0 +1,160 @@
+// Package icapkafka scans Kafka messages through an ICAP server. A Scanner
+// consumes messages from a topic, sends each payload through RESPMOD and
+// publishes the verdict to an output topic, committing the offset of a
+// message only once its verdict has been published.
+package icapkafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/segmentio/kafka-go"
+)
+
+// Reader is the consuming side of a Scanner, implemented by *kafka.Reader
+// with a GroupID set
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Writer is the publishing side of a Scanner, implemented by *kafka.Writer
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Result is the verdict published for a scanned message, encoded as JSON
+type Result struct {
+	Topic      string                 `json:"topic"`
+	Partition  int                    `json:"partition"`
+	Offset     int64                  `json:"offset"`
+	Key        string                 `json:"key,omitempty"`
+	Verdict    string                 `json:"verdict"`
+	IcapStatus int                    `json:"icap_status,omitempty"`
+	RequestID  string                 `json:"request_id,omitempty"`
+	Infection  *icapclient.Infection  `json:"infection,omitempty"`
+	Violations []icapclient.Violation `json:"violations,omitempty"`
+	ScannedAt  time.Time              `json:"scanned_at"`
+}
+
+// Scanner scans the messages of a Reader and publishes their verdicts with
+// a Writer
+type Scanner struct {
+	client *icapclient.IcapClient
+	reader Reader
+	writer Writer
+
+	// ContentType is sent for payloads without a Content-Type message
+	// header. It defaults to application/octet-stream.
+	ContentType string
+}
+
+// NewScanner returns a scanner consuming reader and publishing to writer,
+// scanning with client
+func NewScanner(client *icapclient.IcapClient, reader Reader, writer Writer) *Scanner {
+	return &Scanner{client: client, reader: reader, writer: writer, ContentType: "application/octet-stream"}
+}
+
+// Run scans messages until ctx is done or a message cannot be scanned. The
+// offset of a message is committed after its verdict is published, so a
+// message whose scan failed is consumed again when the scanner restarts.
+// ICAP error responses are a verdict, published and committed like others.
+func (s *Scanner) Run(ctx context.Context) error {
+	for {
+		msg, err := s.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to fetch message: %w", err)
+		}
+
+		if err := s.Process(ctx, msg); err != nil {
+			if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Process scans msg, publishes its verdict and commits its offset
+func (s *Scanner) Process(ctx context.Context, msg kafka.Message) error {
+	result, err := s.scan(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("failed to scan %s/%d@%d: %w", msg.Topic, msg.Partition, msg.Offset, err)
+	}
+
+	value, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to encode verdict: %w", err)
+	}
+	verdict := kafka.Message{
+		Key:   msg.Key,
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "verdict", Value: []byte(result.Verdict)},
+			{Key: "source-topic", Value: []byte(msg.Topic)},
+			{Key: "source-partition", Value: []byte(strconv.Itoa(msg.Partition))},
+			{Key: "source-offset", Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		},
+	}
+	if err := s.writer.WriteMessages(ctx, verdict); err != nil {
+		return fmt.Errorf("failed to publish verdict: %w", err)
+	}
+
+	if err := s.reader.CommitMessages(ctx, msg); err != nil {
+		return fmt.Errorf("failed to commit offset: %w", err)
+	}
+	return nil
+}
+
+// scan sends the payload of msg through RESPMOD as the body of a 200
+// response. A message header named request-id is used as the ICAP request
+// ID.
+func (s *Scanner) scan(ctx context.Context, msg kafka.Message) (*Result, error) {
+	contentType := s.ContentType
+	var options icapclient.RequestOptions
+	for _, header := range msg.Headers {
+		switch header.Key {
+		case "Content-Type", "content-type":
+			contentType = string(header.Value)
+		case "request-id":
+			options.RequestID = string(header.Value)
+		}
+	}
+
+	ctx = icapclient.WithRequestOptions(ctx, options)
+	verdict, response, err := s.client.ScanResponse(ctx, &icapclient.HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers: map[string]string{
+			"Content-Type":   contentType,
+			"Content-Length": strconv.Itoa(len(msg.Value)),
+		},
+		Body: msg.Value,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Close()
+
+	return &Result{
+		Topic:      msg.Topic,
+		Partition:  msg.Partition,
+		Offset:     msg.Offset,
+		Key:        string(msg.Key),
+		Verdict:    verdict.String(),
+		IcapStatus: response.StatusCode,
+		RequestID:  response.RequestID,
+		Infection:  response.Infection,
+		Violations: response.Violations,
+		ScannedAt:  time.Now().UTC(),
+	}, nil
+}
@@ -0,0 +1,174 @@
+package icapkafka
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeTopic is an in-memory Reader and Writer
+type fakeTopic struct {
+	mu        sync.Mutex
+	pending   []kafka.Message
+	written   []kafka.Message
+	committed []int64
+	writeErr  error
+}
+
+// FetchMessage returns the next pending message, or blocks until ctx is done
+func (f *fakeTopic) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	f.mu.Lock()
+	if len(f.pending) > 0 {
+		msg := f.pending[0]
+		f.pending = f.pending[1:]
+		f.mu.Unlock()
+		return msg, nil
+	}
+	f.mu.Unlock()
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+// CommitMessages records the committed offsets
+func (f *fakeTopic) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range msgs {
+		f.committed = append(f.committed, msg.Offset)
+	}
+	return nil
+}
+
+// WriteMessages records the written messages
+func (f *fakeTopic) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writeErr != nil {
+		return f.writeErr
+	}
+	f.written = append(f.written, msgs...)
+	return nil
+}
+
+// virusHandler blocks payloads containing "virus"
+func virusHandler(w icaptest.ResponseWriter, r *icaptest.Request) {
+	if strings.Contains(string(r.Body), "virus") {
+		w.Header().Set("X-Infection-Found", "Type=0; Resolution=2; Threat=Test-Virus;")
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{}}, true)
+		w.Write([]byte("blocked"))
+		return
+	}
+	w.WriteHeader(204, nil, false)
+}
+
+// newTestClient returns a client of an icaptest server running virusHandler
+func newTestClient(t *testing.T) *icapclient.IcapClient {
+	t.Helper()
+
+	server := icaptest.NewServer(icaptest.HandlerFunc(virusHandler))
+	t.Cleanup(server.Close)
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		KeepAlive:    true,
+		LoggingLevel: "ERROR",
+	})
+	t.Cleanup(client.Close)
+	return client
+}
+
+// TestScanner_Run tests that verdicts are published and offsets committed
+func TestScanner_Run(t *testing.T) {
+	topic := &fakeTopic{pending: []kafka.Message{
+		{Topic: "uploads", Offset: 1, Key: []byte("a"), Value: []byte("clean")},
+		{Topic: "uploads", Offset: 2, Key: []byte("b"), Value: []byte("a virus"), Headers: []kafka.Header{{Key: "request-id", Value: []byte("msg-2")}}},
+	}}
+	scanner := NewScanner(newTestClient(t), topic, topic)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- scanner.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		topic.mu.Lock()
+		n := len(topic.committed)
+		topic.mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if len(topic.written) != 2 {
+		t.Fatalf("Expected 2 verdicts, got %d", len(topic.written))
+	}
+	tests := []struct {
+		expectedVerdict   string
+		expectedThreat    string
+		expectedRequestID string
+	}{
+		{"allowed", "", ""},
+		{"blocked", "Test-Virus", "msg-2"},
+	}
+	for i, tt := range tests {
+		var result Result
+		if err := json.Unmarshal(topic.written[i].Value, &result); err != nil {
+			t.Fatalf("Failed to decode verdict: %v", err)
+		}
+		if result.Verdict != tt.expectedVerdict {
+			t.Errorf("Expected verdict %s, got %s", tt.expectedVerdict, result.Verdict)
+		}
+		if tt.expectedThreat != "" && (result.Infection == nil || result.Infection.Threat != tt.expectedThreat) {
+			t.Errorf("Expected threat %s, got %v", tt.expectedThreat, result.Infection)
+		}
+		if tt.expectedRequestID != "" && result.RequestID != tt.expectedRequestID {
+			t.Errorf("Expected request ID %s, got %s", tt.expectedRequestID, result.RequestID)
+		}
+		if result.Offset != int64(i+1) || string(topic.written[i].Key) != result.Key {
+			t.Errorf("Expected verdict for offset %d, got %+v", i+1, result)
+		}
+	}
+	if topic.committed[0] != 1 || topic.committed[1] != 2 {
+		t.Errorf("Expected offsets 1 and 2 committed, got %v", topic.committed)
+	}
+}
+
+// TestScanner_NoCommitOnFailure tests that offsets are only committed after
+// the verdict is published
+func TestScanner_NoCommitOnFailure(t *testing.T) {
+	client := newTestClient(t)
+	msg := kafka.Message{Topic: "uploads", Offset: 7, Value: []byte("clean")}
+
+	topic := &fakeTopic{writeErr: kafka.LeaderNotAvailable}
+	if err := NewScanner(client, topic, topic).Process(context.Background(), msg); err == nil {
+		t.Error("Expected an error when the verdict cannot be published")
+	}
+	if len(topic.committed) != 0 {
+		t.Errorf("Expected no commit, got %v", topic.committed)
+	}
+
+	down := icapclient.NewIcapClient(&icapclient.IcapConfig{Host: "127.0.0.1", Port: 1, Timeout: time.Second, LoggingLevel: "ERROR"})
+	defer down.Close()
+	topic = &fakeTopic{}
+	if err := NewScanner(down, topic, topic).Process(context.Background(), msg); err == nil {
+		t.Error("Expected an error when the ICAP server is down")
+	}
+	if len(topic.committed) != 0 || len(topic.written) != 0 {
+		t.Errorf("Expected nothing published or committed, got %d verdicts and %v", len(topic.written), topic.committed)
+	}
+}
@@ -0,0 +1,189 @@
+package icapmilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// maxMultipartDepth bounds the nesting of multipart bodies that is walked
+const maxMultipartDepth = 10
+
+// Part is one leaf of a message scanned through RESPMOD
+type Part struct {
+	// Filename is the name of an attachment, empty for the message text
+	Filename    string
+	ContentType string
+	Size        int
+	Verdict     icapclient.Verdict
+	Infection   *icapclient.Infection
+	Violations  []icapclient.Violation
+	RequestID   string
+	Err         error
+}
+
+// Result is the outcome of scanning a message
+type Result struct {
+	// Verdict is VerdictBlocked when any part is blocked, VerdictError when
+	// any other part could not be scanned, and VerdictAllowed otherwise.
+	// Adapted parts are not written back to the message, so a message with
+	// modified parts is allowed.
+	Verdict icapclient.Verdict
+	Parts   []Part
+	// Err is the first error that prevented a verdict
+	Err error
+}
+
+// Threat returns the name of the first threat found in the message
+func (r *Result) Threat() string {
+	for _, part := range r.Parts {
+		if part.Infection != nil && part.Infection.Threat != "" {
+			return part.Infection.Threat
+		}
+		for _, violation := range part.Violations {
+			if violation.Threat != "" {
+				return violation.Threat
+			}
+		}
+	}
+	return ""
+}
+
+// ScanMessage sends the text and each attachment of an RFC 5322 message
+// through RESPMOD, decoding their transfer encoding first. A message that
+// cannot be parsed as MIME is scanned whole as message/rfc822. Each part is
+// sent with options, its request ID, if any, suffixed with the part index.
+func ScanMessage(ctx context.Context, client *icapclient.IcapClient, message []byte, options icapclient.RequestOptions) *Result {
+	result := &Result{Verdict: icapclient.VerdictAllowed}
+
+	var parts []Part
+	var bodies [][]byte
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err == nil {
+		err = walkPart(textproto.MIMEHeader(msg.Header), msg.Body, 0, &parts, &bodies)
+	}
+	if err != nil {
+		parts = []Part{{ContentType: "message/rfc822"}}
+		bodies = [][]byte{message}
+	}
+
+	for i := range parts {
+		partOptions := options
+		if options.RequestID != "" {
+			partOptions.RequestID = options.RequestID + "." + strconv.Itoa(i)
+		}
+		scanPart(icapclient.WithRequestOptions(ctx, partOptions), client, &parts[i], bodies[i])
+
+		switch {
+		case parts[i].Verdict == icapclient.VerdictBlocked:
+			result.Verdict = icapclient.VerdictBlocked
+		case parts[i].Verdict == icapclient.VerdictError && result.Verdict != icapclient.VerdictBlocked:
+			result.Verdict = icapclient.VerdictError
+		}
+		if parts[i].Err != nil && result.Err == nil {
+			result.Err = parts[i].Err
+		}
+	}
+	result.Parts = parts
+	return result
+}
+
+// scanPart sends one decoded part through RESPMOD
+func scanPart(ctx context.Context, client *icapclient.IcapClient, part *Part, body []byte) {
+	part.Size = len(body)
+	headers := map[string]string{
+		"Content-Type":   part.ContentType,
+		"Content-Length": strconv.Itoa(len(body)),
+	}
+	if part.Filename != "" {
+		headers["Content-Disposition"] = mime.FormatMediaType("attachment", map[string]string{"filename": part.Filename})
+	}
+
+	verdict, response, err := client.ScanResponse(ctx, &icapclient.HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers:    headers,
+		Body:       body,
+	})
+	part.Verdict = verdict
+	if err != nil {
+		part.Err = err
+		return
+	}
+	defer response.Close()
+	part.RequestID = response.RequestID
+	part.Infection = response.Infection
+	part.Violations = response.Violations
+}
+
+// walkPart collects the leaves of a MIME entity and their decoded bodies
+func walkPart(header textproto.MIMEHeader, body io.Reader, depth int, parts *[]Part, bodies *[][]byte) error {
+	contentType := header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMultipartDepth {
+			return fmt.Errorf("multipart nesting deeper than %d", maxMultipartDepth)
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := walkPart(part.Header, part, depth+1, parts, bodies); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	*parts = append(*parts, Part{Filename: filename(header, params), ContentType: contentType})
+	*bodies = append(*bodies, data)
+	return nil
+}
+
+// decodeTransfer undoes a Content-Transfer-Encoding
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// filename returns the attachment name from Content-Disposition, falling
+// back to the name parameter of Content-Type
+func filename(header textproto.MIMEHeader, typeParams map[string]string) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	return typeParams["name"]
+}
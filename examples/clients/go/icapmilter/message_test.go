@@ -0,0 +1,131 @@
+package icapmilter
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// virusHandler blocks bodies containing "virus" and records the request IDs
+// it received
+type virusHandler struct {
+	mu         sync.Mutex
+	requestIDs []string
+}
+
+func (h *virusHandler) ServeICAP(w icaptest.ResponseWriter, r *icaptest.Request) {
+	h.mu.Lock()
+	h.requestIDs = append(h.requestIDs, r.Header.Get("X-Request-ID"))
+	h.mu.Unlock()
+
+	if strings.Contains(string(r.Body), "virus") {
+		w.Header().Set("X-Infection-Found", "Type=0; Resolution=2; Threat=Test-Virus;")
+		w.WriteHeader(200, &http.Response{StatusCode: 403, Proto: "HTTP/1.1", Header: http.Header{}}, true)
+		w.Write([]byte("blocked"))
+		return
+	}
+	w.WriteHeader(204, nil, false)
+}
+
+// newTestClient returns a client of an icaptest server running handler
+func newTestClient(t *testing.T, handler icaptest.Handler) *icapclient.IcapClient {
+	t.Helper()
+
+	server := icaptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, port := server.HostPort()
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		KeepAlive:    true,
+		LoggingLevel: "ERROR",
+	})
+	t.Cleanup(client.Close)
+	return client
+}
+
+// multipartMessage has a text part and a base64 attachment holding "virus"
+const multipartMessage = "From: alice@example.com\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"See the attached report=2E\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/octet-stream; name=\"report.exe\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.exe\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"YSB2aXJ1cyBp\r\n" +
+	"bnNpZGU=\r\n" +
+	"--b1--\r\n"
+
+// TestScanMessage tests that the text and attachments of a message are
+// decoded and scanned separately
+func TestScanMessage(t *testing.T) {
+	handler := &virusHandler{}
+	client := newTestClient(t, handler)
+
+	result := ScanMessage(context.Background(), client, []byte(multipartMessage), icapclient.RequestOptions{RequestID: "Q123"})
+	if result.Err != nil {
+		t.Fatalf("ScanMessage failed: %v", result.Err)
+	}
+	if result.Verdict != icapclient.VerdictBlocked {
+		t.Errorf("Expected blocked verdict, got %s", result.Verdict)
+	}
+	if len(result.Parts) != 2 {
+		t.Fatalf("Expected 2 parts, got %d", len(result.Parts))
+	}
+	if result.Parts[0].Verdict != icapclient.VerdictAllowed || result.Parts[0].Size != len("See the attached report.") {
+		t.Errorf("Expected decoded allowed text part, got %+v", result.Parts[0])
+	}
+	if result.Parts[1].Filename != "report.exe" || result.Parts[1].Verdict != icapclient.VerdictBlocked {
+		t.Errorf("Expected blocked report.exe attachment, got %+v", result.Parts[1])
+	}
+	if result.Threat() != "Test-Virus" {
+		t.Errorf("Expected threat Test-Virus, got %q", result.Threat())
+	}
+	if strings.Join(handler.requestIDs, ",") != "Q123.0,Q123.1" {
+		t.Errorf("Expected per-part request IDs, got %v", handler.requestIDs)
+	}
+}
+
+// TestScanMessage_Plain tests single-part and unparseable messages
+func TestScanMessage_Plain(t *testing.T) {
+	client := newTestClient(t, &virusHandler{})
+
+	tests := []struct {
+		name            string
+		message         string
+		expectedType    string
+		expectedVerdict icapclient.Verdict
+	}{
+		{"plain", "Subject: hi\r\n\r\nhello\r\n", "text/plain", icapclient.VerdictAllowed},
+		{"plain virus", "Subject: hi\r\nContent-Type: text/html\r\n\r\na virus\r\n", "text/html", icapclient.VerdictBlocked},
+		{"unparseable", "not a message with a virus", "message/rfc822", icapclient.VerdictBlocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ScanMessage(context.Background(), client, []byte(tt.message), icapclient.RequestOptions{})
+			if result.Verdict != tt.expectedVerdict {
+				t.Errorf("Expected verdict %s, got %s", tt.expectedVerdict, result.Verdict)
+			}
+			if len(result.Parts) != 1 || result.Parts[0].ContentType != tt.expectedType {
+				t.Errorf("Expected one %s part, got %+v", tt.expectedType, result.Parts)
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+// Package icapmilter scans mail through an ICAP server. A Server speaks the
+// Sendmail milter protocol to Postfix or Sendmail, sends the body and each
+// attachment of a message through RESPMOD, and answers the MTA with an
+// accept, reject, discard or quarantine action.
+package icapmilter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// Milter commands sent by the MTA
+const (
+	cmdAbort      = 'A'
+	cmdBody       = 'B'
+	cmdConnect    = 'C'
+	cmdMacro      = 'D'
+	cmdEndOfBody  = 'E'
+	cmdHelo       = 'H'
+	cmdQuitNewCon = 'K'
+	cmdHeader     = 'L'
+	cmdMail       = 'M'
+	cmdEndOfHdrs  = 'N'
+	cmdOptNeg     = 'O'
+	cmdQuit       = 'Q'
+	cmdRcpt       = 'R'
+	cmdData       = 'T'
+	cmdUnknown    = 'U'
+)
+
+// Milter replies sent to the MTA
+const (
+	replyAddHeader  = 'h'
+	replyAccept     = 'a'
+	replyContinue   = 'c'
+	replyDiscard    = 'd'
+	replyQuarantine = 'q'
+	replyReject     = 'r'
+	replyTempfail   = 't'
+	replyCode       = 'y'
+)
+
+// Option negotiation flags
+const (
+	milterVersion = 6
+
+	actionAddHeaders = 0x01
+	actionQuarantine = 0x20
+
+	protoNoHelo    = 0x02
+	protoNoMail    = 0x04
+	protoNoRcpt    = 0x08
+	protoNoUnknown = 0x100
+	protoNoData    = 0x200
+)
+
+// maxPacketSize bounds the milter packets accepted from the MTA, which
+// sends bodies in chunks of at most 64 KiB
+const maxPacketSize = 1 << 20
+
+// Action is the answer given to the MTA for a message
+type Action string
+
+const (
+	// ActionAccept delivers the message
+	ActionAccept Action = "accept"
+	// ActionReject refuses the message with a permanent 5xx error
+	ActionReject Action = "reject"
+	// ActionTempfail refuses the message with a temporary 4xx error, so
+	// that the sender retries it
+	ActionTempfail Action = "tempfail"
+	// ActionDiscard accepts the message and silently drops it
+	ActionDiscard Action = "discard"
+	// ActionQuarantine accepts the message into the MTA's hold queue
+	ActionQuarantine Action = "quarantine"
+)
+
+// ParseAction parses the name of an action
+func ParseAction(name string) (Action, error) {
+	switch action := Action(strings.ToLower(name)); action {
+	case ActionAccept, ActionReject, ActionTempfail, ActionDiscard, ActionQuarantine:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown milter action %q", name)
+	}
+}
+
+// Policy selects the actions taken on scanned messages
+type Policy struct {
+	// Blocked is the action for messages with a blocked part. It defaults
+	// to ActionReject.
+	Blocked Action
+	// OnError is the action for messages that could not be scanned. It
+	// defaults to ActionTempfail.
+	OnError Action
+	// MaxMessageSize is the largest message buffered for scanning. Larger
+	// messages are handled as scan errors. Zero buffers every message.
+	MaxMessageSize int64
+	// VerdictHeader, when set, is added to delivered messages with the
+	// verdict of the scan
+	VerdictHeader string
+}
+
+// Server is a milter server scanning messages with an ICAP client
+type Server struct {
+	client *icapclient.IcapClient
+	policy Policy
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+	closed    bool
+}
+
+// NewServer returns a milter server scanning with client according to
+// policy
+func NewServer(client *icapclient.IcapClient, policy Policy) *Server {
+	if policy.Blocked == "" {
+		policy.Blocked = ActionReject
+	}
+	if policy.OnError == "" {
+		policy.OnError = ActionTempfail
+	}
+	return &Server{
+		client:    client,
+		policy:    policy,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("icapmilter: server closed")
+
+// Serve accepts MTA connections on l until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, closes MTA connections and waits for their
+// goroutines to exit
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// session is the state of one MTA connection
+type session struct {
+	clientIP string
+	queueID  string
+	headers  bytes.Buffer
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+// reset clears the state of the current message
+func (s *session) reset() {
+	s.queueID = ""
+	s.headers.Reset()
+	s.body.Reset()
+	s.tooLarge = false
+}
+
+// serveConn runs the milter protocol on conn
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	sess := &session{}
+	for {
+		cmd, data, err := readPacket(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.client.Logger().Warn("milter connection failed", "remote", conn.RemoteAddr().String(), "error", err.Error())
+			}
+			return
+		}
+
+		quit, err := s.handle(sess, bw, cmd, data)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			s.client.Logger().Warn("milter connection failed", "remote", conn.RemoteAddr().String(), "error", err.Error())
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handle answers one command of the MTA. It reports whether the
+// connection should be closed.
+func (s *Server) handle(sess *session, w *bufio.Writer, cmd byte, data []byte) (bool, error) {
+	switch cmd {
+	case cmdOptNeg:
+		return false, negotiate(w, data)
+	case cmdMacro:
+		// Macros are not answered; the queue ID identifies messages in logs
+		if len(data) > 0 && (data[0] == cmdEndOfBody || data[0] == cmdMail || data[0] == cmdEndOfHdrs) {
+			for i, field := 0, splitNull(data[1:]); i+1 < len(field); i += 2 {
+				if field[i] == "i" || field[i] == "{i}" {
+					sess.queueID = field[i+1]
+				}
+			}
+		}
+		return false, nil
+	case cmdConnect:
+		sess.clientIP = connectAddress(data)
+		return false, writePacket(w, replyContinue, nil)
+	case cmdHeader:
+		field := splitNull(data)
+		if len(field) < 2 {
+			return false, fmt.Errorf("malformed header packet")
+		}
+		s.buffer(sess, &sess.headers, []byte(field[0]+":"+field[1]+"\r\n"))
+		return false, writePacket(w, replyContinue, nil)
+	case cmdEndOfHdrs:
+		s.buffer(sess, &sess.headers, []byte("\r\n"))
+		return false, writePacket(w, replyContinue, nil)
+	case cmdBody:
+		s.buffer(sess, &sess.body, data)
+		return false, writePacket(w, replyContinue, nil)
+	case cmdEndOfBody:
+		s.buffer(sess, &sess.body, data)
+		err := s.finish(sess, w)
+		sess.reset()
+		return false, err
+	case cmdAbort:
+		sess.reset()
+		return false, nil
+	case cmdQuitNewCon:
+		sess.reset()
+		sess.clientIP = ""
+		return false, nil
+	case cmdQuit:
+		return true, nil
+	case cmdHelo, cmdMail, cmdRcpt, cmdData, cmdUnknown:
+		return false, writePacket(w, replyContinue, nil)
+	default:
+		return false, fmt.Errorf("unknown milter command %q", cmd)
+	}
+}
+
+// negotiate answers the option negotiation of the MTA, asking to skip the
+// steps the scanner has no use for
+func negotiate(w *bufio.Writer, data []byte) error {
+	if len(data) < 12 {
+		return fmt.Errorf("malformed option negotiation")
+	}
+	version := binary.BigEndian.Uint32(data[0:4])
+	actions := binary.BigEndian.Uint32(data[4:8])
+	protocol := binary.BigEndian.Uint32(data[8:12])
+	if version < 2 {
+		return fmt.Errorf("unsupported milter version %d", version)
+	}
+	if version > milterVersion {
+		version = milterVersion
+	}
+
+	reply := make([]byte, 12)
+	binary.BigEndian.PutUint32(reply[0:4], version)
+	binary.BigEndian.PutUint32(reply[4:8], actions&(actionAddHeaders|actionQuarantine))
+	binary.BigEndian.PutUint32(reply[8:12], protocol&(protoNoHelo|protoNoMail|protoNoRcpt|protoNoUnknown|protoNoData))
+	return writePacket(w, cmdOptNeg, reply)
+}
+
+// buffer appends data to buf unless the message is over the size limit
+func (s *Server) buffer(sess *session, buf *bytes.Buffer, data []byte) {
+	if sess.tooLarge {
+		return
+	}
+	size := int64(sess.headers.Len() + sess.body.Len() + len(data))
+	if s.policy.MaxMessageSize > 0 && size > s.policy.MaxMessageSize {
+		sess.tooLarge = true
+		sess.headers.Reset()
+		sess.body.Reset()
+		return
+	}
+	buf.Write(data)
+}
+
+// finish scans the buffered message and sends the final answer for it
+func (s *Server) finish(sess *session, w *bufio.Writer) error {
+	var result *Result
+	if sess.tooLarge {
+		result = &Result{Verdict: icapclient.VerdictError, Err: icapclient.ErrEntityTooLarge}
+	} else {
+		message := make([]byte, 0, sess.headers.Len()+sess.body.Len())
+		message = append(append(message, sess.headers.Bytes()...), sess.body.Bytes()...)
+		result = ScanMessage(context.Background(), s.client, message, icapclient.RequestOptions{
+			RequestID: sess.queueID,
+			ClientIP:  sess.clientIP,
+		})
+	}
+
+	action := ActionAccept
+	switch result.Verdict {
+	case icapclient.VerdictBlocked:
+		action = s.policy.Blocked
+	case icapclient.VerdictError:
+		action = s.policy.OnError
+	}
+
+	logger := s.client.Logger()
+	if result.Err != nil {
+		logger.Warn("milter scan failed", "queue_id", sess.queueID, "action", string(action), "error", result.Err.Error())
+	} else {
+		logger.Info("milter scan complete", "queue_id", sess.queueID, "verdict", result.Verdict.String(), "threat", result.Threat(), "action", string(action))
+	}
+
+	if s.policy.VerdictHeader != "" && (action == ActionAccept || action == ActionQuarantine) {
+		header := []byte(s.policy.VerdictHeader + "\x00" + result.Verdict.String() + "\x00")
+		if err := writePacket(w, replyAddHeader, header); err != nil {
+			return err
+		}
+	}
+
+	switch action {
+	case ActionReject:
+		text := "550 5.7.1 Message rejected by content scan"
+		if threat := result.Threat(); threat != "" {
+			text += ": " + sanitizeReply(threat)
+		}
+		return writePacket(w, replyCode, []byte(text+"\x00"))
+	case ActionTempfail:
+		return writePacket(w, replyTempfail, nil)
+	case ActionDiscard:
+		return writePacket(w, replyDiscard, nil)
+	case ActionQuarantine:
+		reason := "content scan"
+		if threat := result.Threat(); threat != "" {
+			reason = sanitizeReply(threat)
+		}
+		if err := writePacket(w, replyQuarantine, []byte(reason+"\x00")); err != nil {
+			return err
+		}
+		return writePacket(w, replyAccept, nil)
+	default:
+		return writePacket(w, replyAccept, nil)
+	}
+}
+
+// readPacket reads one length-prefixed milter packet
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > maxPacketSize {
+		return 0, nil, fmt.Errorf("invalid milter packet size %d", size)
+	}
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// writePacket writes one length-prefixed milter packet
+func writePacket(w *bufio.Writer, cmd byte, data []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)+1))
+	header[4] = cmd
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// splitNull splits NUL-terminated strings
+func splitNull(data []byte) []string {
+	fields := strings.Split(string(data), "\x00")
+	if len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return fields
+}
+
+// connectAddress extracts the client address from a connect packet:
+// hostname, NUL, family, port and address
+func connectAddress(data []byte) string {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || len(data) < i+4 {
+		return ""
+	}
+	family := data[i+1]
+	if family != '4' && family != '6' {
+		return ""
+	}
+	address := strings.TrimSuffix(string(data[i+4:]), "\x00")
+	return strings.TrimPrefix(address, "IPv6:")
+}
+
+// sanitizeReply removes characters that cannot appear in an SMTP reply
+func sanitizeReply(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '%' {
+			return '_'
+		}
+		return r
+	}, text)
+}
@@ -0,0 +1,190 @@
+package icapmilter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// fakeMTA drives a milter connection the way Postfix does
+type fakeMTA struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+}
+
+// startMilter serves a milter on a loopback listener and connects to it
+func startMilter(t *testing.T, client *icapclient.IcapClient, policy Policy) *fakeMTA {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := NewServer(client, policy)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &fakeMTA{t: t, conn: conn, br: bufio.NewReader(conn), bw: bufio.NewWriter(conn)}
+}
+
+// send writes one packet
+func (m *fakeMTA) send(cmd byte, data string) {
+	m.t.Helper()
+	if err := writePacket(m.bw, cmd, []byte(data)); err != nil {
+		m.t.Fatalf("Failed to send %q: %v", cmd, err)
+	}
+	if err := m.bw.Flush(); err != nil {
+		m.t.Fatalf("Failed to send %q: %v", cmd, err)
+	}
+}
+
+// expect reads one packet and checks its command
+func (m *fakeMTA) expect(cmd byte) string {
+	m.t.Helper()
+	got, data, err := readPacket(m.br)
+	if err != nil {
+		m.t.Fatalf("Failed to read reply: %v", err)
+	}
+	if got != cmd {
+		m.t.Fatalf("Expected reply %q, got %q (%q)", cmd, got, data)
+	}
+	return string(data)
+}
+
+// negotiate offers every action and protocol step
+func (m *fakeMTA) negotiate() (uint32, uint32) {
+	m.t.Helper()
+	offer := make([]byte, 12)
+	binary.BigEndian.PutUint32(offer[0:4], 6)
+	binary.BigEndian.PutUint32(offer[4:8], 0x1ff)
+	binary.BigEndian.PutUint32(offer[8:12], 0x1fffff)
+	m.send(cmdOptNeg, string(offer))
+	reply := []byte(m.expect(cmdOptNeg))
+	return binary.BigEndian.Uint32(reply[4:8]), binary.BigEndian.Uint32(reply[8:12])
+}
+
+// deliver sends a message and returns the replies to end of body
+func (m *fakeMTA) deliver(headers [][2]string, body string) []byte {
+	m.t.Helper()
+	m.send(cmdMacro, "E{i}\x00Q42\x00")
+	for _, header := range headers {
+		m.send(cmdHeader, header[0]+"\x00"+header[1]+"\x00")
+		m.expect(replyContinue)
+	}
+	m.send(cmdEndOfHdrs, "")
+	m.expect(replyContinue)
+	m.send(cmdBody, body)
+	m.expect(replyContinue)
+	m.send(cmdEndOfBody, "")
+
+	var replies []byte
+	for {
+		cmd, _, err := readPacket(m.br)
+		if err != nil {
+			m.t.Fatalf("Failed to read reply: %v", err)
+		}
+		replies = append(replies, cmd)
+		if cmd != replyAddHeader && cmd != replyQuarantine {
+			return replies
+		}
+	}
+}
+
+// TestServer_Negotiate tests that only supported actions and skippable
+// steps are negotiated
+func TestServer_Negotiate(t *testing.T) {
+	mta := startMilter(t, newTestClient(t, &virusHandler{}), Policy{})
+	actions, protocol := mta.negotiate()
+	if actions != actionAddHeaders|actionQuarantine {
+		t.Errorf("Expected add-header and quarantine actions, got %#x", actions)
+	}
+	if protocol != protoNoHelo|protoNoMail|protoNoRcpt|protoNoUnknown|protoNoData {
+		t.Errorf("Expected unused steps skipped, got %#x", protocol)
+	}
+
+	mta.send(cmdConnect, "mail.example.com\x004\x00\x19192.0.2.1\x00")
+	mta.expect(replyContinue)
+}
+
+// TestServer_Actions tests the answers given for clean, infected and
+// unscannable messages
+func TestServer_Actions(t *testing.T) {
+	client := newTestClient(t, &virusHandler{})
+	down := icapclient.NewIcapClient(&icapclient.IcapConfig{Host: "127.0.0.1", Port: 1, Timeout: time.Second, LoggingLevel: "ERROR"})
+	defer down.Close()
+
+	headers := [][2]string{{"From", " alice@example.com"}, {"Subject", " hello"}}
+	tests := []struct {
+		name            string
+		client          *icapclient.IcapClient
+		policy          Policy
+		body            string
+		expectedReplies string
+	}{
+		{"clean", client, Policy{}, "hello\r\n", "a"},
+		{"clean with header", client, Policy{VerdictHeader: "X-ICAP-Verdict"}, "hello\r\n", "ha"},
+		{"rejected", client, Policy{}, "a virus\r\n", "y"},
+		{"quarantined", client, Policy{Blocked: ActionQuarantine, VerdictHeader: "X-ICAP-Verdict"}, "a virus\r\n", "hqa"},
+		{"discarded", client, Policy{Blocked: ActionDiscard}, "a virus\r\n", "d"},
+		{"too large", client, Policy{MaxMessageSize: 16}, "hello, this message is too long\r\n", "t"},
+		{"server down", down, Policy{}, "hello\r\n", "t"},
+		{"server down fail open", down, Policy{OnError: ActionAccept}, "hello\r\n", "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mta := startMilter(t, tt.client, tt.policy)
+			mta.negotiate()
+			if replies := mta.deliver(headers, tt.body); string(replies) != tt.expectedReplies {
+				t.Errorf("Expected replies %q, got %q", tt.expectedReplies, replies)
+			}
+		})
+	}
+}
+
+// TestServer_RejectReply tests that rejections name the threat and that
+// the connection is reused for the next message
+func TestServer_RejectReply(t *testing.T) {
+	mta := startMilter(t, newTestClient(t, &virusHandler{}), Policy{})
+	mta.negotiate()
+
+	mta.deliver([][2]string{{"Subject", " one"}}, "a virus\r\n")
+	mta.send(cmdAbort, "")
+	if replies := mta.deliver([][2]string{{"Subject", " two"}}, "clean\r\n"); string(replies) != "a" {
+		t.Errorf("Expected the second message accepted, got %q", replies)
+	}
+
+	mta.send(cmdEndOfHdrs, "")
+	mta.expect(replyContinue)
+	mta.send(cmdBody, "a virus\r\n")
+	mta.expect(replyContinue)
+	mta.send(cmdEndOfBody, "")
+	reply := mta.expect(replyCode)
+	if !strings.HasPrefix(reply, "550 5.7.1 ") || !strings.Contains(reply, "Test-Virus") {
+		t.Errorf("Expected a 550 reply naming the threat, got %q", reply)
+	}
+	mta.send(cmdQuit, "")
+}
+
+// TestParseAction tests parsing action names
+func TestParseAction(t *testing.T) {
+	if action, err := ParseAction("Quarantine"); err != nil || action != ActionQuarantine {
+		t.Errorf("Expected quarantine, got %q, %v", action, err)
+	}
+	if _, err := ParseAction("bounce"); err == nil {
+		t.Error("Expected an error for an unknown action")
+	}
+}
@@ -0,0 +1,188 @@
+package icapserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// clamdFound matches a virus in a clamd or clamdscan result line,
+// "stream: Eicar-Test-Signature FOUND"
+var clamdFound = regexp.MustCompile(`^(?:[^:]*:\s+)?(\S.*?)\s+FOUND$`)
+
+// ClamAV is a Handler scanning encapsulated bodies with ClamAV, through
+// the INSTREAM command of a clamd socket or by running clamdscan. Clean
+// messages are answered with 204, infected ones with a block page and the
+// X-Infection-Found and X-Virus-ID headers, and scan failures with 500
+// and an X-ICAP-Error header.
+type ClamAV struct {
+	// Address is the clamd socket, "unix:/run/clamav/clamd.ctl",
+	// "tcp:127.0.0.1:3310" or a plain path or host:port. When empty,
+	// Command is run instead.
+	Address string
+
+	// Command is the scanner run with the body on its standard input,
+	// "clamdscan" if empty, and Args its arguments, "--no-summary -" if
+	// nil. Exit status 1 means a virus was found.
+	Command string
+	Args    []string
+
+	// Timeout bounds a scan, one minute if zero
+	Timeout time.Duration
+}
+
+// ServeICAP scans the encapsulated body and answers with the result
+func (c *ClamAV) ServeICAP(w ResponseWriter, r *Request) {
+	if r.body == nil {
+		w.WriteHeader(204, nil, false)
+		return
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	threat, err := c.Scan(ctx, r.Body)
+	switch {
+	case err != nil:
+		w.Header().Set("X-ICAP-Error", err.Error())
+		w.WriteHeader(500, nil, false)
+	case threat != "":
+		w.Header().Set("X-Infection-Found", fmt.Sprintf("Type=0; Resolution=2; Threat=%s;", threat))
+		w.Header().Set("X-Virus-ID", threat)
+		writeBlockPage(w, &Message{Request: r, blockStatus: http.StatusForbidden, blockReason: fmt.Sprintf("Virus %s detected", threat)})
+	default:
+		w.WriteHeader(204, nil, false)
+	}
+}
+
+// Scan returns the name of the virus found in body, or "" when it is clean
+func (c *ClamAV) Scan(ctx context.Context, body io.Reader) (string, error) {
+	if c.Address != "" {
+		return c.scanClamd(ctx, body)
+	}
+	return c.scanCommand(ctx, body)
+}
+
+// scanClamd streams body to clamd with the INSTREAM command
+func (c *ClamAV) scanClamd(ctx context.Context, body io.Reader) (string, error) {
+	network, address := "tcp", c.Address
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "tcp:"):
+		address = strings.TrimPrefix(address, "tcp:")
+	case strings.HasPrefix(address, "/"):
+		network = "unix"
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// clamd may answer and close early, e.g. when the stream exceeds its
+	// StreamMaxLength, so the reply is read even if sending failed
+	sendErr := sendInstream(conn, body)
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	if reply == "" {
+		if sendErr != nil {
+			return "", fmt.Errorf("failed to send body to clamd: %w", sendErr)
+		}
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return parseClamdReply(reply)
+}
+
+// sendInstream writes an INSTREAM command: the body in chunks prefixed
+// with their big-endian length, terminated by a zero length chunk
+func sendInstream(w io.Writer, body io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+32*1024)
+	for {
+		n, err := body.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// scanCommand runs the scanner command with body on its standard input
+func (c *ClamAV) scanCommand(ctx context.Context, body io.Reader) (string, error) {
+	command, args := c.Command, c.Args
+	if command == "" {
+		command = "clamdscan"
+	}
+	if args == nil {
+		args = []string{"--no-summary", "-"}
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdin = body
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			if match := clamdFound.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+				return match[1], nil
+			}
+		}
+		return "", fmt.Errorf("%s found a virus without naming it", command)
+	default:
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = strings.TrimSpace(stdout.String())
+		}
+		return "", fmt.Errorf("%s failed: %v: %s", command, err, message)
+	}
+}
+
+// parseClamdReply parses a clamd scan result, "stream: OK",
+// "stream: Eicar-Test-Signature FOUND" or "... ERROR"
+func parseClamdReply(reply string) (string, error) {
+	if match := clamdFound.FindStringSubmatch(reply); match != nil {
+		return match[1], nil
+	}
+	if strings.HasSuffix(reply, " OK") {
+		return "", nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
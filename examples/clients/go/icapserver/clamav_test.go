@@ -0,0 +1,157 @@
+package icapserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// eicar is the EICAR antivirus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startFakeClamd serves the clamd INSTREAM command, finding a virus in
+// streams containing the EICAR test file and failing on streams over 64
+// bytes
+func startFakeClamd(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if command, err := br.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(br, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+					if len(data) > 64 && !bytes.Contains(data, []byte("EICAR")) {
+						io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+						return
+					}
+				}
+				if bytes.Contains(data, []byte(eicar)) {
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				} else {
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// TestClamAV_Clamd tests scanning through a clamd socket end-to-end
+func TestClamAV_Clamd(t *testing.T) {
+	clamd := startFakeClamd(t)
+	_, addr := startServer(t, &ClamAV{Address: "tcp:" + clamd})
+	client := newClient(t, addr)
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedThreat string
+	}{
+		{"clean", "hello world", 204, ""},
+		{"infected", eicar, 200, "Eicar-Test-Signature"},
+		{"scan error", strings.Repeat("a", 100), 500, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := client.Respmod(context.Background(), &icapclient.HttpResponse{
+				Version: "HTTP/1.1", StatusCode: 200, Reason: "OK",
+				Headers: map[string]string{"Content-Type": "application/octet-stream"},
+				Body:    []byte(tt.body),
+			})
+			if err != nil {
+				t.Fatalf("RESPMOD failed: %v", err)
+			}
+			if response.StatusCode != tt.expectedStatus {
+				t.Fatalf("Expected ICAP status %d, got %d", tt.expectedStatus, response.StatusCode)
+			}
+			if tt.expectedStatus == 500 && !strings.Contains(response.Headers["X-ICAP-Error"], "size limit") {
+				t.Errorf("Expected X-ICAP-Error with the clamd error, got %q", response.Headers["X-ICAP-Error"])
+			}
+			if tt.expectedThreat == "" {
+				return
+			}
+			if response.Infection == nil || response.Infection.Threat != tt.expectedThreat {
+				t.Errorf("Expected infection %q, got %+v", tt.expectedThreat, response.Infection)
+			}
+			if response.Headers["X-Virus-ID"] != tt.expectedThreat {
+				t.Errorf("Expected X-Virus-ID %q, got %q", tt.expectedThreat, response.Headers["X-Virus-ID"])
+			}
+			if response.HttpResponse == nil || response.HttpResponse.StatusCode != 403 {
+				t.Errorf("Expected a 403 block page, got %+v", response.HttpResponse)
+			}
+		})
+	}
+}
+
+// TestClamAV_Command tests scanning by running a clamdscan stand-in
+func TestClamAV_Command(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires a POSIX shell")
+	}
+	script := filepath.Join(t.TempDir(), "clamdscan")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+if grep -q EICAR-STANDARD; then
+	echo "stdin: Eicar-Test-Signature FOUND"
+	exit 1
+fi
+echo "stdin: OK"
+`), 0o755)
+	if err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	scanner := &ClamAV{Command: script, Args: []string{}}
+
+	threat, err := scanner.Scan(context.Background(), strings.NewReader(eicar))
+	if err != nil || threat != "Eicar-Test-Signature" {
+		t.Errorf("Expected Eicar-Test-Signature, got %q (%v)", threat, err)
+	}
+	threat, err = scanner.Scan(context.Background(), strings.NewReader("hello world"))
+	if err != nil || threat != "" {
+		t.Errorf("Expected clean result, got %q (%v)", threat, err)
+	}
+
+	scanner.Command = filepath.Join(t.TempDir(), "missing")
+	if _, err := scanner.Scan(context.Background(), strings.NewReader("hello")); err == nil {
+		t.Error("Expected error for a missing scanner")
+	}
+}
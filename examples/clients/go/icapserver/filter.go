@@ -0,0 +1,271 @@
+package icapserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Action is the decision of a Filter on a message
+type Action int
+
+const (
+	// Continue passes the message on to the next filter
+	Continue Action = iota
+	// Allow skips the remaining filters and answers with the message as
+	// adapted so far, or 204 if it was not changed
+	Allow
+	// Block skips the remaining filters and answers with a block page
+	Block
+)
+
+// Filter inspects, and may adapt, the encapsulated HTTP message of a
+// REQMOD or RESPMOD request
+type Filter interface {
+	Filter(m *Message) Action
+}
+
+// FilterFunc adapts an ordinary function to a Filter
+type FilterFunc func(m *Message) Action
+
+// Filter calls f(m)
+func (f FilterFunc) Filter(m *Message) Action {
+	return f(m)
+}
+
+// DefaultMaxBodySize is the number of body bytes a FilterChain buffers
+// when MaxBodySize is zero
+const DefaultMaxBodySize = 10 << 20
+
+// ErrBodyTooLarge is returned by Message.Body when the body is longer than
+// the MaxBodySize of the chain
+var ErrBodyTooLarge = errors.New("icapserver: body too large to filter")
+
+// Message is the HTTP message seen by the filters of a chain. Filters
+// rewrite it in place through Header and SetBody; the chain answers 204
+// when no filter changed it.
+type Message struct {
+	// Request is the ICAP request carrying the message
+	Request *Request
+
+	// HTTPRequest and HTTPResponse are the encapsulated messages, if
+	// present. Header is the header of the adapted one, the response for
+	// RESPMOD and the request for REQMOD.
+	HTTPRequest  *http.Request
+	HTTPResponse *http.Response
+	Header       http.Header
+
+	original     http.Header
+	maxBodySize  int64
+	body         []byte
+	overflow     []byte
+	bodyRead     bool
+	bodyErr      error
+	bodyReplaced bool
+	blockStatus  int
+	blockReason  string
+}
+
+// Body returns the body of the message, reading it on first use. Reading
+// the body past a preview asks the client for the rest of it. A body
+// longer than the MaxBodySize of the chain returns its first bytes and
+// ErrBodyTooLarge; the rest is passed through unfiltered.
+func (m *Message) Body() ([]byte, error) {
+	if m.bodyRead || m.Request.body == nil {
+		return m.body, m.bodyErr
+	}
+	m.bodyRead = true
+
+	m.body, m.bodyErr = io.ReadAll(io.LimitReader(m.Request.Body, m.maxBodySize+1))
+	if m.bodyErr == nil && int64(len(m.body)) > m.maxBodySize {
+		// Keep the byte read past the limit to pass the body through whole
+		m.body, m.overflow = m.body[:m.maxBodySize], m.body[m.maxBodySize:]
+		m.bodyErr = ErrBodyTooLarge
+	}
+	return m.body, m.bodyErr
+}
+
+// SetBody replaces the body of the message
+func (m *Message) SetBody(body []byte) {
+	m.body, m.overflow = body, nil
+	m.bodyRead = true
+	m.bodyErr = nil
+	m.bodyReplaced = true
+}
+
+// Block records the HTTP status and reason of the block page, and returns
+// Block
+func (m *Message) Block(status int, reason string) Action {
+	m.blockStatus, m.blockReason = status, reason
+	return Block
+}
+
+// modified reports whether a filter changed the message
+func (m *Message) modified() bool {
+	return m.bodyReplaced || !reflect.DeepEqual(m.Header, m.original)
+}
+
+// FilterChain is a Handler running filters in order over the encapsulated
+// message, so simple content filters can be composed without touching
+// the protocol
+type FilterChain struct {
+	Filters []Filter
+
+	// MaxBodySize bounds the body bytes buffered for filters calling
+	// Message.Body, DefaultMaxBodySize if zero
+	MaxBodySize int64
+}
+
+// NewFilterChain returns a FilterChain running filters in order
+func NewFilterChain(filters ...Filter) *FilterChain {
+	return &FilterChain{Filters: filters}
+}
+
+// Use appends filters to the chain
+func (c *FilterChain) Use(filters ...Filter) {
+	c.Filters = append(c.Filters, filters...)
+}
+
+// ServeICAP runs the filters and answers with a block page, the adapted
+// message, or 204 No Content when the message was left unchanged
+func (c *FilterChain) ServeICAP(w ResponseWriter, r *Request) {
+	if r.Request == nil && r.Response == nil {
+		w.WriteHeader(400, nil, false)
+		return
+	}
+
+	m := &Message{
+		Request:      r,
+		HTTPRequest:  r.Request,
+		HTTPResponse: r.Response,
+		maxBodySize:  c.MaxBodySize,
+	}
+	if m.maxBodySize <= 0 {
+		m.maxBodySize = DefaultMaxBodySize
+	}
+	var message interface{}
+	if r.Response != nil {
+		m.Header, message = r.Response.Header, r.Response
+	} else {
+		m.Header, message = r.Request.Header, r.Request
+	}
+	if m.Header == nil {
+		m.Header = http.Header{}
+		r.setHeader(m.Header)
+	}
+	m.original = m.Header.Clone()
+
+filters:
+	for _, filter := range c.Filters {
+		switch filter.Filter(m) {
+		case Allow:
+			break filters
+		case Block:
+			writeBlockPage(w, m)
+			return
+		}
+	}
+
+	if !m.modified() {
+		w.WriteHeader(204, nil, false)
+		return
+	}
+
+	hasBody := r.body != nil
+	if m.bodyReplaced {
+		hasBody = true
+		m.Header.Set("Content-Length", strconv.Itoa(len(m.body)))
+	}
+	w.WriteHeader(200, message, hasBody)
+	if !hasBody {
+		return
+	}
+	if m.bodyRead {
+		w.Write(m.body)
+		w.Write(m.overflow)
+	}
+	if !m.bodyReplaced {
+		io.Copy(writerOnly{w}, r.Body)
+	}
+}
+
+// setHeader sets the header of the adapted encapsulated message
+func (r *Request) setHeader(header http.Header) {
+	if r.Response != nil {
+		r.Response.Header = header
+	} else if r.Request != nil {
+		r.Request.Header = header
+	}
+}
+
+// writeBlockPage answers with an HTTP block page, carrying the reason in
+// the X-Block-Reason ICAP header
+func writeBlockPage(w ResponseWriter, m *Message) {
+	status, reason := m.blockStatus, m.blockReason
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	if reason == "" {
+		reason = "Blocked by content filter"
+	}
+
+	var page bytes.Buffer
+	fmt.Fprintf(&page, "<html><head><title>%d %s</title></head><body><h1>%s</h1><p>%s</p></body></html>\n",
+		status, http.StatusText(status), http.StatusText(status), html.EscapeString(reason))
+	resp := &http.Response{
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		Header: http.Header{
+			"Content-Type":   {"text/html; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(page.Len())},
+			"Cache-Control":  {"no-store"},
+		},
+	}
+	w.Header().Set("X-Block-Reason", reason)
+	w.WriteHeader(200, resp, true)
+	w.Write(page.Bytes())
+}
+
+// ScrubHeaders returns a filter removing the named headers from the
+// message, e.g. "Server" and "X-Powered-By" in responses or "Cookie" in
+// requests. A name ending in "*" removes every header with that prefix.
+func ScrubHeaders(names ...string) Filter {
+	return FilterFunc(func(m *Message) Action {
+		for name := range m.Header {
+			for _, scrubbed := range names {
+				prefix, wildcard := strings.CutSuffix(scrubbed, "*")
+				if (wildcard && len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)) ||
+					(!wildcard && strings.EqualFold(name, scrubbed)) {
+					delete(m.Header, name)
+					break
+				}
+			}
+		}
+		return Continue
+	})
+}
+
+// BlockKeywords returns a filter blocking messages whose body contains one
+// of keywords, ignoring case. Only the first MaxBodySize bytes of a body
+// are searched.
+func BlockKeywords(keywords ...string) Filter {
+	return FilterFunc(func(m *Message) Action {
+		body, err := m.Body()
+		if err != nil && !errors.Is(err, ErrBodyTooLarge) {
+			return Continue
+		}
+		body = bytes.ToLower(body)
+		for _, keyword := range keywords {
+			if keyword != "" && bytes.Contains(body, bytes.ToLower([]byte(keyword))) {
+				return m.Block(http.StatusForbidden, fmt.Sprintf("Keyword %q is not allowed", keyword))
+			}
+		}
+		return Continue
+	})
+}
@@ -0,0 +1,153 @@
+package icapserver
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// TestFilterChain tests composing header scrubbing, keyword blocking and
+// a body rewriting filter
+func TestFilterChain(t *testing.T) {
+	chain := NewFilterChain(
+		ScrubHeaders("Server", "X-Internal-*"),
+		FilterFunc(func(m *Message) Action {
+			if m.Header.Get("X-Trusted") != "" {
+				return Allow
+			}
+			return Continue
+		}),
+		BlockKeywords("confidential"),
+	)
+	chain.Use(FilterFunc(func(m *Message) Action {
+		body, err := m.Body()
+		if err == nil && bytes.Contains(body, []byte("password=")) {
+			m.SetBody(bytes.ReplaceAll(body, []byte("password="), []byte("password=REDACTED&")))
+		}
+		return Continue
+	}))
+
+	mux := NewServeMux()
+	mux.Handle("/respmod", &Service{Methods: []string{"RESPMOD"}, Handler: chain})
+	_, addr := startServer(t, mux)
+	client := newClient(t, addr)
+
+	tests := []struct {
+		name            string
+		headers         map[string]string
+		body            string
+		expectedStatus  int
+		expectedHTTP    int
+		expectedBody    string
+		expectedHeaders map[string]string
+	}{
+		{
+			name:           "clean message",
+			headers:        map[string]string{"Content-Type": "text/plain"},
+			body:           "hello world",
+			expectedStatus: 204,
+		},
+		{
+			name:            "scrubbed headers",
+			headers:         map[string]string{"Content-Type": "text/plain", "Server": "nginx/1.2", "X-Internal-Host": "db1"},
+			body:            "hello world",
+			expectedStatus:  200,
+			expectedHTTP:    200,
+			expectedBody:    "hello world",
+			expectedHeaders: map[string]string{"Server": "", "X-Internal-Host": "", "Content-Type": "text/plain"},
+		},
+		{
+			name:            "blocked keyword",
+			headers:         map[string]string{"Content-Type": "text/plain"},
+			body:            "this is CONFIDENTIAL",
+			expectedStatus:  200,
+			expectedHTTP:    403,
+			expectedHeaders: map[string]string{"Cache-Control": "no-store"},
+		},
+		{
+			name:           "allowed before keyword filter",
+			headers:        map[string]string{"X-Trusted": "yes"},
+			body:           "this is confidential",
+			expectedStatus: 204,
+		},
+		{
+			name:            "rewritten body",
+			headers:         map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Content-Length": "20"},
+			body:            "user=a&password=hunt",
+			expectedStatus:  200,
+			expectedHTTP:    200,
+			expectedBody:    "user=a&password=REDACTED&hunt",
+			expectedHeaders: map[string]string{"Content-Length": "29"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := client.Respmod(context.Background(), &icapclient.HttpResponse{
+				Version: "HTTP/1.1", StatusCode: 200, Reason: "OK",
+				Headers: tt.headers,
+				Body:    []byte(tt.body),
+			})
+			if err != nil {
+				t.Fatalf("RESPMOD failed: %v", err)
+			}
+			if response.StatusCode != tt.expectedStatus {
+				t.Fatalf("Expected ICAP status %d, got %d", tt.expectedStatus, response.StatusCode)
+			}
+			if tt.expectedHTTP == 0 {
+				return
+			}
+			adapted := response.HttpResponse
+			if adapted == nil || adapted.StatusCode != tt.expectedHTTP {
+				t.Fatalf("Expected HTTP status %d, got %+v", tt.expectedHTTP, adapted)
+			}
+			if tt.expectedBody != "" && string(adapted.Body) != tt.expectedBody {
+				t.Errorf("Expected body %q, got %q", tt.expectedBody, adapted.Body)
+			}
+			for name, value := range tt.expectedHeaders {
+				if adapted.Headers[name] != value {
+					t.Errorf("Expected header %s %q, got %q", name, value, adapted.Headers[name])
+				}
+			}
+			if tt.expectedHTTP == 403 && !strings.Contains(response.Headers["X-Block-Reason"], "confidential") {
+				t.Errorf("Expected X-Block-Reason naming the keyword, got %q", response.Headers["X-Block-Reason"])
+			}
+		})
+	}
+}
+
+// TestMessage_BodyTooLarge tests that a body longer than MaxBodySize is
+// searched in part and passed through whole
+func TestMessage_BodyTooLarge(t *testing.T) {
+	var seen []byte
+	chain := &FilterChain{MaxBodySize: 4, Filters: []Filter{
+		ScrubHeaders("Server"),
+		FilterFunc(func(m *Message) Action {
+			var err error
+			if seen, err = m.Body(); err != ErrBodyTooLarge {
+				t.Errorf("Expected ErrBodyTooLarge, got %v", err)
+			}
+			return Continue
+		}),
+	}}
+	_, addr := startServer(t, chain)
+	client := newClient(t, addr)
+
+	response, err := client.Respmod(context.Background(), &icapclient.HttpResponse{
+		Version: "HTTP/1.1", StatusCode: 200, Reason: "OK",
+		Headers: map[string]string{"Server": "nginx"},
+		Body:    []byte("hello world"),
+	})
+	if err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+	if string(seen) != "hell" {
+		t.Errorf("Expected filter to see 'hell', got %q", seen)
+	}
+	if response.HttpResponse == nil || string(response.HttpResponse.Body) != "hello world" {
+		t.Errorf("Expected body passed through whole, got %+v", response.HttpResponse)
+	}
+}
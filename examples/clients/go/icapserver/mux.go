@@ -0,0 +1,132 @@
+package icapserver
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service describes an ICAP service mounted on a ServeMux. The mux answers
+// OPTIONS for it from these fields and routes its REQMOD and RESPMOD
+// requests to Handler.
+type Service struct {
+	Handler Handler
+
+	// Methods lists the methods of the service, "REQMOD" and/or "RESPMOD"
+	Methods []string
+
+	// Description is sent as the Service header
+	Description string
+
+	// ISTag identifies the state of the service, sent on OPTIONS and on
+	// every response that does not set its own
+	ISTag string
+
+	// Preview is the number of bytes the client should send as a preview,
+	// zero for no preview
+	Preview int
+
+	// TransferPreview, TransferIgnore and TransferComplete list file
+	// extensions, or "*", sent as the Transfer-* headers
+	TransferPreview  []string
+	TransferIgnore   []string
+	TransferComplete []string
+
+	// OptionsTTL is how long clients may cache the OPTIONS response, zero
+	// for no Options-TTL header
+	OptionsTTL time.Duration
+
+	// MaxConnections is sent as Max-Connections when positive
+	MaxConnections int
+}
+
+// ServeMux routes ICAP requests to services by URL path, e.g. "/respmod"
+// for icap://host/respmod
+type ServeMux struct {
+	mu       sync.RWMutex
+	services map[string]*Service
+}
+
+// NewServeMux returns an empty ServeMux
+func NewServeMux() *ServeMux {
+	return &ServeMux{services: make(map[string]*Service)}
+}
+
+// Handle mounts service on path, replacing any service already there
+func (m *ServeMux) Handle(path string, service *Service) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.services[path] = service
+}
+
+// HandleFunc mounts handler on path for methods, with the default OPTIONS
+// answer of a Service
+func (m *ServeMux) HandleFunc(path string, handler func(w ResponseWriter, r *Request), methods ...string) {
+	m.Handle(path, &Service{Handler: HandlerFunc(handler), Methods: methods})
+}
+
+// Service returns the service mounted on path, or nil
+func (m *ServeMux) Service(path string) *Service {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.services[path]
+}
+
+// ServeICAP answers OPTIONS for the service of the request path and
+// dispatches other methods to its handler. Unknown services are answered
+// with 404 and unsupported methods with 405.
+func (m *ServeMux) ServeICAP(w ResponseWriter, r *Request) {
+	service := m.Service(r.URL.Path)
+	if service == nil {
+		w.WriteHeader(404, nil, false)
+		return
+	}
+	if service.ISTag != "" && w.Header().Get("ISTag") == "" {
+		w.Header().Set("ISTag", service.ISTag)
+	}
+
+	if r.Method == "OPTIONS" {
+		service.writeOptions(w)
+		return
+	}
+	for _, method := range service.Methods {
+		if strings.EqualFold(method, r.Method) {
+			service.Handler.ServeICAP(w, r)
+			return
+		}
+	}
+	w.WriteHeader(405, nil, false)
+}
+
+// writeOptions answers an OPTIONS request for the service
+func (s *Service) writeOptions(w ResponseWriter) {
+	header := w.Header()
+	header.Set("Methods", strings.Join(s.Methods, ", "))
+	header.Set("Allow", "204")
+	if s.Description != "" {
+		header.Set("Service", s.Description)
+	}
+	if s.Preview > 0 {
+		header.Set("Preview", strconv.Itoa(s.Preview))
+	}
+	for name, extensions := range map[string][]string{
+		"Transfer-Preview":  s.TransferPreview,
+		"Transfer-Ignore":   s.TransferIgnore,
+		"Transfer-Complete": s.TransferComplete,
+	} {
+		if len(extensions) > 0 {
+			header.Set(name, strings.Join(extensions, ", "))
+		}
+	}
+	if s.OptionsTTL > 0 {
+		header.Set("Options-TTL", strconv.Itoa(int(s.OptionsTTL/time.Second)))
+	}
+	if s.MaxConnections > 0 {
+		header.Set("Max-Connections", strconv.Itoa(s.MaxConnections))
+	}
+	w.WriteHeader(200, nil, false)
+}
@@ -0,0 +1,71 @@
+package icapserver
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestServeMux_Routing tests unknown services, unsupported methods and
+// OPTIONS answers
+func TestServeMux_Routing(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("respmod", &Service{
+		Methods:         []string{"RESPMOD"},
+		TransferPreview: []string{"*"},
+		TransferIgnore:  []string{"jpg", "png"},
+		MaxConnections:  10,
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			w.WriteHeader(204, nil, false)
+		}),
+	})
+	_, addr := startServer(t, mux)
+	conn, br := dialServer(t, addr)
+
+	tests := []struct {
+		name           string
+		request        string
+		expectedStatus string
+		expectedHeader map[string]string
+	}{
+		{"unknown service", "OPTIONS icap://127.0.0.1/missing ICAP/1.0\r\nEncapsulated: null-body=0\r\n\r\n", "ICAP/1.0 404 ICAP Service Not Found", nil},
+		{"unsupported method", "REQMOD icap://127.0.0.1/respmod ICAP/1.0\r\nEncapsulated: null-body=0\r\n\r\n", "ICAP/1.0 405 Method Not Allowed For Service", nil},
+		{"options", "OPTIONS icap://127.0.0.1/respmod ICAP/1.0\r\nEncapsulated: null-body=0\r\n\r\n", "ICAP/1.0 200 OK", map[string]string{
+			"Methods": "RESPMOD", "Allow": "204", "Transfer-Preview": "*", "Transfer-Ignore": "jpg, png", "Max-Connections": "10", "Preview": "",
+		}},
+		{"respmod", strings.Replace(previewRequest, "Preview: 4\r\n", "", 1), "ICAP/1.0 204 No Content", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			io.WriteString(conn, tt.request)
+			status, header := readStatus(t, br)
+			if status != tt.expectedStatus {
+				t.Errorf("Expected %q, got %q", tt.expectedStatus, status)
+			}
+			for name, value := range tt.expectedHeader {
+				if header.Get(name) != value {
+					t.Errorf("Expected %s %q, got %q", name, value, header.Get(name))
+				}
+			}
+		})
+	}
+}
+
+// TestHeader tests case-insensitive header access
+func TestHeader(t *testing.T) {
+	h := make(Header)
+	h.Set("ISTag", "a")
+	h.Set("istag", "b")
+
+	if len(h) != 1 || h["istag"] != "b" {
+		t.Errorf("Expected Set to replace case variants, got %v", h)
+	}
+	if h.Get("IsTag") != "b" {
+		t.Errorf("Expected case-insensitive Get, got %q", h.Get("IsTag"))
+	}
+	h.Del("ISTAG")
+	if len(h) != 0 {
+		t.Errorf("Expected Del to remove header, got %v", h)
+	}
+}
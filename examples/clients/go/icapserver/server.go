@@ -0,0 +1,925 @@
+// Package icapserver is a lightweight ICAP server for prototyping content
+// adaptation services in Go. It speaks RFC 3507 OPTIONS, REQMOD and RESPMOD
+// on persistent connections, streams chunked encapsulated bodies to the
+// handler and negotiates previews, asking the client for the rest of a body
+// only when the handler reads past the preview.
+package icapserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handler responds to an ICAP request
+type Handler interface {
+	ServeICAP(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeICAP calls f(w, r)
+func (f HandlerFunc) ServeICAP(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// Header holds ICAP headers. Names keep the spelling they were set or
+// received with (e.g. "ISTag"), while lookups are case-insensitive.
+type Header map[string]string
+
+// Get returns the value of the named header, ignoring case
+func (h Header) Get(name string) string {
+	if value, ok := h[name]; ok {
+		return value
+	}
+	for key, value := range h {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// Set sets the named header, replacing any value with a different case
+func (h Header) Set(name, value string) {
+	h.Del(name)
+	h[name] = value
+}
+
+// Del deletes the named header, ignoring case
+func (h Header) Del(name string) {
+	for key := range h {
+		if strings.EqualFold(key, name) {
+			delete(h, key)
+		}
+	}
+}
+
+// Request is an ICAP request received by the server
+type Request struct {
+	Method string
+	URL    *url.URL
+	Proto  string
+	Header Header
+
+	// Request and Response are the encapsulated HTTP messages, if present.
+	// The Body of the last one streams the encapsulated body.
+	Request  *http.Request
+	Response *http.Response
+
+	// Body streams the decoded encapsulated body, or is http.NoBody. When
+	// the client sent a preview, the preview bytes are returned first and
+	// reading past them asks the client for the rest with 100 Continue.
+	Body io.Reader
+
+	// Preview holds the preview bytes when the client sent a preview, and
+	// PreviewIEOF reports whether the preview contained the whole body
+	Preview     []byte
+	PreviewIEOF bool
+
+	// Allow204 reports whether the client accepts 204 No Content outside
+	// of a preview
+	Allow204 bool
+
+	RemoteAddr string
+
+	body *body
+}
+
+// ResponseWriter is used by a Handler to construct an ICAP response
+type ResponseWriter interface {
+	// Header returns the ICAP response headers to be sent by WriteHeader
+	Header() Header
+
+	// WriteHeader sends the ICAP status line and headers with an optional
+	// encapsulated *http.Request or *http.Response. When hasBody is set,
+	// the encapsulated body is sent with Write.
+	//
+	// A 204 No Content the client did not allow is sent as a 200 echoing
+	// the original message instead.
+	WriteHeader(code int, httpMessage interface{}, hasBody bool)
+
+	// Write sends encapsulated body data, calling WriteHeader(200, nil,
+	// false) first if needed
+	Write(p []byte) (int, error)
+}
+
+// Server serves ICAP requests with a Handler, usually a *ServeMux
+type Server struct {
+	// Addr is the TCP address to listen on, ":1344" if empty
+	Addr    string
+	Handler Handler
+
+	// ISTag is sent on every response that does not set its own
+	ISTag string
+
+	// TLSConfig, when set, makes ListenAndServe serve ICAPS
+	TLSConfig *tls.Config
+
+	// ReadTimeout bounds reading the headers of a request, IdleTimeout
+	// the wait for the next request on a persistent connection. Zero
+	// means no timeout.
+	ReadTimeout time.Duration
+	IdleTimeout time.Duration
+
+	// MaxHeaderBytes bounds the ICAP headers of a request and, separately,
+	// its encapsulated HTTP headers. DefaultMaxHeaderBytes if zero.
+	MaxHeaderBytes int
+
+	// Logger receives connection errors, slog.Default() when nil
+	Logger *slog.Logger
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*conn]struct{}
+	wg         sync.WaitGroup
+	shutdown   bool
+	numRequest int
+}
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown
+// or Close
+var ErrServerClosed = errors.New("icapserver: server closed")
+
+// DefaultMaxHeaderBytes is the MaxHeaderBytes of a server leaving it zero
+const DefaultMaxHeaderBytes = 64 << 10
+
+const (
+	// maxLineBytes bounds a request line, header line or chunk size line
+	maxLineBytes = 16 << 10
+	// maxPreviewBytes bounds the preview of a request, which is buffered
+	maxPreviewBytes = 1 << 20
+)
+
+// errTooLarge is wrapped by the errors of requests exceeding the limits of
+// the server, which are answered 400
+var errTooLarge = errors.New("request too large")
+
+// ListenAndServe listens on Addr and serves requests until the server is
+// shut down
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":1344"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is shut down
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[*conn]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if shutdown {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		c := &conn{server: s, nc: nc, br: bufio.NewReader(nc), bw: bufio.NewWriter(nc)}
+		s.mu.Lock()
+		if s.shutdown {
+			s.mu.Unlock()
+			nc.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go c.serve()
+	}
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for
+// active requests to complete, or for ctx to be done, before closing the
+// remaining connections
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		for c := range s.conns {
+			if c.isIdle() {
+				c.nc.Close()
+			}
+		}
+		remaining := len(s.conns)
+		s.mu.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the server immediately, closing all connections, and waits
+// for outstanding handlers to return
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.shutdown = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// Requests returns the number of requests served
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.numRequest
+}
+
+// maxHeaderBytes returns MaxHeaderBytes or its default
+func (s *Server) maxHeaderBytes() int {
+	if s.MaxHeaderBytes > 0 {
+		return s.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
+
+// logger returns the configured logger or the default one
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// conn is a client connection to the server
+type conn struct {
+	server *Server
+	nc     net.Conn
+	br     *bufio.Reader
+	bw     *bufio.Writer
+
+	mu     sync.Mutex
+	active bool
+}
+
+// isIdle reports whether the connection is waiting for a request
+func (c *conn) isIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.active
+}
+
+// setActive marks the connection as serving a request
+func (c *conn) setActive(active bool) {
+	c.mu.Lock()
+	c.active = active
+	c.mu.Unlock()
+}
+
+// serve serves requests on a persistent connection
+func (c *conn) serve() {
+	s := c.server
+	defer func() {
+		c.nc.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	for {
+		if s.IdleTimeout > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		if _, err := c.br.Peek(1); err != nil {
+			return
+		}
+		c.setActive(true)
+		if s.ReadTimeout > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+		}
+
+		req, err := c.readRequest()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger().Warn("Malformed ICAP request", "remote", c.nc.RemoteAddr().String(), "error", err.Error())
+				writeStatus(c.bw, 400, "Bad Request", Header{"Encapsulated": "null-body=0"})
+				c.bw.Flush()
+			}
+			return
+		}
+		c.nc.SetReadDeadline(time.Time{})
+
+		s.mu.Lock()
+		s.numRequest++
+		s.mu.Unlock()
+
+		w := &response{conn: c, req: req, header: make(Header), istag: s.ISTag}
+		c.serveRequest(w, req)
+		if err := w.finish(); err != nil {
+			return
+		}
+		// Leave the connection in sync for the next request
+		if req.body != nil && !req.body.inPreview {
+			if _, err := io.Copy(io.Discard, req.body); err != nil {
+				return
+			}
+		}
+		if err := c.bw.Flush(); err != nil {
+			return
+		}
+		c.setActive(false)
+
+		s.mu.Lock()
+		shutdown := s.shutdown
+		s.mu.Unlock()
+		if shutdown || strings.EqualFold(req.Header.Get("Connection"), "close") {
+			return
+		}
+	}
+}
+
+// serveRequest runs the handler, answering 500 if it panics
+func (c *conn) serveRequest(w *response, req *Request) {
+	defer func() {
+		if p := recover(); p != nil {
+			c.server.logger().Error("ICAP handler panicked", "method", req.Method, "uri", req.URL.String(), "panic", fmt.Sprint(p))
+			if !w.wroteHeader {
+				w.header = Header{}
+				w.WriteHeader(500, nil, false)
+			}
+		}
+	}()
+	if c.server.Handler == nil {
+		w.WriteHeader(404, nil, false)
+		return
+	}
+	c.server.Handler.ServeICAP(w, req)
+}
+
+// readRequest reads the headers of an ICAP request and its encapsulated
+// HTTP headers, and the preview if any. The body is left to be streamed.
+func (c *conn) readRequest() (*Request, error) {
+	line, err := readLine(c.br)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "ICAP/") {
+		return nil, fmt.Errorf("malformed request line %q", line)
+	}
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed request URI %q: %w", parts[1], err)
+	}
+	header, err := readHeader(c.br, c.server.maxHeaderBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{
+		Method:     parts[0],
+		URL:        u,
+		Proto:      parts[2],
+		Header:     header,
+		Body:       http.NoBody,
+		RemoteAddr: c.nc.RemoteAddr().String(),
+	}
+	for _, allow := range strings.Split(header.Get("Allow"), ",") {
+		if strings.TrimSpace(allow) == "204" {
+			req.Allow204 = true
+		}
+	}
+
+	sections, err := parseEncapsulated(header.Get("Encapsulated"))
+	if err != nil {
+		return nil, err
+	}
+	var reqHdr, resHdr []byte
+	hasBody := false
+	for i, section := range sections {
+		if strings.HasSuffix(section.name, "-body") {
+			hasBody = section.name != "null-body"
+			break
+		}
+		if i+1 >= len(sections) {
+			return nil, fmt.Errorf("encapsulated section %s has no end offset", section.name)
+		}
+		if limit := c.server.maxHeaderBytes(); sections[i+1].offset > limit {
+			return nil, fmt.Errorf("encapsulated headers longer than %d bytes: %w", limit, errTooLarge)
+		}
+		block := make([]byte, sections[i+1].offset-section.offset)
+		if _, err := io.ReadFull(c.br, block); err != nil {
+			return nil, err
+		}
+		switch section.name {
+		case "req-hdr":
+			reqHdr = block
+		case "res-hdr":
+			resHdr = block
+		}
+	}
+
+	if hasBody {
+		b := &body{br: c.br, bw: c.bw}
+		if header.Get("Preview") != "" {
+			preview, ieof, err := readChunked(c.br)
+			if err != nil {
+				return nil, err
+			}
+			req.Preview, req.PreviewIEOF = preview, ieof
+			b.preview, b.inPreview, b.ieof = preview, true, ieof
+		}
+		if !req.Allow204 {
+			b.record = &bytes.Buffer{}
+		}
+		req.body = b
+		req.Body = b
+	}
+
+	if reqHdr != nil {
+		httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqHdr)))
+		if err != nil {
+			return nil, fmt.Errorf("malformed encapsulated request: %w", err)
+		}
+		httpReq.Body = io.NopCloser(req.Body)
+		req.Request = httpReq
+	}
+	if resHdr != nil {
+		httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resHdr)), req.Request)
+		if err != nil {
+			return nil, fmt.Errorf("malformed encapsulated response: %w", err)
+		}
+		httpResp.Body = io.NopCloser(req.Body)
+		req.Response = httpResp
+		if req.Request != nil {
+			req.Request.Body = http.NoBody
+		}
+	}
+	return req, nil
+}
+
+// body streams a chunked encapsulated body, sending 100 Continue when it
+// is read past the preview
+type body struct {
+	br *bufio.Reader
+	bw *bufio.Writer
+
+	preview   []byte
+	inPreview bool
+	ieof      bool
+	remaining int64
+	eof       bool
+
+	// record keeps the bytes read, to echo the message back when the
+	// handler answers 204 to a client that does not allow it
+	record *bytes.Buffer
+}
+
+// Read implements io.Reader
+func (b *body) Read(p []byte) (int, error) {
+	if len(b.preview) > 0 {
+		n := copy(p, b.preview)
+		b.preview = b.preview[n:]
+		b.keep(p[:n])
+		return n, nil
+	}
+	if b.eof {
+		return 0, io.EOF
+	}
+	if b.inPreview {
+		if b.ieof {
+			b.eof = true
+			return 0, io.EOF
+		}
+		writeStatus(b.bw, 100, "Continue")
+		if err := b.bw.Flush(); err != nil {
+			return 0, err
+		}
+		b.inPreview = false
+	}
+
+	for b.remaining == 0 {
+		line, err := readLine(b.br)
+		if err != nil {
+			return 0, err
+		}
+		sizeText, _, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("malformed chunk size %q", line)
+		}
+		if size == 0 {
+			if err := skipTrailers(b.br); err != nil {
+				return 0, err
+			}
+			b.eof = true
+			return 0, io.EOF
+		}
+		b.remaining = size
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.br.Read(p)
+	b.remaining -= int64(n)
+	b.keep(p[:n])
+	if err == nil && b.remaining == 0 {
+		_, err = readLine(b.br)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// keep records data read by the handler when an echo may be needed
+func (b *body) keep(data []byte) {
+	if b.record != nil {
+		b.record.Write(data)
+	}
+}
+
+// response implements ResponseWriter
+type response struct {
+	conn        *conn
+	req         *Request
+	header      Header
+	istag       string
+	wroteHeader bool
+	chunked     bool
+}
+
+// Header returns the response headers
+func (r *response) Header() Header {
+	return r.header
+}
+
+// WriteHeader writes the ICAP response headers and encapsulated HTTP headers
+func (r *response) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
+	if r.wroteHeader {
+		return
+	}
+	if code == 204 && !r.may204() {
+		r.echo()
+		return
+	}
+	r.wroteHeader = true
+
+	var encapsulated bytes.Buffer
+	section := ""
+	switch msg := httpMessage.(type) {
+	case *http.Request:
+		section = "req"
+		writeHTTPRequestHeader(&encapsulated, msg)
+	case *http.Response:
+		section = "res"
+		writeHTTPResponseHeader(&encapsulated, msg)
+	}
+
+	if r.header.Get("ISTag") == "" && r.istag != "" {
+		r.header.Set("ISTag", r.istag)
+	}
+	if r.header.Get("Encapsulated") == "" {
+		switch {
+		case section == "":
+			r.header.Set("Encapsulated", "null-body=0")
+		case hasBody:
+			r.header.Set("Encapsulated", fmt.Sprintf("%s-hdr=0, %s-body=%d", section, section, encapsulated.Len()))
+		default:
+			r.header.Set("Encapsulated", fmt.Sprintf("%s-hdr=0, null-body=%d", section, encapsulated.Len()))
+		}
+	}
+	if r.header.Get("Date") == "" {
+		r.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	w := r.conn.bw
+	writeStatus(w, code, statusText(code), r.header)
+	w.Write(encapsulated.Bytes())
+	r.chunked = hasBody
+}
+
+// may204 reports whether a 204 No Content may be sent: when the client
+// allows it, or still waits after a preview
+func (r *response) may204() bool {
+	if r.req.Allow204 || r.req.body == nil {
+		return true
+	}
+	return r.req.body.inPreview
+}
+
+// echo answers with the original message, reading back what the handler
+// already consumed of the body
+func (r *response) echo() {
+	var message interface{}
+	switch {
+	case r.req.Response != nil:
+		message = r.req.Response
+	case r.req.Request != nil:
+		message = r.req.Request
+	}
+	hasBody := r.req.body != nil
+	r.WriteHeader(200, message, hasBody)
+	if !hasBody {
+		return
+	}
+
+	consumed := r.req.body.record.Bytes()
+	r.req.body.record = nil
+	r.Write(consumed)
+	io.Copy(writerOnly{r}, r.req.body)
+}
+
+// Write writes a chunk of the encapsulated body
+func (r *response) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(200, nil, false)
+	}
+	if !r.chunked {
+		return 0, errors.New("icapserver: response has no encapsulated body")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	w := r.conn.bw
+	fmt.Fprintf(w, "%x\r\n", len(p))
+	w.Write(p)
+	_, err := w.WriteString("\r\n")
+	return len(p), err
+}
+
+// finish completes the response: a handler that wrote nothing answers 204,
+// and the terminal chunk of the body is written
+func (r *response) finish() error {
+	if !r.wroteHeader {
+		r.WriteHeader(204, nil, false)
+	}
+	if r.chunked {
+		_, err := r.conn.bw.WriteString("0\r\n\r\n")
+		return err
+	}
+	return nil
+}
+
+// writerOnly hides the other methods of a writer from io.Copy
+type writerOnly struct {
+	io.Writer
+}
+
+// encapsulatedSection is an entry of the Encapsulated header
+type encapsulatedSection struct {
+	name   string
+	offset int
+}
+
+// parseEncapsulated parses an Encapsulated header value such as
+// "req-hdr=0, res-hdr=137, res-body=296"
+func parseEncapsulated(value string) ([]encapsulatedSection, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	var sections []encapsulatedSection
+	for _, part := range strings.Split(value, ",") {
+		name, offset, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed Encapsulated header %q", value)
+		}
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("malformed Encapsulated offset %q", part)
+		}
+		if len(sections) > 0 && n < sections[len(sections)-1].offset {
+			return nil, fmt.Errorf("decreasing Encapsulated offsets in %q", value)
+		}
+		sections = append(sections, encapsulatedSection{name: strings.ToLower(name), offset: n})
+	}
+	return sections, nil
+}
+
+// readLine reads a CRLF (or LF) terminated line of at most maxLineBytes
+func readLine(br *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		frag, err := br.ReadSlice('\n')
+		if len(line)+len(frag) > maxLineBytes {
+			return "", fmt.Errorf("line longer than %d bytes: %w", maxLineBytes, errTooLarge)
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// readHeader reads ICAP headers up to the blank line, at most limit bytes
+func readHeader(br *bufio.Reader, limit int) (Header, error) {
+	header := make(Header)
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return header, nil
+		}
+		if limit -= len(line) + 2; limit < 0 {
+			return nil, fmt.Errorf("headers too long: %w", errTooLarge)
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed header line %q", line)
+		}
+		header[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+}
+
+// readChunked reads a whole chunked body of at most maxPreviewBytes,
+// reporting whether the terminal chunk carried the ieof extension
+func readChunked(br *bufio.Reader) ([]byte, bool, error) {
+	var data []byte
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, false, err
+		}
+		sizeText, ext, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+		if err != nil || size < 0 {
+			return nil, false, fmt.Errorf("malformed chunk size %q", line)
+		}
+		if size == 0 {
+			if err := skipTrailers(br); err != nil {
+				return nil, false, err
+			}
+			return data, strings.TrimSpace(ext) == "ieof", nil
+		}
+		if size > int64(maxPreviewBytes-len(data)) {
+			return nil, false, fmt.Errorf("chunked body longer than %d bytes: %w", maxPreviewBytes, errTooLarge)
+		}
+
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, false, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+// skipTrailers skips the trailers after a terminal chunk up to the blank line
+func skipTrailers(br *bufio.Reader) error {
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+	}
+}
+
+// writeStatus writes an ICAP status line and headers
+func writeStatus(w *bufio.Writer, code int, reason string, headers ...Header) {
+	fmt.Fprintf(w, "ICAP/1.0 %d %s\r\n", code, reason)
+	for _, header := range headers {
+		for name, value := range header {
+			fmt.Fprintf(w, "%s: %s\r\n", name, value)
+		}
+	}
+	w.WriteString("\r\n")
+}
+
+// writeHTTPRequestHeader writes the header block of an encapsulated request
+func writeHTTPRequestHeader(w *bytes.Buffer, req *http.Request) {
+	uri := req.RequestURI
+	if uri == "" && req.URL != nil {
+		uri = req.URL.RequestURI()
+		if req.URL.IsAbs() {
+			uri = req.URL.String()
+		}
+	}
+	proto := req.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+
+	fmt.Fprintf(w, "%s %s %s\r\n", req.Method, uri, proto)
+	if req.Host != "" && req.Header.Get("Host") == "" {
+		fmt.Fprintf(w, "Host: %s\r\n", req.Host)
+	}
+	req.Header.Write(w)
+	w.WriteString("\r\n")
+}
+
+// writeHTTPResponseHeader writes the header block of an encapsulated response
+func writeHTTPResponseHeader(w *bytes.Buffer, resp *http.Response) {
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	status := resp.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	fmt.Fprintf(w, "%s %s\r\n", proto, status)
+	resp.Header.Write(w)
+	w.WriteString("\r\n")
+}
+
+// statusText returns the reason phrase for an ICAP status code
+func statusText(code int) string {
+	switch code {
+	case 100:
+		return "Continue"
+	case 204:
+		return "No Content"
+	case 206:
+		return "Partial Content"
+	case 400:
+		return "Bad Request"
+	case 404:
+		return "ICAP Service Not Found"
+	case 405:
+		return "Method Not Allowed For Service"
+	case 503:
+		return "Service Overloaded"
+	case 505:
+		return "ICAP Version Not Supported"
+	default:
+		return http.StatusText(code)
+	}
+}
@@ -0,0 +1,266 @@
+package icapserver
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// startServer serves handler on a loopback port and returns its address
+func startServer(t *testing.T, handler Handler) (*Server, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &Server{Handler: handler, ISTag: `"icapserver-1"`}
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+	return s, listener.Addr().String()
+}
+
+// dialServer connects to addr and returns the connection with a reader
+func dialServer(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// readStatus reads a response status line and headers
+func readStatus(t *testing.T, br *bufio.Reader) (string, Header) {
+	t.Helper()
+
+	status, err := readLine(br)
+	if err != nil {
+		t.Fatalf("Failed to read status line: %v", err)
+	}
+	header, err := readHeader(br, DefaultMaxHeaderBytes)
+	if err != nil {
+		t.Fatalf("Failed to read headers: %v", err)
+	}
+	return status, header
+}
+
+// newClient returns an ICAP client of the server at addr, using services
+// or sending OPTIONS to the /respmod service by default
+func newClient(t *testing.T, addr string, services ...icapclient.ServicesConfig) *icapclient.IcapClient {
+	t.Helper()
+
+	host, portText, _ := net.SplitHostPort(addr)
+	port, _ := net.LookupPort("tcp", portText)
+	paths := icapclient.ServicesConfig{Options: "/respmod"}
+	if len(services) > 0 {
+		paths = services[0]
+	}
+	client := icapclient.NewIcapClient(&icapclient.IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		KeepAlive:    true,
+		LoggingLevel: "ERROR",
+		Services:     paths,
+	})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// previewRequest is a RESPMOD request with a 4 byte preview of "hello world"
+const previewRequest = "RESPMOD icap://127.0.0.1/respmod ICAP/1.0\r\n" +
+	"Host: 127.0.0.1\r\n" +
+	"Allow: 204\r\n" +
+	"Preview: 4\r\n" +
+	"Encapsulated: res-hdr=0, res-body=19\r\n" +
+	"\r\n" +
+	"HTTP/1.1 200 OK\r\n\r\n" +
+	"4\r\nhell\r\n0\r\n\r\n"
+
+// TestServer_PreviewContinue tests that reading past the preview asks the
+// client for the rest of the body
+func TestServer_PreviewContinue(t *testing.T) {
+	received := make(chan string, 1)
+	_, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		body, err := io.ReadAll(r.Response.Body)
+		if err != nil {
+			t.Errorf("Failed to read body: %v", err)
+		}
+		received <- string(r.Preview) + "|" + string(body)
+		w.WriteHeader(204, nil, false)
+	}))
+	conn, br := dialServer(t, addr)
+
+	io.WriteString(conn, previewRequest)
+	if status, _ := readStatus(t, br); status != "ICAP/1.0 100 Continue" {
+		t.Fatalf("Expected 100 Continue, got %q", status)
+	}
+	io.WriteString(conn, "7\r\no world\r\n0\r\n\r\n")
+	status, header := readStatus(t, br)
+	if status != "ICAP/1.0 204 No Content" {
+		t.Errorf("Expected 204, got %q", status)
+	}
+	if header.Get("ISTag") != `"icapserver-1"` {
+		t.Errorf("Expected default ISTag, got %q", header.Get("ISTag"))
+	}
+	if got := <-received; got != "hell|hello world" {
+		t.Errorf("Expected preview 'hell' and body 'hello world', got %q", got)
+	}
+}
+
+// TestServer_PreviewDecline tests answering from the preview alone, and
+// that the connection stays usable for the next request
+func TestServer_PreviewDecline(t *testing.T) {
+	s, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.PreviewIEOF {
+			w.WriteHeader(200, r.Response, true)
+			w.Write(r.Preview)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	conn, br := dialServer(t, addr)
+
+	io.WriteString(conn, previewRequest)
+	if status, _ := readStatus(t, br); status != "ICAP/1.0 204 No Content" {
+		t.Fatalf("Expected 204 without 100 Continue, got %q", status)
+	}
+
+	io.WriteString(conn, strings.Replace(previewRequest, "0\r\n\r\n", "0; ieof\r\n\r\n", 1))
+	status, header := readStatus(t, br)
+	if status != "ICAP/1.0 200 OK" {
+		t.Fatalf("Expected 200 for the ieof preview, got %q", status)
+	}
+	sections, _ := parseEncapsulated(header.Get("Encapsulated"))
+	io.ReadFull(br, make([]byte, sections[1].offset))
+	if body, _, err := readChunked(br); err != nil || string(body) != "hell" {
+		t.Errorf("Expected body 'hell', got %q (%v)", body, err)
+	}
+	if s.Requests() != 2 {
+		t.Errorf("Expected 2 requests, got %d", s.Requests())
+	}
+}
+
+// TestServer_Echo204 tests that a 204 the client did not allow is sent as
+// an echo of the original message
+func TestServer_Echo204(t *testing.T) {
+	_, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.ReadFull(r.Body, make([]byte, 5))
+		w.WriteHeader(204, nil, false)
+	}))
+	conn, br := dialServer(t, addr)
+
+	request := strings.NewReplacer("Allow: 204\r\n", "", "Preview: 4\r\n", "", "4\r\nhell\r\n", "b\r\nhello world\r\n").Replace(previewRequest)
+	io.WriteString(conn, request)
+	status, header := readStatus(t, br)
+	if status != "ICAP/1.0 200 OK" {
+		t.Fatalf("Expected 200 echo, got %q", status)
+	}
+	sections, _ := parseEncapsulated(header.Get("Encapsulated"))
+	if len(sections) != 2 || sections[1].name != "res-body" {
+		t.Fatalf("Expected res-hdr and res-body, got %v", sections)
+	}
+	io.ReadFull(br, make([]byte, sections[1].offset))
+	if body, _, err := readChunked(br); err != nil || string(body) != "hello world" {
+		t.Errorf("Expected echoed body 'hello world', got %q (%v)", body, err)
+	}
+}
+
+// TestServer_MalformedRequest tests that malformed requests get 400
+func TestServer_MalformedRequest(t *testing.T) {
+	_, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		t.Error("Expected handler not to be called")
+	}))
+	conn, br := dialServer(t, addr)
+
+	io.WriteString(conn, "GARBAGE\r\n\r\n")
+	if status, _ := readStatus(t, br); status != "ICAP/1.0 400 Bad Request" {
+		t.Errorf("Expected 400, got %q", status)
+	}
+}
+
+// TestServer_OversizedRequest tests that requests exceeding the limits of
+// the server get 400 instead of being buffered
+func TestServer_OversizedRequest(t *testing.T) {
+	_, addr := startServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		t.Error("Expected handler not to be called")
+	}))
+
+	requests := map[string]string{
+		"Preview chunk": strings.Replace(previewRequest, "4\r\nhell\r\n", "7fffffffffffffff\r\nhell\r\n", 1),
+		"Encapsulated":  strings.Replace(previewRequest, "res-body=19", "res-body=9223372036854775807", 1),
+		"Line":          "OPTIONS icap://127.0.0.1/" + strings.Repeat("a", maxLineBytes) + " ICAP/1.0\r\n\r\n",
+		"Headers":       "OPTIONS icap://127.0.0.1/respmod ICAP/1.0\r\n" + strings.Repeat("X-Padding: "+strings.Repeat("a", 1000)+"\r\n", 100) + "\r\n",
+	}
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			conn, br := dialServer(t, addr)
+			io.WriteString(conn, request)
+			if status, _ := readStatus(t, br); status != "ICAP/1.0 400 Bad Request" {
+				t.Errorf("Expected 400, got %q", status)
+			}
+		})
+	}
+}
+
+// TestServer_Client tests the server end-to-end with the ICAP client
+func TestServer_Client(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/respmod", &Service{
+		Methods:     []string{"RESPMOD"},
+		Description: "uppercase",
+		ISTag:       `"upper-1"`,
+		Preview:     1024,
+		OptionsTTL:  time.Hour,
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			body, _ := io.ReadAll(r.Body)
+			resp := &http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/plain"}}}
+			w.WriteHeader(200, resp, true)
+			w.Write([]byte(strings.ToUpper(string(body))))
+		}),
+	})
+	mux.HandleFunc("/reqmod", func(w ResponseWriter, r *Request) {
+		w.WriteHeader(204, nil, false)
+	}, "REQMOD")
+	_, addr := startServer(t, mux)
+
+	client := newClient(t, addr)
+	ctx := context.Background()
+
+	options, err := client.Options(ctx)
+	if err != nil {
+		t.Fatalf("OPTIONS failed: %v", err)
+	}
+	if options.StatusCode != 200 || options.Headers["Methods"] != "RESPMOD" || options.Headers["Preview"] != "1024" ||
+		options.Headers["Options-TTL"] != "3600" || options.Headers["ISTag"] != `"upper-1"` {
+		t.Errorf("Unexpected OPTIONS response %d %v", options.StatusCode, options.Headers)
+	}
+
+	response, err := client.Respmod(ctx, &icapclient.HttpResponse{
+		Version: "HTTP/1.1", StatusCode: 200, Reason: "OK",
+		Headers: map[string]string{"Content-Type": "text/plain", "Content-Length": "5"},
+		Body:    []byte("hello"),
+	})
+	if err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+	if response.HttpResponse == nil || string(response.HttpResponse.Body) != "HELLO" {
+		t.Errorf("Expected adapted body HELLO, got %+v", response.HttpResponse)
+	}
+
+	response, err = client.Reqmod(ctx, &icapclient.HttpRequest{Method: "GET", URI: "http://example.com/", Version: "HTTP/1.1", Headers: map[string]string{"Host": "example.com"}})
+	if err != nil || response.StatusCode != 204 {
+		t.Errorf("Expected 204 for REQMOD, got %v (%v)", response, err)
+	}
+}
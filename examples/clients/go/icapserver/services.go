@@ -0,0 +1,77 @@
+package icapserver
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Built-in services to exercise clients deterministically. HandleBuiltins
+// mounts them on a ServeMux for REQMOD and RESPMOD.
+
+// EchoHandler returns a handler answering 200 with the encapsulated
+// message and body unchanged
+func EchoHandler() Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		var message interface{}
+		switch {
+		case r.Response != nil:
+			message = r.Response
+		case r.Request != nil:
+			message = r.Request
+		}
+		hasBody := r.body != nil
+		w.WriteHeader(200, message, hasBody)
+		if hasBody {
+			io.Copy(writerOnly{w}, r.Body)
+		}
+	})
+}
+
+// NoContentHandler returns a handler always answering 204 No Content, sent
+// as an echo to clients that do not allow 204
+func NoContentHandler() Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.WriteHeader(204, nil, false)
+	})
+}
+
+// BlockHandler returns a handler always answering with an HTTP block page
+// of status, e.g. 403, carrying reason in the X-Block-Reason ICAP header
+func BlockHandler(status int, reason string) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		writeBlockPage(w, &Message{Request: r, blockStatus: status, blockReason: reason})
+	})
+}
+
+// DelayHandler returns a handler calling next after waiting delay. A
+// "delay" query parameter of the ICAP URI overrides it for the request,
+// e.g. icap://host/delay?delay=250ms. A nil next answers 204.
+func DelayHandler(delay time.Duration, next Handler) Handler {
+	if next == nil {
+		next = NoContentHandler()
+	}
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		wait := delay
+		if value := r.URL.Query().Get("delay"); value != "" {
+			if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+				wait = d
+			}
+		}
+		time.Sleep(wait)
+		next.ServeICAP(w, r)
+	})
+}
+
+// HandleBuiltins mounts the built-in services for REQMOD and RESPMOD:
+//   - /echo answers 200 with the message unchanged
+//   - /always-204 answers 204 No Content
+//   - /always-block answers with a 403 block page
+//   - /delay answers 204 after one second, or the "delay" query parameter
+func (m *ServeMux) HandleBuiltins() {
+	methods := []string{"REQMOD", "RESPMOD"}
+	m.Handle("/echo", &Service{Handler: EchoHandler(), Methods: methods, Description: "echo"})
+	m.Handle("/always-204", &Service{Handler: NoContentHandler(), Methods: methods, Description: "always 204"})
+	m.Handle("/always-block", &Service{Handler: BlockHandler(http.StatusForbidden, "Blocked by always-block service"), Methods: methods, Description: "always block"})
+	m.Handle("/delay", &Service{Handler: DelayHandler(time.Second, nil), Methods: methods, Description: "delay"})
+}
@@ -0,0 +1,58 @@
+package icapserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	icapclient "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+)
+
+// TestHandleBuiltins tests the built-in services selected by path
+func TestHandleBuiltins(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleBuiltins()
+	_, addr := startServer(t, mux)
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+		expectedHTTP   int
+		minDuration    time.Duration
+	}{
+		{path: "/echo", expectedStatus: 200, expectedHTTP: 200},
+		{path: "/always-204", expectedStatus: 204},
+		{path: "/always-block", expectedStatus: 200, expectedHTTP: 403},
+		{path: "/delay?delay=100ms", expectedStatus: 204, minDuration: 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			client := newClient(t, addr, icapclient.ServicesConfig{Respmod: tt.path})
+			start := time.Now()
+			response, err := client.Respmod(context.Background(), &icapclient.HttpResponse{
+				Version: "HTTP/1.1", StatusCode: 200, Reason: "OK",
+				Headers: map[string]string{"Content-Type": "text/plain"},
+				Body:    []byte("hello world"),
+			})
+			if err != nil {
+				t.Fatalf("RESPMOD failed: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minDuration {
+				t.Errorf("Expected at least %v, answered in %v", tt.minDuration, elapsed)
+			}
+			if response.StatusCode != tt.expectedStatus {
+				t.Fatalf("Expected ICAP status %d, got %d", tt.expectedStatus, response.StatusCode)
+			}
+			if tt.expectedHTTP == 0 {
+				return
+			}
+			if response.HttpResponse == nil || response.HttpResponse.StatusCode != tt.expectedHTTP {
+				t.Fatalf("Expected HTTP status %d, got %+v", tt.expectedHTTP, response.HttpResponse)
+			}
+			if tt.expectedHTTP == 200 && string(response.HttpResponse.Body) != "hello world" {
+				t.Errorf("Expected echoed body, got %q", response.HttpResponse.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,748 @@
+// Package icaptest provides an ICAP server for tests, analogous to
+// net/http/httptest. It speaks enough of RFC 3507 (OPTIONS, REQMOD, RESPMOD,
+// previews and 204 responses) to exercise ICAP clients without a real
+// content adaptation appliance.
+package icaptest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handler responds to an ICAP request
+type Handler interface {
+	ServeICAP(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeICAP calls f(w, r)
+func (f HandlerFunc) ServeICAP(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// Header holds ICAP headers. Names keep the spelling they were set or
+// received with (e.g. "ISTag"), while lookups are case-insensitive.
+type Header map[string]string
+
+// Get returns the value of the named header, ignoring case
+func (h Header) Get(name string) string {
+	if value, ok := h[name]; ok {
+		return value
+	}
+	for key, value := range h {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// Set sets the named header, replacing any value with a different case
+func (h Header) Set(name, value string) {
+	h.Del(name)
+	h[name] = value
+}
+
+// Del deletes the named header, ignoring case
+func (h Header) Del(name string) {
+	for key := range h {
+		if strings.EqualFold(key, name) {
+			delete(h, key)
+		}
+	}
+}
+
+// Request is an ICAP request received by the server
+type Request struct {
+	Method string
+	URL    *url.URL
+	Proto  string
+	Header Header
+
+	// Request and Response are the encapsulated HTTP messages, if present.
+	// Their bodies hold the complete encapsulated body, including data
+	// received after a preview.
+	Request  *http.Request
+	Response *http.Response
+
+	// Preview holds the preview bytes when the client sent a preview, and
+	// PreviewIEOF reports whether the preview contained the whole body
+	Preview     []byte
+	PreviewIEOF bool
+
+	// Body is the decoded encapsulated body
+	Body []byte
+
+	RemoteAddr string
+}
+
+// ResponseWriter is used by a Handler to construct an ICAP response
+type ResponseWriter interface {
+	// Header returns the ICAP response headers to be sent by WriteHeader
+	Header() Header
+
+	// WriteHeader sends the ICAP status line and headers with an optional
+	// encapsulated *http.Request or *http.Response. When hasBody is set,
+	// the encapsulated body is sent with Write.
+	WriteHeader(code int, httpMessage interface{}, hasBody bool)
+
+	// Write sends encapsulated body data, calling WriteHeader(200, nil,
+	// false) first if needed
+	Write(p []byte) (int, error)
+}
+
+// Server is an ICAP server listening on a system-chosen port on the local
+// loopback interface, for use in end-to-end tests
+type Server struct {
+	// URL is the base URL of the form icap://ipaddr:port with no trailing slash
+	URL      string
+	Listener net.Listener
+
+	// TLS is the TLS configuration of a server started with StartTLS
+	TLS *tls.Config
+
+	// ContinueAfterPreview decides whether the server asks for the rest of
+	// the body after a preview (100 Continue) or answers 204 right away.
+	// When nil the server always continues.
+	ContinueAfterPreview func(r *Request) bool
+
+	// ISTag is sent on every response that does not set its own
+	ISTag string
+
+	handler    Handler
+	mu         sync.Mutex
+	conns      map[net.Conn]struct{}
+	wg         sync.WaitGroup
+	closed     bool
+	numConns   int
+	numRequest int
+}
+
+// NewServer starts and returns a new Server
+func NewServer(handler Handler) *Server {
+	s := NewUnstartedServer(handler)
+	s.Start()
+	return s
+}
+
+// NewTLSServer starts and returns a new Server speaking ICAPS with a
+// self-signed certificate for 127.0.0.1
+func NewTLSServer(handler Handler) *Server {
+	s := NewUnstartedServer(handler)
+	s.StartTLS()
+	return s
+}
+
+// NewUnstartedServer returns a new Server that is not yet listening
+func NewUnstartedServer(handler Handler) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("icaptest: failed to listen on a port: %v", err))
+	}
+
+	return &Server{
+		Listener: listener,
+		ISTag:    `"icaptest-1"`,
+		handler:  handler,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// Start starts the server
+func (s *Server) Start() {
+	s.URL = "icap://" + s.Listener.Addr().String()
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// StartTLS starts ICAPS on the server, generating a certificate unless
+// TLS already has one
+func (s *Server) StartTLS() {
+	if s.TLS == nil {
+		s.TLS = &tls.Config{}
+	}
+	if len(s.TLS.Certificates) == 0 {
+		s.TLS.Certificates = []tls.Certificate{newLocalhostCertificate()}
+	}
+
+	s.Listener = tls.NewListener(s.Listener, s.TLS)
+	s.URL = "icaps://" + s.Listener.Addr().String()
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Certificate returns the certificate used by a TLS server, or nil
+func (s *Server) Certificate() *x509.Certificate {
+	if s.TLS == nil || len(s.TLS.Certificates) == 0 {
+		return nil
+	}
+	return s.TLS.Certificates[0].Leaf
+}
+
+// HostPort returns the host and port the server is listening on
+func (s *Server) HostPort() (string, int) {
+	addr := s.Listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// Stats returns the number of accepted connections and served requests
+func (s *Server) Stats() (conns int, requests int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.numConns, s.numRequest
+}
+
+// Close shuts down the server, closing all connections, and waits for
+// outstanding handlers to return
+func (s *Server) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		s.Listener.Close()
+		for conn := range s.conns {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// CloseClientConnections closes any open connections to the server
+func (s *Server) CloseClientConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// serve accepts connections until the listener is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.numConns++
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn serves requests on a persistent connection
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+
+	for {
+		req, err := s.readRequest(br, bw)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !isClosedConnError(err) {
+				writeStatus(bw, 400, "Bad Request")
+				bw.Flush()
+			}
+			return
+		}
+		req.RemoteAddr = conn.RemoteAddr().String()
+
+		s.mu.Lock()
+		s.numRequest++
+		s.mu.Unlock()
+
+		w := &response{w: bw, header: make(Header), istag: s.ISTag}
+		if req.Preview != nil && !req.PreviewIEOF && req.Body == nil {
+			// The handler declined the rest of the body after the preview
+			w.header.Set("Encapsulated", "null-body=0")
+			w.WriteHeader(204, nil, false)
+		} else {
+			s.handler.ServeICAP(w, req)
+		}
+		if err := w.finish(); err != nil {
+			return
+		}
+		if err := bw.Flush(); err != nil {
+			return
+		}
+
+		if strings.EqualFold(req.Header.Get("Connection"), "close") {
+			return
+		}
+	}
+}
+
+// readRequest reads one ICAP request, handling the preview exchange
+func (s *Server) readRequest(br *bufio.Reader, bw *bufio.Writer) (*Request, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "ICAP/") {
+		return nil, fmt.Errorf("malformed request line %q", line)
+	}
+
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed request URI %q: %w", parts[1], err)
+	}
+
+	header, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{
+		Method: parts[0],
+		URL:    u,
+		Proto:  parts[2],
+		Header: header,
+	}
+
+	sections, err := parseEncapsulated(header.Get("Encapsulated"))
+	if err != nil {
+		return nil, err
+	}
+
+	var reqHdr, resHdr []byte
+	hasBody := false
+	for i, section := range sections {
+		if strings.HasSuffix(section.name, "-body") {
+			hasBody = section.name != "null-body"
+			break
+		}
+		if i+1 >= len(sections) {
+			return nil, fmt.Errorf("encapsulated section %s has no end offset", section.name)
+		}
+		if sections[i+1].offset > maxHeaderBytes {
+			return nil, fmt.Errorf("encapsulated headers longer than %d bytes: %w", maxHeaderBytes, errTooLarge)
+		}
+		block := make([]byte, sections[i+1].offset-section.offset)
+		if _, err := io.ReadFull(br, block); err != nil {
+			return nil, err
+		}
+		switch section.name {
+		case "req-hdr":
+			reqHdr = block
+		case "res-hdr":
+			resHdr = block
+		}
+	}
+
+	if hasBody {
+		if header.Get("Preview") != "" {
+			preview, ieof, err := readChunked(br)
+			if err != nil {
+				return nil, err
+			}
+			req.Preview = preview
+			req.PreviewIEOF = ieof
+			if ieof {
+				req.Body = preview
+			} else if s.ContinueAfterPreview == nil || s.ContinueAfterPreview(req) {
+				writeStatus(bw, 100, "Continue")
+				if err := bw.Flush(); err != nil {
+					return nil, err
+				}
+				rest, _, err := readChunked(br)
+				if err != nil {
+					return nil, err
+				}
+				req.Body = append(preview, rest...)
+			}
+		} else {
+			body, _, err := readChunked(br)
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+
+	if reqHdr != nil {
+		httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqHdr)))
+		if err != nil {
+			return nil, fmt.Errorf("malformed encapsulated request: %w", err)
+		}
+		httpReq.Body = io.NopCloser(bytes.NewReader(req.Body))
+		req.Request = httpReq
+	}
+	if resHdr != nil {
+		httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resHdr)), req.Request)
+		if err != nil {
+			return nil, fmt.Errorf("malformed encapsulated response: %w", err)
+		}
+		httpResp.Body = io.NopCloser(bytes.NewReader(req.Body))
+		req.Response = httpResp
+	}
+
+	return req, nil
+}
+
+// response implements ResponseWriter
+type response struct {
+	w           *bufio.Writer
+	header      Header
+	istag       string
+	wroteHeader bool
+	chunked     bool
+}
+
+// Header returns the response headers
+func (r *response) Header() Header {
+	return r.header
+}
+
+// WriteHeader writes the ICAP response headers and encapsulated HTTP headers
+func (r *response) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+
+	var encapsulated bytes.Buffer
+	section := ""
+	switch msg := httpMessage.(type) {
+	case *http.Request:
+		section = "req"
+		writeHTTPRequestHeader(&encapsulated, msg)
+	case *http.Response:
+		section = "res"
+		writeHTTPResponseHeader(&encapsulated, msg)
+	}
+
+	if r.header.Get("ISTag") == "" && r.istag != "" {
+		r.header.Set("ISTag", r.istag)
+	}
+	if r.header.Get("Encapsulated") == "" {
+		switch {
+		case section == "":
+			r.header.Set("Encapsulated", "null-body=0")
+		case hasBody:
+			r.header.Set("Encapsulated", fmt.Sprintf("%s-hdr=0, %s-body=%d", section, section, encapsulated.Len()))
+		default:
+			r.header.Set("Encapsulated", fmt.Sprintf("%s-hdr=0, null-body=%d", section, encapsulated.Len()))
+		}
+	}
+	if r.header.Get("Date") == "" {
+		r.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	writeStatus(r.w, code, statusText(code), r.header)
+	r.w.Write(encapsulated.Bytes())
+	r.chunked = hasBody
+}
+
+// Write writes a chunk of the encapsulated body
+func (r *response) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(200, nil, false)
+	}
+	if !r.chunked {
+		return 0, errors.New("icaptest: response has no encapsulated body")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	fmt.Fprintf(r.w, "%x\r\n", len(p))
+	r.w.Write(p)
+	_, err := r.w.WriteString("\r\n")
+	return len(p), err
+}
+
+// finish completes the response, writing the terminal chunk of the body
+func (r *response) finish() error {
+	if !r.wroteHeader {
+		r.WriteHeader(200, nil, false)
+	}
+	if r.chunked {
+		_, err := r.w.WriteString("0\r\n\r\n")
+		return err
+	}
+	return nil
+}
+
+// encapsulatedSection is an entry of the Encapsulated header
+type encapsulatedSection struct {
+	name   string
+	offset int
+}
+
+// parseEncapsulated parses an Encapsulated header value such as
+// "req-hdr=0, res-hdr=137, res-body=296"
+func parseEncapsulated(value string) ([]encapsulatedSection, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	var sections []encapsulatedSection
+	for _, part := range strings.Split(value, ",") {
+		name, offset, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed Encapsulated header %q", value)
+		}
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("malformed Encapsulated offset %q", part)
+		}
+		if len(sections) > 0 && n < sections[len(sections)-1].offset {
+			return nil, fmt.Errorf("decreasing Encapsulated offsets in %q", value)
+		}
+		sections = append(sections, encapsulatedSection{name: strings.ToLower(name), offset: n})
+	}
+	return sections, nil
+}
+
+// Limits of the requests read by the server, which answers 400 to larger
+// ones instead of buffering them
+const (
+	// maxLineBytes bounds a request line, header line or chunk size line
+	maxLineBytes = 16 << 10
+	// maxHeaderBytes bounds the ICAP headers and, separately, the
+	// encapsulated HTTP headers
+	maxHeaderBytes = 64 << 10
+	// maxBodyBytes bounds an encapsulated body, which is buffered
+	maxBodyBytes = 64 << 20
+)
+
+// errTooLarge is wrapped by the errors of requests exceeding the limits
+var errTooLarge = errors.New("icaptest: request too large")
+
+// readLine reads a CRLF (or LF) terminated line of at most maxLineBytes
+func readLine(br *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		frag, err := br.ReadSlice('\n')
+		if len(line)+len(frag) > maxLineBytes {
+			return "", fmt.Errorf("line longer than %d bytes: %w", maxLineBytes, errTooLarge)
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// readHeader reads ICAP headers up to the blank line, at most
+// maxHeaderBytes
+func readHeader(br *bufio.Reader) (Header, error) {
+	header := make(Header)
+	remaining := maxHeaderBytes
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return header, nil
+		}
+		if remaining -= len(line) + 2; remaining < 0 {
+			return nil, fmt.Errorf("headers too long: %w", errTooLarge)
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed header line %q", line)
+		}
+		header[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+}
+
+// readChunked reads a chunked body of at most maxBodyBytes up to the
+// terminal chunk, reporting whether the terminal chunk carried the ieof
+// extension
+func readChunked(br *bufio.Reader) ([]byte, bool, error) {
+	var body []byte
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, false, err
+		}
+
+		sizeText, ext, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+		if err != nil || size < 0 {
+			return nil, false, fmt.Errorf("malformed chunk size %q", line)
+		}
+
+		if size == 0 {
+			// Skip trailers up to the blank line
+			for {
+				trailer, err := readLine(br)
+				if err != nil {
+					return nil, false, err
+				}
+				if trailer == "" {
+					break
+				}
+			}
+			return body, strings.TrimSpace(ext) == "ieof", nil
+		}
+		if size > int64(maxBodyBytes-len(body)) {
+			return nil, false, fmt.Errorf("chunked body longer than %d bytes: %w", maxBodyBytes, errTooLarge)
+		}
+
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, false, err
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+// writeStatus writes an ICAP status line and headers
+func writeStatus(w *bufio.Writer, code int, reason string, headers ...Header) {
+	fmt.Fprintf(w, "ICAP/1.0 %d %s\r\n", code, reason)
+	for _, header := range headers {
+		for name, value := range header {
+			fmt.Fprintf(w, "%s: %s\r\n", name, value)
+		}
+	}
+	w.WriteString("\r\n")
+}
+
+// writeHTTPRequestHeader writes the header block of an encapsulated request
+func writeHTTPRequestHeader(w *bytes.Buffer, req *http.Request) {
+	uri := req.RequestURI
+	if uri == "" && req.URL != nil {
+		uri = req.URL.RequestURI()
+		if req.URL.IsAbs() {
+			uri = req.URL.String()
+		}
+	}
+	proto := req.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+
+	fmt.Fprintf(w, "%s %s %s\r\n", req.Method, uri, proto)
+	if req.Host != "" && req.Header.Get("Host") == "" {
+		fmt.Fprintf(w, "Host: %s\r\n", req.Host)
+	}
+	req.Header.Write(w)
+	w.WriteString("\r\n")
+}
+
+// writeHTTPResponseHeader writes the header block of an encapsulated response
+func writeHTTPResponseHeader(w *bytes.Buffer, resp *http.Response) {
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	status := resp.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	fmt.Fprintf(w, "%s %s\r\n", proto, status)
+	resp.Header.Write(w)
+	w.WriteString("\r\n")
+}
+
+// statusText returns the reason phrase for an ICAP status code
+func statusText(code int) string {
+	switch code {
+	case 100:
+		return "Continue"
+	case 204:
+		return "No Content"
+	case 206:
+		return "Partial Content"
+	case 400:
+		return "Bad Request"
+	case 404:
+		return "ICAP Service Not Found"
+	case 405:
+		return "Method Not Allowed For Service"
+	case 503:
+		return "Service Overloaded"
+	case 505:
+		return "ICAP Version Not Supported"
+	default:
+		return http.StatusText(code)
+	}
+}
+
+// isClosedConnError reports whether err comes from using a closed connection
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// newLocalhostCertificate creates a self-signed certificate for 127.0.0.1
+func newLocalhostCertificate() tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("icaptest: failed to generate key: %v", err))
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"icaptest"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(fmt.Sprintf("icaptest: failed to create certificate: %v", err))
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
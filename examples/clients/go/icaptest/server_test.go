@@ -0,0 +1,225 @@
+package icaptest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialServer connects to s and returns the connection with a reader
+func dialServer(t *testing.T, s *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// readStatus reads a response status line and headers
+func readStatus(t *testing.T, br *bufio.Reader) (string, Header) {
+	t.Helper()
+
+	status, err := readLine(br)
+	if err != nil {
+		t.Fatalf("Failed to read status line: %v", err)
+	}
+	header, err := readHeader(br)
+	if err != nil {
+		t.Fatalf("Failed to read headers: %v", err)
+	}
+	return status, header
+}
+
+// previewRequest is a RESPMOD request with a 4 byte preview of "hello world"
+const previewRequest = "RESPMOD icap://127.0.0.1/respmod ICAP/1.0\r\n" +
+	"Host: 127.0.0.1\r\n" +
+	"Allow: 204\r\n" +
+	"Preview: 4\r\n" +
+	"Encapsulated: res-hdr=0, res-body=19\r\n" +
+	"\r\n" +
+	"HTTP/1.1 200 OK\r\n\r\n" +
+	"4\r\nhell\r\n0\r\n\r\n"
+
+// TestServer_Preview tests the preview and 100 Continue exchange
+func TestServer_Preview(t *testing.T) {
+	received := make(chan *Request, 1)
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		received <- r
+		w.WriteHeader(204, nil, false)
+	}))
+	defer s.Close()
+
+	conn, br := dialServer(t, s)
+	defer conn.Close()
+
+	io.WriteString(conn, previewRequest)
+	if status, _ := readStatus(t, br); status != "ICAP/1.0 100 Continue" {
+		t.Fatalf("Expected 100 Continue, got %q", status)
+	}
+
+	io.WriteString(conn, "7\r\no world\r\n0\r\n\r\n")
+	status, header := readStatus(t, br)
+	if status != "ICAP/1.0 204 No Content" {
+		t.Errorf("Expected 204, got %q", status)
+	}
+	if header.Get("istag") != `"icaptest-1"` {
+		t.Errorf("Expected default ISTag, got %q", header.Get("ISTag"))
+	}
+
+	r := <-received
+	if string(r.Preview) != "hell" || r.PreviewIEOF {
+		t.Errorf("Expected preview 'hell' without ieof, got %q %v", r.Preview, r.PreviewIEOF)
+	}
+	if string(r.Body) != "hello world" {
+		t.Errorf("Expected full body 'hello world', got %q", r.Body)
+	}
+	if r.Response == nil || r.Response.StatusCode != 200 {
+		t.Errorf("Expected encapsulated 200 response, got %+v", r.Response)
+	}
+}
+
+// TestServer_PreviewIEOF tests a preview that contains the whole body
+func TestServer_PreviewIEOF(t *testing.T) {
+	received := make(chan *Request, 1)
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		received <- r
+		w.WriteHeader(204, nil, false)
+	}))
+	defer s.Close()
+
+	conn, br := dialServer(t, s)
+	defer conn.Close()
+
+	io.WriteString(conn, strings.Replace(previewRequest, "0\r\n\r\n", "0; ieof\r\n\r\n", 1))
+	if status, _ := readStatus(t, br); status != "ICAP/1.0 204 No Content" {
+		t.Fatalf("Expected 204 without 100 Continue, got %q", status)
+	}
+
+	r := <-received
+	if !r.PreviewIEOF || string(r.Body) != "hell" {
+		t.Errorf("Expected ieof preview as body, got %q %v", r.Body, r.PreviewIEOF)
+	}
+}
+
+// TestServer_ContinueAfterPreview tests answering 204 right after the preview
+func TestServer_ContinueAfterPreview(t *testing.T) {
+	called := false
+	s := NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		called = true
+	}))
+	s.ContinueAfterPreview = func(r *Request) bool { return false }
+	s.Start()
+	defer s.Close()
+
+	conn, br := dialServer(t, s)
+	defer conn.Close()
+
+	io.WriteString(conn, previewRequest)
+	if status, _ := readStatus(t, br); status != "ICAP/1.0 204 No Content" {
+		t.Fatalf("Expected 204 after preview, got %q", status)
+	}
+	if called {
+		t.Error("Expected handler not to be called")
+	}
+}
+
+// TestServer_EncapsulatedResponse tests writing an adapted HTTP response
+func TestServer_EncapsulatedResponse(t *testing.T) {
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.WriteHeader(200, r.Response, true)
+		w.Write([]byte("rewritten"))
+	}))
+	defer s.Close()
+
+	conn, br := dialServer(t, s)
+	defer conn.Close()
+
+	io.WriteString(conn, strings.Replace(previewRequest, "Preview: 4\r\n", "", 1))
+	status, header := readStatus(t, br)
+	if status != "ICAP/1.0 200 OK" {
+		t.Fatalf("Expected 200, got %q", status)
+	}
+
+	sections, err := parseEncapsulated(header.Get("Encapsulated"))
+	if err != nil || len(sections) != 2 || sections[1].name != "res-body" {
+		t.Fatalf("Expected res-hdr and res-body sections, got %v (%v)", sections, err)
+	}
+	httpHeader := make([]byte, sections[1].offset)
+	if _, err := io.ReadFull(br, httpHeader); err != nil {
+		t.Fatalf("Failed to read encapsulated header: %v", err)
+	}
+	if !strings.HasPrefix(string(httpHeader), "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("Expected encapsulated status line, got %q", httpHeader)
+	}
+	body, _, err := readChunked(br)
+	if err != nil || string(body) != "rewritten" {
+		t.Errorf("Expected body 'rewritten', got %q (%v)", body, err)
+	}
+}
+
+// TestServer_MalformedRequest tests that malformed requests get 400
+func TestServer_MalformedRequest(t *testing.T) {
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		t.Error("Expected handler not to be called")
+	}))
+	defer s.Close()
+
+	conn, br := dialServer(t, s)
+	defer conn.Close()
+
+	io.WriteString(conn, "GARBAGE\r\n\r\n")
+	if status, _ := readStatus(t, br); status != "ICAP/1.0 400 Bad Request" {
+		t.Errorf("Expected 400, got %q", status)
+	}
+}
+
+// TestServer_OversizedRequest tests that requests exceeding the limits of
+// the server get 400 instead of being buffered
+func TestServer_OversizedRequest(t *testing.T) {
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		t.Error("Expected handler not to be called")
+	}))
+	defer s.Close()
+
+	requests := map[string]string{
+		"Preview chunk": strings.Replace(previewRequest, "4\r\nhell\r\n", "7fffffffffffffff\r\nhell\r\n", 1),
+		"Encapsulated":  strings.Replace(previewRequest, "res-body=19", "res-body=9223372036854775807", 1),
+		"Line":          "OPTIONS icap://127.0.0.1/" + strings.Repeat("a", maxLineBytes) + " ICAP/1.0\r\n\r\n",
+	}
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			conn, br := dialServer(t, s)
+			defer conn.Close()
+
+			io.WriteString(conn, request)
+			if status, _ := readStatus(t, br); status != "ICAP/1.0 400 Bad Request" {
+				t.Errorf("Expected 400, got %q", status)
+			}
+		})
+	}
+}
+
+// TestHeader tests case-insensitive header access
+func TestHeader(t *testing.T) {
+	h := make(Header)
+	h.Set("ISTag", "a")
+	h.Set("istag", "b")
+
+	if len(h) != 1 || h["istag"] != "b" {
+		t.Errorf("Expected Set to replace case variants, got %v", h)
+	}
+	if h.Get("IsTag") != "b" {
+		t.Errorf("Expected case-insensitive Get, got %q", h.Get("IsTag"))
+	}
+
+	h.Del("ISTAG")
+	if len(h) != 0 {
+		t.Errorf("Expected Del to remove header, got %v", h)
+	}
+}
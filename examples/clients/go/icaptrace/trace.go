@@ -0,0 +1,120 @@
+// Package icaptrace provides hooks to trace the events of ICAP requests,
+// analogous to net/http/httptrace. A ClientTrace attached to the context of
+// a request is called as the client gets a connection, sends the request
+// and reads the response, so that APM agents can instrument the transport.
+package icaptrace
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"time"
+)
+
+// ClientTrace is a set of hooks run at the stages of an ICAP request. Any
+// hook may be nil. Hooks are called synchronously from the goroutine making
+// the request, once per attempt when the request is retried.
+type ClientTrace struct {
+	// GetConn is called before a connection is taken from the idle pool or
+	// dialed, with the host:port of the ICAP server
+	GetConn func(hostPort string)
+	// GotConn is called once a connection is obtained
+	GotConn func(GotConnInfo)
+	// DNSStart and DNSDone are called around the lookups of the DNS cache.
+	// Without it the dialer resolves the address as part of the connect.
+	DNSStart func(DNSStartInfo)
+	DNSDone  func(DNSDoneInfo)
+	// ConnectStart and ConnectDone are called around each TCP connect, to
+	// the proxy if one is configured
+	ConnectStart func(network, addr string)
+	ConnectDone  func(network, addr string, err error)
+	// TLSHandshakeStart and TLSHandshakeDone are called around the ICAPS
+	// handshake
+	TLSHandshakeStart func()
+	TLSHandshakeDone  func(tls.ConnectionState, error)
+	// WroteHeaders is called once the ICAP headers and the encapsulated
+	// HTTP headers are written, along with a body held in memory
+	WroteHeaders func()
+	// WroteRequest is called once the whole request, or its preview, is
+	// written and flushed
+	WroteRequest func(WroteRequestInfo)
+	// Got100Continue is called when the server asks for the rest of the
+	// body after a preview
+	Got100Continue func()
+	// GotFirstResponseByte is called when the first byte of the response
+	// arrives
+	GotFirstResponseByte func()
+}
+
+// GotConnInfo describes the connection of a request
+type GotConnInfo struct {
+	Conn net.Conn
+	// Reused reports whether the connection served earlier requests
+	Reused bool
+	// WasIdle reports whether the connection came from the idle pool, and
+	// IdleTime how long it was there
+	WasIdle  bool
+	IdleTime time.Duration
+}
+
+// DNSStartInfo describes a DNS lookup
+type DNSStartInfo struct {
+	Host string
+}
+
+// DNSDoneInfo describes the result of a DNS lookup
+type DNSDoneInfo struct {
+	Addrs []string
+	Err   error
+}
+
+// WroteRequestInfo describes the write of a request
+type WroteRequestInfo struct {
+	// Err is the error writing the request, if any
+	Err error
+}
+
+// clientTraceKey is the context key of the ClientTrace
+type clientTraceKey struct{}
+
+// ContextClientTrace returns the ClientTrace of ctx, or nil
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+// WithClientTrace returns a context tracing requests with trace. The hooks
+// of a ClientTrace already in ctx are called after those of trace.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	if trace == nil {
+		panic("nil trace")
+	}
+	if old := ContextClientTrace(ctx); old != nil {
+		trace = trace.compose(old)
+	}
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// compose returns a copy of t whose hooks also call those of old
+func (t *ClientTrace) compose(old *ClientTrace) *ClientTrace {
+	composed := *t
+	tv := reflect.ValueOf(&composed).Elem()
+	ov := reflect.ValueOf(old).Elem()
+	for i := 0; i < tv.NumField(); i++ {
+		hook, oldHook := tv.Field(i), ov.Field(i)
+		if oldHook.IsNil() {
+			continue
+		}
+		if hook.IsNil() {
+			hook.Set(oldHook)
+			continue
+		}
+		first := hook.Interface()
+		hook.Set(reflect.MakeFunc(hook.Type(), func(args []reflect.Value) []reflect.Value {
+			reflect.ValueOf(first).Call(args)
+			return oldHook.Call(args)
+		}))
+	}
+	return &composed
+}
@@ -0,0 +1,46 @@
+package icaptrace
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// TestWithClientTrace tests calling the hooks of nested traces, newest
+// first
+func TestWithClientTrace(t *testing.T) {
+	var calls []string
+	ctx := WithClientTrace(context.Background(), &ClientTrace{
+		GetConn:        func(hostPort string) { calls = append(calls, "outer GetConn "+hostPort) },
+		Got100Continue: func() { calls = append(calls, "outer Got100Continue") },
+	})
+	ctx = WithClientTrace(ctx, &ClientTrace{
+		GetConn:      func(hostPort string) { calls = append(calls, "inner GetConn "+hostPort) },
+		WroteHeaders: func() { calls = append(calls, "inner WroteHeaders") },
+	})
+
+	trace := ContextClientTrace(ctx)
+	trace.GetConn("icap.example.com:1344")
+	trace.WroteHeaders()
+	trace.Got100Continue()
+	if trace.GotFirstResponseByte != nil {
+		t.Errorf("Expected no GotFirstResponseByte hook")
+	}
+
+	expected := []string{
+		"inner GetConn icap.example.com:1344",
+		"outer GetConn icap.example.com:1344",
+		"inner WroteHeaders",
+		"outer Got100Continue",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected %v, got %v", expected, calls)
+	}
+}
+
+// TestContextClientTrace tests that a context without a trace has none
+func TestContextClientTrace(t *testing.T) {
+	if trace := ContextClientTrace(context.Background()); trace != nil {
+		t.Errorf("Expected no trace, got %+v", trace)
+	}
+}
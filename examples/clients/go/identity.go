@@ -0,0 +1,99 @@
+package icapclient
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// defaultUserAgent is the User-Agent template when identity.user_agent is
+// empty
+const defaultUserAgent = "G3ICAP-Go-Client/{{.Version}}"
+
+// IdentityConfig sets the headers identifying the client to the server, for
+// gateways applying policy by client identity. Values are Go templates over
+// the fields of IdentityInfo, e.g. "scanner/{{.Version}} ({{.Hostname}})".
+type IdentityConfig struct {
+	// UserAgent is the User-Agent header, "G3ICAP-Go-Client/{{.Version}}"
+	// if empty
+	UserAgent string `yaml:"user_agent" json:"user_agent"`
+	// Headers are sent with every request, e.g. X-Scan-Client
+	Headers map[string]string `yaml:"headers" json:"headers"`
+}
+
+// IdentityInfo is the data available to identity header templates
+type IdentityInfo struct {
+	// Version is the client version, set at build time with
+	// -ldflags "-X github.com/ByteDance/Arcus/g3icap/examples/clients/go.Version=..."
+	Version   string
+	GoVersion string
+	OS        string
+	Arch      string
+	Hostname  string
+}
+
+// identityInfo returns the data of the running client
+func identityInfo() IdentityInfo {
+	hostname, _ := os.Hostname()
+	return IdentityInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Hostname:  hostname,
+	}
+}
+
+// renderIdentity renders the identity headers, by name, and returns the
+// first error of a template that fails to parse or execute, or that renders
+// a value unfit for a header
+func renderIdentity(config IdentityConfig, info IdentityInfo) (map[string]string, error) {
+	headers := make(map[string]string, len(config.Headers)+1)
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	render := func(name, value string) error {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s template: %w", name, err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, info); err != nil {
+			return fmt.Errorf("invalid %s template: %w", name, err)
+		}
+		if strings.ContainsAny(b.String(), "\r\n") {
+			return fmt.Errorf("%s must not contain line breaks", name)
+		}
+		headers[name] = b.String()
+		return nil
+	}
+
+	if err := render("User-Agent", userAgent); err != nil {
+		return nil, err
+	}
+	for name, value := range config.Headers {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if err := render(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return headers, nil
+}
+
+// identityHeaders returns the rendered identity headers of config, falling
+// back to the default User-Agent alone when they fail to render
+func (c *IcapClient) identityHeaders(config *IcapConfig) map[string]string {
+	info := identityInfo()
+	headers, err := renderIdentity(config.Identity, info)
+	if err != nil {
+		c.logger.Warn("Failed to render identity headers, sending the default User-Agent", "error", err)
+		headers, _ = renderIdentity(IdentityConfig{}, info)
+	}
+	return headers
+}
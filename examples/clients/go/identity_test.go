@@ -0,0 +1,95 @@
+package icapclient
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestRenderIdentity tests rendering identity header templates
+func TestRenderIdentity(t *testing.T) {
+	info := IdentityInfo{Version: "2.1.0", GoVersion: "go1.21.0", OS: "linux", Arch: "amd64", Hostname: "scanner-7"}
+
+	tests := []struct {
+		name     string
+		config   IdentityConfig
+		expected map[string]string
+		err      string
+	}{
+		{"default", IdentityConfig{}, map[string]string{"User-Agent": "G3ICAP-Go-Client/2.1.0"}, ""},
+		{"user agent", IdentityConfig{UserAgent: "mail-gw/{{.Version}} ({{.OS}}/{{.Arch}})"},
+			map[string]string{"User-Agent": "mail-gw/2.1.0 (linux/amd64)"}, ""},
+		{"headers", IdentityConfig{Headers: map[string]string{"X-Scan-Client": "{{.Hostname}}", "X-Tenant": "acme"}},
+			map[string]string{"User-Agent": "G3ICAP-Go-Client/2.1.0", "X-Scan-Client": "scanner-7", "X-Tenant": "acme"}, ""},
+		{"unknown field", IdentityConfig{UserAgent: "{{.Release}}"}, nil, "invalid User-Agent template"},
+		{"parse error", IdentityConfig{Headers: map[string]string{"X-Scan-Client": "{{.Version"}}, nil, "invalid X-Scan-Client template"},
+		{"header name", IdentityConfig{Headers: map[string]string{"X Scan": "client"}}, nil, "invalid header name"},
+		{"line break", IdentityConfig{Headers: map[string]string{"X-Scan-Client": "a\r\nX-Injected: b"}}, nil, "must not contain line breaks"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers, err := renderIdentity(tt.config, info)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to render identity: %v", err)
+			}
+			if len(headers) != len(tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, headers)
+			}
+			for name, value := range tt.expected {
+				if headers[name] != value {
+					t.Errorf("Expected %s %q, got %q", name, value, headers[name])
+				}
+			}
+		})
+	}
+}
+
+// TestIcapClient_IdentityHeaders tests sending the configured identity
+// headers, and updating them on reload
+func TestIcapClient_IdentityHeaders(t *testing.T) {
+	headers := make(chan icaptest.Header, 1)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		headers <- r.Header
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	if _, err := client.Options(context.Background()); err != nil {
+		t.Fatalf("Options failed: %v", err)
+	}
+	if received := (<-headers).Get("User-Agent"); received != "G3ICAP-Go-Client/"+Version {
+		t.Errorf("Expected the default User-Agent, got %q", received)
+	}
+
+	changed := *client.config.Load()
+	changed.Identity = IdentityConfig{
+		UserAgent: "mail-gw/{{.Version}}",
+		Headers:   map[string]string{"X-Scan-Client": "mail-gw {{.GoVersion}}"},
+	}
+	if reloaded, _ := client.Reload(&changed); len(reloaded) != 1 || reloaded[0] != "identity" {
+		t.Fatalf("Expected identity to be reloaded, got %v", reloaded)
+	}
+	if _, err := client.Options(context.Background()); err != nil {
+		t.Fatalf("Options failed: %v", err)
+	}
+	received := <-headers
+	if userAgent := received.Get("User-Agent"); userAgent != "mail-gw/"+Version {
+		t.Errorf("Expected the configured User-Agent, got %q", userAgent)
+	}
+	if scanClient := received.Get("X-Scan-Client"); scanClient != "mail-gw "+runtime.Version() {
+		t.Errorf("Expected the configured X-Scan-Client, got %q", scanClient)
+	}
+}
@@ -0,0 +1,98 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+)
+
+// startPinger sends an OPTIONS request, encoded by encode, on every idle
+// connection that has been idle for interval, so that NAT and firewall idle
+// timeouts do not silently drop pooled connections. Connections that fail
+// the ping are closed. The pinger runs until stopPinger is called.
+func (t *icapTransport) startPinger(interval time.Duration, encode func(*bytes.Buffer)) {
+	if interval <= 0 {
+		return
+	}
+
+	t.pingStop = make(chan struct{})
+	t.pingDone = make(chan struct{})
+	go func() {
+		defer close(t.pingDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.pingStop:
+				return
+			case <-ticker.C:
+				t.pingIdle(interval, encode)
+			}
+		}
+	}()
+}
+
+// stopPinger stops the pinger and waits for a ping in progress
+func (t *icapTransport) stopPinger() {
+	if t.pingStop == nil {
+		return
+	}
+	close(t.pingStop)
+	<-t.pingDone
+	t.pingStop = nil
+}
+
+// pingIdle pings the connections idle for at least interval. They are taken
+// out of the pool while pinged, so requests never share them with a ping.
+func (t *icapTransport) pingIdle(interval time.Duration, encode func(*bytes.Buffer)) {
+	t.mu.Lock()
+	var due []*persistConn
+	kept := t.idle[:0]
+	for _, pc := range t.idle {
+		if time.Since(pc.idleAt) >= interval {
+			due = append(due, pc)
+		} else {
+			kept = append(kept, pc)
+		}
+	}
+	t.idle = kept
+	t.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	request := getBuffer()
+	defer putBuffer(request)
+	encode(request)
+
+	for _, pc := range due {
+		if err := t.ping(context.Background(), pc, request.Bytes()); err != nil {
+			pc.close(closeReasonError)
+			continue
+		}
+		t.putConn(pc)
+	}
+}
+
+// ping performs an OPTIONS exchange on pc
+func (t *icapTransport) ping(ctx context.Context, pc *persistConn, request []byte) error {
+	if timeout := t.getAttemptTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	response, err := t.exchange(ctx, pc, request, nil)
+	if err != nil {
+		return err
+	}
+	t.recordMaxConnections(response.Headers)
+	if response.StatusCode >= 400 {
+		return &IcapError{Message: "Keep-alive ping failed", Code: response.StatusCode}
+	}
+	if strings.EqualFold(headerValue(response.Headers, "Connection"), "close") {
+		return &IcapError{Message: "Keep-alive ping closed the connection"}
+	}
+	return nil
+}
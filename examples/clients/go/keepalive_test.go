@@ -0,0 +1,86 @@
+package icapclient
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestIcapClient_KeepAlivePing tests that idle connections are pinged and
+// stay in the pool
+func TestIcapClient_KeepAlivePing(t *testing.T) {
+	var pings atomic.Int32
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.Method == "OPTIONS" {
+			pings.Add(1)
+		}
+		testServerHandler(w, r)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host:          host,
+		Port:          port,
+		Timeout:       5 * time.Second,
+		KeepAlive:     true,
+		KeepAlivePing: 10 * time.Millisecond,
+		LoggingLevel:  "ERROR",
+	})
+	defer client.Close()
+
+	ctx := context.Background()
+	if _, err := client.Reqmod(ctx, &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}); err != nil {
+		t.Fatalf("Reqmod failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pings.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pings.Load() < 2 {
+		t.Fatalf("Expected repeated pings, got %d", pings.Load())
+	}
+
+	if _, err := client.Reqmod(ctx, &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}); err != nil {
+		t.Fatalf("Reqmod after pings failed: %v", err)
+	}
+	if conns, _ := server.Stats(); conns != 1 {
+		t.Errorf("Expected the pinged connection to be reused, got %d connections", conns)
+	}
+}
+
+// TestIcapTransport_PingFailure tests that connections failing a ping are
+// closed instead of being returned to the pool
+func TestIcapTransport_PingFailure(t *testing.T) {
+	var failPings atomic.Bool
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.Method == "OPTIONS" && failPings.Load() {
+			w.WriteHeader(500, nil, false)
+			return
+		}
+		testServerHandler(w, r)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	if _, err := client.Options(context.Background()); err != nil {
+		t.Fatalf("OPTIONS failed: %v", err)
+	}
+
+	client.transport.pingIdle(0, client.encodeOptionsRequest)
+	if n := len(client.transport.idle); n != 1 {
+		t.Fatalf("Expected a successful ping to keep the connection, got %d idle", n)
+	}
+
+	failPings.Store(true)
+	client.transport.pingIdle(0, client.encodeOptionsRequest)
+	if n := len(client.transport.idle); n != 0 {
+		t.Errorf("Expected a failed ping to close the connection, got %d idle", n)
+	}
+}
@@ -0,0 +1,46 @@
+package icapclient
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logger is the logging interface used by the client. Arguments are
+// alternating key/value pairs as in log/slog, so a *slog.Logger can be passed
+// directly and adapters for other logging libraries stay small.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// NewDefaultLogger creates the default structured JSON logger writing to stderr
+func NewDefaultLogger(level string) *slog.Logger {
+	return newLevelLogger(getLogLevel(level))
+}
+
+// newLevelLogger creates the default logger with a level that may be a
+// *slog.LevelVar, changed by config reloads
+func newLevelLogger(level slog.Leveler) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+	}))
+}
+
+// getLogLevel converts string to slog level
+func getLogLevel(level string) slog.Level {
+	switch strings.ToUpper(level) {
+	case "DEBUG":
+		return slog.LevelDebug
+	case "INFO":
+		return slog.LevelInfo
+	case "WARN", "WARNING":
+		return slog.LevelWarn
+	case "ERROR", "FATAL":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,66 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// TestGetLogLevel tests log level parsing
+func TestGetLogLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"debug":   slog.LevelDebug,
+		"INFO":    slog.LevelInfo,
+		"warning": slog.LevelWarn,
+		"ERROR":   slog.LevelError,
+		"FATAL":   slog.LevelError,
+		"":        slog.LevelInfo,
+	}
+
+	for level, expected := range tests {
+		if actual := getLogLevel(level); actual != expected {
+			t.Errorf("Expected level %v for %q, got %v", expected, level, actual)
+		}
+	}
+}
+
+// TestIcapClient_CustomLogger tests that an embedder-provided logger receives client logs
+func TestIcapClient_CustomLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil)).With("app", "embedder")
+
+	client := NewIcapClient(&IcapConfig{
+		Host:    "127.0.0.1",
+		Port:    1344,
+		Timeout: time.Second,
+		Logger:  logger,
+	})
+	client.Options(context.Background())
+	client.Close()
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) == 0 {
+		t.Fatal("Expected client logs in the custom logger")
+	}
+
+	messages := make(map[string]bool)
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("Expected JSON log line, got %s", line)
+		}
+		if entry["app"] != "embedder" {
+			t.Errorf("Expected embedder attributes on log line, got %s", line)
+		}
+		messages[entry["msg"].(string)] = true
+	}
+
+	for _, msg := range []string{"Sending OPTIONS request", "ICAP client closed"} {
+		if !messages[msg] {
+			t.Errorf("Expected log message %q", msg)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package icapclient
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// requestLabels are the dimensions of the per-request metrics
+var requestLabels = []string{"method", "status_class", "service", "host"}
+
+// timingLabels are the dimensions of the response time histogram
+var timingLabels = []string{"method", "service", "host"}
+
+// statusClassError labels requests that failed without an ICAP response
+const statusClassError = "error"
+
+// ClientMetrics represents client metrics
+type ClientMetrics struct {
+	RequestsTotal   *prometheus.CounterVec
+	RequestsSuccess *prometheus.CounterVec
+	RequestsFailed  *prometheus.CounterVec
+	ResponseTime    *prometheus.HistogramVec
+	ConnectionPool  prometheus.Gauge
+	TLSHandshakes   prometheus.Counter
+	TLSResumed      prometheus.Counter
+	ClockSkew       prometheus.Gauge
+	RetriesSkipped  *prometheus.CounterVec
+
+	ConnectionsOpen      prometheus.Gauge
+	ConnectionsOpened    prometheus.Counter
+	ConnectionsReused    prometheus.Counter
+	ConnectionsClosed    *prometheus.CounterVec
+	DialDuration         prometheus.Histogram
+	TLSHandshakeDuration prometheus.Histogram
+	PoolQueueDepth       prometheus.Gauge
+	PoolWaitDuration     prometheus.Histogram
+	RequestsInFlight     prometheus.Gauge
+	ThrottleWait         prometheus.Counter
+	ScanCacheLookups     *prometheus.CounterVec
+
+	BackendDown           prometheus.Gauge
+	BackendDownRejections prometheus.Counter
+
+	CleanFilterHits    prometheus.Counter
+	CleanFilterEntries prometheus.Gauge
+
+	PolicyDecisions     *prometheus.CounterVec
+	PolicyBypassedBytes *prometheus.CounterVec
+	FailOpen            *prometheus.CounterVec
+	FailClosed          *prometheus.CounterVec
+}
+
+// Reasons for closing a connection, labelling ConnectionsClosed
+const (
+	// closeReasonIdle is a connection idle for longer than the timeout
+	closeReasonIdle = "idle"
+	// closeReasonPoolFull is a connection returned to a full idle pool
+	closeReasonPoolFull = "pool_full"
+	// closeReasonMaxRequests is a connection that served
+	// max_requests_per_conn requests
+	closeReasonMaxRequests = "max_requests"
+	// closeReasonError is a connection whose exchange or ping failed
+	closeReasonError = "error"
+	// closeReasonServer is a connection the server asked to close
+	closeReasonServer = "server"
+	// closeReasonNoKeepAlive is a connection used once, keep_alive being off
+	closeReasonNoKeepAlive = "no_keep_alive"
+	// closeReasonShutdown is an idle connection closed with the client
+	closeReasonShutdown = "shutdown"
+)
+
+// NewClientMetrics creates new client metrics registered with registerer
+// (the default registry when nil) under an optional namespace. Metrics that
+// are already registered, e.g. by another client, are shared.
+func NewClientMetrics(registerer prometheus.Registerer, namespace string) *ClientMetrics {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	return &ClientMetrics{
+		RequestsTotal: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_requests_total",
+			Help:      "Total number of ICAP requests",
+		}, requestLabels)),
+		RequestsSuccess: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_requests_success_total",
+			Help:      "Total number of successful ICAP requests",
+		}, requestLabels)),
+		RequestsFailed: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_requests_failed_total",
+			Help:      "Total number of failed ICAP requests",
+		}, requestLabels)),
+		ResponseTime: registerCollector(registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "icap_client_response_time_seconds",
+			Help:      "ICAP client response time in seconds",
+			Buckets:   prometheus.DefBuckets,
+		}, timingLabels)),
+		ConnectionPool: registerCollector(registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icap_client_connection_pool_size",
+			Help:      "ICAP client connection pool size",
+		})),
+		TLSHandshakes: registerCollector(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_tls_handshakes_total",
+			Help:      "Total number of completed ICAPS handshakes",
+		})),
+		TLSResumed: registerCollector(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_tls_resumed_total",
+			Help:      "Total number of ICAPS handshakes that resumed a cached session",
+		})),
+		ClockSkew: registerCollector(registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icap_client_clock_skew_seconds",
+			Help:      "Server clock less the local clock, from the Date of the last ICAP response",
+		})),
+		RetriesSkipped: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_retries_skipped_total",
+			Help:      "Total number of retries skipped, by reason: deadline or budget",
+		}, []string{"reason"})),
+		ConnectionsOpen: registerCollector(registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icap_client_connections_open",
+			Help:      "Number of connections open to the ICAP server, idle or in use",
+		})),
+		ConnectionsOpened: registerCollector(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_connections_opened_total",
+			Help:      "Total number of connections opened to the ICAP server",
+		})),
+		ConnectionsReused: registerCollector(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_connections_reused_total",
+			Help:      "Total number of requests sent on an idle pooled connection",
+		})),
+		ConnectionsClosed: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_connections_closed_total",
+			Help:      "Total number of connections closed, by reason: idle, pool_full, max_requests, error, server, no_keep_alive or shutdown",
+		}, []string{"reason"})),
+		DialDuration: registerCollector(registerer, prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "icap_client_dial_duration_seconds",
+			Help:      "Time to open a connection to the ICAP server, including DNS, proxy and TLS",
+			Buckets:   prometheus.DefBuckets,
+		})),
+		TLSHandshakeDuration: registerCollector(registerer, prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "icap_client_tls_handshake_duration_seconds",
+			Help:      "ICAPS handshake time in seconds",
+			Buckets:   prometheus.DefBuckets,
+		})),
+		PoolQueueDepth: registerCollector(registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icap_client_pool_queue_depth",
+			Help:      "Number of requests waiting for a connection or a request slot",
+		})),
+		PoolWaitDuration: registerCollector(registerer, prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "icap_client_pool_wait_seconds",
+			Help:      "Time requests waited for a connection or a request slot, when all were busy",
+			Buckets:   prometheus.DefBuckets,
+		})),
+		RequestsInFlight: registerCollector(registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icap_client_requests_in_flight",
+			Help:      "Number of requests in flight, counted against max_concurrent_requests",
+		})),
+		ThrottleWait: registerCollector(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_throttle_wait_seconds_total",
+			Help:      "Time requests spent waiting for bandwidth under the throttle limits",
+		})),
+		ScanCacheLookups: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_scan_cache_lookups_total",
+			Help:      "Lookups of the scan cache by result, hit or miss",
+		}, []string{"result"})),
+		BackendDown: registerCollector(registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icap_client_backend_down",
+			Help:      "1 while connect failures mark the ICAP server down, 0 otherwise",
+		})),
+		BackendDownRejections: registerCollector(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_backend_down_rejections_total",
+			Help:      "Connects failed at once because the ICAP server was marked down",
+		})),
+		CleanFilterHits: registerCollector(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_clean_filter_hits_total",
+			Help:      "Bodies answered 204 without scanning, their hash being in the clean filter",
+		})),
+		CleanFilterEntries: registerCollector(registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icap_client_clean_filter_entries",
+			Help:      "Number of hashes in the clean filter",
+		})),
+		PolicyDecisions: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_policy_decisions_total",
+			Help:      "Decisions of the client policy by action, scan, bypass or block",
+		}, []string{"action"})),
+		PolicyBypassedBytes: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_policy_bypassed_bytes_total",
+			Help:      "Body bytes not scanned under the client policy by action, bypass or preview",
+		}, []string{"action"})),
+		FailOpen: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_fail_open_total",
+			Help:      "Messages allowed unscanned because the ICAP server failed, by method",
+		}, []string{"method"})),
+		FailClosed: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "icap_client_fail_closed_total",
+			Help:      "Messages blocked because the ICAP server failed, by method",
+		}, []string{"method"})),
+	}
+}
+
+// registerCollector registers collector, returning the existing collector
+// instead if an identical one was registered before
+func registerCollector[T prometheus.Collector](registerer prometheus.Registerer, collector T) T {
+	if err := registerer.Register(collector); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			if existing, ok := alreadyRegistered.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return collector
+}
+
+// statusClass returns the status class label for an ICAP status code, e.g. "2xx"
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return statusClassError
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// serviceLabels splits an ICAP URL into its service path and target host labels
+func serviceLabels(icapURL string) (string, string) {
+	u, err := url.Parse(icapURL)
+	if err != nil {
+		return icapURL, ""
+	}
+	return u.Path, u.Host
+}
+
+// observeResponse records a request that received an ICAP response
+func (m *ClientMetrics) observeResponse(method IcapMethod, icapURL string, statusCode int, responseTime time.Duration, requestID string) {
+	service, host := serviceLabels(icapURL)
+	class := statusClass(statusCode)
+
+	m.RequestsTotal.WithLabelValues(string(method), class, service, host).Inc()
+	observer := m.ResponseTime.WithLabelValues(string(method), service, host)
+	if exemplar, ok := observer.(prometheus.ExemplarObserver); ok && validExemplarValue(requestID) {
+		exemplar.ObserveWithExemplar(responseTime.Seconds(), prometheus.Labels{"request_id": requestID})
+	} else {
+		observer.Observe(responseTime.Seconds())
+	}
+	if statusCode < 400 {
+		m.RequestsSuccess.WithLabelValues(string(method), class, service, host).Inc()
+	} else {
+		m.RequestsFailed.WithLabelValues(string(method), class, service, host).Inc()
+	}
+}
+
+// observeFailure records a request that failed without an ICAP response
+func (m *ClientMetrics) observeFailure(method IcapMethod, icapURL string) {
+	service, host := serviceLabels(icapURL)
+	m.RequestsFailed.WithLabelValues(string(method), statusClassError, service, host).Inc()
+}
+
+// observeConnOpened records a connection opened after dialing for dial
+func (m *ClientMetrics) observeConnOpened(dial time.Duration) {
+	m.ConnectionsOpened.Inc()
+	m.ConnectionsOpen.Inc()
+	m.DialDuration.Observe(dial.Seconds())
+}
+
+// observeConnClosed records a connection closed for reason
+func (m *ClientMetrics) observeConnClosed(reason string) {
+	m.ConnectionsOpen.Dec()
+	m.ConnectionsClosed.WithLabelValues(reason).Inc()
+}
+
+// validExemplarValue reports whether a request ID fits in an exemplar, whose
+// labels are limited to 128 UTF-8 runes in total
+func validExemplarValue(value string) bool {
+	return value != "" && len(value) <= 64 && utf8.ValidString(value)
+}
@@ -0,0 +1,179 @@
+package icapclient
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestStatusClass tests status class labels
+func TestStatusClass(t *testing.T) {
+	tests := map[int]string{
+		100: "1xx",
+		204: "2xx",
+		404: "4xx",
+		503: "5xx",
+		0:   statusClassError,
+		999: statusClassError,
+	}
+
+	for code, expected := range tests {
+		if class := statusClass(code); class != expected {
+			t.Errorf("Expected status class %s for %d, got %s", expected, code, class)
+		}
+	}
+}
+
+// TestClientMetrics_Labels tests that request metrics are broken down per backend
+func TestClientMetrics_Labels(t *testing.T) {
+	metrics := &ClientMetrics{
+		RequestsTotal:   prometheus.NewCounterVec(prometheus.CounterOpts{Name: "total"}, requestLabels),
+		RequestsSuccess: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "success"}, requestLabels),
+		RequestsFailed:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "failed"}, requestLabels),
+		ResponseTime:    prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "time"}, timingLabels),
+	}
+
+	metrics.observeResponse(RESPMOD, "icap://av1:1344/respmod", 204, time.Millisecond, "req-1")
+	metrics.observeResponse(RESPMOD, "icap://av1:1344/respmod", 500, time.Millisecond, "")
+	metrics.observeResponse(REQMOD, "icap://av2:1344/reqmod", 200, time.Millisecond, strings.Repeat("x", 200))
+	metrics.observeFailure(REQMOD, "icap://av2:1344/reqmod")
+
+	if v := testutil.ToFloat64(metrics.RequestsTotal.WithLabelValues("RESPMOD", "2xx", "/respmod", "av1:1344")); v != 1 {
+		t.Errorf("Expected 1 successful RESPMOD on av1, got %v", v)
+	}
+	if v := testutil.ToFloat64(metrics.RequestsFailed.WithLabelValues("RESPMOD", "5xx", "/respmod", "av1:1344")); v != 1 {
+		t.Errorf("Expected 1 failed RESPMOD on av1, got %v", v)
+	}
+	if v := testutil.ToFloat64(metrics.RequestsSuccess.WithLabelValues("REQMOD", "2xx", "/reqmod", "av2:1344")); v != 1 {
+		t.Errorf("Expected 1 successful REQMOD on av2, got %v", v)
+	}
+	if v := testutil.ToFloat64(metrics.RequestsFailed.WithLabelValues("REQMOD", statusClassError, "/reqmod", "av2:1344")); v != 1 {
+		t.Errorf("Expected 1 transport failure on av2, got %v", v)
+	}
+	if n := testutil.CollectAndCount(metrics.ResponseTime); n != 2 {
+		t.Errorf("Expected 2 response time series, got %d", n)
+	}
+}
+
+// TestNewClientMetrics_Registerer tests registration into an injected registry
+func TestNewClientMetrics_Registerer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	first := NewClientMetrics(registry, "app")
+	second := NewClientMetrics(registry, "app")
+
+	if first.RequestsTotal != second.RequestsTotal {
+		t.Error("Expected clients sharing a registry to share collectors")
+	}
+
+	first.observeFailure(OPTIONS, "icap://127.0.0.1:1344/options")
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+
+	found := false
+	for _, family := range families {
+		if family.GetName() == "app_icap_client_requests_failed_total" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected namespaced metric app_icap_client_requests_failed_total")
+	}
+
+	// Separate registries keep clients independent
+	other := NewClientMetrics(prometheus.NewRegistry(), "app")
+	if other.RequestsTotal == first.RequestsTotal {
+		t.Error("Expected separate registries to use separate collectors")
+	}
+}
+
+// TestClientMetrics_RequestIDExemplar tests that response times carry the
+// request ID as an exemplar
+func TestClientMetrics_RequestIDExemplar(t *testing.T) {
+	metrics := &ClientMetrics{
+		RequestsTotal:   prometheus.NewCounterVec(prometheus.CounterOpts{Name: "total"}, requestLabels),
+		RequestsSuccess: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "success"}, requestLabels),
+		RequestsFailed:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "failed"}, requestLabels),
+		ResponseTime:    prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "time"}, timingLabels),
+	}
+	metrics.observeResponse(RESPMOD, "icap://av1:1344/respmod", 204, time.Millisecond, "req-1")
+
+	var metric dto.Metric
+	if err := metrics.ResponseTime.WithLabelValues("RESPMOD", "/respmod", "av1:1344").(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatalf("Failed to collect histogram: %v", err)
+	}
+	var found bool
+	for _, bucket := range metric.GetHistogram().GetBucket() {
+		for _, label := range bucket.GetExemplar().GetLabel() {
+			if label.GetName() == "request_id" && label.GetValue() == "req-1" {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected an exemplar with request_id req-1, got %v", metric.GetHistogram())
+	}
+}
+
+// TestIcapClient_ConnectionMetrics tests counting connections opened,
+// reused and closed by reason
+func TestIcapClient_ConnectionMetrics(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host:               host,
+		Port:               port,
+		Timeout:            5 * time.Second,
+		ConnectionPoolSize: 1,
+		KeepAlive:          true,
+		MaxRequestsPerConn: 2,
+		LoggingLevel:       "ERROR",
+		MetricsEnabled:     true,
+		MetricsRegisterer:  prometheus.NewRegistry(),
+	})
+	metrics := client.metrics
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Options(context.Background()); err != nil {
+			t.Fatalf("OPTIONS %d failed: %v", i, err)
+		}
+	}
+	if v := testutil.ToFloat64(metrics.ConnectionsOpened); v != 2 {
+		t.Errorf("Expected 2 connections opened, got %v", v)
+	}
+	if v := testutil.ToFloat64(metrics.ConnectionsReused); v != 1 {
+		t.Errorf("Expected 1 connection reused, got %v", v)
+	}
+	if v := testutil.ToFloat64(metrics.ConnectionsClosed.WithLabelValues(closeReasonMaxRequests)); v != 1 {
+		t.Errorf("Expected 1 connection closed after max requests, got %v", v)
+	}
+	if v := testutil.ToFloat64(metrics.ConnectionsOpen); v != 1 {
+		t.Errorf("Expected 1 open connection, got %v", v)
+	}
+
+	client.Close()
+	if v := testutil.ToFloat64(metrics.ConnectionsClosed.WithLabelValues(closeReasonShutdown)); v != 1 {
+		t.Errorf("Expected 1 connection closed on shutdown, got %v", v)
+	}
+	if v := testutil.ToFloat64(metrics.ConnectionsOpen); v != 0 {
+		t.Errorf("Expected no open connection, got %v", v)
+	}
+
+	var metric dto.Metric
+	if err := metrics.DialDuration.Write(&metric); err != nil {
+		t.Fatalf("Failed to collect histogram: %v", err)
+	}
+	if observed := metric.GetHistogram().GetSampleCount(); observed != 2 {
+		t.Errorf("Expected 2 dial durations, got %d", observed)
+	}
+}
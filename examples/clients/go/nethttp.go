@@ -0,0 +1,118 @@
+package icapclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ApplyToRequest rewrites req as the adapted request of r: its method, URL,
+// headers and body. The body is read into memory, releasing a spooled body,
+// so that req.GetBody can replay it. It is a no-op when r carries no
+// adapted request, e.g. a 204 or a block page.
+func (r *IcapResponse) ApplyToRequest(req *http.Request) error {
+	adapted := r.HttpRequest
+	if adapted == nil {
+		return nil
+	}
+	target, err := req.URL.Parse(adapted.URI)
+	if err != nil {
+		return fmt.Errorf("invalid adapted request URI %q: %w", adapted.URI, err)
+	}
+	body := adapted.Body
+	if adapted.BodyReader != nil {
+		body, err = io.ReadAll(adapted.BodyReader)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read adapted request body: %w", err)
+		}
+	}
+
+	req.Method = adapted.Method
+	req.URL = target
+	req.RequestURI = ""
+	req.Header = toHTTPHeader(adapted.Headers)
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	req.Body = newHTTPBody(body)
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) { return newHTTPBody(body), nil }
+	return nil
+}
+
+// ApplyToResponse rewrites resp as the adapted response of r, or as the
+// block page answering an adapted request: its status, headers and body.
+// The previous body of resp is closed, and closing the new one releases a
+// spooled body. It is a no-op when r carries no adapted response.
+func (r *IcapResponse) ApplyToResponse(resp *http.Response) {
+	adapted := r.HttpResponse
+	if adapted == nil {
+		return
+	}
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+
+	reason := adapted.Reason
+	if reason == "" {
+		reason = http.StatusText(adapted.StatusCode)
+	}
+	resp.Status = strconv.Itoa(adapted.StatusCode) + " " + reason
+	resp.StatusCode = adapted.StatusCode
+	if resp.ProtoMajor == 0 {
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	resp.Header = toHTTPHeader(adapted.Headers)
+	resp.Trailer = nil
+	if len(adapted.Trailer) > 0 {
+		resp.Trailer = toHTTPHeader(adapted.Trailer)
+	}
+	resp.TransferEncoding = nil
+	resp.Uncompressed = false
+
+	if adapted.BodyReader != nil {
+		resp.Body = &adaptedBody{Reader: adapted.BodyReader, response: r}
+		resp.ContentLength = -1
+	} else {
+		resp.Body = &adaptedBody{Reader: bytes.NewReader(adapted.Body), response: r}
+		resp.ContentLength = int64(len(adapted.Body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(adapted.Body)))
+	}
+}
+
+// adaptedBody is the body of an http.Response rewritten by ApplyToResponse
+type adaptedBody struct {
+	io.Reader
+	response *IcapResponse
+}
+
+// Close releases the spool file of the ICAP response, if any
+func (b *adaptedBody) Close() error {
+	return b.response.Close()
+}
+
+// toHTTPHeader converts client headers to an http.Header, dropping the
+// framing headers that no longer describe the adapted body
+func toHTTPHeader(headers map[string]string) http.Header {
+	header := make(http.Header, len(headers))
+	for name, value := range headers {
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+			continue
+		}
+		header.Set(name, value)
+	}
+	return header
+}
+
+// newHTTPBody returns a request body reading body
+func newHTTPBody(body []byte) io.ReadCloser {
+	if len(body) == 0 {
+		return http.NoBody
+	}
+	return io.NopCloser(bytes.NewReader(body))
+}
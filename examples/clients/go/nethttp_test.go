@@ -0,0 +1,107 @@
+package icapclient
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestIcapResponse_ApplyToRequest tests rewriting an http.Request as the
+// adapted request
+func TestIcapResponse_ApplyToRequest(t *testing.T) {
+	target, _ := url.Parse("http://example.com/upload?x=1")
+	req := &http.Request{
+		Method: "POST",
+		URL:    target,
+		Host:   "example.com",
+		Header: http.Header{"Content-Type": {"text/plain"}, "X-Secret": {"1"}},
+		Body:   io.NopCloser(strings.NewReader("original")),
+	}
+	response := &IcapResponse{StatusCode: 200, HttpRequest: &HttpRequest{
+		Method:  "PUT",
+		URI:     "/sanitized",
+		Version: "HTTP/1.1",
+		Headers: map[string]string{"Host": "mirror.example.com", "Content-Type": "text/plain", "Content-Length": "99"},
+		Body:    []byte("redacted"),
+	}}
+
+	if err := response.ApplyToRequest(req); err != nil {
+		t.Fatalf("ApplyToRequest failed: %v", err)
+	}
+	if req.Method != "PUT" || req.URL.String() != "http://example.com/sanitized" || req.Host != "mirror.example.com" {
+		t.Errorf("Expected PUT http://example.com/sanitized on mirror.example.com, got %s %s on %s", req.Method, req.URL, req.Host)
+	}
+	if req.Header.Get("X-Secret") != "" || req.Header.Get("Host") != "" || req.Header.Get("Content-Length") != "" {
+		t.Errorf("Expected the adapted headers only, got %v", req.Header)
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != "redacted" || req.ContentLength != 8 {
+		t.Errorf("Expected the adapted body of length 8, got %q of length %d", body, req.ContentLength)
+	}
+	replay, _ := req.GetBody()
+	if body, _ := io.ReadAll(replay); string(body) != "redacted" {
+		t.Errorf("Expected GetBody to replay the adapted body, got %q", body)
+	}
+
+	if err := (&IcapResponse{StatusCode: 200, HttpRequest: &HttpRequest{URI: "%zz"}}).ApplyToRequest(req); err == nil {
+		t.Errorf("Expected an invalid adapted URI to fail")
+	}
+	if err := (&IcapResponse{StatusCode: 204}).ApplyToRequest(req); err != nil || req.Method != "PUT" {
+		t.Errorf("Expected a 204 to leave the request unchanged")
+	}
+}
+
+// TestIcapResponse_ApplyToResponse tests rewriting an http.Response as the
+// adapted response
+func TestIcapResponse_ApplyToResponse(t *testing.T) {
+	original := &closeRecorder{Reader: strings.NewReader("malware")}
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     http.Header{"Content-Type": {"application/octet-stream"}},
+		Body:       original,
+	}
+	response := &IcapResponse{StatusCode: 200, HttpResponse: &HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 403,
+		Headers:    map[string]string{"Content-Type": "text/html", "Transfer-Encoding": "chunked"},
+		Body:       []byte("<h1>Blocked</h1>"),
+	}}
+
+	response.ApplyToResponse(resp)
+	if !original.closed {
+		t.Errorf("Expected the original body to be closed")
+	}
+	if resp.StatusCode != 403 || resp.Status != "403 Forbidden" || resp.Proto != "HTTP/2.0" {
+		t.Errorf("Expected 403 Forbidden over HTTP/2.0, got %q over %s", resp.Status, resp.Proto)
+	}
+	if resp.Header.Get("Content-Type") != "text/html" || resp.Header.Get("Transfer-Encoding") != "" || resp.Header.Get("Content-Length") != "16" {
+		t.Errorf("Expected the adapted headers with a Content-Length, got %v", resp.Header)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "<h1>Blocked</h1>" || resp.ContentLength != 16 {
+		t.Errorf("Expected the block page of length 16, got %q of length %d", body, resp.ContentLength)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Errorf("Expected closing the adapted body to succeed, got %v", err)
+	}
+
+	fresh := &http.Response{}
+	response.ApplyToResponse(fresh)
+	if fresh.ProtoMajor != 1 || fresh.ProtoMinor != 1 {
+		t.Errorf("Expected a new response to default to HTTP/1.1, got %s", fresh.Proto)
+	}
+}
+
+// closeRecorder is a body recording whether it was closed
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
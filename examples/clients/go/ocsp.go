@@ -0,0 +1,85 @@
+package icapclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspMode controls verification of stapled OCSP responses
+type ocspMode int
+
+const (
+	ocspOff ocspMode = iota
+	ocspVerify
+	ocspStrict
+)
+
+// parseOCSPMode parses the tls.ocsp_stapling setting
+func parseOCSPMode(mode string) (ocspMode, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "off", "none":
+		return ocspOff, nil
+	case "verify":
+		return ocspVerify, nil
+	case "strict":
+		return ocspStrict, nil
+	default:
+		return ocspOff, fmt.Errorf("tls.ocsp_stapling: unknown mode %q", mode)
+	}
+}
+
+// verifyOCSPStaple checks the OCSP response stapled by the server. A missing
+// staple or an unknown status is only an error in strict mode; an invalid or
+// revoked staple always fails the handshake.
+func verifyOCSPStaple(state tls.ConnectionState, strict bool) error {
+	if len(state.OCSPResponse) == 0 {
+		if strict {
+			return &IcapError{Message: "OCSP verification failed: server did not staple an OCSP response"}
+		}
+		return nil
+	}
+
+	leaf, issuer := ocspCertificates(state)
+	if leaf == nil || issuer == nil {
+		return &IcapError{Message: "OCSP verification failed: issuer certificate not available"}
+	}
+
+	response, err := ocsp.ParseResponseForCert(state.OCSPResponse, leaf, issuer)
+	if err != nil {
+		return &IcapError{Message: "OCSP verification failed", Err: err}
+	}
+
+	if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate) {
+		return &IcapError{Message: "OCSP verification failed: stapled response is expired"}
+	}
+
+	switch response.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return &IcapError{Message: fmt.Sprintf("OCSP verification failed: certificate revoked at %s", response.RevokedAt.Format(time.RFC3339))}
+	default:
+		if strict {
+			return &IcapError{Message: "OCSP verification failed: certificate status unknown"}
+		}
+		return nil
+	}
+}
+
+// ocspCertificates returns the leaf certificate and its issuer, preferring the
+// verified chain over the certificates presented by the server
+func ocspCertificates(state tls.ConnectionState) (*x509.Certificate, *x509.Certificate) {
+	chain := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		chain = state.VerifiedChains[0]
+	}
+	if len(chain) < 2 {
+		return nil, nil
+	}
+	return chain[0], chain[1]
+}
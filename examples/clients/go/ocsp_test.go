@@ -0,0 +1,129 @@
+package icapclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newOCSPTestChain creates a CA and a leaf certificate issued by it
+func newOCSPTestChain(t *testing.T) (*x509.Certificate, *x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate leaf key: %v", err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "icap.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create leaf certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(leafDER)
+
+	return leaf, ca, caKey
+}
+
+// TestVerifyOCSPStaple tests stapled OCSP response verification
+func TestVerifyOCSPStaple(t *testing.T) {
+	leaf, ca, caKey := newOCSPTestChain(t)
+
+	staple := func(status int) []byte {
+		response, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, caKey)
+		if err != nil {
+			t.Fatalf("Failed to create OCSP response: %v", err)
+		}
+		return response
+	}
+
+	tests := []struct {
+		name    string
+		staple  []byte
+		strict  bool
+		wantErr bool
+	}{
+		{"Good staple", staple(ocsp.Good), true, false},
+		{"Revoked staple", staple(ocsp.Revoked), false, true},
+		{"Unknown status", staple(ocsp.Unknown), false, false},
+		{"Unknown status strict", staple(ocsp.Unknown), true, true},
+		{"Missing staple", nil, false, false},
+		{"Missing staple strict", nil, true, true},
+		{"Malformed staple", []byte("garbage"), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{leaf, ca},
+				OCSPResponse:     tt.staple,
+			}
+			err := verifyOCSPStaple(state, tt.strict)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestParseOCSPMode tests OCSP mode parsing
+func TestParseOCSPMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected ocspMode
+		wantErr  bool
+	}{
+		{"", ocspOff, false},
+		{"verify", ocspVerify, false},
+		{"STRICT", ocspStrict, false},
+		{"sometimes", ocspOff, true},
+	}
+
+	for _, tt := range tests {
+		mode, err := parseOCSPMode(tt.mode)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Mode %q: expected error %v, got %v", tt.mode, tt.wantErr, err)
+		}
+		if mode != tt.expected {
+			t.Errorf("Mode %q: expected %v, got %v", tt.mode, tt.expected, mode)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OptBody is the opt-body of an OPTIONS response, describing for instance
+// the capabilities of the service or the categories it reports
+type OptBody struct {
+	// Type is the Opt-body-type header, e.g. "XML-Policy-Table-1.0"
+	Type string `yaml:"type" json:"type"`
+	// Fields holds the entries of the body: the "name: value" or
+	// "name=value" lines of text bodies, and the scalar members of the top
+	// JSON object or the leaf children of the XML root element. Repeated
+	// entries and JSON arrays are joined with ", ".
+	Fields map[string]string `yaml:"fields,omitempty" json:"fields,omitempty"`
+	raw    []byte
+}
+
+// Optional body formats, from Opt-body-type or the content
+const (
+	optBodyText = "text"
+	optBodyJSON = "json"
+	optBodyXML  = "xml"
+)
+
+// newOptBody decodes the opt-body data of type optType. Bodies that fail to
+// decode keep their raw bytes without fields.
+func newOptBody(optType string, data []byte) *OptBody {
+	body := &OptBody{Type: optType, raw: data, Fields: make(map[string]string)}
+	var err error
+	switch body.format() {
+	case optBodyJSON:
+		err = body.decodeJSONFields()
+	case optBodyXML:
+		err = body.decodeXMLFields()
+	default:
+		body.decodeTextFields()
+	}
+	if err != nil || len(body.Fields) == 0 {
+		body.Fields = nil
+	}
+	return body
+}
+
+// Bytes returns the raw opt-body
+func (b *OptBody) Bytes() []byte {
+	return b.raw
+}
+
+// Decode unmarshals a JSON or XML opt-body into v, as json.Unmarshal or
+// xml.Unmarshal would
+func (b *OptBody) Decode(v interface{}) error {
+	switch b.format() {
+	case optBodyJSON:
+		return json.Unmarshal(b.raw, v)
+	case optBodyXML:
+		return xml.Unmarshal(b.raw, v)
+	}
+	return fmt.Errorf("opt-body of type %q is neither JSON nor XML", b.Type)
+}
+
+// format returns the format named by the Opt-body-type, or else sniffed
+// from the first character of the body
+func (b *OptBody) format() string {
+	optType := strings.ToLower(b.Type)
+	switch {
+	case strings.Contains(optType, "json"):
+		return optBodyJSON
+	case strings.Contains(optType, "xml"):
+		return optBodyXML
+	}
+	switch trimmed := bytes.TrimSpace(b.raw); {
+	case len(trimmed) == 0:
+		return optBodyText
+	case trimmed[0] == '{' || trimmed[0] == '[':
+		return optBodyJSON
+	case trimmed[0] == '<':
+		return optBodyXML
+	}
+	return optBodyText
+}
+
+// addField adds an entry, joining it to an existing one of the same name
+func (b *OptBody) addField(name, value string) {
+	if existing, ok := b.Fields[name]; ok {
+		value = existing + ", " + value
+	}
+	b.Fields[name] = value
+}
+
+// decodeTextFields reads "name: value" and "name=value" lines
+func (b *OptBody) decodeTextFields() {
+	scanner := bufio.NewScanner(bytes.NewReader(b.raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, ":=")
+		if i <= 0 {
+			continue
+		}
+		b.addField(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+}
+
+// decodeJSONFields reads the scalar members, and arrays of scalars, of a
+// top-level JSON object
+func (b *OptBody) decodeJSONFields() error {
+	var object map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b.raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values, ok := object[name].([]interface{})
+		if !ok {
+			values = []interface{}{object[name]}
+		}
+		for _, value := range values {
+			if text, ok := jsonScalar(value); ok {
+				b.addField(name, text)
+			}
+		}
+	}
+	return nil
+}
+
+// jsonScalar formats a decoded JSON string, number or boolean
+func jsonScalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// decodeXMLFields reads the children of the XML root element that hold
+// only text
+func (b *OptBody) decodeXMLFields() error {
+	decoder := xml.NewDecoder(bytes.NewReader(b.raw))
+	depth := 0
+	var name string
+	var text strings.Builder
+	leaf := false
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				name, leaf = t.Name.Local, true
+				text.Reset()
+			} else if depth > 2 {
+				leaf = false
+			}
+		case xml.CharData:
+			if depth == 2 {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if depth == 2 && leaf {
+				b.addField(name, strings.TrimSpace(text.String()))
+			}
+			depth--
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package icapclient
+
+import (
+	"testing"
+)
+
+// TestNewOptBody tests decoding opt-bodies of each format into fields
+func TestNewOptBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		optType  string
+		data     string
+		expected map[string]string
+	}{
+		{"text", "Plain-Text", "# capabilities\nEngine: clamav\nCategory: malware\ncategory=spam\nCategory: phishing\nnot a field\n",
+			map[string]string{"Engine": "clamav", "Category": "malware, phishing", "category": "spam"}},
+		{"json", "JSON-Capabilities", `{"engine": "clamav", "max_size": 1048576, "preview": true, "categories": ["malware", "pua"], "limits": {"files": 10}}`,
+			map[string]string{"engine": "clamav", "max_size": "1048576", "preview": "true", "categories": "malware, pua"}},
+		{"sniffed json", "", `{"engine": "clamav"}`, map[string]string{"engine": "clamav"}},
+		{"xml", "XML-Policy-Table-1.0", `<?xml version="1.0"?><Service><Engine> clamav </Engine><Category>malware</Category>` +
+			`<Category>pua</Category><Limits><Files>10</Files></Limits></Service>`,
+			map[string]string{"Engine": "clamav", "Category": "malware, pua"}},
+		{"sniffed xml", "Policy-Table", `<Service><Engine>clamav</Engine></Service>`, map[string]string{"Engine": "clamav"}},
+		{"invalid json", "JSON", `{"engine": `, nil},
+		{"empty", "", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := newOptBody(tt.optType, []byte(tt.data))
+			if string(body.Bytes()) != tt.data || body.Type != tt.optType {
+				t.Errorf("Expected the raw body and type to be kept, got %q %q", body.Type, body.Bytes())
+			}
+			if len(body.Fields) != len(tt.expected) || (tt.expected == nil) != (body.Fields == nil) {
+				t.Errorf("Expected fields %v, got %v", tt.expected, body.Fields)
+			}
+			for name, value := range tt.expected {
+				if body.Fields[name] != value {
+					t.Errorf("Expected %s %q, got %q", name, value, body.Fields[name])
+				}
+			}
+		})
+	}
+}
+
+// TestOptBody_Decode tests unmarshalling JSON and XML opt-bodies
+func TestOptBody_Decode(t *testing.T) {
+	var capabilities struct {
+		Categories []string `json:"categories"`
+	}
+	if err := newOptBody("JSON", []byte(`{"categories": ["malware", "pua"]}`)).Decode(&capabilities); err != nil || len(capabilities.Categories) != 2 {
+		t.Errorf("Expected two JSON categories, got %v (%v)", capabilities.Categories, err)
+	}
+
+	var policy struct {
+		Categories []string `xml:"Category"`
+	}
+	if err := newOptBody("XML-Policy-Table-1.0", []byte(`<Policy><Category>malware</Category></Policy>`)).Decode(&policy); err != nil || len(policy.Categories) != 1 {
+		t.Errorf("Expected one XML category, got %v (%v)", policy.Categories, err)
+	}
+
+	if err := newOptBody("Plain-Text", []byte("a: b")).Decode(&policy); err == nil {
+		t.Error("Expected an error decoding a text opt-body")
+	}
+}
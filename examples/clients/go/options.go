@@ -0,0 +1,129 @@
+package icapclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// RequestOptions carries per-request ICAP metadata. Attach it to the context
+// passed to Reqmod, Respmod or Options with WithRequestOptions.
+type RequestOptions struct {
+	// RequestID identifies the transaction in client and server logs, sent
+	// as X-Request-ID. One is generated when empty.
+	RequestID string
+	// ClientIP and ServerIP are the addresses of the HTTP client and origin
+	// server, sent as X-Client-IP and X-Server-IP
+	ClientIP string
+	ServerIP string
+	// AuthenticatedUser is the user principal, e.g. "LDAP://dc/cn=alice",
+	// sent base64-encoded as X-Authenticated-User
+	AuthenticatedUser string
+	// AuthenticatedGroups are sent comma-separated and base64-encoded as
+	// X-Authenticated-Groups
+	AuthenticatedGroups []string
+	// SubscriberID identifies the subscriber, sent as X-Subscriber-ID
+	SubscriberID string
+	// HostHeader overrides the Host header of the request
+	HostHeader string
+	// ServiceID and TenantID override service_id and tenant_id, sent as
+	// Service-ID and in the tenant_header of the client
+	ServiceID string
+	TenantID  string
+	// Allow overrides the capabilities advertised in the Allow header when
+	// not nil, e.g. []string{AllowNone} when streaming a body that cannot be
+	// read again after a 204
+	Allow []string
+	// BandwidthLimit overrides throttle.per_transfer for the request, in
+	// bytes per second, negative for unlimited; e.g. to slow down batch
+	// scans sharing a client with production traffic
+	BandwidthLimit int64
+	// SpoolThreshold, when positive, spools bodies over it to disk even if
+	// spool.threshold is higher or unset, e.g. for bodies of unknown length
+	// that must not be held in memory
+	SpoolThreshold int64
+	// URL is the URL of the HTTP request a RESPMOD response answers,
+	// matched by the urls of policy rules
+	URL string
+	// Service overrides the ICAP service path of the request, e.g. to send
+	// OPTIONS to the REQMOD service
+	Service string
+}
+
+// requestOptionsKey is the context key of RequestOptions
+type requestOptionsKey struct{}
+
+// WithRequestOptions returns a context carrying opts for the requests made
+// with it
+func WithRequestOptions(ctx context.Context, opts RequestOptions) context.Context {
+	return context.WithValue(ctx, requestOptionsKey{}, opts)
+}
+
+// requestOptionsFrom returns the RequestOptions attached to ctx
+func requestOptionsFrom(ctx context.Context) RequestOptions {
+	opts, _ := ctx.Value(requestOptionsKey{}).(RequestOptions)
+	return opts
+}
+
+// ContextRequestOptions returns the RequestOptions attached to ctx with
+// WithRequestOptions, so that they can be extended rather than replaced
+func ContextRequestOptions(ctx context.Context) RequestOptions {
+	return requestOptionsFrom(ctx)
+}
+
+// applyHeaders sets the ICAP headers for the metadata in opts, with the
+// tenant identifier in tenantHeader
+func (o RequestOptions) applyHeaders(headers map[string]string, tenantHeader string) {
+	if o.RequestID != "" {
+		headers["X-Request-ID"] = o.RequestID
+	}
+	if o.ClientIP != "" {
+		headers["X-Client-IP"] = o.ClientIP
+	}
+	if o.ServerIP != "" {
+		headers["X-Server-IP"] = o.ServerIP
+	}
+	if o.AuthenticatedUser != "" {
+		headers["X-Authenticated-User"] = base64.StdEncoding.EncodeToString([]byte(o.AuthenticatedUser))
+	}
+	if len(o.AuthenticatedGroups) > 0 {
+		groups := strings.Join(o.AuthenticatedGroups, ",")
+		headers["X-Authenticated-Groups"] = base64.StdEncoding.EncodeToString([]byte(groups))
+	}
+	if o.SubscriberID != "" {
+		headers["X-Subscriber-ID"] = o.SubscriberID
+	}
+	if o.HostHeader != "" {
+		headers["Host"] = o.HostHeader
+	}
+	if o.ServiceID != "" {
+		headers["Service-ID"] = o.ServiceID
+	}
+	if o.TenantID != "" {
+		headers[tenantHeader] = o.TenantID
+	}
+	if o.Allow != nil {
+		setAllow(headers, o.Allow)
+	}
+}
+
+// newRequestID returns a random 128-bit request ID in hex
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// defaultTenantHeader carries the tenant identifier when tenant_header is
+// empty
+const defaultTenantHeader = "X-Tenant-ID"
+
+// tenantHeader returns the header carrying the tenant identifier
+func tenantHeader(configured string) string {
+	if configured == "" {
+		return defaultTenantHeader
+	}
+	return configured
+}
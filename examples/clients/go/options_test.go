@@ -0,0 +1,241 @@
+package icapclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestRequestOptions_applyHeaders tests the metadata headers and their encoding
+func TestRequestOptions_applyHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     RequestOptions
+		expected map[string]string
+	}{
+		{"Empty", RequestOptions{}, map[string]string{}},
+		{
+			"All fields",
+			RequestOptions{
+				ClientIP:            "192.0.2.10",
+				ServerIP:            "2001:db8::1",
+				AuthenticatedUser:   "LDAP://dc/cn=alice",
+				AuthenticatedGroups: []string{"staff", "admins"},
+				SubscriberID:        "sub-42",
+				HostHeader:          "scanner.example.com",
+				Allow:               []string{"204", "trailers"},
+				ServiceID:           "av-scan",
+				TenantID:            "acme",
+			},
+			map[string]string{
+				"X-Client-IP":            "192.0.2.10",
+				"X-Server-IP":            "2001:db8::1",
+				"X-Authenticated-User":   "TERBUDovL2RjL2NuPWFsaWNl",
+				"X-Authenticated-Groups": "c3RhZmYsYWRtaW5z",
+				"X-Subscriber-ID":        "sub-42",
+				"Host":                   "scanner.example.com",
+				"Allow":                  "204, trailers",
+				"Service-ID":             "av-scan",
+				"X-Tenant-ID":            "acme",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := make(map[string]string)
+			tt.opts.applyHeaders(headers, defaultTenantHeader)
+			if len(headers) != len(tt.expected) {
+				t.Errorf("Expected %d headers, got %v", len(tt.expected), headers)
+			}
+			for name, value := range tt.expected {
+				if headers[name] != value {
+					t.Errorf("Expected %s %q, got %q", name, value, headers[name])
+				}
+			}
+		})
+	}
+}
+
+// TestIcapClient_RequestOptions tests that context metadata reaches the server
+func TestIcapClient_RequestOptions(t *testing.T) {
+	headers := make(chan icaptest.Header, 1)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		headers <- r.Header
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	ctx := WithRequestOptions(context.Background(), RequestOptions{ClientIP: "192.0.2.10", AuthenticatedUser: "alice"})
+	if _, err := client.Reqmod(ctx, &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}); err != nil {
+		t.Fatalf("Reqmod failed: %v", err)
+	}
+
+	received := <-headers
+	if received.Get("X-Client-IP") != "192.0.2.10" {
+		t.Errorf("Expected X-Client-IP 192.0.2.10, got %q", received.Get("X-Client-IP"))
+	}
+	if received.Get("X-Authenticated-User") != "YWxpY2U=" {
+		t.Errorf("Expected base64 X-Authenticated-User, got %q", received.Get("X-Authenticated-User"))
+	}
+	if received.Get("X-Subscriber-ID") != "" {
+		t.Errorf("Expected no X-Subscriber-ID, got %q", received.Get("X-Subscriber-ID"))
+	}
+}
+
+// TestIcapClient_HostHeader tests the Host header sent, from the ICAP
+// authority, the host_header setting and the per-request override
+func TestIcapClient_HostHeader(t *testing.T) {
+	headers := make(chan icaptest.Header, 1)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		headers <- r.Header
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+	host, port := server.HostPort()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	for _, tt := range []struct {
+		name       string
+		hostHeader string
+		override   string
+		expected   string
+	}{
+		{"authority", "", "", fmt.Sprintf("%s:%d", host, port)},
+		{"configured", "av.scanner.internal", "", "av.scanner.internal"},
+		{"per request", "av.scanner.internal", "dlp.scanner.internal:1344", "dlp.scanner.internal:1344"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client.config.Load().HostHeader = tt.hostHeader
+			ctx := WithRequestOptions(context.Background(), RequestOptions{HostHeader: tt.override})
+			if _, err := client.Options(ctx); err != nil {
+				t.Fatalf("Options failed: %v", err)
+			}
+			if received := (<-headers).Get("Host"); received != tt.expected {
+				t.Errorf("Expected Host %q, got %q", tt.expected, received)
+			}
+		})
+	}
+}
+
+// TestIcapClient_hostHeader tests omitting the default port of the scheme
+func TestIcapClient_hostHeader(t *testing.T) {
+	for _, tt := range []struct {
+		host     string
+		port     int
+		tls      bool
+		expected string
+	}{
+		{"icap.example.com", 1344, false, "icap.example.com"},
+		{"icap.example.com", 1345, false, "icap.example.com:1345"},
+		{"icap.example.com", 11344, true, "icap.example.com"},
+		{"icap.example.com", 1344, true, "icap.example.com:1344"},
+		{"2001:db8::1", 1344, false, "[2001:db8::1]"},
+		{"2001:db8::1", 8080, false, "[2001:db8::1]:8080"},
+	} {
+		client := &IcapClient{}
+		client.config.Store(&IcapConfig{Host: tt.host, Port: tt.port, TLS: TLSConfig{Enabled: tt.tls}})
+		if host := client.hostHeader(client.config.Load()); host != tt.expected {
+			t.Errorf("%s port %d TLS %v: expected %q, got %q", tt.host, tt.port, tt.tls, tt.expected, host)
+		}
+	}
+}
+
+// TestIcapClient_RequestID tests that request IDs are generated or accepted,
+// sent to the server and returned on responses and errors
+func TestIcapClient_RequestID(t *testing.T) {
+	ids := make(chan string, 2)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		ids <- r.Header.Get("X-Request-ID")
+		if r.Method == "RESPMOD" {
+			w.WriteHeader(500, nil, false)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	response, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+	if err != nil {
+		t.Fatalf("Reqmod failed: %v", err)
+	}
+	if sent := <-ids; len(sent) != 32 || sent != response.RequestID {
+		t.Errorf("Expected a generated ID on request and response, got %q and %q", sent, response.RequestID)
+	}
+
+	ctx := WithRequestOptions(context.Background(), RequestOptions{RequestID: "trace-123"})
+	response, err = client.Reqmod(ctx, &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+	if err != nil {
+		t.Fatalf("Reqmod failed: %v", err)
+	}
+	if sent := <-ids; sent != "trace-123" || response.RequestID != "trace-123" {
+		t.Errorf("Expected the caller's ID, got %q and %q", sent, response.RequestID)
+	}
+
+	client.config.Load().MaxBodySize = 1
+	_, err = client.Respmod(ctx, &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Body: []byte("too large")})
+	var icapErr *IcapError
+	if !errors.As(err, &icapErr) || icapErr.RequestID != "trace-123" {
+		t.Errorf("Expected an IcapError with the request ID, got %v", err)
+	}
+}
+
+// TestIcapClient_TenantHeaders tests sending Service-ID and the tenant
+// identifier with every method, and overriding them per request
+func TestIcapClient_TenantHeaders(t *testing.T) {
+	headers := make(chan icaptest.Header, 1)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		headers <- r.Header
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	config := client.config.Load()
+	config.ServiceID, config.TenantID, config.TenantHeader = "av-scan", "acme", "X-Org"
+
+	send := map[string]func(ctx context.Context) error{
+		"OPTIONS": func(ctx context.Context) error {
+			_, err := client.Options(ctx)
+			return err
+		},
+		"REQMOD": func(ctx context.Context) error {
+			_, err := client.Reqmod(ctx, &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1", Headers: map[string]string{}})
+			return err
+		},
+		"RESPMOD": func(ctx context.Context) error {
+			_, err := client.Respmod(ctx, &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Headers: map[string]string{}, Body: []byte("ok")})
+			return err
+		},
+	}
+	for method, request := range send {
+		if err := request(context.Background()); err != nil {
+			t.Fatalf("%s failed: %v", method, err)
+		}
+		received := <-headers
+		if received.Get("Service-ID") != "av-scan" || received.Get("X-Org") != "acme" || received.Get("X-Tenant-ID") != "" {
+			t.Errorf("%s: expected Service-ID av-scan and X-Org acme, got %v", method, received)
+		}
+
+		ctx := WithRequestOptions(context.Background(), RequestOptions{ServiceID: "dlp", TenantID: "globex"})
+		if err := request(ctx); err != nil {
+			t.Fatalf("%s failed: %v", method, err)
+		}
+		received = <-headers
+		if received.Get("Service-ID") != "dlp" || received.Get("X-Org") != "globex" {
+			t.Errorf("%s: expected per-request Service-ID dlp and X-Org globex, got %v", method, received)
+		}
+	}
+}
@@ -0,0 +1,794 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultMaxHeaderBytes bounds the ICAP and encapsulated HTTP headers of a response
+	defaultMaxHeaderBytes = 64 << 10
+	// defaultMaxHeaderCount bounds the number of ICAP headers of a response
+	defaultMaxHeaderCount = 100
+	// maxChunkLineBytes bounds a chunk size line including extensions
+	maxChunkLineBytes = 4096
+	// maxProtocolErrorInput bounds the offending input quoted in a ProtocolError
+	maxProtocolErrorInput = 64
+)
+
+var (
+	// ErrHeaderTooLarge is wrapped by protocol errors for oversized headers
+	ErrHeaderTooLarge = errors.New("header section too large")
+	// ErrTooManyHeaders is wrapped by protocol errors for too many headers
+	ErrTooManyHeaders = errors.New("too many headers")
+)
+
+// ProtocolError describes an ICAP response that violates the protocol or
+// exceeds the parser limits
+type ProtocolError struct {
+	Message string
+	Input   string
+	Err     error
+}
+
+func (e *ProtocolError) Error() string {
+	msg := "malformed ICAP response: " + e.Message
+	if e.Input != "" {
+		msg += fmt.Sprintf(" (%q)", e.Input)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// newProtocolError creates a ProtocolError quoting a bounded prefix of input
+func newProtocolError(message string, input string, err error) *ProtocolError {
+	if len(input) > maxProtocolErrorInput {
+		input = input[:maxProtocolErrorInput] + "..."
+	}
+	return &ProtocolError{Message: message, Input: input, Err: err}
+}
+
+// responseParser reads ICAP responses from a stream, enforcing limits on the
+// header sections so a misbehaving server cannot exhaust memory. Lines are
+// read as byte slices into buffers reused across responses; the ICAP headers
+// are converted to a single string and the header names and values are
+// substrings of it, so parsing costs no allocations per header.
+type responseParser struct {
+	br             *bufio.Reader
+	maxHeaderBytes int
+	maxHeaderCount int
+
+	// headerBytes counts the header bytes of the response being read
+	headerBytes int
+	// block accumulates the ICAP header lines, separated by '\n'
+	block []byte
+	// line holds the chunk size, terminator and trailer lines
+	line []byte
+	// sections holds the parsed Encapsulated header entries
+	sections []encapsulatedSection
+	// spool moves encapsulated bodies over its threshold to disk
+	spool SpoolConfig
+	// extensions collects the chunk extensions of the response being read
+	extensions []ChunkExtension
+	// trailer holds the trailer fields after the terminal chunk
+	trailer map[string]string
+}
+
+// newResponseParser creates a parser for br, using the default limits for
+// non-positive values
+func newResponseParser(br *bufio.Reader, maxHeaderBytes, maxHeaderCount int) *responseParser {
+	p := &responseParser{}
+	p.reset(br, maxHeaderBytes, maxHeaderCount)
+	return p
+}
+
+// reset makes p read from br with the given limits, keeping its buffers
+func (p *responseParser) reset(br *bufio.Reader, maxHeaderBytes, maxHeaderCount int) {
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if maxHeaderCount <= 0 {
+		maxHeaderCount = defaultMaxHeaderCount
+	}
+
+	p.br = br
+	p.maxHeaderBytes = maxHeaderBytes
+	p.maxHeaderCount = maxHeaderCount
+	p.spool = SpoolConfig{}
+}
+
+// maxBodySizeHint bounds the buffer preallocated from an encapsulated
+// Content-Length, which the server may not honour
+const maxBodySizeHint = 1 << 20
+
+// ReadResponse reads an ICAP response and its encapsulated HTTP message.
+// Body holds the encapsulated message with the body de-chunked, and the
+// encapsulated headers are parsed into HttpRequest and HttpResponse, whose
+// Body shares memory with it. A body over the spool threshold is moved to
+// a spool file exposed as the BodyReader of the HTTP message instead, and
+// Body then holds the encapsulated headers only.
+func (p *responseParser) ReadResponse() (*IcapResponse, error) {
+	p.headerBytes = 0
+	p.block = p.block[:0]
+	p.extensions = nil
+	p.trailer = nil
+
+	statusLine, err := p.readHeaderLine()
+	if err != nil {
+		return nil, err
+	}
+	response, err := parseStatusLine(string(statusLine))
+	if err != nil {
+		return nil, err
+	}
+
+	p.block = p.block[:0]
+	count := 0
+	for {
+		line, err := p.readHeaderLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			count++
+			if count > p.maxHeaderCount {
+				return nil, newProtocolError(fmt.Sprintf("more than %d headers", p.maxHeaderCount), "", ErrTooManyHeaders)
+			}
+		}
+	}
+	block := string(p.block)
+	if response.Headers, err = parseHeaders(block, count); err != nil {
+		return nil, err
+	}
+	parseThreatHeaders(response, block)
+
+	if p.sections, err = parseEncapsulated(p.sections[:0], headerValue(response.Headers, "Encapsulated")); err != nil {
+		return nil, err
+	}
+
+	// The header sections and the body are read into one buffer, sized
+	// up front when the offsets and Content-Length tell how much follows
+	var message []byte
+	if n := len(p.sections); n > 0 {
+		message = make([]byte, 0, min(p.sections[n-1].offset, p.maxHeaderBytes))
+	}
+	var reqHdr, resHdr []byte
+	for i, section := range p.sections {
+		if section.isBody() {
+			if section.name == "null-body" {
+				break
+			}
+			header := resHdr
+			if header == nil {
+				header = reqHdr
+			}
+			spool := header != nil && p.spool.enabled()
+			hint := maxBodySizeHint
+			if spool {
+				hint = int(min(int64(hint), p.spool.Threshold))
+			}
+			message = growBodyHint(message, header, hint)
+
+			start := len(message)
+			var spooled *spoolFile
+			if message, spooled, err = p.readChunkedBody(message, spool); err != nil {
+				return nil, err
+			}
+			var body []byte
+			if len(message) > start {
+				body = message[start:len(message):len(message)]
+			}
+			switch {
+			case section.name == "opt-body":
+				response.OptBody = newOptBody(headerValue(response.Headers, "Opt-body-type"), body)
+			case resHdr != nil:
+				response.HttpResponse = parseHTTPResponseHeader(resHdr, body)
+				response.HttpResponse.Trailer = p.trailer
+				if spooled != nil {
+					response.HttpResponse.BodyReader = spooled
+				}
+			case reqHdr != nil:
+				response.HttpRequest = parseHTTPRequestHeader(reqHdr, body)
+				response.HttpRequest.Trailer = p.trailer
+				if spooled != nil {
+					response.HttpRequest.BodyReader = spooled
+				}
+			}
+			break
+		}
+
+		start := len(message)
+		message, err = p.readSection(message, section.name, p.sections[i+1].offset-section.offset)
+		if err != nil {
+			return nil, err
+		}
+		switch section.name {
+		case "req-hdr":
+			reqHdr = message[start:len(message):len(message)]
+		case "res-hdr":
+			resHdr = message[start:len(message):len(message)]
+		}
+	}
+
+	if reqHdr != nil && response.HttpRequest == nil {
+		response.HttpRequest = parseHTTPRequestHeader(reqHdr, nil)
+	}
+	if resHdr != nil && response.HttpResponse == nil {
+		response.HttpResponse = parseHTTPResponseHeader(resHdr, nil)
+	}
+	if len(message) > 0 {
+		response.Body = message
+	}
+	response.ChunkExtensions = p.extensions
+
+	return response, nil
+}
+
+// growBodyHint grows message for the Content-Length advertised in header,
+// up to limit bytes
+func growBodyHint(message []byte, header []byte, limit int) []byte {
+	if header == nil {
+		return message
+	}
+	_, headers := parseHTTPHeaderBlock(header)
+	size, err := strconv.Atoi(headerValue(headers, "Content-Length"))
+	if err != nil || size <= 0 {
+		return message
+	}
+	size = min(size, limit)
+	if cap(message)-len(message) >= size {
+		return message
+	}
+	grown := make([]byte, len(message), len(message)+size)
+	copy(grown, message)
+	return grown
+}
+
+// parseStatusLine parses a status line such as "ICAP/1.0 204 No Content"
+func parseStatusLine(line string) (*IcapResponse, error) {
+	version, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return nil, newProtocolError("malformed status line", line, nil)
+	}
+	if !validICAPVersion(version) {
+		return nil, newProtocolError("invalid ICAP version in status line", line, nil)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+	if len(code) != 3 {
+		return nil, newProtocolError("invalid status code in status line", line, nil)
+	}
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || statusCode < 100 {
+		return nil, newProtocolError("invalid status code in status line", line, nil)
+	}
+
+	return &IcapResponse{
+		Version:    version,
+		StatusCode: statusCode,
+		Reason:     reason,
+	}, nil
+}
+
+// validICAPVersion reports whether version has the form ICAP/<digit>.<digit>
+func validICAPVersion(version string) bool {
+	return len(version) == 8 && strings.HasPrefix(version, "ICAP/") &&
+		isDigit(version[5]) && version[6] == '.' && isDigit(version[7])
+}
+
+// isDigit reports whether b is an ASCII digit
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// parseHeaders parses '\n'-separated ICAP header lines. Names and values are
+// substrings of block; only repeated headers, which are joined with commas,
+// and folded continuation lines, which are appended, allocate.
+func parseHeaders(block string, count int) (map[string]string, error) {
+	headers := make(map[string]string, count)
+	last := ""
+
+	for block != "" {
+		var line string
+		line, block, _ = strings.Cut(block, "\n")
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if last == "" {
+				return nil, newProtocolError("continuation line without header", line, nil)
+			}
+			headers[last] += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, newProtocolError("malformed header line", line, nil)
+		}
+		if !validHeaderName(name) {
+			return nil, newProtocolError("invalid header name", line, nil)
+		}
+
+		value = strings.TrimSpace(value)
+		if existing, ok := headers[name]; ok {
+			value = existing + ", " + value
+		}
+		headers[name] = value
+		last = name
+	}
+
+	return headers, nil
+}
+
+// validHeaderName reports whether name is a non-empty HTTP token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readHeaderLine appends a header line and a '\n' separator to p.block,
+// charging it to the header byte budget. The returned line aliases p.block.
+func (p *responseParser) readHeaderLine() ([]byte, error) {
+	start := len(p.block)
+	block, err := p.appendLine(p.block, p.maxHeaderBytes-p.headerBytes)
+	p.block = block
+	p.headerBytes += len(block) - start + 2
+	if errors.Is(err, ErrHeaderTooLarge) {
+		return nil, newProtocolError(fmt.Sprintf("headers exceed %d bytes", p.maxHeaderBytes), "", ErrHeaderTooLarge)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line := p.block[start:]
+	if len(line) > 0 {
+		p.block = append(p.block, '\n')
+	}
+	return line, nil
+}
+
+// readLine reads a line of at most limit bytes into p.line. The returned
+// slice is only valid until the next call.
+func (p *responseParser) readLine(limit int) ([]byte, error) {
+	line, err := p.appendLine(p.line[:0], limit)
+	p.line = line
+	return line, err
+}
+
+// appendLine appends a line of at most limit bytes to dst, stripping the
+// CRLF (or bare LF) terminator
+func (p *responseParser) appendLine(dst []byte, limit int) ([]byte, error) {
+	start := len(dst)
+	for {
+		fragment, err := p.br.ReadSlice('\n')
+		if len(dst)-start+len(fragment) > limit {
+			return dst[:start], ErrHeaderTooLarge
+		}
+		dst = append(dst, fragment...)
+
+		switch {
+		case err == nil:
+			for len(dst) > start && (dst[len(dst)-1] == '\n' || dst[len(dst)-1] == '\r') {
+				dst = dst[:len(dst)-1]
+			}
+			return dst, nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(dst) > start:
+			return dst[:start], newProtocolError("unexpected end of response", string(dst[start:]), io.ErrUnexpectedEOF)
+		default:
+			return dst[:start], err
+		}
+	}
+}
+
+// readSection appends an encapsulated header section of the given size to
+// message
+func (p *responseParser) readSection(message []byte, name string, size int) ([]byte, error) {
+	p.headerBytes += size
+	if p.headerBytes > p.maxHeaderBytes {
+		return nil, newProtocolError(fmt.Sprintf("encapsulated %s exceeds %d bytes", name, p.maxHeaderBytes), "", ErrHeaderTooLarge)
+	}
+
+	start := len(message)
+	message = append(message, make([]byte, size)...)
+	block := message[start:]
+	if _, err := io.ReadFull(p.br, block); err != nil {
+		return nil, newProtocolError("truncated encapsulated "+name, "", io.ErrUnexpectedEOF)
+	}
+	if !bytes.HasSuffix(block, []byte("\r\n\r\n")) && !bytes.HasSuffix(block, []byte("\n\n")) {
+		return nil, newProtocolError("encapsulated "+name+" does not end with a blank line", string(block), nil)
+	}
+	return message, nil
+}
+
+// readChunkedBody appends a chunked body, up to and including the terminal
+// chunk, de-chunked to message, collecting chunk extensions in
+// p.extensions and trailer fields in p.trailer. With spool set, a body growing past the spool threshold is
+// moved to a spool file, returned rewound, and message is left without it.
+func (p *responseParser) readChunkedBody(message []byte, spool bool) ([]byte, *spoolFile, error) {
+	start := len(message)
+	var spooled *spoolFile
+	chunk := 0
+	fail := func(err error) ([]byte, *spoolFile, error) {
+		if spooled != nil {
+			spooled.Close()
+		}
+		return nil, nil, err
+	}
+
+	for {
+		line, err := p.readLine(maxChunkLineBytes)
+		if err != nil {
+			if errors.Is(err, ErrHeaderTooLarge) {
+				return fail(newProtocolError("chunk size line too long", "", nil))
+			}
+			return fail(err)
+		}
+
+		size, ok := parseChunkSize(line)
+		if !ok {
+			return fail(newProtocolError("malformed chunk size", string(line), nil))
+		}
+		p.extensions = parseChunkExtensions(p.extensions, chunk, line)
+		chunk++
+
+		if size == 0 {
+			if err := p.readTrailer(); err != nil {
+				return fail(err)
+			}
+			if spooled != nil {
+				if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+					return fail(fmt.Errorf("failed to rewind spool file: %w", err))
+				}
+			}
+			return message, spooled, nil
+		}
+
+		if spool && spooled == nil && int64(len(message)-start)+size > p.spool.Threshold {
+			file, err := p.spool.create()
+			if err != nil {
+				return fail(err)
+			}
+			spooled = &spoolFile{file}
+			if _, err := file.Write(message[start:]); err != nil {
+				return fail(fmt.Errorf("failed to spool body: %w", err))
+			}
+			message = message[:start]
+		}
+
+		if spooled != nil {
+			if n, err := io.CopyN(spooled, p.br, size); err != nil {
+				if errors.Is(err, io.EOF) {
+					return fail(newProtocolError(fmt.Sprintf("truncated chunk, got %d of %d bytes", n, size), "", io.ErrUnexpectedEOF))
+				}
+				return fail(fmt.Errorf("failed to spool body: %w", err))
+			}
+		} else if message, err = p.readChunkData(message, size); err != nil {
+			return fail(err)
+		}
+		if terminator, err := p.readLine(2); err != nil || len(terminator) != 0 {
+			return fail(newProtocolError("chunk data not followed by CRLF", string(terminator), nil))
+		}
+	}
+}
+
+// readTrailer reads the trailer fields after the terminal chunk up to the
+// blank line into p.trailer, charging them to the header limits. Lines
+// that are not fields are skipped.
+func (p *responseParser) readTrailer() error {
+	count := 0
+	for {
+		line, err := p.readLine(maxChunkLineBytes)
+		if err != nil {
+			if errors.Is(err, ErrHeaderTooLarge) {
+				return newProtocolError("trailer line too long", "", nil)
+			}
+			return err
+		}
+		if len(line) == 0 {
+			return nil
+		}
+
+		p.headerBytes += len(line) + 2
+		if p.headerBytes > p.maxHeaderBytes {
+			return newProtocolError(fmt.Sprintf("trailer exceeds %d bytes", p.maxHeaderBytes), "", ErrHeaderTooLarge)
+		}
+		if count++; count > p.maxHeaderCount {
+			return newProtocolError(fmt.Sprintf("more than %d trailer fields", p.maxHeaderCount), "", ErrTooManyHeaders)
+		}
+		name, value, ok := strings.Cut(string(line), ":")
+		if name = strings.TrimSpace(name); !ok || !validHeaderName(name) {
+			continue
+		}
+		if p.trailer == nil {
+			p.trailer = make(map[string]string)
+		}
+		p.trailer[name] = strings.TrimSpace(value)
+	}
+}
+
+// readChunkData appends size bytes of chunk data to message. The buffer is
+// grown as data arrives rather than by the announced size, which the server
+// may not deliver.
+func (p *responseParser) readChunkData(message []byte, size int64) ([]byte, error) {
+	var read int64
+	for read < size {
+		if len(message) == cap(message) {
+			message = append(message, 0)[:len(message)]
+		}
+		n := int(min(int64(cap(message)-len(message)), size-read))
+		got, err := io.ReadFull(p.br, message[len(message):len(message)+n])
+		message = message[:len(message)+got]
+		read += int64(got)
+		if err != nil {
+			return nil, newProtocolError(fmt.Sprintf("truncated chunk, got %d of %d bytes", read, size), "", io.ErrUnexpectedEOF)
+		}
+	}
+	return message, nil
+}
+
+// parseChunkSize parses the hexadecimal size of a chunk size line, ignoring
+// chunk extensions
+func parseChunkSize(line []byte) (int64, bool) {
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return 0, false
+	}
+
+	var size int64
+	for _, c := range line {
+		var digit byte
+		switch {
+		case c >= '0' && c <= '9':
+			digit = c - '0'
+		case c >= 'a' && c <= 'f':
+			digit = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			digit = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		if size > (math.MaxInt64-int64(digit))/16 {
+			return 0, false
+		}
+		size = size*16 + int64(digit)
+	}
+	return size, true
+}
+
+// ChunkExtension is an extension on a chunk size line of an encapsulated
+// body, such as "ieof" or "use-original-body=0"
+type ChunkExtension struct {
+	// Chunk is the index of the chunk in the body, counting the terminal
+	// zero size chunk
+	Chunk int    `yaml:"chunk" json:"chunk"`
+	Name  string `yaml:"name" json:"name"`
+	Value string `yaml:"value,omitempty" json:"value,omitempty"`
+}
+
+// parseChunkExtensions appends the extensions of a chunk size line to dst.
+// Values may be tokens or quoted strings; malformed extensions are skipped
+// rather than failing the response.
+func parseChunkExtensions(dst []ChunkExtension, chunk int, line []byte) []ChunkExtension {
+	i := bytes.IndexByte(line, ';')
+	if i < 0 {
+		return dst
+	}
+	rest := string(line[i+1:])
+	for rest != "" {
+		var extension string
+		extension, rest = cutChunkExtension(rest)
+		name, value, _ := strings.Cut(extension, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !validHeaderName(name) {
+			continue
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = unquoteChunkValue(value[1 : len(value)-1])
+		}
+		dst = append(dst, ChunkExtension{Chunk: chunk, Name: strings.ToLower(name), Value: value})
+	}
+	return dst
+}
+
+// cutChunkExtension splits the first extension from a list separated by
+// ';', which may appear inside quoted values
+func cutChunkExtension(list string) (string, string) {
+	quoted := false
+	for i := 0; i < len(list); i++ {
+		switch c := list[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			return list[:i], list[i+1:]
+		}
+	}
+	return list, ""
+}
+
+// unquoteChunkValue removes the backslash escapes of a quoted string
+func unquoteChunkValue(value string) string {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// UseOriginalBody returns the offset in the original body from which the
+// server asks the client to use it, sent as a "use-original-body" extension
+// of the terminal chunk in a 206 Partial Content response
+func (r *IcapResponse) UseOriginalBody() (int64, bool) {
+	for _, extension := range r.ChunkExtensions {
+		if extension.Name != "use-original-body" {
+			continue
+		}
+		offset, err := strconv.ParseInt(extension.Value, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, false
+		}
+		return offset, true
+	}
+	return 0, false
+}
+
+// encapsulatedSection is an entry of the Encapsulated header
+type encapsulatedSection struct {
+	name   string
+	offset int
+}
+
+// isBody reports whether the section is a body entity, which must come last
+func (s encapsulatedSection) isBody() bool {
+	return strings.HasSuffix(s.name, "-body")
+}
+
+// encapsulatedNames are the entity names allowed in the Encapsulated header
+var encapsulatedNames = map[string]bool{
+	"req-hdr":   true,
+	"res-hdr":   true,
+	"req-body":  true,
+	"res-body":  true,
+	"opt-body":  true,
+	"null-body": true,
+}
+
+// parseEncapsulated parses an Encapsulated header value such as
+// "res-hdr=0, res-body=137", appending the sections to dst
+func parseEncapsulated(dst []encapsulatedSection, value string) ([]encapsulatedSection, error) {
+	if strings.TrimSpace(value) == "" {
+		return dst, nil
+	}
+
+	sections := dst
+	for rest := value; rest != ""; {
+		var part string
+		part, rest, _ = strings.Cut(rest, ",")
+		name, offset, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, newProtocolError("malformed Encapsulated header", value, nil)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !encapsulatedNames[name] {
+			return nil, newProtocolError("unknown Encapsulated entity "+name, value, nil)
+		}
+		if len(sections) > 0 && sections[len(sections)-1].isBody() {
+			return nil, newProtocolError("Encapsulated body entity is not last", value, nil)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(offset))
+		if err != nil || n < 0 {
+			return nil, newProtocolError("malformed Encapsulated offset", value, nil)
+		}
+		if len(sections) == 0 && n != 0 {
+			return nil, newProtocolError("first Encapsulated offset is not 0", value, nil)
+		}
+		if len(sections) > 0 && n < sections[len(sections)-1].offset {
+			return nil, newProtocolError("decreasing Encapsulated offsets", value, nil)
+		}
+		sections = append(sections, encapsulatedSection{name: name, offset: n})
+	}
+
+	if !sections[len(sections)-1].isBody() {
+		return nil, newProtocolError("Encapsulated header has no body entity", value, nil)
+	}
+
+	return sections, nil
+}
+
+// parseHTTPHeaderBlock splits an HTTP header block into its start line and
+// headers, which are substrings of a single copy of block
+func parseHTTPHeaderBlock(block []byte) (string, map[string]string) {
+	text := strings.TrimRight(string(block), "\r\n")
+	startLine, text, _ := strings.Cut(text, "\n")
+	headers := make(map[string]string, bytes.Count(block, []byte("\n")))
+	for text != "" {
+		var line string
+		line, text, _ = strings.Cut(text, "\n")
+		name, value, ok := strings.Cut(strings.TrimRight(line, "\r"), ":")
+		if ok {
+			headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return strings.TrimRight(startLine, "\r"), headers
+}
+
+// splitStartLine splits an HTTP start line into its three space-separated
+// fields, the last of which may contain spaces
+func splitStartLine(line string) (string, string, string) {
+	first, rest, _ := strings.Cut(line, " ")
+	second, third, _ := strings.Cut(rest, " ")
+	return first, second, third
+}
+
+// parseHTTPRequestHeader parses an encapsulated HTTP request header block
+func parseHTTPRequestHeader(block []byte, body []byte) *HttpRequest {
+	startLine, headers := parseHTTPHeaderBlock(block)
+	method, uri, version := splitStartLine(startLine)
+	return &HttpRequest{
+		Method:  method,
+		URI:     uri,
+		Version: version,
+		Headers: headers,
+		Body:    body,
+	}
+}
+
+// parseHTTPResponseHeader parses an encapsulated HTTP response header block
+func parseHTTPResponseHeader(block []byte, body []byte) *HttpResponse {
+	startLine, headers := parseHTTPHeaderBlock(block)
+	version, code, reason := splitStartLine(startLine)
+	statusCode, _ := strconv.Atoi(code)
+	return &HttpResponse{
+		Version:    version,
+		StatusCode: statusCode,
+		Reason:     reason,
+		Headers:    headers,
+		Body:       body,
+	}
+}
+
+// headerValue looks up a header ignoring case
+func headerValue(headers map[string]string, name string) string {
+	if value, ok := headers[name]; ok {
+		return value
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,351 @@
+package icapclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// parseTestResponse parses wire with the given limits
+func parseTestResponse(wire string, maxHeaderBytes, maxHeaderCount int) (*IcapResponse, error) {
+	return newResponseParser(bufio.NewReader(strings.NewReader(wire)), maxHeaderBytes, maxHeaderCount).ReadResponse()
+}
+
+// TestResponseParser_ReadResponse tests reading an ICAP response with an encapsulated message
+func TestResponseParser_ReadResponse(t *testing.T) {
+	wire := "ICAP/1.0 200 OK\r\n" +
+		"ISTag: \"abc\"\r\n" +
+		"X-Folded: first\r\n second\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+		"\r\n" +
+		"HTTP/1.1 403 Forbidden\r\nContent-Length: 7\r\n\r\n" +
+		"3\r\nblo\r\n4; ext=1\r\ncked\r\n0\r\n\r\n"
+
+	response, err := parseTestResponse(wire, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	if response.StatusCode != 200 || response.Headers["ISTag"] != "\"abc\"" {
+		t.Errorf("Expected 200 with ISTag, got %d %v", response.StatusCode, response.Headers)
+	}
+	if response.Headers["X-Folded"] != "first second" {
+		t.Errorf("Expected folded header 'first second', got %q", response.Headers["X-Folded"])
+	}
+	if response.HttpResponse == nil || response.HttpResponse.StatusCode != 403 {
+		t.Fatalf("Expected encapsulated 403, got %+v", response.HttpResponse)
+	}
+	if string(response.HttpResponse.Body) != "blocked" {
+		t.Errorf("Expected body 'blocked', got %q", response.HttpResponse.Body)
+	}
+	if response.HttpResponse.Headers["Content-Length"] != "7" {
+		t.Errorf("Expected Content-Length 7, got %q", response.HttpResponse.Headers["Content-Length"])
+	}
+
+	expectedBody := "HTTP/1.1 403 Forbidden\r\nContent-Length: 7\r\n\r\nblocked"
+	if string(response.Body) != expectedBody {
+		t.Errorf("Expected body %q, got %q", expectedBody, response.Body)
+	}
+}
+
+// TestResponseParser_ChunkExtensions tests that chunk extensions are parsed
+// and exposed, and malformed ones tolerated
+func TestResponseParser_ChunkExtensions(t *testing.T) {
+	wire := "ICAP/1.0 206 Partial Content\r\n" +
+		"Encapsulated: res-hdr=0, res-body=19\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n\r\n" +
+		"3; X-Vendor=\"a;\\\"b\" ;hint\r\nnew\r\n" +
+		"2;=bad; ;IEOF\r\nly\r\n" +
+		"0; use-original-body=5\r\n\r\n"
+
+	response, err := parseTestResponse(wire, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if string(response.HttpResponse.Body) != "newly" {
+		t.Errorf("Expected body 'newly', got %q", response.HttpResponse.Body)
+	}
+
+	expected := []ChunkExtension{
+		{Chunk: 0, Name: "x-vendor", Value: `a;"b`},
+		{Chunk: 0, Name: "hint"},
+		{Chunk: 1, Name: "ieof"},
+		{Chunk: 2, Name: "use-original-body", Value: "5"},
+	}
+	if fmt.Sprint(response.ChunkExtensions) != fmt.Sprint(expected) {
+		t.Errorf("Expected extensions %v, got %v", expected, response.ChunkExtensions)
+	}
+	if offset, ok := response.UseOriginalBody(); !ok || offset != 5 {
+		t.Errorf("Expected use-original-body 5, got %d %v", offset, ok)
+	}
+
+	response, err = parseTestResponse("ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\n2\r\nok\r\n0\r\n\r\n", 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if response.ChunkExtensions != nil {
+		t.Errorf("Expected no extensions, got %v", response.ChunkExtensions)
+	}
+	if _, ok := response.UseOriginalBody(); ok {
+		t.Error("Expected no use-original-body")
+	}
+}
+
+// TestResponseParser_Trailer tests reading the trailer after the terminal
+// chunk into the encapsulated message
+func TestResponseParser_Trailer(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		wire     string
+		expected map[string]string
+	}{
+		{"response", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\nHTTP/1.1 200 OK\r\n\r\n" +
+			"2\r\nok\r\n0\r\nX-Checksum: 47b6ee26\r\nbogus line\r\nDigest:  sha-256=abc \r\n\r\n",
+			map[string]string{"X-Checksum": "47b6ee26", "Digest": "sha-256=abc"}},
+		{"request", "ICAP/1.0 200 OK\r\nEncapsulated: req-hdr=0, req-body=18\r\n\r\nPUT / HTTP/1.1\r\n\r\n" +
+			"2\r\nok\r\n0\r\nX-Checksum: 47b6ee26\r\n\r\n",
+			map[string]string{"X-Checksum": "47b6ee26"}},
+		{"none", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\nHTTP/1.1 200 OK\r\n\r\n2\r\nok\r\n0\r\n\r\n", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := parseTestResponse(tt.wire, 0, 0)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			var trailer map[string]string
+			if response.HttpResponse != nil {
+				trailer = response.HttpResponse.Trailer
+			} else {
+				trailer = response.HttpRequest.Trailer
+			}
+			if fmt.Sprint(trailer) != fmt.Sprint(tt.expected) {
+				t.Errorf("Expected trailer %v, got %v", tt.expected, trailer)
+			}
+		})
+	}
+
+	_, err := parseTestResponse("ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\n0\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", 0, 2)
+	if !errors.Is(err, ErrTooManyHeaders) {
+		t.Errorf("Expected ErrTooManyHeaders for too many trailer fields, got %v", err)
+	}
+}
+
+// TestResponseParser_OptBody tests decoding the opt-body of an OPTIONS
+// response
+func TestResponseParser_OptBody(t *testing.T) {
+	body := `{"service": "avscan", "categories": ["malware", "phishing"]}`
+	wire := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nOpt-body-type: JSON-Capabilities\r\nEncapsulated: opt-body=0\r\n\r\n" +
+		fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+	response, err := parseTestResponse(wire, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if response.OptBody == nil || response.OptBody.Type != "JSON-Capabilities" || string(response.OptBody.Bytes()) != body {
+		t.Fatalf("Expected the opt-body, got %+v", response.OptBody)
+	}
+	if categories := response.OptBody.Fields["categories"]; categories != "malware, phishing" {
+		t.Errorf("Expected categories field, got %q", categories)
+	}
+	if string(response.Body) != body || response.HttpResponse != nil {
+		t.Errorf("Expected the raw opt-body in Body only, got %q", response.Body)
+	}
+
+	response, err = parseTestResponse("ICAP/1.0 200 OK\r\nEncapsulated: null-body=0\r\n\r\n", 0, 0)
+	if err != nil || response.OptBody != nil {
+		t.Errorf("Expected no opt-body, got %+v (%v)", response.OptBody, err)
+	}
+}
+
+// TestResponseParser_Malformed tests descriptive errors for malformed responses
+func TestResponseParser_Malformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		wire    string
+		message string
+	}{
+		{"Empty status line", "\r\n\r\n", "malformed status line"},
+		{"Missing status code", "ICAP/1.0\r\n\r\n", "malformed status line"},
+		{"Bad version", "HTTP/1.1 200 OK\r\n\r\n", "invalid ICAP version"},
+		{"Bad status code", "ICAP/1.0 2x0 OK\r\n\r\n", "invalid status code"},
+		{"Short status code", "ICAP/1.0 20 OK\r\n\r\n", "invalid status code"},
+		{"Header without colon", "ICAP/1.0 200 OK\r\nISTag\r\n\r\n", "malformed header line"},
+		{"Invalid header name", "ICAP/1.0 200 OK\r\nIS Tag: x\r\n\r\n", "invalid header name"},
+		{"Leading continuation", "ICAP/1.0 200 OK\r\n folded\r\n\r\n", "continuation line"},
+		{"Truncated headers", "ICAP/1.0 200 OK\r\nISTag: x", "unexpected end"},
+		{"Unknown entity", "ICAP/1.0 200 OK\r\nEncapsulated: foo=0\r\n\r\n", "unknown Encapsulated entity"},
+		{"Nonzero first offset", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=5, null-body=10\r\n\r\n", "first Encapsulated offset"},
+		{"Decreasing offsets", "ICAP/1.0 200 OK\r\nEncapsulated: req-hdr=0, res-hdr=10, null-body=5\r\n\r\n", "decreasing"},
+		{"No body entity", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0\r\n\r\n", "no body entity"},
+		{"Body not last", "ICAP/1.0 200 OK\r\nEncapsulated: res-body=0, res-hdr=0\r\n\r\n", "not last"},
+		{"Truncated section", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=100\r\n\r\nHTTP/1.1 200 OK\r\n", "truncated"},
+		{"Section without blank line", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=17\r\n\r\nHTTP/1.1 200 OK\r\n", "blank line"},
+		{"Bad chunk size", "ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\nzz\r\n", "malformed chunk size"},
+		{"Negative chunk size", "ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\n-5\r\n", "malformed chunk size"},
+		{"Truncated chunk", "ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\n10\r\nabc", "truncated chunk"},
+		{"Chunk without CRLF", "ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\n3\r\nabcdef\r\n", "not followed by CRLF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestResponse(tt.wire, 0, 0)
+			var protocolErr *ProtocolError
+			if !errors.As(err, &protocolErr) {
+				t.Fatalf("Expected ProtocolError, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("Expected error containing %q, got %q", tt.message, err.Error())
+			}
+		})
+	}
+}
+
+// TestResponseParser_Limits tests the header size and count limits
+func TestResponseParser_Limits(t *testing.T) {
+	var manyHeaders strings.Builder
+	manyHeaders.WriteString("ICAP/1.0 200 OK\r\n")
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&manyHeaders, "X-Header-%d: value\r\n", i)
+	}
+	manyHeaders.WriteString("\r\n")
+
+	longHeader := "ICAP/1.0 200 OK\r\nX-Long: " + strings.Repeat("a", 10000) + "\r\n\r\n"
+	bigSection := "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=5000\r\n\r\n" + strings.Repeat("a", 5000)
+
+	tests := []struct {
+		name           string
+		wire           string
+		maxHeaderBytes int
+		maxHeaderCount int
+		wantErr        error
+	}{
+		{"Headers within count", manyHeaders.String(), 0, 20, nil},
+		{"Too many headers", manyHeaders.String(), 0, 10, ErrTooManyHeaders},
+		{"Long header within limit", longHeader, 0, 0, nil},
+		{"Long header over limit", longHeader, 1024, 0, ErrHeaderTooLarge},
+		{"Encapsulated section over limit", bigSection, 1024, 0, ErrHeaderTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestResponse(tt.wire, tt.maxHeaderBytes, tt.maxHeaderCount)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestResponseParser_Stream tests reading consecutive responses from one stream
+func TestResponseParser_Stream(t *testing.T) {
+	wire := "ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n" +
+		"ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\n2\r\nok\r\n0\r\n\r\n"
+	parser := newResponseParser(bufio.NewReader(strings.NewReader(wire)), 0, 0)
+
+	for _, expected := range []int{204, 200} {
+		response, err := parser.ReadResponse()
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if response.StatusCode != expected {
+			t.Errorf("Expected status %d, got %d", expected, response.StatusCode)
+		}
+	}
+}
+
+// parserTestResponse builds a RESPMOD response with headers ICAP headers and
+// a small encapsulated body
+func parserTestResponse(headers int) string {
+	var b strings.Builder
+	b.WriteString("ICAP/1.0 200 OK\r\n")
+	for i := 0; i < headers; i++ {
+		fmt.Fprintf(&b, "X-Header-%d: value-%d\r\n", i, i)
+	}
+	b.WriteString("Encapsulated: res-hdr=0, res-body=64\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 12\r\n\r\n" +
+		"c\r\nHello World!\r\n0\r\n\r\n")
+	return b.String()
+}
+
+// newReusedParser returns a parser and a function that rewinds it to the
+// start of wire, as a persistent connection reuses its parser
+func newReusedParser(wire string) (*responseParser, func()) {
+	reader := strings.NewReader(wire)
+	br := bufio.NewReader(reader)
+	parser := newResponseParser(br, 0, 0)
+	return parser, func() {
+		reader.Reset(wire)
+		br.Reset(reader)
+	}
+}
+
+// TestResponseParser_Allocations tests that the allocations of a response do
+// not grow with its number of headers
+func TestResponseParser_Allocations(t *testing.T) {
+	allocs := func(headers int) float64 {
+		parser, rewind := newReusedParser(parserTestResponse(headers))
+		return testing.AllocsPerRun(100, func() {
+			rewind()
+			if _, err := parser.ReadResponse(); err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+		})
+	}
+
+	few, many := allocs(4), allocs(64)
+	// A larger header map needs a few more bucket allocations, not one per header
+	if many-few > 4 {
+		t.Errorf("Expected allocations independent of header count, got %.0f for 4 headers and %.0f for 64", few, many)
+	}
+}
+
+// BenchmarkResponseParser_ReadResponse benchmarks reading responses with a
+// reused parser
+func BenchmarkResponseParser_ReadResponse(b *testing.B) {
+	for _, headers := range []int{4, 64} {
+		b.Run(fmt.Sprintf("%d headers", headers), func(b *testing.B) {
+			parser, rewind := newReusedParser(parserTestResponse(headers))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rewind()
+				if _, err := parser.ReadResponse(); err != nil {
+					b.Fatalf("Failed to read response: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// FuzzResponseParser checks that arbitrary input never panics the parser and
+// that accepted responses are consistent
+func FuzzResponseParser(f *testing.F) {
+	f.Add("ICAP/1.0 204 No Content\r\nISTag: \"x\"\r\nEncapsulated: null-body=0\r\n\r\n")
+	f.Add("ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\nHTTP/1.1 200 OK\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	f.Add("ICAP/1.0 200 OK\r\nEncapsulated: req-hdr=0, null-body=18\r\n\r\nGET / HTTP/1.1\r\n\r\n")
+	f.Add("ICAP/1.0 100 Continue\r\n\r\n")
+	f.Add("ICAP/1.0\r\n")
+	f.Add("ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\nffffffffffffffff\r\n")
+	f.Add("ICAP/1.0 206 Partial Content\r\nEncapsulated: res-body=0\r\n\r\n2; a=\"x;y\"\r\nok\r\n0; use-original-body=2\r\n\r\n")
+
+	f.Fuzz(func(t *testing.T, wire string) {
+		response, err := parseTestResponse(wire, 4096, 32)
+		if err != nil {
+			return
+		}
+		if response.StatusCode < 100 || response.StatusCode > 999 {
+			t.Errorf("Accepted invalid status code %d", response.StatusCode)
+		}
+		if len(response.Headers) > 32 {
+			t.Errorf("Accepted %d headers over the limit", len(response.Headers))
+		}
+	})
+}
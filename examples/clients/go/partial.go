@@ -0,0 +1,114 @@
+package icapclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// reassemblePartial completes the encapsulated message of a 206 Partial
+// Content response, which holds the adapted headers and the start of the
+// body, with the body that was sent from the offset of the terminal
+// chunk's use-original-body extension. Content-Length is updated to the
+// reassembled size. The rest of the original body is appended to a spooled
+// adapted body, and is spooled itself when a streamed original would take
+// the reassembled body over the spool threshold.
+func (c *IcapClient) reassemblePartial(spool SpoolConfig, response *IcapResponse, sent interface{}, stream *bodyStream) error {
+	if response.StatusCode != int(PartialContent) {
+		return nil
+	}
+	offset, ok := response.UseOriginalBody()
+	if !ok {
+		return nil
+	}
+
+	// The adapted message of the kind that was sent
+	var body *[]byte
+	var reader *io.Reader
+	var headers map[string]string
+	switch sent.(type) {
+	case *HttpRequest:
+		if adapted := response.HttpRequest; adapted != nil {
+			body, reader, headers = &adapted.Body, &adapted.BodyReader, adapted.Headers
+		}
+	case *HttpResponse:
+		if adapted := response.HttpResponse; adapted != nil {
+			body, reader, headers = &adapted.Body, &adapted.BodyReader, adapted.Headers
+		}
+	}
+	if body == nil {
+		return newProtocolError("206 response without the encapsulated message sent", "", nil)
+	}
+
+	// The rest of the original body, from the stream when it was streamed
+	var rest io.Reader
+	size := int64(len(httpBody(sent)))
+	if stream != nil {
+		size = stream.size
+	}
+	if offset > size {
+		return newProtocolError(fmt.Sprintf("use-original-body offset %d is past the %d byte original body", offset, size), "", nil)
+	}
+	if stream != nil {
+		if _, err := stream.source.Seek(stream.start+offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind original body: %w", err)
+		}
+		rest = io.LimitReader(stream.source, size-offset)
+	} else {
+		rest = bytes.NewReader(httpBody(sent)[offset:])
+	}
+
+	total, err := c.appendOriginalBody(spool, body, reader, rest, size-offset, stream != nil)
+	if err != nil {
+		return err
+	}
+	if headerValue(headers, "Content-Length") != "" {
+		setHeader(headers, "Content-Length", strconv.FormatInt(total, 10))
+	}
+	return nil
+}
+
+// appendOriginalBody appends n bytes of rest to the adapted body, held in
+// *body or in the spool file *reader, and returns the reassembled size
+func (c *IcapClient) appendOriginalBody(spool SpoolConfig, body *[]byte, reader *io.Reader, rest io.Reader, n int64, streamed bool) (int64, error) {
+	spooled, _ := (*reader).(*spoolFile)
+	if spooled == nil && streamed && spool.enabled() && int64(len(*body))+n > spool.Threshold {
+		file, err := spool.create()
+		if err != nil {
+			return 0, err
+		}
+		spooled = &spoolFile{file}
+		if _, err := file.Write(*body); err != nil {
+			spooled.Close()
+			return 0, fmt.Errorf("failed to spool body: %w", err)
+		}
+		*body, *reader = nil, spooled
+	}
+
+	if spooled == nil {
+		joined := make([]byte, len(*body), int64(len(*body))+n)
+		copy(joined, *body)
+		tail, err := io.ReadAll(rest)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read original body: %w", err)
+		}
+		*body = append(joined, tail...)
+		return int64(len(*body)), nil
+	}
+
+	if _, err := spooled.Seek(0, io.SeekEnd); err != nil {
+		return 0, fmt.Errorf("failed to spool body: %w", err)
+	}
+	if _, err := io.Copy(spooled, rest); err != nil {
+		return 0, fmt.Errorf("failed to spool body: %w", err)
+	}
+	total, err := spooled.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to spool body: %w", err)
+	}
+	if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+	return total, nil
+}
@@ -0,0 +1,156 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// servePartial starts a server answering every request with response,
+// after checking that the client allows 206, and returns a client for it
+func servePartial(t *testing.T, response string) *IcapClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				var request bytes.Buffer
+				for !bytes.HasSuffix(request.Bytes(), []byte("\r\n0\r\n\r\n")) {
+					line, err := br.ReadBytes('\n')
+					request.Write(line)
+					if err != nil {
+						return
+					}
+				}
+				if !strings.Contains(request.String(), "Allow: 204, 206\r\n") {
+					t.Errorf("Expected the client to allow 206, got %q", request.String())
+				}
+				io.WriteString(conn, response)
+			}()
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	client := NewIcapClient(&IcapConfig{Host: addr.IP.String(), Port: addr.Port, Timeout: 5 * time.Second, LoggingLevel: "ERROR"})
+	t.Cleanup(client.Close)
+	return client
+}
+
+// partialResponse returns a 206 response encapsulating the section header,
+// then body and a terminal chunk asking for the original body from offset
+func partialResponse(section, header, body string, offset int) string {
+	chunk := ""
+	if body != "" {
+		chunk = fmt.Sprintf("%x\r\n%s\r\n", len(body), body)
+	}
+	return "ICAP/1.0 206 Partial Content\r\n" +
+		"ISTag: \"partial-1\"\r\n" +
+		fmt.Sprintf("Encapsulated: %s-hdr=0, %s-body=%d\r\n", section, section, len(header)) +
+		"\r\n" + header + chunk +
+		fmt.Sprintf("0; use-original-body=%d\r\n\r\n", offset)
+}
+
+// TestIcapClient_PartialContent tests reassembling 206 responses from the
+// returned start of the body and the rest of the original
+func TestIcapClient_PartialContent(t *testing.T) {
+	original := "hello world, from the origin"
+
+	t.Run("respmod", func(t *testing.T) {
+		client := servePartial(t, partialResponse("res", "HTTP/1.1 200 OK\r\nContent-Length: 28\r\nX-Adapted: yes\r\n\r\n", "HOWDY", 5))
+		verdict, response, err := client.ScanResponse(context.Background(), &HttpResponse{
+			Version: "HTTP/1.1", StatusCode: 200, Reason: "OK",
+			Headers: map[string]string{"Content-Length": "28"}, Body: []byte(original),
+		})
+		if err != nil {
+			t.Fatalf("RESPMOD failed: %v", err)
+		}
+
+		adapted := response.HttpResponse
+		if response.StatusCode != 206 || verdict != VerdictModified {
+			t.Errorf("Expected modified 206, got %d %s", response.StatusCode, verdict)
+		}
+		if string(adapted.Body) != "HOWDY world, from the origin" {
+			t.Errorf("Expected reassembled body, got %q", adapted.Body)
+		}
+		if adapted.Headers["X-Adapted"] != "yes" || adapted.Headers["Content-Length"] != "28" {
+			t.Errorf("Expected adapted headers with Content-Length 28, got %v", adapted.Headers)
+		}
+	})
+
+	t.Run("reqmod", func(t *testing.T) {
+		client := servePartial(t, partialResponse("req", "POST /upload HTTP/1.1\r\nContent-Length: 28\r\n\r\n", "", 6))
+		response, err := client.Reqmod(context.Background(), &HttpRequest{
+			Method: "POST", URI: "/upload", Version: "HTTP/1.1",
+			Headers: map[string]string{"Content-Length": "28"}, Body: []byte(original),
+		})
+		if err != nil {
+			t.Fatalf("REQMOD failed: %v", err)
+		}
+		adapted := response.HttpRequest
+		if string(adapted.Body) != "world, from the origin" || adapted.Headers["Content-Length"] != "22" {
+			t.Errorf("Expected the original body from offset 6 with Content-Length 22, got %q %v", adapted.Body, adapted.Headers)
+		}
+	})
+
+	t.Run("offset past the body", func(t *testing.T) {
+		client := servePartial(t, partialResponse("res", "HTTP/1.1 200 OK\r\n\r\n", "", 100))
+		_, err := client.Respmod(context.Background(), &HttpResponse{
+			Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Headers: map[string]string{}, Body: []byte(original),
+		})
+		if err == nil || !strings.Contains(err.Error(), "past the 28 byte original body") {
+			t.Errorf("Expected an error for an offset past the body, got %v", err)
+		}
+	})
+}
+
+// TestIcapClient_PartialContentStreamed tests reassembling a streamed
+// original body into a spool file
+func TestIcapClient_PartialContentStreamed(t *testing.T) {
+	original := strings.Repeat("0123456789", 500)
+	client := servePartial(t, partialResponse("res", "HTTP/1.1 200 OK\r\n\r\n", "start", 10))
+	dir := t.TempDir()
+	client.config.Load().Spool = SpoolConfig{Directory: dir, Threshold: 1024}
+
+	response, err := client.Respmod(context.Background(), &HttpResponse{
+		Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Headers: map[string]string{},
+		BodyReader: strings.NewReader(original),
+	})
+	if err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+
+	adapted := response.HttpResponse
+	if adapted.Body != nil || adapted.BodyReader == nil {
+		t.Fatalf("Expected a spooled body, got %d bytes in memory", len(adapted.Body))
+	}
+	data, err := io.ReadAll(adapted.BodyReader)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if string(data) != "start"+original[10:] {
+		t.Errorf("Expected %d byte reassembled body, got %d bytes", len(original)-5, len(data))
+	}
+	if err := response.Close(); err != nil {
+		t.Errorf("Failed to close response: %v", err)
+	}
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected spool files to be removed, got %v", files)
+	}
+}
@@ -0,0 +1,496 @@
+package icapclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Policy actions
+const (
+	// PolicyScan sends the message to the ICAP server
+	PolicyScan = "scan"
+	// PolicyBypass answers 204 without contacting the server
+	PolicyBypass = "bypass"
+	// PolicyBlock answers with a 403 block page without contacting the
+	// server
+	PolicyBlock = "block"
+	// PolicyPreview scans only the first policy.preview_size bytes of the
+	// body, sent as if complete with the original headers, so that the
+	// Content-Length still tells the server the full size
+	PolicyPreview = "preview"
+)
+
+// Failure modes, what happens to a scanned message when the ICAP server
+// cannot be reached or times out
+const (
+	// FailError returns the error to the caller
+	FailError = "error"
+	// FailOpen allows the message unscanned, answering 204
+	FailOpen = "open"
+	// FailClosed blocks the message with the block page of PolicyBlock
+	FailClosed = "closed"
+)
+
+// defaultPolicyPreviewSize is the policy.preview_size used when unset
+const defaultPolicyPreviewSize = 1 << 20
+
+// policyBlockPage is the body of the block page of PolicyBlock
+const policyBlockPage = "Blocked by client policy\n"
+
+// PolicyConfig decides, before a REQMOD or RESPMOD request is sent, whether
+// its message is scanned, bypassed or blocked, so that the client can sit
+// inline without scanning everything. URLs in Denylist are blocked and
+// those in Allowlist bypassed, then bodies outside the scan sizes are
+// handled, before rules are tried in order, the first one matching
+// deciding; messages matching none get Default. Messages to be scanned are
+// then sampled when Sampling is enabled.
+type PolicyConfig struct {
+	// Default is the action of messages matching no rule, PolicyScan if
+	// empty
+	Default   string        `yaml:"default" json:"default"`
+	Allowlist URLListConfig `yaml:"allowlist" json:"allowlist"`
+	Denylist  URLListConfig `yaml:"denylist" json:"denylist"`
+	// MinScanSize bypasses bodies shorter than it, when not zero. Messages
+	// without a body are always sent, for URL filtering.
+	MinScanSize int64 `yaml:"min_scan_size" json:"min_scan_size"`
+	// MaxScanSize applies MaxScanSizeAction, PolicyBypass (default) or
+	// PolicyPreview, to bodies longer than it, when not zero
+	MaxScanSize       int64  `yaml:"max_scan_size" json:"max_scan_size"`
+	MaxScanSizeAction string `yaml:"max_scan_size_action" json:"max_scan_size_action"`
+	// PreviewSize is the length scanned by PolicyPreview, 1 MiB if zero
+	PreviewSize int64          `yaml:"preview_size" json:"preview_size"`
+	Rules       []PolicyRule   `yaml:"rules" json:"rules"`
+	Sampling    SamplingConfig `yaml:"sampling" json:"sampling"`
+	// OnFailure is the failure mode of scanned messages, FailError if
+	// empty
+	OnFailure string `yaml:"on_failure" json:"on_failure"`
+}
+
+// PolicyRule matches the messages meeting all of its conditions, a list
+// condition being met by any of its values. A rule without conditions
+// matches every message.
+type PolicyRule struct {
+	// Name identifies the rule in responses and the access log
+	Name string `yaml:"name" json:"name"`
+	// Action is PolicyScan, PolicyBypass, PolicyBlock or PolicyPreview
+	Action string `yaml:"action" json:"action"`
+	// ICAPMethods limits the rule to REQMOD or RESPMOD
+	ICAPMethods []string `yaml:"icap_methods" json:"icap_methods"`
+	// Methods are HTTP methods, matched by REQMOD requests only
+	Methods []string `yaml:"methods" json:"methods"`
+	// URLs are patterns as in URLListConfig. RESPMOD responses are matched
+	// by RequestOptions.URL.
+	URLs []string `yaml:"urls" json:"urls"`
+	// ContentTypes are media types, "image/*" matching any subtype
+	ContentTypes []string `yaml:"content_types" json:"content_types"`
+	// MinSize and MaxSize bound the body size in bytes, when not zero
+	MinSize int64 `yaml:"min_size" json:"min_size"`
+	MaxSize int64 `yaml:"max_size" json:"max_size"`
+	// OnFailure overrides PolicyConfig.OnFailure for the messages matching
+	// the rule, when not empty
+	OnFailure string `yaml:"on_failure" json:"on_failure"`
+}
+
+// PolicyDecision is the action taken on a message by the client policy,
+// and the name of the rule that chose it, empty for the default
+type PolicyDecision struct {
+	Action string `yaml:"action" json:"action"`
+	Rule   string `yaml:"rule,omitempty" json:"rule,omitempty"`
+}
+
+// validPolicyAction reports whether action is a policy action
+func validPolicyAction(action string) bool {
+	switch strings.ToLower(action) {
+	case PolicyScan, PolicyBypass, PolicyBlock, PolicyPreview:
+		return true
+	}
+	return false
+}
+
+// validFailureMode reports whether mode is a failure mode
+func validFailureMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "", FailError, FailOpen, FailClosed:
+		return true
+	}
+	return false
+}
+
+// Rule names of the decisions of the URL lists and scan sizes, and of the
+// failure modes
+const (
+	policyRuleAllowlist   = "allowlist"
+	policyRuleDenylist    = "denylist"
+	policyRuleMinScanSize = "min_scan_size"
+	policyRuleMaxScanSize = "max_scan_size"
+	policyRuleFailOpen    = "fail_open"
+	policyRuleFailClosed  = "fail_closed"
+)
+
+// policy is a PolicyConfig compiled for matching
+type policy struct {
+	defaultAction string
+	allow         *urlList
+	deny          *urlList
+	minScanSize   int64
+	maxScanSize   int64
+	maxScanAction string
+	previewSize   int64
+	rules         []policyRule
+	sampler       *sampler
+	onFailure     string
+}
+
+// policyRule is a compiled PolicyRule
+type policyRule struct {
+	PolicyRule
+	action string
+	urls   *urlList
+}
+
+// newPolicy compiles config, reading the files of its URL lists, or returns
+// nil if every message is scanned. Files that cannot be read and invalid
+// patterns are returned as errors and skipped.
+func newPolicy(config PolicyConfig) (*policy, []error) {
+	p := &policy{
+		defaultAction: strings.ToLower(config.Default),
+		minScanSize:   config.MinScanSize,
+		maxScanSize:   config.MaxScanSize,
+		maxScanAction: strings.ToLower(config.MaxScanSizeAction),
+		previewSize:   config.PreviewSize,
+		sampler:       newSampler(config.Sampling),
+		onFailure:     strings.ToLower(config.OnFailure),
+	}
+	if p.defaultAction == "" {
+		p.defaultAction = PolicyScan
+	}
+	if p.maxScanAction == "" {
+		p.maxScanAction = PolicyBypass
+	}
+	if p.previewSize <= 0 {
+		p.previewSize = defaultPolicyPreviewSize
+	}
+	if len(config.Rules) == 0 && config.Allowlist.empty() && config.Denylist.empty() &&
+		p.minScanSize <= 0 && p.maxScanSize <= 0 && p.defaultAction == PolicyScan && p.sampler == nil &&
+		(p.onFailure == "" || p.onFailure == FailError) {
+		return nil, nil
+	}
+
+	var errs []error
+	p.allow, errs = loadURLList(config.Allowlist)
+	deny, denyErrs := loadURLList(config.Denylist)
+	p.deny, errs = deny, append(errs, denyErrs...)
+	for _, rule := range config.Rules {
+		compiled := policyRule{PolicyRule: rule, action: strings.ToLower(rule.Action)}
+		if len(rule.URLs) > 0 {
+			var urlErrs []error
+			compiled.urls, urlErrs = loadURLList(URLListConfig{Patterns: rule.URLs})
+			errs = append(errs, urlErrs...)
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p, errs
+}
+
+// globPattern compiles a pattern where "*" matches any characters,
+// ignoring case
+func globPattern(pattern string) *regexp.Regexp {
+	quoted := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, `.*`)
+	return regexp.MustCompile(`(?i)^` + quoted + `$`)
+}
+
+// policyMessage is what rules match of a message
+type policyMessage struct {
+	icapMethod  IcapMethod
+	method      string
+	host        string
+	path        string
+	contentType string
+	size        int64
+}
+
+// newPolicyMessage describes httpData, sent with method, whose body is size
+// bytes long. requestURL is the URL of the HTTP transaction of responses.
+func newPolicyMessage(method IcapMethod, httpData interface{}, size int64, requestURL string) policyMessage {
+	message := policyMessage{icapMethod: method, size: size}
+	headers := httpHeaders(httpData)
+	target := requestURL
+	if request, ok := httpData.(*HttpRequest); ok {
+		message.method = request.Method
+		target = request.URI
+	}
+	if u, err := url.Parse(target); err == nil {
+		message.host, message.path = u.Hostname(), u.EscapedPath()
+		if message.host == "" {
+			if _, ok := httpData.(*HttpRequest); ok {
+				message.host = headerValue(headers, "Host")
+				if host, _, err := net.SplitHostPort(message.host); err == nil {
+					message.host = host
+				}
+			}
+		}
+	}
+	if message.path == "" {
+		message.path = "/"
+	}
+
+	message.contentType = httpMediaType(httpData)
+	return message
+}
+
+// decide returns the decision on message
+func (p *policy) decide(message policyMessage) PolicyDecision {
+	decision, _ := p.evaluate(message)
+	return decision
+}
+
+// evaluate returns the decision on message, bypassing messages to be
+// scanned that are left out of the sample, and its failure mode
+func (p *policy) evaluate(message policyMessage) (PolicyDecision, string) {
+	decision, rule := p.match(message)
+	if decision.Action == PolicyScan && p.sampler != nil && !p.sampler.sampled(message) {
+		return PolicyDecision{Action: PolicyBypass, Rule: policyRuleSampling}, ""
+	}
+	onFailure := p.onFailure
+	if rule != nil && rule.OnFailure != "" {
+		onFailure = strings.ToLower(rule.OnFailure)
+	}
+	return decision, onFailure
+}
+
+// match returns the decision of the lists, scan sizes and rules on message,
+// and the rule that chose it, nil for the others
+func (p *policy) match(message policyMessage) (PolicyDecision, *policyRule) {
+	if p.deny.matches(message.host, message.path) {
+		return PolicyDecision{Action: PolicyBlock, Rule: policyRuleDenylist}, nil
+	}
+	if p.allow.matches(message.host, message.path) {
+		return PolicyDecision{Action: PolicyBypass, Rule: policyRuleAllowlist}, nil
+	}
+	if p.minScanSize > 0 && message.size > 0 && message.size < p.minScanSize {
+		return PolicyDecision{Action: PolicyBypass, Rule: policyRuleMinScanSize}, nil
+	}
+	if p.maxScanSize > 0 && message.size > p.maxScanSize {
+		return PolicyDecision{Action: p.maxScanAction, Rule: policyRuleMaxScanSize}, nil
+	}
+	for i := range p.rules {
+		if rule := &p.rules[i]; rule.matches(message) {
+			return PolicyDecision{Action: rule.action, Rule: rule.Name}, rule
+		}
+	}
+	return PolicyDecision{Action: p.defaultAction}, nil
+}
+
+// matches reports whether message meets every condition of the rule
+func (r *policyRule) matches(message policyMessage) bool {
+	if len(r.ICAPMethods) > 0 && !containsFold(r.ICAPMethods, string(message.icapMethod)) {
+		return false
+	}
+	if len(r.Methods) > 0 && (message.method == "" || !containsFold(r.Methods, message.method)) {
+		return false
+	}
+	if r.urls != nil && !r.urls.matches(message.host, message.path) {
+		return false
+	}
+	if len(r.ContentTypes) > 0 && !matchesContentType(r.ContentTypes, message.contentType) {
+		return false
+	}
+	if r.MinSize > 0 && message.size < r.MinSize {
+		return false
+	}
+	if r.MaxSize > 0 && message.size > r.MaxSize {
+		return false
+	}
+	return true
+}
+
+// matchesContentType reports whether contentType matches one of patterns,
+// "type/*" matching any subtype and "*/*" any type
+func matchesContentType(patterns []string, contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mainType, _, _ := strings.Cut(contentType, "/")
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == contentType || pattern == "*/*" || pattern == mainType+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether values holds value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyResponse returns the response answering a message bypassed or
+// blocked by decision
+func policyResponse(decision PolicyDecision) *IcapResponse {
+	if decision.Action == PolicyBypass {
+		return &IcapResponse{
+			Version:    "ICAP/1.0",
+			StatusCode: int(NoContent),
+			Reason:     "No Content",
+			Headers:    map[string]string{},
+			Policy:     &decision,
+		}
+	}
+	return &IcapResponse{
+		Version:    "ICAP/1.0",
+		StatusCode: int(OK),
+		Reason:     "OK",
+		Headers:    map[string]string{},
+		HttpResponse: &HttpResponse{
+			Version:    "HTTP/1.1",
+			StatusCode: 403,
+			Reason:     "Forbidden",
+			Headers: map[string]string{
+				"Content-Type":   "text/plain; charset=utf-8",
+				"Content-Length": strconv.Itoa(len(policyBlockPage)),
+			},
+			Body: []byte(policyBlockPage),
+		},
+		Policy: &decision,
+	}
+}
+
+// failureDecision returns the decision on a message whose scan failed with
+// err under the failure mode onFailure, or false if the error is returned.
+// Bodies rejected as too large and requests canceled by the caller are not
+// server failures.
+func failureDecision(ctx context.Context, onFailure string, err error) (PolicyDecision, bool) {
+	if errors.Is(err, ErrEntityTooLarge) || errors.Is(ctx.Err(), context.Canceled) {
+		return PolicyDecision{}, false
+	}
+	switch onFailure {
+	case FailOpen:
+		return PolicyDecision{Action: PolicyBypass, Rule: policyRuleFailOpen}, true
+	case FailClosed:
+		return PolicyDecision{Action: PolicyBlock, Rule: policyRuleFailClosed}, true
+	}
+	return PolicyDecision{}, false
+}
+
+// policyWatcher reloads the URL lists of the policy when their files change
+type policyWatcher struct {
+	mu   sync.Mutex
+	stop func()
+}
+
+// close stops watching
+func (w *policyWatcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopLocked()
+}
+
+// stopLocked stops watching, guarded by mu
+func (w *policyWatcher) stopLocked() {
+	if w.stop != nil {
+		w.stop()
+		w.stop = nil
+	}
+}
+
+// loadPolicy compiles config into the policy of the client, logging the
+// files and patterns skipped, and watches the files of its URL lists
+func (c *IcapClient) loadPolicy(config PolicyConfig) {
+	c.storePolicy(config)
+
+	c.policyWatcher.mu.Lock()
+	defer c.policyWatcher.mu.Unlock()
+	c.policyWatcher.stopLocked()
+	files := append(slices.Clone(config.Allowlist.Files), config.Denylist.Files...)
+	if len(files) == 0 {
+		return
+	}
+	stop, err := c.watchPolicyFiles(files)
+	if err != nil {
+		c.logger.Warn("Policy URL list files not watched, changes apply on restart", "error", err)
+		return
+	}
+	c.policyWatcher.stop = stop
+}
+
+// storePolicy compiles config into the policy of the client
+func (c *IcapClient) storePolicy(config PolicyConfig) {
+	p, errs := newPolicy(config)
+	for _, err := range errs {
+		c.logger.Warn("Policy URL list entry skipped", "error", err)
+	}
+	c.policy.Store(p)
+}
+
+// watchPolicyFiles recompiles the policy whenever one of files changes,
+// until the returned function is called
+func (c *IcapClient) watchPolicyFiles(files []string) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// Watch the directories, as lists are usually replaced rather than
+	// written to
+	for _, file := range files {
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer watcher.Close()
+		var timer *time.Timer
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-done:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !slices.ContainsFunc(files, func(file string) bool { return isConfigEvent(event, file) }) {
+					continue
+				}
+				if timer == nil {
+					timer = time.NewTimer(configReloadDelay)
+				} else {
+					timer.Reset(configReloadDelay)
+				}
+				reload = timer.C
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				c.logger.Warn("Policy URL list watch error", "error", err)
+			case <-reload:
+				reload = nil
+				c.storePolicy(c.config.Load().Policy)
+				c.logger.Info("Policy URL lists reloaded", "files", files)
+			}
+		}
+	}()
+	return func() { close(done) }, nil
+}
@@ -0,0 +1,230 @@
+package icapclient
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestPolicy tests matching messages against policy rules in order
+func TestPolicy(t *testing.T) {
+	p, _ := newPolicy(PolicyConfig{Rules: []PolicyRule{
+		{Name: "trusted", Action: "bypass", URLs: []string{"*.internal.example.com", "example.com/static/*"}},
+		{Name: "exe", Action: "block", ICAPMethods: []string{"respmod"}, ContentTypes: []string{"application/x-msdownload"}},
+		{Name: "media", Action: "bypass", ContentTypes: []string{"image/*", "video/*"}},
+		{Name: "large", Action: "bypass", MinSize: 1000},
+		{Name: "reads", Action: "bypass", Methods: []string{"GET", "HEAD"}, MaxSize: 10},
+	}})
+
+	request := func(method, uri string, headers map[string]string, size int64) policyMessage {
+		return newPolicyMessage(REQMOD, &HttpRequest{Method: method, URI: uri, Headers: headers}, size, "")
+	}
+	response := func(contentType, url string) policyMessage {
+		return newPolicyMessage(RESPMOD, &HttpResponse{StatusCode: 200, Headers: map[string]string{"Content-Type": contentType}}, 100, url)
+	}
+	for _, tt := range []struct {
+		name     string
+		message  policyMessage
+		expected PolicyDecision
+	}{
+		{"host pattern", request("POST", "http://api.internal.example.com/upload", nil, 100), PolicyDecision{"bypass", "trusted"}},
+		{"host header of a relative URI", request("POST", "/upload", map[string]string{"Host": "db.internal.example.com:8080"}, 100), PolicyDecision{"bypass", "trusted"}},
+		{"path pattern", request("POST", "http://EXAMPLE.com/static/app.js", nil, 100), PolicyDecision{"bypass", "trusted"}},
+		{"path outside pattern", request("POST", "http://example.com/upload", nil, 100), PolicyDecision{"scan", ""}},
+		{"response URL", response("text/html", "https://wiki.internal.example.com/"), PolicyDecision{"bypass", "trusted"}},
+		{"content type with parameters", response("application/x-msdownload; name=a.exe", ""), PolicyDecision{"block", "exe"}},
+		{"rule limited to RESPMOD", request("POST", "/", map[string]string{"Content-Type": "application/x-msdownload"}, 100), PolicyDecision{"scan", ""}},
+		{"content type wildcard", response("image/png", ""), PolicyDecision{"bypass", "media"}},
+		{"min size", request("POST", "/", nil, 5000), PolicyDecision{"bypass", "large"}},
+		{"methods and max size", request("GET", "/", nil, 0), PolicyDecision{"bypass", "reads"}},
+		{"over max size", request("GET", "/", nil, 11), PolicyDecision{"scan", ""}},
+		{"methods on RESPMOD", response("text/plain", ""), PolicyDecision{"scan", ""}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if decision := p.decide(tt.message); decision != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, decision)
+			}
+		})
+	}
+
+	if p, _ := newPolicy(PolicyConfig{Default: "scan"}); p != nil {
+		t.Errorf("Expected no policy when everything is scanned")
+	}
+	p, _ = newPolicy(PolicyConfig{Default: "Block"})
+	if decision := p.decide(policyMessage{}); decision.Action != PolicyBlock {
+		t.Errorf("Expected the default action, got %+v", decision)
+	}
+}
+
+// TestPolicy_ScanSizes tests the min_scan_size and max_scan_size thresholds
+func TestPolicy_ScanSizes(t *testing.T) {
+	p, _ := newPolicy(PolicyConfig{MinScanSize: 10, MaxScanSize: 100})
+	for _, tt := range []struct {
+		size     int64
+		expected PolicyDecision
+	}{
+		{0, PolicyDecision{Action: PolicyScan}},
+		{9, PolicyDecision{Action: PolicyBypass, Rule: "min_scan_size"}},
+		{10, PolicyDecision{Action: PolicyScan}},
+		{100, PolicyDecision{Action: PolicyScan}},
+		{101, PolicyDecision{Action: PolicyBypass, Rule: "max_scan_size"}},
+	} {
+		if decision := p.decide(policyMessage{size: tt.size}); decision != tt.expected {
+			t.Errorf("Expected %+v for %d bytes, got %+v", tt.expected, tt.size, decision)
+		}
+	}
+
+	p, _ = newPolicy(PolicyConfig{MaxScanSize: 100, MaxScanSizeAction: "Preview"})
+	if decision := p.decide(policyMessage{size: 101}); decision.Action != PolicyPreview || p.previewSize != defaultPolicyPreviewSize {
+		t.Errorf("Expected a preview of %d bytes, got %+v of %d", defaultPolicyPreviewSize, decision, p.previewSize)
+	}
+}
+
+// TestIcapClient_PolicyPreview tests scanning the start of large bodies only
+// and counting the bytes left unscanned
+func TestIcapClient_PolicyPreview(t *testing.T) {
+	var received atomic.Value
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		received.Store(string(r.Body))
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host:               host,
+		Port:               port,
+		Timeout:            5 * time.Second,
+		ConnectionPoolSize: 2,
+		KeepAlive:          true,
+		LoggingLevel:       "ERROR",
+		MetricsEnabled:     true,
+		MetricsRegisterer:  prometheus.NewRegistry(),
+		Policy:             PolicyConfig{MinScanSize: 4, MaxScanSize: 16, MaxScanSizeAction: "preview", PreviewSize: 8},
+	})
+	defer client.Close()
+
+	response, err := client.Reqmod(context.Background(), &HttpRequest{
+		Method: "POST", URI: "/upload", Version: "HTTP/1.1", Body: []byte("0123456789abcdefghij"),
+	})
+	if err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+	if body, _ := received.Load().(string); body != "01234567" {
+		t.Errorf("Expected the server to receive the first 8 bytes, got %q", body)
+	}
+	if response.Policy == nil || response.Policy.Action != PolicyPreview {
+		t.Errorf("Expected a preview decision on the response, got %+v", response.Policy)
+	}
+
+	if _, err := client.Reqmod(context.Background(), &HttpRequest{
+		Method: "POST", URI: "/upload", Version: "HTTP/1.1", Body: []byte("abc"),
+	}); err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+	if v := testutil.ToFloat64(client.metrics.PolicyBypassedBytes.WithLabelValues(PolicyPreview)); v != 12 {
+		t.Errorf("Expected 12 bytes left unscanned by the preview, got %v", v)
+	}
+	if v := testutil.ToFloat64(client.metrics.PolicyBypassedBytes.WithLabelValues(PolicyBypass)); v != 3 {
+		t.Errorf("Expected 3 bytes bypassed, got %v", v)
+	}
+}
+
+// TestIcapClient_Policy tests bypassing and blocking messages without
+// contacting the server
+func TestIcapClient_Policy(t *testing.T) {
+	var requests atomic.Int32
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		requests.Add(1)
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	config := *client.config.Load()
+	config.Policy = PolicyConfig{Rules: []PolicyRule{
+		{Name: "images", Action: "bypass", ContentTypes: []string{"image/*"}},
+		{Name: "blocked-site", Action: "block", URLs: []string{"malware.example"}},
+	}}
+	client.Reload(&config)
+
+	verdict, response, err := client.ScanResponse(context.Background(), &HttpResponse{
+		Version: "HTTP/1.1", StatusCode: 200, Headers: map[string]string{"Content-Type": "image/jpeg"}, Body: []byte("jpeg"),
+	})
+	if err != nil || verdict != VerdictAllowed || response.StatusCode != 204 {
+		t.Fatalf("Expected a bypassed 204, got %v %+v %v", verdict, response, err)
+	}
+	if response.Policy == nil || response.Policy.Rule != "images" {
+		t.Errorf("Expected the images rule to decide, got %+v", response.Policy)
+	}
+
+	ctx := WithRequestOptions(context.Background(), RequestOptions{URL: "http://malware.example/payload"})
+	verdict, response, err = client.ScanResponse(ctx, &HttpResponse{
+		Version: "HTTP/1.1", StatusCode: 200, Headers: map[string]string{"Content-Type": "text/plain"}, Body: []byte("payload"),
+	})
+	if err != nil || verdict != VerdictBlocked {
+		t.Fatalf("Expected a blocked response, got %v %v", verdict, err)
+	}
+	if response.HttpResponse == nil || response.HttpResponse.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 block page, got %+v", response.HttpResponse)
+	}
+
+	if _, err := client.Reqmod(context.Background(), &HttpRequest{Method: "POST", URI: "http://example.com/", Version: "HTTP/1.1", Body: []byte("data")}); err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected only the scanned request to reach the server, got %d", n)
+	}
+}
+
+// TestIcapClient_PolicyOnFailure tests allowing or blocking messages when
+// the ICAP server is down, by policy and by rule
+func TestIcapClient_PolicyOnFailure(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(204, nil, false)
+	}))
+	host, port := server.HostPort()
+	server.Close()
+
+	client := NewIcapClient(&IcapConfig{
+		Host:              host,
+		Port:              port,
+		Timeout:           time.Second,
+		LoggingLevel:      "ERROR",
+		MetricsEnabled:    true,
+		MetricsRegisterer: prometheus.NewRegistry(),
+		Policy: PolicyConfig{OnFailure: "open", Rules: []PolicyRule{
+			{Name: "uploads", Action: "scan", Methods: []string{"POST"}, OnFailure: "closed"},
+			{Name: "strict", Action: "scan", Methods: []string{"PUT"}, OnFailure: "error"},
+		}},
+	})
+	defer client.Close()
+
+	verdict, response, err := client.ScanRequest(context.Background(), &HttpRequest{Method: "GET", URI: "http://example.com/", Version: "HTTP/1.1"})
+	if err != nil || verdict != VerdictAllowed || response.Policy == nil || response.Policy.Rule != "fail_open" {
+		t.Errorf("Expected the GET to fail open, got %v %+v %v", verdict, response, err)
+	}
+
+	verdict, response, err = client.ScanRequest(context.Background(), &HttpRequest{Method: "POST", URI: "http://example.com/", Version: "HTTP/1.1", Body: []byte("data")})
+	if err != nil || verdict != VerdictBlocked || response.Policy == nil || response.Policy.Rule != "fail_closed" {
+		t.Errorf("Expected the POST to fail closed, got %v %+v %v", verdict, response, err)
+	}
+
+	if _, err := client.Reqmod(context.Background(), &HttpRequest{Method: "PUT", URI: "http://example.com/", Version: "HTTP/1.1"}); err == nil {
+		t.Errorf("Expected the PUT to return the error")
+	}
+
+	if v := testutil.ToFloat64(client.metrics.FailOpen.WithLabelValues("REQMOD")); v != 1 {
+		t.Errorf("Expected 1 message failed open, got %v", v)
+	}
+	if v := testutil.ToFloat64(client.metrics.FailClosed.WithLabelValues("REQMOD")); v != 1 {
+		t.Errorf("Expected 1 message failed closed, got %v", v)
+	}
+}
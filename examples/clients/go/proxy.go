@@ -0,0 +1,175 @@
+package icapclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyConfig selects a proxy used to reach the ICAP server. At most one
+// proxy may be configured.
+type ProxyConfig struct {
+	SOCKS5      SOCKS5Config      `yaml:"socks5" json:"socks5"`
+	HTTPConnect HTTPConnectConfig `yaml:"http_connect" json:"http_connect"`
+}
+
+// SOCKS5Config is a SOCKS5 proxy, such as a bastion host in front of a
+// segmented network. The ICAP server host name is resolved by the proxy.
+type SOCKS5Config struct {
+	Address      string `yaml:"address" json:"address"`
+	Username     string `yaml:"username" json:"username"`
+	Password     string `yaml:"password" json:"password"`
+	PasswordFile string `yaml:"password_file" json:"password_file"`
+}
+
+// enabled reports whether a SOCKS5 proxy is configured
+func (c SOCKS5Config) enabled() bool {
+	return c.Address != ""
+}
+
+// HTTPConnectConfig is an HTTP proxy through which a CONNECT tunnel to the
+// ICAP server is established, optionally with Basic proxy authentication
+type HTTPConnectConfig struct {
+	Address      string `yaml:"address" json:"address"`
+	Username     string `yaml:"username" json:"username"`
+	Password     string `yaml:"password" json:"password"`
+	PasswordFile string `yaml:"password_file" json:"password_file"`
+}
+
+// enabled reports whether an HTTP CONNECT proxy is configured
+func (c HTTPConnectConfig) enabled() bool {
+	return c.Address != ""
+}
+
+// wrapDial returns dial routed through the configured proxy, or dial itself
+// when no proxy is configured
+func (c ProxyConfig) wrapDial(dial dialFunc) (dialFunc, error) {
+	switch {
+	case c.SOCKS5.enabled() && c.HTTPConnect.enabled():
+		return nil, errors.New("proxy.socks5 and proxy.http_connect are mutually exclusive")
+	case c.SOCKS5.enabled():
+		return newSOCKS5Dialer(c.SOCKS5, dial)
+	case c.HTTPConnect.enabled():
+		return newHTTPConnectDialer(c.HTTPConnect, dial), nil
+	default:
+		return dial, nil
+	}
+}
+
+// newSOCKS5Dialer returns a dial function connecting through the SOCKS5
+// proxy in config, reaching the proxy itself with forward
+func newSOCKS5Dialer(config SOCKS5Config, forward dialFunc) (dialFunc, error) {
+	var auth *proxy.Auth
+	if config.Username != "" {
+		auth = &proxy.Auth{User: config.Username, Password: config.Password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", config.Address, auth, forwardDialer(forward))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure SOCKS5 proxy %s: %w", config.Address, err)
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("SOCKS5 proxy %s: dialer does not support contexts", config.Address)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := contextDialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("SOCKS5 proxy %s: %w", config.Address, err)
+		}
+		return conn, nil
+	}, nil
+}
+
+// forwardDialer adapts a dialFunc to the dialer interfaces of the proxy package
+type forwardDialer dialFunc
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// newHTTPConnectDialer returns a dial function tunnelling through the HTTP
+// proxy in config with CONNECT, reaching the proxy itself with forward
+func newHTTPConnectDialer(config HTTPConnectConfig, forward dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, network, config.Address)
+		if err != nil {
+			return nil, fmt.Errorf("HTTP proxy %s: %w", config.Address, err)
+		}
+
+		tunnel, err := connectTunnel(ctx, conn, config, addr)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("HTTP proxy %s: %w", config.Address, err)
+		}
+		return tunnel, nil
+	}
+}
+
+// connectTunnel sends a CONNECT request for addr on conn and waits for the
+// proxy to accept it
+func connectTunnel(ctx context.Context, conn net.Conn, config HTTPConnectConfig, addr string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if config.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(config.Username + ":" + config.Password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	response, err := http.ReadResponse(br, request)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s rejected: %s", addr, response.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, br: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into br
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
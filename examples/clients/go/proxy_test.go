@@ -0,0 +1,339 @@
+package icapclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// socks5TestServer is a minimal SOCKS5 proxy that records the addresses
+// clients asked to connect to
+type socks5TestServer struct {
+	listener net.Listener
+	username string
+	password string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+// newSOCKS5TestServer starts a SOCKS5 proxy, requiring username/password
+// authentication when username is set
+func newSOCKS5TestServer(t *testing.T, username, password string) *socks5TestServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &socks5TestServer{listener: listener, username: username, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+// serve handles one SOCKS5 CONNECT
+func (s *socks5TestServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting: version, method count, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	if s.username == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		// Username/password subnegotiation (RFC 1929)
+		fields := make([]string, 2)
+		version := make([]byte, 1)
+		if _, err := io.ReadFull(conn, version); err != nil {
+			return
+		}
+		for i := range fields {
+			length := make([]byte, 1)
+			if _, err := io.ReadFull(conn, length); err != nil {
+				return
+			}
+			value := make([]byte, length[0])
+			if _, err := io.ReadFull(conn, value); err != nil {
+				return
+			}
+			fields[i] = string(value)
+		}
+		if fields[0] != s.username || fields[1] != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		addr := make([]byte, 4)
+		io.ReadFull(conn, addr)
+		host = net.IP(addr).String()
+	case 3:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+// TestIcapClient_SOCKS5Proxy tests reaching the ICAP server through a SOCKS5 proxy
+func TestIcapClient_SOCKS5Proxy(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+	host, port := server.HostPort()
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	tests := []struct {
+		name      string
+		username  string
+		password  string
+		clientPwd string
+		wantErr   bool
+	}{
+		{"No authentication", "", "", "", false},
+		{"Username and password", "icap", "secret", "secret", false},
+		{"Wrong password", "icap", "secret", "wrong", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newSOCKS5TestServer(t, tt.username, tt.password)
+
+			client := newTestServerClient(server, false)
+			client.config.Load().Proxy.SOCKS5 = SOCKS5Config{
+				Address:  proxy.listener.Addr().String(),
+				Username: tt.username,
+				Password: tt.clientPwd,
+			}
+			client.transport = newIcapTransport(client.config.Load(), nil, nil, nil)
+			defer client.Close()
+
+			response, err := client.Options(context.Background())
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "SOCKS5 proxy") {
+					t.Errorf("Expected SOCKS5 proxy error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OPTIONS through proxy failed: %v", err)
+			}
+			if response.StatusCode != 200 {
+				t.Errorf("Expected 200, got %d", response.StatusCode)
+			}
+
+			proxy.mu.Lock()
+			defer proxy.mu.Unlock()
+			if len(proxy.targets) != 1 || proxy.targets[0] != target {
+				t.Errorf("Expected proxy to connect to %s, got %v", target, proxy.targets)
+			}
+		})
+	}
+}
+
+// newConnectTestProxy starts an HTTP proxy accepting CONNECT, requiring
+// Basic credentials when auth is set, and reports tunnelled addresses on
+// targets
+func newConnectTestProxy(t *testing.T, auth string, targets chan<- string) *httptest.Server {
+	t.Helper()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if auth != "" && r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		targets <- r.Host
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			defer upstream.Close()
+			io.Copy(upstream, rw)
+		}()
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, upstream)
+		}()
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// TestIcapClient_HTTPConnectProxy tests ICAP and ICAPS through a CONNECT tunnel
+func TestIcapClient_HTTPConnectProxy(t *testing.T) {
+	plain := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer plain.Close()
+	secure := icaptest.NewTLSServer(icaptest.HandlerFunc(testServerHandler))
+	defer secure.Close()
+	digest := sha256.Sum256(secure.Certificate().Raw)
+
+	tests := []struct {
+		name     string
+		server   *icaptest.Server
+		tls      bool
+		auth     string
+		username string
+		password string
+		wantErr  string
+	}{
+		{"ICAP", plain, false, "", "", "", ""},
+		{"ICAPS", secure, true, "", "", "", ""},
+		{"Proxy authentication", plain, false, "icap:secret", "icap", "secret", ""},
+		{"Rejected credentials", plain, false, "icap:secret", "icap", "wrong", "407"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := make(chan string, 4)
+			proxy := newConnectTestProxy(t, tt.auth, targets)
+			host, port := tt.server.HostPort()
+
+			client := NewIcapClient(&IcapConfig{
+				Host:         host,
+				Port:         port,
+				Timeout:      5 * time.Second,
+				LoggingLevel: "ERROR",
+				TLS:          TLSConfig{Enabled: tt.tls, PinnedSHA256: []string{hex.EncodeToString(digest[:])}},
+				Proxy: ProxyConfig{HTTPConnect: HTTPConnectConfig{
+					Address:  strings.TrimPrefix(proxy.URL, "http://"),
+					Username: tt.username,
+					Password: tt.password,
+				}},
+			})
+			defer client.Close()
+
+			response, err := client.Options(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OPTIONS through tunnel failed: %v", err)
+			}
+			if response.StatusCode != 200 {
+				t.Errorf("Expected 200, got %d", response.StatusCode)
+			}
+			if target := <-targets; target != net.JoinHostPort(host, strconv.Itoa(port)) {
+				t.Errorf("Expected tunnel to %s:%d, got %s", host, port, target)
+			}
+		})
+	}
+
+	if _, err := (ProxyConfig{
+		SOCKS5:      SOCKS5Config{Address: "127.0.0.1:1080"},
+		HTTPConnect: HTTPConnectConfig{Address: "127.0.0.1:3128"},
+	}).wrapDial(nil); err == nil {
+		t.Error("Expected an error when both proxies are configured")
+	}
+}
+
+// TestIcapClient_HTTPConnectTimeout tests that a proxy that never answers
+// CONNECT is bounded by the client timeout
+func TestIcapClient_HTTPConnectTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := NewIcapClient(&IcapConfig{
+		Host:         "icap.example.com",
+		Port:         1344,
+		Timeout:      200 * time.Millisecond,
+		LoggingLevel: "ERROR",
+		Proxy:        ProxyConfig{HTTPConnect: HTTPConnectConfig{Address: listener.Addr().String()}},
+	})
+	defer client.Close()
+
+	start := time.Now()
+	if _, err := client.Options(context.Background()); err == nil {
+		t.Fatal("Expected silent proxy to fail the request")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the CONNECT to time out after 200ms, took %v", elapsed)
+	}
+}
@@ -0,0 +1,183 @@
+package icapclient
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadableFields are the configuration fields, by YAML name, that Reload
+// applies to a running client. Changes to other fields take effect on
+// restart.
+var reloadableFields = map[string]bool{
+	"timeout":                 true,
+	"attempt_timeout":         true,
+	"pool_wait_timeout":       true,
+	"backend_down_ttl":        true,
+	"max_concurrent_requests": true,
+	"retries":                 true,
+	"retry_delay":             true,
+	"max_retry_delay":         true,
+	"backoff_factor":          true,
+	"logging_level":           true,
+	"max_body_size":           true,
+	"body_limit_action":       true,
+	"response_profile":        true,
+	"services":                true,
+	"decode_content_encoding": true,
+	"compression":             true,
+	"host_header":             true,
+	"identity":                true,
+	"allow":                   true,
+	"transfer_rules":          true,
+	"transfer_types":          true,
+	"clock_skew_threshold":    true,
+	"retry_on":                true,
+	"retry_budget":            true,
+	"throttle":                true,
+	"content_hash":            true,
+	"policy":                  true,
+	"service_id":              true,
+	"tenant_id":               true,
+	"tenant_header":           true,
+}
+
+// configReloadDelay lets editors and secret mounts finish writing the
+// configuration file before it is read
+const configReloadDelay = 250 * time.Millisecond
+
+// Reload applies the changes of config that are safe while requests are in
+// flight: timeouts, retries, the log level of the default logger, body
+// limits, bandwidth throttling, the client policy, the response profile,
+// service paths and identity headers. It returns the YAML names of the
+// changed fields it applied, and of those that require a restart. Requests
+// already sent keep the settings they started with.
+func (c *IcapClient) Reload(config *IcapConfig) (reloaded, restartRequired []string) {
+	current := c.config.Load()
+	next := *current
+
+	currentValue := reflect.ValueOf(current).Elem()
+	newValue := reflect.ValueOf(config).Elem()
+	nextValue := reflect.ValueOf(&next).Elem()
+	for i := 0; i < currentValue.NumField(); i++ {
+		name, _, _ := strings.Cut(currentValue.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if reflect.DeepEqual(currentValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		if !reloadableFields[name] || (name == "logging_level" && c.logLevel == nil) {
+			restartRequired = append(restartRequired, name)
+			continue
+		}
+		nextValue.Field(i).Set(newValue.Field(i))
+		reloaded = append(reloaded, name)
+	}
+	if len(reloaded) == 0 {
+		return nil, restartRequired
+	}
+
+	c.config.Store(&next)
+	c.transport.setTimeouts(&next)
+	c.transport.setThrottle(&next)
+	c.requests.setLimit(max(next.MaxConcurrentRequests, 0))
+	if !reflect.DeepEqual(current.Identity, next.Identity) {
+		identity := c.identityHeaders(&next)
+		c.identity.Store(&identity)
+	}
+	if !reflect.DeepEqual(current.Policy, next.Policy) {
+		c.loadPolicy(next.Policy)
+	}
+	if c.logLevel != nil {
+		c.logLevel.Set(getLogLevel(next.LoggingLevel))
+	}
+	return reloaded, restartRequired
+}
+
+// WatchConfig reloads the client whenever the configuration file at path
+// changes, until ctx is done. load reads the new configuration, usually
+// with LoadConfig and any command-line overrides. Each reload is logged
+// with the fields applied and those requiring a restart; configurations
+// that fail to load are logged and ignored.
+func (c *IcapClient) WatchConfig(ctx context.Context, path string, load func() (*IcapConfig, error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch config: %w", err)
+	}
+	// Watch the directory, as editors and Kubernetes replace the file
+	// rather than write to it
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch config: %w", err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		var timer *time.Timer
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isConfigEvent(event, path) {
+					continue
+				}
+				if timer == nil {
+					timer = time.NewTimer(configReloadDelay)
+				} else {
+					timer.Reset(configReloadDelay)
+				}
+				reload = timer.C
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				c.logger.Warn("Config watch error", "path", path, "error", err)
+			case <-reload:
+				reload = nil
+				c.reloadFrom(path, load)
+			}
+		}
+	}()
+	return nil
+}
+
+// isConfigEvent reports whether event may have changed the file at path,
+// including the "..data" symlink swap of Kubernetes volumes
+func isConfigEvent(event fsnotify.Event, path string) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	return name == filepath.Clean(path) || filepath.Base(name) == "..data"
+}
+
+// reloadFrom loads the configuration and applies it, logging the outcome
+func (c *IcapClient) reloadFrom(path string, load func() (*IcapConfig, error)) {
+	config, err := load()
+	if err != nil {
+		c.logger.Error("Config reload failed, keeping current config", "path", path, "error", err)
+		return
+	}
+
+	reloaded, restartRequired := c.Reload(config)
+	if len(reloaded) > 0 {
+		c.logger.Info("Config reloaded", "path", path, "fields", reloaded)
+	}
+	if len(restartRequired) > 0 {
+		c.logger.Warn("Config changes require a restart", "path", path, "fields", restartRequired)
+	}
+	if len(reloaded) == 0 && len(restartRequired) == 0 {
+		c.logger.Debug("Config unchanged", "path", path)
+	}
+}
@@ -0,0 +1,153 @@
+package icapclient
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestIcapClient_Reload tests that safe fields are applied and others are
+// reported as requiring a restart
+func TestIcapClient_Reload(t *testing.T) {
+	config := &IcapConfig{Host: "127.0.0.1", Port: 1344, Timeout: time.Second, Retries: 1, LoggingLevel: "INFO"}
+	client := NewIcapClient(config)
+	defer client.Close()
+
+	changed := *config
+	changed.Host = "10.0.0.1"
+	changed.Timeout = 5 * time.Second
+	changed.AttemptTimeout = 2 * time.Second
+	changed.Retries = 4
+	changed.LoggingLevel = "DEBUG"
+	changed.Services = ServicesConfig{Respmod: "/avscan"}
+
+	reloaded, restartRequired := client.Reload(&changed)
+	if want := []string{"timeout", "attempt_timeout", "retries", "logging_level", "services"}; !reflect.DeepEqual(reloaded, want) {
+		t.Errorf("Expected reloaded %v, got %v", want, reloaded)
+	}
+	if want := []string{"host"}; !reflect.DeepEqual(restartRequired, want) {
+		t.Errorf("Expected restart required %v, got %v", want, restartRequired)
+	}
+
+	current := client.config.Load()
+	if current.Host != "127.0.0.1" || current.Retries != 4 || current.Timeout != 5*time.Second {
+		t.Errorf("Unexpected config after reload: host %s, retries %d, timeout %v", current.Host, current.Retries, current.Timeout)
+	}
+	if client.transport.getTimeout() != 5*time.Second {
+		t.Errorf("Expected transport timeout 5s, got %v", client.transport.getTimeout())
+	}
+	if client.transport.getAttemptTimeout() != 2*time.Second {
+		t.Errorf("Expected transport attempt timeout 2s, got %v", client.transport.getAttemptTimeout())
+	}
+	if client.logLevel.Level() != slog.LevelDebug {
+		t.Errorf("Expected debug log level, got %v", client.logLevel.Level())
+	}
+	if got := client.buildICAPURL(client.config.Load(), RESPMOD); got != "icap://127.0.0.1:1344/avscan" {
+		t.Errorf("Expected reloaded service path, got %s", got)
+	}
+	if config.Retries != 1 {
+		t.Errorf("Expected the original config to be unchanged, got retries %d", config.Retries)
+	}
+
+	if reloaded, restartRequired := client.Reload(&changed); reloaded != nil || len(restartRequired) != 1 {
+		t.Errorf("Expected only the host to differ on a second reload, got %v and %v", reloaded, restartRequired)
+	}
+}
+
+// TestIcapClient_ReloadDuringRequest tests that a request in flight keeps
+// the retries it started with
+func TestIcapClient_ReloadDuringRequest(t *testing.T) {
+	var requests atomic.Int32
+	started, reloaded := make(chan struct{}), make(chan struct{})
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if requests.Add(1) == 1 {
+			close(started)
+			<-reloaded
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(503, nil, false)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	config := &IcapConfig{Host: host, Port: port, Timeout: 5 * time.Second, Retries: 1, KeepAlive: true, LoggingLevel: "ERROR"}
+	client := NewIcapClient(config)
+	defer client.Close()
+
+	go func() {
+		<-started
+		changed := *config
+		changed.Retries = 0
+		client.Reload(&changed)
+		close(reloaded)
+	}()
+	response, err := client.Respmod(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte("test")})
+	if err != nil || response.StatusCode != 204 {
+		t.Fatalf("Expected the request to be retried under its original settings, got %+v (%v)", response, err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected 2 requests, got %d", n)
+	}
+}
+
+// TestIcapClient_ReloadCustomLogger tests that the log level of a custom
+// logger requires a restart
+func TestIcapClient_ReloadCustomLogger(t *testing.T) {
+	config := &IcapConfig{LoggingLevel: "INFO", Logger: NewDefaultLogger("ERROR")}
+	client := NewIcapClient(config)
+	defer client.Close()
+
+	changed := *config
+	changed.LoggingLevel = "DEBUG"
+	reloaded, restartRequired := client.Reload(&changed)
+	if reloaded != nil || !reflect.DeepEqual(restartRequired, []string{"logging_level"}) {
+		t.Errorf("Expected logging_level to require a restart, got %v and %v", reloaded, restartRequired)
+	}
+}
+
+// TestIcapClient_WatchConfig tests reloading when the file is replaced
+func TestIcapClient_WatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("host: 127.0.0.1\nretries: 1\nlogging_level: ERROR\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	load := func() (*IcapConfig, error) { return LoadConfig(path) }
+	config, err := load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	client := NewIcapClient(config)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := client.WatchConfig(ctx, path, load); err != nil {
+		t.Fatalf("WatchConfig failed: %v", err)
+	}
+
+	// Replace the file as editors do
+	next := path + ".tmp"
+	if err := os.WriteFile(next, []byte("host: 127.0.0.1\nretries: 6\nlogging_level: ERROR\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if err := os.Rename(next, path); err != nil {
+		t.Fatalf("Failed to replace config: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.config.Load().Retries != 6 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected retries 6 after reload, got %d", client.config.Load().Retries)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
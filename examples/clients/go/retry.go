@@ -0,0 +1,182 @@
+package icapclient
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error classes of failed attempts, by how much of the request reached the
+// server, for retry_on
+const (
+	// ErrorClassConnect is a failure to connect, nothing was sent
+	ErrorClassConnect = "connect"
+	// ErrorClassSend is a failure while sending, part of the request and
+	// its body may have reached the server
+	ErrorClassSend = "send"
+	// ErrorClassResponse is a failure reading the response, the whole
+	// request was sent
+	ErrorClassResponse = "response"
+	// ErrorClassUnavailable is a 503 response with Retry-After
+	ErrorClassUnavailable = "unavailable"
+)
+
+// validErrorClass reports whether class is one of the error classes
+func validErrorClass(class string) bool {
+	switch class {
+	case ErrorClassConnect, ErrorClassSend, ErrorClassResponse, ErrorClassUnavailable:
+		return true
+	}
+	return false
+}
+
+// retryEligible reports whether a failure of class is retried for method
+// under retry_on. Methods that are not listed retry every class.
+func retryEligible(config *IcapConfig, method IcapMethod, class string) bool {
+	for name, classes := range config.RetryOn {
+		if strings.EqualFold(name, string(method)) {
+			return slices.Contains(classes, class)
+		}
+	}
+	return true
+}
+
+// defaultRetryBudget is the ratio of retries to requests when retry_budget
+// is zero
+const defaultRetryBudget = 0.2
+
+// retryBudgetReserve is the number of retries allowed beyond the ratio, so
+// that isolated failures are retried however few requests were sent
+const retryBudgetReserve = 10
+
+// Reasons for skipping a retry
+const (
+	retrySkippedDeadline = "deadline"
+	retrySkippedBudget   = "budget"
+)
+
+// retryBudget bounds the retries of a client to a ratio of its requests, so
+// that a failing server is not hit by a retry storm. Each retry spends one
+// token and each request earns back ratio tokens, and retries are refused
+// once retryBudgetReserve tokens are spent. Tokens are counted in
+// thousandths to keep the ratio exact.
+type retryBudget struct {
+	mu    sync.Mutex
+	spent int64
+}
+
+// request earns back ratio tokens for a request
+func (b *retryBudget) request(ratio float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spent = max(b.spent-int64(math.Round(ratio*1000)), 0)
+}
+
+// retry spends a token for a retry, reporting false if none is left
+func (b *retryBudget) retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.spent+1000 > retryBudgetReserve*1000 {
+		return false
+	}
+	b.spent += 1000
+	return true
+}
+
+// retryBudgetRatio returns the retry_budget of config, zero if unbounded
+func retryBudgetRatio(config *IcapConfig) float64 {
+	switch {
+	case config.RetryBudget == 0:
+		return defaultRetryBudget
+	case config.RetryBudget < 0:
+		return 0
+	}
+	return config.RetryBudget
+}
+
+// skipRetry returns why a retry after delay should not be made, or "" to
+// make it: when ctx would be done before an attempt as long as the last one
+// could finish, or when the retry budget of the client is spent
+func (c *IcapClient) skipRetry(ctx context.Context, config *IcapConfig, delay, lastAttempt time.Duration) string {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay+lastAttempt {
+		return retrySkippedDeadline
+	}
+	if retryBudgetRatio(config) > 0 && !c.retryBudget.retry() {
+		return retrySkippedBudget
+	}
+	return ""
+}
+
+// attemptTimeout returns the attempt_timeout of config, or its timeout
+func attemptTimeout(config *IcapConfig) time.Duration {
+	if config.AttemptTimeout > 0 {
+		return config.AttemptTimeout
+	}
+	return config.Timeout
+}
+
+// backoffDelay returns the delay before the nth retry: retry_delay grown by
+// backoff_factor for each retry after the first, capped at max_retry_delay
+func backoffDelay(config *IcapConfig, n int) time.Duration {
+	factor := config.BackoffFactor
+	if factor < 1 {
+		factor = 1
+	}
+	delay := float64(config.RetryDelay) * math.Pow(factor, float64(n-1))
+	if config.MaxRetryDelay > 0 && delay > float64(config.MaxRetryDelay) {
+		return config.MaxRetryDelay
+	}
+	return time.Duration(delay)
+}
+
+// retryAfter returns the delay asked for by the Retry-After header of a 503
+// response, in seconds or as an HTTP date, reporting false for other
+// responses and for missing or malformed headers
+func retryAfter(response *IcapResponse, now time.Time) (time.Duration, bool) {
+	if response.StatusCode != int(ServiceUnavailable) {
+		return 0, false
+	}
+	value := strings.TrimSpace(headerValue(response.Headers, "Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(min(seconds, int64(math.MaxInt64/time.Second))) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// capRetryDelay bounds a delay asked for by the server by max_retry_delay
+func capRetryDelay(config *IcapConfig, delay time.Duration) time.Duration {
+	if config.MaxRetryDelay > 0 && delay > config.MaxRetryDelay {
+		return config.MaxRetryDelay
+	}
+	return delay
+}
+
+// sleepContext waits for d, returning early with the error of ctx when it
+// is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,323 @@
+package icapclient
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestBackoffDelay tests growing the retry delay by the backoff factor
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   IcapConfig
+		retry    int
+		expected time.Duration
+	}{
+		{"first retry", IcapConfig{RetryDelay: time.Second, BackoffFactor: 2, MaxRetryDelay: time.Minute}, 1, time.Second},
+		{"third retry", IcapConfig{RetryDelay: time.Second, BackoffFactor: 2, MaxRetryDelay: time.Minute}, 3, 4 * time.Second},
+		{"capped", IcapConfig{RetryDelay: time.Second, BackoffFactor: 2, MaxRetryDelay: 5 * time.Second}, 10, 5 * time.Second},
+		{"uncapped", IcapConfig{RetryDelay: time.Second, BackoffFactor: 2}, 5, 16 * time.Second},
+		{"no factor", IcapConfig{RetryDelay: time.Second}, 4, time.Second},
+		{"no delay", IcapConfig{BackoffFactor: 2}, 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if delay := backoffDelay(&tt.config, tt.retry); delay != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, delay)
+			}
+		})
+	}
+}
+
+// TestRetryAfter tests parsing the Retry-After header of 503 responses
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		status   int
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"seconds", 503, "120", 2 * time.Minute, true},
+		{"date", 503, "Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second, true},
+		{"past date", 503, "Wed, 01 May 2024 11:00:00 GMT", 0, true},
+		{"missing", 503, "", 0, false},
+		{"negative", 503, "-5", 0, false},
+		{"malformed", 503, "soon", 0, false},
+		{"not unavailable", 500, "120", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &IcapResponse{StatusCode: tt.status, Headers: map[string]string{"retry-after": tt.value}}
+			delay, ok := retryAfter(response, now)
+			if delay != tt.expected || ok != tt.ok {
+				t.Errorf("Expected %v %v, got %v %v", tt.expected, tt.ok, delay, ok)
+			}
+		})
+	}
+}
+
+// TestIcapClient_RetryAfter tests waiting for the Retry-After of a 503
+// response, bounded by max_retry_delay, before retrying
+func TestIcapClient_RetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	var unavailable atomic.Int32
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if requests.Add(1) <= unavailable.Load() {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(503, nil, false)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	client.config.Load().Retries = 2
+	client.config.Load().RetryDelay = time.Hour
+	client.config.Load().MaxRetryDelay = 50 * time.Millisecond
+
+	t.Run("recovers", func(t *testing.T) {
+		requests.Store(0)
+		unavailable.Store(1)
+		start := time.Now()
+		response, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		defer response.Close()
+		if response.StatusCode != 204 {
+			t.Errorf("Expected 204, got %d", response.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Expected a delay before retrying, got %v", elapsed)
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		requests.Store(0)
+		unavailable.Store(10)
+		_, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+		var icapErr *IcapError
+		if !errors.As(err, &icapErr) {
+			t.Fatalf("Expected IcapError, got %v", err)
+		}
+		if icapErr.Code != 503 || icapErr.RetryAfter != time.Hour {
+			t.Errorf("Expected 503 with Retry-After 1h, got %d %v", icapErr.Code, icapErr.RetryAfter)
+		}
+		if n := requests.Load(); n != 3 {
+			t.Errorf("Expected 3 requests, got %d", n)
+		}
+	})
+
+	t.Run("past deadline", func(t *testing.T) {
+		requests.Store(0)
+		unavailable.Store(10)
+		client.config.Load().MaxRetryDelay = time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_, err := client.Reqmod(ctx, &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+		var icapErr *IcapError
+		if !errors.As(err, &icapErr) || icapErr.Code != 503 {
+			t.Errorf("Expected the 503 error, got %v", err)
+		}
+		if n := requests.Load(); n != 1 {
+			t.Errorf("Expected the retry skipped, got %d requests", n)
+		}
+	})
+}
+
+// TestRetryBudget tests refusing retries once the reserve is spent, until
+// requests earn tokens back
+func TestRetryBudget(t *testing.T) {
+	var budget retryBudget
+	for i := 0; i < retryBudgetReserve; i++ {
+		if !budget.retry() {
+			t.Fatalf("Expected retry %d within the reserve", i+1)
+		}
+	}
+	if budget.retry() {
+		t.Errorf("Expected retry refused once the reserve is spent")
+	}
+	for i := 0; i < 4; i++ {
+		budget.request(0.2)
+		if budget.retry() {
+			t.Errorf("Expected retry refused after %d requests", i+1)
+		}
+	}
+	budget.request(0.2)
+	if !budget.retry() {
+		t.Errorf("Expected retry allowed after 5 requests at ratio 0.2")
+	}
+}
+
+// TestIcapClient_skipRetry tests skipping retries that cannot finish before
+// the deadline or that exceed the budget
+func TestIcapClient_skipRetry(t *testing.T) {
+	client := NewIcapClient(&IcapConfig{Host: "127.0.0.1", Port: 1344})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if reason := client.skipRetry(ctx, client.config.Load(), 500*time.Millisecond, time.Second); reason != retrySkippedDeadline {
+		t.Errorf("Expected %q, got %q", retrySkippedDeadline, reason)
+	}
+	if reason := client.skipRetry(ctx, client.config.Load(), 0, 10*time.Millisecond); reason != "" {
+		t.Errorf("Expected retry allowed, got %q", reason)
+	}
+
+	client.config.Load().RetryBudget = -1
+	for i := 0; i < 2*retryBudgetReserve; i++ {
+		if reason := client.skipRetry(context.Background(), client.config.Load(), 0, 0); reason != "" {
+			t.Fatalf("Expected unbounded retries, got %q", reason)
+		}
+	}
+	client.config.Load().RetryBudget = 0
+	for i := 1; i < retryBudgetReserve; i++ {
+		client.skipRetry(context.Background(), client.config.Load(), 0, 0)
+	}
+	if reason := client.skipRetry(context.Background(), client.config.Load(), 0, 0); reason != retrySkippedBudget {
+		t.Errorf("Expected %q, got %q", retrySkippedBudget, reason)
+	}
+}
+
+// TestIcapClient_AttemptTimeout tests abandoning a slow attempt after
+// attempt_timeout and retrying within the overall timeout
+func TestIcapClient_AttemptTimeout(t *testing.T) {
+	var requests atomic.Int32
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if requests.Add(1) == 1 {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	client.config.Load().Retries = 1
+	client.config.Load().RetryBudget = -1
+	client.transport.setTimeouts(&IcapConfig{Timeout: 5 * time.Second, AttemptTimeout: 100 * time.Millisecond})
+
+	start := time.Now()
+	response, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	defer response.Close()
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected 2 requests, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("Expected the slow attempt abandoned, took %v", elapsed)
+	}
+}
+
+// TestIcapClient_OverallTimeout tests bounding a request and its retries by
+// the timeout
+func TestIcapClient_OverallTimeout(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(503, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	client.config.Load().Retries = 5
+	client.config.Load().Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	if _, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected the retries bounded by the timeout, took %v", elapsed)
+	}
+}
+
+// TestRetryEligible tests retrying only the error classes listed for a
+// method in retry_on
+func TestRetryEligible(t *testing.T) {
+	config := &IcapConfig{RetryOn: map[string][]string{
+		"OPTIONS": {ErrorClassConnect, ErrorClassResponse},
+		"respmod": {ErrorClassConnect},
+		"REQMOD":  {},
+	}}
+	tests := []struct {
+		method   IcapMethod
+		class    string
+		expected bool
+	}{
+		{OPTIONS, ErrorClassConnect, true},
+		{OPTIONS, ErrorClassResponse, true},
+		{OPTIONS, ErrorClassSend, false},
+		{RESPMOD, ErrorClassConnect, true},
+		{RESPMOD, ErrorClassResponse, false},
+		{RESPMOD, ErrorClassUnavailable, false},
+		{REQMOD, ErrorClassConnect, false},
+		{"SCAN", ErrorClassSend, true},
+	}
+
+	for _, tt := range tests {
+		if eligible := retryEligible(config, tt.method, tt.class); eligible != tt.expected {
+			t.Errorf("Expected %s on %s eligible %v, got %v", tt.method, tt.class, tt.expected, eligible)
+		}
+	}
+}
+
+// TestIcapClient_RetryOn tests that a RESPMOD limited to connect errors is
+// not resent once the server received it, while REQMOD still is
+func TestIcapClient_RetryOn(t *testing.T) {
+	var requests atomic.Int32
+	var server *icaptest.Server
+	server = icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		requests.Add(1)
+		server.CloseClientConnections()
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	client.config.Load().Retries = 2
+	client.config.Load().RetryOn = map[string][]string{"RESPMOD": {ErrorClassConnect}}
+
+	_, err := client.Respmod(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte("body")})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if errorClass(err) != ErrorClassResponse {
+		t.Errorf("Expected class %q, got %q", ErrorClassResponse, errorClass(err))
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected RESPMOD sent once, got %d", n)
+	}
+
+	requests.Store(0)
+	if _, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("Expected REQMOD sent 3 times, got %d", n)
+	}
+}
+
+// TestErrorClass tests classifying a failure to connect
+func TestErrorClass(t *testing.T) {
+	client := NewIcapClient(&IcapConfig{Host: "127.0.0.1", Port: 1, Timeout: time.Second, LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	_, err := client.Options(context.Background())
+	if class := errorClass(err); class != ErrorClassConnect {
+		t.Errorf("Expected class %q, got %q", ErrorClassConnect, class)
+	}
+}
@@ -0,0 +1,99 @@
+package icapclient
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sampling modes
+const (
+	// SamplingHash samples by a hash of the URL of the transaction, so that
+	// its REQMOD and RESPMOD, and its repetitions, are sampled the same way
+	SamplingHash = "hash"
+	// SamplingRandom samples transactions at random
+	SamplingRandom = "random"
+)
+
+// policyRuleSampling is the rule name of messages left out of the sample
+const policyRuleSampling = "sampling"
+
+// SamplingConfig scans a share of the messages the policy would otherwise
+// scan, bypassing the rest, for statistical visibility without the cost of
+// scanning everything inline
+type SamplingConfig struct {
+	// Rate is the share of messages scanned, from 0 to 1, e.g. 0.05 to scan
+	// 5%. Sampling is disabled when zero.
+	Rate float64 `yaml:"rate" json:"rate"`
+	// Mode is SamplingHash (default) or SamplingRandom
+	Mode string `yaml:"mode" json:"mode"`
+	// Seed makes random sampling reproducible; zero seeds from the clock
+	Seed int64 `yaml:"seed" json:"seed"`
+}
+
+// enabled reports whether only part of the messages is scanned
+func (c SamplingConfig) enabled() bool {
+	return c.Rate > 0 && c.Rate < 1
+}
+
+// validSamplingMode reports whether mode is a sampling mode
+func validSamplingMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "", SamplingHash, SamplingRandom:
+		return true
+	}
+	return false
+}
+
+// sampler decides which messages are in the sample
+type sampler struct {
+	rate   float64
+	random bool
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// newSampler creates a sampler, or returns nil if sampling is disabled
+func newSampler(config SamplingConfig) *sampler {
+	if !config.enabled() {
+		return nil
+	}
+
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &sampler{
+		rate:   config.Rate,
+		random: strings.EqualFold(config.Mode, SamplingRandom),
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// sampled reports whether message is in the sample. In hash mode only the
+// URL identifies the transaction, the ICAP and HTTP methods differing
+// between its REQMOD and RESPMOD. Messages without a host, e.g. RESPMOD
+// without RequestOptions.URL, are told apart by their body size instead.
+func (s *sampler) sampled(message policyMessage) bool {
+	if s.random {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.rand.Float64() < s.rate
+	}
+
+	parts := []string{message.host, message.path}
+	if message.host == "" {
+		parts = append(parts, strconv.FormatInt(message.size, 10))
+	}
+	h := fnv.New64a()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return float64(h.Sum64()) < s.rate*math.MaxUint64
+}
@@ -0,0 +1,64 @@
+package icapclient
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestSampler tests scanning a share of the messages by hash and at random
+func TestSampler(t *testing.T) {
+	for _, mode := range []string{SamplingHash, SamplingRandom} {
+		t.Run(mode, func(t *testing.T) {
+			s := newSampler(SamplingConfig{Rate: 0.2, Mode: mode, Seed: 1})
+			sampled := 0
+			for i := 0; i < 10000; i++ {
+				if s.sampled(policyMessage{icapMethod: REQMOD, method: "GET", host: "example.com", path: fmt.Sprintf("/%d", i)}) {
+					sampled++
+				}
+			}
+			if sampled < 1800 || sampled > 2200 {
+				t.Errorf("Expected about 2000 of 10000 messages sampled, got %d", sampled)
+			}
+		})
+	}
+
+	s := newSampler(SamplingConfig{Rate: 0.5})
+	message := policyMessage{icapMethod: RESPMOD, host: "example.com", path: "/file", size: 42}
+	first := s.sampled(message)
+	for i := 0; i < 10; i++ {
+		if s.sampled(message) != first {
+			t.Fatalf("Expected hash sampling to be deterministic")
+		}
+	}
+
+	// The REQMOD and RESPMOD of a transaction are sampled together
+	for i := 0; i < 100; i++ {
+		path := fmt.Sprintf("/%d", i)
+		request := policyMessage{icapMethod: REQMOD, method: "POST", host: "example.com", path: path, size: 10}
+		response := policyMessage{icapMethod: RESPMOD, host: "example.com", path: path, size: 5000}
+		if s.sampled(request) != s.sampled(response) {
+			t.Fatalf("Expected the REQMOD and RESPMOD of %s to be sampled the same way", path)
+		}
+	}
+
+	if newSampler(SamplingConfig{Rate: 1}) != nil || newSampler(SamplingConfig{}) != nil {
+		t.Errorf("Expected no sampler when everything is scanned")
+	}
+}
+
+// TestPolicy_Sampling tests sampling only the messages to be scanned
+func TestPolicy_Sampling(t *testing.T) {
+	p, _ := newPolicy(PolicyConfig{
+		Rules:    []PolicyRule{{Name: "blocked-site", Action: "block", URLs: []string{"malware.example"}}},
+		Sampling: SamplingConfig{Rate: 0.000001},
+	})
+	if p == nil {
+		t.Fatalf("Expected a policy when sampling")
+	}
+	if decision := p.decide(policyMessage{host: "example.com", path: "/"}); decision != (PolicyDecision{Action: PolicyBypass, Rule: "sampling"}) {
+		t.Errorf("Expected the message to be left out of the sample, got %+v", decision)
+	}
+	if decision := p.decide(policyMessage{host: "malware.example", path: "/"}); decision.Action != PolicyBlock {
+		t.Errorf("Expected blocked messages not to be sampled, got %+v", decision)
+	}
+}
@@ -0,0 +1,309 @@
+package icapclient
+
+import (
+	"bytes"
+	"container/list"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scan cache keys
+const (
+	// ScanCacheKeyHash caches the verdicts on RESPMOD bodies by their
+	// SHA-256
+	ScanCacheKeyHash = "hash"
+	// ScanCacheKeyURL also caches the verdicts on REQMOD requests by their
+	// method and URI, along with the SHA-256 of their body if any
+	ScanCacheKeyURL = "url"
+)
+
+const (
+	// defaultScanCacheEntries is the scan_cache.max_entries used when unset
+	defaultScanCacheEntries = 10000
+	// defaultScanCacheTTL is the scan_cache.ttl used when unset
+	defaultScanCacheTTL = time.Hour
+	// defaultScanCacheSaveInterval is the scan_cache.save_interval used
+	// when unset
+	defaultScanCacheSaveInterval = 5 * time.Minute
+)
+
+// ScanCacheConfig controls the cache of verdicts, which answers repeated
+// submissions of the same body, common with mail and CI artifacts, or of
+// the same URL through a proxy without scanning them again. RESPMOD entries
+// are keyed by the SHA-256 of the body and REQMOD entries, only cached with
+// ScanCacheKeyURL, by the method, URI and body of the request. Entries are
+// also keyed by the ISTag of the service and are flushed as soon as the
+// server reports a new ISTag, e.g. after a signature update. Only clean
+// (204) and infected verdicts are cached, along with block pages of
+// URL-keyed requests; REQMOD verdicts that depend on request headers such
+// as cookies should not be cached.
+type ScanCacheConfig struct {
+	Enabled    bool          `yaml:"enabled" json:"enabled"`
+	MaxEntries int           `yaml:"max_entries" json:"max_entries"`
+	TTL        time.Duration `yaml:"ttl" json:"ttl"`
+	// Key is ScanCacheKeyHash (default) or ScanCacheKeyURL
+	Key string `yaml:"key" json:"key"`
+	// Path persists the cache between runs, along with the capabilities
+	// advertised by the server: it is loaded when the client is created and
+	// saved every SaveInterval (5m by default) and when it is closed.
+	// Loaded entries are only served once a response of this run, such as
+	// an OPTIONS response of the service, confirms their ISTag.
+	Path         string        `yaml:"path" json:"path"`
+	SaveInterval time.Duration `yaml:"save_interval" json:"save_interval"`
+}
+
+// scanCacheKey identifies the scan of a message by a service
+type scanCacheKey struct {
+	method IcapMethod
+	url    string
+	// message is the SHA-256 of the body, or the method and URI of the
+	// request prefixing it when keyed by URL
+	message string
+	istag   string
+}
+
+// scanCacheEntry is a cached response, an element of the LRU list
+type scanCacheEntry struct {
+	key       scanCacheKey
+	response  *IcapResponse
+	expiresAt time.Time
+}
+
+// scanCache is an LRU cache of responses by content hash and ISTag
+type scanCache struct {
+	maxEntries int
+	ttl        time.Duration
+	byURL      bool
+	path       string
+	now        func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[scanCacheKey]*list.Element
+	// istags are the last ISTag of each service URL reported in this run.
+	// They are not saved, so that loaded entries wait for the server to
+	// confirm their ISTag.
+	istags map[string]string
+	// options are the headers of the last OPTIONS response, saved at path
+	options map[string]string
+
+	// saveStop and saveDone stop the periodic saves to path
+	saveStop chan struct{}
+	saveDone chan struct{}
+}
+
+// newScanCache creates the cache for config, or returns nil if disabled
+func newScanCache(config ScanCacheConfig) *scanCache {
+	if !config.Enabled {
+		return nil
+	}
+	maxEntries, ttl := config.MaxEntries, config.TTL
+	if maxEntries <= 0 {
+		maxEntries = defaultScanCacheEntries
+	}
+	if ttl <= 0 {
+		ttl = defaultScanCacheTTL
+	}
+
+	return &scanCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		byURL:      strings.EqualFold(config.Key, ScanCacheKeyURL),
+		path:       config.Path,
+		now:        time.Now,
+		lru:        list.New(),
+		entries:    make(map[scanCacheKey]*list.Element),
+		istags:     make(map[string]string),
+	}
+}
+
+// messageKey returns the key of httpData, whose body is hashed as hashes,
+// or "" if its verdict is not cached. REQMOD verdicts usually depend on the
+// URL and headers of the request, so they are only cached when keyed by URL.
+func (c *scanCache) messageKey(method IcapMethod, httpData interface{}, hashes ContentHashes) string {
+	if c == nil {
+		return ""
+	}
+	sha256 := hashes[HashSHA256]
+	switch request, ok := httpData.(*HttpRequest); {
+	case method == RESPMOD:
+		return sha256
+	case method == REQMOD && c.byURL && ok:
+		key := request.Method + " " + request.URI
+		if sha256 != "" {
+			key += " " + sha256
+		}
+		return key
+	}
+	return ""
+}
+
+// lookup returns a copy of the response cached for the message keyed as
+// key, under the current ISTag of the service at url
+func (c *scanCache) lookup(method IcapMethod, url, key string) (*IcapResponse, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	istag, ok := c.istags[url]
+	if !ok {
+		return nil, false
+	}
+	elem, ok := c.entries[scanCacheKey{method, url, key, istag}]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*scanCacheEntry)
+	if c.now().After(entry.expiresAt) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return cloneResponse(entry.response), true
+}
+
+// record remembers the ISTag of response, flushing the entries of the
+// service at url under another ISTag when it changed or was not known yet,
+// e.g. entries loaded from path, and caches response for the message keyed
+// as key if cacheable. It returns the number of entries flushed.
+func (c *scanCache) record(method IcapMethod, url, key string, response *IcapResponse) int {
+	if c == nil {
+		return 0
+	}
+	istag := headerValue(response.Headers, "ISTag")
+	if istag == "" {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flushed := 0
+	if previous, ok := c.istags[url]; !ok || previous != istag {
+		flushed = c.flush(url, istag)
+	}
+	c.istags[url] = istag
+	if key == "" || !c.cacheable(method, response) {
+		return flushed
+	}
+
+	entryKey := scanCacheKey{method, url, key, istag}
+	entry := &scanCacheEntry{key: entryKey, response: cloneResponse(response), expiresAt: c.now().Add(c.ttl)}
+	if elem, ok := c.entries[entryKey]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return flushed
+	}
+	c.entries[entryKey] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	return flushed
+}
+
+// len returns the number of entries
+func (c *scanCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// flush drops the entries of the service at url under another ISTag than
+// istag, guarded by mu
+func (c *scanCache) flush(url, istag string) int {
+	flushed := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if key := elem.Value.(*scanCacheEntry).key; key.url == url && key.istag != istag {
+			c.remove(elem)
+			flushed++
+		}
+		elem = next
+	}
+	return flushed
+}
+
+// remove drops elem from the cache, guarded by mu
+func (c *scanCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*scanCacheEntry).key)
+}
+
+// cacheable reports whether response is a clean or infected verdict, or a
+// block page answering a URL-keyed request, held in memory
+func (c *scanCache) cacheable(method IcapMethod, response *IcapResponse) bool {
+	switch {
+	case response.StatusCode == int(NoContent):
+	case response.StatusCode == int(OK) && (response.Infection != nil || len(response.Violations) > 0):
+	case response.StatusCode == int(OK) && method == REQMOD && c.byURL && response.HttpResponse != nil:
+	default:
+		return false
+	}
+	return (response.HttpRequest == nil || response.HttpRequest.BodyReader == nil) &&
+		(response.HttpResponse == nil || response.HttpResponse.BodyReader == nil)
+}
+
+// cloneResponse returns a copy of response sharing no mutable state with it
+func cloneResponse(response *IcapResponse) *IcapResponse {
+	clone := *response
+	clone.Headers = maps.Clone(response.Headers)
+	clone.Body = bytes.Clone(response.Body)
+	if response.HttpRequest != nil {
+		request := *response.HttpRequest
+		request.Headers = maps.Clone(request.Headers)
+		request.Trailer = maps.Clone(request.Trailer)
+		request.Body = bytes.Clone(request.Body)
+		clone.HttpRequest = &request
+	}
+	if response.HttpResponse != nil {
+		httpResponse := *response.HttpResponse
+		httpResponse.Headers = maps.Clone(httpResponse.Headers)
+		httpResponse.Trailer = maps.Clone(httpResponse.Trailer)
+		httpResponse.Body = bytes.Clone(httpResponse.Body)
+		clone.HttpResponse = &httpResponse
+	}
+	if response.Infection != nil {
+		infection := *response.Infection
+		clone.Infection = &infection
+	}
+	clone.Violations = slices.Clone(response.Violations)
+	clone.ChunkExtensions = slices.Clone(response.ChunkExtensions)
+	clone.ContentHashes = maps.Clone(response.ContentHashes)
+	clone.Timings = nil
+	return &clone
+}
+
+// localResponse completes a response answered without contacting the
+// server for the request identified by requestID, from source, and logs it
+// like a scanned one
+func (c *IcapClient) localResponse(config *IcapConfig, method IcapMethod, url, requestID string, httpData interface{}, hashes ContentHashes, response *IcapResponse, source string) *IcapResponse {
+	response.RequestID = requestID
+	response.ContentHashes = hashes
+
+	c.logger.Debug("Verdict answered from the "+source, "method", method, "request_id", requestID, "status_code", response.StatusCode)
+	c.logAccess(method, url, requestID, httpData, hashes, response, 0, len(response.Body), 0, 0, nil)
+	config.Hooks.verdict(VerdictEvent{
+		Method:   method,
+		URL:      url,
+		Verdict:  verdictOf(httpData, response),
+		Response: response,
+	})
+	return response
+}
+
+// localError completes the request identified by requestID, failed with err
+// without contacting the server, and logs it like a failed scan
+func (c *IcapClient) localError(config *IcapConfig, method IcapMethod, url, requestID string, httpData interface{}, hashes ContentHashes, err error) error {
+	c.logAccess(method, url, requestID, httpData, hashes, nil, 0, 0, 0, 0, err)
+	config.Hooks.verdict(VerdictEvent{
+		Method:  method,
+		URL:     url,
+		Verdict: VerdictError,
+		Err:     err,
+	})
+	return withRequestID(err, requestID)
+}
@@ -0,0 +1,356 @@
+package icapclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestScanCache tests caching by message key and ISTag, flushing on ISTag
+// changes, expiry and eviction
+func TestScanCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := newScanCache(ScanCacheConfig{Enabled: true, MaxEntries: 2, TTL: time.Minute})
+	cache.now = func() time.Time { return now }
+
+	clean := &IcapResponse{StatusCode: 204, Headers: map[string]string{"ISTag": `"v1"`}}
+	cache.record(REQMOD, "icap://av/reqmod", "a", clean)
+	if _, ok := cache.lookup(REQMOD, "icap://av/reqmod", "a"); !ok {
+		t.Errorf("Expected a hit for a cached body")
+	}
+	if _, ok := cache.lookup(RESPMOD, "icap://av/reqmod", "a"); ok {
+		t.Errorf("Expected a miss for another method")
+	}
+	if _, ok := cache.lookup(REQMOD, "icap://av/reqmod", "b"); ok {
+		t.Errorf("Expected a miss for another body")
+	}
+
+	echo := &IcapResponse{StatusCode: 200, Headers: map[string]string{"ISTag": `"v1"`}}
+	cache.record(REQMOD, "icap://av/reqmod", "b", echo)
+	if _, ok := cache.lookup(REQMOD, "icap://av/reqmod", "b"); ok {
+		t.Errorf("Expected a 200 without a threat not to be cached")
+	}
+	infected := &IcapResponse{StatusCode: 200, Headers: map[string]string{"ISTag": `"v1"`}, Infection: &Infection{Threat: "EICAR"}}
+	cache.record(REQMOD, "icap://av/reqmod", "b", infected)
+	response, ok := cache.lookup(REQMOD, "icap://av/reqmod", "b")
+	if !ok || response.Infection == nil || response.Infection.Threat != "EICAR" {
+		t.Errorf("Expected the infected verdict to be cached, got %v", response)
+	}
+	response.Infection.Threat = "changed"
+	if response, _ := cache.lookup(REQMOD, "icap://av/reqmod", "b"); response.Infection.Threat != "EICAR" {
+		t.Errorf("Expected cached responses to be copied, got %q", response.Infection.Threat)
+	}
+
+	cache.record(REQMOD, "icap://av/reqmod", "c", clean)
+	if _, ok := cache.lookup(REQMOD, "icap://av/reqmod", "a"); ok {
+		t.Errorf("Expected the least recently used entry to be evicted")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := cache.lookup(REQMOD, "icap://av/reqmod", "c"); ok {
+		t.Errorf("Expected an expired entry to miss")
+	}
+
+	cache.record(REQMOD, "icap://av/reqmod", "c", clean)
+	cache.record(RESPMOD, "icap://av/respmod", "c", clean)
+	flushed := cache.record(REQMOD, "icap://av/reqmod", "", &IcapResponse{StatusCode: 200, Headers: map[string]string{"ISTag": `"v2"`}})
+	if flushed != 1 {
+		t.Errorf("Expected a new ISTag to flush 1 entry, got %d", flushed)
+	}
+	if _, ok := cache.lookup(REQMOD, "icap://av/reqmod", "c"); ok {
+		t.Errorf("Expected a new ISTag to invalidate the entries")
+	}
+	if _, ok := cache.lookup(RESPMOD, "icap://av/respmod", "c"); !ok {
+		t.Errorf("Expected the entries of other services to be kept")
+	}
+}
+
+// TestScanCache_SaveVerdicts tests that only verdict metadata is saved,
+// leaving entries holding an encapsulated message in memory
+func TestScanCache_SaveVerdicts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan-cache.json")
+	config := ScanCacheConfig{Enabled: true, Key: ScanCacheKeyURL, Path: path}
+	cache := newScanCache(config)
+
+	istag := map[string]string{"ISTag": `"v1"`}
+	infected := &IcapResponse{StatusCode: 200, Reason: "OK", Headers: istag, Infection: &Infection{Threat: "EICAR"}}
+	blockPage := &IcapResponse{StatusCode: 200, Headers: istag, HttpResponse: &HttpResponse{StatusCode: 403, Body: []byte("secret block page")}}
+	cache.record(RESPMOD, "icap://av/respmod", "a", infected)
+	cache.record(REQMOD, "icap://av/reqmod", "GET /blocked", blockPage)
+	if err := cache.save(); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	if strings.Contains(string(data), "secret block page") {
+		t.Errorf("Expected no encapsulated message in the file, got %s", data)
+	}
+
+	loaded := newScanCache(config)
+	if _, err := loaded.load(); err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	loaded.record(OPTIONS, "icap://av/respmod", "", &IcapResponse{StatusCode: 200, Headers: istag})
+	loaded.record(OPTIONS, "icap://av/reqmod", "", &IcapResponse{StatusCode: 200, Headers: istag})
+	response, ok := loaded.lookup(RESPMOD, "icap://av/respmod", "a")
+	if !ok || response.StatusCode != 200 || response.Infection == nil || response.Infection.Threat != "EICAR" {
+		t.Errorf("Expected the infected verdict to be loaded, got %+v", response)
+	}
+	if _, ok := loaded.lookup(REQMOD, "icap://av/reqmod", "GET /blocked"); ok {
+		t.Errorf("Expected the block page not to be saved")
+	}
+}
+
+// TestIcapClient_ScanCache tests answering repeated bodies from the cache
+// until the server reports a new ISTag, and not caching REQMOD by body
+func TestIcapClient_ScanCache(t *testing.T) {
+	var requests atomic.Int32
+	var istag atomic.Value
+	istag.Store(`"v1"`)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		requests.Add(1)
+		w.Header().Set("ISTag", istag.Load().(string))
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, ConnectionPoolSize: 2, KeepAlive: true, LoggingLevel: "ERROR",
+		ScanCache: ScanCacheConfig{Enabled: true},
+	})
+	defer client.Close()
+
+	scan := func(body string) *IcapResponse {
+		t.Helper()
+		response, err := client.Respmod(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte(body)})
+		if err != nil {
+			t.Fatalf("RESPMOD failed: %v", err)
+		}
+		return response
+	}
+
+	if response := scan("test"); response.FromCache {
+		t.Errorf("Expected the first scan to reach the server")
+	}
+	response := scan("test")
+	if !response.FromCache || response.StatusCode != 204 || response.ContentHashes[HashSHA256] != testSHA256 {
+		t.Errorf("Expected a cached 204 for the same body, got %+v", response)
+	}
+	if response := scan("other"); response.FromCache {
+		t.Errorf("Expected another body to reach the server")
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected 2 requests to the server, got %d", n)
+	}
+
+	// The cache learns the new ISTag from the next response of the server
+	istag.Store(`"v2"`)
+	scan("third")
+	if response := scan("test"); response.FromCache {
+		t.Errorf("Expected a new ISTag to bypass the cache")
+	}
+	if response := scan("test"); !response.FromCache {
+		t.Errorf("Expected the verdict under the new ISTag to be cached")
+	}
+	if n := requests.Load(); n != 4 {
+		t.Errorf("Expected 4 requests to the server, got %d", n)
+	}
+
+	// REQMOD verdicts depend on the URL, so they are not keyed by body
+	for _, uri := range []string{"/allowed", "/blocked"} {
+		response, err := client.Reqmod(context.Background(), &HttpRequest{Method: "POST", URI: uri, Version: "HTTP/1.1", Body: []byte("test")})
+		if err != nil || response.FromCache {
+			t.Errorf("Expected REQMOD to %s to reach the server, got %+v (%v)", uri, response, err)
+		}
+	}
+}
+
+// TestIcapClient_ScanCacheByURL tests caching the verdicts on bodiless
+// requests by URL, as sent by a proxy
+func TestIcapClient_ScanCacheByURL(t *testing.T) {
+	var requests atomic.Int32
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		requests.Add(1)
+		if r.Request != nil && r.Request.URL.Path == "/blocked" {
+			w.WriteHeader(200, &http.Response{StatusCode: 403, Header: http.Header{}}, false)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, ConnectionPoolSize: 2, KeepAlive: true, LoggingLevel: "ERROR",
+		ScanCache: ScanCacheConfig{Enabled: true, Key: ScanCacheKeyURL},
+	})
+	defer client.Close()
+
+	for _, tt := range []struct {
+		uri     string
+		verdict Verdict
+	}{
+		{"http://example.com/", VerdictAllowed},
+		{"http://example.com/blocked", VerdictBlocked},
+	} {
+		for i := 0; i < 2; i++ {
+			verdict, response, err := client.ScanRequest(context.Background(), &HttpRequest{Method: "GET", URI: tt.uri, Version: "HTTP/1.1"})
+			if err != nil {
+				t.Fatalf("%s: REQMOD failed: %v", tt.uri, err)
+			}
+			if verdict != tt.verdict {
+				t.Errorf("%s: Expected %s, got %s", tt.uri, tt.verdict, verdict)
+			}
+			if response.FromCache != (i == 1) {
+				t.Errorf("%s: Expected FromCache %v on scan %d", tt.uri, i == 1, i+1)
+			}
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected 2 requests to the server, got %d", n)
+	}
+}
+
+// TestIcapClient_ScanCachePath tests saving the cache and the capabilities
+// of the server when the client is closed and restoring them in the next,
+// whose loaded entries wait for the server to confirm their ISTag
+func TestIcapClient_ScanCachePath(t *testing.T) {
+	var requests atomic.Int32
+	var istag atomic.Value
+	istag.Store(`"v1"`)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		requests.Add(1)
+		w.Header().Set("ISTag", istag.Load().(string))
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Methods", "RESPMOD")
+			w.Header().Set("Accept-Encoding", "gzip")
+			w.WriteHeader(200, nil, false)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "scan-cache.json")
+	host, port := server.HostPort()
+	newClient := func() *IcapClient {
+		return NewIcapClient(&IcapConfig{
+			Host: host, Port: port, Timeout: 5 * time.Second, ConnectionPoolSize: 2, KeepAlive: true, LoggingLevel: "ERROR",
+			Services:  ServicesConfig{Options: "/respmod"},
+			ScanCache: ScanCacheConfig{Enabled: true, Path: path},
+		})
+	}
+	options := func(client *IcapClient) {
+		t.Helper()
+		if _, err := client.Options(context.Background()); err != nil {
+			t.Fatalf("OPTIONS failed: %v", err)
+		}
+	}
+	scan := func(client *IcapClient) *IcapResponse {
+		t.Helper()
+		response, err := client.Respmod(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte("test")})
+		if err != nil {
+			t.Fatalf("RESPMOD failed: %v", err)
+		}
+		return response
+	}
+
+	client := newClient()
+	options(client)
+	if response := scan(client); response.FromCache {
+		t.Errorf("Expected the first scan to reach the server")
+	}
+	client.Close()
+
+	client = newClient()
+	if client.gzipSupport.Load() != gzipSupported {
+		t.Errorf("Expected the Accept-Encoding of the saved OPTIONS response to be applied")
+	}
+	options(client)
+	response := scan(client)
+	if !response.FromCache || response.StatusCode != 204 {
+		t.Errorf("Expected a cached 204 loaded from %s once OPTIONS confirmed its ISTag, got %+v", path, response)
+	}
+	client.Close()
+	if n := requests.Load(); n != 3 {
+		t.Errorf("Expected 3 requests to the server, got %d", n)
+	}
+
+	// Loaded entries are not served before the server reports an ISTag
+	client = newClient()
+	if response := scan(client); response.FromCache {
+		t.Errorf("Expected a loaded entry not to be served before the ISTag is known")
+	}
+	client.Close()
+
+	// nor after it changed while the client was stopped
+	istag.Store(`"v2"`)
+	client = newClient()
+	options(client)
+	if response := scan(client); response.FromCache {
+		t.Errorf("Expected a loaded entry under a stale ISTag not to be served")
+	}
+	client.Close()
+
+	// A corrupt file is ignored, and replaced on close
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client = newClient()
+	options(client)
+	if response := scan(client); response.FromCache {
+		t.Errorf("Expected a corrupt cache file to start empty")
+	}
+	client.Close()
+	client = newClient()
+	defer client.Close()
+	options(client)
+	if response := scan(client); !response.FromCache {
+		t.Errorf("Expected the cache file to be rewritten on close")
+	}
+}
+
+// TestIcapClient_ScanCacheSaveInterval tests saving the cache periodically
+// while the client runs
+func TestIcapClient_ScanCacheSaveInterval(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.Header().Set("ISTag", `"v1"`)
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "scan-cache.json")
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, LoggingLevel: "ERROR",
+		ScanCache: ScanCacheConfig{Enabled: true, Path: path, SaveInterval: 10 * time.Millisecond},
+	})
+	defer client.Close()
+	if _, err := client.Respmod(context.Background(), &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte("test")}); err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var file scanCacheFile
+		if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &file) == nil && len(file.Entries) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the cache to be saved before the client is closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
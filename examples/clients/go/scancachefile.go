@@ -0,0 +1,230 @@
+package icapclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// scanCacheFileVersion is the format version of saved scan caches. Files
+// of version 1, which held whole responses, are not loaded.
+const scanCacheFileVersion = 2
+
+// scanCacheFile is a scan cache saved to disk, as JSON
+type scanCacheFile struct {
+	Version int `json:"version"`
+	// Options are the headers of the last OPTIONS response of the server
+	Options map[string]string `json:"options,omitempty"`
+	// Entries are in LRU order, the most recently used first
+	Entries []scanCacheFileEntry `json:"entries"`
+}
+
+// scanCacheFileEntry is a saved cache entry
+type scanCacheFileEntry struct {
+	Method    IcapMethod        `json:"method"`
+	URL       string            `json:"url"`
+	Message   string            `json:"message"`
+	ISTag     string            `json:"istag"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	Verdict   *scanCacheVerdict `json:"verdict"`
+}
+
+// scanCacheVerdict is the metadata of a cached response saved to disk.
+// Encapsulated messages, such as block pages, and bodies are never saved,
+// so only the entries of responses without them are.
+type scanCacheVerdict struct {
+	StatusCode int               `json:"status_code"`
+	Reason     string            `json:"reason"`
+	Headers    map[string]string `json:"headers"`
+	Infection  *Infection        `json:"infection,omitempty"`
+	Violations []Violation       `json:"violations,omitempty"`
+}
+
+// savedVerdict returns the metadata of response to save, or nil if it
+// carries an encapsulated message or a body
+func savedVerdict(response *IcapResponse) *scanCacheVerdict {
+	if response.HttpRequest != nil || response.HttpResponse != nil || len(response.Body) > 0 {
+		return nil
+	}
+	return &scanCacheVerdict{
+		StatusCode: response.StatusCode,
+		Reason:     response.Reason,
+		Headers:    response.Headers,
+		Infection:  response.Infection,
+		Violations: response.Violations,
+	}
+}
+
+// response returns the cached response restored from v
+func (v *scanCacheVerdict) response() *IcapResponse {
+	return &IcapResponse{
+		Version:    "ICAP/1.0",
+		StatusCode: v.StatusCode,
+		Reason:     v.Reason,
+		Headers:    v.Headers,
+		Infection:  v.Infection,
+		Violations: v.Violations,
+	}
+}
+
+// recordOptions remembers the headers of an OPTIONS response, saved with
+// the cache so the capabilities of the server are known on restart
+func (c *scanCache) recordOptions(headers map[string]string) {
+	if c == nil || c.path == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.options = maps.Clone(headers)
+}
+
+// load restores the cache saved at its path, dropping expired entries, and
+// returns the saved OPTIONS headers, if any. The ISTags of the services are
+// left unknown, so the entries are only served once the server confirms
+// their ISTag.
+func (c *scanCache) load() (map[string]string, error) {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	var file scanCacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid scan cache file: %w", err)
+	}
+	if file.Version != scanCacheFileVersion {
+		return nil, fmt.Errorf("unsupported scan cache file version %d", file.Version)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for _, saved := range file.Entries {
+		if saved.Verdict == nil || now.After(saved.ExpiresAt) || c.lru.Len() >= c.maxEntries {
+			continue
+		}
+		key := scanCacheKey{saved.Method, saved.URL, saved.Message, saved.ISTag}
+		if _, ok := c.entries[key]; ok {
+			continue
+		}
+		c.entries[key] = c.lru.PushBack(&scanCacheEntry{key: key, response: saved.Verdict.response(), expiresAt: saved.ExpiresAt})
+	}
+	c.options = file.Options
+	return maps.Clone(file.Options), nil
+}
+
+// save writes the verdicts of the cache to its path, replacing the
+// previous file at once. Entries holding an encapsulated message are only
+// kept in memory.
+func (c *scanCache) save() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	file := scanCacheFile{
+		Version: scanCacheFileVersion,
+		Options: c.options,
+		Entries: make([]scanCacheFileEntry, 0, c.lru.Len()),
+	}
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*scanCacheEntry)
+		verdict := savedVerdict(entry.response)
+		if verdict == nil {
+			continue
+		}
+		file.Entries = append(file.Entries, scanCacheFileEntry{
+			Method:    entry.key.method,
+			URL:       entry.key.url,
+			Message:   entry.key.message,
+			ISTag:     entry.key.istag,
+			ExpiresAt: entry.expiresAt,
+			Verdict:   verdict,
+		})
+	}
+	data, err := json.Marshal(&file)
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to save scan cache: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to save scan cache: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save scan cache: %w", err)
+	}
+	return nil
+}
+
+// startScanCacheSaver saves the scan cache to scan_cache.path every
+// interval, so that a crash only loses the verdicts of the last interval
+func (c *IcapClient) startScanCacheSaver(interval time.Duration) {
+	cache := c.scanCache
+	if cache == nil || cache.path == "" {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultScanCacheSaveInterval
+	}
+
+	cache.saveStop = make(chan struct{})
+	cache.saveDone = make(chan struct{})
+	go func() {
+		defer close(cache.saveDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cache.saveStop:
+				return
+			case <-ticker.C:
+				if err := cache.save(); err != nil {
+					c.logger.Warn("Scan cache not saved", "path", cache.path, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopSaver stops the periodic saves and waits for a save in progress
+func (c *scanCache) stopSaver() {
+	if c == nil || c.saveStop == nil {
+		return
+	}
+	close(c.saveStop)
+	<-c.saveDone
+	c.saveStop = nil
+}
+
+// restoreScanCache loads the scan cache saved at scan_cache.path and
+// applies the saved capabilities of the server
+func (c *IcapClient) restoreScanCache() {
+	if c.scanCache == nil || c.scanCache.path == "" {
+		return
+	}
+	options, err := c.scanCache.load()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return
+	case err != nil:
+		c.logger.Warn("Failed to load scan cache, starting empty", "path", c.scanCache.path, "error", err)
+		return
+	}
+	c.logger.Info("Scan cache loaded", "path", c.scanCache.path, "entries", c.scanCache.len())
+	if options != nil {
+		c.recordCapabilities(&IcapResponse{StatusCode: int(OK), Headers: options})
+	}
+}
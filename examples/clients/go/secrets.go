@@ -0,0 +1,77 @@
+package icapclient
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// secretFileSuffix marks a setting read from a file, e.g. password_file
+const secretFileSuffix = "_file"
+
+// authSecretFields are the authentication settings that may be read from a
+// file with a "_file" suffixed key, e.g. password_file
+var authSecretFields = []string{"username", "password", "token", "jwt_token", "api_key"}
+
+// ResolveSecretFiles reads the credentials configured as file references,
+// such as authentication.password_file or proxy.socks5.password_file, so
+// secrets can be mounted from Kubernetes or Docker secrets rather than
+// written in the configuration. A trailing newline is ignored. Each
+// reference is replaced by the value it points to, and all problems are
+// returned at once as a *ValidationError.
+func (c *IcapConfig) ResolveSecretFiles() error {
+	v := &validator{}
+
+	for _, name := range authSecretFields {
+		path, ok := c.Authentication[name+secretFileSuffix]
+		if !ok {
+			continue
+		}
+		field := "authentication." + name
+		if value, err := resolveSecretFile(v, field, c.Authentication[name], path); err == nil {
+			c.Authentication[name] = value
+			delete(c.Authentication, name+secretFileSuffix)
+		}
+	}
+
+	for _, credential := range []struct {
+		field        string
+		password     *string
+		passwordFile *string
+	}{
+		{"proxy.socks5.password", &c.Proxy.SOCKS5.Password, &c.Proxy.SOCKS5.PasswordFile},
+		{"proxy.http_connect.password", &c.Proxy.HTTPConnect.Password, &c.Proxy.HTTPConnect.PasswordFile},
+	} {
+		if *credential.passwordFile == "" {
+			continue
+		}
+		if value, err := resolveSecretFile(v, credential.field, *credential.password, *credential.passwordFile); err == nil {
+			*credential.password = value
+			*credential.passwordFile = ""
+		}
+	}
+
+	return v.err()
+}
+
+// resolveSecretFile reads the secret of field from path, recording a
+// problem when it cannot be read or is also set inline
+func resolveSecretFile(v *validator, field, inline, path string) (string, error) {
+	var err error
+	switch {
+	case inline != "":
+		err = fmt.Errorf("is mutually exclusive with %s", field)
+	case path == "":
+		err = fmt.Errorf("file path is empty")
+	default:
+		var data []byte
+		if data, err = os.ReadFile(path); err == nil {
+			if value := strings.TrimRight(string(data), "\r\n"); value != "" {
+				return value, nil
+			}
+			err = fmt.Errorf("%s is empty", path)
+		}
+	}
+	v.add(field+secretFileSuffix, "%v", err)
+	return "", err
+}
@@ -0,0 +1,85 @@
+package icapclient
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestIcapConfig_ResolveSecretFiles tests reading credentials from files
+func TestIcapConfig_ResolveSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret := func(name, value string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+			t.Fatalf("Failed to write secret: %v", err)
+		}
+		return path
+	}
+	password := writeSecret("password", "s3cret\n")
+	token := writeSecret("token", "abc.def.ghi")
+	empty := writeSecret("empty", "\n")
+
+	config := &IcapConfig{
+		Authentication: map[string]string{"method": "basic", "username": "admin", "password_file": password},
+		Proxy: ProxyConfig{
+			SOCKS5: SOCKS5Config{Address: "bastion:1080", Username: "icap", PasswordFile: token},
+		},
+	}
+	if err := config.ResolveSecretFiles(); err != nil {
+		t.Fatalf("ResolveSecretFiles failed: %v", err)
+	}
+	if want := map[string]string{"method": "basic", "username": "admin", "password": "s3cret"}; !reflect.DeepEqual(config.Authentication, want) {
+		t.Errorf("Expected authentication %v, got %v", want, config.Authentication)
+	}
+	if config.Proxy.SOCKS5.Password != "abc.def.ghi" || config.Proxy.SOCKS5.PasswordFile != "" {
+		t.Errorf("Expected SOCKS5 password from file, got %+v", config.Proxy.SOCKS5)
+	}
+	if err := config.ResolveSecretFiles(); err != nil {
+		t.Errorf("Expected resolving twice to succeed, got %v", err)
+	}
+
+	config = &IcapConfig{
+		Authentication: map[string]string{"method": "bearer", "token": "inline", "token_file": token, "api_key_file": empty},
+		Proxy: ProxyConfig{
+			HTTPConnect: HTTPConnectConfig{Address: "proxy:3128", PasswordFile: filepath.Join(dir, "missing")},
+		},
+	}
+	err := config.ResolveSecretFiles()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected *ValidationError, got %v", err)
+	}
+	var fields []string
+	for _, problem := range validationErr.Problems {
+		fields = append(fields, problem.Field)
+	}
+	if want := []string{"authentication.token_file", "authentication.api_key_file", "proxy.http_connect.password_file"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("Expected problems with %v, got %v", want, err)
+	}
+}
+
+// TestLoadConfig_SecretFiles tests that LoadConfig resolves secret files
+// before validating
+func TestLoadConfig_SecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	apiKey := filepath.Join(dir, "api_key")
+	if err := os.WriteFile(apiKey, []byte("key-123\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+	configPath := filepath.Join(dir, "config.yaml")
+	configData := "authentication:\n  method: api_key\n  api_key_file: " + apiKey + "\n"
+	if err := os.WriteFile(configPath, []byte(configData), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Expected config to load, got %v", err)
+	}
+	if config.Authentication["api_key"] != "key-123" {
+		t.Errorf("Expected api_key from file, got %v", config.Authentication)
+	}
+}
@@ -0,0 +1,246 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// spoolChunkSize is the chunk size used to stream a body from its source
+const spoolChunkSize = 32 << 10
+
+// SpoolConfig controls spooling of large encapsulated bodies to disk. Bodies
+// up to Threshold bytes stay in memory; larger ones are written to temporary
+// files in Directory (os.TempDir when empty). A zero Threshold disables
+// spooling.
+type SpoolConfig struct {
+	Directory string `yaml:"directory" json:"directory"`
+	Threshold int64  `yaml:"threshold" json:"threshold"`
+}
+
+// enabled reports whether bodies over the threshold are spooled to disk
+func (s SpoolConfig) enabled() bool {
+	return s.Threshold > 0
+}
+
+// withThreshold returns s spooling bodies over threshold too, when positive
+func (s SpoolConfig) withThreshold(threshold int64) SpoolConfig {
+	if threshold > 0 && (!s.enabled() || threshold < s.Threshold) {
+		s.Threshold = threshold
+	}
+	return s
+}
+
+// create creates a spool file
+func (s SpoolConfig) create() (*os.File, error) {
+	file, err := os.CreateTemp(s.Directory, "icap-spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	return file, nil
+}
+
+// spoolFile is a body spooled to disk, removed when closed
+type spoolFile struct {
+	*os.File
+}
+
+// Close closes and removes the spool file
+func (f *spoolFile) Close() error {
+	err := f.File.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// bodyStream is an encapsulated body sent from a seekable source rather
+// than from memory, so it can be replayed when a request is retried
+type bodyStream struct {
+	source io.ReadSeeker
+	start  int64
+	size   int64
+	closer io.Closer
+	// trailer is written after the terminal chunk
+	trailer map[string]string
+	// preview, when set, limits the first write to the first previewSize
+	// bytes, the rest following a 100 Continue
+	preview     bool
+	previewSize int64
+	// hasher, when set, hashes the first hashSize bytes of the source as
+	// they are sent. hashed counts the bytes it saw and offset is the
+	// position of the source from start.
+	hasher   *contentHasher
+	hashSize int64
+	hashed   int64
+	offset   int64
+}
+
+// httpBodyReader returns the BodyReader of an encapsulated HTTP message
+func httpBodyReader(httpData interface{}) io.Reader {
+	switch data := httpData.(type) {
+	case *HttpRequest:
+		return data.BodyReader
+	case *HttpResponse:
+		return data.BodyReader
+	}
+	return nil
+}
+
+// openBodyStream prepares the BodyReader of httpData for sending. Seekable
+// readers are streamed in place; others are read into memory, or into a
+// spool file once they exceed the spool threshold.
+func openBodyStream(httpData interface{}, spool SpoolConfig) (*bodyStream, error) {
+	reader := httpBodyReader(httpData)
+	if reader == nil {
+		return nil, nil
+	}
+
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek body: %w", err)
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek body: %w", err)
+		}
+		return &bodyStream{source: seeker, start: start, size: end - start}, nil
+	}
+
+	if !spool.enabled() {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body: %w", err)
+		}
+		return &bodyStream{source: bytes.NewReader(data), size: int64(len(data))}, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, spool.Threshold+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if int64(len(data)) <= spool.Threshold {
+		return &bodyStream{source: bytes.NewReader(data), size: int64(len(data))}, nil
+	}
+
+	file, err := spool.create()
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spoolFile{file}
+	size, err := io.Copy(file, io.MultiReader(bytes.NewReader(data), reader))
+	if err != nil {
+		spooled.Close()
+		return nil, fmt.Errorf("failed to spool body: %w", err)
+	}
+	return &bodyStream{source: file, size: size, closer: spooled}, nil
+}
+
+// writeChunks rewinds the stream and writes it to w as a chunked body,
+// including the terminal chunk and trailer. With a preview only the preview
+// is written, its terminal chunk marked ieof when it holds the whole body.
+func (s *bodyStream) writeChunks(w *bufio.Writer) error {
+	if _, err := s.source.Seek(s.start, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind body: %w", err)
+	}
+	s.offset = 0
+	if !s.preview {
+		if err := s.copyChunks(w, s.size); err != nil {
+			return err
+		}
+		return s.writeEnd(w, "0\r\n")
+	}
+
+	if err := s.copyChunks(w, min(s.previewSize, s.size)); err != nil {
+		return err
+	}
+	if !s.previewIncomplete() {
+		return s.writeEnd(w, "0; ieof\r\n")
+	}
+	w.WriteString("0\r\n\r\n")
+	return w.Flush()
+}
+
+// writeRest writes the body after the preview to w once the server asks
+// for it with 100 Continue, including the terminal chunk and trailer
+func (s *bodyStream) writeRest(w *bufio.Writer) error {
+	if _, err := s.source.Seek(s.start+s.previewSize, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind body: %w", err)
+	}
+	s.offset = s.previewSize
+	if err := s.copyChunks(w, s.size-s.previewSize); err != nil {
+		return err
+	}
+	return s.writeEnd(w, "0\r\n")
+}
+
+// previewIncomplete reports whether the preview leaves part of the body
+// unsent
+func (s *bodyStream) previewIncomplete() bool {
+	return s != nil && s.preview && s.previewSize < s.size
+}
+
+// copyChunks writes the next n bytes of the source to w as chunks, hashing
+// those that follow the bytes hashed so far
+func (s *bodyStream) copyChunks(w *bufio.Writer, n int64) error {
+	var size [16]byte
+	remaining := n
+	buf := make([]byte, min(int64(spoolChunkSize), max(remaining, 1)))
+	for remaining > 0 {
+		n, err := io.ReadFull(s.source, buf[:min(int64(len(buf)), remaining)])
+		if err != nil {
+			return fmt.Errorf("failed to read body: %w", err)
+		}
+		if s.hasher != nil && s.offset == s.hashed {
+			s.hasher.w.Write(buf[:n])
+			s.hashed += int64(n)
+		}
+		s.offset += int64(n)
+		w.Write(strconv.AppendInt(size[:0], int64(n), 16))
+		w.WriteString("\r\n")
+		w.Write(buf[:n])
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+		remaining -= int64(n)
+	}
+	return nil
+}
+
+// writeEnd writes the terminal chunk and the trailer, and flushes w
+func (s *bodyStream) writeEnd(w *bufio.Writer, terminal string) error {
+	w.WriteString(terminal)
+	writeHeaders(w, s.trailer)
+	return w.Flush()
+}
+
+// contentHashes returns the hashes of the body when it is hashed as it is
+// sent, or nil. The bytes that were not sent, after a preview or when the
+// body was truncated, are read to complete them.
+func (s *bodyStream) contentHashes() ContentHashes {
+	if s == nil || s.hasher == nil {
+		return nil
+	}
+	if s.hashed < s.hashSize {
+		if _, err := s.source.Seek(s.start+s.hashed, io.SeekStart); err != nil {
+			return nil
+		}
+		if _, err := io.CopyN(s.hasher.w, s.source, s.hashSize-s.hashed); err != nil {
+			return nil
+		}
+		s.hashed = s.hashSize
+	}
+	return s.hasher.sum()
+}
+
+// Close releases the spool file of the stream, if any
+func (s *bodyStream) Close() error {
+	if s == nil || s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,211 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// spoolFiles lists the spool files in dir
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "icap-spool-*"))
+	if err != nil {
+		t.Fatalf("Failed to list spool files: %v", err)
+	}
+	return files
+}
+
+// TestOpenBodyStream tests how message bodies are prepared for streaming
+func TestOpenBodyStream(t *testing.T) {
+	dir := t.TempDir()
+	spool := SpoolConfig{Directory: dir, Threshold: 8}
+
+	tests := []struct {
+		name    string
+		reader  io.Reader
+		spool   SpoolConfig
+		size    int64
+		spooled bool
+	}{
+		{"Seekable", strings.NewReader("0123456789abcdef"), spool, 16, false},
+		{"Small stream", io.LimitReader(strings.NewReader("0123"), 4), spool, 4, false},
+		{"Large stream", io.LimitReader(strings.NewReader("0123456789abcdef"), 16), spool, 16, true},
+		{"Spooling disabled", io.LimitReader(strings.NewReader("0123456789abcdef"), 16), SpoolConfig{}, 16, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := openBodyStream(&HttpResponse{BodyReader: tt.reader}, tt.spool)
+			if err != nil {
+				t.Fatalf("Failed to open body stream: %v", err)
+			}
+			if stream.size != tt.size {
+				t.Errorf("Expected size %d, got %d", tt.size, stream.size)
+			}
+			if got := len(spoolFiles(t, dir)) == 1; got != tt.spooled {
+				t.Errorf("Expected spooled %v, got %v", tt.spooled, got)
+			}
+
+			stream.Close()
+			if files := spoolFiles(t, dir); len(files) != 0 {
+				t.Errorf("Expected spool files to be removed, got %v", files)
+			}
+		})
+	}
+
+	if stream, err := openBodyStream(&HttpResponse{Body: []byte("x")}, spool); stream != nil || err != nil {
+		t.Errorf("Expected no stream for an in-memory body, got %v %v", stream, err)
+	}
+}
+
+// TestBodyStream_writeChunks tests chunk framing and replay of a stream
+func TestBodyStream_writeChunks(t *testing.T) {
+	source := strings.NewReader("skip" + strings.Repeat("a", spoolChunkSize+5))
+	source.Seek(4, io.SeekStart)
+	stream, err := openBodyStream(&HttpRequest{BodyReader: source}, SpoolConfig{})
+	if err != nil {
+		t.Fatalf("Failed to open body stream: %v", err)
+	}
+
+	expected := "8000\r\n" + strings.Repeat("a", spoolChunkSize) + "\r\n5\r\naaaaa\r\n0\r\n\r\n"
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		if err := stream.writeChunks(w); err != nil {
+			t.Fatalf("Failed to write chunks: %v", err)
+		}
+		w.Flush()
+		if buf.String() != expected {
+			t.Errorf("Attempt %d: expected %d framed bytes, got %q...", i+1, len(expected), buf.String()[:20])
+		}
+	}
+}
+
+// TestBodyStream_writeChunksTrailer tests writing the trailer of a stream
+func TestBodyStream_writeChunksTrailer(t *testing.T) {
+	stream, err := openBodyStream(&HttpRequest{BodyReader: strings.NewReader("abc")}, SpoolConfig{})
+	if err != nil {
+		t.Fatalf("Failed to open body stream: %v", err)
+	}
+	stream.trailer = map[string]string{"X-Checksum": "352441c2"}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := stream.writeChunks(w); err != nil {
+		t.Fatalf("Failed to write chunks: %v", err)
+	}
+	w.Flush()
+	expected := "3\r\nabc\r\n0\r\nX-Checksum: 352441c2\r\n\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+// TestIcapClient_Spooling tests streaming a large request body and
+// spooling a large response body against an icaptest server
+func TestIcapClient_Spooling(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		resp := &http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {"text/plain"}}}
+		w.WriteHeader(200, resp, true)
+		w.Write(bytes.ToUpper(r.Body))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	client := newTestServerClient(server, false)
+	client.config.Load().Spool = SpoolConfig{Directory: dir, Threshold: 1024}
+	client.transport.spool = client.config.Load().Spool
+	defer client.Close()
+
+	body := strings.Repeat("spool me ", 1000)
+	response, err := client.Respmod(context.Background(), &HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		BodyReader: io.LimitReader(strings.NewReader(body), int64(len(body))),
+	})
+	if err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+
+	if response.HttpResponse == nil || response.HttpResponse.Body != nil || response.HttpResponse.BodyReader == nil {
+		t.Fatalf("Expected the response body to be spooled, got %+v", response.HttpResponse)
+	}
+	if files := spoolFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected the request spool to be removed and the response spooled, got %v", files)
+	}
+
+	data, err := io.ReadAll(response.HttpResponse.BodyReader)
+	if err != nil {
+		t.Fatalf("Failed to read spooled body: %v", err)
+	}
+	if string(data) != strings.ToUpper(body) {
+		t.Errorf("Expected %d byte modified body, got %d bytes", len(body), len(data))
+	}
+
+	if err := response.Close(); err != nil {
+		t.Errorf("Failed to close response: %v", err)
+	}
+	if _, err := os.Stat(response.HttpResponse.BodyReader.(*spoolFile).Name()); !os.IsNotExist(err) {
+		t.Errorf("Expected spool file to be removed, got %v", err)
+	}
+}
+
+// TestBodyStream_writePreview tests writing a preview and the rest of the
+// body after it
+func TestBodyStream_writePreview(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		previewSize int64
+		preview     string
+		rest        string
+	}{
+		{"partial", "abcdef", 4, "4\r\nabcd\r\n0\r\n\r\n", "2\r\nef\r\n0\r\nX-Checksum: 1\r\n\r\n"},
+		{"whole body", "abc", 4, "3\r\nabc\r\n0; ieof\r\nX-Checksum: 1\r\n\r\n", ""},
+		{"empty preview", "abc", 0, "0\r\n\r\n", "3\r\nabc\r\n0\r\nX-Checksum: 1\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := openBodyStream(&HttpRequest{BodyReader: strings.NewReader(tt.body)}, SpoolConfig{})
+			if err != nil {
+				t.Fatalf("Failed to open body stream: %v", err)
+			}
+			stream.trailer = map[string]string{"X-Checksum": "1"}
+			stream.preview, stream.previewSize = true, tt.previewSize
+
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			if err := stream.writeChunks(w); err != nil {
+				t.Fatalf("Failed to write preview: %v", err)
+			}
+			if buf.String() != tt.preview {
+				t.Errorf("Expected preview %q, got %q", tt.preview, buf.String())
+			}
+			if stream.previewIncomplete() != (tt.rest != "") {
+				t.Fatalf("Expected previewIncomplete %v", tt.rest != "")
+			}
+			if tt.rest == "" {
+				return
+			}
+			buf.Reset()
+			if err := stream.writeRest(w); err != nil {
+				t.Fatalf("Failed to write the rest: %v", err)
+			}
+			if buf.String() != tt.rest {
+				t.Errorf("Expected rest %q, got %q", tt.rest, buf.String())
+			}
+		})
+	}
+}
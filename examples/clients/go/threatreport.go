@@ -0,0 +1,165 @@
+package icapclient
+
+import (
+	"encoding/json"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// ThreatReport is the extended scan result of G3ICAP's analysis modules:
+// the engine that decided, the matched YARA rules, a severity and the
+// indicators of compromise of the scanned content
+type ThreatReport struct {
+	Engine     string            `yaml:"engine,omitempty" json:"engine,omitempty"`
+	ThreatName string            `yaml:"threat_name,omitempty" json:"threat_name,omitempty"`
+	ThreatType string            `yaml:"threat_type,omitempty" json:"threat_type,omitempty"`
+	Severity   string            `yaml:"severity,omitempty" json:"severity,omitempty"`
+	Reason     string            `yaml:"reason,omitempty" json:"reason,omitempty"`
+	Rules      []YaraMatch       `yaml:"yara_matches,omitempty" json:"yara_matches,omitempty"`
+	Hashes     map[string]string `yaml:"hashes,omitempty" json:"hashes,omitempty"`
+	Metadata   map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+// YaraMatch is a YARA rule that matched the scanned content
+type YaraMatch struct {
+	RuleName  string            `yaml:"rule_name" json:"rule_name"`
+	Namespace string            `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	Tags      []string          `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Priority  int               `yaml:"priority,omitempty" json:"priority,omitempty"`
+	Metadata  map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+// ThreatReport returns the extended scan result carried by the response, or
+// nil when it carries none. It is assembled from, in increasing priority:
+//   - the threat of X-Infection-Found
+//   - the X-ICAP-Virus, X-Threat-Engine, X-Threat-Type, X-Threat-Severity,
+//     X-Block-Reason, X-ICAP-Error and X-YARA-Rules headers, and one
+//     X-IOC-<Algorithm> header per content hash
+//   - a JSON report in the encapsulated HTTP response body, when its
+//     Content-Type is application/json
+//
+// The report is parsed on every call.
+func (r *IcapResponse) ThreatReport() *ThreatReport {
+	report := &ThreatReport{}
+	found := false
+	set := func(field *string, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			*field = value
+			found = true
+		}
+	}
+
+	if r.Infection != nil {
+		set(&report.ThreatName, r.Infection.Threat)
+		set(&report.ThreatType, r.Infection.Type.String())
+	}
+
+	set(&report.ThreatName, headerValue(r.Headers, "X-ICAP-Virus"))
+	set(&report.Engine, headerValue(r.Headers, "X-Threat-Engine"))
+	set(&report.ThreatType, headerValue(r.Headers, "X-Threat-Type"))
+	set(&report.Severity, strings.ToLower(headerValue(r.Headers, "X-Threat-Severity")))
+	set(&report.Reason, headerValue(r.Headers, "X-ICAP-Error"))
+	set(&report.Reason, headerValue(r.Headers, "X-Block-Reason"))
+	if rules := ParseYaraRules(headerValue(r.Headers, "X-YARA-Rules")); len(rules) > 0 {
+		report.Rules = rules
+		found = true
+	}
+	for name, value := range r.Headers {
+		if len(name) > len("X-IOC-") && strings.EqualFold(name[:len("X-IOC-")], "X-IOC-") && strings.TrimSpace(value) != "" {
+			if report.Hashes == nil {
+				report.Hashes = map[string]string{}
+			}
+			report.Hashes[strings.ToLower(name[len("X-IOC-"):])] = strings.ToLower(strings.TrimSpace(value))
+			found = true
+		}
+	}
+
+	if body := r.HttpResponse; body != nil && body.BodyReader == nil && len(body.Body) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(headerValue(body.Headers, "Content-Type"))
+		var decoded ThreatReport
+		if mediaType == "application/json" && json.Unmarshal(body.Body, &decoded) == nil && decoded.found() {
+			report.merge(&decoded)
+			found = true
+		}
+	}
+
+	if report.ThreatName == "" && len(report.Rules) > 0 {
+		report.ThreatName = report.Rules[0].RuleName
+	}
+	if !found {
+		return nil
+	}
+	return report
+}
+
+// found reports whether a decoded JSON report holds any result
+func (t *ThreatReport) found() bool {
+	return t.Engine != "" || t.ThreatName != "" || t.Severity != "" || t.Reason != "" ||
+		len(t.Rules) > 0 || len(t.Hashes) > 0
+}
+
+// merge overrides the fields of t with the fields set in other
+func (t *ThreatReport) merge(other *ThreatReport) {
+	for _, field := range []struct{ dst, src *string }{
+		{&t.Engine, &other.Engine},
+		{&t.ThreatName, &other.ThreatName},
+		{&t.ThreatType, &other.ThreatType},
+		{&t.Severity, &other.Severity},
+		{&t.Reason, &other.Reason},
+	} {
+		if *field.src != "" {
+			*field.dst = *field.src
+		}
+	}
+	t.Severity = strings.ToLower(t.Severity)
+	if len(other.Rules) > 0 {
+		t.Rules = other.Rules
+	}
+	for name, value := range other.Hashes {
+		if t.Hashes == nil {
+			t.Hashes = map[string]string{}
+		}
+		t.Hashes[strings.ToLower(name)] = strings.ToLower(value)
+	}
+	if len(other.Metadata) > 0 {
+		t.Metadata = other.Metadata
+	}
+}
+
+// ParseYaraRules parses an X-YARA-Rules header, a comma-separated list of
+// rules written as [namespace:]rule, optionally followed by space-separated
+// tags in brackets and a priority, e.g.
+// "malware:Emotet_Loader [trojan banker] priority=90, Suspicious_PE"
+func ParseYaraRules(value string) []YaraMatch {
+	var rules []YaraMatch
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var match YaraMatch
+		if open := strings.IndexByte(entry, '['); open >= 0 {
+			if end := strings.IndexByte(entry[open:], ']'); end >= 0 {
+				match.Tags = strings.Fields(entry[open+1 : open+end])
+				entry = entry[:open] + " " + entry[open+end+1:]
+			}
+		}
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if value, ok := strings.CutPrefix(field, "priority="); ok {
+				match.Priority, _ = strconv.Atoi(value)
+			}
+		}
+		match.RuleName = fields[0]
+		if namespace, name, ok := strings.Cut(fields[0], ":"); ok {
+			match.Namespace, match.RuleName = namespace, name
+		}
+		rules = append(rules, match)
+	}
+	return rules
+}
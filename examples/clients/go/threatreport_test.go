@@ -0,0 +1,105 @@
+package icapclient
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseYaraRules tests parsing X-YARA-Rules headers
+func TestParseYaraRules(t *testing.T) {
+	rules := ParseYaraRules("malware:Emotet_Loader [trojan banker] priority=90, Suspicious_PE,, ")
+	expected := []YaraMatch{
+		{RuleName: "Emotet_Loader", Namespace: "malware", Tags: []string{"trojan", "banker"}, Priority: 90},
+		{RuleName: "Suspicious_PE"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, rules)
+	}
+	if rules := ParseYaraRules(""); rules != nil {
+		t.Errorf("Expected no rules, got %+v", rules)
+	}
+}
+
+// TestIcapResponse_ThreatReport tests assembling threat reports from
+// headers and JSON bodies
+func TestIcapResponse_ThreatReport(t *testing.T) {
+	t.Run("none", func(t *testing.T) {
+		response := &IcapResponse{StatusCode: 204, Headers: map[string]string{"ISTag": `"g3icap"`}}
+		if report := response.ThreatReport(); report != nil {
+			t.Errorf("Expected no report, got %+v", report)
+		}
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		response := &IcapResponse{
+			StatusCode: 200,
+			Headers: map[string]string{
+				"X-Threat-Engine":   "YARA",
+				"X-Threat-Severity": "High",
+				"x-yara-rules":      "malware:Emotet_Loader [trojan], Suspicious_PE",
+				"X-IOC-SHA256":      "E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855",
+				"X-IOC-MD5":         "d41d8cd98f00b204e9800998ecf8427e",
+				"X-Block-Reason":    "Malware detected",
+			},
+		}
+		report := response.ThreatReport()
+		if report == nil {
+			t.Fatal("Expected a report")
+		}
+		if report.Engine != "YARA" || report.Severity != "high" || report.Reason != "Malware detected" {
+			t.Errorf("Unexpected report fields %+v", report)
+		}
+		if report.ThreatName != "Emotet_Loader" || len(report.Rules) != 2 || report.Rules[0].Namespace != "malware" {
+			t.Errorf("Expected the first rule as threat, got %+v", report)
+		}
+		if report.Hashes["sha256"] != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" || report.Hashes["md5"] == "" {
+			t.Errorf("Expected sha256 and md5 IOCs, got %v", report.Hashes)
+		}
+	})
+
+	t.Run("infection and g3icap virus header", func(t *testing.T) {
+		response := &IcapResponse{
+			StatusCode: 200,
+			Headers:    map[string]string{"X-ICAP-Virus": "EICAR-Test-File"},
+			Infection:  &Infection{Type: ThreatVirus, Resolution: ResolutionBlocked, Threat: "Other"},
+		}
+		report := response.ThreatReport()
+		if report == nil || report.ThreatName != "EICAR-Test-File" || report.ThreatType != "virus" {
+			t.Errorf("Expected EICAR-Test-File virus, got %+v", report)
+		}
+	})
+
+	t.Run("json body", func(t *testing.T) {
+		response := &IcapResponse{
+			StatusCode: 200,
+			Headers:    map[string]string{"X-Threat-Severity": "low", "X-IOC-MD5": "aaaa"},
+			HttpResponse: &HttpResponse{
+				StatusCode: 403,
+				Headers:    map[string]string{"Content-Type": "application/json; charset=utf-8"},
+				Body: []byte(`{"engine":"YARA","threat_name":"Ransom_Note","severity":"CRITICAL",` +
+					`"yara_matches":[{"rule_name":"Ransom_Note","namespace":"ransomware","tags":["note"],"priority":100}],` +
+					`"hashes":{"SHA1":"BBBB"},"metadata":{"top_rule":"Ransom_Note"}}`),
+			},
+		}
+		report := response.ThreatReport()
+		if report == nil {
+			t.Fatal("Expected a report")
+		}
+		if report.ThreatName != "Ransom_Note" || report.Severity != "critical" || report.Rules[0].Priority != 100 {
+			t.Errorf("Expected the JSON report to win, got %+v", report)
+		}
+		if report.Hashes["md5"] != "aaaa" || report.Hashes["sha1"] != "bbbb" || report.Metadata["top_rule"] != "Ransom_Note" {
+			t.Errorf("Expected merged hashes and metadata, got %+v", report)
+		}
+	})
+
+	t.Run("unrelated json body", func(t *testing.T) {
+		response := &IcapResponse{
+			StatusCode:   200,
+			HttpResponse: &HttpResponse{StatusCode: 200, Headers: map[string]string{"Content-Type": "application/json"}, Body: []byte(`{"user":"alice"}`)},
+		}
+		if report := response.ThreatReport(); report != nil {
+			t.Errorf("Expected no report, got %+v", report)
+		}
+	})
+}
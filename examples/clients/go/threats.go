@@ -0,0 +1,191 @@
+package icapclient
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ThreatType is the Type of an X-Infection-Found header
+type ThreatType int
+
+const (
+	ThreatVirus      ThreatType = 0
+	ThreatMailPolicy ThreatType = 1
+	ThreatContainer  ThreatType = 2
+)
+
+// String returns the name of the threat type
+func (t ThreatType) String() string {
+	switch t {
+	case ThreatVirus:
+		return "virus"
+	case ThreatMailPolicy:
+		return "mail-policy"
+	case ThreatContainer:
+		return "container"
+	default:
+		return fmt.Sprintf("type-%d", int(t))
+	}
+}
+
+// Resolution is what the ICAP server did about a threat
+type Resolution int
+
+const (
+	ResolutionNotRepaired Resolution = 0
+	ResolutionRepaired    Resolution = 1
+	ResolutionBlocked     Resolution = 2
+)
+
+// String returns the name of the resolution
+func (r Resolution) String() string {
+	switch r {
+	case ResolutionNotRepaired:
+		return "not-repaired"
+	case ResolutionRepaired:
+		return "repaired"
+	case ResolutionBlocked:
+		return "blocked"
+	default:
+		return fmt.Sprintf("resolution-%d", int(r))
+	}
+}
+
+// Infection is a parsed X-Infection-Found header, e.g.
+// "Type=0; Resolution=2; Threat=EICAR-Test-File;"
+type Infection struct {
+	Type       ThreatType `yaml:"type" json:"type"`
+	Resolution Resolution `yaml:"resolution" json:"resolution"`
+	Threat     string     `yaml:"threat" json:"threat"`
+}
+
+// Violation is one entry of an X-Violations-Found header
+type Violation struct {
+	Filename   string     `yaml:"filename" json:"filename"`
+	Threat     string     `yaml:"threat" json:"threat"`
+	ProblemID  int        `yaml:"problem_id" json:"problem_id"`
+	Resolution Resolution `yaml:"resolution" json:"resolution"`
+}
+
+// ParseInfectionFound parses an X-Infection-Found header value
+func ParseInfectionFound(value string) (*Infection, error) {
+	infection := &Infection{}
+	seen := false
+	for _, field := range strings.Split(value, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed X-Infection-Found field %q", field)
+		}
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+
+		switch strings.ToLower(key) {
+		case "type":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid X-Infection-Found type %q", val)
+			}
+			infection.Type = ThreatType(n)
+		case "resolution":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid X-Infection-Found resolution %q", val)
+			}
+			infection.Resolution = Resolution(n)
+		case "threat":
+			infection.Threat = val
+			seen = true
+		}
+	}
+	if !seen {
+		return nil, fmt.Errorf("X-Infection-Found without Threat")
+	}
+	return infection, nil
+}
+
+// ParseViolationsFound parses the lines of an X-Violations-Found header: a
+// count followed by four lines per violation, the filename, threat name,
+// problem ID and resolution. A single folded line is split on whitespace
+// instead, which only works for names without spaces.
+func ParseViolationsFound(lines []string) ([]Violation, error) {
+	if len(lines) == 1 {
+		lines = strings.Fields(lines[0])
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("empty X-Violations-Found")
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid X-Violations-Found count %q", lines[0])
+	}
+	if len(lines)-1 != count*4 {
+		return nil, fmt.Errorf("X-Violations-Found has %d lines for %d violations", len(lines)-1, count)
+	}
+
+	violations := make([]Violation, count)
+	for i := range violations {
+		entry := lines[1+i*4 : 5+i*4]
+		problemID, err := strconv.Atoi(strings.TrimSpace(entry[2]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-Violations-Found problem ID %q", entry[2])
+		}
+		resolution, err := strconv.Atoi(strings.TrimSpace(entry[3]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-Violations-Found resolution %q", entry[3])
+		}
+		violations[i] = Violation{
+			Filename:   strings.TrimSpace(entry[0]),
+			Threat:     strings.TrimSpace(entry[1]),
+			ProblemID:  problemID,
+			Resolution: Resolution(resolution),
+		}
+	}
+	return violations, nil
+}
+
+// headerLines returns the value of header name in a '\n'-separated header
+// block as its first line followed by its continuation lines
+func headerLines(block, name string) []string {
+	var lines []string
+	for block != "" {
+		var line string
+		line, block, _ = strings.Cut(block, "\n")
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if lines != nil {
+				lines = append(lines, strings.TrimSpace(line))
+			}
+			continue
+		}
+		if lines != nil {
+			break
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(key, name) {
+			lines = []string{strings.TrimSpace(value)}
+		}
+	}
+	return lines
+}
+
+// parseThreatHeaders fills the Infection and Violations of response from its
+// header block. Malformed vendor headers are left to the raw Headers rather
+// than failing the response.
+func parseThreatHeaders(response *IcapResponse, block string) {
+	if value := headerValue(response.Headers, "X-Infection-Found"); value != "" {
+		if infection, err := ParseInfectionFound(value); err == nil {
+			response.Infection = infection
+		}
+	}
+	if headerValue(response.Headers, "X-Violations-Found") != "" {
+		if violations, err := ParseViolationsFound(headerLines(block, "X-Violations-Found")); err == nil {
+			response.Violations = violations
+		}
+	}
+}
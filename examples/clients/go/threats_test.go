@@ -0,0 +1,108 @@
+package icapclient
+
+import (
+	"testing"
+)
+
+// TestParseInfectionFound tests parsing X-Infection-Found values
+func TestParseInfectionFound(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected *Infection
+	}{
+		{"Virus blocked", "Type=0; Resolution=2; Threat=EICAR-Test-File;", &Infection{ThreatVirus, ResolutionBlocked, "EICAR-Test-File"}},
+		{"Without trailing semicolon", "Type=2; Resolution=1; Threat=Zip Bomb", &Infection{ThreatContainer, ResolutionRepaired, "Zip Bomb"}},
+		{"Lowercase keys", "type=1;resolution=0;threat=Attachment", &Infection{ThreatMailPolicy, ResolutionNotRepaired, "Attachment"}},
+		{"Missing threat", "Type=0; Resolution=2;", nil},
+		{"Bad type", "Type=x; Resolution=2; Threat=X;", nil},
+		{"Field without value", "Type; Threat=X;", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			infection, err := ParseInfectionFound(tt.value)
+			if tt.expected == nil {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", infection)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if *infection != *tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, infection)
+			}
+		})
+	}
+}
+
+// TestParseViolationsFound tests parsing X-Violations-Found lines
+func TestParseViolationsFound(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		expected []Violation
+		wantErr  bool
+	}{
+		{
+			name:     "Multi-line",
+			lines:    []string{"1", "my file.exe", "Win.Trojan", "42", "2"},
+			expected: []Violation{{"my file.exe", "Win.Trojan", 42, ResolutionBlocked}},
+		},
+		{
+			name:     "Folded single line",
+			lines:    []string{"2 a.exe Trojan 1 2 b.doc Macro 2 0"},
+			expected: []Violation{{"a.exe", "Trojan", 1, ResolutionBlocked}, {"b.doc", "Macro", 2, ResolutionNotRepaired}},
+		},
+		{name: "No violations", lines: []string{"0"}, expected: []Violation{}},
+		{name: "Empty", lines: nil, wantErr: true},
+		{name: "Bad count", lines: []string{"two"}, wantErr: true},
+		{name: "Missing lines", lines: []string{"1", "a.exe", "Trojan"}, wantErr: true},
+		{name: "Bad problem ID", lines: []string{"1", "a.exe", "Trojan", "x", "2"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := ParseViolationsFound(tt.lines)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", violations)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(violations) != len(tt.expected) {
+				t.Fatalf("Expected %d violations, got %+v", len(tt.expected), violations)
+			}
+			for i := range violations {
+				if violations[i] != tt.expected[i] {
+					t.Errorf("Expected %+v, got %+v", tt.expected[i], violations[i])
+				}
+			}
+		})
+	}
+}
+
+// TestResponseParser_MalformedThreatHeaders tests that malformed vendor
+// headers do not fail the response
+func TestResponseParser_MalformedThreatHeaders(t *testing.T) {
+	wire := "ICAP/1.0 204 No Content\r\n" +
+		"X-Infection-Found: garbage\r\n" +
+		"X-Violations-Found: 3\r\n" +
+		"Encapsulated: null-body=0\r\n\r\n"
+
+	response, err := parseTestResponse(wire, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if response.Infection != nil || response.Violations != nil {
+		t.Errorf("Expected no parsed threats, got %+v %+v", response.Infection, response.Violations)
+	}
+	if response.Headers["X-Infection-Found"] != "garbage" {
+		t.Errorf("Expected raw header to be kept, got %q", response.Headers["X-Infection-Found"])
+	}
+}
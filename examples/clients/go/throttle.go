@@ -0,0 +1,161 @@
+package icapclient
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most written at once when a transfer is throttled,
+// so that the bytes go out at an even pace rather than in bursts
+const throttleChunk = 16 << 10
+
+// ThrottleConfig limits the rate at which requests are sent, in bytes per
+// second, so that bulk scans on a shared link leave room for other traffic.
+// Zero means unlimited. Bodies make up nearly all the bytes throttled.
+type ThrottleConfig struct {
+	// PerTransfer limits each request, unless its RequestOptions set
+	// BandwidthLimit
+	PerTransfer int64 `yaml:"per_transfer" json:"per_transfer"`
+	// Global limits the requests of the client together
+	Global int64 `yaml:"global" json:"global"`
+}
+
+// tokenBucket limits a byte rate, allowing bursts of up to one second of
+// bytes. Takes beyond the available tokens put the bucket in debt, which
+// the caller sleeps off.
+type tokenBucket struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket for rate bytes per second, unlimited
+// if zero
+func newTokenBucket(rate int64) *tokenBucket {
+	b := &tokenBucket{now: time.Now}
+	b.setRate(rate)
+	return b
+}
+
+// setRate changes the rate of b, keeping its tokens up to the new burst.
+// A bucket that was unlimited starts full.
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.rate <= 0 {
+		b.tokens = float64(rate)
+	}
+	b.rate = float64(max(rate, 0))
+	b.tokens = min(b.tokens, b.rate)
+}
+
+// limited reports whether b has a rate
+func (b *tokenBucket) limited() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate > 0
+}
+
+// take takes n tokens and returns how long to wait before sending them
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refill adds the tokens accrued since the last call, guarded by mu
+func (b *tokenBucket) refill() {
+	now := b.now()
+	if !b.last.IsZero() && b.rate > 0 {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	}
+	b.last = now
+}
+
+// throttledWriter writes to w no faster than every one of its buckets
+// allows, failing once ctx is done or a wait would pass deadline
+type throttledWriter struct {
+	w        io.Writer
+	ctx      context.Context
+	deadline time.Time
+	buckets  []*tokenBucket
+	metrics  *ClientMetrics
+}
+
+// Write implements io.Writer
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		var delay time.Duration
+		for _, bucket := range tw.buckets {
+			delay = max(delay, bucket.take(len(chunk)))
+		}
+		if delay > 0 {
+			if !tw.deadline.IsZero() && time.Now().Add(delay).After(tw.deadline) {
+				return written, os.ErrDeadlineExceeded
+			}
+			if err := sleepContext(tw.ctx, delay); err != nil {
+				return written, err
+			}
+			if tw.metrics != nil {
+				tw.metrics.ThrottleWait.Add(delay.Seconds())
+			}
+		}
+
+		n, err := tw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// setThrottle applies the bandwidth limits of config
+func (t *icapTransport) setThrottle(config *IcapConfig) {
+	t.perTransfer.Store(config.Throttle.PerTransfer)
+	t.globalThrottle.setRate(config.Throttle.Global)
+}
+
+// throttle returns the writer of pc limited to the bandwidth allowed for
+// the request of ctx, or nil if it is unlimited
+func (t *icapTransport) throttle(ctx context.Context, pc *persistConn) io.Writer {
+	rate := t.perTransfer.Load()
+	if limit := requestOptionsFrom(ctx).BandwidthLimit; limit != 0 {
+		rate = limit
+	}
+
+	var buckets []*tokenBucket
+	if rate > 0 {
+		buckets = append(buckets, newTokenBucket(rate))
+	}
+	if t.globalThrottle.limited() {
+		buckets = append(buckets, t.globalThrottle)
+	}
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	deadline, _ := t.deadline(ctx)
+	return &throttledWriter{w: pc.conn, ctx: ctx, deadline: deadline, buckets: buckets, metrics: t.metrics}
+}
@@ -0,0 +1,130 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestTokenBucket tests bursts, debt and rate changes of the token bucket
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	bucket := &tokenBucket{now: func() time.Time { return now }}
+	bucket.setRate(1000)
+
+	if delay := bucket.take(1000); delay != 0 {
+		t.Errorf("Expected the burst to pass, got a %s delay", delay)
+	}
+	if delay := bucket.take(500); delay != 500*time.Millisecond {
+		t.Errorf("Expected a 500ms delay, got %s", delay)
+	}
+	now = now.Add(time.Second)
+	if delay := bucket.take(500); delay != 0 {
+		t.Errorf("Expected the debt to be paid off, got a %s delay", delay)
+	}
+	now = now.Add(time.Hour)
+	if delay := bucket.take(1500); delay != 500*time.Millisecond {
+		t.Errorf("Expected tokens capped at one second, got a %s delay", delay)
+	}
+
+	bucket.setRate(0)
+	if bucket.limited() {
+		t.Errorf("Expected a zero rate to be unlimited")
+	}
+	if delay := bucket.take(1 << 20); delay != 0 {
+		t.Errorf("Expected no delay without a rate, got %s", delay)
+	}
+	bucket.setRate(1000)
+	if delay := bucket.take(1000); delay != 0 {
+		t.Errorf("Expected a bucket limited again to start full, got a %s delay", delay)
+	}
+}
+
+// TestIcapClient_Throttle tests the per-transfer and global bandwidth
+// limits, and overriding them per request
+func TestIcapClient_Throttle(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	body := bytes.Repeat([]byte("x"), 15000)
+	send := func(client *IcapClient, ctx context.Context) error {
+		_, err := client.Reqmod(ctx, &HttpRequest{Method: "POST", URI: "/", Version: "HTTP/1.1", Body: body})
+		return err
+	}
+
+	t.Run("per transfer", func(t *testing.T) {
+		client := newTestServerClient(server, false)
+		defer client.Close()
+		client.config.Load().Throttle.PerTransfer = 10000
+		client.transport.setThrottle(client.config.Load())
+
+		start := time.Now()
+		if err := send(client, context.Background()); err != nil {
+			t.Fatalf("REQMOD failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Errorf("Expected the body to take about 500ms, took %s", elapsed)
+		}
+
+		start = time.Now()
+		ctx := WithRequestOptions(context.Background(), RequestOptions{BandwidthLimit: -1})
+		if err := send(client, ctx); err != nil {
+			t.Fatalf("REQMOD failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+			t.Errorf("Expected an unthrottled request, took %s", elapsed)
+		}
+	})
+
+	t.Run("global", func(t *testing.T) {
+		client := newTestServerClient(server, false)
+		defer client.Close()
+		next := *client.config.Load()
+		next.Throttle.Global = 20000
+		if reloaded, _ := client.Reload(&next); len(reloaded) != 1 || reloaded[0] != "throttle" {
+			t.Fatalf("Expected throttle to be reloaded, got %v", reloaded)
+		}
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := send(client, context.Background()); err != nil {
+					t.Errorf("REQMOD failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > time.Second {
+			t.Errorf("Expected the bodies to share 20000 bytes/s, took %s", elapsed)
+		}
+	})
+
+	t.Run("past deadline", func(t *testing.T) {
+		client := newTestServerClient(server, false)
+		defer client.Close()
+		client.config.Load().Throttle.PerTransfer = 1000
+		client.transport.setThrottle(client.config.Load())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		start := time.Now()
+		err := send(client, ctx)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Expected a deadline error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Expected to fail without waiting, took %s", elapsed)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package icapclient
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptrace"
+)
+
+// Timings is the time spent in each stage of a request, for the attempt
+// that produced the response. Stages skipped on a reused connection are
+// zero.
+type Timings struct {
+	// DNS is the lookup of the server address by the DNS cache, zero when
+	// the dialer resolves it itself as part of Connect
+	DNS time.Duration `yaml:"dns" json:"dns"`
+	// Connect is the TCP connect, to the proxy if any
+	Connect time.Duration `yaml:"connect" json:"connect"`
+	// TLS is the ICAPS handshake
+	TLS time.Duration `yaml:"tls" json:"tls"`
+	// Write is sending the request and its body, or its preview
+	Write time.Duration `yaml:"write" json:"write"`
+	// TTFB is the wait for the first response byte once the request is sent
+	TTFB time.Duration `yaml:"ttfb" json:"ttfb"`
+	// Total is the whole request, across attempts and retry delays
+	Total time.Duration `yaml:"total" json:"total"`
+	// Attempts counts the attempts made, 1 without retries
+	Attempts int `yaml:"attempts" json:"attempts"`
+	// ConnReused reports whether the attempt reused a pooled connection
+	ConnReused bool `yaml:"conn_reused" json:"conn_reused"`
+}
+
+// clientTrace returns the trace recording the stages of an attempt into t.
+// Stages are reset whenever the attempt gets another connection.
+func (t *Timings) clientTrace() *icaptrace.ClientTrace {
+	var dnsStart, connectStart, tlsStart, writeStart, sent time.Time
+	return &icaptrace.ClientTrace{
+		GetConn: func(string) {
+			t.DNS, t.Connect, t.TLS, t.Write, t.TTFB = 0, 0, 0, 0, 0
+		},
+		DNSStart: func(icaptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(icaptrace.DNSDoneInfo) {
+			t.DNS = time.Since(dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.Connect += time.Since(connectStart)
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.TLS = time.Since(tlsStart)
+		},
+		GotConn: func(info icaptrace.GotConnInfo) {
+			t.ConnReused = info.Reused
+			writeStart = time.Now()
+		},
+		WroteRequest: func(icaptrace.WroteRequestInfo) {
+			sent = time.Now()
+			t.Write = sent.Sub(writeStart)
+		},
+		GotFirstResponseByte: func() {
+			t.TTFB = time.Since(sent)
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package icapclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestIcapClient_Timings tests breaking down the time of requests on new
+// and reused connections
+func TestIcapClient_Timings(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	request := &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}
+	response, err := client.Reqmod(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	timings := response.Timings
+	if timings == nil {
+		t.Fatal("Expected timings")
+	}
+	if timings.ConnReused || timings.Connect <= 0 || timings.TLS != 0 || timings.Attempts != 1 {
+		t.Errorf("Unexpected timings on a new connection: %+v", timings)
+	}
+	if timings.TTFB < 20*time.Millisecond || timings.Total < timings.TTFB+timings.Write {
+		t.Errorf("Expected TTFB covering the server delay within the total, got %+v", timings)
+	}
+
+	response, err = client.Reqmod(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if timings := response.Timings; !timings.ConnReused || timings.Connect != 0 || timings.TTFB < 20*time.Millisecond {
+		t.Errorf("Unexpected timings on a reused connection: %+v", timings)
+	}
+}
+
+// TestIcapClient_TimingsTLS tests timing the ICAPS handshake
+func TestIcapClient_TimingsTLS(t *testing.T) {
+	server := icaptest.NewTLSServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	digest := sha256.Sum256(server.Certificate().Raw)
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host:         host,
+		Port:         port,
+		Timeout:      5 * time.Second,
+		LoggingLevel: "ERROR",
+		TLS:          TLSConfig{Enabled: true, PinnedSHA256: []string{hex.EncodeToString(digest[:])}},
+	})
+	defer client.Close()
+
+	response, err := client.Options(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if timings := response.Timings; timings.TLS <= 0 || timings.Connect <= 0 {
+		t.Errorf("Expected connect and TLS timings, got %+v", timings)
+	}
+}
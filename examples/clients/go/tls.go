@@ -0,0 +1,284 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptrace"
+)
+
+// TLSConfig represents TLS settings for ICAPS connections
+type TLSConfig struct {
+	Enabled      bool     `yaml:"enabled" json:"enabled"`
+	PinnedSHA256 []string `yaml:"pinned_sha256" json:"pinned_sha256"`
+	MinVersion   string   `yaml:"min_version" json:"min_version"`
+	MaxVersion   string   `yaml:"max_version" json:"max_version"`
+	CipherSuites []string `yaml:"cipher_suites" json:"cipher_suites"`
+	ServerName   string   `yaml:"server_name" json:"server_name"`
+
+	// SessionCacheSize is the number of sessions kept for resumption; zero
+	// uses defaultSessionCacheSize and a negative value disables resumption
+	SessionCacheSize int `yaml:"session_cache_size" json:"session_cache_size"`
+	// SessionCache replaces the built-in cache, e.g. to share it between clients
+	SessionCache tls.ClientSessionCache `yaml:"-" json:"-"`
+
+	// KeyLogFile receives TLS session keys in NSS key log format for
+	// debugging with Wireshark; SSLKEYLOGFILE is used when unset
+	KeyLogFile string `yaml:"key_log_file" json:"key_log_file"`
+
+	// OCSPStapling is "off" (default), "verify" to reject invalid or revoked
+	// staples, or "strict" to additionally require a good staple
+	OCSPStapling string `yaml:"ocsp_stapling" json:"ocsp_stapling"`
+}
+
+// defaultSessionCacheSize is the default TLS session cache capacity
+const defaultSessionCacheSize = 64
+
+// tlsVersions maps configured TLS version names to protocol versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// buildTLSConfig builds the tls.Config used for ICAPS connections. Invalid
+// settings make every handshake fail rather than silently weakening TLS.
+func buildTLSConfig(config *IcapConfig) *tls.Config {
+	// An explicit server name is used for SNI and certificate verification
+	// instead of the dial host, e.g. when connecting by IP or via a load balancer
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !config.VerifySSL,
+		ServerName:         config.TLS.ServerName,
+		ClientSessionCache: buildSessionCache(&config.TLS),
+	}
+
+	if err := applyTLSProtocolSettings(tlsConfig, &config.TLS); err != nil {
+		tlsConfig.VerifyConnection = func(tls.ConnectionState) error {
+			return &IcapError{Message: "Invalid TLS configuration", Err: err}
+		}
+		return tlsConfig
+	}
+
+	ocspMode, err := parseOCSPMode(config.TLS.OCSPStapling)
+	if err != nil {
+		tlsConfig.VerifyConnection = func(tls.ConnectionState) error {
+			return &IcapError{Message: "Invalid TLS configuration", Err: err}
+		}
+		return tlsConfig
+	}
+
+	pins := config.TLS.PinnedSHA256
+	if len(pins) > 0 || ocspMode != ocspOff {
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(pins) > 0 {
+				if err := verifyPinnedSHA256(state, pins, config.VerifySSL); err != nil {
+					return err
+				}
+			}
+			if ocspMode != ocspOff {
+				return verifyOCSPStaple(state, ocspMode == ocspStrict)
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig
+}
+
+// openKeyLogFile opens the TLS key log file for appending, or returns nil if
+// key logging is not enabled
+func openKeyLogFile(config *TLSConfig) (*os.File, error) {
+	path := config.KeyLogFile
+	if path == "" {
+		path = os.Getenv("SSLKEYLOGFILE")
+	}
+	if path == "" {
+		return nil, nil
+	}
+
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+}
+
+// buildSessionCache returns the session cache shared by all pooled connections
+func buildSessionCache(config *TLSConfig) tls.ClientSessionCache {
+	if config.SessionCache != nil {
+		return config.SessionCache
+	}
+
+	switch {
+	case config.SessionCacheSize < 0:
+		return nil
+	case config.SessionCacheSize == 0:
+		return tls.NewLRUClientSessionCache(defaultSessionCacheSize)
+	default:
+		return tls.NewLRUClientSessionCache(config.SessionCacheSize)
+	}
+}
+
+// newTLSDialer returns a DialTLSContext function that performs the ICAPS
+// handshake itself so session resumption can be recorded in metrics
+func newTLSDialer(dial dialFunc, tlsConfig *tls.Config, metrics *ClientMetrics) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			config.ServerName = host
+		}
+
+		tlsConn := tls.Client(conn, config)
+		trace := icaptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		start := time.Now()
+		err = tlsConn.HandshakeContext(ctx)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if metrics != nil {
+			metrics.TLSHandshakeDuration.Observe(time.Since(start).Seconds())
+			metrics.TLSHandshakes.Inc()
+			if tlsConn.ConnectionState().DidResume {
+				metrics.TLSResumed.Inc()
+			}
+		}
+
+		return tlsConn, nil
+	}
+}
+
+// applyTLSProtocolSettings applies the configured version range and cipher suites
+func applyTLSProtocolSettings(tlsConfig *tls.Config, config *TLSConfig) error {
+	var err error
+	if tlsConfig.MinVersion, err = parseTLSVersion(config.MinVersion); err != nil {
+		return fmt.Errorf("tls.min_version: %w", err)
+	}
+	if tlsConfig.MaxVersion, err = parseTLSVersion(config.MaxVersion); err != nil {
+		return fmt.Errorf("tls.max_version: %w", err)
+	}
+	if tlsConfig.MinVersion != 0 && tlsConfig.MaxVersion != 0 && tlsConfig.MinVersion > tlsConfig.MaxVersion {
+		return fmt.Errorf("tls.min_version %s is above tls.max_version %s", config.MinVersion, config.MaxVersion)
+	}
+	if tlsConfig.CipherSuites, err = parseCipherSuites(config.CipherSuites); err != nil {
+		return fmt.Errorf("tls.cipher_suites: %w", err)
+	}
+	return nil
+}
+
+// parseTLSVersion parses a TLS version such as "1.2" or "TLS1.3"; empty means the Go default
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(version)), "TLS")
+	name = strings.TrimLeft(name, "V_ ")
+	if v, ok := tlsVersions[name]; ok {
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// parseCipherSuites resolves cipher suite names (as in crypto/tls) to IDs.
+// TLS 1.3 suites are not configurable in Go and are ignored by crypto/tls.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// decodePin decodes a SHA-256 pin given as hex (optionally colon separated)
+// or base64, with an optional "sha256/" prefix
+func decodePin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+
+	if digest, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err == nil && len(digest) == sha256.Size {
+		return digest, nil
+	}
+	if digest, err := base64.StdEncoding.DecodeString(pin); err == nil && len(digest) == sha256.Size {
+		return digest, nil
+	}
+
+	return nil, fmt.Errorf("invalid SHA-256 pin %q", pin)
+}
+
+// verifyPinnedSHA256 checks that a certificate of the server matches one of
+// the pins, either by the hash of the whole certificate or of its
+// SubjectPublicKeyInfo. When the chain was verified, any certificate of the
+// verified chains may match, so that an intermediate or root can be pinned.
+// Otherwise the presented chain is unauthenticated and only the leaf may.
+func verifyPinnedSHA256(state tls.ConnectionState, pins []string, verified bool) error {
+	digests := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		digest, err := decodePin(pin)
+		if err != nil {
+			return &IcapError{Message: "TLS pinning failed", Err: err}
+		}
+		digests = append(digests, digest)
+	}
+
+	var certs []*x509.Certificate
+	if verified {
+		for _, chain := range state.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	} else if len(state.PeerCertificates) > 0 {
+		certs = state.PeerCertificates[:1]
+	}
+
+	for _, cert := range certs {
+		certDigest := sha256.Sum256(cert.Raw)
+		spkiDigest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, digest := range digests {
+			if bytes.Equal(digest, certDigest[:]) || bytes.Equal(digest, spkiDigest[:]) {
+				return nil
+			}
+		}
+	}
+
+	return &IcapError{Message: "TLS pinning failed: no server certificate matches pinned_sha256"}
+}
@@ -0,0 +1,308 @@
+package icapclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestVerifyPinnedSHA256 tests certificate and SPKI pinning
+func TestVerifyPinnedSHA256(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	cert := server.Certificate()
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	certDigest := sha256.Sum256(cert.Raw)
+	spkiDigest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	otherDigest := sha256.Sum256([]byte("other"))
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{"Certificate hex pin", []string{hex.EncodeToString(certDigest[:])}, false},
+		{"SPKI base64 pin", []string{"sha256/" + base64.StdEncoding.EncodeToString(spkiDigest[:])}, false},
+		{"Second pin matches", []string{hex.EncodeToString(otherDigest[:]), hex.EncodeToString(spkiDigest[:])}, false},
+		{"Mismatched pin", []string{hex.EncodeToString(otherDigest[:])}, true},
+		{"Invalid pin", []string{"not-a-pin"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPinnedSHA256(state, tt.pins, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestVerifyPinnedSHA256_Chain tests that a pinned CA only matches chains
+// that were verified, and that an unverified chain only pins its leaf
+func TestVerifyPinnedSHA256_Chain(t *testing.T) {
+	leaf, ca, _ := newOCSPTestChain(t)
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	unrelated := server.Certificate()
+
+	caDigest := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	leafDigest := sha256.Sum256(leaf.Raw)
+	caPin := []string{hex.EncodeToString(caDigest[:])}
+	leafPin := []string{hex.EncodeToString(leafDigest[:])}
+
+	tests := []struct {
+		name     string
+		state    tls.ConnectionState
+		pins     []string
+		verified bool
+		wantErr  bool
+	}{
+		{
+			"Verified chain through pinned CA",
+			tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}, VerifiedChains: [][]*x509.Certificate{{leaf, ca}}},
+			caPin, true, false,
+		},
+		{
+			"Unrelated leaf with pinned CA appended",
+			tls.ConnectionState{PeerCertificates: []*x509.Certificate{unrelated, ca}, VerifiedChains: [][]*x509.Certificate{{unrelated}}},
+			caPin, true, true,
+		},
+		{
+			"Unverified unrelated leaf with pinned CA appended",
+			tls.ConnectionState{PeerCertificates: []*x509.Certificate{unrelated, ca}},
+			caPin, false, true,
+		},
+		{
+			"Unverified pinned leaf",
+			tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}},
+			leafPin, false, false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPinnedSHA256(tt.state, tt.pins, tt.verified)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// A handshake without verification must not accept the appended CA
+	certificate := server.TLS.Certificates[0]
+	certificate.Certificate = append(certificate.Certificate[:1:1], ca.Raw)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{certificate}}).Handshake()
+		serverConn.Close()
+	}()
+	tlsConfig := buildTLSConfig(&IcapConfig{VerifySSL: false, TLS: TLSConfig{PinnedSHA256: caPin}})
+	if err := tls.Client(clientConn, tlsConfig).Handshake(); err == nil {
+		t.Error("Expected the handshake to fail on an unrelated leaf with the pinned CA appended")
+	}
+}
+
+// TestBuildTLSConfig tests TLS configuration building
+func TestBuildTLSConfig(t *testing.T) {
+	tlsConfig := buildTLSConfig(&IcapConfig{VerifySSL: true})
+	if tlsConfig.InsecureSkipVerify {
+		t.Error("Expected certificate verification to be enabled")
+	}
+	if tlsConfig.VerifyConnection != nil {
+		t.Error("Expected no pin verification without pins")
+	}
+
+	if tlsConfig.ServerName != "" {
+		t.Errorf("Expected server name to default to the dial host, got %s", tlsConfig.ServerName)
+	}
+
+	tlsConfig = buildTLSConfig(&IcapConfig{Host: "10.0.0.1", TLS: TLSConfig{ServerName: "icap.example.com"}})
+	if tlsConfig.ServerName != "icap.example.com" {
+		t.Errorf("Expected server name icap.example.com, got %s", tlsConfig.ServerName)
+	}
+
+	tlsConfig = buildTLSConfig(&IcapConfig{TLS: TLSConfig{PinnedSHA256: []string{"00"}}})
+	if tlsConfig.VerifyConnection == nil {
+		t.Error("Expected pin verification to be configured")
+	}
+}
+
+// TestParseTLSVersion tests TLS version parsing
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected uint16
+		wantErr  bool
+	}{
+		{"", 0, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"TLS1.3", tls.VersionTLS13, false},
+		{"tlsv1.1", tls.VersionTLS11, false},
+		{"SSL3", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			version, err := parseTLSVersion(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if version != tt.expected {
+				t.Errorf("Expected version %x, got %x", tt.expected, version)
+			}
+		})
+	}
+}
+
+// TestBuildTLSConfig_ProtocolSettings tests version range and cipher suite settings
+func TestBuildTLSConfig_ProtocolSettings(t *testing.T) {
+	tlsConfig := buildTLSConfig(&IcapConfig{TLS: TLSConfig{
+		MinVersion:   "1.2",
+		MaxVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "tls_ecdhe_ecdsa_with_aes_256_gcm_sha384"},
+	}})
+
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.2-1.3, got %x-%x", tlsConfig.MinVersion, tlsConfig.MaxVersion)
+	}
+
+	expectedSuites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if len(tlsConfig.CipherSuites) != len(expectedSuites) {
+		t.Fatalf("Expected %d cipher suites, got %d", len(expectedSuites), len(tlsConfig.CipherSuites))
+	}
+	for i, id := range expectedSuites {
+		if tlsConfig.CipherSuites[i] != id {
+			t.Errorf("Expected cipher suite %x at %d, got %x", id, i, tlsConfig.CipherSuites[i])
+		}
+	}
+
+	invalid := []TLSConfig{
+		{CipherSuites: []string{"TLS_NOT_A_SUITE"}},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{MaxVersion: "2.0"},
+	}
+	for _, config := range invalid {
+		tlsConfig := buildTLSConfig(&IcapConfig{TLS: config})
+		if tlsConfig.VerifyConnection == nil || tlsConfig.VerifyConnection(tls.ConnectionState{}) == nil {
+			t.Errorf("Expected handshake to fail for %+v", config)
+		}
+	}
+}
+
+// TestNewTLSDialer_SessionResumption tests that the shared session cache resumes sessions
+func TestNewTLSDialer_SessionResumption(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: server.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Write a byte so the client processes the session ticket
+			conn.Write([]byte{0})
+			conn.Close()
+		}
+	}()
+
+	metrics := &ClientMetrics{
+		TLSHandshakes: prometheus.NewCounter(prometheus.CounterOpts{Name: "handshakes"}),
+		TLSResumed:    prometheus.NewCounter(prometheus.CounterOpts{Name: "resumed"}),
+
+		TLSHandshakeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "handshake_duration"}),
+	}
+	tlsConfig := buildTLSConfig(&IcapConfig{VerifySSL: false})
+	dial := newTLSDialer((&net.Dialer{Timeout: time.Second}).DialContext, tlsConfig, metrics)
+
+	for i := 0; i < 2; i++ {
+		conn, err := dial(context.Background(), "tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial %d failed: %v", i, err)
+		}
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	if handshakes := testutil.ToFloat64(metrics.TLSHandshakes); handshakes != 2 {
+		t.Errorf("Expected 2 handshakes, got %v", handshakes)
+	}
+	if resumed := testutil.ToFloat64(metrics.TLSResumed); resumed != 1 {
+		t.Errorf("Expected 1 resumed handshake, got %v", resumed)
+	}
+	var metric dto.Metric
+	if err := metrics.TLSHandshakeDuration.Write(&metric); err != nil {
+		t.Fatalf("Failed to collect histogram: %v", err)
+	}
+	if observed := metric.GetHistogram().GetSampleCount(); observed != 2 {
+		t.Errorf("Expected 2 handshake durations, got %d", observed)
+	}
+}
+
+// TestBuildSessionCache tests session cache sizing
+func TestBuildSessionCache(t *testing.T) {
+	if buildSessionCache(&TLSConfig{}) == nil {
+		t.Error("Expected a default session cache")
+	}
+	if buildSessionCache(&TLSConfig{SessionCacheSize: -1}) != nil {
+		t.Error("Expected session cache to be disabled")
+	}
+
+	shared := tls.NewLRUClientSessionCache(1)
+	if buildSessionCache(&TLSConfig{SessionCache: shared}) != shared {
+		t.Error("Expected the provided session cache to be used")
+	}
+}
+
+// TestOpenKeyLogFile tests key log file selection
+func TestOpenKeyLogFile(t *testing.T) {
+	t.Setenv("SSLKEYLOGFILE", "")
+	keyLog, err := openKeyLogFile(&TLSConfig{})
+	if err != nil || keyLog != nil {
+		t.Fatalf("Expected key logging to be disabled, got %v, %v", keyLog, err)
+	}
+
+	envPath := filepath.Join(t.TempDir(), "env-keys.log")
+	t.Setenv("SSLKEYLOGFILE", envPath)
+	keyLog, err = openKeyLogFile(&TLSConfig{})
+	if err != nil {
+		t.Fatalf("Failed to open key log file: %v", err)
+	}
+	if keyLog.Name() != envPath {
+		t.Errorf("Expected key log file %s, got %s", envPath, keyLog.Name())
+	}
+	keyLog.Close()
+
+	configPath := filepath.Join(t.TempDir(), "keys.log")
+	keyLog, err = openKeyLogFile(&TLSConfig{KeyLogFile: configPath})
+	if err != nil {
+		t.Fatalf("Failed to open key log file: %v", err)
+	}
+	defer keyLog.Close()
+	if keyLog.Name() != configPath {
+		t.Errorf("Expected key log file %s, got %s", configPath, keyLog.Name())
+	}
+}
@@ -0,0 +1,79 @@
+package icapclient
+
+import (
+	"context"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name reported on ICAP spans
+const tracerName = "github.com/ByteDance/Arcus/g3icap/examples/clients/go"
+
+// traceIDHeader carries the trace ID so scans can be correlated with upstream traces
+const traceIDHeader = "X-Trace-Id"
+
+// newTracer returns the tracer for ICAP spans, falling back to the global provider
+func newTracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// startRequestSpan starts a client span for an ICAP request as a child of the
+// caller's span, and sets the X-Trace-Id header when the span is sampled or
+// the trace ID was propagated by the caller
+func (c *IcapClient) startRequestSpan(ctx context.Context, config *IcapConfig, method IcapMethod, icapURL string, headers map[string]string) (context.Context, trace.Span) {
+	service := icapURL
+	if u, err := url.Parse(icapURL); err == nil {
+		service = u.Path
+	}
+
+	ctx, span := c.tracer.Start(ctx, "ICAP "+string(method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("icap.method", string(method)),
+			attribute.String("icap.service", service),
+			attribute.String("icap.url", icapURL),
+			attribute.String("server.address", config.Host),
+			attribute.Int("server.port", config.Port),
+			attribute.String("icap.request_id", headers["X-Request-ID"]),
+		),
+	)
+
+	if spanContext := span.SpanContext(); spanContext.HasTraceID() {
+		headers[traceIDHeader] = spanContext.TraceID().String()
+	}
+
+	return ctx, span
+}
+
+// endRequestSpan records the outcome of an ICAP request and ends its span
+func endRequestSpan(span trace.Span, response *IcapResponse, attempts int, requestBytes int, responseBytes int, err error) {
+	span.SetAttributes(
+		attribute.Int("icap.retries", attempts-1),
+		attribute.Int("icap.request.body_size", requestBytes),
+		attribute.Int("icap.response.body_size", responseBytes),
+	)
+
+	if response != nil {
+		span.SetAttributes(attribute.Int("icap.status_code", response.StatusCode))
+		if istag, ok := response.Headers["ISTag"]; ok {
+			span.SetAttributes(attribute.String("icap.istag", istag))
+		}
+		if response.StatusCode >= 400 {
+			span.SetStatus(codes.Error, response.Reason)
+		}
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,130 @@
+package icapclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTracingTestClient creates a client that records spans
+func newTracingTestClient() (*IcapClient, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	client := NewIcapClient(&IcapConfig{
+		Host:           "127.0.0.1",
+		Port:           1344,
+		Timeout:        time.Second,
+		LoggingLevel:   "ERROR",
+		TracerProvider: provider,
+	})
+	return client, recorder
+}
+
+// TestIcapClient_startRequestSpan tests trace context propagation into the X-Trace-Id header
+func TestIcapClient_startRequestSpan(t *testing.T) {
+	client, recorder := newTracingTestClient()
+	defer client.Close()
+
+	ctx, parent := client.tracer.Start(context.Background(), "upstream")
+	headers := make(map[string]string)
+	_, span := client.startRequestSpan(ctx, client.config.Load(), REQMOD, client.buildICAPURL(client.config.Load(), REQMOD), headers)
+	endRequestSpan(span, &IcapResponse{StatusCode: 204, Headers: map[string]string{"ISTag": "\"abc\""}}, 2, 10, 0, nil)
+	parent.End()
+
+	traceID := parent.SpanContext().TraceID().String()
+	if headers[traceIDHeader] != traceID {
+		t.Errorf("Expected %s header %s, got %s", traceIDHeader, traceID, headers[traceIDHeader])
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	icapSpan := spans[0]
+	if icapSpan.Name() != "ICAP REQMOD" {
+		t.Errorf("Expected span name ICAP REQMOD, got %s", icapSpan.Name())
+	}
+	if icapSpan.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("Expected ICAP span to be a child of the caller span")
+	}
+
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range icapSpan.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	expected := map[attribute.Key]string{
+		"icap.method":             "REQMOD",
+		"icap.service":            "/reqmod",
+		"icap.status_code":        "204",
+		"icap.istag":              "\"abc\"",
+		"icap.retries":            "1",
+		"icap.request.body_size":  "10",
+		"icap.response.body_size": "0",
+	}
+	for key, value := range expected {
+		if attributes[key].Emit() != value {
+			t.Errorf("Expected attribute %s=%s, got %s", key, value, attributes[key].Emit())
+		}
+	}
+}
+
+// TestIcapClient_TraceIDOnWire tests that the X-Trace-Id header of a
+// request under a sampled span reaches the server
+func TestIcapClient_TraceIDOnWire(t *testing.T) {
+	traceIDs := make(chan string, 1)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		traceIDs <- r.Header.Get(traceIDHeader)
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host:           host,
+		Port:           port,
+		Timeout:        5 * time.Second,
+		LoggingLevel:   "ERROR",
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.AlwaysSample())),
+	})
+	defer client.Close()
+
+	ctx, parent := client.tracer.Start(context.Background(), "upstream")
+	defer parent.End()
+	if !parent.SpanContext().IsSampled() {
+		t.Fatal("Expected the parent span to be sampled")
+	}
+	request := &HttpRequest{Method: "GET", URI: "http://example.com/", Version: "HTTP/1.1", Headers: map[string]string{"Host": "example.com"}}
+	if _, err := client.Reqmod(ctx, request); err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+
+	if traceID := <-traceIDs; traceID != parent.SpanContext().TraceID().String() {
+		t.Errorf("Expected %s %s on the wire, got %q", traceIDHeader, parent.SpanContext().TraceID(), traceID)
+	}
+}
+
+// TestIcapClient_TracingOnError tests that failed requests produce error spans
+func TestIcapClient_TracingOnError(t *testing.T) {
+	client, recorder := newTracingTestClient()
+	defer client.Close()
+
+	if _, err := client.Options(context.Background()); err == nil {
+		t.Skip("OPTIONS request succeeded, no error span to check")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("Expected error status, got %v", spans[0].Status().Code)
+	}
+}
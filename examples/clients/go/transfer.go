@@ -0,0 +1,211 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// transferAction is how a body is sent under the Transfer-* rules of the
+// server
+type transferAction int
+
+const (
+	// transferComplete sends the whole body without a preview
+	transferComplete transferAction = iota
+	// transferPreview sends a preview, and the rest on 100 Continue
+	transferPreview
+	// transferIgnore skips the request, the server has no use for the body
+	transferIgnore
+)
+
+// TransferTypesConfig applies Transfer-Ignore and Transfer-Complete
+// semantics by content type on the client side, for servers that do not
+// advertise transfer rules. Media types are matched as in policy rules,
+// "image/*" matching any subtype, and take precedence over the rules of the
+// server; Ignore wins over Complete.
+type TransferTypesConfig struct {
+	// Ignore lists the content types whose bodies are not sent, the request
+	// reporting 204, e.g. "image/*" or "video/*"
+	Ignore []string `yaml:"ignore" json:"ignore"`
+	// Complete lists the content types whose bodies are sent whole, never
+	// previewed
+	Complete []string `yaml:"complete" json:"complete"`
+}
+
+// action returns how a body of the media type contentType is sent, and
+// false when neither list holds it
+func (c TransferTypesConfig) action(contentType string) (transferAction, bool) {
+	switch {
+	case matchesContentType(c.Ignore, contentType):
+		return transferIgnore, true
+	case matchesContentType(c.Complete, contentType):
+		return transferComplete, true
+	}
+	return transferComplete, false
+}
+
+// transferRules are the Preview, Transfer-Preview, Transfer-Ignore and
+// Transfer-Complete headers of an OPTIONS response. The lists hold
+// lower-case file extensions, "*" matching those in no other list.
+type transferRules struct {
+	preview     int64
+	hasPreview  bool
+	previewExt  []string
+	ignoreExt   []string
+	completeExt []string
+}
+
+// parseTransferRules parses the transfer rules of OPTIONS response headers
+func parseTransferRules(headers map[string]string) *transferRules {
+	rules := &transferRules{
+		previewExt:  transferList(headerValue(headers, "Transfer-Preview")),
+		ignoreExt:   transferList(headerValue(headers, "Transfer-Ignore")),
+		completeExt: transferList(headerValue(headers, "Transfer-Complete")),
+	}
+	if n, err := strconv.ParseInt(strings.TrimSpace(headerValue(headers, "Preview")), 10, 64); err == nil && n >= 0 {
+		rules.preview, rules.hasPreview = n, true
+	}
+	return rules
+}
+
+// transferList parses a comma-separated list of file extensions
+func transferList(value string) []string {
+	var exts []string
+	for _, ext := range strings.Split(value, ",") {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// action returns how a body with the file extension ext is sent. Listed
+// extensions take precedence over "*", Transfer-Ignore over
+// Transfer-Complete over Transfer-Preview. Bodies are previewed by default,
+// and sent complete when the server takes no preview.
+func (r *transferRules) action(ext string) transferAction {
+	action, ok := r.match(ext)
+	if !ok {
+		if action, ok = r.match("*"); !ok {
+			action = transferPreview
+		}
+	}
+	if action == transferPreview && !r.hasPreview {
+		return transferComplete
+	}
+	return action
+}
+
+// match returns the action of the list holding ext
+func (r *transferRules) match(ext string) (transferAction, bool) {
+	switch {
+	case ext == "":
+		return transferComplete, false
+	case slices.Contains(r.ignoreExt, ext):
+		return transferIgnore, true
+	case slices.Contains(r.completeExt, ext):
+		return transferComplete, true
+	case slices.Contains(r.previewExt, ext):
+		return transferPreview, true
+	}
+	return transferComplete, false
+}
+
+// transferExtension returns the lower-case file extension of the body of
+// httpData, from the filename of its Content-Disposition or the path of the
+// request URI
+func transferExtension(httpData interface{}) string {
+	if _, params, err := mime.ParseMediaType(headerValue(httpHeaders(httpData), "Content-Disposition")); err == nil && params["filename"] != "" {
+		return strings.ToLower(strings.TrimPrefix(path.Ext(params["filename"]), "."))
+	}
+	if request, ok := httpData.(*HttpRequest); ok {
+		if u, err := url.Parse(request.URI); err == nil {
+			return strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), "."))
+		}
+	}
+	return ""
+}
+
+// httpMediaType returns the lower-case media type of the Content-Type of
+// httpData, without parameters
+func httpMediaType(httpData interface{}) string {
+	contentType := headerValue(httpHeaders(httpData), "Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// transferAction decides how the body of httpData is sent: by its content
+// type under transfer_types, then, when transfer_rules is set, from the
+// rules of the server, sending an OPTIONS request to learn them the first
+// time. It returns the preview size for transferPreview.
+func (c *IcapClient) transferAction(ctx context.Context, config *IcapConfig, method IcapMethod, httpData interface{}) (transferAction, int64) {
+	if method != REQMOD && method != RESPMOD {
+		return transferComplete, 0
+	}
+	if len(httpBody(httpData)) == 0 && httpBodyReader(httpData) == nil {
+		return transferComplete, 0
+	}
+	if action, ok := config.TransferTypes.action(httpMediaType(httpData)); ok {
+		return action, 0
+	}
+	if !config.TransferRules {
+		return transferComplete, 0
+	}
+
+	rules := c.transferRules.Load()
+	if rules == nil {
+		if _, err := c.Options(ctx); err != nil {
+			c.logger.Warn("Failed to learn server transfer rules, sending complete body", "error", err)
+			return transferComplete, 0
+		}
+		if rules = c.transferRules.Load(); rules == nil {
+			return transferComplete, 0
+		}
+	}
+	return rules.action(transferExtension(httpData)), rules.preview
+}
+
+// recordTransferRules remembers the transfer rules of an OPTIONS response
+func (c *IcapClient) recordTransferRules(response *IcapResponse) {
+	if response.StatusCode == int(OK) {
+		c.transferRules.Store(parseTransferRules(response.Headers))
+	}
+}
+
+// previewStream returns httpData and stream set up to send a preview of
+// size bytes, moving a body held in memory to a stream
+func previewStream(httpData interface{}, stream *bodyStream, size int64) (interface{}, *bodyStream) {
+	if stream == nil {
+		body := httpBody(httpData)
+		reader := bytes.NewReader(body)
+		stream = &bodyStream{source: reader, size: int64(len(body)), trailer: httpTrailer(httpData)}
+		httpData = withBodyReader(httpData, reader)
+	}
+	stream.preview, stream.previewSize = true, size
+	return httpData, stream
+}
+
+// withBodyReader returns a copy of httpData sending its body from reader
+func withBodyReader(httpData interface{}, reader io.Reader) interface{} {
+	switch data := httpData.(type) {
+	case *HttpRequest:
+		request := *data
+		request.Body, request.BodyReader = nil, reader
+		return &request
+	case *HttpResponse:
+		response := *data
+		response.Body, response.BodyReader = nil, reader
+		return &response
+	}
+	return httpData
+}
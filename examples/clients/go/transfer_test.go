@@ -0,0 +1,219 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestTransferRules_action tests deciding how bodies are sent by extension
+func TestTransferRules_action(t *testing.T) {
+	rules := parseTransferRules(map[string]string{
+		"Preview":           "1024",
+		"Transfer-Preview":  "*",
+		"Transfer-Ignore":   "JPG, .png",
+		"Transfer-Complete": "exe,zip",
+	})
+	noPreview := parseTransferRules(map[string]string{"Transfer-Ignore": "jpg"})
+	completeByDefault := parseTransferRules(map[string]string{"Preview": "0", "Transfer-Complete": "*", "Transfer-Preview": "html"})
+
+	tests := []struct {
+		name     string
+		rules    *transferRules
+		ext      string
+		expected transferAction
+	}{
+		{"ignored", rules, "jpg", transferIgnore},
+		{"ignored with dot", rules, "png", transferIgnore},
+		{"complete", rules, "zip", transferComplete},
+		{"wildcard", rules, "txt", transferPreview},
+		{"no extension", rules, "", transferPreview},
+		{"no preview", noPreview, "txt", transferComplete},
+		{"ignored without preview", noPreview, "jpg", transferIgnore},
+		{"complete wildcard", completeByDefault, "txt", transferComplete},
+		{"listed preview", completeByDefault, "html", transferPreview},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if action := tt.rules.action(tt.ext); action != tt.expected {
+				t.Errorf("Expected action %d, got %d", tt.expected, action)
+			}
+		})
+	}
+	if rules.preview != 1024 || completeByDefault.preview != 0 || !completeByDefault.hasPreview {
+		t.Errorf("Expected preview sizes 1024 and 0, got %d and %d", rules.preview, completeByDefault.preview)
+	}
+}
+
+// TestTransferExtension tests finding the file extension of a body
+func TestTransferExtension(t *testing.T) {
+	tests := []struct {
+		name     string
+		httpData interface{}
+		expected string
+	}{
+		{"request path", &HttpRequest{URI: "http://example.com/files/Report.PDF?download=1"}, "pdf"},
+		{"content disposition", &HttpRequest{URI: "/upload", Headers: map[string]string{"content-disposition": `attachment; filename="setup.exe"`}}, "exe"},
+		{"response", &HttpResponse{Headers: map[string]string{"Content-Disposition": "inline; filename=photo.jpg"}}, "jpg"},
+		{"none", &HttpResponse{Headers: map[string]string{}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ext := transferExtension(tt.httpData); ext != tt.expected {
+				t.Errorf("Expected extension %q, got %q", tt.expected, ext)
+			}
+		})
+	}
+}
+
+// TestIcapClient_TransferRules tests previewing, skipping and sending
+// complete bodies by the rules of the OPTIONS response
+func TestIcapClient_TransferRules(t *testing.T) {
+	received := make(chan *icaptest.Request, 1)
+	server := icaptest.NewUnstartedServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Methods", "REQMOD")
+			w.Header().Set("Preview", "4")
+			w.Header().Set("Transfer-Preview", "*")
+			w.Header().Set("Transfer-Ignore", "jpg")
+			w.Header().Set("Transfer-Complete", "exe")
+			w.WriteHeader(200, nil, false)
+			return
+		}
+		received <- r
+		w.WriteHeader(204, nil, false)
+	}))
+	previews := make(chan string, 1)
+	server.ContinueAfterPreview = func(r *icaptest.Request) bool {
+		previews <- string(r.Preview)
+		return bytes.HasPrefix(r.Preview, []byte("scan"))
+	}
+	server.Start()
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	client.config.Load().TransferRules = true
+	defer client.Close()
+
+	tests := []struct {
+		name    string
+		uri     string
+		body    string
+		handled bool
+		preview string
+		ieof    bool
+	}{
+		{"ignored", "/photo.jpg", "jpeg data", false, "", false},
+		{"complete", "/setup.exe", "binary data", true, "", false},
+		{"preview and continue", "/notes.txt", "scan the whole body", true, "scan", false},
+		{"preview only", "/notes.txt", "skip the rest", false, "skip", false},
+		{"whole body in preview", "/a.txt", "abc", true, "abc", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := client.Reqmod(context.Background(), &HttpRequest{
+				Method: "POST", URI: tt.uri, Version: "HTTP/1.1", Headers: map[string]string{}, Body: []byte(tt.body),
+			})
+			if err != nil {
+				t.Fatalf("REQMOD failed: %v", err)
+			}
+			if response.StatusCode != 204 {
+				t.Errorf("Expected 204, got %d", response.StatusCode)
+			}
+
+			// The server asks for the rest of incomplete previews
+			if tt.preview != "" && !tt.ieof {
+				if preview := <-previews; preview != tt.preview {
+					t.Errorf("Expected preview %q, got %q", tt.preview, preview)
+				}
+			}
+			if !tt.handled {
+				select {
+				case r := <-received:
+					t.Errorf("Expected the request not to reach the handler, got %s", r.Method)
+				default:
+				}
+				return
+			}
+
+			r := <-received
+			if string(r.Preview) != tt.preview || r.PreviewIEOF != tt.ieof {
+				t.Errorf("Expected preview %q (ieof %v), got %q (ieof %v)", tt.preview, tt.ieof, r.Preview, r.PreviewIEOF)
+			}
+			if string(r.Body) != tt.body {
+				t.Errorf("Expected the whole body, got %q", r.Body)
+			}
+		})
+	}
+}
+
+// TestIcapClient_TransferTypes tests skipping and sending complete bodies
+// by content type, ahead of the rules of the server
+func TestIcapClient_TransferTypes(t *testing.T) {
+	received := make(chan *icaptest.Request, 1)
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Methods", "RESPMOD")
+			w.Header().Set("Preview", "4")
+			w.Header().Set("Transfer-Preview", "*")
+			w.WriteHeader(200, nil, false)
+			return
+		}
+		received <- r
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	client.config.Load().TransferRules = true
+	client.config.Load().TransferTypes = TransferTypesConfig{Ignore: []string{"image/*", "video/mp4"}, Complete: []string{"application/pdf"}}
+	defer client.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		handled     bool
+		preview     string
+	}{
+		{"ignored subtype", "image/png", false, ""},
+		{"ignored type", "Video/MP4; codecs=avc1", false, ""},
+		{"complete", "application/pdf", true, ""},
+		{"server rules", "text/plain", true, "scan"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := client.Respmod(context.Background(), &HttpResponse{
+				Version: "HTTP/1.1", StatusCode: 200, Reason: "OK",
+				Headers: map[string]string{"Content-Type": tt.contentType}, Body: []byte("scan this body"),
+			})
+			if err != nil {
+				t.Fatalf("RESPMOD failed: %v", err)
+			}
+			if response.StatusCode != 204 {
+				t.Errorf("Expected 204, got %d", response.StatusCode)
+			}
+
+			if !tt.handled {
+				select {
+				case r := <-received:
+					t.Errorf("Expected the request not to reach the handler, got %s", r.Method)
+				default:
+				}
+				return
+			}
+			r := <-received
+			if string(r.Preview) != tt.preview {
+				t.Errorf("Expected preview %q, got %q", tt.preview, r.Preview)
+			}
+			if string(r.Body) != "scan this body" {
+				t.Errorf("Expected the whole body, got %q", r.Body)
+			}
+		})
+	}
+}
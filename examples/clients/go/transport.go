@@ -0,0 +1,632 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptrace"
+)
+
+// defaultMaxIdleConns is the idle pool size when connection_pool_size is unset
+const defaultMaxIdleConns = 2
+
+// icapTransport sends ICAP requests over persistent TCP or TLS connections to
+// a single ICAP server, keeping idle connections for reuse
+type icapTransport struct {
+	addr string
+	dial dialFunc
+	// maxIdle is the idle pool size, poolSize clamped by the connection
+	// limit of conns, guarded by mu
+	maxIdle  int
+	poolSize int
+	conns    *connLimiter
+
+	// timeout bounds the reuse of idle connections, and attemptTimeout
+	// each exchange, time.Durations changed by config reloads
+	timeout        atomic.Int64
+	attemptTimeout atomic.Int64
+	// poolWaitTimeout bounds the wait for a connection at the limit
+	poolWaitTimeout atomic.Int64
+	// perTransfer is the bandwidth limit of each request and
+	// globalThrottle that of all of them, changed by config reloads
+	perTransfer    atomic.Int64
+	globalThrottle *tokenBucket
+
+	// backend fails dials at once while connects to the server fail
+	backend *backendState
+
+	maxRequests int
+	keepAlive   bool
+	faults      *faultInjector
+	metrics     *ClientMetrics
+
+	maxHeaderBytes int
+	maxHeaderCount int
+	spool          SpoolConfig
+
+	mu   sync.Mutex
+	idle []*persistConn
+
+	pingStop chan struct{}
+	pingDone chan struct{}
+}
+
+// persistConn is a connection to the ICAP server with its buffers
+type persistConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	bw     *bufio.Writer
+	parser *responseParser
+	idleAt time.Time
+	reused bool
+	// requests counts the exchanges completed on the connection
+	requests int
+	conns    *connLimiter
+	metrics  *ClientMetrics
+}
+
+// newIcapTransport creates the transport for config, dialing through the
+// configured proxy and with TLS when ICAPS is enabled
+func newIcapTransport(config *IcapConfig, tlsConfig *tls.Config, metrics *ClientMetrics, faults *faultInjector) *icapTransport {
+	// Connects are bounded by the timeout in dialConn, which follows
+	// config reloads
+	dialer := &net.Dialer{
+		KeepAlive: config.Timeout,
+	}
+	dialContext := dialFunc(dialer.DialContext)
+	if config.DialContext != nil {
+		dialContext = config.DialContext
+	}
+	dialContext = traceConnect(dialContext)
+
+	var resolver *dnsCache
+	if config.DNS.Enabled {
+		resolver = newDNSCache(config.DNS)
+	}
+
+	base, err := config.Proxy.wrapDial(resolver.wrapDial(dialContext))
+	if err != nil {
+		// Surface the misconfiguration on every request rather than
+		// silently connecting directly
+		base = func(context.Context, string, string) (net.Conn, error) { return nil, err }
+	}
+
+	dial := config.Hooks.wrapDial(base, false)
+	if config.TLS.Enabled {
+		dial = config.Hooks.wrapDial(newTLSDialer(base, tlsConfig, metrics), true)
+	}
+	dial = faults.wrapDial(dial)
+
+	maxIdle := config.ConnectionPoolSize
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConns
+	}
+
+	t := &icapTransport{
+		addr:        net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+		dial:        dial,
+		maxIdle:     maxIdle,
+		poolSize:    maxIdle,
+		conns:       newConnLimiter(),
+		backend:     newBackendState(),
+		maxRequests: config.MaxRequestsPerConn,
+		keepAlive:   config.KeepAlive,
+		faults:      faults,
+		metrics:     metrics,
+
+		maxHeaderBytes: config.MaxHeaderBytes,
+		maxHeaderCount: config.MaxHeaderCount,
+		spool:          config.Spool,
+
+		globalThrottle: newTokenBucket(config.Throttle.Global),
+	}
+	t.setTimeouts(config)
+	t.setThrottle(config)
+	return t
+}
+
+// traceConnect reports the connects made through dial to the ClientTrace
+// of their context
+func traceConnect(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		trace := icaptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.ConnectStart != nil {
+			trace.ConnectStart(network, addr)
+		}
+		conn, err := dial(ctx, network, addr)
+		if trace != nil && trace.ConnectDone != nil {
+			trace.ConnectDone(network, addr, err)
+		}
+		return conn, err
+	}
+}
+
+// setTimeouts sets the idle connection timeout, the exchange timeout and
+// the time connect failures are remembered of config, zero for none
+func (t *icapTransport) setTimeouts(config *IcapConfig) {
+	t.timeout.Store(int64(config.Timeout))
+	t.attemptTimeout.Store(int64(attemptTimeout(config)))
+	t.poolWaitTimeout.Store(int64(config.PoolWaitTimeout))
+	t.backend.setTTL(config.BackendDownTTL)
+}
+
+// getTimeout returns the idle connection timeout
+func (t *icapTransport) getTimeout() time.Duration {
+	return time.Duration(t.timeout.Load())
+}
+
+// getAttemptTimeout returns the exchange timeout
+func (t *icapTransport) getAttemptTimeout() time.Duration {
+	return time.Duration(t.attemptTimeout.Load())
+}
+
+// getPoolWaitTimeout returns the wait for a connection at the limit, zero
+// for the attempt timeout and negative for none
+func (t *icapTransport) getPoolWaitTimeout() time.Duration {
+	return time.Duration(t.poolWaitTimeout.Load())
+}
+
+// roundTrip writes an encoded ICAP request, followed by body as chunks when
+// it is streamed, and reads the response. After a preview the rest of the
+// body is sent if the server answers 100 Continue. A request that fails on a reused
+// connection before any response byte arrives is retried once on a new
+// connection, since the server may have closed it while it was idle.
+func (t *icapTransport) roundTrip(ctx context.Context, request []byte, body *bodyStream) (*IcapResponse, error) {
+	if response := t.faults.errorResponse(); response != nil {
+		return response, nil
+	}
+
+	trace := icaptrace.ContextClientTrace(ctx)
+	for {
+		if trace != nil && trace.GetConn != nil {
+			trace.GetConn(t.addr)
+		}
+		pc, err := t.getConn(ctx)
+		if err != nil {
+			return nil, &attemptError{ErrorClassConnect, fmt.Errorf("failed to connect to %s: %w", t.addr, err)}
+		}
+		if trace != nil && trace.GotConn != nil {
+			trace.GotConn(pc.gotConnInfo())
+		}
+
+		response, err := t.exchange(ctx, pc, request, body)
+		if err == nil {
+			switch {
+			case !t.keepAlive:
+				pc.close(closeReasonNoKeepAlive)
+			case strings.EqualFold(headerValue(response.Headers, "Connection"), "close"):
+				pc.close(closeReasonServer)
+			default:
+				t.putConn(pc)
+			}
+			return response, nil
+		}
+
+		pc.close(closeReasonError)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, &attemptError{errorClass(err), ctxErr}
+		}
+		if pc.reused && errors.Is(err, errStaleConn) {
+			continue
+		}
+		return nil, err
+	}
+}
+
+// attemptError is a failed attempt with the class of its failure, telling
+// how much of the request reached the server
+type attemptError struct {
+	class string
+	err   error
+}
+
+func (e *attemptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *attemptError) Unwrap() error {
+	return e.err
+}
+
+// errorClass returns the class of a failed attempt, ErrorClassResponse if
+// unknown
+func errorClass(err error) string {
+	var attemptErr *attemptError
+	if errors.As(err, &attemptErr) {
+		return attemptErr.class
+	}
+	return ErrorClassResponse
+}
+
+// errStaleConn reports a reused connection closed by the server before it
+// answered
+var errStaleConn = errors.New("connection closed before response")
+
+// exchange performs one request/response exchange on pc
+func (t *icapTransport) exchange(ctx context.Context, pc *persistConn, request []byte, body *bodyStream) (*IcapResponse, error) {
+	if deadline, ok := t.deadline(ctx); ok {
+		pc.conn.SetDeadline(deadline)
+	} else {
+		pc.conn.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() {
+		pc.conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+	if w := t.throttle(ctx, pc); w != nil {
+		pc.bw.Reset(w)
+		defer pc.bw.Reset(pc.conn)
+	}
+
+	trace := icaptrace.ContextClientTrace(ctx)
+	if err := t.writeRequest(pc, request, body, trace); err != nil {
+		if trace != nil && trace.WroteRequest != nil {
+			trace.WroteRequest(icaptrace.WroteRequestInfo{Err: err})
+		}
+		return nil, &attemptError{ErrorClassSend, t.staleError(pc, err)}
+	}
+	if trace != nil && trace.WroteRequest != nil {
+		trace.WroteRequest(icaptrace.WroteRequestInfo{})
+	}
+
+	if _, err := pc.br.Peek(1); err != nil {
+		return nil, &attemptError{ErrorClassResponse, t.staleError(pc, err)}
+	}
+	if trace != nil && trace.GotFirstResponseByte != nil {
+		trace.GotFirstResponseByte()
+	}
+
+	response, err := pc.parser.ReadResponse()
+	if err == nil && response.StatusCode == int(Continue) && body.previewIncomplete() {
+		// The server wants the rest of the body after the preview
+		if trace != nil && trace.Got100Continue != nil {
+			trace.Got100Continue()
+		}
+		if err := body.writeRest(pc.bw); err != nil {
+			return nil, &attemptError{ErrorClassSend, err}
+		}
+		response, err = pc.parser.ReadResponse()
+	}
+	if err != nil {
+		return nil, &attemptError{ErrorClassResponse, err}
+	}
+	pc.requests++
+	return response, nil
+}
+
+// writeRequest writes and flushes the encoded request and the chunks of
+// body, or of its preview
+func (t *icapTransport) writeRequest(pc *persistConn, request []byte, body *bodyStream, trace *icaptrace.ClientTrace) error {
+	if _, err := pc.bw.Write(request); err != nil {
+		return err
+	}
+	if trace != nil && trace.WroteHeaders != nil {
+		trace.WroteHeaders()
+	}
+	if body != nil {
+		if err := body.writeChunks(pc.bw); err != nil {
+			return err
+		}
+	}
+	return pc.bw.Flush()
+}
+
+// staleError maps errors on a reused connection that had not produced a
+// response to errStaleConn
+func (t *icapTransport) staleError(pc *persistConn, err error) error {
+	if pc.reused && (errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isConnReset(err)) {
+		return fmt.Errorf("%w: %v", errStaleConn, err)
+	}
+	return err
+}
+
+// isConnReset reports whether err is a connection reset or broken pipe
+func isConnReset(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	msg := opErr.Err.Error()
+	return strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe")
+}
+
+// deadline returns the I/O deadline for an attempt, the earlier of the
+// context deadline and the attempt timeout
+func (t *icapTransport) deadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if timeout := t.getAttemptTimeout(); timeout > 0 {
+		timeout := time.Now().Add(timeout)
+		if !ok || timeout.Before(deadline) {
+			deadline, ok = timeout, true
+		}
+	}
+	return deadline, ok
+}
+
+// getConn returns an idle connection or dials a new one
+func (t *icapTransport) getConn(ctx context.Context) (*persistConn, error) {
+	pc, err := t.acquireConn(ctx, true)
+	if err != nil || pc != nil {
+		return pc, err
+	}
+	return t.newConn(ctx)
+}
+
+// popIdle takes the most recently used idle connection from the pool,
+// closing those idle for longer than the timeout, or returns nil
+func (t *icapTransport) popIdle() *persistConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.idle) > 0 {
+		pc := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		if timeout := t.getTimeout(); timeout > 0 && time.Since(pc.idleAt) > timeout {
+			pc.close(closeReasonIdle)
+			continue
+		}
+		pc.reused = true
+		if t.metrics != nil {
+			t.metrics.ConnectionsReused.Inc()
+		}
+		return pc
+	}
+	return nil
+}
+
+// dialConn dials a new connection to the ICAP server, waiting while the
+// connection limit is reached
+func (t *icapTransport) dialConn(ctx context.Context) (*persistConn, error) {
+	if _, err := t.acquireConn(ctx, false); err != nil {
+		return nil, err
+	}
+	return t.newConn(ctx)
+}
+
+// newConn dials a connection counted by acquireConn, failing at once while
+// the server is marked down
+func (t *icapTransport) newConn(ctx context.Context) (*persistConn, error) {
+	if err := t.backend.allow(); err != nil {
+		t.conns.release()
+		if t.metrics != nil {
+			t.metrics.BackendDownRejections.Inc()
+		}
+		return nil, err
+	}
+
+	// Bound proxy and TLS handshakes as well as the TCP connect
+	dialCtx := ctx
+	if timeout := t.getAttemptTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	conn, err := t.dial(dialCtx, "tcp", t.addr)
+	if err != nil && ctx.Err() != nil {
+		t.backend.abort()
+	} else {
+		t.backend.result(err)
+	}
+	if t.metrics != nil {
+		down := 0.0
+		if t.backend.down() {
+			down = 1
+		}
+		t.metrics.BackendDown.Set(down)
+	}
+	if err != nil {
+		t.conns.release()
+		return nil, err
+	}
+	if t.metrics != nil {
+		t.metrics.observeConnOpened(time.Since(start))
+	}
+
+	br := getBufioReader(conn)
+	parser := getResponseParser(br, t.maxHeaderBytes, t.maxHeaderCount)
+	parser.spool = t.spool
+	return &persistConn{
+		conn:    conn,
+		br:      br,
+		bw:      getBufioWriter(conn),
+		parser:  parser,
+		conns:   t.conns,
+		metrics: t.metrics,
+	}, nil
+}
+
+// gotConnInfo describes pc for icaptrace
+func (pc *persistConn) gotConnInfo() icaptrace.GotConnInfo {
+	info := icaptrace.GotConnInfo{Conn: pc.conn, Reused: pc.reused, WasIdle: pc.reused}
+	if pc.reused {
+		info.IdleTime = time.Since(pc.idleAt)
+	}
+	return info
+}
+
+// close closes the connection for reason and returns its buffers to the
+// pools
+func (pc *persistConn) close(reason string) {
+	if pc.metrics != nil {
+		pc.metrics.observeConnClosed(reason)
+	}
+	pc.conn.Close()
+	putResponseParser(pc.parser)
+	putBufioReader(pc.br)
+	putBufioWriter(pc.bw)
+	pc.parser, pc.br, pc.bw = nil, nil, nil
+	pc.conns.release()
+}
+
+// putConn returns a connection to the idle pool, closing it if the pool is
+// full or the connection has served max_requests_per_conn requests
+func (t *icapTransport) putConn(pc *persistConn) {
+	pc.idleAt = time.Now()
+
+	t.mu.Lock()
+	if t.maxRequests > 0 && pc.requests >= t.maxRequests {
+		t.mu.Unlock()
+		pc.close(closeReasonMaxRequests)
+		return
+	}
+	if len(t.idle) >= t.maxIdle {
+		t.mu.Unlock()
+		pc.close(closeReasonPoolFull)
+		return
+	}
+	t.idle = append(t.idle, pc)
+	t.mu.Unlock()
+	t.conns.notify()
+}
+
+// closeIdleConnections closes all idle connections
+func (t *icapTransport) closeIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pc := range t.idle {
+		pc.close(closeReasonShutdown)
+	}
+	t.idle = nil
+}
+
+// encodeRequest serializes an ICAP request into buf: the request line, ICAP
+// headers in a stable order, and the encapsulated HTTP header and chunked
+// body. A body with a BodyReader is left to the transport to stream. It
+// returns the size of the encapsulated HTTP message written.
+func (c *IcapClient) encodeRequest(buf *bytes.Buffer, method IcapMethod, icapURL string, headers map[string]string, httpData interface{}) int {
+	buf.WriteString(string(method))
+	buf.WriteByte(' ')
+	buf.WriteString(icapURL)
+	buf.WriteString(" ICAP/1.0\r\n")
+	writeHeaders(buf, headers)
+
+	if httpData == nil {
+		return 0
+	}
+
+	start := buf.Len()
+	writeHTTPHeader(buf, httpData)
+	size := buf.Len() - start
+	if body := httpBody(httpData); len(body) > 0 && httpBodyReader(httpData) == nil {
+		writeChunk(buf, body)
+		buf.WriteString("0\r\n")
+		writeHeaders(buf, httpTrailer(httpData))
+		size += len(body)
+	}
+	return size
+}
+
+// writeChunk frames data as a single chunk of a chunked body
+func writeChunk(buf *bytes.Buffer, data []byte) {
+	var size [16]byte
+	buf.Write(strconv.AppendInt(size[:0], int64(len(data)), 16))
+	buf.WriteString("\r\n")
+	buf.Write(data)
+	buf.WriteString("\r\n")
+}
+
+// writeHeaders writes headers in name order followed by the blank line
+func writeHeaders(buf io.StringWriter, headers map[string]string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteString(": ")
+		buf.WriteString(headers[name])
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+}
+
+// writeHTTPHeader writes the header block of an encapsulated HTTP message,
+// including the terminating blank line
+func writeHTTPHeader(buf *bytes.Buffer, httpData interface{}) {
+	switch data := httpData.(type) {
+	case *HttpRequest:
+		buf.WriteString(data.Method)
+		buf.WriteByte(' ')
+		buf.WriteString(data.URI)
+		buf.WriteByte(' ')
+		buf.WriteString(data.Version)
+		buf.WriteString("\r\n")
+		writeHeaders(buf, data.Headers)
+	case *HttpResponse:
+		var code [8]byte
+		buf.WriteString(data.Version)
+		buf.WriteByte(' ')
+		buf.Write(strconv.AppendInt(code[:0], int64(data.StatusCode), 10))
+		buf.WriteByte(' ')
+		buf.WriteString(data.Reason)
+		buf.WriteString("\r\n")
+		writeHeaders(buf, data.Headers)
+	}
+}
+
+// serializeHTTPHeader serializes the header block of an encapsulated HTTP
+// message, including the terminating blank line
+func serializeHTTPHeader(httpData interface{}) []byte {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	writeHTTPHeader(buf, httpData)
+	if buf.Len() == 0 {
+		return nil
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// httpHeaderLength returns the size of the header block serializeHTTPHeader
+// would produce
+func httpHeaderLength(httpData interface{}) int {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	writeHTTPHeader(buf, httpData)
+	return buf.Len()
+}
+
+// httpBody returns the body of an encapsulated HTTP message
+func httpBody(httpData interface{}) []byte {
+	switch data := httpData.(type) {
+	case *HttpRequest:
+		return data.Body
+	case *HttpResponse:
+		return data.Body
+	}
+	return nil
+}
+
+// httpTrailer returns the trailer of an encapsulated HTTP message
+func httpTrailer(httpData interface{}) map[string]string {
+	switch data := httpData.(type) {
+	case *HttpRequest:
+		return data.Trailer
+	case *HttpResponse:
+		return data.Trailer
+	}
+	return nil
+}
+
+// httpHeaders returns the headers of an encapsulated HTTP message
+func httpHeaders(httpData interface{}) map[string]string {
+	switch data := httpData.(type) {
+	case *HttpRequest:
+		return data.Headers
+	case *HttpResponse:
+		return data.Headers
+	}
+	return nil
+}
@@ -0,0 +1,433 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptrace"
+)
+
+// newTestServerClient creates a client for an icaptest server
+func newTestServerClient(server *icaptest.Server, tlsEnabled bool) *IcapClient {
+	host, port := server.HostPort()
+	return NewIcapClient(&IcapConfig{
+		Host:               host,
+		Port:               port,
+		Timeout:            5 * time.Second,
+		ConnectionPoolSize: 2,
+		KeepAlive:          true,
+		LoggingLevel:       "ERROR",
+		TLS:                TLSConfig{Enabled: tlsEnabled},
+	})
+}
+
+// testServerHandler answers OPTIONS, allows requests as 204 and rewrites
+// responses containing "virus"
+func testServerHandler(w icaptest.ResponseWriter, r *icaptest.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("Methods", "REQMOD, RESPMOD")
+		w.Header().Set("Service", "icaptest")
+		w.WriteHeader(200, nil, false)
+	case "REQMOD":
+		w.WriteHeader(204, nil, false)
+	case "RESPMOD":
+		if !strings.Contains(string(r.Body), "virus") {
+			w.WriteHeader(204, nil, false)
+			return
+		}
+		resp := &http.Response{
+			StatusCode: 403,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+		}
+		w.WriteHeader(200, resp, true)
+		w.Write([]byte("blocked"))
+	default:
+		w.WriteHeader(405, nil, false)
+	}
+}
+
+// TestIcapClient_TestServer tests the client against an icaptest server
+func TestIcapClient_TestServer(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	ctx := context.Background()
+
+	options, err := client.Options(ctx)
+	if err != nil {
+		t.Fatalf("OPTIONS failed: %v", err)
+	}
+	if options.StatusCode != 200 || options.Headers["Methods"] != "REQMOD, RESPMOD" {
+		t.Errorf("Expected 200 with Methods, got %d %v", options.StatusCode, options.Headers)
+	}
+
+	reqmod, err := client.Reqmod(ctx, &HttpRequest{
+		Method:  "GET",
+		URI:     "/",
+		Version: "HTTP/1.1",
+		Headers: map[string]string{"Host": "example.com"},
+	})
+	if err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+	if reqmod.StatusCode != 204 {
+		t.Errorf("Expected 204, got %d", reqmod.StatusCode)
+	}
+
+	clean, err := client.Respmod(ctx, &HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       []byte("hello"),
+	})
+	if err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+	if clean.StatusCode != 204 {
+		t.Errorf("Expected 204 for clean body, got %d", clean.StatusCode)
+	}
+
+	infected, err := client.Respmod(ctx, &HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       []byte("a virus inside"),
+	})
+	if err != nil {
+		t.Fatalf("RESPMOD failed: %v", err)
+	}
+	if infected.StatusCode != 200 || infected.HttpResponse == nil {
+		t.Fatalf("Expected 200 with an encapsulated response, got %d", infected.StatusCode)
+	}
+	if infected.HttpResponse.StatusCode != 403 || string(infected.HttpResponse.Body) != "blocked" {
+		t.Errorf("Expected adapted 403 'blocked', got %d %q", infected.HttpResponse.StatusCode, infected.HttpResponse.Body)
+	}
+	if infected.Headers["ISTag"] == "" {
+		t.Error("Expected ISTag header")
+	}
+}
+
+// TestIcapTransport_ReusesConnections tests keep-alive connection reuse
+func TestIcapTransport_ReusesConnections(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Options(context.Background()); err != nil {
+			t.Fatalf("OPTIONS %d failed: %v", i, err)
+		}
+	}
+
+	if conns, requests := server.Stats(); conns != 1 || requests != 3 {
+		t.Errorf("Expected 3 requests on 1 connection, got %d on %d", requests, conns)
+	}
+
+	// A connection closed by the server while idle is replaced transparently
+	server.CloseClientConnections()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := client.Options(context.Background()); err != nil {
+		t.Fatalf("OPTIONS after server close failed: %v", err)
+	}
+	if conns, _ := server.Stats(); conns != 2 {
+		t.Errorf("Expected a second connection, got %d", conns)
+	}
+}
+
+// TestIcapTransport_KeepAliveDisabled tests that connections are not reused without keep-alive
+func TestIcapTransport_KeepAliveDisabled(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	client.transport.keepAlive = false
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Options(context.Background()); err != nil {
+			t.Fatalf("OPTIONS %d failed: %v", i, err)
+		}
+	}
+
+	if conns, _ := server.Stats(); conns != 2 {
+		t.Errorf("Expected 2 connections, got %d", conns)
+	}
+}
+
+// TestIcapTransport_MaxRequestsPerConn tests that connections are retired
+// after max_requests_per_conn requests
+func TestIcapTransport_MaxRequestsPerConn(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	client.transport.maxRequests = 2
+	defer client.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := client.Options(context.Background()); err != nil {
+			t.Fatalf("OPTIONS %d failed: %v", i, err)
+		}
+	}
+
+	if conns, requests := server.Stats(); conns != 3 || requests != 5 {
+		t.Errorf("Expected 5 requests on 3 connections, got %d on %d", requests, conns)
+	}
+}
+
+// TestIcapClient_TLSTestServer tests ICAPS with certificate pinning
+func TestIcapClient_TLSTestServer(t *testing.T) {
+	server := icaptest.NewTLSServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	digest := sha256.Sum256(server.Certificate().Raw)
+	host, port := server.HostPort()
+
+	tests := []struct {
+		name    string
+		pin     string
+		wantErr bool
+	}{
+		{"Matching pin", hex.EncodeToString(digest[:]), false},
+		{"Wrong pin", strings.Repeat("00", sha256.Size), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connects := 0
+			client := NewIcapClient(&IcapConfig{
+				Host:         host,
+				Port:         port,
+				Timeout:      5 * time.Second,
+				LoggingLevel: "ERROR",
+				TLS:          TLSConfig{Enabled: true, PinnedSHA256: []string{tt.pin}},
+				Hooks: Hooks{OnConnect: func(event ConnectEvent) {
+					if event.TLS {
+						connects++
+					}
+				}},
+			})
+			defer client.Close()
+
+			_, err := client.Options(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if connects != 1 {
+				t.Errorf("Expected 1 TLS connect event, got %d", connects)
+			}
+		})
+	}
+}
+
+// TestIcapClient_TimeoutAgainstSlowServer tests that a stalled server times out
+func TestIcapClient_TimeoutAgainstSlowServer(t *testing.T) {
+	release := make(chan struct{})
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		<-release
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.Options(ctx); err == nil {
+		t.Fatal("Expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected request to stop at the context deadline, took %v", elapsed)
+	}
+}
+
+// TestIcapClient_encodeRequest tests the ICAP wire format of a request
+func TestIcapClient_encodeRequest(t *testing.T) {
+	client := NewIcapClient(&IcapConfig{LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	httpResponse := &HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: 200,
+		Reason:     "OK",
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       []byte("hello world"),
+	}
+	headers := map[string]string{
+		"Host":         "icap.example.com",
+		"Encapsulated": client.buildEncapsulatedHeader(httpResponse),
+	}
+
+	var buf bytes.Buffer
+	size := client.encodeRequest(&buf, RESPMOD, "icap://icap.example.com:1344/respmod", headers, httpResponse)
+	request := buf.String()
+	expected := "RESPMOD icap://icap.example.com:1344/respmod ICAP/1.0\r\n" +
+		"Encapsulated: res-hdr=0, res-body=45\r\n" +
+		"Host: icap.example.com\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n" +
+		"b\r\nhello world\r\n0\r\n\r\n"
+
+	if request != expected {
+		t.Errorf("Expected request %q, got %q", expected, request)
+	}
+	if size != 56 {
+		t.Errorf("Expected encapsulated size 56, got %d", size)
+	}
+}
+
+// TestIcapClient_encodeRequestTrailer tests writing the trailer after the
+// terminal chunk
+func TestIcapClient_encodeRequestTrailer(t *testing.T) {
+	client := NewIcapClient(&IcapConfig{LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	httpRequest := &HttpRequest{
+		Method:  "POST",
+		URI:     "/upload",
+		Version: "HTTP/1.1",
+		Headers: map[string]string{"Trailer": "Digest, X-Checksum"},
+		Body:    []byte("hello"),
+		Trailer: map[string]string{"X-Checksum": "907d14fb", "Digest": "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="},
+	}
+
+	var buf bytes.Buffer
+	client.encodeRequest(&buf, REQMOD, "icap://icap.example.com/reqmod", map[string]string{}, httpRequest)
+	expected := "5\r\nhello\r\n0\r\n" +
+		"Digest: sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=\r\n" +
+		"X-Checksum: 907d14fb\r\n\r\n"
+	if !strings.HasSuffix(buf.String(), expected) {
+		t.Errorf("Expected request ending %q, got %q", expected, buf.String())
+	}
+}
+
+// TestIcapClient_DialContext tests that a custom dialer carries ICAP and
+// ICAPS connections for an address only it can reach
+func TestIcapClient_DialContext(t *testing.T) {
+	plain := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer plain.Close()
+	secure := icaptest.NewTLSServer(icaptest.HandlerFunc(testServerHandler))
+	defer secure.Close()
+	digest := sha256.Sum256(secure.Certificate().Raw)
+
+	for _, tt := range []struct {
+		name   string
+		server *icaptest.Server
+		tls    bool
+	}{
+		{"ICAP", plain, false},
+		{"ICAPS", secure, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port := tt.server.HostPort()
+			var dialed []string
+			client := NewIcapClient(&IcapConfig{
+				Host:         "icap.mesh.internal",
+				Port:         1344,
+				Timeout:      5 * time.Second,
+				LoggingLevel: "ERROR",
+				TLS:          TLSConfig{Enabled: tt.tls, PinnedSHA256: []string{hex.EncodeToString(digest[:])}},
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					dialed = append(dialed, addr)
+					var d net.Dialer
+					return d.DialContext(ctx, network, net.JoinHostPort(host, strconv.Itoa(port)))
+				},
+			})
+			defer client.Close()
+
+			response, err := client.Options(context.Background())
+			if err != nil {
+				t.Fatalf("OPTIONS through custom dialer failed: %v", err)
+			}
+			if response.StatusCode != 200 {
+				t.Errorf("Expected 200, got %d", response.StatusCode)
+			}
+			if len(dialed) != 1 || dialed[0] != "icap.mesh.internal:1344" {
+				t.Errorf("Expected custom dialer to be asked for icap.mesh.internal:1344, got %v", dialed)
+			}
+		})
+	}
+}
+
+// TestIcapClient_ClientTrace tests the icaptrace hooks of a request on a
+// new connection, and of a previewed request on a reused one
+func TestIcapClient_ClientTrace(t *testing.T) {
+	server := icaptest.NewUnstartedServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Preview", "4")
+			w.Header().Set("Transfer-Preview", "*")
+			w.WriteHeader(200, nil, false)
+			return
+		}
+		w.WriteHeader(204, nil, false)
+	}))
+	server.ContinueAfterPreview = func(r *icaptest.Request) bool { return true }
+	server.Start()
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	client.config.Load().TransferRules = true
+	defer client.Close()
+
+	var events []string
+	ctx := icaptrace.WithClientTrace(context.Background(), &icaptrace.ClientTrace{
+		GetConn:      func(string) { events = append(events, "GetConn") },
+		ConnectStart: func(string, string) { events = append(events, "ConnectStart") },
+		ConnectDone: func(_, _ string, err error) {
+			events = append(events, "ConnectDone")
+			if err != nil {
+				t.Errorf("Expected connect to succeed, got %v", err)
+			}
+		},
+		GotConn: func(info icaptrace.GotConnInfo) {
+			events = append(events, "GotConn reused="+strconv.FormatBool(info.Reused))
+		},
+		WroteHeaders: func() { events = append(events, "WroteHeaders") },
+		WroteRequest: func(info icaptrace.WroteRequestInfo) {
+			events = append(events, "WroteRequest")
+			if info.Err != nil {
+				t.Errorf("Expected write to succeed, got %v", info.Err)
+			}
+		},
+		Got100Continue:       func() { events = append(events, "Got100Continue") },
+		GotFirstResponseByte: func() { events = append(events, "GotFirstResponseByte") },
+	})
+
+	if _, err := client.Options(ctx); err != nil {
+		t.Fatalf("OPTIONS failed: %v", err)
+	}
+	expected := []string{"GetConn", "ConnectStart", "ConnectDone", "GotConn reused=false", "WroteHeaders", "WroteRequest", "GotFirstResponseByte"}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected OPTIONS events %v, got %v", expected, events)
+	}
+
+	events = nil
+	if _, err := client.Reqmod(ctx, &HttpRequest{Method: "POST", URI: "/a.txt", Version: "HTTP/1.1", Body: []byte("scan the body")}); err != nil {
+		t.Fatalf("REQMOD failed: %v", err)
+	}
+	expected = []string{"GetConn", "GotConn reused=true", "WroteHeaders", "WroteRequest", "GotFirstResponseByte", "Got100Continue"}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected REQMOD events %v, got %v", expected, events)
+	}
+}
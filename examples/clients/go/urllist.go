@@ -0,0 +1,157 @@
+package icapclient
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// urlRegexPrefix marks URL patterns that are regular expressions
+const urlRegexPrefix = "regex:"
+
+// URLListConfig is a list of URL patterns, given inline and in files of
+// one pattern per line, "#" starting comments. A pattern is a host, or a
+// host and path when it holds a "/", matched exactly or with "*" matching
+// any characters, e.g. "example.com", "*.example.com" or
+// "example.com/downloads/*". Patterns starting with "regex:" are regular
+// expressions matched against the host and path, e.g.
+// "regex:^[a-z0-9]{32}\.example\.net/".
+type URLListConfig struct {
+	Patterns []string `yaml:"patterns" json:"patterns"`
+	// Files are read when the client is created and whenever they change
+	Files []string `yaml:"files" json:"files"`
+}
+
+// empty reports whether the list has no patterns nor files
+func (c URLListConfig) empty() bool {
+	return len(c.Patterns) == 0 && len(c.Files) == 0
+}
+
+// urlList is a compiled list of URL patterns. Exact hosts and "*." host
+// suffixes are looked up in maps so that large lists stay cheap.
+type urlList struct {
+	hosts    map[string]bool
+	suffixes map[string]bool
+	paths    map[string]bool
+	// patterns match the host, and pathPatterns the host and path
+	patterns     []*regexp.Regexp
+	pathPatterns []*regexp.Regexp
+}
+
+// newURLList creates an empty list
+func newURLList() *urlList {
+	return &urlList{hosts: map[string]bool{}, suffixes: map[string]bool{}, paths: map[string]bool{}}
+}
+
+// loadURLList compiles the patterns of config and of its files. Files that
+// cannot be read and invalid patterns are returned as errors and skipped.
+func loadURLList(config URLListConfig) (*urlList, []error) {
+	list := newURLList()
+	var errs []error
+	for _, pattern := range config.Patterns {
+		if err := list.add(pattern); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, path := range config.Files {
+		file, err := os.Open(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			pattern, _, _ := strings.Cut(scanner.Text(), "#")
+			if pattern = strings.TrimSpace(pattern); pattern == "" {
+				continue
+			}
+			if err := list.add(pattern); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: %w", path, line, err))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to read %s: %w", path, err))
+		}
+		file.Close()
+	}
+	return list, errs
+}
+
+// add compiles pattern into the list
+func (l *urlList) add(pattern string) error {
+	if expr, ok := strings.CutPrefix(pattern, urlRegexPrefix); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid URL pattern %q: %w", pattern, err)
+		}
+		l.pathPatterns = append(l.pathPatterns, re)
+		return nil
+	}
+
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	hasPath := strings.Contains(pattern, "/")
+	switch {
+	case pattern == "":
+		return fmt.Errorf("empty URL pattern")
+	case !strings.Contains(pattern, "*") && hasPath:
+		l.paths[pattern] = true
+	case !strings.Contains(pattern, "*"):
+		l.hosts[pattern] = true
+	case !hasPath && strings.HasPrefix(pattern, "*.") && !strings.Contains(pattern[2:], "*"):
+		l.suffixes[pattern[2:]] = true
+	case hasPath:
+		l.pathPatterns = append(l.pathPatterns, globPattern(pattern))
+	default:
+		l.patterns = append(l.patterns, globPattern(pattern))
+	}
+	return nil
+}
+
+// len returns the number of patterns in the list
+func (l *urlList) len() int {
+	return len(l.hosts) + len(l.suffixes) + len(l.paths) + len(l.patterns) + len(l.pathPatterns)
+}
+
+// matches reports whether the host and path of a URL match the list
+func (l *urlList) matches(host, path string) bool {
+	if host == "" {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if l.hosts[host] {
+		return true
+	}
+	for suffix := host; ; {
+		_, rest, ok := strings.Cut(suffix, ".")
+		if !ok {
+			break
+		}
+		if l.suffixes[rest] {
+			return true
+		}
+		suffix = rest
+	}
+	for _, re := range l.patterns {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+
+	hostPath := host + path
+	if l.paths[strings.ToLower(hostPath)] {
+		return true
+	}
+	for _, re := range l.pathPatterns {
+		if re.MatchString(hostPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// validURLPattern returns the error of an invalid URL pattern, or nil
+func validURLPattern(pattern string) error {
+	return newURLList().add(pattern)
+}
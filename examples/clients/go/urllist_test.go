@@ -0,0 +1,113 @@
+package icapclient
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestURLList tests exact, wildcard and regular expression URL patterns
+func TestURLList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	content := "# trusted\ntrusted.example  # exact host\n\n*.cdn.example\nregex:([\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list, errs := loadURLList(URLListConfig{
+		Patterns: []string{"Example.com/Downloads/setup.exe", "example.org/static/*", "ads*.example.net", `regex:^[a-f0-9]{16}\.dga\.example/`},
+		Files:    []string{path, filepath.Join(t.TempDir(), "missing.txt")},
+	})
+	if len(errs) != 2 {
+		t.Errorf("Expected the invalid regex and the missing file to be reported, got %v", errs)
+	}
+	if n := list.len(); n != 6 {
+		t.Errorf("Expected 6 patterns, got %d", n)
+	}
+
+	for _, tt := range []struct {
+		host, path string
+		expected   bool
+	}{
+		{"trusted.example", "/", true},
+		{"TRUSTED.example.", "/any", true},
+		{"sub.trusted.example", "/", false},
+		{"a.b.cdn.example", "/", true},
+		{"cdn.example", "/", false},
+		{"example.com", "/downloads/setup.exe", true},
+		{"example.com", "/downloads/other.exe", false},
+		{"example.org", "/static/js/app.js", true},
+		{"example.org", "/api", false},
+		{"ads42.example.net", "/", true},
+		{"0123456789abcdef.dga.example", "/", true},
+		{"short.dga.example", "/", false},
+		{"", "/", false},
+	} {
+		if matched := list.matches(tt.host, tt.path); matched != tt.expected {
+			t.Errorf("Expected %s%s to match %v, got %v", tt.host, tt.path, tt.expected, matched)
+		}
+	}
+}
+
+// TestIcapClient_PolicyURLLists tests denylisted and allowlisted URLs, and
+// reloading list files when they change
+func TestIcapClient_PolicyURLLists(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(func(w icaptest.ResponseWriter, r *icaptest.Request) {
+		w.WriteHeader(204, nil, false)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("malware.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host: host, Port: port, Timeout: 5 * time.Second, ConnectionPoolSize: 2, KeepAlive: true, LoggingLevel: "ERROR",
+		Policy: PolicyConfig{
+			Allowlist: URLListConfig{Patterns: []string{"*.example.com"}},
+			Denylist:  URLListConfig{Files: []string{path}},
+		},
+	})
+	defer client.Close()
+
+	decide := func(uri string) string {
+		t.Helper()
+		response, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: uri, Version: "HTTP/1.1"})
+		if err != nil {
+			t.Fatalf("REQMOD failed: %v", err)
+		}
+		if response.Policy == nil {
+			return PolicyScan
+		}
+		return response.Policy.Action + " " + response.Policy.Rule
+	}
+
+	if decision := decide("http://malware.example/"); decision != "block denylist" {
+		t.Errorf("Expected the denylist to block, got %q", decision)
+	}
+	if decision := decide("http://www.example.com/"); decision != "bypass allowlist" {
+		t.Errorf("Expected the allowlist to bypass, got %q", decision)
+	}
+	if decision := decide("http://phishing.example/"); decision != PolicyScan {
+		t.Errorf("Expected an unlisted URL to be scanned, got %q", decision)
+	}
+
+	next := path + ".tmp"
+	if err := os.WriteFile(next, []byte("malware.example\nphishing.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for decide("http://phishing.example/") != "block denylist" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the denylist file to be reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
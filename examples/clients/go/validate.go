@@ -0,0 +1,365 @@
+package icapclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError is a problem with one configuration field, identified by its
+// YAML path, e.g. "tls.pinned_sha256[1]"
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// Error implements error
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists every problem found by IcapConfig.Validate
+type ValidationError struct {
+	Problems []*FieldError
+}
+
+// Error lists the problems, one per line
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString("invalid configuration:")
+	for _, problem := range e.Problems {
+		b.WriteString("\n  - ")
+		b.WriteString(problem.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the problems, for errors.As
+func (e *ValidationError) Unwrap() []error {
+	errs := make([]error, len(e.Problems))
+	for i, problem := range e.Problems {
+		errs[i] = problem
+	}
+	return errs
+}
+
+// authRequiredFields are the authentication settings each method needs
+var authRequiredFields = map[AuthenticationMethod][]string{
+	AuthNone:   nil,
+	AuthBasic:  {"username", "password"},
+	AuthBearer: {"token"},
+	AuthJWT:    {"jwt_token"},
+	AuthAPIKey: {"api_key"},
+}
+
+// Validate checks the configuration for invalid values and combinations,
+// and returns a *ValidationError listing all of them, or nil
+func (c *IcapConfig) Validate() error {
+	v := &validator{}
+
+	if strings.TrimSpace(c.Host) == "" {
+		v.add("host", "is required")
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		v.add("port", "must be between 1 and 65535, got %d", c.Port)
+	}
+	v.nonNegative("timeout", int64(c.Timeout))
+	v.nonNegative("attempt_timeout", int64(c.AttemptTimeout))
+	v.nonNegative("max_concurrent_requests", int64(c.MaxConcurrentRequests))
+	v.nonNegative("backend_down_ttl", int64(c.BackendDownTTL))
+	if c.Timeout > 0 && c.AttemptTimeout > c.Timeout {
+		v.add("attempt_timeout", "%s exceeds timeout %s", c.AttemptTimeout, c.Timeout)
+	}
+	v.nonNegative("retries", int64(c.Retries))
+	v.nonNegative("retry_delay", int64(c.RetryDelay))
+	v.nonNegative("max_retry_delay", int64(c.MaxRetryDelay))
+	if c.RetryDelay > 0 && c.MaxRetryDelay > 0 && c.MaxRetryDelay < c.RetryDelay {
+		v.add("max_retry_delay", "%s is below retry_delay %s", c.MaxRetryDelay, c.RetryDelay)
+	}
+	if c.BackoffFactor != 0 && c.BackoffFactor < 1 {
+		v.add("backoff_factor", "must be at least 1, got %g", c.BackoffFactor)
+	}
+	for method, classes := range c.RetryOn {
+		for _, class := range classes {
+			if !validErrorClass(class) {
+				v.add("retry_on."+method, "unknown error class %q, expected connect, send, response or unavailable", class)
+			}
+		}
+	}
+
+	v.nonNegative("connection_pool_size", int64(c.ConnectionPoolSize))
+	if c.KeepAlive && c.ConnectionPoolSize == 0 {
+		v.add("connection_pool_size", "must be positive when keep_alive is enabled")
+	}
+	v.nonNegative("keep_alive_ping", int64(c.KeepAlivePing))
+	v.nonNegative("warmup_connections", int64(c.WarmupConnections))
+	if c.ConnectionPoolSize > 0 && c.WarmupConnections > c.ConnectionPoolSize {
+		v.add("warmup_connections", "%d exceeds connection_pool_size %d", c.WarmupConnections, c.ConnectionPoolSize)
+	}
+	v.nonNegative("max_requests_per_conn", int64(c.MaxRequestsPerConn))
+
+	c.validateAuthentication(v)
+	c.validateTLS(v)
+
+	switch strings.ToUpper(c.LoggingLevel) {
+	case "", "DEBUG", "INFO", "WARN", "WARNING", "ERROR", "FATAL":
+	default:
+		v.add("logging_level", "unknown level %q, expected DEBUG, INFO, WARN or ERROR", c.LoggingLevel)
+	}
+
+	v.nonNegative("access_log.max_size_mb", int64(c.AccessLog.MaxSizeMB))
+	v.nonNegative("access_log.max_backups", int64(c.AccessLog.MaxBackups))
+	v.nonNegative("access_log.max_age_days", int64(c.AccessLog.MaxAgeDays))
+
+	faults := &c.FaultInjection
+	for _, rate := range []struct {
+		field string
+		value float64
+	}{
+		{"reset_rate", faults.ResetRate},
+		{"slow_read_rate", faults.SlowReadRate},
+		{"truncate_rate", faults.TruncateRate},
+		{"error_rate", faults.ErrorRate},
+	} {
+		if rate.value < 0 || rate.value > 1 {
+			v.add("fault_injection."+rate.field, "must be between 0 and 1, got %g", rate.value)
+		}
+	}
+	if faults.ErrorStatus != 0 && (faults.ErrorStatus < 100 || faults.ErrorStatus > 599) {
+		v.add("fault_injection.error_status", "must be an ICAP status code, got %d", faults.ErrorStatus)
+	}
+
+	v.nonNegative("max_header_bytes", int64(c.MaxHeaderBytes))
+	v.nonNegative("max_header_count", int64(c.MaxHeaderCount))
+	v.nonNegative("max_body_size", c.MaxBodySize)
+	switch strings.ToLower(c.BodyLimitAction) {
+	case "", BodyLimitReject, BodyLimitTruncate:
+	default:
+		v.add("body_limit_action", "unknown action %q, expected %q or %q", c.BodyLimitAction, BodyLimitReject, BodyLimitTruncate)
+	}
+	switch strings.ToLower(c.ResponseProfile) {
+	case "", ResponseProfileClamAV:
+	default:
+		v.add("response_profile", "unknown profile %q", c.ResponseProfile)
+	}
+
+	for method := range c.Services.Custom {
+		if !validHeaderName(method) {
+			v.add("services.custom", "invalid ICAP method %q", method)
+		}
+	}
+	if c.TenantHeader != "" && !validHeaderName(c.TenantHeader) {
+		v.add("tenant_header", "invalid header name %q", c.TenantHeader)
+	}
+	for _, capability := range c.Allow {
+		if !validCapability(capability) {
+			v.add("allow", "unknown capability %q, expected 204, 206, trailers or none", capability)
+		}
+	}
+	if _, err := renderIdentity(c.Identity, IdentityInfo{}); err != nil {
+		v.add("identity", "%v", err)
+	}
+	if _, err := parseCompressionMode(c.Compression.Mode); err != nil {
+		v.add("compression.mode", "unknown mode %q, expected off, auto or always", c.Compression.Mode)
+	}
+	v.nonNegative("compression.min_size", c.Compression.MinSize)
+	v.nonNegative("spool.threshold", c.Spool.Threshold)
+
+	if c.Proxy.SOCKS5.enabled() && c.Proxy.HTTPConnect.Address != "" {
+		v.add("proxy", "socks5 and http_connect are mutually exclusive")
+	}
+	if c.Proxy.SOCKS5.Password != "" && c.Proxy.SOCKS5.Username == "" {
+		v.add("proxy.socks5.username", "is required with proxy.socks5.password")
+	}
+
+	v.nonNegative("dns.min_ttl", int64(c.DNS.MinTTL))
+	v.nonNegative("dns.max_ttl", int64(c.DNS.MaxTTL))
+	if c.DNS.MinTTL > 0 && c.DNS.MaxTTL > 0 && c.DNS.MinTTL > c.DNS.MaxTTL {
+		v.add("dns.min_ttl", "%s is above dns.max_ttl %s", c.DNS.MinTTL, c.DNS.MaxTTL)
+	}
+	v.nonNegative("throttle.per_transfer", c.Throttle.PerTransfer)
+	v.nonNegative("throttle.global", c.Throttle.Global)
+	v.nonNegative("scan_cache.max_entries", int64(c.ScanCache.MaxEntries))
+	v.nonNegative("scan_cache.ttl", int64(c.ScanCache.TTL))
+	v.nonNegative("scan_cache.save_interval", int64(c.ScanCache.SaveInterval))
+	switch strings.ToLower(c.ScanCache.Key) {
+	case "", ScanCacheKeyHash, ScanCacheKeyURL:
+	default:
+		v.add("scan_cache.key", "unknown key %q, expected %q or %q", c.ScanCache.Key, ScanCacheKeyHash, ScanCacheKeyURL)
+	}
+	v.nonNegative("clean_filter.capacity", int64(c.CleanFilter.Capacity))
+	if rate := c.CleanFilter.FalsePositiveRate; rate < 0 || rate >= 1 {
+		v.add("clean_filter.false_positive_rate", "must be between 0 and 1, got %g", rate)
+	}
+	c.validatePolicy(v)
+	for _, list := range []struct {
+		field string
+		types []string
+	}{{"transfer_types.ignore", c.TransferTypes.Ignore}, {"transfer_types.complete", c.TransferTypes.Complete}} {
+		for _, contentType := range list.types {
+			if !strings.Contains(contentType, "/") {
+				v.add(list.field, "invalid media type %q", contentType)
+			}
+		}
+	}
+	for _, algorithm := range c.ContentHash.Algorithms {
+		if !validHashAlgorithm(algorithm) {
+			v.add("content_hash.algorithms", "unknown algorithm %q, expected sha256, sha1 or md5", algorithm)
+		}
+	}
+
+	return v.err()
+}
+
+// validatePolicy checks the actions and conditions of the policy rules
+func (c *IcapConfig) validatePolicy(v *validator) {
+	if c.Policy.Default != "" && !validPolicyAction(c.Policy.Default) {
+		v.add("policy.default", "unknown action %q, expected scan, bypass, block or preview", c.Policy.Default)
+	}
+	for _, list := range []struct {
+		field  string
+		config URLListConfig
+	}{{"policy.allowlist", c.Policy.Allowlist}, {"policy.denylist", c.Policy.Denylist}} {
+		for _, pattern := range list.config.Patterns {
+			if err := validURLPattern(pattern); err != nil {
+				v.add(list.field+".patterns", "%v", err)
+			}
+		}
+	}
+	v.nonNegative("policy.min_scan_size", c.Policy.MinScanSize)
+	v.nonNegative("policy.max_scan_size", c.Policy.MaxScanSize)
+	v.nonNegative("policy.preview_size", c.Policy.PreviewSize)
+	if c.Policy.MinScanSize > 0 && c.Policy.MaxScanSize > 0 && c.Policy.MinScanSize > c.Policy.MaxScanSize {
+		v.add("policy.min_scan_size", "%d is above policy.max_scan_size %d", c.Policy.MinScanSize, c.Policy.MaxScanSize)
+	}
+	switch strings.ToLower(c.Policy.MaxScanSizeAction) {
+	case "", PolicyBypass, PolicyPreview, PolicyBlock:
+	default:
+		v.add("policy.max_scan_size_action", "unknown action %q, expected bypass, preview or block", c.Policy.MaxScanSizeAction)
+	}
+	if c.Policy.Sampling.Rate < 0 || c.Policy.Sampling.Rate > 1 {
+		v.add("policy.sampling.rate", "must be between 0 and 1, got %g", c.Policy.Sampling.Rate)
+	}
+	if !validFailureMode(c.Policy.OnFailure) {
+		v.add("policy.on_failure", "unknown failure mode %q, expected error, open or closed", c.Policy.OnFailure)
+	}
+	if !validSamplingMode(c.Policy.Sampling.Mode) {
+		v.add("policy.sampling.mode", "unknown mode %q, expected hash or random", c.Policy.Sampling.Mode)
+	}
+	for i, rule := range c.Policy.Rules {
+		field := fmt.Sprintf("policy.rules[%d]", i)
+		if !validPolicyAction(rule.Action) {
+			v.add(field+".action", "unknown action %q, expected scan, bypass, block or preview", rule.Action)
+		}
+		if !validFailureMode(rule.OnFailure) {
+			v.add(field+".on_failure", "unknown failure mode %q, expected error, open or closed", rule.OnFailure)
+		}
+		for _, method := range rule.ICAPMethods {
+			if !strings.EqualFold(method, string(REQMOD)) && !strings.EqualFold(method, string(RESPMOD)) {
+				v.add(field+".icap_methods", "unknown method %q, expected REQMOD or RESPMOD", method)
+			}
+		}
+		for _, pattern := range rule.URLs {
+			if err := validURLPattern(pattern); err != nil {
+				v.add(field+".urls", "%v", err)
+			}
+		}
+		for _, contentType := range rule.ContentTypes {
+			if !strings.Contains(contentType, "/") {
+				v.add(field+".content_types", "invalid media type %q", contentType)
+			}
+		}
+		v.nonNegative(field+".min_size", rule.MinSize)
+		v.nonNegative(field+".max_size", rule.MaxSize)
+		if rule.MinSize > 0 && rule.MaxSize > 0 && rule.MinSize > rule.MaxSize {
+			v.add(field+".min_size", "%d is above max_size %d", rule.MinSize, rule.MaxSize)
+		}
+	}
+}
+
+// validateAuthentication checks the authentication method and the settings
+// it requires
+func (c *IcapConfig) validateAuthentication(v *validator) {
+	if c.Authentication == nil {
+		return
+	}
+	method := AuthenticationMethod(strings.ToLower(c.Authentication["method"]))
+	if method == "" {
+		if len(c.Authentication) > 0 {
+			v.add("authentication.method", "is required when authentication settings are present")
+		}
+		return
+	}
+	required, ok := authRequiredFields[method]
+	if !ok {
+		v.add("authentication.method", "unknown method %q, expected none, basic, bearer, jwt or api_key", c.Authentication["method"])
+		return
+	}
+	for _, field := range required {
+		if c.Authentication[field] == "" {
+			v.add("authentication."+field, "is required by method %s", method)
+		}
+	}
+}
+
+// validateTLS checks the TLS settings, and that settings only meaningful
+// with TLS are not set without it
+func (c *IcapConfig) validateTLS(v *validator) {
+	settings := &c.TLS
+	ocspMode, ocspErr := parseOCSPMode(settings.OCSPStapling)
+	if !settings.Enabled {
+		if len(settings.PinnedSHA256) > 0 {
+			v.add("tls.pinned_sha256", "requires tls.enabled")
+		}
+		if ocspErr == nil && ocspMode != ocspOff {
+			v.add("tls.ocsp_stapling", "requires tls.enabled")
+		}
+	}
+
+	for i, pin := range settings.PinnedSHA256 {
+		if _, err := decodePin(pin); err != nil {
+			v.add(fmt.Sprintf("tls.pinned_sha256[%d]", i), "%v", err)
+		}
+	}
+	minVersion, err := parseTLSVersion(settings.MinVersion)
+	if err != nil {
+		v.add("tls.min_version", "%v", err)
+	}
+	maxVersion, err := parseTLSVersion(settings.MaxVersion)
+	if err != nil {
+		v.add("tls.max_version", "%v", err)
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		v.add("tls.min_version", "%s is above tls.max_version %s", settings.MinVersion, settings.MaxVersion)
+	}
+	if _, err := parseCipherSuites(settings.CipherSuites); err != nil {
+		v.add("tls.cipher_suites", "%v", err)
+	}
+	if ocspErr != nil {
+		v.add("tls.ocsp_stapling", "unknown mode %q, expected off, verify or strict", settings.OCSPStapling)
+	}
+}
+
+// validator collects configuration problems
+type validator struct {
+	problems []*FieldError
+}
+
+// add records a problem with field
+func (v *validator) add(field, format string, args ...any) {
+	v.problems = append(v.problems, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// nonNegative records a problem if value, a count or duration, is negative
+func (v *validator) nonNegative(field string, value int64) {
+	if value < 0 {
+		v.add(field, "must not be negative")
+	}
+}
+
+// err returns the collected problems as a *ValidationError, or nil
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
@@ -0,0 +1,172 @@
+package icapclient
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns a configuration that passes Validate
+func validConfig() *IcapConfig {
+	return &IcapConfig{
+		Host:               "127.0.0.1",
+		Port:               1344,
+		Timeout:            30 * time.Second,
+		Retries:            3,
+		RetryDelay:         time.Second,
+		MaxRetryDelay:      time.Minute,
+		BackoffFactor:      2,
+		ConnectionPoolSize: 10,
+		KeepAlive:          true,
+		LoggingLevel:       "INFO",
+	}
+}
+
+// TestIcapConfig_Validate tests that each invalid setting is reported with
+// its field path
+func TestIcapConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name           string
+		modify         func(c *IcapConfig)
+		expectedFields []string
+	}{
+		{"valid", func(c *IcapConfig) {}, nil},
+		{"negative retries", func(c *IcapConfig) { c.Retries = -1 }, []string{"retries"}},
+		{"missing host and bad port", func(c *IcapConfig) { c.Host, c.Port = "", 70000 }, []string{"host", "port"}},
+		{"pool size 0 with keep_alive", func(c *IcapConfig) { c.ConnectionPoolSize = 0 }, []string{"connection_pool_size"}},
+		{"pool size 0 without keep_alive", func(c *IcapConfig) { c.ConnectionPoolSize, c.KeepAlive = 0, false }, nil},
+		{"attempt timeout above timeout", func(c *IcapConfig) { c.AttemptTimeout = time.Hour }, []string{"attempt_timeout"}},
+		{"unknown retry error class", func(c *IcapConfig) { c.RetryOn = map[string][]string{"RESPMOD": {"timeout"}} }, []string{"retry_on.RESPMOD"}},
+		{"negative max concurrent requests", func(c *IcapConfig) { c.MaxConcurrentRequests = -1 }, []string{"max_concurrent_requests"}},
+		{"negative throttle", func(c *IcapConfig) { c.Throttle.Global = -1 }, []string{"throttle.global"}},
+		{"unknown hash algorithm", func(c *IcapConfig) { c.ContentHash.Algorithms = []string{"crc32"} }, []string{"content_hash.algorithms"}},
+		{"negative scan cache ttl", func(c *IcapConfig) { c.ScanCache.TTL = -time.Second }, []string{"scan_cache.ttl"}},
+		{"unknown scan cache key", func(c *IcapConfig) { c.ScanCache.Key = "path" }, []string{"scan_cache.key"}},
+		{"negative backend down ttl", func(c *IcapConfig) { c.BackendDownTTL = -time.Second }, []string{"backend_down_ttl"}},
+		{"clean filter false positive rate", func(c *IcapConfig) { c.CleanFilter.FalsePositiveRate = 1 }, []string{"clean_filter.false_positive_rate"}},
+		{"unknown policy default", func(c *IcapConfig) { c.Policy.Default = "allow" }, []string{"policy.default"}},
+		{"policy rule size bounds", func(c *IcapConfig) {
+			c.Policy.Rules = []PolicyRule{{Action: "bypass", MinSize: 10, MaxSize: 5}}
+		}, []string{"policy.rules[0].min_size"}},
+		{"policy rule without action", func(c *IcapConfig) {
+			c.Policy.Rules = []PolicyRule{{ContentTypes: []string{"image"}}}
+		}, []string{"policy.rules[0].action", "policy.rules[0].content_types"}},
+		{"invalid policy URL patterns", func(c *IcapConfig) {
+			c.Policy.Denylist.Patterns = []string{"regex:("}
+			c.Policy.Rules = []PolicyRule{{Action: "scan", URLs: []string{""}}}
+		}, []string{"policy.denylist.patterns", "policy.rules[0].urls"}},
+		{"invalid transfer type", func(c *IcapConfig) { c.TransferTypes.Ignore = []string{"image"} }, []string{"transfer_types.ignore"}},
+		{"policy scan sizes", func(c *IcapConfig) {
+			c.Policy = PolicyConfig{MinScanSize: 100, MaxScanSize: 10, MaxScanSizeAction: "scan", PreviewSize: -1}
+		}, []string{"policy.preview_size", "policy.min_scan_size", "policy.max_scan_size_action"}},
+		{"policy sampling", func(c *IcapConfig) {
+			c.Policy.Sampling = SamplingConfig{Rate: 1.5, Mode: "every-other"}
+		}, []string{"policy.sampling.rate", "policy.sampling.mode"}},
+		{"unknown policy failure modes", func(c *IcapConfig) {
+			c.Policy = PolicyConfig{OnFailure: "ignore", Rules: []PolicyRule{{Action: "scan", OnFailure: "fail-open"}}}
+		}, []string{"policy.on_failure", "policy.rules[0].on_failure"}},
+		{"max retry delay below retry delay", func(c *IcapConfig) { c.MaxRetryDelay = time.Millisecond }, []string{"max_retry_delay"}},
+		{"basic auth without password", func(c *IcapConfig) {
+			c.Authentication = map[string]string{"method": "basic", "username": "admin"}
+		}, []string{"authentication.password"}},
+		{"bearer without token", func(c *IcapConfig) {
+			c.Authentication = map[string]string{"method": "bearer"}
+		}, []string{"authentication.token"}},
+		{"unknown auth method", func(c *IcapConfig) {
+			c.Authentication = map[string]string{"method": "kerberos"}
+		}, []string{"authentication.method"}},
+		{"TLS pin without TLS", func(c *IcapConfig) {
+			c.TLS.PinnedSHA256 = []string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", "bogus"}
+		}, []string{"tls.pinned_sha256", "tls.pinned_sha256[1]"}},
+		{"TLS versions", func(c *IcapConfig) {
+			c.TLS.Enabled = true
+			c.TLS.MinVersion, c.TLS.MaxVersion = "1.3", "1.2"
+		}, []string{"tls.min_version"}},
+		{"unknown enums", func(c *IcapConfig) {
+			c.LoggingLevel, c.BodyLimitAction, c.ResponseProfile = "LOUD", "drop", "sophos"
+		}, []string{"logging_level", "body_limit_action", "response_profile"}},
+		{"compression", func(c *IcapConfig) {
+			c.Compression = CompressionConfig{Mode: "zstd", MinSize: -1}
+		}, []string{"compression.mode", "compression.min_size"}},
+		{"custom method", func(c *IcapConfig) {
+			c.Services.Custom = map[string]string{"log": "/log", "bad method": "/bad"}
+		}, []string{"services.custom"}},
+		{"tenant header", func(c *IcapConfig) {
+			c.TenantHeader = "X Tenant"
+		}, []string{"tenant_header"}},
+		{"allow", func(c *IcapConfig) {
+			c.Allow = []string{"204", "preview"}
+		}, []string{"allow"}},
+		{"identity template", func(c *IcapConfig) {
+			c.Identity.Headers = map[string]string{"X-Scan-Client": "scanner/{{.Release}}"}
+		}, []string{"identity"}},
+		{"fault rates", func(c *IcapConfig) {
+			c.FaultInjection.ResetRate, c.FaultInjection.ErrorRate = 1.5, -0.1
+		}, []string{"fault_injection.reset_rate", "fault_injection.error_rate"}},
+		{"both proxies", func(c *IcapConfig) {
+			c.Proxy.SOCKS5.Address, c.Proxy.HTTPConnect.Address = "bastion:1080", "proxy:3128"
+		}, []string{"proxy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validConfig()
+			tt.modify(config)
+
+			err := config.Validate()
+			if tt.expectedFields == nil {
+				if err != nil {
+					t.Fatalf("Expected valid config, got %v", err)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Expected *ValidationError, got %v", err)
+			}
+			var fields []string
+			for _, problem := range validationErr.Problems {
+				fields = append(fields, problem.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.expectedFields) {
+				t.Errorf("Expected problems with %v, got %v", tt.expectedFields, err)
+			}
+		})
+	}
+}
+
+// TestLoadConfig_Invalid tests that LoadConfig reports all problems at once
+func TestLoadConfig_Invalid(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configData := `retries: -2
+connection_pool_size: 0
+authentication:
+  method: api_key
+tls:
+  pinned_sha256:
+    - "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+`
+	if err := os.WriteFile(configPath, []byte(configData), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	_, err := LoadConfig(configPath)
+	if err == nil {
+		t.Fatal("Expected validation error")
+	}
+	for _, field := range []string{"retries:", "connection_pool_size:", "authentication.api_key:", "tls.pinned_sha256:"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected error to mention %s, got:\n%v", field, err)
+		}
+	}
+
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "retries" {
+		t.Errorf("Expected the first problem to be retries, got %v", fieldErr)
+	}
+}
@@ -0,0 +1,146 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// Verdict is the outcome of scanning an HTTP message
+type Verdict int
+
+const (
+	// VerdictAllowed means the message may pass unchanged
+	VerdictAllowed Verdict = iota
+	// VerdictModified means the server returned an adapted message to use
+	// in place of the original
+	VerdictModified
+	// VerdictBlocked means the server refused the message, e.g. found a
+	// threat or answered with a block page
+	VerdictBlocked
+	// VerdictError means no verdict could be obtained
+	VerdictError
+)
+
+// String returns the name of the verdict
+func (v Verdict) String() string {
+	switch v {
+	case VerdictAllowed:
+		return "allowed"
+	case VerdictModified:
+		return "modified"
+	case VerdictBlocked:
+		return "blocked"
+	case VerdictError:
+		return "error"
+	default:
+		return fmt.Sprintf("verdict-%d", int(v))
+	}
+}
+
+// ScanRequest sends httpRequest with REQMOD and returns its verdict. The
+// response holds the adapted request or the block page, and is nil only
+// when the verdict is VerdictError.
+func (c *IcapClient) ScanRequest(ctx context.Context, httpRequest *HttpRequest) (Verdict, *IcapResponse, error) {
+	response, err := c.Reqmod(ctx, httpRequest)
+	if err != nil {
+		return VerdictError, nil, err
+	}
+	return verdictOf(httpRequest, response), response, nil
+}
+
+// ScanResponse sends httpResponse with RESPMOD and returns its verdict. The
+// response holds the adapted response or the block page, and is nil only
+// when the verdict is VerdictError.
+func (c *IcapClient) ScanResponse(ctx context.Context, httpResponse *HttpResponse) (Verdict, *IcapResponse, error) {
+	response, err := c.Respmod(ctx, httpResponse)
+	if err != nil {
+		return VerdictError, nil, err
+	}
+	return verdictOf(httpResponse, response), response, nil
+}
+
+// verdictOf derives the verdict on original, an *HttpRequest or
+// *HttpResponse, from the ICAP response to it
+func verdictOf(original interface{}, response *IcapResponse) Verdict {
+	switch {
+	case response.Policy != nil && response.Policy.Action == PolicyBlock:
+		return VerdictBlocked
+	case response.StatusCode >= 400:
+		return VerdictError
+	case response.StatusCode == int(NoContent):
+		return VerdictAllowed
+	}
+
+	if infection := response.Infection; infection != nil {
+		if infection.Resolution == ResolutionRepaired {
+			return VerdictModified
+		}
+		return VerdictBlocked
+	}
+	for _, violation := range response.Violations {
+		if violation.Resolution != ResolutionRepaired {
+			return VerdictBlocked
+		}
+	}
+
+	switch original := original.(type) {
+	case *HttpRequest:
+		// A response to a request modification is the server answering in
+		// place of the origin, which is how block pages are returned
+		if response.HttpResponse != nil {
+			return VerdictBlocked
+		}
+		if response.HttpRequest == nil || sameRequest(original, response.HttpRequest) {
+			return VerdictAllowed
+		}
+	case *HttpResponse:
+		adapted := response.HttpResponse
+		if adapted == nil || sameResponse(original, adapted) {
+			return VerdictAllowed
+		}
+		if adapted.StatusCode >= 400 && original.StatusCode < 400 {
+			return VerdictBlocked
+		}
+	}
+	return VerdictModified
+}
+
+// sameRequest reports whether adapted is an unchanged echo of original
+func sameRequest(original, adapted *HttpRequest) bool {
+	return original.Method == adapted.Method &&
+		original.URI == adapted.URI &&
+		sameHeaders(original.Headers, adapted.Headers) &&
+		sameBody(original.Body, original.BodyReader, adapted.Body, adapted.BodyReader)
+}
+
+// sameResponse reports whether adapted is an unchanged echo of original
+func sameResponse(original, adapted *HttpResponse) bool {
+	return original.StatusCode == adapted.StatusCode &&
+		sameHeaders(original.Headers, adapted.Headers) &&
+		sameBody(original.Body, original.BodyReader, adapted.Body, adapted.BodyReader)
+}
+
+// sameHeaders reports whether two header maps hold the same values,
+// comparing names case-insensitively
+func sameHeaders(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if headerValue(b, name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sameBody reports whether two bodies are equal. Streamed bodies are not
+// read back, so they are taken as unchanged and the headers decide.
+func sameBody(a []byte, aReader io.Reader, b []byte, bReader io.Reader) bool {
+	if aReader != nil || bReader != nil {
+		return true
+	}
+	return bytes.Equal(a, b)
+}
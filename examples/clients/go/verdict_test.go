@@ -0,0 +1,74 @@
+package icapclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestVerdictOf tests deriving verdicts from ICAP responses
+func TestVerdictOf(t *testing.T) {
+	request := &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1", Headers: map[string]string{"Host": "example.com"}}
+	response := &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Headers: map[string]string{"Content-Type": "text/plain"}, Body: []byte("hello")}
+
+	tests := []struct {
+		name     string
+		original interface{}
+		response *IcapResponse
+		expected Verdict
+	}{
+		{"No content", response, &IcapResponse{StatusCode: 204}, VerdictAllowed},
+		{"Server error", response, &IcapResponse{StatusCode: 500}, VerdictError},
+		{"Infection", response, &IcapResponse{StatusCode: 200, Infection: &Infection{Resolution: ResolutionBlocked}}, VerdictBlocked},
+		{"Repaired infection", response, &IcapResponse{StatusCode: 200, Infection: &Infection{Resolution: ResolutionRepaired}}, VerdictModified},
+		{"Violation", response, &IcapResponse{StatusCode: 200, Violations: []Violation{{Resolution: ResolutionNotRepaired}}}, VerdictBlocked},
+		{"Unchanged echo", response, &IcapResponse{StatusCode: 200, HttpResponse: &HttpResponse{
+			StatusCode: 200, Headers: map[string]string{"content-type": "text/plain"}, Body: []byte("hello"),
+		}}, VerdictAllowed},
+		{"Modified body", response, &IcapResponse{StatusCode: 200, HttpResponse: &HttpResponse{
+			StatusCode: 200, Headers: map[string]string{"Content-Type": "text/plain"}, Body: []byte("HELLO"),
+		}}, VerdictModified},
+		{"Block page", response, &IcapResponse{StatusCode: 200, HttpResponse: &HttpResponse{StatusCode: 403}}, VerdictBlocked},
+		{"Request block page", request, &IcapResponse{StatusCode: 200, HttpResponse: &HttpResponse{StatusCode: 403}}, VerdictBlocked},
+		{"Request echo", request, &IcapResponse{StatusCode: 200, HttpRequest: &HttpRequest{
+			Method: "GET", URI: "/", Headers: map[string]string{"Host": "example.com"},
+		}}, VerdictAllowed},
+		{"Request rewritten", request, &IcapResponse{StatusCode: 200, HttpRequest: &HttpRequest{
+			Method: "GET", URI: "/safe", Headers: map[string]string{"Host": "example.com"},
+		}}, VerdictModified},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if verdict := verdictOf(tt.original, tt.response); verdict != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, verdict)
+			}
+		})
+	}
+}
+
+// TestIcapClient_ScanResponse tests verdicts from an icaptest server
+func TestIcapClient_ScanResponse(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+	ctx := context.Background()
+
+	for body, expected := range map[string]Verdict{"clean": VerdictAllowed, "virus": VerdictBlocked} {
+		verdict, response, err := client.ScanResponse(ctx, &HttpResponse{Version: "HTTP/1.1", StatusCode: 200, Reason: "OK", Body: []byte(body)})
+		if err != nil {
+			t.Fatalf("ScanResponse failed: %v", err)
+		}
+		if verdict != expected {
+			t.Errorf("Expected %s for %q, got %s (%d)", expected, body, verdict, response.StatusCode)
+		}
+	}
+
+	verdict, _, err := client.ScanRequest(ctx, &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+	if err != nil || verdict != VerdictAllowed {
+		t.Errorf("Expected allowed request, got %s %v", verdict, err)
+	}
+}
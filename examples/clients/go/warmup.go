@@ -0,0 +1,68 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Warmup opens n connections to the ICAP server and sends OPTIONS on each
+// before putting them in the idle pool, so that traffic starts on
+// established connections instead of dialing all at once. n is capped at
+// the pool size, clamped by the Max-Connections of the server when known.
+// It returns the errors of the connections that failed.
+func (c *IcapClient) Warmup(ctx context.Context, n int) error {
+	if limit := c.transport.idleLimit(); n > limit {
+		n = limit
+	}
+
+	request := getBuffer()
+	defer putBuffer(request)
+	c.encodeOptionsRequest(request)
+
+	warmed, err := c.transport.warmup(ctx, n, request.Bytes())
+	c.logger.Info("Connection warm-up completed", "connections", warmed, "requested", n)
+	return err
+}
+
+// encodeOptionsRequest encodes the OPTIONS request used to warm up and
+// keep alive connections
+func (c *IcapClient) encodeOptionsRequest(buf *bytes.Buffer) {
+	config := c.config.Load()
+	c.encodeRequest(buf, OPTIONS, c.buildICAPURL(config, OPTIONS), c.requestHeaders(config, nil), nil)
+}
+
+// warmup dials n connections concurrently, pings each with request and
+// pools the ones that answered
+func (t *icapTransport) warmup(ctx context.Context, n int, request []byte) (int, error) {
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pc, err := t.dialConn(ctx)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to connect to %s: %w", t.addr, err)
+				return
+			}
+			if err := t.ping(ctx, pc, request); err != nil {
+				pc.close(closeReasonError)
+				errs[i] = err
+				return
+			}
+			t.putConn(pc)
+		}(i)
+	}
+	wg.Wait()
+
+	warmed := 0
+	for _, err := range errs {
+		if err == nil {
+			warmed++
+		}
+	}
+	return warmed, errors.Join(errs...)
+}
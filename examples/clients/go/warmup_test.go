@@ -0,0 +1,81 @@
+package icapclient
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ByteDance/Arcus/g3icap/examples/clients/go/icaptest"
+)
+
+// TestIcapClient_Warmup tests that warmed connections are pooled and reused
+func TestIcapClient_Warmup(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	client := newTestServerClient(server, false)
+	defer client.Close()
+
+	// The pool holds 2 connections, so warming up 3 opens 2
+	if err := client.Warmup(context.Background(), 3); err != nil {
+		t.Fatalf("Warmup failed: %v", err)
+	}
+	if conns, requests := server.Stats(); conns != 2 || requests != 2 {
+		t.Errorf("Expected 2 OPTIONS on 2 connections, got %d on %d", requests, conns)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Reqmod(context.Background(), &HttpRequest{Method: "GET", URI: "/", Version: "HTTP/1.1"}); err != nil {
+			t.Fatalf("Reqmod failed: %v", err)
+		}
+	}
+	if conns, _ := server.Stats(); conns != 2 {
+		t.Errorf("Expected requests on warmed connections, got %d connections", conns)
+	}
+}
+
+// TestIcapClient_WarmupOnStart tests the warmup_connections option
+func TestIcapClient_WarmupOnStart(t *testing.T) {
+	server := icaptest.NewServer(icaptest.HandlerFunc(testServerHandler))
+	defer server.Close()
+
+	host, port := server.HostPort()
+	client := NewIcapClient(&IcapConfig{
+		Host:               host,
+		Port:               port,
+		Timeout:            5 * time.Second,
+		ConnectionPoolSize: 4,
+		KeepAlive:          true,
+		WarmupConnections:  3,
+		LoggingLevel:       "ERROR",
+	})
+	defer client.Close()
+
+	if conns, _ := server.Stats(); conns != 3 {
+		t.Errorf("Expected 3 connections after start, got %d", conns)
+	}
+	if n := len(client.transport.idle); n != 3 {
+		t.Errorf("Expected 3 idle connections, got %d", n)
+	}
+}
+
+// TestIcapClient_WarmupFailure tests that warm-up reports unreachable servers
+func TestIcapClient_WarmupFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	client := NewIcapClient(&IcapConfig{Host: addr.IP.String(), Port: addr.Port, Timeout: time.Second, LoggingLevel: "ERROR"})
+	defer client.Close()
+
+	if err := client.Warmup(context.Background(), 2); err == nil {
+		t.Error("Expected an error warming up against a closed port")
+	}
+	if n := len(client.transport.idle); n != 0 {
+		t.Errorf("Expected no idle connections, got %d", n)
+	}
+}